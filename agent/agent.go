@@ -1,8 +1,10 @@
 package agent
 
 import (
+	"crypto/ed25519"
+	"sync/atomic"
+
 	"github.com/labstack/echo"
-	"github.com/labstack/echo/middleware"
 	"github.com/xtfly/gofd/common"
 	"github.com/xtfly/gofd/p2p"
 )
@@ -11,27 +13,94 @@ type Agent struct {
 	common.BaseService
 	// Session管理
 	sessionMgnt *p2p.P2pSessionMgnt
+	// 停止向Server发送心跳
+	quitChan chan struct{}
+	// 信任的签名公钥，配置后只接受签名正确的元数据
+	trustedKeys []ed25519.PublicKey
+	// 升级任务安装了新版本，停止时交接下载中的任务后重启
+	upgraded uint32 // atomic
+	// 通过WithRateLimit指定的总速率，热加载时不使用配置中的值，没有指定时为nil
+	rateLimit *p2p.SpeedLimit
+}
+
+// l为nil时使用seelog。嵌入其它程序时使用New，通过选项设置其它参数
+func NewAgent(cfg *common.Config, l common.Logger) (*Agent, error) {
+	return New(cfg, WithLogger(l))
 }
 
-func NewAgent(cfg *common.Config) (*Agent, error) {
+// 按配置创建Agent，选项优先于配置中的对应项
+func New(cfg *common.Config, opts ...Option) (*Agent, error) {
+	o := newOptions(opts)
+	l := o.log
+	if l == nil {
+		l = common.NewSeelogLogger()
+	}
 	c := &Agent{
-		sessionMgnt: p2p.NewSessionMgnt(cfg),
+		sessionMgnt: p2p.NewSessionMgnt(cfg, l),
+		quitChan:    make(chan struct{}),
+	}
+	c.sessionMgnt.SetUpgrader(c)
+	if cfg.Sign != nil && len(cfg.Sign.PublicKeys) > 0 {
+		keys, err := p2p.ParsePublicKeys(cfg.Sign.PublicKeys)
+		if err != nil {
+			return nil, err
+		}
+		c.trustedKeys = keys
+	}
+	if o.rateLimit != nil {
+		c.rateLimit = o.rateLimit
+		c.sessionMgnt.SetSpeed(c.rateLimit)
 	}
-	c.BaseService = *common.NewBaseService(cfg, cfg.Name, c)
+	c.BaseService = *common.NewBaseService(cfg, cfg.Name, c, l)
 	return c, nil
 }
 
 func (c *Agent) OnStart(cfg *common.Config, e *echo.Echo) error {
 	go func() { c.sessionMgnt.Start() }()
+	// 升级重启前下载中的任务
+	c.sessionMgnt.ResumeHandoff()
 
-	e.Use(middleware.BasicAuth(c.Auth))
+	e.Use(c.AuthMiddleware())
 	e.POST("/api/v1/agent/tasks", c.CreateTask)
 	e.POST("/api/v1/agent/tasks/start", c.StartTask)
+	e.POST("/api/v1/agent/tasks/check", c.CheckTask)
 	e.DELETE("/api/v1/agent/tasks/:id", c.CancelTask)
+	e.POST("/api/v1/agent/speed", c.SetSpeed)
+	e.GET("/api/v1/agent/tasks/:id/progress", c.QueryProgress)
+	e.GET("/api/v1/tasks", c.ListTasks)
+	e.GET("/api/v1/tasks/:id", c.QueryProgress)
+	e.DELETE("/api/v1/tasks/:id", c.CancelTask)
+	e.PATCH("/api/v1/agent/tasks/:id", c.SetTaskLimits)
+	e.PATCH("/api/v1/tasks/:id", c.SetTaskLimits)
+	e.POST("/api/v1/agent/tasks/:id/verify", c.VerifyTask)
+	e.GET("/api/v1/agent/tasks/:id/stream", c.StreamTask)
+	e.POST("/api/v1/agent/tasks/:id/mount", c.MountTask)
+	e.DELETE("/api/v1/agent/tasks/:id/mount", c.UnmountTask)
+	e.GET("/api/v1/agent/tasks/:id/report", c.QueryTransferReport)
+	e.GET("/api/v1/agent/meta/:hash", c.GetMeta)
+	e.GET("/metrics", c.Metrics)
+	e.GET("/api/v1/health", c.Health)
+	e.GET("/api/v1/capabilities", c.Capabilities)
+	e.POST("/api/v1/reload", c.ReloadConfig)
 
+	if len(cfg.Control.Trackers) > 0 {
+		go c.heartbeat()
+	}
 	return nil
 }
 
+// Implements common.Reloader
+func (c *Agent) OnReload(cfg *common.Config) {
+	if c.rateLimit == nil {
+		c.sessionMgnt.SetSpeed(&p2p.SpeedLimit{Upload: cfg.Control.UploadSpeed, Download: cfg.Control.DownloadSpeed})
+	}
+}
+
 func (c *Agent) OnStop(cfg *common.Config, e *echo.Echo) {
-	go func() { c.sessionMgnt.Stop() }()
+	close(c.quitChan)
+	if atomic.LoadUint32(&c.upgraded) == 1 {
+		c.sessionMgnt.Handoff()
+		return
+	}
+	c.sessionMgnt.Stop()
 }
@@ -1,38 +1,158 @@
 package agent
 
 import (
-	log "github.com/cihub/seelog"
+	"io"
+	"net/http"
+	"strconv"
+
 	"github.com/labstack/echo"
+	"github.com/xtfly/gofd/common"
 	"github.com/xtfly/gofd/p2p"
 )
 
 //------------------------------------------
 // POST /api/v1/agent/tasks
 func (svc *Agent) CreateTask(c echo.Context) (err error) {
+	if !svc.IsRunning() {
+		return common.ReplyCode(c, http.StatusServiceUnavailable, "AGENT_STOPPING")
+	}
 	//  获取Body
 	dt := new(p2p.DispatchTask)
 	if err = c.Bind(dt); err != nil {
-		log.Errorf("Recv '%s' request, decode body failed. %v", c.Request().URL(), err)
+		svc.Log.Errorf("Recv '%s' request, decode body failed. %v", c.Request().URL(), err)
 		return
 	}
 
-	log.Infof("[%s] Recv create task request", dt.TaskId)
-	// 暂不检查任务是否重复下发
+	svc.Log.With("taskID", dt.TaskId).Infof("Recv create task request")
+	if code, reason := svc.checkTask(dt); code != 0 {
+		return common.ReplyCode(c, code, reason)
+	}
+	mode := svc.Cfg.Control.Mode
+	if len(dt.Pipe) > 0 {
+		// 按顺序写入命令，写入后的数据不再保存，不给其它节点上传
+		dt.Sequential, mode = true, common.AGENT_MODE_LEECH
+	}
+	// 重复下发的任务替换运行中的任务，从断点续传信息继续下载
 	svc.sessionMgnt.CreateTask(dt)
-	return nil
+	return c.JSON(http.StatusOK, &p2p.CreateTaskRsp{Zone: svc.Cfg.Net.Zone, Mode: mode})
+}
+
+// 接收任务前的检查，不能接收时返回HTTP状态码与错误码，可以接收时code为0
+func (svc *Agent) checkTask(dt *p2p.DispatchTask) (code int, reason string) {
+	var err error
+	switch mode := svc.Cfg.Control.Mode; {
+	case mode == common.AGENT_MODE_SEED && !dt.Seed:
+		svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, agent is in seed mode")
+		return http.StatusForbidden, "AGENT_SEED_ONLY"
+	case mode == common.AGENT_MODE_LEECH && dt.Seed:
+		svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, agent is in leech mode")
+		return http.StatusForbidden, "AGENT_LEECH_ONLY"
+	}
+	if dt.MetaInfo == nil && dt.URI != "" {
+		if dt.MetaInfo, err = resolveTaskURI(svc, dt.URI); err != nil {
+			svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, %v", err)
+			return http.StatusBadRequest, "META_NOT_FOUND"
+		}
+	}
+	if dt.MetaInfo != nil && len(svc.trustedKeys) > 0 {
+		if err = dt.MetaInfo.VerifyAnySignature(svc.trustedKeys); err != nil {
+			svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, %v", err)
+			return http.StatusForbidden, "META_SIGNATURE_INVALID"
+		}
+	}
+	if dt.Upgrade {
+		// 只接受信任的公钥签名的新版本
+		if !svc.Cfg.Control.AllowUpgrade || len(svc.trustedKeys) == 0 {
+			svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, upgrade is not allowed")
+			return http.StatusForbidden, "UPGRADE_NOT_ALLOWED"
+		}
+		if dt.MetaInfo == nil || len(dt.MetaInfo.Files) != 1 || dt.Seed || dt.InMemory || len(dt.Pipe) > 0 {
+			svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, upgrade task must download only one file to disk")
+			return http.StatusBadRequest, "INVALID_UPGRADE_TASK"
+		}
+		if !dt.MetaInfo.Upgrade {
+			// 签名的元数据本身要标记为升级，否则普通任务的元数据可以被当作新版本安装
+			svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, metainfo is not signed for upgrade")
+			return http.StatusForbidden, "INVALID_UPGRADE_TASK"
+		}
+	}
+	if err = p2p.CheckHooks(svc.Cfg, dt.Hooks); err != nil && !dt.Seed {
+		svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, %v", err)
+		return http.StatusForbidden, "HOOK_NOT_ALLOWED"
+	}
+	if err = p2p.CheckPipe(svc.Cfg, dt); err != nil {
+		svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, %v", err)
+		return http.StatusForbidden, "PIPE_NOT_ALLOWED"
+	}
+	if dt.DestDir, err = p2p.ResolveDestDir(svc.Cfg, dt); err != nil {
+		svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, %v", err)
+		return http.StatusForbidden, "DEST_DIR_NOT_ALLOWED"
+	}
+	if dt.MetaInfo != nil && !dt.Seed && dt.InMemory {
+		if err = svc.sessionMgnt.CheckMemoryStore(dt.MetaInfo); err != nil {
+			svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, %v", err)
+			return http.StatusInsufficientStorage, "INSUFFICIENT_MEMORY"
+		}
+	} else if dt.MetaInfo != nil && !dt.Seed && len(dt.Pipe) == 0 {
+		// 使用暂存目录时先下载到暂存目录
+		dir := dt.DestDir
+		if sd := p2p.StagingDir(svc.Cfg, dt); sd != "" {
+			dir = sd
+		}
+		if err = p2p.CheckDiskSpace(svc.Cfg, svc.Log, dt.MetaInfo, dir); err != nil {
+			svc.Log.With("taskID", dt.TaskId).Errorf("Reject task, %v", err)
+			return http.StatusInsufficientStorage, "INSUFFICIENT_DISK_SPACE"
+		}
+	}
+	return 0, ""
+}
+
+func resolveTaskURI(svc *Agent, uri string) (*p2p.MetaInfo, error) {
+	tu, err := p2p.ParseTaskURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	return p2p.ResolveTaskURI(svc.Cfg, svc.Log, tu)
+}
+
+//------------------------------------------
+// POST /api/v1/agent/tasks/check
+// Server试运行创建任务时调用，与创建任务做相同的检查，如下载目录与可用空间，不创建任务
+func (svc *Agent) CheckTask(c echo.Context) (err error) {
+	if !svc.IsRunning() {
+		return common.ReplyCode(c, http.StatusServiceUnavailable, "AGENT_STOPPING")
+	}
+	dt := new(p2p.DispatchTask)
+	if err = c.Bind(dt); err != nil {
+		svc.Log.Errorf("Recv '%s' request, decode body failed. %v", c.Request().URL(), err)
+		return
+	}
+
+	svc.Log.With("taskID", dt.TaskId).Infof("Recv check task request")
+	if code, reason := svc.checkTask(dt); code != 0 {
+		return common.ReplyCode(c, code, reason)
+	}
+	mode := svc.Cfg.Control.Mode
+	if len(dt.Pipe) > 0 {
+		mode = common.AGENT_MODE_LEECH
+	}
+	return c.JSON(http.StatusOK, &p2p.CreateTaskRsp{Zone: svc.Cfg.Net.Zone, Mode: mode})
 }
 
 //------------------------------------------
 // POST /api/v1/agent/tasks/start
 func (svc *Agent) StartTask(c echo.Context) (err error) {
+	if !svc.IsRunning() {
+		return common.ReplyCode(c, http.StatusServiceUnavailable, "AGENT_STOPPING")
+	}
 	//  获取Body
 	st := new(p2p.StartTask)
 	if err = c.Bind(st); err != nil {
-		log.Errorf("Recv '%s' request, decode body failed. %v", c.Request().URL(), err)
+		svc.Log.Errorf("Recv '%s' request, decode body failed. %v", c.Request().URL(), err)
 		return
 	}
 
-	log.Infof("[%s] Recv start task request", st.TaskId)
+	svc.Log.With("taskID", st.TaskId).Infof("Recv start task request")
 	// 暂不检查任务是否重复下发
 	svc.sessionMgnt.StartTask(st)
 	return nil
@@ -40,9 +160,179 @@ func (svc *Agent) StartTask(c echo.Context) (err error) {
 
 //------------------------------------------
 // DELETE /api/v1/agent/tasks/:id
+// DELETE /api/v1/tasks/:id
 func (svc *Agent) CancelTask(c echo.Context) error {
 	id := c.Param("id")
-	log.Infof("[%s] Recv cancel task request", id)
-	svc.sessionMgnt.StopTask(id)
+	clean := c.QueryParam("clean") == "true"
+	svc.Log.With("taskID", id).Infof("Recv cancel task request, clean=%v", clean)
+	svc.sessionMgnt.CancelTask(id, clean)
+	return nil
+}
+
+//------------------------------------------
+// POST /api/v1/agent/speed
+func (svc *Agent) SetSpeed(c echo.Context) (err error) {
+	//  获取Body
+	sl := new(p2p.SpeedLimit)
+	if err = c.Bind(sl); err != nil {
+		svc.Log.Errorf("Recv '%s' request, decode body failed. %v", c.Request().URL(), err)
+		return
+	}
+
+	svc.Log.With("taskID", sl.TaskId).Infof("Recv set speed request")
+	svc.sessionMgnt.SetSpeed(sl)
+	return nil
+}
+
+//------------------------------------------
+// PATCH /api/v1/agent/tasks/:id
+// PATCH /api/v1/tasks/:id
+func (svc *Agent) SetTaskLimits(c echo.Context) (err error) {
+	//  获取Body
+	tl := new(p2p.TaskLimits)
+	if err = c.Bind(tl); err != nil {
+		svc.Log.Errorf("Recv '%s' request, decode body failed. %v", c.Request().URL(), err)
+		return
+	}
+	tl.TaskId = c.Param("id")
+
+	svc.Log.With("taskID", tl.TaskId).Infof("Recv set task limits, %v", tl)
+	if err = tl.Validate(); err != nil {
+		return common.ReplyError(c, http.StatusBadRequest, err)
+	}
+	svc.sessionMgnt.SetLimits(tl)
+	return c.String(http.StatusOK, "")
+}
+
+//------------------------------------------
+// GET /api/v1/agent/tasks/:id/progress
+// GET /api/v1/tasks/:id
+func (svc *Agent) QueryProgress(c echo.Context) error {
+	id := c.Param("id")
+	svc.Log.With("taskID", id).Debugf("Recv query progress request")
+	tp, ok := svc.sessionMgnt.Progress(id)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, "TASK_NOT_EXISTED")
+	}
+	return c.JSON(http.StatusOK, tp)
+}
+
+//------------------------------------------
+// GET /api/v1/tasks
+func (svc *Agent) ListTasks(c echo.Context) error {
+	svc.Log.Debugf("Recv list tasks request")
+	return c.JSON(http.StatusOK, svc.sessionMgnt.Tasks())
+}
+
+//------------------------------------------
+// GET /api/v1/agent/tasks/:id/report
+func (svc *Agent) QueryTransferReport(c echo.Context) error {
+	id := c.Param("id")
+	svc.Log.With("taskID", id).Debugf("Recv query transfer report request")
+	tr, ok := svc.sessionMgnt.TransferReport(id)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, "REPORT_NOT_EXISTED")
+	}
+	return c.JSON(http.StatusOK, tr)
+}
+
+//------------------------------------------
+// POST /api/v1/agent/tasks/:id/verify?repair=true
+func (svc *Agent) VerifyTask(c echo.Context) error {
+	id := c.Param("id")
+	repair := c.QueryParam("repair") == "true"
+	svc.Log.With("taskID", id).Infof("Recv verify task request, repair=%v", repair)
+	vr, err := svc.sessionMgnt.VerifyTask(id, repair)
+	if err != nil {
+		svc.Log.With("taskID", id).Errorf("Verify task failed, error=%v", err)
+		return common.ReplyError(c, http.StatusBadRequest, err)
+	}
+	return c.JSON(http.StatusOK, vr)
+}
+
+//------------------------------------------
+// GET /api/v1/agent/tasks/:id/stream?file=name
+func (svc *Agent) StreamTask(c echo.Context) error {
+	id := c.Param("id")
+	file := c.QueryParam("file")
+	svc.Log.With("taskID", id).Infof("Recv stream task request, file=%s", file)
+	r, err := svc.sessionMgnt.OpenStream(id, file)
+	if err != nil {
+		return common.ReplyError(c, http.StatusBadRequest, err)
+	}
+	defer r.Close()
+
+	c.Response().Header().Set("Content-Type", "application/octet-stream")
+	c.Response().WriteHeader(http.StatusOK)
+	if n, err := io.Copy(c.Response().Writer(), r); err != nil {
+		// 已经发送了响应头，只记录日志
+		svc.Log.With("taskID", id).Errorf("Stream task aborted after %v bytes, error=%v", n, err)
+	}
 	return nil
 }
+
+//------------------------------------------
+// POST /api/v1/agent/tasks/:id/mount?dir=/mnt/gofd/1
+func (svc *Agent) MountTask(c echo.Context) error {
+	id := c.Param("id")
+	dir := c.QueryParam("dir")
+	svc.Log.With("taskID", id).Infof("Recv mount task request, dir=%s", dir)
+	if err := svc.sessionMgnt.Mount(id, dir); err != nil {
+		svc.Log.With("taskID", id).Errorf("Mount task failed, error=%v", err)
+		return common.ReplyError(c, http.StatusBadRequest, err)
+	}
+	return c.String(http.StatusOK, "")
+}
+
+//------------------------------------------
+// DELETE /api/v1/agent/tasks/:id/mount
+func (svc *Agent) UnmountTask(c echo.Context) error {
+	id := c.Param("id")
+	svc.Log.With("taskID", id).Infof("Recv unmount task request")
+	if err := svc.sessionMgnt.Unmount(id); err != nil {
+		return common.ReplyError(c, http.StatusBadRequest, err)
+	}
+	return c.String(http.StatusOK, "")
+}
+
+//------------------------------------------
+// GET /metrics
+func (svc *Agent) Metrics(c echo.Context) error {
+	return c.String(http.StatusOK, svc.sessionMgnt.Metrics().String())
+}
+
+//------------------------------------------
+// GET /api/v1/health
+func (svc *Agent) Health(c echo.Context) error {
+	h := svc.sessionMgnt.Health(!svc.IsRunning())
+	if h.Status == p2p.HEALTH_STOPPING {
+		return c.JSON(http.StatusServiceUnavailable, h)
+	}
+	return c.JSON(http.StatusOK, h)
+}
+
+//------------------------------------------
+// GET /api/v1/capabilities
+func (svc *Agent) Capabilities(c echo.Context) error {
+	return c.JSON(http.StatusOK, svc.sessionMgnt.Capabilities())
+}
+
+//------------------------------------------
+// GET /api/v1/agent/meta/:hash?format=jsonl
+func (svc *Agent) GetMeta(c echo.Context) error {
+	hash := c.Param("hash")
+	svc.Log.Debugf("Recv get metainfo request, infoHash=%s", hash)
+	meta, ok := svc.sessionMgnt.MetaByHash(hash)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, "META_NOT_FOUND")
+	}
+	meta, contentType, err := p2p.MetaResponse(meta, c.QueryParam("format"))
+	if err != nil {
+		return common.ReplyError(c, http.StatusInternalServerError, err)
+	}
+	c.Response().Header().Set("Content-Type", contentType)
+	c.Response().Header().Set("Content-Length", strconv.Itoa(len(meta)))
+	c.Response().WriteHeader(http.StatusOK)
+	_, err = c.Response().Write(meta)
+	return err
+}
@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
+)
+
+// 创建Agent的选项。之后增加的参数只增加选项，New的签名保持不变
+type Option func(*options)
+
+type options struct {
+	log       common.Logger
+	rateLimit *p2p.SpeedLimit
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// 日志，为nil时使用seelog
+func WithLogger(l common.Logger) Option {
+	return func(o *options) { o.log = l }
+}
+
+// 所有任务总的上传与下载速率，Unit: MiBps，0表示不限制。替代配置中的control.uploadSpeed与downloadSpeed，热加载时不再修改
+func WithRateLimit(upload, download int) Option {
+	return func(o *options) { o.rateLimit = &p2p.SpeedLimit{Upload: upload, Download: download} }
+}
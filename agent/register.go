@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 向配置的Server注册，之后定期发送心跳，直到quitChan关闭
+func (c *Agent) heartbeat() {
+	ticker := time.NewTicker(time.Duration(c.Cfg.Control.HeartbeatInterval) * time.Second)
+	defer ticker.Stop()
+
+	registered := make(map[string]bool)
+	for {
+		if body, err := json.Marshal(c.sessionMgnt.Heartbeat()); err == nil {
+			// 每次心跳重新查询SRV记录，Server迁移后自动注册到新的地址
+			for _, addr := range common.ResolveAddrs(c.Cfg.Control.Trackers) {
+				c.sendHeartbeat(addr, body, registered)
+			}
+		}
+		select {
+		case <-c.quitChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 只在注册成功与失败的变化时输出日志
+func (c *Agent) sendHeartbeat(addr string, body []byte, registered map[string]bool) {
+	ok, known := registered[addr]
+	if _, err := common.SendHttpReq(c.Cfg, "POST", addr, "/api/v1/server/agents", body); err != nil {
+		if ok || !known {
+			c.Log.Warnf("Send heartbeat to server %s failed, error=%v", addr, err)
+		}
+		registered[addr] = false
+	} else if !ok {
+		c.Log.Infof("Registered to server %s", addr)
+		registered[addr] = true
+	}
+}
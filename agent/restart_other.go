@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package agent
+
+import (
+	"errors"
+)
+
+// 不支持原地替换进程，退出后由服务管理器重新启动
+func restartSelf() error {
+	return errors.New("Restart in place is not supported")
+}
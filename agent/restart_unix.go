@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// 用新的程序文件替换当前进程，PID不变，监听的端口在exec时关闭
+func restartSelf() error {
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
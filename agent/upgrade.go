@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	UPGRADE_NEW_SUFFIX    = ".new" // 新版本先复制到程序所在目录，再改名替换
+	UPGRADE_BACKUP_SUFFIX = ".old" // 替换前的程序，升级出问题时手工恢复
+
+	// 不能原地重启时以该退出码退出，由服务管理器重新启动
+	UPGRADE_EXIT_CODE = 10
+
+	// 试运行新版本的最长时间
+	upgradeCheckTimeout = 10 * time.Second
+)
+
+// Implements p2p.Upgrader。
+// 文件的每个Piece已按签名的元数据校验，复制到程序所在目录并试运行后原子地替换程序文件
+func (c *Agent) Install(taskId, file string) error {
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+	tmp := exe + UPGRADE_NEW_SUFFIX
+	if err = copyExecutable(file, tmp); err != nil {
+		return fmt.Errorf("Copy %s to %s failed: %v", file, tmp, err)
+	}
+	if err = checkExecutable(tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("New binary can not run: %v", err)
+	}
+	if err = copyExecutable(exe, exe+UPGRADE_BACKUP_SUFFIX); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Backup %s failed: %v", exe, err)
+	}
+	if err = os.Rename(tmp, exe); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	c.Log.With("taskID", taskId).Infof("Installed new binary %s, backup is %s", exe, exe+UPGRADE_BACKUP_SUFFIX)
+	return nil
+}
+
+// Implements p2p.Upgrader。
+// 停止服务，下载中的任务保存后交给新进程继续，然后用新的程序文件重新执行当前的命令行
+func (c *Agent) Restart(taskId string) {
+	go func() {
+		c.Log.With("taskID", taskId).Infof("Restart agent with new binary")
+		atomic.StoreUint32(&c.upgraded, 1)
+		if !c.Stop() {
+			// 已经在停止
+			return
+		}
+		if err := restartSelf(); err != nil {
+			fmt.Printf("restart agent error, %s.\n", err.Error())
+			os.Exit(UPGRADE_EXIT_CODE)
+		}
+	}()
+}
+
+// 当前程序文件的实际路径，是软链接时替换其指向的文件
+func executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+func copyExecutable(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// 不带参数运行时打印用法后退出，能启动即可，排除其它平台或损坏的程序
+func checkExecutable(file string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeCheckTimeout)
+	defer cancel()
+	err := exec.CommandContext(ctx, file).Run()
+	if _, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		// 以非0退出码退出也说明可以运行
+		return nil
+	}
+	return err
+}
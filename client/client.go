@@ -0,0 +1,237 @@
+// 嵌入其它Go服务的gofd客户端，通过Server与Agent的管理接口创建、查询与取消分发任务
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
+	"github.com/xtfly/gofd/server"
+)
+
+const (
+	// 单个请求的默认超时
+	DEFAULT_TIMEOUT = 10 * time.Second
+	// WatchTask默认的查询间隔
+	DEFAULT_WATCH_INTERVAL = time.Second
+)
+
+type (
+	CreateTask   = server.CreateTask
+	TaskInfo     = server.TaskInfo
+	DispatchInfo = server.DispatchInfo
+	TaskFile     = server.TaskFile
+	TaskProgress = p2p.TaskProgress
+	FileCheck    = p2p.FileCheck
+)
+
+type Options struct {
+	Username string
+	Password string
+	Token    string            // Bearer令牌，设置后不使用Basic认证
+	Tls      *common.TlsConfig // 为nil时使用HTTP，Server不要求客户端证书时Cert与Key可以为空
+
+	Timeout       time.Duration // 单个请求的超时，为0时使用DEFAULT_TIMEOUT
+	WatchInterval time.Duration // WatchTask的查询间隔，为0时使用DEFAULT_WATCH_INTERVAL
+}
+
+// 管理接口返回的错误，Reason为响应中的错误码，如TASK_NOT_EXISTED
+type Error struct {
+	StatusCode int
+	Reason     string
+	Message    string // 错误的说明
+	Retriable  bool   // 稍后重试可能成功
+	File       string // 出错的文件
+	Peer       string // 出错的节点地址
+}
+
+func (e *Error) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("Recv http status code %v", e.StatusCode)
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("Recv http status code %v, %s: %s", e.StatusCode, e.Reason, e.Message)
+	}
+	return fmt.Sprintf("Recv http status code %v, %s", e.StatusCode, e.Reason)
+}
+
+// 任务不存在或已被移出Server的缓存
+func IsNotExist(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Reason == server.TaskStatus_TaskNotExist.String()
+}
+
+// 错误码，如AUTH_FAILED、NO_SPACE，不是管理接口返回的错误时为空
+func ErrorCode(err error) string {
+	if e, ok := err.(*Error); ok {
+		return e.Reason
+	}
+	return ""
+}
+
+// 管理接口返回的错误稍后重试可能成功，连接失败或超时也可以重试
+func IsRetriable(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.Retriable
+	}
+	return common.IsRetriable(err)
+}
+
+type Client struct {
+	addr string // Server的管理地址，ip:port
+	opts Options
+	http *http.Client
+}
+
+// addr为Server的管理地址，opts可以为nil
+func New(addr string, opts *Options) (*Client, error) {
+	c := &Client{addr: addr}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Timeout == 0 {
+		c.opts.Timeout = DEFAULT_TIMEOUT
+	}
+	if c.opts.WatchInterval == 0 {
+		c.opts.WatchInterval = DEFAULT_WATCH_INTERVAL
+	}
+
+	tr := &http.Transport{
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 2,
+	}
+	if c.opts.Tls != nil {
+		tc, err := c.opts.Tls.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tc
+	}
+	c.http = &http.Client{Transport: tr, Timeout: c.opts.Timeout}
+	return c, nil
+}
+
+// 创建分发任务，Id为空时由Server生成。重复提交相同的任务返回已有任务的状态
+func (c *Client) CreateTask(ctx context.Context, t *CreateTask) (*TaskInfo, error) {
+	ti := new(TaskInfo)
+	if err := c.do(ctx, "POST", c.addr, "/api/v1/server/tasks", t, ti); err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
+func (c *Client) QueryTask(ctx context.Context, id string) (*TaskInfo, error) {
+	ti := new(TaskInfo)
+	if err := c.do(ctx, "GET", c.addr, "/api/v1/server/tasks/"+url.PathEscape(id), nil, ti); err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
+// 定时查询任务状态，有变化时调用fn，任务结束后返回最后的状态。
+// fn可以为nil；ctx取消时返回ctx的错误
+func (c *Client) WatchTask(ctx context.Context, id string, fn func(*TaskInfo)) (*TaskInfo, error) {
+	tick := time.NewTicker(c.opts.WatchInterval)
+	defer tick.Stop()
+	var last []byte
+	for {
+		ti, err := c.QueryTask(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if bs, _ := json.Marshal(ti); !bytes.Equal(bs, last) {
+			if fn != nil {
+				fn(ti)
+			}
+			last = bs
+		}
+		if Finished(ti) {
+			return ti, nil
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// 任务是否已结束：完成、失败或取消
+func Finished(ti *TaskInfo) bool {
+	switch ti.Status {
+	case server.TaskStatus_Queued.String(), server.TaskStatus_Init.String(), server.TaskStatus_InProgress.String():
+		return false
+	}
+	return true
+}
+
+// 取消任务，clean为true时同时删除Agent上未下载完成的文件
+func (c *Client) CancelTask(ctx context.Context, id string, clean bool) error {
+	urlpath := "/api/v1/server/tasks/" + url.PathEscape(id)
+	if clean {
+		urlpath += "?clean=true"
+	}
+	return c.do(ctx, "DELETE", c.addr, urlpath, nil, nil)
+}
+
+// 查询Agent上任务的下载进度，agentAddr为Agent的管理地址，ip:port
+func (c *Client) AgentStatus(ctx context.Context, agentAddr, id string) (*TaskProgress, error) {
+	tp := new(TaskProgress)
+	if err := c.do(ctx, "GET", agentAddr, "/api/v1/agent/tasks/"+url.PathEscape(id)+"/progress", nil, tp); err != nil {
+		return nil, err
+	}
+	return tp, nil
+}
+
+// req不为nil时编码为JSON请求体，rsp不为nil时解码响应
+func (c *Client) do(ctx context.Context, method, addr, urlpath string, req, rsp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		bs, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(bs)
+	}
+
+	schema := "http"
+	if c.opts.Tls != nil {
+		schema = "https"
+	}
+	hreq, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s://%s%s", schema, addr, urlpath), body)
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if c.opts.Token != "" {
+		hreq.Header.Set("Authorization", common.AUTH_BEARER+" "+c.opts.Token)
+	} else if c.opts.Username != "" {
+		hreq.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+
+	hrsp, err := c.http.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hrsp.Body.Close()
+
+	if hrsp.StatusCode >= 300 {
+		bs, _ := ioutil.ReadAll(io.LimitReader(hrsp.Body, 4096))
+		ae := common.ParseApiError(hrsp.StatusCode, bs)
+		return &Error{StatusCode: hrsp.StatusCode, Reason: ae.Code, Message: ae.Message, Retriable: ae.Retriable,
+			File: ae.File, Peer: ae.Peer}
+	}
+	if rsp == nil {
+		return nil
+	}
+	return json.NewDecoder(hrsp.Body).Decode(rsp)
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 创建Client的选项，修改Options中的对应项
+type Option func(*Options)
+
+// Basic认证的用户名与密码
+func WithBasicAuth(username, password string) Option {
+	return func(o *Options) { o.Username, o.Password = username, password }
+}
+
+// Bearer令牌，设置后不使用Basic认证
+func WithToken(token string) Option {
+	return func(o *Options) { o.Token = token }
+}
+
+// 使用HTTPS访问管理接口
+func WithTLS(tc *common.TlsConfig) Option {
+	return func(o *Options) { o.Tls = tc }
+}
+
+// 单个请求的超时
+func WithTimeout(d time.Duration) Option {
+	return func(o *Options) { o.Timeout = d }
+}
+
+// WatchTask的查询间隔
+func WithWatchInterval(d time.Duration) Option {
+	return func(o *Options) { o.WatchInterval = d }
+}
+
+// addr为Server的管理地址。之后增加的参数只增加选项，NewClient的签名保持不变
+func NewClient(addr string, opts ...Option) (*Client, error) {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return New(addr, o)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
+)
+
+func usage() {
+	fmt.Println("gofd-bench [options]")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// 在本机回环地址上运行一个源头节点与多个下载节点，输出分发的吞吐量、Piece的校验速率与内存分配
+func main() {
+	leechers := flag.Int("n", 4, "number of leechers")
+	files := flag.Int("files", 1, "number of files to dispatch")
+	size := flag.Int64("size", 256, "size of each file in MB")
+	profile := flag.String("profile", "", "profile name: small, balanced or large")
+	pieceLen := flag.Int64("pieceLen", 0, "piece length in bytes, overrides the profile")
+	hash := flag.String("hash", "", "hash algorithm of pieces, overrides the profile")
+	inMemory := flag.Bool("inMemory", false, "leechers keep data in memory instead of writing to disk")
+	transport := flag.String("transport", "", "peer transport between nodes, such as unix, default is tcp")
+	dir := flag.String("dir", "", "directory for generated data and downloads, default is the system temp directory")
+	timeout := flag.Int("timeout", 600, "timeout in seconds, 0 is unlimited")
+	asJSON := flag.Bool("json", false, "print the result as json")
+	verbose := flag.Bool("v", false, "print logs of all nodes to stderr")
+	flag.Usage = usage
+	flag.Parse()
+
+	p := &p2p.Profile{}
+	if *profile != "" {
+		pp, ok := p2p.LookupProfile(*profile)
+		if !ok {
+			fmt.Printf("profile %s not found\n", *profile)
+			os.Exit(2)
+		}
+		*p = *pp
+	}
+	if *pieceLen != 0 {
+		p.PieceLen = *pieceLen
+	}
+	if *hash != "" {
+		p.Hash = *hash
+	}
+
+	opts := &p2p.BenchOptions{
+		Leechers:  *leechers,
+		Files:     *files,
+		FileSize:  *size * 1024 * 1024,
+		Profile:   p,
+		InMemory:  *inMemory,
+		Transport: *transport,
+		Dir:       *dir,
+		Timeout:   time.Duration(*timeout) * time.Second,
+	}
+	if *verbose {
+		opts.Log = common.NewSlogLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	}
+
+	r, err := p2p.RunBench(opts)
+	if err != nil {
+		fmt.Printf("benchmark error, %s.\n", err.Error())
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		bs, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Println(string(bs))
+		return
+	}
+	fmt.Printf("leechers     %d\n", r.Leechers)
+	fmt.Printf("data         %d bytes, %d pieces of %d bytes\n", r.TotalBytes, r.Pieces, r.PieceLen)
+	fmt.Printf("metainfo     %.2f s\n", r.MetaSeconds)
+	fmt.Printf("dispatch     %.2f s, %.2f MB/s in total\n", r.Seconds, r.Throughput)
+	fmt.Printf("leechers     fastest %.2f s, slowest %.2f s\n", r.LeecherSeconds[0], r.LeecherSeconds[len(r.LeecherSeconds)-1])
+	fmt.Printf("verify       %.2f s, %.0f pieces/s, %.2f MB/s by %s\n", r.VerifySeconds, r.VerifyRate, r.HashRate, r.HashImpl)
+	fmt.Printf("allocations  %d, %d bytes, %d gc, %.2f ms paused\n", r.Allocs, r.AllocBytes, r.NumGC, r.GCPauseMs)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	// 没有指定-socket与GOFD_SOCKET环境变量时使用的控制socket
+	DEFAULT_SOCKET = "/var/run/gofd.sock"
+)
+
+func usage() {
+	fmt.Println("gofd-ctl [-socket <path>] [-server] <command> [args]")
+	fmt.Println("commands:")
+	fmt.Println("  health                 query the health of the agent")
+	fmt.Println("  capabilities           query the capabilities of the agent")
+	fmt.Println("  tasks                  list tasks on the node")
+	fmt.Println("  task <id>              query a task on the node")
+	fmt.Println("  cancel [-clean] <id>   cancel a task, -clean removes the unfinished files")
+	fmt.Println("  verify <id>            verify the downloaded files of a task on the agent")
+	fmt.Println("  limits <id> <json>     set the limits of a running task, such as '{\"upload\":2}'")
+	fmt.Println("  reload                 reload the config file")
+	fmt.Println("  metrics                print the prometheus metrics")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// 通过本机的控制socket调用Server或Agent的管理接口，不需要用户名与密码
+func main() {
+	socket := flag.String("socket", "", "control socket of the node, default is $GOFD_SOCKET or "+DEFAULT_SOCKET)
+	server := flag.Bool("server", false, "the socket belongs to a server instead of an agent")
+	timeout := flag.Int("timeout", 30, "timeout of the request in seconds")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("miss command")
+		usage()
+	}
+	if *socket == "" {
+		if *socket = os.Getenv("GOFD_SOCKET"); *socket == "" {
+			*socket = DEFAULT_SOCKET
+		}
+	}
+	c := newCtl(*socket, time.Duration(*timeout)*time.Second)
+
+	args := flag.Args()[1:]
+	id := func() string {
+		if len(args) < 1 {
+			fmt.Println("miss task id")
+			usage()
+		}
+		return url.PathEscape(args[0])
+	}
+	switch flag.Arg(0) {
+	case "health":
+		c.call("GET", "/api/v1/health", nil)
+	case "capabilities":
+		c.call("GET", "/api/v1/capabilities", nil)
+	case "tasks":
+		c.call("GET", "/api/v1/tasks", nil)
+	case "task":
+		c.call("GET", "/api/v1/tasks/"+id(), nil)
+	case "cancel":
+		fs := flag.NewFlagSet("cancel", flag.ExitOnError)
+		clean := fs.Bool("clean", false, "remove the unfinished files")
+		fs.Parse(args)
+		args = fs.Args()
+		prefix := "/api/v1/agent/tasks/"
+		if *server {
+			prefix = "/api/v1/server/tasks/"
+		}
+		c.call("DELETE", fmt.Sprintf("%s%s?clean=%v", prefix, id(), *clean), nil)
+	case "verify":
+		c.call("POST", "/api/v1/agent/tasks/"+id()+"/verify", nil)
+	case "limits":
+		if len(args) < 2 {
+			fmt.Println("miss limits")
+			usage()
+		}
+		c.call("PATCH", "/api/v1/tasks/"+id(), []byte(args[1]))
+	case "reload":
+		c.call("POST", "/api/v1/reload", nil)
+	case "metrics":
+		c.call("GET", "/metrics", nil)
+	default:
+		fmt.Printf("unknown command %s\n", flag.Arg(0))
+		usage()
+	}
+}
+
+type ctl struct {
+	socket string
+	http   *http.Client
+}
+
+func newCtl(socket string, timeout time.Duration) *ctl {
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &ctl{socket: socket, http: &http.Client{Transport: tr, Timeout: timeout}}
+}
+
+// 调用管理接口并输出响应，JSON响应格式化后输出。失败时以非0退出
+func (c *ctl) call(method, urlpath string, body []byte) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	// 主机名不参与连接，只用于组成URL
+	req, err := http.NewRequest(method, "http://gofd"+urlpath, rd)
+	if err != nil {
+		fmt.Printf("create request error, %s.\n", err.Error())
+		os.Exit(3)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rsp, err := c.http.Do(req)
+	if err != nil {
+		fmt.Printf("request %s error, %s.\n", c.socket, err.Error())
+		os.Exit(4)
+	}
+	defer rsp.Body.Close()
+	bs, _ := ioutil.ReadAll(rsp.Body)
+
+	var out bytes.Buffer
+	if json.Indent(&out, bs, "", "  ") == nil {
+		bs = out.Bytes()
+	}
+	if len(bytes.TrimSpace(bs)) > 0 {
+		fmt.Println(string(bytes.TrimSpace(bs)))
+	}
+	if rsp.StatusCode >= 300 {
+		fmt.Printf("http status code %v\n", rsp.StatusCode)
+		os.Exit(1)
+	}
+}
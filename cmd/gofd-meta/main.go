@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/xtfly/gofd/p2p"
+)
+
+const (
+	FORMAT_JSON    = "json"
+	FORMAT_TORRENT = "torrent"
+)
+
+func usage() {
+	fmt.Println("gofd-meta create [options] <path>...")
+	fmt.Println("gofd-meta verify [options] <metafile> <dir>")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("miss command")
+		usage()
+	}
+	switch os.Args[1] {
+	case "create":
+		create(os.Args[2:])
+	case "verify":
+		verify(os.Args[2:])
+	default:
+		fmt.Printf("unknown command %s\n", os.Args[1])
+		usage()
+	}
+}
+
+// 为文件或目录创建元数据，写入JSON或.torrent文件
+func create(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	out := fs.String("o", "", "write the metainfo to the file, default is stdout")
+	format := fs.String("format", FORMAT_JSON, "output format, json or torrent (bencode)")
+	profile := fs.String("profile", "", "profile name: small, balanced or large")
+	pieceLen := fs.Int64("pieceLen", 0, "piece length in bytes, a power of 2 not less than 16KB, default is chosen by the total size")
+	hash := fs.String("hash", "", "hash algorithm of pieces and files, overrides the profile")
+	skipSums := fs.Bool("skipSums", false, "not compute the whole file sums, files are read only once")
+	sums := fs.String("sums", "", "a json file of precomputed file sums in hex, keyed by file path")
+	dedup := fs.Bool("dedup", false, "dispatch files with the same content only once")
+	keepLinks := fs.Bool("keepLinks", false, "keep relative symlinks inside directories")
+	announce := fs.String("announce", "", "comma separated tracker urls written to the torrent")
+	name := fs.String("name", "", "directory name in the torrent when files have no common top directory")
+	quiet := fs.Bool("q", false, "not print the progress to stderr")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fmt.Println("miss path")
+		usage()
+	}
+	if *format != FORMAT_JSON && *format != FORMAT_TORRENT {
+		fmt.Printf("unknown format %s\n", *format)
+		os.Exit(2)
+	}
+
+	p := &p2p.Profile{}
+	if *profile != "" {
+		pp, ok := p2p.LookupProfile(*profile)
+		if !ok {
+			fmt.Printf("profile %s not found\n", *profile)
+			os.Exit(2)
+		}
+		*p = *pp
+	}
+	if *pieceLen != 0 {
+		p.PieceLen = *pieceLen
+	}
+	if *hash != "" {
+		p.Hash = *hash
+	}
+
+	opts := &p2p.CreateOptions{Profile: p, SkipFileSums: *skipSums, DedupFiles: *dedup, KeepLinks: *keepLinks}
+	if *sums != "" {
+		bs, err := ioutil.ReadFile(*sums)
+		if err == nil {
+			err = json.Unmarshal(bs, &opts.FileSums)
+		}
+		if err != nil {
+			fmt.Printf("read sums file %s error, %s.\n", *sums, err.Error())
+			os.Exit(3)
+		}
+	}
+	if !*quiet {
+		opts.Progress = printProgress
+	}
+
+	mi, err := p2p.CreateFileMetaWithOptions(fs.Args(), opts)
+	if err != nil {
+		fmt.Printf("create metainfo error, %s.\n", err.Error())
+		os.Exit(4)
+	}
+
+	var bs []byte
+	if *format == FORMAT_TORRENT {
+		to := &p2p.TorrentOptions{Name: *name}
+		if *announce != "" {
+			to.Announce = strings.Split(*announce, ",")
+		}
+		bs, err = mi.MarshalTorrent(to)
+	} else {
+		bs, err = json.MarshalIndent(mi, "", "  ")
+	}
+	if err != nil {
+		fmt.Printf("encode metainfo error, %s.\n", err.Error())
+		os.Exit(4)
+	}
+
+	if *out == "" {
+		os.Stdout.Write(bs)
+		return
+	}
+	if err = ioutil.WriteFile(*out, bs, 0644); err != nil {
+		fmt.Printf("write metainfo to %s error, %s.\n", *out, err.Error())
+		os.Exit(4)
+	}
+}
+
+func printProgress(p *p2p.MetaProgress) {
+	percent := 100.0
+	if p.Total > 0 {
+		percent = float64(p.Done) * 100 / float64(p.Total)
+	}
+	fmt.Fprintf(os.Stderr, "\r%-8s %6.2f%% %d/%d bytes", p.Phase, percent, p.Done, p.Total)
+	if p.Done == p.Total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// 按元数据校验目录中的文件，有损坏的Piece时以1退出
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	memory := fs.Int64("memory", 0, "memory budget in MB to verify pieces in parallel, 0 is unlimited")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fmt.Println("miss metafile or dir")
+		usage()
+	}
+
+	mi, err := readMeta(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("read metainfo %s error, %s.\n", fs.Arg(0), err.Error())
+		os.Exit(3)
+	}
+	vr, err := p2p.VerifyDir(mi, fs.Arg(1), *memory*1024*1024)
+	if err != nil {
+		fmt.Printf("verify %s error, %s.\n", fs.Arg(1), err.Error())
+		os.Exit(4)
+	}
+	for _, r := range vr.BadRanges {
+		fmt.Printf("corrupt %s offset=%d length=%d\n", r.File, r.Offset, r.Length)
+	}
+	fmt.Printf("pieces total %d, bad %d\n", vr.PiecesTotal, len(vr.BadPieces))
+	if len(vr.BadPieces) > 0 {
+		os.Exit(1)
+	}
+}
+
+// 按内容区分JSON与.torrent文件
+func readMeta(file string) (*p2p.MetaInfo, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(bs), []byte("{")) {
+		mi := new(p2p.MetaInfo)
+		if err = json.Unmarshal(bs, mi); err != nil {
+			return nil, err
+		}
+		return mi, nil
+	}
+	mi, _, err := p2p.UnmarshalTorrent(bs)
+	return mi, err
+}
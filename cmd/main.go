@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/xtfly/gofd/agent"
 	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
 	"github.com/xtfly/gofd/server"
 	"github.com/xtfly/gokits"
 )
@@ -16,29 +18,45 @@ var (
 	a = flag.Bool("a", false, "start as a agent")
 	s = flag.Bool("s", false, "start as a server")
 	p = flag.String("p", "", "create a password encrypted by AES128")
+	f = flag.String("f", "", "encrypt with the factor in config file, used with -p or -k")
+	k = flag.Bool("k", false, "create a ed25519 key pair to sign metainfo, the private key is encrypted by AES128")
 )
 
 func usage() {
-	fmt.Println("gofd [<-a|-s> <configfile>] [-p <passwd>]")
+	fmt.Println("gofd [<-a|-s> <configfile>] [-p <passwd> [-f <factor>]] [-k [-f <factor>]]")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
 
 func main() {
 	flag.Parse()
-	if !*a && !*s && *p == "" {
+	if !*a && !*s && *p == "" && !*k {
 		fmt.Println("miss option")
 		usage()
 	}
 
-	if *p != "" {
-		factor := gokits.NewRand(8)
+	if *p != "" || *k {
+		factor := *f
+		if factor == "" {
+			factor = gokits.NewRand(8)
+		}
 		crc := gokits.KermitStr(factor)
 		crypto, _ := gokits.NewCrypto(factor, crc)
-		stxt, _ := crypto.EncryptStr(*p)
 		fmt.Println("factor =", factor)
 		fmt.Println("crc =", crc)
-		fmt.Println("stxt =", stxt)
+		if *p != "" {
+			stxt, _ := crypto.EncryptStr(*p)
+			fmt.Println("stxt =", stxt)
+			return
+		}
+		priv, pub, err := p2p.GenerateSignKey()
+		if err != nil {
+			fmt.Printf("create key pair error, %s.\n", err.Error())
+			os.Exit(1)
+		}
+		stxt, _ := crypto.EncryptStr(priv)
+		fmt.Println("privateKey =", stxt)
+		fmt.Println("publicKey =", pub)
 		return
 	}
 
@@ -55,16 +73,17 @@ func main() {
 		os.Exit(3)
 	}
 
+	logger := common.NewLogger(cfg)
 	var svc common.Service
 	if *s {
-		if svc, err = server.NewServer(cfg); err != nil {
+		if svc, err = server.New(cfg, server.WithLogger(logger)); err != nil {
 			fmt.Printf("start server error, %s.\n", err.Error())
 			os.Exit(4)
 		}
 	}
 
 	if *a {
-		if svc, err = agent.NewAgent(cfg); err != nil {
+		if svc, err = agent.New(cfg, agent.WithLogger(logger)); err != nil {
 			fmt.Printf("start agent error, %s.\n", err.Error())
 			os.Exit(4)
 		}
@@ -76,15 +95,32 @@ func main() {
 	}
 
 	quitChan := listenSigInt()
-	select {
-	case <-quitChan:
-		fmt.Printf("got control-C")
-		svc.Stop()
+	// SIGHUP时重新加载配置
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	for {
+		select {
+		case <-hupChan:
+			if changed, err := svc.Reload(); err != nil {
+				fmt.Printf("reload config error, %s.\n", err.Error())
+			} else {
+				fmt.Printf("reloaded config, changed %v\n", changed)
+			}
+		case sig := <-quitChan:
+			fmt.Printf("got signal %v, stopping...\n", sig)
+			// 再次收到信号时直接退出
+			go func() {
+				<-quitChan
+				os.Exit(5)
+			}()
+			svc.Stop()
+			return
+		}
 	}
 }
 
 func listenSigInt() chan os.Signal {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	return c
 }
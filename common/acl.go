@@ -0,0 +1,75 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+)
+
+// 多个团队共用Server时，按令牌文件中的客户端限制任务的创建。配置了acls时，没有规则的令牌客户端不能创建任务；
+// 使用Basic认证的节点账号不受限制。只有服务端才配置
+type AclRule struct {
+	Client string     `yaml:"client"`           // 令牌文件中的client
+	Agents []string   `yaml:"agents,omitempty"` // 可以作为目的节点与种子节点的Agent，IP或网段，为空时不限制
+	Paths  []*AclPath `yaml:"paths,omitempty"`  // 按Agent限制任务的下载目录，为空时不限制
+
+	agents []*net.IPNet
+}
+
+// 匹配的Agent上，任务需要指定destDir，并且在其中一个前缀之下。多条匹配时合并所有前缀
+type AclPath struct {
+	Agents   []string `yaml:"agents,omitempty"` // IP或网段，为空时匹配所有Agent
+	Prefixes []string `yaml:"prefixes"`         // 允许的下载目录前缀，绝对路径
+
+	agents []*net.IPNet
+}
+
+func (r *AclRule) parse() (err error) {
+	if r.Client == "" {
+		return fmt.Errorf("Not set client in acls")
+	}
+	if r.agents, err = parseIPNets(r.Agents); err != nil {
+		return fmt.Errorf("Invalid agent %v in acl of client %s", err, r.Client)
+	}
+	for _, p := range r.Paths {
+		if p.agents, err = parseIPNets(p.Agents); err != nil {
+			return fmt.Errorf("Invalid agent %v in acl of client %s", err, r.Client)
+		}
+		if len(p.Prefixes) == 0 {
+			return fmt.Errorf("Not set prefixes in acl paths of client %s", r.Client)
+		}
+		for _, prefix := range p.Prefixes {
+			if !path.IsAbs(filepath.ToSlash(prefix)) {
+				return fmt.Errorf("Path prefix %s in acl of client %s is not an absolute path", prefix, r.Client)
+			}
+		}
+	}
+	return nil
+}
+
+// 客户端的规则，没有配置时返回nil
+func (c *Config) AclFor(client string) *AclRule {
+	for _, r := range c.Acls {
+		if r.Client == client {
+			return r
+		}
+	}
+	return nil
+}
+
+// 是否可以向该Agent下发任务
+func (r *AclRule) AllowAgent(ip string) bool {
+	return matchIPNets(r.agents, StripPort(ip))
+}
+
+// 该Agent上允许的下载目录前缀，返回nil时不限制
+func (r *AclRule) PathPrefixes(ip string) (prefixes []string) {
+	ip = StripPort(ip)
+	for _, p := range r.Paths {
+		if matchIPNets(p.agents, ip) {
+			prefixes = append(prefixes, p.Prefixes...)
+		}
+	}
+	return
+}
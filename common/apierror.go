@@ -0,0 +1,183 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/labstack/echo"
+)
+
+// 通用的错误码，自动化可以按错误码区分失败的类型，不需要解析错误信息。
+// 各接口特有的错误码，如TASK_NOT_EXISTED，直接使用字符串
+const (
+	ERR_NO_SPACE          = "NO_SPACE"          // 磁盘空间不足
+	ERR_PERMISSION_DENIED = "PERMISSION_DENIED" // 没有文件或目录的权限
+	ERR_FILE_NOT_FOUND    = "FILE_NOT_FOUND"    // 文件或目录不存在
+	ERR_AUTH_FAILED       = "AUTH_FAILED"       // 认证失败
+	ERR_PEER_UNREACHABLE  = "PEER_UNREACHABLE"  // 连接Peer、Agent或Server失败
+	ERR_TIMEOUT           = "TIMEOUT"           // 操作超时
+	ERR_CANCELED          = "CANCELED"          // 操作被取消
+	ERR_INVALID_REQUEST   = "INVALID_REQUEST"   // 请求的参数不正确
+	ERR_INTERNAL          = "INTERNAL_ERROR"    // 没有对应错误码的其它错误
+)
+
+// 稍后重试可能成功的错误码
+var retriableCodes = map[string]bool{
+	ERR_PEER_UNREACHABLE:  true,
+	ERR_TIMEOUT:           true,
+	"AGENT_STOPPING":      true,
+	"SERVER_STANDBY":      true,
+	"SAVE_CATALOG_FAILED": true,
+	"LOAD_HISTORY_FAILED": true,
+}
+
+// 管理接口返回的错误，以JSON作为响应体。Agent内部的错误也按错误码上报给Server
+type ApiError struct {
+	Status    int    `json:"-"`                 // HTTP状态码
+	Code      string `json:"code"`              // 错误码，如NO_SPACE、AUTH_FAILED、PEER_UNREACHABLE
+	Message   string `json:"message,omitempty"` // 错误的说明，不作为判断的依据
+	Retriable bool   `json:"retriable"`         // 稍后重试可能成功
+	File      string `json:"file,omitempty"`    // 出错的文件
+	Peer      string `json:"peer,omitempty"`    // 出错的Peer或节点地址
+}
+
+func NewApiError(status int, code string) *ApiError {
+	return &ApiError{Status: status, Code: code, Retriable: retriableCodes[code]}
+}
+
+func (e *ApiError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+// 内部的错误转换为ApiError，带上错误信息与出错的文件或地址
+func ToApiError(status int, err error) *ApiError {
+	var ae *ApiError
+	if errors.As(err, &ae) {
+		return ae
+	}
+	ae = NewApiError(status, ErrorCode(err))
+	ae.Message = err.Error()
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		ae.File = pe.Path
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Addr != nil {
+		ae.Peer = oe.Addr.String()
+	}
+	return ae
+}
+
+// 其它包的错误对应的错误码
+var errorCodes = struct {
+	sync.RWMutex
+	m map[error]string
+}{m: make(map[error]string)}
+
+// 注册预定义错误对应的错误码，在init中调用
+func RegisterErrorCode(err error, code string) {
+	errorCodes.Lock()
+	defer errorCodes.Unlock()
+	errorCodes.m[err] = code
+}
+
+// 错误对应的错误码，不能识别时为INTERNAL_ERROR
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var ae *ApiError
+	if errors.As(err, &ae) {
+		return ae.Code
+	}
+	errorCodes.RLock()
+	for e, code := range errorCodes.m {
+		if errors.Is(err, e) {
+			errorCodes.RUnlock()
+			return code
+		}
+	}
+	errorCodes.RUnlock()
+
+	var ne net.Error
+	var oe *net.OpError
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return ERR_NO_SPACE
+	case errors.Is(err, os.ErrPermission):
+		return ERR_PERMISSION_DENIED
+	case errors.Is(err, os.ErrNotExist):
+		return ERR_FILE_NOT_FOUND
+	case errors.Is(err, context.Canceled):
+		return ERR_CANCELED
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return ERR_TIMEOUT
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.As(err, &oe) && oe.Op == "dial":
+		return ERR_PEER_UNREACHABLE
+	}
+	return ERR_INTERNAL
+}
+
+// 错误是否稍后重试可能成功
+func IsRetriable(err error) bool {
+	var ae *ApiError
+	if errors.As(err, &ae) {
+		return ae.Retriable
+	}
+	return retriableCodes[ErrorCode(err)]
+}
+
+// 解析管理接口返回的错误，旧版本的响应体只有错误码，没有错误码时按HTTP状态码
+func ParseApiError(status int, body []byte) *ApiError {
+	body = bytes.TrimSpace(body)
+	ae := &ApiError{}
+	if len(body) > 0 && body[0] == '{' && json.Unmarshal(body, ae) == nil {
+		ae.Status = status
+	} else {
+		ae = NewApiError(status, string(body))
+	}
+	if ae.Code == "" {
+		ae.Code = statusCode(status)
+		ae.Retriable = retriableCodes[ae.Code]
+	}
+	return ae
+}
+
+func statusCode(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return ERR_AUTH_FAILED
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return ERR_TIMEOUT
+	case status == http.StatusBadGateway || status == http.StatusServiceUnavailable:
+		return ERR_PEER_UNREACHABLE
+	case status >= http.StatusInternalServerError:
+		return ERR_INTERNAL
+	}
+	return ERR_INVALID_REQUEST
+}
+
+// 以错误码返回失败的响应
+func ReplyCode(c echo.Context, status int, code string) error {
+	return c.JSON(status, NewApiError(status, code))
+}
+
+// 以错误返回失败的响应，没有对应错误码的错误使用INVALID_REQUEST
+func ReplyError(c echo.Context, status int, err error) error {
+	ae := *ToApiError(status, err)
+	if ae.Code == ERR_INTERNAL && status < http.StatusInternalServerError {
+		ae.Code = ERR_INVALID_REQUEST
+	}
+	return c.JSON(status, &ae)
+}
@@ -0,0 +1,276 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/xtfly/gokits"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	AUTH_BEARER = "Bearer"
+	AUTH_HMAC   = "HMAC-SHA256"
+	// 签名请求的时间戳与本地时间允许的最大偏差
+	MAX_SIGN_SKEW = 5 * time.Minute
+)
+
+// 调用管理接口的客户端令牌。同一个客户端可以配置多个令牌，
+// 轮换时先增加新令牌，客户端切换后再删除旧令牌或设置过期时间
+type Token struct {
+	Client string `yaml:"client"`
+	Token  string `yaml:"token"`            // 与auth.passowrd一样加密保存
+	Expire string `yaml:"expire,omitempty"` // RFC3339格式，过期后不能再使用
+
+	expire time.Time
+}
+
+func (t *Token) expired(now time.Time) bool {
+	return !t.expire.IsZero() && now.After(t.expire)
+}
+
+// 令牌文件更新后自动重新加载，不需要重启服务
+type tokenStore struct {
+	file   string
+	crypto *gokits.Crypto
+	log    Logger
+
+	mu       sync.Mutex
+	tokens   []*Token
+	modTime  time.Time
+	checkAt  time.Time
+	interval time.Duration
+}
+
+func newTokenStore(cfg *Config, l Logger) (*tokenStore, error) {
+	t := &tokenStore{file: cfg.Auth.TokenFile, crypto: cfg.Crypto, log: l, interval: 10 * time.Second}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tokenStore) reload() error {
+	st, err := os.Stat(t.file)
+	if err != nil {
+		return err
+	}
+	bs, err := ioutil.ReadFile(t.file)
+	if err != nil {
+		return err
+	}
+	var tokens []*Token
+	if err := yaml.Unmarshal(bs, &tokens); err != nil {
+		return err
+	}
+	for _, tk := range tokens {
+		if tk.Client == "" || tk.Token == "" {
+			return fmt.Errorf("Not set client or token in %s", t.file)
+		}
+		if tk.Token, err = t.crypto.DecryptStr(tk.Token); err != nil {
+			return fmt.Errorf("Decrypt token of client %s failed: %v", tk.Client, err)
+		}
+		if tk.Expire != "" {
+			if tk.expire, err = time.Parse(time.RFC3339, tk.Expire); err != nil {
+				return fmt.Errorf("Invalid expire of client %s: %v", tk.Client, err)
+			}
+		}
+	}
+	t.tokens, t.modTime = tokens, st.ModTime()
+	return nil
+}
+
+// 配置重新加载时立即重新加载令牌文件
+func (t *tokenStore) forceReload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.checkAt = time.Now().Add(t.interval)
+	return t.reload()
+}
+
+// 定时检查令牌文件的修改时间，加载失败时继续使用旧的令牌
+func (t *tokenStore) list() []*Token {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now := time.Now(); now.After(t.checkAt) {
+		t.checkAt = now.Add(t.interval)
+		if st, err := os.Stat(t.file); err == nil && !st.ModTime().Equal(t.modTime) {
+			if err := t.reload(); err != nil {
+				t.log.Errorf("Reload tokens %s failed, error=%v", t.file, err)
+			} else {
+				t.log.Infof("Reloaded tokens %s", t.file)
+			}
+		}
+	}
+	return t.tokens
+}
+
+// 返回令牌所属的客户端
+func (t *tokenStore) bearer(token string) (string, bool) {
+	now := time.Now()
+	for _, tk := range t.list() {
+		if !tk.expired(now) && secureEqual(tk.Token, token) {
+			return tk.Client, true
+		}
+	}
+	return "", false
+}
+
+// 客户端的任一有效令牌签名正确即可，轮换期间新旧令牌都能使用
+func (t *tokenStore) verify(client string, payload, signature []byte) bool {
+	now := time.Now()
+	for _, tk := range t.list() {
+		if tk.Client != client || tk.expired(now) {
+			continue
+		}
+		if hmac.Equal(signPayload(tk.Token, payload), signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// 待签名的内容：方法、请求URI、时间戳与请求体的SHA256，以换行分隔
+func signingPayload(method, uri, timestamp string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(method + "\n" + uri + "\n" + timestamp + "\n" + hex.EncodeToString(sum[:]))
+}
+
+func signPayload(token string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// 为请求生成HMAC签名的认证头，供调用管理接口的Go客户端使用
+func SignRequest(req *http.Request, client, token string, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := signPayload(token, signingPayload(req.Method, req.URL.RequestURI(), ts, body))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Client=%s, Timestamp=%s, Signature=%s",
+		AUTH_HMAC, client, ts, hex.EncodeToString(sig)))
+}
+
+// 解析 Client=xx, Timestamp=xx, Signature=xx
+func parseSignParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if i := strings.Index(kv, "="); i > 0 {
+			params[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+		}
+	}
+	return params
+}
+
+// 管理接口的认证：节点之间使用Basic认证，其它客户端使用Bearer令牌或HMAC签名
+func (s *BaseService) AuthMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			client, err := s.authenticate(c)
+			if err != nil {
+				req := c.Request()
+				s.Log.Warnf("Reject request %s %s from %s, error=%v", req.Method(), req.URL().Path(), req.RemoteAddress(), err)
+				c.Response().Header().Set("WWW-Authenticate", `Basic realm="gofd"`)
+				return ReplyCode(c, http.StatusUnauthorized, ERR_AUTH_FAILED)
+			}
+			c.Set("client", client)
+			return next(c)
+		}
+	}
+}
+
+func (s *BaseService) authenticate(c echo.Context) (string, error) {
+	if isControlRequest(c) {
+		// 能连接控制socket即有socket文件的权限，作为节点之间的账号
+		return s.Cfg.Auth.Username, nil
+	}
+	auth := c.Request().Header().Get("Authorization")
+	if scheme, cred := splitAuthorization(auth); scheme == AUTH_HMAC && s.tokens != nil {
+		return s.verifySigned(c, parseSignParams(cred))
+	}
+	return s.AuthenticateHeader(auth)
+}
+
+func splitAuthorization(auth string) (scheme, cred string) {
+	scheme = auth
+	if i := strings.IndexByte(auth, ' '); i > 0 {
+		scheme, cred = auth[:i], strings.TrimSpace(auth[i+1:])
+	}
+	return
+}
+
+// 校验Basic认证或Bearer令牌，返回调用方。HMAC签名需要请求体，只有HTTP接口支持
+func (s *BaseService) AuthenticateHeader(auth string) (string, error) {
+	scheme, cred := splitAuthorization(auth)
+	switch scheme {
+	case "":
+		return "", errors.New("No authorization header")
+	case "Basic":
+		bs, err := base64.StdEncoding.DecodeString(cred)
+		if err != nil {
+			return "", err
+		}
+		up := strings.SplitN(string(bs), ":", 2)
+		if len(up) != 2 || !s.Auth(up[0], up[1]) {
+			return "", errors.New("Invalid username or password")
+		}
+		return up[0], nil
+	}
+
+	if s.tokens == nil {
+		return "", fmt.Errorf("Not support authorization %s", scheme)
+	}
+	switch scheme {
+	case AUTH_BEARER:
+		if client, ok := s.tokens.bearer(cred); ok {
+			return client, nil
+		}
+		return "", errors.New("Invalid or expired token")
+	}
+	return "", fmt.Errorf("Not support authorization %s", scheme)
+}
+
+func (s *BaseService) verifySigned(c echo.Context, params map[string]string) (string, error) {
+	client, ts := params["Client"], params["Timestamp"]
+	sig, err := hex.DecodeString(params["Signature"])
+	if client == "" || ts == "" || err != nil {
+		return "", errors.New("Invalid signature parameters")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Invalid timestamp %s", ts)
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > MAX_SIGN_SKEW || skew < -MAX_SIGN_SKEW {
+		return "", fmt.Errorf("Timestamp %s out of range", ts)
+	}
+
+	// 读出请求体计算摘要后放回，后续的处理还需要读取
+	req := c.Request()
+	body, err := ioutil.ReadAll(req.Body())
+	if err != nil {
+		return "", err
+	}
+	req.SetBody(bytes.NewReader(body))
+
+	if !s.tokens.verify(client, signingPayload(req.Method(), req.URI(), ts, body), sig) {
+		return "", fmt.Errorf("Invalid signature of client %s", client)
+	}
+	return client, nil
+}
@@ -1,12 +1,14 @@
 package common
 
 import (
+	"crypto/tls"
 	"errors"
-	"fmt"
+	"net"
 	"sync/atomic"
 
 	log "github.com/cihub/seelog"
 	"github.com/labstack/echo"
+	"github.com/labstack/echo/engine"
 	"github.com/labstack/echo/engine/standard"
 )
 
@@ -16,6 +18,7 @@ type Service interface {
 	OnStart(c *Config, e *echo.Echo) error
 	OnStop(c *Config, e *echo.Echo)
 	IsRunning() bool
+	Reload() ([]string, error)
 }
 
 type BaseService struct {
@@ -24,47 +27,61 @@ type BaseService struct {
 	Cfg     *Config
 	echo    *echo.Echo
 	svc     Service
+	tokens  *tokenStore  // 未配置令牌文件时为nil
+	control net.Listener // 控制socket，未配置时为nil
+	Log     Logger
 }
 
-func NewBaseService(cfg *Config, name string, svc Service) *BaseService {
+// l为nil时使用seelog
+func NewBaseService(cfg *Config, name string, svc Service, l Logger) *BaseService {
+	if l == nil {
+		l = NewSeelogLogger()
+	}
+	defaultLogger = l
 	return &BaseService{
 		name:    name,
 		running: 0,
 		Cfg:     cfg,
 		echo:    echo.New(),
 		svc:     svc,
+		Log:     l,
 	}
 }
 
 // init log by config
 func (s *BaseService) initlog() {
-	if s.Cfg.Log != "" {
-		if logger, err := log.LoggerFromConfigAsFile(s.Cfg.Log); err == nil {
-			log.ReplaceLogger(logger)
-		}
-	}
+	s.loadSeelog()
 
 	// init echo log
-	s.echo.SetLogger(NewEchoLogger())
+	s.echo.SetLogger(NewEchoLogger(s.Log))
 }
 
 func (s *BaseService) runEcho() error {
-	net := s.Cfg.Net
-	var sr *standard.Server
-	if net.Tls != nil {
-		sr = standard.WithTLS(fmt.Sprintf("%s:%v", net.IP, net.MgntPort),
-			net.Tls.Cert,
-			net.Tls.Key,
-		)
-	} else {
-		sr = standard.New(fmt.Sprintf("%s:%v", net.IP, net.MgntPort))
+	addr := JoinHostPort(s.Cfg.Net.IP, s.Cfg.Net.MgntPort)
+	// 自己创建Listener，支持IPv6与双栈监听
+	ln, err := net.Listen(s.Cfg.ListenNetwork(), addr)
+	if err != nil {
+		s.Log.Errorf("Listen %s failed, error=%v", addr, err)
+		return err
+	}
+	if tlsCfg := s.Cfg.Net.Tls; tlsCfg != nil {
+		// 支持双向认证与证书更新后重新加载
+		tc, err := tlsCfg.ServerConfig()
+		if err != nil {
+			ln.Close()
+			s.Log.Errorf("Load tls config failed, error=%v", err)
+			return err
+		}
+		tc.NextProtos = []string{"http/1.1"}
+		ln = tls.NewListener(ln, tc)
 	}
+	sr := standard.WithConfig(engine.Config{Address: addr, Listener: ln})
 	sr.SetHandler(s.echo)
 	sr.SetLogger(s.echo.Logger())
 
-	log.Infof("Starting http server %s:%v", net.IP, net.MgntPort)
+	s.Log.Infof("Starting http server %s", addr)
 	if err := sr.Start(); err != nil {
-		log.Infof("Start http server %s:%v failed %v", net.IP, net.MgntPort, err)
+		s.Log.Infof("Start http server %s failed %v", addr, err)
 		return err
 	}
 	return nil
@@ -73,10 +90,29 @@ func (s *BaseService) runEcho() error {
 func (s *BaseService) Start() error {
 	if atomic.CompareAndSwapUint32(&s.running, 0, 1) {
 		s.initlog()
-		log.Infof("Starting %s", s.name)
+		s.Log.Infof("Starting %s", s.name)
+		if s.Cfg.Auth.TokenFile != "" {
+			tokens, err := newTokenStore(s.Cfg, s.Log)
+			if err != nil {
+				atomic.StoreUint32(&s.running, 0)
+				s.Log.Errorf("Load tokens %s failed, error=%v", s.Cfg.Auth.TokenFile, err)
+				return err
+			}
+			s.tokens = tokens
+		}
+		if err := InitTracing(s.Cfg, s.name); err != nil {
+			atomic.StoreUint32(&s.running, 0)
+			s.Log.Errorf("Init tracing failed, error=%v", err)
+			return err
+		}
 		if err := s.svc.OnStart(s.Cfg, s.echo); err != nil {
 			return err
 		}
+		if s.Cfg.Net.ControlSocket != "" {
+			if err := s.runControlSocket(); err != nil {
+				return err
+			}
+		}
 		go s.runEcho()
 		return nil
 	} else {
@@ -88,8 +124,11 @@ func (s *BaseService) OnStart(c *Config, e *echo.Echo) error { return nil }
 
 func (s *BaseService) Stop() bool {
 	if atomic.CompareAndSwapUint32(&s.running, 1, 0) {
-		log.Infof("Stopping %s", s.name)
+		s.Log.Infof("Stopping %s", s.name)
 		s.svc.OnStop(s.Cfg, s.echo)
+		s.closeControlSocket()
+		ShutdownTracing()
+		log.Flush()
 		return true
 	} else {
 		return false
@@ -105,8 +144,5 @@ func (s *BaseService) IsRunning() bool {
 }
 
 func (s *BaseService) Auth(u, p string) bool {
-	if u == s.Cfg.Auth.Username && p == s.Cfg.Auth.Passowrd {
-		return true
-	}
-	return false
+	return secureEqual(u, s.Cfg.Auth.Username) && secureEqual(p, s.Cfg.Auth.Passowrd)
 }
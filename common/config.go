@@ -4,24 +4,43 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/xtfly/gokits"
 
 	"gopkg.in/yaml.v2"
 )
 
+// Agent的运行模式
+const (
+	AGENT_MODE_SEED  = "seed"  // 只接收种子任务，给其它节点上传，不下载
+	AGENT_MODE_LEECH = "leech" // 只下载，不接受其它节点的数据连接
+)
+
+// Agent位于NAT之后时映射数据端口的协议
+const (
+	NAT_UPNP = "upnp"   // UPnP IGD
+	NAT_PMP  = "natpmp" // NAT-PMP
+	NAT_AUTO = "auto"   // 依次尝试UPnP与NAT-PMP
+)
+
 // 定义配置映射的结构体
 type Config struct {
 	Server bool //是否为服务端
 	Crypto *gokits.Crypto
+	File   string `yaml:"-"` // 配置文件的路径，重新加载时使用
 
 	Name string `yaml:"name"`
 
 	DownDir string `yaml:"downdir,omitempty"` //只有客户端才配置
 
-	Log string `yaml:"log"`
+	Log       string `yaml:"log"`
+	LogFormat string `yaml:"logFormat,omitempty"` // json时以JSON格式输出结构化日志到标准输出，不使用log配置的seelog
+	LogLevel  string `yaml:"logLevel,omitempty"`  // logFormat为json时的日志级别，debug、info、warn或error，默认info
 
 	Net struct {
 		IP       string `yaml:"ip"`
@@ -31,10 +50,32 @@ type Config struct {
 		AgentMgntPort int `yaml:"agentMgntPort,omitempty"`
 		AgentDataPort int `yaml:"agentDataPort,omitempty"`
 
-		Tls *struct {
-			Cert string `yaml:"cert"`
-			Key  string `yaml:"key"`
-		} `yaml:"tls,omitempty"`
+		Tls *TlsConfig `yaml:"tls,omitempty"`
+
+		Interface     string `yaml:"interface,omitempty"`     // 没有配置ip时使用该网卡的地址，管理端口监听该地址，Agent以该地址注册
+		DataIP        string `yaml:"dataIP,omitempty"`        // 数据端口与中继端口监听的地址，连接其它节点时使用该源地址，默认与ip相同
+		DataInterface string `yaml:"dataInterface,omitempty"` // 没有配置dataIP时使用该网卡的地址
+		Advertise     string `yaml:"advertise,omitempty"`     // 其它节点连接本节点数据端口使用的地址，默认为dataIP，用于数据网卡与管理网卡分开的主机
+
+		Proxies []*ProxyConfig `yaml:"proxies,omitempty"` // 按目的地址的网段选择代理，按顺序使用第一个匹配的，没有匹配时直接连接
+
+		DualStack bool   `yaml:"dualStack,omitempty"` // ip为0.0.0.0或::时同时监听IPv4与IPv6
+		Transport string `yaml:"transport,omitempty"` // 节点之间数据连接的传输方式，默认tcp，可选quic、unix或通过p2p.RegisterTransport注册的名称
+		SocketDir string `yaml:"socketDir,omitempty"` // transport为unix时socket文件所在的目录，按数据端口命名，默认为系统临时目录
+		Zone      string `yaml:"zone,omitempty"`      // 所在的机房或机架，优先从同一zone的节点下载
+		Nat       string `yaml:"nat,omitempty"`       // 位于NAT之后时自动映射数据端口，upnp、natpmp或auto，并向Server上报外部地址，只有客户端才配置
+		Relay     string `yaml:"relay,omitempty"`     // 不能接收入站连接时，通过该中继地址接收其它节点的数据连接，只有客户端才配置
+		RelayPort int    `yaml:"relayPort,omitempty"` // 为不能接收入站连接的节点中继数据连接的端口，0表示不中继
+
+		Labels map[string]string `yaml:"labels,omitempty"` // Agent注册时上报，创建任务时按标签选择Agent，如role: web
+
+		GrpcPort int `yaml:"grpcPort,omitempty"` // gRPC管理接口的端口，需要使用 -tags grpc 编译，只有服务端才配置
+
+		AnnouncePort int `yaml:"announcePort,omitempty"` // 接收Agent通过UDP上报任务状态的端口，Agent失败时使用HTTP，0表示只使用HTTP，只有服务端才配置
+
+		ControlSocket string `yaml:"controlSocket,omitempty"` // 本机的unix socket路径，同时在其上提供管理接口，由文件权限控制访问，不需要认证，供gofd-ctl使用
+
+		PeerIdleTimeout int `yaml:"peerIdleTimeout,omitempty"` // Unit: Second, 任务结束后保留节点之间的数据连接供后续任务复用，超时没有复用时关闭，0表示不保留
 	} `yaml:"net"`
 
 	Auth struct {
@@ -42,15 +83,144 @@ type Config struct {
 		Passowrd string `yaml:"passowrd"`
 		Factor   string `yaml:"factor"`
 		Crc      string `yaml:"crc"`
+
+		TokenFile string `yaml:"tokenFile,omitempty"` // 可选，管理接口的客户端令牌，修改后自动重新加载
 	} `yaml:"auth"`
 
 	Control *Control `yaml:"control"`
+
+	S3 *S3Config `yaml:"s3,omitempty"`
+
+	Sign *SignConfig `yaml:"sign,omitempty"`
+
+	Ha *HaConfig `yaml:"ha,omitempty"`
+
+	Trace *TraceConfig `yaml:"trace,omitempty"`
+
+	Acls []*AclRule `yaml:"acls,omitempty"`
+
+	Namespaces []*Namespace `yaml:"namespaces,omitempty"`
+}
+
+// 两个Server组成主备，主Server把运行中的任务同步给备Server，备Server超时没有收到同步时接管任务。
+// 只有服务端才配置，两个Server需要能读取相同路径的分发文件
+type HaConfig struct {
+	Peer            string `yaml:"peer"`                      // 另一个Server的管理地址，如10.0.0.2:45000
+	Standby         bool   `yaml:"standby,omitempty"`         // 启动时作为备Server，主Server启动时另一个Server已是主Server则作为备Server
+	SyncInterval    int    `yaml:"syncInterval,omitempty"`    // Unit: Second, 主Server同步任务的间隔，默认2
+	FailoverTimeout int    `yaml:"failoverTimeout,omitempty"` // Unit: Second, 备Server超过该时间没有收到同步时接管，默认10
+}
+
+// 元数据的ed25519签名，防止被篡改的Server向Agent下发伪造的文件列表
+type SignConfig struct {
+	PrivateKey string   `yaml:"privateKey,omitempty"` // base64编码的私钥种子，与auth.passowrd一样加密保存，只有服务端才配置，创建元数据时签名
+	PublicKeys []string `yaml:"publicKeys,omitempty"` // base64编码的公钥，只有客户端才配置，只接受其中任一公钥签名的元数据
+}
+
+// S3兼容的对象存储，服务端可直接分发其中的对象，客户端可把下载完成的文件上传
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`         // 如 https://s3.amazonaws.com 或 http://minio:9000
+	Region    string `yaml:"region,omitempty"` // 默认us-east-1
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`          // 与auth.passowrd一样加密保存
+	UploadTo  string `yaml:"uploadTo,omitempty"` // 如 s3://bucket/prefix，只有客户端才配置，下载完成后上传文件
 }
 
 type Control struct {
-	Speed     int `yaml:"speed"` // Unit: MiBps
-	MaxActive int `yaml:"maxActive"`
-	CacheSize int `yaml:"cacheSize"` // Unit: MiB
+	Speed     int    `yaml:"speed"` // Unit: MiBps, 每个任务的上传速率
+	MaxActive int    `yaml:"maxActive"`
+	CacheSize int    `yaml:"cacheSize"`          // Unit: MiB
+	Profile   string `yaml:"profile,omitempty"`  // 创建元数据所用的分发模板，只有服务端才配置
+	PieceLen  int64  `yaml:"pieceLen,omitempty"` // Unit: Byte, 默认的Piece长度，覆盖分发模板中的配置，只有服务端才配置
+
+	PieceCountLog2 int   `yaml:"pieceCountLog2,omitempty"` // 自动选择Piece长度时的目标Piece个数为2的该次幂，覆盖分发模板中的配置，只有服务端才配置
+	MaxPieceLen    int64 `yaml:"maxPieceLen,omitempty"`    // Unit: Byte, Piece长度的上限，覆盖分发模板中的配置，只有服务端才配置
+	BundleSize     int64 `yaml:"bundleSize,omitempty"`     // Unit: Byte, 长度小于该值的连续文件打包传输，覆盖分发模板中的配置，只有服务端才配置
+
+	VerifyReads  bool `yaml:"verifyReads,omitempty"`  // 发送块之前校验所在Piece的摘要
+	Mmap         bool `yaml:"mmap,omitempty"`         // 服务端使用内存映射读取分发的文件，不支持的平台使用read
+	VerifyMemory int  `yaml:"verifyMemory,omitempty"` // Unit: MiB, 并行校验已下载Piece的内存上限，0表示不限制
+
+	MaxPieceRetries int `yaml:"maxPieceRetries,omitempty"` // 一个Piece校验失败的最大次数，超过后不再下载，0表示不限制
+	MaxUploadPeers  int `yaml:"maxUploadPeers,omitempty"`  // 每个任务同时上传的Peer数，0表示不限制
+	WriteBuffer     int `yaml:"writeBuffer,omitempty"`     // Unit: MiB, 每个任务延迟写入磁盘的缓冲大小，0表示直接写入
+	RequestWindow   int `yaml:"requestWindow,omitempty"`   // 向每个Peer同时发送的未完成块请求数，高延迟的链路可以调大，默认16
+	RequestTimeout  int `yaml:"requestTimeout,omitempty"`  // Unit: Second, 块请求的超时，超时后从其它Peer重新请求，默认30
+	MinPeerSpeed    int `yaml:"minPeerSpeed,omitempty"`    // Unit: KiBps, 从上游Peer下载的速率低于该值时取消其请求，由其它Peer下载，0表示不检查
+
+	AdaptiveBlock bool `yaml:"adaptiveBlock,omitempty"` // 按每个Peer请求的往返时间在8KiB到128KiB之间调整块大小，默认固定为32KiB
+	Pex           bool `yaml:"pex,omitempty"`           // 与已连接的Agent交换任务的上游节点，Server不可用时仍可以连接其它Agent
+
+	Webhooks []string `yaml:"webhooks,omitempty"` // 任务事件的回调地址，只有服务端才配置
+
+	UploadSpeed   int `yaml:"uploadSpeed,omitempty"`   // Unit: MiBps, 所有任务总的上传速率，0表示不限制
+	DownloadSpeed int `yaml:"downloadSpeed,omitempty"` // Unit: MiBps, 所有任务总的下载速率，0表示不限制
+
+	BandwidthSchedule *BandwidthSchedule `yaml:"bandwidthSchedule,omitempty"` // 按时间段限制所有任务总的速率，不在时间段内时使用uploadSpeed与downloadSpeed
+
+	FairShare        bool `yaml:"fairShare,omitempty"`        // 总速率有限制时在同时运行的任务间公平分配，用不完的速率由其它任务使用
+	MaxConns         int  `yaml:"maxConns,omitempty"`         // 所有任务总的Peer连接数，达到后拒绝其它Peer的接入，0表示不限制
+	MaxTaskConns     int  `yaml:"maxTaskConns,omitempty"`     // 每个任务的Peer连接数，达到后拒绝其它Peer的接入，0表示不限制
+	MaxOpenFiles     int  `yaml:"maxOpenFiles,omitempty"`     // 所有任务读写数据时同时打开的文件数，0表示不限制
+	MaxTaskOpenFiles int  `yaml:"maxTaskOpenFiles,omitempty"` // 每个任务读写数据时同时打开的文件数，0表示不限制
+
+	DrainTimeout int `yaml:"drainTimeout,omitempty"` // Unit: Second, 退出时等待任务保存状态的最长时间，默认30
+	DiskReserve  int `yaml:"diskReserve,omitempty"`  // Unit: MiB, 接收任务时下载目录需要额外保留的可用空间
+	MemoryStore  int `yaml:"memoryStore,omitempty"`  // Unit: MiB, 只在内存中保存的任务总共可以使用的空间，0表示不接收这类任务
+	PieceCache   int `yaml:"pieceCache,omitempty"`   // Unit: MiB, 服务端与种子节点按Piece缓存发送块时读取的数据，按最近使用淘汰，0表示不缓存
+	BufferPool   int `yaml:"bufferPool,omitempty"`   // Unit: MiB, 所有任务读写块与Piece时复用的空闲缓冲的上限，默认64，负数表示不复用
+
+	RetryAttempts int `yaml:"retryAttempts,omitempty"` // 连接同一地址失败、同一Peer请求超时的最大次数，超过后连接上一个节点，默认10
+	RetryBackoff  int `yaml:"retryBackoff,omitempty"`  // Unit: Millisecond, 第一次重试的等待时间，之后每次翻倍，最长30秒，默认100
+	RetryJitter   int `yaml:"retryJitter,omitempty"`   // Unit: Percent, 等待时间随机增减的比例，默认20
+	BadPeerPieces int `yaml:"badPeerPieces,omitempty"` // Peer发送的坏Piece达到该个数后断开并不再连接，默认2
+
+	ZoneBridges int `yaml:"zoneBridges,omitempty"` // 每个zone中从其它zone下载的Agent数，只有服务端才配置，默认1
+
+	HookCommands []string `yaml:"hookCommands,omitempty"` // 任务钩子允许执行的命令，与命令的第一个参数完全匹配，只有客户端才配置
+	HookURLs     []string `yaml:"hookURLs,omitempty"`     // 任务钩子允许调用的地址，协议、主机与端口相同且路径在其之下，只有客户端才配置
+	HookTimeout  int      `yaml:"hookTimeout,omitempty"`  // Unit: Second, 每个钩子执行的最长时间，默认300
+
+	DestDirs  []string `yaml:"destDirs,omitempty"`  // 任务指定下载目录时，允许的目录及其子目录，只有客户端才配置
+	MountDirs []string `yaml:"mountDirs,omitempty"` // 只读挂载任务文件时，允许的挂载点及其子目录，需要使用 -tags fuse 编译，只有客户端才配置
+
+	StagingDir   string `yaml:"stagingDir,omitempty"`   // 任务先下载到该目录下以任务ID命名的目录，全部Piece校验通过后再放到下载目录，只有客户端才配置
+	ContentStore string `yaml:"contentStore,omitempty"` // 校验通过的文件按摘要保存到该目录，之后的任务中摘要相同的文件直接链接，不再下载，只有客户端才配置
+
+	PartialSuffix string `yaml:"partialSuffix,omitempty"` // 下载中的文件名加上该后缀，如.partial，文件校验通过后改名，只有客户端才配置
+	PartialDir    string `yaml:"partialDir,omitempty"`    // 下载中的文件写入下载目录中该相对目录下的相同路径，如.gofd-tmp，文件校验通过后改名，只有客户端才配置
+
+	AllowUpgrade bool `yaml:"allowUpgrade,omitempty"` // 接受Server下发的升级任务，下载完成后替换Agent的程序文件并重启，需要配置sign.publicKeys，只有客户端才配置
+
+	Trackers          []string `yaml:"trackers,omitempty"`          // Server的管理地址，Agent启动后注册并定期发送心跳，可以为srv://开头的SRV记录，只有客户端才配置
+	HeartbeatInterval int      `yaml:"heartbeatInterval,omitempty"` // Unit: Second, Agent发送心跳的间隔，默认10
+	AgentTimeout      int      `yaml:"agentTimeout,omitempty"`      // Unit: Second, 超过该时间没有心跳的Agent不再下发任务，只有服务端才配置，默认30
+
+	TaskRetention int `yaml:"taskRetention,omitempty"` // Unit: Second, 结束的任务保留的时间，期间重复提交返回任务的状态，只有服务端才配置，默认300
+	TaskTtl       int `yaml:"taskTtl,omitempty"`       // Unit: Second, 任务提交后的最长时间，超过后失败并删除Agent上未完成的文件，0表示不限制。Agent上为收到任务后的最长时间
+	StallTimeout  int `yaml:"stallTimeout,omitempty"`  // Unit: Second, 运行中的任务所有Agent的进度在该时间内都没有增长时失败，0表示不检查，只有服务端才配置
+
+	CatalogFile string `yaml:"catalogFile,omitempty"` // 保存任务模板与制品目录的文件，不配置时只保存在内存中，只有服务端才配置
+	ImportDir   string `yaml:"importDir,omitempty"`   // 导入的制品归档解压到该目录下的name/version目录，不配置时不能导入，只有服务端才配置
+
+	HistoryStore     string `yaml:"historyStore,omitempty"`     // 保存已结束任务的存储，bolt，或使用 -tags sqlite 编译时的sqlite，为空时不保存，只有服务端才配置
+	HistoryPath      string `yaml:"historyPath,omitempty"`      // 存储的文件，默认history.db，只有服务端才配置
+	HistoryRetention int    `yaml:"historyRetention,omitempty"` // Unit: Day, 已结束任务保存的时间，0表示不按时间清理，只有服务端才配置
+	HistoryMaxTasks  int    `yaml:"historyMaxTasks,omitempty"`  // 最多保存的任务数，超过时删除最早结束的任务，0表示不限制，只有服务端才配置
+
+	SeedLinger int `yaml:"seedLinger,omitempty"` // Unit: Second, 下载完成后继续给其它节点上传的时间，只有客户端才配置，默认180
+
+	Mode string `yaml:"mode,omitempty"` // Agent的运行模式，seed只作为种子节点上传，leech只下载不给其它节点上传，为空时两者都可以，只有客户端才配置
+
+	RelaySpeed int `yaml:"relaySpeed,omitempty"` // Unit: MiBps, 配置了relayPort时所有中继连接总的速率，0表示不限制
+
+	MaxCPU    int `yaml:"maxCPU,omitempty"`    // Unit: Percent, 主机CPU使用率超过时暂停块的传输，0表示不检查，只有客户端才配置
+	MaxDiskIO int `yaml:"maxDiskIO,omitempty"` // Unit: Percent, 下载目录所在磁盘的IO利用率超过时暂停块的传输，0表示不检查，只有客户端才配置
+	MaxMemory int `yaml:"maxMemory,omitempty"` // Unit: MiB, 进程用于缓冲的堆内存超过时暂停块的传输，0表示不检查，只有客户端才配置
+
+	IOClass    string `yaml:"ioClass,omitempty"`    // 读写任务数据的IO调度类，besteffort或idle，为空时不调整，只在Linux上生效
+	IOPriority int    `yaml:"ioPriority,omitempty"` // ioClass为besteffort时的优先级，1到7，数值越大优先级越低，默认7
+	Nice       int    `yaml:"nice,omitempty"`       // 读写任务数据的线程的nice值，1到19，0表示不调整，只在Linux上生效
 }
 
 func normalFile(dir string) string {
@@ -80,9 +250,42 @@ func (c *Config) defaultValue() {
 		c.Log = normalFile(c.Log)
 	}
 
+	if c.Auth.TokenFile != "" {
+		c.Auth.TokenFile = normalFile(c.Auth.TokenFile)
+	}
+
+	if c.Control != nil && c.Control.CatalogFile != "" {
+		c.Control.CatalogFile = normalFile(c.Control.CatalogFile)
+	}
+	if c.Control != nil && c.Control.ImportDir != "" {
+		c.Control.ImportDir = normalFile(c.Control.ImportDir)
+	}
+
+	if c.Control != nil && c.Control.StagingDir != "" {
+		c.Control.StagingDir = normalFile(c.Control.StagingDir)
+	}
+
+	if c.Control != nil && c.Control.ContentStore != "" {
+		c.Control.ContentStore = normalFile(c.Control.ContentStore)
+	}
+
+	if c.Control != nil && c.Control.HistoryStore != "" {
+		if c.Control.HistoryPath == "" {
+			c.Control.HistoryPath = "history.db"
+		}
+		c.Control.HistoryPath = normalFile(c.Control.HistoryPath)
+	}
+
+	if c.Net.ControlSocket != "" {
+		c.Net.ControlSocket = normalFile(c.Net.ControlSocket)
+	}
+
 	if c.Net.Tls != nil {
 		c.Net.Tls.Cert = normalFile(c.Net.Tls.Cert)
 		c.Net.Tls.Key = normalFile(c.Net.Tls.Key)
+		if c.Net.Tls.CA != "" {
+			c.Net.Tls.CA = normalFile(c.Net.Tls.CA)
+		}
 	}
 
 	if c.Control == nil {
@@ -98,6 +301,61 @@ func (c *Config) defaultValue() {
 	if c.Control.CacheSize == 0 {
 		c.Control.CacheSize = 25
 	}
+	if c.Control.BufferPool == 0 {
+		c.Control.BufferPool = 64
+	}
+	if c.Control.DrainTimeout == 0 {
+		c.Control.DrainTimeout = 30
+	}
+	if c.Control.RetryAttempts == 0 {
+		c.Control.RetryAttempts = 10
+	}
+	if c.Control.RetryBackoff == 0 {
+		c.Control.RetryBackoff = 100
+	}
+	if c.Control.RetryJitter == 0 {
+		c.Control.RetryJitter = 20
+	}
+	if c.Control.BadPeerPieces == 0 {
+		c.Control.BadPeerPieces = 2
+	}
+	if c.Control.ZoneBridges == 0 {
+		c.Control.ZoneBridges = 1
+	}
+	if c.Control.HookTimeout == 0 {
+		c.Control.HookTimeout = 300
+	}
+	if c.Control.HeartbeatInterval == 0 {
+		c.Control.HeartbeatInterval = 10
+	}
+	if c.Control.AgentTimeout == 0 {
+		c.Control.AgentTimeout = 30
+	}
+	if c.Control.RequestWindow == 0 {
+		c.Control.RequestWindow = 16
+	}
+	if c.Control.RequestTimeout == 0 {
+		c.Control.RequestTimeout = 30
+	}
+	if c.Control.TaskRetention == 0 {
+		c.Control.TaskRetention = 300
+	}
+	if c.Control.SeedLinger == 0 {
+		c.Control.SeedLinger = 180
+	}
+
+	if c.Ha != nil {
+		if c.Ha.SyncInterval == 0 {
+			c.Ha.SyncInterval = 2
+		}
+		if c.Ha.FailoverTimeout == 0 {
+			c.Ha.FailoverTimeout = 10
+		}
+	}
+
+	if c.Trace != nil && c.Trace.SampleRatio == 0 {
+		c.Trace.SampleRatio = 1
+	}
 }
 
 func (c *Config) validate() error {
@@ -114,6 +372,97 @@ func (c *Config) validate() error {
 		if c.DownDir == "" {
 			return errors.New("Not set DownDir in client config file")
 		}
+		// 元数据中的文件只能写入下载目录之下，不能是整个文件系统
+		if d := filepath.Clean(c.DownDir); d == string(filepath.Separator) || d == filepath.VolumeName(d)+string(filepath.Separator) {
+			return errors.New("DownDir can not be the root directory in client config file")
+		}
+	}
+
+	switch c.Control.Mode {
+	case "", AGENT_MODE_SEED, AGENT_MODE_LEECH:
+		if c.Server && c.Control.Mode != "" {
+			return errors.New("Control.Mode is only for client config file")
+		}
+	default:
+		return fmt.Errorf("Invalid Control.Mode %s in config file", c.Control.Mode)
+	}
+
+	switch c.Control.IOClass {
+	case "", "besteffort", "idle":
+	default:
+		return fmt.Errorf("Invalid Control.IOClass %s in config file", c.Control.IOClass)
+	}
+	if c.Control.Nice < 0 || c.Control.Nice > 19 {
+		return fmt.Errorf("Invalid Control.Nice %d in config file", c.Control.Nice)
+	}
+
+	if !c.Server && c.Control.HistoryStore != "" {
+		return errors.New("Control.HistoryStore is only for server config file")
+	}
+	if !c.Server && c.Control.StallTimeout != 0 {
+		return errors.New("Control.StallTimeout is only for server config file")
+	}
+	if c.Control.TaskTtl < 0 || c.Control.StallTimeout < 0 {
+		return errors.New("Invalid Control.TaskTtl or Control.StallTimeout in config file")
+	}
+	if c.Control.RequestTimeout < 0 || c.Control.MinPeerSpeed < 0 {
+		return errors.New("Invalid Control.RequestTimeout or Control.MinPeerSpeed in config file")
+	}
+	if !c.Server && c.Control.ImportDir != "" {
+		return errors.New("Control.ImportDir is only for server config file")
+	}
+	if c.Server && c.Control.StagingDir != "" {
+		return errors.New("Control.StagingDir is only for client config file")
+	}
+	if c.Server && c.Control.ContentStore != "" {
+		return errors.New("Control.ContentStore is only for client config file")
+	}
+	if c.Server && (c.Control.PartialSuffix != "" || c.Control.PartialDir != "") {
+		return errors.New("Control.PartialSuffix and Control.PartialDir are only for client config file")
+	}
+	if strings.ContainsAny(c.Control.PartialSuffix, "/\\\x00") {
+		return errors.New("Invalid Control.PartialSuffix in config file")
+	}
+	if d := c.Control.PartialDir; d != "" && (filepath.IsAbs(d) || d != filepath.Clean(d) || d == "." || d == ".." ||
+		strings.HasPrefix(d, ".."+string(filepath.Separator))) {
+		return errors.New("Invalid Control.PartialDir in config file, must be a relative directory inside downdir")
+	}
+	if c.Server && c.Control.AllowUpgrade {
+		return errors.New("Control.AllowUpgrade is only for client config file")
+	}
+	if c.Control.AllowUpgrade && (c.Sign == nil || len(c.Sign.PublicKeys) == 0) {
+		return errors.New("Control.AllowUpgrade requires Sign.PublicKeys in config file")
+	}
+
+	switch c.Net.Nat {
+	case "", NAT_UPNP, NAT_PMP, NAT_AUTO:
+		if c.Server && c.Net.Nat != "" {
+			return errors.New("Net.Nat is only for client config file")
+		}
+	default:
+		return fmt.Errorf("Invalid Net.Nat %s in config file", c.Net.Nat)
+	}
+
+	if c.Server && c.Net.Relay != "" {
+		return errors.New("Net.Relay is only for client config file")
+	}
+	if c.Net.Relay != "" && c.Net.Nat != "" {
+		return errors.New("Net.Relay and Net.Nat can not be both set")
+	}
+	if !c.Server && c.Net.AnnouncePort != 0 {
+		return errors.New("Net.AnnouncePort is only for server config file")
+	}
+
+	if c.Control.BandwidthSchedule != nil {
+		if err := c.Control.BandwidthSchedule.parse(); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range c.Net.Proxies {
+		if err := p.parse(); err != nil {
+			return err
+		}
 	}
 
 	if c.Auth.Username == "" || c.Auth.Passowrd == "" || c.Auth.Factor == "" || c.Auth.Crc == "" {
@@ -130,6 +479,67 @@ func (c *Config) validate() error {
 		return err
 	}
 
+	if c.S3 != nil {
+		if u, err := url.Parse(c.S3.Endpoint); err != nil || u.Host == "" {
+			return fmt.Errorf("Invalid s3 endpoint %s in config file", c.S3.Endpoint)
+		}
+		if c.S3.SecretKey, err = c.Crypto.DecryptStr(c.S3.SecretKey); err != nil {
+			return err
+		}
+	}
+
+	if c.Sign != nil && c.Sign.PrivateKey != "" {
+		if c.Sign.PrivateKey, err = c.Crypto.DecryptStr(c.Sign.PrivateKey); err != nil {
+			return err
+		}
+	}
+
+	if c.Ha != nil {
+		if !c.Server {
+			return errors.New("Ha is only for server config file")
+		}
+		if _, _, err := net.SplitHostPort(c.Ha.Peer); err != nil {
+			return fmt.Errorf("Invalid ha peer %s in config file", c.Ha.Peer)
+		}
+		if c.Ha.FailoverTimeout <= c.Ha.SyncInterval {
+			return errors.New("Ha.FailoverTimeout should be greater than Ha.SyncInterval")
+		}
+	}
+
+	if len(c.Acls) > 0 && !c.Server {
+		return errors.New("Acls is only for server config file")
+	}
+	for _, r := range c.Acls {
+		if err := r.parse(); err != nil {
+			return err
+		}
+	}
+
+	if len(c.Namespaces) > 0 && !c.Server {
+		return errors.New("Namespaces is only for server config file")
+	}
+	names := make(map[string]bool, len(c.Namespaces))
+	for _, n := range c.Namespaces {
+		if err := n.parse(); err != nil {
+			return err
+		}
+		if names[n.Name] {
+			return fmt.Errorf("Duplicate namespace %s in config file", n.Name)
+		}
+		names[n.Name] = true
+	}
+
+	if c.Trace != nil {
+		switch c.Trace.Exporter {
+		case TRACE_EXPORTER_OTLP_GRPC, TRACE_EXPORTER_OTLP_HTTP, TRACE_EXPORTER_STDOUT:
+		default:
+			return fmt.Errorf("Invalid trace exporter %s in config file", c.Trace.Exporter)
+		}
+		if c.Trace.SampleRatio < 0 || c.Trace.SampleRatio > 1 {
+			return errors.New("Trace.SampleRatio should be between 0 and 1")
+		}
+	}
+
 	return nil
 }
 
@@ -140,15 +550,26 @@ func ParserConfig(cfgfile string, server bool) (*Config, error) {
 	} else {
 		cfg := new(Config)
 		cfg.Server = server
+		cfg.File = ncfg
 		if err := yaml.Unmarshal(bs, cfg); err != nil {
 			return nil, err
 		}
 
-		if err := cfg.validate(); err != nil {
+		if err := cfg.Init(); err != nil {
 			return nil, err
 		}
-
-		cfg.defaultValue()
 		return cfg, nil
 	}
 }
+
+// 校验配置并设置默认值，不从配置文件读取的配置（如进程内的基准测试）需要调用
+func (c *Config) Init() error {
+	if err := c.resolveInterfaces(); err != nil {
+		return err
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	c.defaultValue()
+	return nil
+}
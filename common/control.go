@@ -0,0 +1,68 @@
+package common
+
+import (
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/engine"
+	"github.com/labstack/echo/engine/standard"
+)
+
+const (
+	// 控制socket文件的权限，进程的用户与同组的用户可以访问
+	CONTROL_SOCKET_MODE = 0660
+)
+
+// 在本机的unix socket上同时提供管理接口，访问控制由socket文件的权限决定，请求不需要认证
+func (s *BaseService) runControlSocket() error {
+	path := s.Cfg.Net.ControlSocket
+	// 删除上次异常退出时留下的socket文件
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		s.Log.Errorf("Remove control socket %s failed, error=%v", path, err)
+		return err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		s.Log.Errorf("Listen control socket %s failed, error=%v", path, err)
+		return err
+	}
+	if err = os.Chmod(path, CONTROL_SOCKET_MODE); err != nil {
+		ln.Close()
+		s.Log.Errorf("Chmod control socket %s failed, error=%v", path, err)
+		return err
+	}
+	s.control = ln
+
+	sr := standard.WithConfig(engine.Config{Address: path, Listener: ln})
+	sr.SetHandler(s.echo)
+	sr.SetLogger(s.echo.Logger())
+	s.Log.Infof("Starting control socket %s", path)
+	go func() {
+		if err := sr.Start(); err != nil && s.IsRunning() {
+			s.Log.Errorf("Serve control socket %s failed, error=%v", path, err)
+		}
+	}()
+	return nil
+}
+
+// 停止时关闭控制socket并删除文件
+func (s *BaseService) closeControlSocket() {
+	if s.control == nil {
+		return
+	}
+	s.control.Close()
+	os.Remove(s.Cfg.Net.ControlSocket)
+	s.control = nil
+}
+
+// 请求是否来自控制socket
+func isControlRequest(c echo.Context) bool {
+	r, ok := c.Request().(*standard.Request)
+	if !ok {
+		return false
+	}
+	_, ok = r.Request.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return ok
+}
@@ -2,14 +2,15 @@ package common
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 
-	slog "github.com/cihub/seelog"
 	"github.com/labstack/echo/log"
 	glog "github.com/labstack/gommon/log"
 )
 
 type elog struct {
+	l Logger
 }
 
 func toString(j glog.JSON) string {
@@ -17,32 +18,32 @@ func toString(j glog.JSON) string {
 	return string(b)
 }
 
-func NewEchoLogger() log.Logger {
-	return &elog{}
+func NewEchoLogger(l Logger) log.Logger {
+	return &elog{l: l}
 }
 func (l *elog) SetOutput(io.Writer) {}
 func (l *elog) SetLevel(glog.Lvl)   {}
-func (l *elog) Printj(j glog.JSON)  { slog.Trace(toString(j)) }
-func (l *elog) Debugj(j glog.JSON)  { slog.Debug(toString(j)) }
-func (l *elog) Infoj(j glog.JSON)   { slog.Info(toString(j)) }
-func (l *elog) Warnj(j glog.JSON)   { slog.Warn(toString(j)) }
-func (l *elog) Errorj(j glog.JSON)  { slog.Error(toString(j)) }
-func (l *elog) Fatalj(j glog.JSON)  { slog.Error(toString(j)); panic("toString(j)") }
+func (l *elog) Printj(j glog.JSON)  { l.l.Debugf("%s", toString(j)) }
+func (l *elog) Debugj(j glog.JSON)  { l.l.Debugf("%s", toString(j)) }
+func (l *elog) Infoj(j glog.JSON)   { l.l.Infof("%s", toString(j)) }
+func (l *elog) Warnj(j glog.JSON)   { l.l.Warnf("%s", toString(j)) }
+func (l *elog) Errorj(j glog.JSON)  { l.l.Errorf("%s", toString(j)) }
+func (l *elog) Fatalj(j glog.JSON)  { l.l.Errorf("%s", toString(j)); panic("toString(j)") }
 
-func (l *elog) Print(a ...interface{})            { slog.Trace(a...) }
-func (l *elog) Printf(f string, a ...interface{}) { slog.Tracef(f, a...) }
+func (l *elog) Print(a ...interface{})            { l.l.Debugf("%s", fmt.Sprint(a...)) }
+func (l *elog) Printf(f string, a ...interface{}) { l.l.Debugf(f, a...) }
 
-func (l *elog) Debug(a ...interface{})            { slog.Debug(a...) }
-func (l *elog) Debugf(f string, a ...interface{}) { slog.Debugf(f, a...) }
+func (l *elog) Debug(a ...interface{})            { l.l.Debugf("%s", fmt.Sprint(a...)) }
+func (l *elog) Debugf(f string, a ...interface{}) { l.l.Debugf(f, a...) }
 
-func (l *elog) Info(a ...interface{})            { slog.Info(a...) }
-func (l *elog) Infof(f string, a ...interface{}) { slog.Infof(f, a...) }
+func (l *elog) Info(a ...interface{})            { l.l.Infof("%s", fmt.Sprint(a...)) }
+func (l *elog) Infof(f string, a ...interface{}) { l.l.Infof(f, a...) }
 
-func (l *elog) Warn(a ...interface{})            { slog.Warn(a...) }
-func (l *elog) Warnf(f string, a ...interface{}) { slog.Warnf(f, a...) }
+func (l *elog) Warn(a ...interface{})            { l.l.Warnf("%s", fmt.Sprint(a...)) }
+func (l *elog) Warnf(f string, a ...interface{}) { l.l.Warnf(f, a...) }
 
-func (l *elog) Error(a ...interface{})            { slog.Error(a...) }
-func (l *elog) Errorf(f string, a ...interface{}) { slog.Errorf(f, a...) }
+func (l *elog) Error(a ...interface{})            { l.l.Errorf("%s", fmt.Sprint(a...)) }
+func (l *elog) Errorf(f string, a ...interface{}) { l.l.Errorf(f, a...) }
 
-func (l *elog) Fatal(a ...interface{})            { slog.Error(a...); panic("") }
-func (l *elog) Fatalf(f string, a ...interface{}) { slog.Errorf(f, a...) }
+func (l *elog) Fatal(a ...interface{})            { l.l.Errorf("%s", fmt.Sprint(a...)); panic("") }
+func (l *elog) Fatalf(f string, a ...interface{}) { l.l.Errorf(f, a...) }
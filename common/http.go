@@ -2,12 +2,14 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"errors"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"strings"
 	"time"
 )
 
@@ -19,6 +21,10 @@ func (s *BaseService) HttpPost(addr, urlpath string, reqBody []byte) (rspBody []
 	return SendHttpReq(s.Cfg, "POST", addr, urlpath, reqBody)
 }
 
+func (s *BaseService) HttpPatch(addr, urlpath string, reqBody []byte) (rspBody []byte, err error) {
+	return SendHttpReq(s.Cfg, "PATCH", addr, urlpath, reqBody)
+}
+
 func (s *BaseService) HttpDelete(addr, urlpath string) (err error) {
 	_, err = SendHttpReq(s.Cfg, "DELETE", addr, urlpath, nil)
 	return
@@ -26,39 +32,43 @@ func (s *BaseService) HttpDelete(addr, urlpath string) (err error) {
 
 func CreateHttpClient(cfg *Config) *http.Client {
 	var client *http.Client
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
 	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return cfg.DialContext(ctx, dialer, network, addr)
+		},
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 		MaxIdleConnsPerHost:   1,
 		DisableKeepAlives:     true,
 	}
 	if cfg.Net.Tls != nil {
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		tc, err := cfg.Net.Tls.ClientConfig()
+		if err != nil {
+			// 不降级为不校验证书，让所有请求失败
+			DefaultLogger().Errorf("Load tls config failed, error=%v", err)
+			tc = &tls.Config{
+				InsecureSkipVerify:    true,
+				VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error { return err },
+			}
+		}
+		tr.TLSClientConfig = tc
 	}
 	client = &http.Client{Transport: tr}
 	return client
 }
 
 func SendHttpReqWithClien(client *http.Client, cfg *Config, method, addr, urlpath string, reqBody []byte) (rspBody []byte, err error) {
-	schema := "http"
-	if cfg.Net.Tls != nil {
-		schema = "https"
-	}
-
-	if cfg.Server && !strings.Contains(addr, ":") {
-		addr = fmt.Sprintf("%s:%v", addr, cfg.Net.AgentMgntPort)
-	}
+	return SendHttpReqContext(context.Background(), client, cfg, method, addr, urlpath, reqBody)
+}
 
-	url := fmt.Sprintf("%s://%s%s", schema, addr, urlpath)
-	req, err := http.NewRequest(method, url, bytes.NewReader(reqBody))
+// ctx取消或超时后中止请求，同时仍受2秒的请求超时限制
+func SendHttpReqContext(ctx context.Context, client *http.Client, cfg *Config, method, addr, urlpath string, reqBody []byte) (rspBody []byte, err error) {
+	req, err := newHttpReq(ctx, cfg, method, addr, urlpath, reqBody)
 	if err != nil {
 		return nil, err
 	}
 
-	req.SetBasicAuth(cfg.Auth.Username, cfg.Auth.Passowrd)
-	req.Header.Set("Content-Type", "application/json")
-	//log.Debugf("Sending http request %v", req)
-
 	client.Timeout = 2 * time.Second
 	resp, err := client.Do(req)
 	if err != nil {
@@ -66,8 +76,8 @@ func SendHttpReqWithClien(client *http.Client, cfg *Config, method, addr, urlpat
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode > 300 {
-		return nil, errors.New(fmt.Sprintf("Recv http status code %v", resp.StatusCode))
+	if err = checkHttpRsp(resp); err != nil {
+		return nil, err
 	}
 
 	if resp.ContentLength > 0 {
@@ -76,6 +86,82 @@ func SendHttpReqWithClien(client *http.Client, cfg *Config, method, addr, urlpat
 	return
 }
 
+// 返回响应体，由调用方边读边处理并关闭，用于元数据等大的响应。
+// 2秒内没有收到响应头时中止请求，之后读取响应体的时间只受ctx限制
+func OpenHttpReqContext(ctx context.Context, client *http.Client, cfg *Config, method, addr, urlpath string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := newHttpReq(ctx, cfg, method, addr, urlpath, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	timer := time.AfterFunc(2*time.Second, cancel)
+	resp, err := client.Do(req)
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err = checkHttpRsp(resp); err != nil {
+		resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	return &cancelBody{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+// 关闭响应体时释放请求的ctx
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func newHttpReq(ctx context.Context, cfg *Config, method, addr, urlpath string, reqBody []byte) (*http.Request, error) {
+	schema := "http"
+	if cfg.Net.Tls != nil {
+		schema = "https"
+	}
+
+	if cfg.Server {
+		// 只有IP时使用Agent的管理端口
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = JoinHostPort(addr, cfg.Net.AgentMgntPort)
+		}
+	}
+
+	url := fmt.Sprintf("%s://%s%s", schema, addr, urlpath)
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetBasicAuth(cfg.Auth.Username, cfg.Auth.Passowrd)
+	req.Header.Set("Content-Type", "application/json")
+	//log.Debugf("Sending http request %v", req)
+	return req, nil
+}
+
+func checkHttpRsp(resp *http.Response) error {
+	if resp.StatusCode > 300 {
+		// 带上响应中的错误，可以用ErrorCode取得错误码，如INSUFFICIENT_DISK_SPACE
+		bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("Recv http status code %v, %w", resp.StatusCode, ParseApiError(resp.StatusCode, bs))
+	}
+	return nil
+}
+
 func SendHttpReq(cfg *Config, method, addr, urlpath string, reqBody []byte) (rspBody []byte, err error) {
 	client := CreateHttpClient(cfg)
 	return SendHttpReqWithClien(client, cfg, method, addr, urlpath, reqBody)
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// 日志接口，由Server与Agent的构造函数传入，可以适配zap、logrus、slog等。
+// With返回附加了字段的Logger，字段以键值对传入，如With("taskID", id)，之后的每条日志都带有这些字段
+type Logger interface {
+	Debugf(format string, params ...interface{})
+	Infof(format string, params ...interface{})
+	Warnf(format string, params ...interface{})
+	Errorf(format string, params ...interface{})
+	With(kv ...interface{}) Logger
+}
+
+var defaultLogger Logger = NewSeelogLogger()
+
+// logFormat为json时的日志级别，可以在重新加载配置时修改
+var jsonLogLevel = new(slog.LevelVar)
+
+// 不属于某个Server或Agent的代码（如生成元数据、加载证书）使用的Logger，创建Service时替换为传入的Logger
+func DefaultLogger() Logger {
+	return defaultLogger
+}
+
+// 根据配置创建Logger，logFormat为json时以JSON格式输出到标准输出，否则使用seelog
+func NewLogger(cfg *Config) Logger {
+	if cfg.LogFormat == "json" {
+		SetLogLevel(cfg.LogLevel)
+		return NewSlogLogger(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: jsonLogLevel})))
+	}
+	return NewSeelogLogger()
+}
+
+// 设置JSON日志的级别：debug、info、warn或error，为空时使用info。seelog的级别在其配置文件中设置
+func SetLogLevel(level string) error {
+	if level == "" {
+		level = "info"
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	jsonLogLevel.Set(l)
+	return nil
+}
+
+// 使用seelog输出，字段以[key=value ...]的形式放在消息之前
+type seelogLogger struct {
+	fields []string
+	prefix string
+}
+
+func NewSeelogLogger() Logger {
+	return &seelogLogger{}
+}
+
+func (l *seelogLogger) Debugf(format string, params ...interface{}) {
+	log.Debug(l.prefix + fmt.Sprintf(format, params...))
+}
+
+func (l *seelogLogger) Infof(format string, params ...interface{}) {
+	log.Info(l.prefix + fmt.Sprintf(format, params...))
+}
+
+func (l *seelogLogger) Warnf(format string, params ...interface{}) {
+	log.Warn(l.prefix + fmt.Sprintf(format, params...))
+}
+
+func (l *seelogLogger) Errorf(format string, params ...interface{}) {
+	log.Error(l.prefix + fmt.Sprintf(format, params...))
+}
+
+func (l *seelogLogger) With(kv ...interface{}) Logger {
+	fields := append([]string(nil), l.fields...)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields = append(fields, fmt.Sprintf("%v=%v", kv[i], kv[i+1]))
+	}
+	return &seelogLogger{fields: fields, prefix: "[" + strings.Join(fields, " ") + "] "}
+}
+
+// 使用标准库的slog输出，字段作为slog的属性
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func NewSlogLogger(l *slog.Logger) Logger {
+	return &slogLogger{l: l}
+}
+
+func (l *slogLogger) Debugf(format string, params ...interface{}) {
+	l.l.Debug(fmt.Sprintf(format, params...))
+}
+
+func (l *slogLogger) Infof(format string, params ...interface{}) {
+	l.l.Info(fmt.Sprintf(format, params...))
+}
+
+func (l *slogLogger) Warnf(format string, params ...interface{}) {
+	l.l.Warn(fmt.Sprintf(format, params...))
+}
+
+func (l *slogLogger) Errorf(format string, params ...interface{}) {
+	l.l.Error(fmt.Sprintf(format, params...))
+}
+
+func (l *slogLogger) With(kv ...interface{}) Logger {
+	return &slogLogger{l: l.l.With(kv...)}
+}
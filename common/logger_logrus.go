@@ -0,0 +1,32 @@
+//go:build logrus
+// +build logrus
+
+package common
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 适配logrus，需要使用 -tags logrus 编译
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+func NewLogrusLogger(l logrus.FieldLogger) Logger {
+	return &logrusLogger{l: l}
+}
+
+func (l *logrusLogger) Debugf(format string, params ...interface{}) { l.l.Debugf(format, params...) }
+func (l *logrusLogger) Infof(format string, params ...interface{})  { l.l.Infof(format, params...) }
+func (l *logrusLogger) Warnf(format string, params ...interface{})  { l.l.Warnf(format, params...) }
+func (l *logrusLogger) Errorf(format string, params ...interface{}) { l.l.Errorf(format, params...) }
+
+func (l *logrusLogger) With(kv ...interface{}) Logger {
+	fields := make(logrus.Fields, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+	return &logrusLogger{l: l.l.WithFields(fields)}
+}
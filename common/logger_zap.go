@@ -0,0 +1,26 @@
+//go:build zap
+// +build zap
+
+package common
+
+import (
+	"go.uber.org/zap"
+)
+
+// 适配zap，需要使用 -tags zap 编译
+type zapLogger struct {
+	l *zap.SugaredLogger
+}
+
+func NewZapLogger(l *zap.Logger) Logger {
+	return &zapLogger{l: l.Sugar()}
+}
+
+func (l *zapLogger) Debugf(format string, params ...interface{}) { l.l.Debugf(format, params...) }
+func (l *zapLogger) Infof(format string, params ...interface{})  { l.l.Infof(format, params...) }
+func (l *zapLogger) Warnf(format string, params ...interface{})  { l.l.Warnf(format, params...) }
+func (l *zapLogger) Errorf(format string, params ...interface{}) { l.l.Errorf(format, params...) }
+
+func (l *zapLogger) With(kv ...interface{}) Logger {
+	return &zapLogger{l: l.l.With(kv...)}
+}
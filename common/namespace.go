@@ -0,0 +1,59 @@
+package common
+
+import (
+	"fmt"
+)
+
+// 多个团队共用Server时，按命名空间限制任务的并发数、每天分发的数据量与每个任务的Agent数。只有服务端才配置
+type Namespace struct {
+	Name             string   `yaml:"name"`
+	Clients          []string `yaml:"clients,omitempty"`          // 可以使用该命名空间的令牌客户端，为空时所有客户端都可以使用
+	MaxActiveTasks   int      `yaml:"maxActiveTasks,omitempty"`   // 同时未结束的任务数，为0时不限制
+	MaxBytesPerDay   int64    `yaml:"maxBytesPerDay,omitempty"`   // Unit: Byte, 每天分发的数据量，按文件长度乘以目的Agent数计算，为0时不限制
+	MaxAgentsPerTask int      `yaml:"maxAgentsPerTask,omitempty"` // 每个任务的目的Agent数，为0时不限制
+}
+
+func (n *Namespace) parse() error {
+	if n.Name == "" {
+		return fmt.Errorf("Not set name in namespaces")
+	}
+	if n.MaxActiveTasks < 0 || n.MaxBytesPerDay < 0 || n.MaxAgentsPerTask < 0 {
+		return fmt.Errorf("Invalid quota in namespace %s", n.Name)
+	}
+	return nil
+}
+
+// 名称对应的命名空间，没有配置时返回nil
+func (c *Config) NamespaceFor(name string) *Namespace {
+	for _, n := range c.Namespaces {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// 任务没有指定命名空间时，客户端所在的第一个命名空间，没有时返回nil
+func (c *Config) ClientNamespace(client string) *Namespace {
+	for _, n := range c.Namespaces {
+		for _, cl := range n.Clients {
+			if cl == client {
+				return n
+			}
+		}
+	}
+	return nil
+}
+
+// 客户端是否可以使用该命名空间
+func (n *Namespace) AllowClient(client string) bool {
+	if len(n.Clients) == 0 {
+		return true
+	}
+	for _, cl := range n.Clients {
+		if cl == client {
+			return true
+		}
+	}
+	return false
+}
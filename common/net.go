@@ -0,0 +1,125 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 拼接地址与端口，IPv6地址加上[]
+func JoinHostPort(host string, port int) string {
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+}
+
+// 去掉地址中的端口，没有端口时原样返回
+func StripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// 监听的网络类型：配置了dualStack或没有配置IP时同时监听IPv4与IPv6，否则只监听IP所属的协议
+func (c *Config) ListenNetwork() string {
+	return c.listenNetwork(c.Net.IP)
+}
+
+// 数据端口监听的网络类型
+func (c *Config) DataListenNetwork() string {
+	return c.listenNetwork(c.DataListenIP())
+}
+
+func (c *Config) listenNetwork(addr string) string {
+	ip := net.ParseIP(addr)
+	switch {
+	case c.Net.DualStack || ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// 数据端口监听的地址，没有配置dataIP时与ip相同
+func (c *Config) DataListenIP() string {
+	if c.Net.DataIP != "" {
+		return c.Net.DataIP
+	}
+	return c.Net.IP
+}
+
+// 其它节点连接本节点数据端口的地址，依次使用advertise、dataIP与ip
+func (c *Config) DataAddr() string {
+	host := c.Net.Advertise
+	if host == "" {
+		host = c.DataListenIP()
+	}
+	return JoinHostPort(host, c.Net.DataPort)
+}
+
+// 配置了advertise或dataIP时向Server上报的数据地址，没有配置或为未指定的地址时为空
+func (c *Config) AdvertisedDataAddr() string {
+	if c.Net.Advertise == "" && c.Net.DataIP == "" {
+		return ""
+	}
+	addr := c.DataAddr()
+	if ip := net.ParseIP(StripPort(addr)); ip != nil && ip.IsUnspecified() {
+		return ""
+	}
+	return addr
+}
+
+// 连接其它节点时绑定的源地址，没有配置dataIP或为未指定的地址时为nil
+func (c *Config) DataSourceAddr() *net.TCPAddr {
+	ip := net.ParseIP(c.Net.DataIP)
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+// 按网卡名解析ip与dataIP，已经配置了地址时不使用网卡
+func (c *Config) resolveInterfaces() (err error) {
+	if c.Net.IP == "" && c.Net.Interface != "" {
+		if c.Net.IP, err = InterfaceIP(c.Net.Interface); err != nil {
+			return fmt.Errorf("Invalid Net.Interface: %v", err)
+		}
+	}
+	if c.Net.DataIP == "" && c.Net.DataInterface != "" {
+		if c.Net.DataIP, err = InterfaceIP(c.Net.DataInterface); err != nil {
+			return fmt.Errorf("Invalid Net.DataInterface: %v", err)
+		}
+	}
+	return nil
+}
+
+// 网卡上的第一个地址，优先使用IPv4，忽略链路本地地址
+func InterfaceIP(name string) (string, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return "", err
+	}
+	var v6 string
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipn.IP.To4() != nil {
+			return ipn.IP.String(), nil
+		}
+		if v6 == "" {
+			v6 = ipn.IP.String()
+		}
+	}
+	if v6 == "" {
+		return "", fmt.Errorf("No address on interface %s", name)
+	}
+	return v6, nil
+}
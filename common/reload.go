@@ -0,0 +1,113 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+
+	log "github.com/cihub/seelog"
+	"github.com/labstack/echo"
+)
+
+// 配置重新加载后调用，应用需要由服务自己处理的配置，如总的速率与并发任务数
+type Reloader interface {
+	OnReload(c *Config)
+}
+
+// 可以热加载的配置，其它配置修改后需要重启才生效
+func (c *Config) applyReload(n *Config) (changed []string) {
+	set := func(name string, dst, src interface{}) {
+		d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+		if !reflect.DeepEqual(d.Interface(), s.Interface()) {
+			d.Set(s)
+			changed = append(changed, name)
+		}
+	}
+	set("log", &c.Log, &n.Log)
+	set("logLevel", &c.LogLevel, &n.LogLevel)
+	set("control.speed", &c.Control.Speed, &n.Control.Speed)
+	set("control.uploadSpeed", &c.Control.UploadSpeed, &n.Control.UploadSpeed)
+	set("control.downloadSpeed", &c.Control.DownloadSpeed, &n.Control.DownloadSpeed)
+	set("control.bandwidthSchedule", &c.Control.BandwidthSchedule, &n.Control.BandwidthSchedule)
+	set("control.fairShare", &c.Control.FairShare, &n.Control.FairShare)
+	set("control.maxConns", &c.Control.MaxConns, &n.Control.MaxConns)
+	set("control.maxTaskConns", &c.Control.MaxTaskConns, &n.Control.MaxTaskConns)
+	set("control.maxActive", &c.Control.MaxActive, &n.Control.MaxActive)
+	set("control.maxUploadPeers", &c.Control.MaxUploadPeers, &n.Control.MaxUploadPeers)
+	set("control.requestWindow", &c.Control.RequestWindow, &n.Control.RequestWindow)
+	set("control.requestTimeout", &c.Control.RequestTimeout, &n.Control.RequestTimeout)
+	set("control.minPeerSpeed", &c.Control.MinPeerSpeed, &n.Control.MinPeerSpeed)
+	set("control.adaptiveBlock", &c.Control.AdaptiveBlock, &n.Control.AdaptiveBlock)
+	set("control.pex", &c.Control.Pex, &n.Control.Pex)
+	set("control.maxPieceRetries", &c.Control.MaxPieceRetries, &n.Control.MaxPieceRetries)
+	set("control.badPeerPieces", &c.Control.BadPeerPieces, &n.Control.BadPeerPieces)
+	set("control.hookCommands", &c.Control.HookCommands, &n.Control.HookCommands)
+	set("control.hookURLs", &c.Control.HookURLs, &n.Control.HookURLs)
+	set("control.destDirs", &c.Control.DestDirs, &n.Control.DestDirs)
+	set("control.mountDirs", &c.Control.MountDirs, &n.Control.MountDirs)
+	set("control.allowUpgrade", &c.Control.AllowUpgrade, &n.Control.AllowUpgrade)
+	set("control.hookTimeout", &c.Control.HookTimeout, &n.Control.HookTimeout)
+	set("control.historyRetention", &c.Control.HistoryRetention, &n.Control.HistoryRetention)
+	set("control.historyMaxTasks", &c.Control.HistoryMaxTasks, &n.Control.HistoryMaxTasks)
+	set("control.taskTtl", &c.Control.TaskTtl, &n.Control.TaskTtl)
+	set("control.stallTimeout", &c.Control.StallTimeout, &n.Control.StallTimeout)
+	set("acls", &c.Acls, &n.Acls)
+	set("namespaces", &c.Namespaces, &n.Namespaces)
+	return
+}
+
+// 重新读取配置文件并应用可以热加载的配置，运行中的任务不受影响
+func (s *BaseService) Reload() ([]string, error) {
+	if s.Cfg.File == "" {
+		return nil, errors.New("Config is not loaded from a file")
+	}
+	n, err := ParserConfig(s.Cfg.File, s.Cfg.Server)
+	if err != nil {
+		s.Log.Errorf("Reload config %s failed, error=%v", s.Cfg.File, err)
+		return nil, err
+	}
+
+	changed := s.Cfg.applyReload(n)
+	s.loadSeelog()
+	if err = SetLogLevel(s.Cfg.LogLevel); err != nil {
+		s.Log.Warnf("Set log level failed, error=%v", err)
+	}
+	if s.tokens != nil {
+		if n.Auth.TokenFile != s.Cfg.Auth.TokenFile {
+			s.Log.Warnf("Token file is changed to %s, restart to take effect", n.Auth.TokenFile)
+		} else if err = s.tokens.forceReload(); err != nil {
+			s.Log.Errorf("Reload tokens %s failed, error=%v", s.tokens.file, err)
+		}
+	}
+	if r, ok := s.svc.(Reloader); ok {
+		r.OnReload(s.Cfg)
+	}
+	s.Log.Infof("Reloaded config %s, changed=%v", s.Cfg.File, changed)
+	return changed, nil
+}
+
+// POST /api/v1/reload
+func (s *BaseService) ReloadConfig(c echo.Context) error {
+	changed, err := s.Reload()
+	if err != nil {
+		return ReplyError(c, http.StatusBadRequest, err)
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	return c.JSON(http.StatusOK, changed)
+}
+
+// 重新加载seelog的配置文件，日志级别在其中配置
+func (s *BaseService) loadSeelog() {
+	if s.Cfg.Log == "" {
+		return
+	}
+	if logger, err := log.LoggerFromConfigAsFile(s.Cfg.Log); err == nil {
+		// 日志经过seelogLogger输出，调用位置需要多跳过一层
+		logger.SetAdditionalStackDepth(1)
+		log.ReplaceLogger(logger)
+	} else {
+		s.Log.Errorf("Load log config %s failed, error=%v", s.Cfg.Log, err)
+	}
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// 以该前缀配置的地址为SRV记录的名称，如srv://_gofd._tcp.example.com，每次使用时查询，
+	// 按优先级与权重排列记录中的host:port
+	SRV_SCHEME = "srv://"
+)
+
+// 最近一次查询成功的SRV记录，查询失败时继续使用
+var srvCache = struct {
+	sync.Mutex
+	m map[string][]string
+}{m: make(map[string][]string)}
+
+// 展开地址中的SRV记录，其它地址原样返回。域名在每次建立连接时重新解析，服务迁移后不需要重启
+func ResolveAddrs(addrs []string) []string {
+	var resolved []string
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, SRV_SCHEME) {
+			resolved = append(resolved, lookupSRV(strings.TrimPrefix(addr, SRV_SCHEME))...)
+		} else {
+			resolved = append(resolved, addr)
+		}
+	}
+	return resolved
+}
+
+func lookupSRV(name string) []string {
+	srvCache.Lock()
+	defer srvCache.Unlock()
+	_, srvs, err := net.LookupSRV("", "", name)
+	if err != nil || len(srvs) == 0 {
+		if cached, ok := srvCache.m[name]; ok {
+			DefaultLogger().Warnf("Lookup srv %s failed, use last records %v, error=%v", name, cached, err)
+			return cached
+		}
+		DefaultLogger().Errorf("Lookup srv %s failed, error=%v", name, err)
+		return nil
+	}
+	addrs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	srvCache.m[name] = addrs
+	return addrs
+}
+
+// 地址中的域名已解析到其它IP，不再包含remote的IP。地址为IP或解析失败时返回false
+func AddrMoved(addr string, remote net.Addr) bool {
+	host := StripPort(addr)
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	var ip net.IP
+	switch a := remote.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
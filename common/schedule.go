@@ -0,0 +1,102 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 按一天中的时间段限制所有任务总的速率，如工作时间限制为10MiBps，其它时间使用uploadSpeed与downloadSpeed
+type BandwidthSchedule struct {
+	Timezone string             `yaml:"timezone,omitempty"` // 时间段所在的时区，如Asia/Shanghai，默认本机的时区
+	Windows  []*BandwidthWindow `yaml:"windows"`            // 按顺序匹配第一个时间段
+
+	loc *time.Location
+}
+
+type BandwidthWindow struct {
+	Start    string   `yaml:"start"`              // 开始时间，如08:00
+	End      string   `yaml:"end"`                // 结束时间，不包含，早于开始时间时跨过零点
+	Days     []string `yaml:"days,omitempty"`     // 生效的星期，如mon、tue，按开始时间所在的日期，为空时每天生效
+	Upload   int      `yaml:"upload,omitempty"`   // Unit: MiBps, 时间段内总的上传速率，0表示不限制
+	Download int      `yaml:"download,omitempty"` // Unit: MiBps, 时间段内总的下载速率，0表示不限制
+
+	start, end int // 从零点开始的分钟数
+	days       map[time.Weekday]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid bandwidth schedule time %s, should be HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (b *BandwidthSchedule) parse() (err error) {
+	b.loc = time.Local
+	if b.Timezone != "" {
+		if b.loc, err = time.LoadLocation(b.Timezone); err != nil {
+			return fmt.Errorf("Invalid bandwidth schedule timezone %s: %v", b.Timezone, err)
+		}
+	}
+	for _, w := range b.Windows {
+		if w.start, err = parseClock(w.Start); err != nil {
+			return err
+		}
+		if w.end, err = parseClock(w.End); err != nil {
+			return err
+		}
+		if w.start == w.end {
+			return fmt.Errorf("Invalid bandwidth schedule %s-%s, start equals end", w.Start, w.End)
+		}
+		if w.Upload < 0 || w.Download < 0 {
+			return fmt.Errorf("Invalid bandwidth schedule %s-%s, speed should not be negative", w.Start, w.End)
+		}
+		w.days = nil
+		for _, d := range w.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return fmt.Errorf("Invalid bandwidth schedule day %s", d)
+			}
+			if w.days == nil {
+				w.days = make(map[time.Weekday]bool)
+			}
+			w.days[wd] = true
+		}
+	}
+	return nil
+}
+
+// t所在的时间段，没有匹配时返回nil
+func (b *BandwidthSchedule) Window(t time.Time) *BandwidthWindow {
+	if b == nil {
+		return nil
+	}
+	t = t.In(b.loc)
+	now := t.Hour()*60 + t.Minute()
+	for _, w := range b.Windows {
+		day := t.Weekday()
+		switch {
+		case w.start < w.end:
+			if now < w.start || now >= w.end {
+				continue
+			}
+		case now >= w.start:
+		case now < w.end:
+			// 跨过零点的时间段按开始的日期匹配星期
+			day = (day + 6) % 7
+		default:
+			continue
+		}
+		if w.days == nil || w.days[day] {
+			return w
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS配置，配置CA时双向认证，对端的证书必须由CA签发
+type TlsConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	CA   string `yaml:"ca,omitempty"`
+	Peer bool   `yaml:"peer,omitempty"` // 节点之间的数据连接也使用TLS
+}
+
+// 证书文件更新后自动重新加载，不需要重启服务
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checkAt  time.Time
+	interval time.Duration
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, interval: 10 * time.Second}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	st, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTime = &cert, st.ModTime()
+	return nil
+}
+
+// 定时检查证书文件的修改时间，加载失败时继续使用旧的证书
+func (r *certReloader) certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.After(r.checkAt) {
+		r.checkAt = now.Add(r.interval)
+		if st, err := os.Stat(r.certFile); err == nil && !st.ModTime().Equal(r.modTime) {
+			if err := r.reload(); err != nil {
+				DefaultLogger().Errorf("Reload certificate %s failed, error=%v", r.certFile, err)
+			} else {
+				DefaultLogger().Infof("Reloaded certificate %s", r.certFile)
+			}
+		}
+	}
+	return r.cert
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+var (
+	reloadersLock sync.Mutex
+	reloaders     = make(map[string]*certReloader)
+)
+
+// 同一个证书只创建一个reloader，服务端与客户端共用
+func getCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloadersLock.Lock()
+	defer reloadersLock.Unlock()
+	if r, ok := reloaders[certFile]; ok {
+		return r, nil
+	}
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	reloaders[certFile] = r
+	return r, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificate in %s", caFile)
+	}
+	return pool, nil
+}
+
+// 服务端的TLS配置，配置CA时要求客户端提供证书
+func (t *TlsConfig) ServerConfig() (*tls.Config, error) {
+	r, err := getCertReloader(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{GetCertificate: r.GetCertificate}
+	if t.CA != "" {
+		if c.ClientCAs, err = loadCertPool(t.CA); err != nil {
+			return nil, err
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// 客户端的TLS配置。节点按IP互相访问，只校验证书由CA签发，不校验主机名；
+// 没有配置CA时不校验服务端证书，没有配置证书时不提供客户端证书
+func (t *TlsConfig) ClientConfig() (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: true}
+	if t.CA == "" {
+		return c, nil
+	}
+
+	pool, err := loadCertPool(t.CA)
+	if err != nil {
+		return nil, err
+	}
+	if t.Cert != "" {
+		r, err := getCertReloader(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.GetClientCertificate = r.GetClientCertificate
+	}
+	c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("No peer certificate")
+		}
+		// 配置由多个连接并发使用，不能修改外层的变量
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{Roots: pool, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+	return c, nil
+}
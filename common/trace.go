@@ -0,0 +1,93 @@
+package common
+
+import (
+	"errors"
+)
+
+// 追踪数据的导出方式
+const (
+	TRACE_EXPORTER_OTLP_GRPC = "otlp-grpc" // OTLP over gRPC，默认端口4317
+	TRACE_EXPORTER_OTLP_HTTP = "otlp-http" // OTLP over HTTP，默认端口4318
+	TRACE_EXPORTER_STDOUT    = "stdout"    // 输出到标准输出，用于调试
+)
+
+// 使用OpenTelemetry追踪任务的创建、分发、状态上报、Peer握手与Piece传输。
+// Server把任务的追踪上下文随任务下发，Agent的Span都是其子Span，一次分发可以在Server与所有Agent间端到端查看。
+// 需要使用 -tags otel 编译
+type TraceConfig struct {
+	Exporter    string  `yaml:"exporter"`              // otlp-grpc、otlp-http或stdout
+	Endpoint    string  `yaml:"endpoint,omitempty"`    // 采集器的地址，如127.0.0.1:4317，默认使用OTEL_EXPORTER_OTLP_ENDPOINT环境变量
+	Insecure    bool    `yaml:"insecure,omitempty"`    // 不使用TLS连接采集器
+	SampleRatio float64 `yaml:"sampleRatio,omitempty"` // 采样的任务比例，0到1之间，默认1。Agent跟随Server的采样决定
+}
+
+// 追踪的一段操作，没有配置trace时为空操作
+type Span interface {
+	// kv为交替的属性名与属性值
+	SetAttributes(kv ...interface{})
+	// err为nil时忽略
+	SetError(err error)
+	End()
+	// W3C traceparent格式的追踪上下文，跨节点传递，没有采样时为空
+	TraceParent() string
+}
+
+type Tracer interface {
+	// parent为nil时开始新的追踪
+	Start(parent Span, name string, kv ...interface{}) Span
+	// traceParent为其它节点传递的追踪上下文，为空时开始新的追踪
+	StartRemote(traceParent string, name string, kv ...interface{}) Span
+	Shutdown()
+}
+
+// 使用 -tags otel 编译时注册
+var newOtelTracer func(cfg *TraceConfig, service string) (Tracer, error)
+
+var tracer Tracer = noopTracer{}
+
+// 服务启动时调用，没有配置trace时不追踪
+func InitTracing(cfg *Config, service string) error {
+	if cfg.Trace == nil {
+		return nil
+	}
+	if newOtelTracer == nil {
+		return errors.New("Tracing is not supported, build with -tags otel")
+	}
+	t, err := newOtelTracer(cfg.Trace, service)
+	if err != nil {
+		return err
+	}
+	tracer = t
+	return nil
+}
+
+// 服务退出时导出还没有发送的Span
+func ShutdownTracing() {
+	tracer.Shutdown()
+	tracer = noopTracer{}
+}
+
+func StartSpan(parent Span, name string, kv ...interface{}) Span {
+	return tracer.Start(parent, name, kv...)
+}
+
+func StartRemoteSpan(traceParent string, name string, kv ...interface{}) Span {
+	return tracer.StartRemote(traceParent, name, kv...)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(parent Span, name string, kv ...interface{}) Span { return noopSpan{} }
+
+func (noopTracer) StartRemote(traceParent string, name string, kv ...interface{}) Span {
+	return noopSpan{}
+}
+
+func (noopTracer) Shutdown() {}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(kv ...interface{}) {}
+func (noopSpan) SetError(err error)              {}
+func (noopSpan) End()                            {}
+func (noopSpan) TraceParent() string             { return "" }
@@ -0,0 +1,159 @@
+//go:build otel
+// +build otel
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// 退出时等待导出Span的最长时间
+	OTEL_SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+func init() {
+	newOtelTracer = startOtelTracer
+}
+
+var traceContext = propagation.TraceContext{}
+
+type otelTracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+type otelSpan struct {
+	ctx  context.Context
+	span trace.Span
+}
+
+func startOtelTracer(cfg *TraceConfig, service string) (Tracer, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	ctx := context.Background()
+	switch cfg.Exporter {
+	case TRACE_EXPORTER_OTLP_GRPC:
+		var opts []otlptracegrpc.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exp, err = otlptracegrpc.New(ctx, opts...)
+	case TRACE_EXPORTER_OTLP_HTTP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	default:
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+		// 有上游的追踪上下文时跟随其采样决定
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	return &otelTracer{provider: tp, tracer: tp.Tracer("github.com/xtfly/gofd")}, nil
+}
+
+func (t *otelTracer) Start(parent Span, name string, kv ...interface{}) Span {
+	ctx := context.Background()
+	if ps, ok := parent.(*otelSpan); ok {
+		ctx = ps.ctx
+	}
+	return t.start(ctx, name, kv)
+}
+
+func (t *otelTracer) StartRemote(traceParent string, name string, kv ...interface{}) Span {
+	ctx := context.Background()
+	if traceParent != "" {
+		ctx = traceContext.Extract(ctx, propagation.MapCarrier{"traceparent": traceParent})
+	}
+	return t.start(ctx, name, kv)
+}
+
+func (t *otelTracer) start(ctx context.Context, name string, kv []interface{}) Span {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithAttributes(otelAttributes(kv)...))
+	return &otelSpan{ctx: ctx, span: span}
+}
+
+func (t *otelTracer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), OTEL_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		DefaultLogger().Warnf("Shutdown tracer failed, error=%v", err)
+	}
+}
+
+func otelAttributes(kv []interface{}) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := attribute.Key(fmt.Sprint(kv[i]))
+		switch v := kv[i+1].(type) {
+		case string:
+			attrs = append(attrs, key.String(v))
+		case bool:
+			attrs = append(attrs, key.Bool(v))
+		case int:
+			attrs = append(attrs, key.Int(v))
+		case int64:
+			attrs = append(attrs, key.Int64(v))
+		case uint32:
+			attrs = append(attrs, key.Int64(int64(v)))
+		case uint64:
+			attrs = append(attrs, key.Int64(int64(v)))
+		case float32:
+			attrs = append(attrs, key.Float64(float64(v)))
+		case float64:
+			attrs = append(attrs, key.Float64(v))
+		default:
+			attrs = append(attrs, key.String(fmt.Sprint(v)))
+		}
+	}
+	return attrs
+}
+
+func (s *otelSpan) SetAttributes(kv ...interface{}) {
+	s.span.SetAttributes(otelAttributes(kv)...)
+}
+
+func (s *otelSpan) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *otelSpan) End() {
+	s.span.End()
+}
+
+func (s *otelSpan) TraceParent() string {
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(s.ctx, carrier)
+	return carrier["traceparent"]
+}
@@ -0,0 +1,170 @@
+package flowctrl
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// maxChunk is the largest transfer that is accounted against the buckets at a
+// time, so that streams sharing a bucket interleave fairly.
+const maxChunk = 32 * 1024
+
+// maxWait bounds a single sleep in Wait, so that rate changes take effect
+// promptly.
+const maxWait = 100 * time.Millisecond
+
+// TokenBucket limits the combined transfer rate of all streams that share it.
+// Tokens accumulate at rate bytes per second, with a burst of one second worth
+// of tokens. It is safe for concurrent use.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   int64   // Bytes per second (unlimited when <= 0)
+	tokens float64 // Available tokens, negative while paying back a large transfer
+	last   time.Time
+	used   int64 // Total bytes transferred through the bucket
+}
+
+// NewTokenBucket creates a bucket that allows rate bytes per second.
+func NewTokenBucket(rate int64) *TokenBucket {
+	return &TokenBucket{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// SetRate changes the rate to new bytes per second and returns the previous
+// setting.
+func (b *TokenBucket) SetRate(new int64) (old int64) {
+	b.mu.Lock()
+	old, b.rate = b.rate, new
+	if b.tokens > float64(new) {
+		b.tokens = float64(new)
+	}
+	b.mu.Unlock()
+	return
+}
+
+// Rate returns the current rate in bytes per second.
+func (b *TokenBucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// Used returns the total number of bytes transferred through the bucket,
+// including those transferred while it was unlimited.
+func (b *TokenBucket) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Wait blocks until n bytes may be transferred without exceeding the rate. A
+// nil bucket never blocks.
+func (b *TokenBucket) Wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	for {
+		b.mu.Lock()
+		if b.rate <= 0 {
+			b.used += int64(n)
+			b.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		rate := float64(b.rate)
+		if b.tokens += now.Sub(b.last).Seconds() * rate; b.tokens > rate {
+			b.tokens = rate
+		}
+		b.last = now
+
+		// A transfer larger than the burst goes through once the bucket is
+		// full and leaves it in debt.
+		need := float64(n)
+		if need > rate {
+			need = rate
+		}
+		if b.tokens >= need {
+			b.tokens -= float64(n)
+			b.used += int64(n)
+			b.mu.Unlock()
+			return
+		}
+		d := time.Duration((need - b.tokens) / rate * float64(time.Second))
+		b.mu.Unlock()
+
+		if d > maxWait {
+			d = maxWait
+		}
+		time.Sleep(d)
+	}
+}
+
+// BucketWriter implements io.Writer, limiting writes by all of its buckets.
+type BucketWriter struct {
+	io.Writer
+	buckets []*TokenBucket
+}
+
+// NewBucketWriter restricts all Write operations on w to the rates of buckets.
+// Nil buckets are ignored.
+func NewBucketWriter(w io.Writer, buckets ...*TokenBucket) *BucketWriter {
+	return &BucketWriter{w, buckets}
+}
+
+func (w *BucketWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 && err == nil {
+		chunk := len(p)
+		if chunk > maxChunk {
+			chunk = maxChunk
+		}
+		for _, b := range w.buckets {
+			b.Wait(chunk)
+		}
+		var c int
+		c, err = w.Writer.Write(p[:chunk])
+		p = p[c:]
+		n += c
+	}
+	return
+}
+
+// Wait blocks until n bytes are allowed by all buckets. It is used for data
+// sent to the underlying writer directly, e.g. with sendfile.
+func (w *BucketWriter) Wait(n int) {
+	for n > 0 {
+		chunk := n
+		if chunk > maxChunk {
+			chunk = maxChunk
+		}
+		for _, b := range w.buckets {
+			b.Wait(chunk)
+		}
+		n -= chunk
+	}
+}
+
+// BucketReader implements io.Reader, limiting reads by all of its buckets.
+type BucketReader struct {
+	io.Reader
+	buckets []*TokenBucket
+}
+
+// NewBucketReader restricts all Read operations on r to the rates of buckets.
+// Nil buckets are ignored.
+func NewBucketReader(r io.Reader, buckets ...*TokenBucket) *BucketReader {
+	return &BucketReader{r, buckets}
+}
+
+// Read reads up to len(p) bytes, and then waits until the bytes read are
+// allowed by the buckets. Holding back the reader lets TCP flow control slow
+// down the sender.
+func (r *BucketReader) Read(p []byte) (n int, err error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err = r.Reader.Read(p)
+	for _, b := range r.buckets {
+		b.Wait(n)
+	}
+	return
+}
@@ -1,20 +1,68 @@
 package p2p
 
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+)
+
 //----------------------------------------
 // 一个文件的元数据信息
 type FileDict struct {
-	Length int64  `json:"length"`
-	Path   string `json:"path"`
-	Name   string `json:"name"`
-	Sum    string `json:"sum"`
+	Length  int64  `json:"length"`
+	Path    string `json:"path"`
+	Name    string `json:"name"`
+	Sum     string `json:"sum"`
+	Offset  int64  `json:"offset,omitempty"`  // 只分发文件中的一段数据时，数据在文件中的偏移
+	Partial bool   `json:"partial,omitempty"` // 只分发文件中的一段数据，不会截断文件
+	Mode    uint32 `json:"mode,omitempty"`    // 文件的权限位，下载完成后恢复
+	ModTime int64  `json:"modTime,omitempty"` // 文件的修改时间，Unix秒，下载完成后恢复
+	Link    string `json:"link,omitempty"`    // 软链接指向的相对路径，Length为0，下载完成后创建软链接
+	Same    string `json:"same,omitempty"`    // 与任务中该名称的文件内容相同，Length为0，下载完成后创建硬链接或复制
+}
+
+// Sum为摘要的原始字节，JSON中使用十六进制，否则不是UTF-8的字节会被替换
+func (fd FileDict) MarshalJSON() ([]byte, error) {
+	type fileDict FileDict
+	return json.Marshal(&struct {
+		*fileDict
+		Sum string `json:"sum"`
+	}{(*fileDict)(&fd), hex.EncodeToString([]byte(fd.Sum))})
+}
+
+func (fd *FileDict) UnmarshalJSON(data []byte) error {
+	type fileDict FileDict
+	v := &struct {
+		*fileDict
+		Sum string `json:"sum"`
+	}{fileDict: (*fileDict)(fd)}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	if sum, err := hex.DecodeString(v.Sum); err == nil {
+		fd.Sum = string(sum)
+	} else {
+		// 旧版本的元数据，Sum没有编码
+		fd.Sum = v.Sum
+	}
+	return nil
 }
 
 // 一个任务内所有文件的元数据信息
 type MetaInfo struct {
-	Length   int64       `json:"length"`
-	PieceLen int64       `json:"PieceLen"`
-	Pieces   []byte      `json:"pieces"`
-	Files    []*FileDict `json:"files"`
+	Length       int64       `json:"length"`
+	PieceLen     int64       `json:"PieceLen"`
+	Pieces       []byte      `json:"pieces"`
+	Files        []*FileDict `json:"files"`
+	Hash         string      `json:"hash,omitempty"`         // 摘要算法，为空时为sha1
+	AlignFiles   bool        `json:"alignFiles,omitempty"`   // 每个文件从Piece边界开始
+	Signature    []byte      `json:"signature,omitempty"`    // 对Fingerprint的ed25519签名
+	PadLastPiece bool        `json:"padLastPiece,omitempty"` // 最后一个Piece补0到PieceLen再传输与计算摘要
+	WebSeeds     []string    `json:"webSeeds,omitempty"`     // HTTP(S)源站地址，没有可用的Peer时通过Range请求下载
+	NoCompress   bool        `json:"noCompress,omitempty"`   // 已压缩的文件，传输时不再压缩块数据
+	EncryptKey   []byte      `json:"encryptKey,omitempty"`   // 节点之间使用AES-GCM加密块数据的密钥，不参与指纹计算
+	BundleSize   int64       `json:"bundleSize,omitempty"`   // 长度小于该值的连续文件打包传输，Agent写入同一个文件，下载完成后解包
+	Upgrade      bool        `json:"upgrade,omitempty"`      // 文件为Agent的新版本程序，参与签名，Agent只安装带有该标记的元数据
 }
 
 // 下发给Agent的分发任务
@@ -23,6 +71,59 @@ type DispatchTask struct {
 	MetaInfo  *MetaInfo  `json:"metaInfo"`
 	LinkChain *LinkChain `json:"linkChain"`
 	Speed     int64      `json:"speed"`
+
+	// Agent上旧版本文件所在的目录，相同的Piece从本地复制，不再下载
+	PreviousPath string `json:"previousPath,omitempty"`
+
+	// 种子节点在元数据中的路径上已有完整的文件，校验后与服务端一起作为源头上传，不下载
+	Seed bool `json:"seed,omitempty"`
+	// 种子节点信任已有的文件，只检查长度与修改时间，不重新计算所有Piece的摘要
+	TrustSeed bool `json:"trustSeed,omitempty"`
+	// TrustSeed时随机抽样校验的Piece百分比，0表示不抽样
+	SeedSample int `json:"seedSample,omitempty"`
+
+	// 按顺序下载Piece，下载过程中可以读取从文件开头连续完成的数据
+	Sequential bool `json:"sequential,omitempty"`
+
+	// 文件的下载优先级，键为元数据中的文件名或path.Match的模式，越大越先下载，没有匹配的文件为0
+	FilePriorities map[string]int `json:"filePriorities,omitempty"`
+
+	// 下载的数据只保存在Agent的内存中，不写入磁盘，通过stream接口读取
+	InMemory bool `json:"inMemory,omitempty"`
+
+	// 下载完成并写入磁盘后依次执行，全部成功后才上报完成
+	Hooks []*Hook `json:"hooks,omitempty"`
+
+	// 没有MetaInfo时，Agent按任务URI从服务端或Peer获取元数据
+	URI string `json:"uri,omitempty"`
+
+	// 下载目录的模板，Agent接收任务时替换变量，为空时下载到Agent配置的目录
+	DestDir string `json:"destDir,omitempty"`
+
+	// 下载完成后继续给其它节点上传的时间，单位为秒，为0时使用Agent的配置
+	SeedLinger int `json:"seedLinger,omitempty"`
+
+	// 复制模式，只下载Server在上报响应中分配的Piece，完成后上报并等待新的分配
+	Replicate bool `json:"replicate,omitempty"`
+
+	// 任务的剩余时间，单位为秒，超过后Agent上报失败并删除未完成的文件，Server不可用时不会遗留任务。
+	// 为0时使用Agent的配置，两者都配置时取较小的值
+	Ttl int `json:"ttl,omitempty"`
+
+	// 上报最终状态时带上传输报告，由Server汇总
+	PushReport bool `json:"pushReport,omitempty"`
+
+	// 下载的唯一文件是Agent的新版本程序，下载完成后替换Agent的程序文件并重启。元数据需要签名
+	Upgrade bool `json:"upgrade,omitempty"`
+
+	// 校验通过的数据按顺序写入该命令的标准输入，不写入磁盘，如["tar","-x"]。命令需要在Agent配置的hookCommands中
+	Pipe []string `json:"pipe,omitempty"`
+
+	// Server上任务的追踪上下文，Agent上的Span作为其子Span，没有启用追踪时为空
+	TraceParent string `json:"traceParent,omitempty"`
+
+	// 本节点的调用方通过CreateTaskContext设置，不下发
+	ctx context.Context
 }
 
 // 下发给Agent的分发任务
@@ -31,12 +132,129 @@ type StartTask struct {
 	LinkChain *LinkChain `json:"linkChain"`
 }
 
+// 任务的下载进度
+type TaskProgress struct {
+	TaskId      string          `json:"taskId"`
+	TotalBytes  int64           `json:"totalBytes"`
+	BytesDone   int64           `json:"bytesDone"`
+	PiecesDone  int             `json:"piecesDone"`
+	PiecesTotal int             `json:"piecesTotal"`
+	Speed       int64           `json:"speed"` // 最近的下载速率，单位为字节每秒
+	ETA         float64         `json:"eta"`   // 预计剩余的下载时间，单位为秒，速率为0时为-1
+	Peers       []*PeerProgress `json:"peers,omitempty"`
+
+	Status    string       `json:"status"`              // INIT、INPROGRESS、PAUSED、COMPLETED或FAILED
+	Error     string       `json:"error,omitempty"`     // 任务失败的原因
+	ErrorCode string       `json:"errorCode,omitempty"` // 任务失败的错误码，如NO_SPACE、PEER_UNREACHABLE
+	Files     []string     `json:"files,omitempty"`
+	Checks    []*FileCheck `json:"checks,omitempty"` // 已完成校验的文件
+}
+
+// 下载完成的文件按元数据中的摘要校验的结果
+type FileCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`          // VERIFIED或FAILED
+	Error  string `json:"error,omitempty"` // 校验失败的原因
+	Code   string `json:"code,omitempty"`  // 校验失败的错误码，如CHECKSUM_MISMATCH
+}
+
+// 每个Peer传输的字节数
+type PeerProgress struct {
+	Address       string `json:"address"`
+	Downloaded    uint64 `json:"downloaded"`              // 从该Peer下载的字节数
+	Uploaded      uint64 `json:"uploaded"`                // 上传给该Peer的字节数
+	CorruptPieces int    `json:"corruptPieces,omitempty"` // 该Peer发送的校验失败的Piece数
+	Timeouts      int    `json:"timeouts,omitempty"`      // 向该Peer请求超时的次数
+	Abandons      int    `json:"abandons,omitempty"`      // 下载速率低于minPeerSpeed被放弃的次数
+}
+
+// 校验已下载文件的结果
+type VerifyResult struct {
+	TaskId      string          `json:"taskId"`
+	PiecesTotal int             `json:"piecesTotal"`
+	BadPieces   []int           `json:"badPieces,omitempty"`
+	BadRanges   []*CorruptRange `json:"badRanges,omitempty"`
+	Repairing   bool            `json:"repairing"` // 正在从Peer重新下载损坏的Piece
+}
+
+// 损坏的数据在文件中的范围
+type CorruptRange struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// 运行时调整传输速率，单位为MiBps，0表示不限制
+type SpeedLimit struct {
+	TaskId   string `json:"taskId,omitempty"` // 为空时调整所有任务总的速率
+	Upload   int    `json:"upload"`
+	Download int    `json:"download"`
+}
+
 // 分发路径
 type LinkChain struct {
 	// 软件分发的路径，要求服务端的地址排在第一个
 	DispatchAddrs []string `json:"dispatchAddrs"`
 	// 服务端管理接口，用于上报状态
 	ServerAddr string `json:"serverAddr"`
+	// 备用的服务端管理接口，ServerAddr不可达时依次尝试
+	BackupAddrs []string `json:"backupAddrs,omitempty"`
+	// 服务端接收UDP上报的地址，为空时只使用HTTP上报
+	AnnounceAddr string `json:"announceAddr,omitempty"`
+	// 种子节点的数据地址。DispatchAddrs中的Agent按顺序轮流分到服务端与各种子节点为源头的分支，
+	// 每个分支内依次连接上一个节点
+	SeedAddrs []string `json:"seedAddrs,omitempty"`
+	// DispatchAddrs中每个节点所在的zone，为空时不区分
+	Zones []string `json:"zones,omitempty"`
+	// 每个zone中从其它zone下载的节点数
+	ZoneBridges int `json:"zoneBridges,omitempty"`
+	// leech模式的Agent的数据地址，不接受其它节点的连接，不作为上游
+	Leeches []string `json:"leeches,omitempty"`
+	// 只能通过中继连接的Agent的数据地址与所用中继的地址
+	Relays map[string]string `json:"relays,omitempty"`
+	// 为chain或tree时Agent按DispatchAddrs的顺序排成流水线或树，每个节点只从一个上游下载，
+	// 不交换PEX，为空时按分支连接
+	Topology string `json:"topology,omitempty"`
+	// tree时每个节点的下游数
+	Fanout int `json:"fanout,omitempty"`
+}
+
+// Agent创建任务的响应
+type CreateTaskRsp struct {
+	Zone string `json:"zone,omitempty"`
+	Mode string `json:"mode,omitempty"` // leech模式的Agent不作为其它节点的上游
+}
+
+// Agent启动后向Server注册，之后定期发送相同的内容作为心跳
+type AgentHeartbeat struct {
+	IP       string            `json:"ip"` // 为空或未指定的地址时，Server使用请求的来源地址
+	MgntPort int               `json:"mgntPort"`
+	DataPort int               `json:"dataPort"`
+	Zone     string            `json:"zone,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`   // 创建任务时按标签选择Agent
+	Mode     string            `json:"mode,omitempty"`     // seed或leech，seed模式的Agent不作为下载的目的节点
+	External string            `json:"external,omitempty"` // NAT映射后的外部数据地址，Server分发时其它节点连接该地址
+	DataAddr string            `json:"dataAddr,omitempty"` // 配置了advertise或dataIP时其它节点连接的数据地址，没有External时使用
+	Relay    string            `json:"relay,omitempty"`    // 注册的中继地址，其它节点通过该中继连接本节点
+	Capacity *AgentCapacity    `json:"capacity"`
+
+	ProtocolVersion int                `json:"protocolVersion,omitempty"` // Agent的协议版本，旧版本没有上报
+	Capabilities    *AgentCapabilities `json:"capabilities,omitempty"`    // Agent支持的功能，旧版本没有上报
+}
+
+// Agent当前接收任务的能力
+type AgentCapacity struct {
+	MaxActive     int   `json:"maxActive"`
+	ActiveTasks   int   `json:"activeTasks"`
+	DiskFree      int64 `json:"diskFree"`                // 下载目录的可用空间，查询失败时为-1
+	MemoryStore   int64 `json:"memoryStore"`             // 只在内存中保存的任务还可以使用的空间
+	Peers         int   `json:"peers"`                   // 所有任务的Peer连接数
+	UnderPressure bool  `json:"underPressure,omitempty"` // 因内存或磁盘压力暂停了下载
+}
+
+// 上报状态的所有地址，ServerAddr排在第一个
+func (lc *LinkChain) reportAddrs() []string {
+	return append([]string{lc.ServerAddr}, lc.BackupAddrs...)
 }
 
 // 连接认证消息头
@@ -46,6 +264,9 @@ type Header struct {
 	Username string
 	Passowrd string
 	Salt     string
+	Codecs   string // 发起端支持的压缩算法，逗号分隔
+	Features string // 发起端支持的其它功能，如复用连接
+	Version  string // 发起端的协议版本
 }
 
 // Agent分发状态上报
@@ -53,4 +274,34 @@ type StatusReport struct {
 	TaskId          string  `json:"taskId"`
 	IP              string  `json:"ip"`
 	PercentComplete float32 `json:"percentComplete"`
+	Leaving         bool    `json:"leaving,omitempty"`   // Agent退出，未完成的任务不再下载
+	Speed           int64   `json:"speed,omitempty"`     // 最近的下载速率，单位为字节每秒
+	Error           string  `json:"error,omitempty"`     // 失败的原因
+	ErrorCode       string  `json:"errorCode,omitempty"` // 失败的错误码，如NO_SPACE
+	Have            []byte  `json:"have,omitempty"`      // 已下载Piece的位图
+
+	Transfer *TransferReport `json:"transfer,omitempty"` // 任务要求汇总时，完成或失败的上报带上传输报告
+
+	BadPeers []string `json:"badPeers,omitempty"` // 发送的坏Piece达到Control.BadPeerPieces，本节点不再连接的Peer
+
+	Files []*FileCheck `json:"files,omitempty"` // 上次上报之后完成校验的文件，完成或失败的上报带上所有文件
+
+	TraceParent string `json:"traceParent,omitempty"` // 上报的追踪上下文，Server处理上报的Span作为其子Span
+
+	ProtocolVersion int                `json:"protocolVersion,omitempty"` // Agent的协议版本，旧版本没有上报
+	Capabilities    *AgentCapabilities `json:"capabilities,omitempty"`    // Agent支持的功能，旧版本没有上报
+}
+
+// 上报带有位图时，Server返回所有上报过的Agent中拥有每个Piece的个数，
+// 新加入的节点优先下载副本少的Piece
+type AnnounceResponse struct {
+	Availability []int    `json:"availability"`
+	Seeds        []string `json:"seeds,omitempty"`    // 下载完成后继续上传的Agent的数据地址，上游的节点不可用时连接
+	BadPeers     []string `json:"badPeers,omitempty"` // 被任一Agent上报发送坏Piece的Peer，选择上游时排在最后
+	Assign       []int    `json:"assign,omitempty"`   // 复制模式下分配给上报的Agent下载的Piece
+}
+
+// 上报中的协议版本是否仍然兼容，没有上报版本的旧Agent为版本1
+func CompatibleVersion(v int) bool {
+	return v == 0 || v >= MIN_PROTOCOL_VERSION
 }
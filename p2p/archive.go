@@ -0,0 +1,133 @@
+package p2p
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 归档文件中第一个条目，保存元数据
+	ArchiveMetaName = ".gofd-meta.json"
+)
+
+// 把元数据与所有文件打包成一个tar归档，第一个条目为元数据，之后按元数据中的顺序保存每个文件，
+// 用于不经过P2P，直接通过HTTP等方式分发
+func WriteArchive(w io.Writer, fs FileStore, mi *MetaInfo) (err error) {
+	meta, err := json.Marshal(mi)
+	if err != nil {
+		return
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	if err = tw.WriteHeader(&tar.Header{
+		Name:    ArchiveMetaName,
+		Mode:    0644,
+		Size:    int64(len(meta)),
+		ModTime: now,
+	}); err != nil {
+		return
+	}
+	if _, err = tw.Write(meta); err != nil {
+		return
+	}
+
+	offsets, _ := mi.fileOffsets()
+	// 按Piece长度读取，fs读取时校验Piece的摘要时每个Piece最多计算两次
+	buf := make([]byte, mi.PieceLen)
+	for i, fd := range mi.Files {
+		if err = tw.WriteHeader(&tar.Header{
+			Name:    fd.Name,
+			Mode:    0644,
+			Size:    fd.Length,
+			ModTime: now,
+		}); err != nil {
+			return
+		}
+		if _, err = io.CopyBuffer(tw, io.NewSectionReader(fs, offsets[i], fd.Length), buf); err != nil {
+			common.DefaultLogger().Errorf("Write file to archive failed, file=%s, error=%v", fd.Name, err)
+			return
+		}
+	}
+	return tw.Close()
+}
+
+// 读取WriteArchive生成的归档，把文件解压到dir目录下，并按元数据校验所有的Piece
+func ReadArchive(r io.Reader, dir string) (mi *MetaInfo, err error) {
+	tr := tar.NewReader(r)
+	h, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("Read archive header failed: %v", err)
+	}
+	if h.Name != ArchiveMetaName {
+		return nil, fmt.Errorf("Invalid archive, first entry is %s", h.Name)
+	}
+	mi = &MetaInfo{}
+	if err = json.NewDecoder(tr).Decode(mi); err != nil {
+		return nil, fmt.Errorf("Decode archive metainfo failed: %v", err)
+	}
+
+	for _, fd := range mi.Files {
+		if h, err = tr.Next(); err != nil {
+			return nil, fmt.Errorf("Read archive entry %s failed: %v", fd.Name, err)
+		}
+		if h.Name != fd.Name || h.Size != fd.Length {
+			return nil, fmt.Errorf("Unexpected archive entry %s(%v), expected %s(%v)", h.Name, h.Size, fd.Name, fd.Length)
+		}
+		if err = checkFileName(fd.Name); err != nil {
+			return nil, err
+		}
+		if err = checkInsideDir(dir, fd.Name); err != nil {
+			return nil, err
+		}
+		fd.Path = dir
+		if err = extractFile(tr, localPath(dir, fd.Name), fd.Length); err != nil {
+			return nil, err
+		}
+		// 文件中的一段数据被解压为单独的文件
+		fd.Offset, fd.Partial = 0, false
+	}
+
+	if err = verifyFiles(mi); err != nil {
+		return nil, err
+	}
+	return mi, nil
+}
+
+func extractFile(r io.Reader, file string, length int64) error {
+	if err := ensureDirectory(file); err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(f, r, length)
+	return err
+}
+
+// 按元数据校验本地文件的所有Piece
+func verifyFiles(mi *MetaInfo) error {
+	fs, totalSize, err := NewFileStore(mi, &fileSystemAdapter{}, common.DefaultLogger())
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	good, bad, _, err := checkPieces(fs, totalSize, mi, 0)
+	if err != nil {
+		return err
+	}
+	if bad > 0 {
+		return errors.New(fmt.Sprint("Verify pieces failed, good ", good, ", bad ", bad))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package p2p
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// 软链接只能指向下载目录内的相对路径
+func checkLinkTarget(name, target string) error {
+	if isAbsSlash(target) {
+		return fmt.Errorf("Invalid symlink %s, target %s is absolute", name, target)
+	}
+	if err := checkFileName(path.Join(path.Dir(name), target)); err != nil {
+		return fmt.Errorf("Invalid symlink %s to %s: %v", name, target, err)
+	}
+	return nil
+}
+
+// 下载完成后恢复文件的权限位与修改时间，并创建软链接与内容重复的文件。失败时只记录日志，不影响下载结果
+func (s *P2pSession) restoreAttrs() {
+	if s.noDisk() {
+		return
+	}
+	for _, fd := range s.task.MetaInfo.Files {
+		file := s.currentPath(fd.Name)
+		if fd.Link != "" {
+			if err := restoreLink(file, filepath.FromSlash(fd.Link)); err != nil {
+				s.log.Warnf("Create symlink failed, file=%s, error=%v", file, err)
+			}
+			continue
+		}
+		if fd.Partial {
+			// 文件的其它部分不属于该任务
+			continue
+		}
+		if fd.Same != "" {
+			linked, err := restoreSame(file, s.currentPath(fd.Same))
+			if err != nil {
+				s.log.Warnf("Create duplicate file failed, file=%s, same=%s, error=%v", file, fd.Same, err)
+				continue
+			}
+			if linked {
+				// 硬链接与原文件共用权限位与修改时间
+				continue
+			}
+		}
+		if fd.Mode != 0 {
+			if err := os.Chmod(file, os.FileMode(fd.Mode)&os.ModePerm); err != nil {
+				s.log.Warnf("Restore file mode failed, file=%s, error=%v", file, err)
+			}
+		}
+		if fd.ModTime != 0 {
+			mt := time.Unix(fd.ModTime, 0)
+			if err := os.Chtimes(file, mt, mt); err != nil {
+				s.log.Warnf("Restore file mtime failed, file=%s, error=%v", file, err)
+			}
+		}
+	}
+}
+
+// 已存在相同的软链接时不修改，已存在的文件被替换为软链接
+func restoreLink(file, target string) error {
+	if fi, err := os.Lstat(file); err == nil {
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if old, err := os.Readlink(file); err == nil && old == target {
+				return nil
+			}
+		}
+		if fi.IsDir() {
+			return fmt.Errorf("%s is a directory", file)
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	if err := ensureDirectory(file); err != nil {
+		return err
+	}
+	return os.Symlink(target, file)
+}
@@ -0,0 +1,305 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gokits"
+)
+
+const (
+	benchTaskId  = "gofd-bench"
+	benchAddress = "127.0.0.1"
+)
+
+// 进程内的性能基准测试：一个源头节点与多个下载节点在本机回环地址上分发生成的随机数据，
+// 用于比较性能相关修改前后的结果，不需要部署Server与Agent
+type BenchOptions struct {
+	Leechers  int           // 下载节点数
+	Files     int           // 生成的文件数
+	FileSize  int64         // 每个文件的字节数
+	Profile   *Profile      // 为nil时按总大小选择Piece长度
+	InMemory  bool          // 下载节点只在内存中保存数据，不写入磁盘
+	Transport string        // 节点之间的传输方式，如unix，为空时使用TCP
+	Dir       string        // 生成的数据与各节点的下载目录所在的目录，为空时使用临时目录，结束后删除
+	Timeout   time.Duration // 为0时不限制
+	Log       common.Logger // 为nil时丢弃日志
+}
+
+type BenchResult struct {
+	Leechers   int   `json:"leechers"`
+	TotalBytes int64 `json:"totalBytes"` // 每个下载节点下载的字节数
+	PieceLen   int64 `json:"pieceLen"`
+	Pieces     int   `json:"pieces"`
+
+	MetaSeconds float64 `json:"metaSeconds"` // 创建元数据的时间，包括计算所有摘要
+
+	Seconds        float64   `json:"seconds"`        // 开始分发到所有下载节点完成的时间
+	Throughput     float64   `json:"throughput"`     // 所有下载节点合计的下载速率，单位为MB/s
+	LeecherSeconds []float64 `json:"leecherSeconds"` // 每个下载节点完成的时间，从快到慢排列
+
+	VerifySeconds float64 `json:"verifySeconds"` // 按元数据校验一份数据的时间
+	VerifyRate    float64 `json:"verifyRate"`    // 每秒校验的Piece数
+	HashRate      float64 `json:"hashRate"`      // 校验的速率，包括读取数据，单位为MB/s
+	HashImpl      string  `json:"hashImpl"`      // 摘要算法的实现
+
+	Allocs     uint64  `json:"allocs"`     // 分发期间的内存分配次数
+	AllocBytes uint64  `json:"allocBytes"` // 分发期间分配的字节数
+	NumGC      uint32  `json:"numGC"`      // 分发期间的GC次数
+	GCPauseMs  float64 `json:"gcPauseMs"`  // 分发期间GC暂停的总时间
+}
+
+// 下载节点完成或失败时通知一次
+type benchListener struct {
+	once sync.Once
+	done chan<- *TaskProgress
+}
+
+func (l *benchListener) OnProgress(p *TaskProgress) {
+	if p.Status == "COMPLETED" || p.Status == "FAILED" {
+		l.once.Do(func() { l.done <- p })
+	}
+}
+
+// 运行一次基准测试，所有下载节点完成后返回结果，任一节点失败或超时时返回错误
+func RunBench(opts *BenchOptions) (*BenchResult, error) {
+	if opts.Leechers <= 0 || opts.Files <= 0 || opts.FileSize <= 0 {
+		return nil, errors.New("Leechers, files and file size should be greater than 0")
+	}
+	l := opts.Log
+	if l == nil {
+		l = common.NewSlogLogger(slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+	}
+
+	dir, err := ioutil.TempDir(opts.Dir, "gofd-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "source")
+	files, err := benchFiles(srcDir, opts.Files, opts.FileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	mi, err := CreateFileMetaWithOptions(files, &CreateOptions{Profile: opts.Profile})
+	if err != nil {
+		return nil, err
+	}
+	r := &BenchResult{Leechers: opts.Leechers, TotalBytes: opts.FileSize * int64(opts.Files), PieceLen: mi.PieceLen,
+		MetaSeconds: time.Now().Sub(start).Seconds(), HashImpl: HashImpl(mi.Hash)}
+	// 每个节点使用独立的元数据，下载节点会修改文件的路径
+	metaJSON, err := json.Marshal(mi)
+	if err != nil {
+		return nil, err
+	}
+
+	// 接收下载节点的状态上报，不作处理
+	ln, err := net.Listen("tcp", common.JoinHostPort(benchAddress, 0))
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(ioutil.Discard, req.Body)
+	}))
+	mgntPort := ln.Addr().(*net.TCPAddr).Port
+
+	done := make(chan *TaskProgress, opts.Leechers)
+	nodes := make([]*P2pSessionMgnt, 0, opts.Leechers+1)
+	defer func() {
+		for _, sm := range nodes {
+			sm.Stop()
+		}
+	}()
+	lc := &LinkChain{ServerAddr: common.JoinHostPort(benchAddress, mgntPort)}
+	for i := 0; i <= opts.Leechers; i++ {
+		cfg, err := benchConfig(i == 0, filepath.Join(dir, "node"+strconv.Itoa(i)), mgntPort, r.TotalBytes, opts)
+		if err != nil {
+			return nil, err
+		}
+		sm := NewSessionMgnt(cfg, l)
+		if i > 0 {
+			sm.SetProgressListener(&benchListener{done: done})
+		}
+		started := make(chan error, 1)
+		go func() { started <- sm.Start() }()
+		select {
+		case err = <-started:
+			return nil, fmt.Errorf("Start node %d failed: %v", i, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		nodes = append(nodes, sm)
+		lc.DispatchAddrs = append(lc.DispatchAddrs, cfg.DataAddr())
+	}
+
+	for i, sm := range nodes {
+		dt := &DispatchTask{TaskId: benchTaskId, InMemory: opts.InMemory && i > 0}
+		if err = json.Unmarshal(metaJSON, &dt.MetaInfo); err != nil {
+			return nil, err
+		}
+		dt.LinkChain = lc
+		sm.CreateTask(dt)
+	}
+	// 所有节点初始化完成后再开始
+	for _, sm := range nodes {
+		if err = benchWaitInited(sm, 10*time.Second); err != nil {
+			return nil, err
+		}
+	}
+	r.Pieces = int((r.TotalBytes + mi.PieceLen - 1) / mi.PieceLen)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start = time.Now()
+	for _, sm := range nodes {
+		sm.StartTask(&StartTask{TaskId: benchTaskId, LinkChain: lc})
+	}
+	var timeout <-chan time.Time
+	if opts.Timeout > 0 {
+		timeout = time.After(opts.Timeout)
+	}
+	for len(r.LeecherSeconds) < opts.Leechers {
+		select {
+		case tp := <-done:
+			if tp.Status != "COMPLETED" {
+				return nil, fmt.Errorf("Leecher failed: %s", tp.Error)
+			}
+			r.LeecherSeconds = append(r.LeecherSeconds, time.Now().Sub(start).Seconds())
+		case <-timeout:
+			return nil, fmt.Errorf("Timeout after %v, %d of %d leechers completed", opts.Timeout,
+				len(r.LeecherSeconds), opts.Leechers)
+		}
+	}
+	r.Seconds = time.Now().Sub(start).Seconds()
+	runtime.ReadMemStats(&after)
+	sort.Float64s(r.LeecherSeconds)
+	r.Throughput = float64(r.TotalBytes) * float64(opts.Leechers) / r.Seconds / 1024 / 1024
+	r.Allocs = after.Mallocs - before.Mallocs
+	r.AllocBytes = after.TotalAlloc - before.TotalAlloc
+	r.NumGC = after.NumGC - before.NumGC
+	r.GCPauseMs = float64(after.PauseTotalNs-before.PauseTotalNs) / 1e6
+
+	// 校验源头节点的数据，内容与下载节点相同
+	start = time.Now()
+	vr, err := VerifyDir(mi, srcDir, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(vr.BadPieces) > 0 {
+		return nil, fmt.Errorf("Verify found %d bad pieces", len(vr.BadPieces))
+	}
+	r.VerifySeconds = time.Now().Sub(start).Seconds()
+	if r.VerifySeconds > 0 {
+		r.VerifyRate = float64(vr.PiecesTotal) / r.VerifySeconds
+		r.HashRate = float64(r.TotalBytes) / r.VerifySeconds / 1024 / 1024
+	}
+	return r, nil
+}
+
+// 生成随机内容的文件，不能压缩也不会重复
+func benchFiles(dir string, n int, size int64) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	files := make([]string, n)
+	for i := range files {
+		files[i] = filepath.Join(dir, "file"+strconv.Itoa(i))
+		f, err := os.Create(files[i])
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(f, rnd, size)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// 节点的配置，第一个节点作为源头，使用服务端的配置
+func benchConfig(server bool, dir string, mgntPort int, totalBytes int64, opts *BenchOptions) (*common.Config, error) {
+	port, err := benchFreePort()
+	if err != nil {
+		return nil, err
+	}
+	factor := gokits.NewRand(8)
+	crc := gokits.KermitStr(factor)
+	crypto, err := gokits.NewCrypto(factor, crc)
+	if err != nil {
+		return nil, err
+	}
+	passwd, err := crypto.EncryptStr(benchTaskId)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &common.Config{Server: server, Name: filepath.Base(dir), DownDir: dir}
+	cfg.Net.IP = benchAddress
+	cfg.Net.MgntPort = mgntPort
+	cfg.Net.DataPort = port
+	cfg.Net.Transport, cfg.Net.SocketDir = opts.Transport, filepath.Dir(dir)
+	cfg.Auth.Username, cfg.Auth.Passowrd, cfg.Auth.Factor, cfg.Auth.Crc = "gofd", passwd, factor, crc
+	cfg.Control = &common.Control{}
+	if server {
+		cfg.Net.AgentMgntPort, cfg.Net.AgentDataPort = mgntPort, port
+	} else if opts.InMemory {
+		cfg.Control.MemoryStore = int(totalBytes/1024/1024) + 1
+	}
+	if err = cfg.Init(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func benchFreePort() (int, error) {
+	ln, err := net.Listen("tcp", common.JoinHostPort(benchAddress, 0))
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Session初始化完成后才能查询进度
+func benchWaitInited(sm *P2pSessionMgnt, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		inited := make(chan bool, 1)
+		go func() {
+			_, ok := sm.Progress(benchTaskId)
+			inited <- ok
+		}()
+		select {
+		case ok := <-inited:
+			if ok {
+				return nil
+			}
+		case <-deadline:
+			return errors.New("Timeout waiting for the task to be inited")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,156 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	// 解码时列表与字典嵌套的最大层数
+	MAX_BENCODE_DEPTH = 32
+)
+
+var errBencodeTruncated = errors.New("Bencode data is truncated")
+
+// bencode编码，只支持.torrent文件用到的整数、字符串、列表与字典，字典的键按字节序排列
+func bencodeValue(b *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case int:
+		fmt.Fprintf(b, "i%de", v)
+	case int64:
+		fmt.Fprintf(b, "i%de", v)
+	case string:
+		fmt.Fprintf(b, "%d:", len(v))
+		b.WriteString(v)
+	case []byte:
+		fmt.Fprintf(b, "%d:", len(v))
+		b.Write(v)
+	case []string:
+		b.WriteByte('l')
+		for _, s := range v {
+			bencodeValue(b, s)
+		}
+		b.WriteByte('e')
+	case []interface{}:
+		b.WriteByte('l')
+		for _, e := range v {
+			if err := bencodeValue(b, e); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('d')
+		for _, k := range keys {
+			bencodeValue(b, k)
+			if err := bencodeValue(b, v[k]); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('e')
+	default:
+		return fmt.Errorf("Unsupported bencode type %T", v)
+	}
+	return nil
+}
+
+// 解码为int64、string、[]interface{}与map[string]interface{}
+func bdecode(data []byte) (interface{}, error) {
+	d := &bdecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("Unexpected bencode data at %v", d.pos)
+	}
+	return v, nil
+}
+
+type bdecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *bdecoder) value(depth int) (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, errBencodeTruncated
+	}
+	if depth > MAX_BENCODE_DEPTH {
+		return nil, errors.New("Bencode data is nested too deep")
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, errBencodeTruncated
+		}
+		n, err := strconv.ParseInt(string(d.data[d.pos+1:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bencode integer at %v", d.pos)
+		}
+		d.pos += end + 1
+		return n, nil
+	case c >= '0' && c <= '9':
+		return d.str()
+	case c == 'l':
+		d.pos++
+		l := []interface{}{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			e, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, e)
+		}
+		if d.pos >= len(d.data) {
+			return nil, errBencodeTruncated
+		}
+		d.pos++
+		return l, nil
+	case c == 'd':
+		d.pos++
+		m := make(map[string]interface{})
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			k, err := d.str()
+			if err != nil {
+				return nil, err
+			}
+			if m[k], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		if d.pos >= len(d.data) {
+			return nil, errBencodeTruncated
+		}
+		d.pos++
+		return m, nil
+	default:
+		return nil, fmt.Errorf("Invalid bencode data at %v", d.pos)
+	}
+}
+
+func (d *bdecoder) str() (string, error) {
+	colon := bytes.IndexByte(d.data[d.pos:], ':')
+	if colon < 0 {
+		return "", errBencodeTruncated
+	}
+	n, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("Invalid bencode string length at %v", d.pos)
+	}
+	start := d.pos + colon + 1
+	if n > len(d.data)-start {
+		return "", errBencodeTruncated
+	}
+	d.pos = start + n
+	return string(d.data[start:d.pos]), nil
+}
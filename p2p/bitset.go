@@ -1,6 +1,6 @@
 package p2p
 
-import log "github.com/cihub/seelog"
+import "github.com/xtfly/gofd/common"
 
 // As defined by the bittorrent protocol, this bitset is big-endian, such that
 // the high bit of the first byte is block 0
@@ -59,7 +59,7 @@ func (b *Bitset) InRange(index int) bool {
 
 func (b *Bitset) checkRange(index int) {
 	if !b.InRange(index) {
-		log.Errorf("Index %d out of range 0..%d.", index, b.n)
+		common.DefaultLogger().Errorf("Index %d out of range 0..%d.", index, b.n)
 	}
 }
 
@@ -90,6 +90,14 @@ func (b *Bitset) FindNextClear(index int) int {
 	return -1
 }
 
+// 已设置的位数
+func (b *Bitset) Count() (n int) {
+	for i := b.FindNextSet(0); i >= 0; i = b.FindNextSet(i + 1) {
+		n++
+	}
+	return
+}
+
 func (b *Bitset) Bytes() []byte {
 	return b.b
 }
@@ -0,0 +1,68 @@
+package p2p
+
+import (
+	"time"
+)
+
+const (
+	// 自适应块大小时请求往返时间的目标
+	ADAPTIVE_BLOCK_RTT = 500 * time.Millisecond
+	// 每收到该个数的块调整一次
+	ADAPTIVE_BLOCK_SAMPLES = 8
+
+	STANDARD_BLOCK_UNITS = STANDARD_BLOCK_LENGTH / MIN_BLOCK_LENGTH
+	MAX_BLOCK_UNITS      = MAX_BLOCK_LENGTH / MIN_BLOCK_LENGTH
+)
+
+// 按往返时间调整向一个上游Peer请求的块大小，以MIN_BLOCK_LENGTH为单位。
+// 往返时间包含链路延迟与窗口中排在前面的请求的传输时间，吞吐低或丢包重传时变长：
+// 超过目标时块大小减半，请求超时后降到最小；低于目标的一半时增加一个单位，
+// 局域网上很快增大到MAX_BLOCK_LENGTH
+type blockSizer struct {
+	units   int
+	srtt    time.Duration // 平滑后的往返时间
+	samples int           // 上次调整后收到的块数
+}
+
+func newBlockSizer() *blockSizer {
+	return &blockSizer{units: STANDARD_BLOCK_UNITS}
+}
+
+func (b *blockSizer) received(rtt time.Duration) {
+	if b.srtt == 0 {
+		b.srtt = rtt
+	} else {
+		b.srtt = (7*b.srtt + rtt) / 8
+	}
+	b.samples++
+	if b.samples < ADAPTIVE_BLOCK_SAMPLES {
+		return
+	}
+	b.samples = 0
+	switch {
+	case b.srtt > ADAPTIVE_BLOCK_RTT && b.units > 1:
+		b.units /= 2
+	case b.srtt < ADAPTIVE_BLOCK_RTT/2 && b.units < MAX_BLOCK_UNITS:
+		b.units++
+	}
+}
+
+func (b *blockSizer) timedOut() {
+	b.units = 1
+	b.samples = 0
+}
+
+// 向Peer请求的块包含的单位数，没有开启adaptiveBlock时固定为STANDARD_BLOCK_LENGTH
+func (s *P2pSession) blockUnits(p *peer) int {
+	if !s.g.cfg.Control.AdaptiveBlock {
+		return STANDARD_BLOCK_UNITS
+	}
+	return p.blockSize.units
+}
+
+// 块所在的第一个单位与单位数
+func blockUnitsOf(begin, length int) (index, count int) {
+	index = begin / MIN_BLOCK_LENGTH
+	count = (begin+length+MIN_BLOCK_LENGTH-1)/MIN_BLOCK_LENGTH - index
+	return
+}
@@ -0,0 +1,128 @@
+package p2p
+
+import (
+	"sync"
+)
+
+const (
+	// 缓冲的大小按该粒度取整，取整后大小相同的缓冲才能复用
+	BUFFER_POOL_ALIGN = 4 * 1024
+	// 小于该大小的缓冲直接分配，不放入缓冲池
+	BUFFER_POOL_MIN_SIZE = 4 * 1024
+)
+
+// 所有任务共享的块与Piece读写缓冲，按大小分类保存用完的缓冲，减少高吞吐时的内存分配与GC。
+// 空闲缓冲的总大小不超过limit，超过时先淘汰最久没有使用的大小的缓冲，仍然超过时丢弃放回的缓冲
+type bufferPool struct {
+	lock    sync.Mutex
+	limit   int64
+	idle    int64 // 空闲缓冲的总大小
+	classes map[int]*bufferClass
+	clock   uint64 // 每次取用时递增，用于找出最久没有使用的大小
+	metrics *Metrics
+}
+
+type bufferClass struct {
+	free    [][]byte
+	lastUse uint64
+}
+
+// limit不大于0时不复用缓冲
+func newBufferPool(limit int64, metrics *Metrics) *bufferPool {
+	return &bufferPool{limit: limit, classes: make(map[int]*bufferClass), metrics: metrics}
+}
+
+func (bp *bufferPool) enabled() bool {
+	return bp != nil && bp.limit > 0
+}
+
+// 返回长度为n的缓冲，复用的缓冲中有之前的数据，调用方需要完整写入
+func (bp *bufferPool) get(n int) []byte {
+	if !bp.enabled() || n < BUFFER_POOL_MIN_SIZE {
+		return make([]byte, n)
+	}
+	size := (n + BUFFER_POOL_ALIGN - 1) &^ (BUFFER_POOL_ALIGN - 1)
+
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	bp.clock++
+	c, ok := bp.classes[size]
+	if !ok {
+		c = &bufferClass{}
+		bp.classes[size] = c
+	}
+	c.lastUse = bp.clock
+	hit := len(c.free) > 0
+	bp.metrics.bufferPoolGet(hit)
+	if !hit {
+		return make([]byte, n, size)
+	}
+	b := c.free[len(c.free)-1]
+	c.free[len(c.free)-1] = nil
+	c.free = c.free[:len(c.free)-1]
+	bp.idle -= int64(size)
+	bp.metrics.bufferPoolSize(bp.idle)
+	return b[:n]
+}
+
+// 放回get返回的缓冲，调用方之后不能再使用。不是缓冲池分配的大小时忽略
+func (bp *bufferPool) put(b []byte) {
+	size := cap(b)
+	if !bp.enabled() || size < BUFFER_POOL_MIN_SIZE || size%BUFFER_POOL_ALIGN != 0 || int64(size) > bp.limit {
+		return
+	}
+
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	for bp.idle+int64(size) > bp.limit {
+		if !bp.evictLocked(size) {
+			bp.metrics.bufferPoolSize(bp.idle)
+			bp.metrics.bufferPoolDiscarded()
+			return
+		}
+	}
+	c, ok := bp.classes[size]
+	if !ok {
+		c = &bufferClass{lastUse: bp.clock}
+		bp.classes[size] = c
+	}
+	c.free = append(c.free, b[:size])
+	bp.idle += int64(size)
+	bp.metrics.bufferPoolSize(bp.idle)
+}
+
+// 淘汰其它大小中最久没有使用的一个空闲缓冲，已结束任务的Piece大小不再占用空间
+func (bp *bufferPool) evictLocked(keep int) bool {
+	victim := 0
+	for size, c := range bp.classes {
+		if len(c.free) == 0 {
+			if size != keep {
+				delete(bp.classes, size)
+			}
+			continue
+		}
+		if size != keep && (victim == 0 || c.lastUse < bp.classes[victim].lastUse) {
+			victim = size
+		}
+	}
+	if victim == 0 {
+		return false
+	}
+	c := bp.classes[victim]
+	c.free[len(c.free)-1] = nil
+	c.free = c.free[:len(c.free)-1]
+	bp.idle -= int64(victim)
+	return true
+}
+
+// 块数据已写入存储，消息的缓冲可以复用
+func isPieceMessage(message []byte) bool {
+	if len(message) == 0 {
+		return false
+	}
+	switch message[0] {
+	case PIECE, PIECE_GZIP, PIECE_ZSTD, PIECE_SEALED:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package p2p
+
+import (
+	"testing"
+)
+
+func TestBufferPoolReuse(t *testing.T) {
+	m := NewMetrics()
+	bp := newBufferPool(64*1024, m)
+	b := bp.get(10000)
+	if len(b) != 10000 || cap(b) != 12*1024 {
+		t.Fatalf("len=%v, cap=%v, want 10000 rounded up to 12KB", len(b), cap(b))
+	}
+	bp.put(b)
+	if bp.idle != 12*1024 {
+		t.Fatalf("idle=%v after put", bp.idle)
+	}
+	// 取整后大小相同的缓冲可以复用
+	c := bp.get(12 * 1024)
+	if &c[0] != &b[0] || bp.idle != 0 {
+		t.Fatal("buffer of the same size class is not reused")
+	}
+	if m.bufferPoolGets != 2 || m.bufferPoolHits != 1 {
+		t.Fatalf("gets=%v, hits=%v", m.bufferPoolGets, m.bufferPoolHits)
+	}
+
+	// 太小或不是缓冲池分配的缓冲不放入缓冲池
+	bp.put(make([]byte, 100))
+	bp.put(make([]byte, 5000))
+	if bp.idle != 0 {
+		t.Fatalf("idle=%v after putting foreign buffers", bp.idle)
+	}
+}
+
+func TestBufferPoolLimit(t *testing.T) {
+	m := NewMetrics()
+	bp := newBufferPool(16*1024, m)
+	a, b := bp.get(8*1024), bp.get(8*1024)
+	big := bp.get(32 * 1024)
+	bp.put(a)
+	bp.put(b)
+	// 超过上限的缓冲直接丢弃
+	bp.put(big)
+	if bp.idle != 16*1024 {
+		t.Fatalf("idle=%v, want 16KB", bp.idle)
+	}
+
+	// 放回其它大小的缓冲时淘汰最久没有使用的大小
+	bp.put(bp.get(4 * 1024))
+	if bp.idle > bp.limit || len(bp.classes[8*1024].free) != 1 || len(bp.classes[4*1024].free) != 1 {
+		t.Fatalf("idle=%v, 8KB free=%v, want the oldest size evicted", bp.idle, len(bp.classes[8*1024].free))
+	}
+
+	// 只有同样大小的空闲缓冲时丢弃放回的缓冲
+	bp = newBufferPool(8*1024, m)
+	bp.put(bp.get(8 * 1024))
+	bp.put(make([]byte, 8*1024))
+	if bp.idle != 8*1024 || m.bufferPoolDiscards != 1 {
+		t.Fatalf("idle=%v, discards=%v", bp.idle, m.bufferPoolDiscards)
+	}
+}
+
+func TestBufferPoolDisabled(t *testing.T) {
+	var nilPool *bufferPool
+	for _, bp := range []*bufferPool{nilPool, newBufferPool(0, NewMetrics())} {
+		b := bp.get(8 * 1024)
+		if len(b) != 8*1024 {
+			t.Fatalf("len=%v", len(b))
+		}
+		bp.put(b)
+	}
+}
@@ -0,0 +1,114 @@
+package p2p
+
+import (
+	"errors"
+	"hash"
+	"sync"
+)
+
+// 边写边计算元数据，用于还在生成中的文件（如追加写的日志、构建中的制品）。
+// 写入的数据每凑满一个Piece就计算它的摘要，已完成的Piece可以先开始分发，Finish之后得到完整的元数据
+type MetaBuilder struct {
+	m sync.Mutex
+
+	file     string
+	pieceLen int64
+	hashName string
+	newHash  hashFunc
+
+	buf      []byte    // 还未凑满一个Piece的数据
+	fileHash hash.Hash // 整个文件的摘要
+	length   int64
+	pieces   []byte
+	finished bool
+}
+
+// 创建一个元数据生成器，file为最终文件的路径，pieceLen不能为0
+func NewMetaBuilder(file string, pieceLen int64, hashName string) (*MetaBuilder, error) {
+	if !validPieceLength(pieceLen) {
+		return nil, errors.New("Invalid piece length")
+	}
+	newHash, err := lookupHash(hashName)
+	if err != nil {
+		return nil, err
+	}
+	return &MetaBuilder{
+		file:     file,
+		pieceLen: pieceLen,
+		hashName: hashName,
+		newHash:  newHash,
+		buf:      make([]byte, 0, pieceLen),
+		fileHash: newHash(),
+	}, nil
+}
+
+// 实现io.Writer，凑满一个Piece时计算摘要
+func (b *MetaBuilder) Write(p []byte) (n int, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.finished {
+		return 0, errors.New("Meta builder is finished")
+	}
+
+	b.fileHash.Write(p)
+	b.length += int64(len(p))
+	n = len(p)
+	for len(p) > 0 {
+		space := int(b.pieceLen) - len(b.buf)
+		if space > len(p) {
+			space = len(p)
+		}
+		b.buf = append(b.buf, p[:space]...)
+		p = p[space:]
+		if int64(len(b.buf)) == b.pieceLen {
+			b.hashPiece()
+		}
+	}
+	return
+}
+
+func (b *MetaBuilder) hashPiece() {
+	h := b.newHash()
+	h.Write(b.buf)
+	b.pieces = h.Sum(b.pieces)
+	b.buf = b.buf[:0]
+}
+
+// 已经完成计算的Piece个数
+func (b *MetaBuilder) CompletedPieces() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return len(b.pieces) / b.newHash().Size()
+}
+
+// 已经完成计算的Piece的摘要
+func (b *MetaBuilder) Pieces() []byte {
+	b.m.Lock()
+	defer b.m.Unlock()
+	pieces := make([]byte, len(b.pieces))
+	copy(pieces, b.pieces)
+	return pieces
+}
+
+// 写入结束，计算最后一个Piece与整个文件的摘要，返回完整的元数据
+func (b *MetaBuilder) Finish() (*MetaInfo, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.finished {
+		return nil, errors.New("Meta builder is finished")
+	}
+	b.finished = true
+	if len(b.buf) > 0 {
+		b.hashPiece()
+	}
+
+	fd := &FileDict{Length: b.length, Sum: string(b.fileHash.Sum(nil))}
+	fd.Path, fd.Name = splitLocalPath(b.file)
+	return &MetaInfo{
+		Length:   b.length,
+		PieceLen: b.pieceLen,
+		Pieces:   b.pieces,
+		Files:    []*FileDict{fd},
+		Hash:     b.hashName,
+	}, nil
+}
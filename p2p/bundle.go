@@ -0,0 +1,212 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// bundle文件名的前缀，之后为InfoHash的前16个字符与bundle的序号
+	BUNDLE_FILE_PREFIX = ".gofd-bundle-"
+)
+
+// 设置了BundleSize时，长度小于该值的文件打包传输，只分发文件中一段数据的文件除外
+func (m *MetaInfo) bundled(fd *FileDict) bool {
+	return m.BundleSize > 0 && !fd.Partial && fd.Length < m.BundleSize
+}
+
+// 与前一个文件打包在一起，AlignFiles时不再从Piece边界开始
+func (m *MetaInfo) packed(i int) bool {
+	return i > 0 && m.bundled(m.Files[i]) && m.bundled(m.Files[i-1])
+}
+
+// 连续的小文件在Agent上先写入同一个bundle文件，下载完成后再解包，
+// 下载过程中不需要逐个打开与关闭大量的小文件
+type bundle struct {
+	name    string      // bundle文件的完整路径
+	length  int64       // bundle文件的长度
+	files   []*FileDict // bundle中的文件，不包括软链接与内容重复的文件
+	offsets []int64     // 与files对应，文件在bundle中的偏移
+	file    File        // 打开后的bundle文件，读写时打开
+}
+
+// 任务的所有bundle，作为文件系统打开时，bundle中的文件映射到bundle文件中的一段
+type bundleFileSystem struct {
+	FileSystem // 不在bundle中的文件，以及bundle文件本身
+	dir        string
+	bundles    []*bundle
+	entries    map[string]*bundleEntry // 以元数据中的文件名为键
+	log        common.Logger
+	existed    bool // 打开时已有下载过的bundle文件
+	unpacked   bool // 已解包到各个文件
+}
+
+type bundleEntry struct {
+	b      *bundle
+	offset int64
+}
+
+// 按元数据划分bundle，少于2个文件的不打包。没有bundle时返回nil
+func newBundleFileSystem(fs FileSystem, m *MetaInfo, dir, infoHash string, l common.Logger) *bundleFileSystem {
+	if m.BundleSize <= 0 {
+		return nil
+	}
+	bfs := &bundleFileSystem{FileSystem: fs, dir: dir, entries: make(map[string]*bundleEntry), log: l}
+	offsets, _ := m.fileOffsets()
+	prefix := BUNDLE_FILE_PREFIX + infoHash[:16]
+	var cur *bundle
+	var start int64
+	for i, fd := range m.Files {
+		if !m.bundled(fd) || !m.packed(i) {
+			cur = nil
+		}
+		if !m.bundled(fd) || fd.Link != "" || fd.Same != "" {
+			continue
+		}
+		if cur == nil {
+			cur = &bundle{}
+			start = offsets[i]
+			bfs.bundles = append(bfs.bundles, cur)
+		}
+		cur.files = append(cur.files, fd)
+		cur.offsets = append(cur.offsets, offsets[i]-start)
+		cur.length = offsets[i] - start + fd.Length
+	}
+
+	bundles := bfs.bundles[:0]
+	for _, b := range bfs.bundles {
+		if len(b.files) < 2 {
+			continue
+		}
+		b.name = localPath(dir, fmt.Sprintf("%s-%d", prefix, len(bundles)))
+		bundles = append(bundles, b)
+		for j, fd := range b.files {
+			bfs.entries[fd.Name] = &bundleEntry{b: b, offset: b.offsets[j]}
+		}
+	}
+	bfs.bundles = bundles
+	if len(bundles) == 0 {
+		return nil
+	}
+	return bfs
+}
+
+// bundle中的文件返回bundle文件中的一段，其它文件直接打开
+func (bfs *bundleFileSystem) Open(name []string, length int64) (File, error) {
+	e, ok := bfs.entries[name[len(name)-1]]
+	if !ok {
+		return bfs.FileSystem.Open(name, length)
+	}
+	b := e.b
+	if b.file == nil {
+		_, err := os.Stat(b.name)
+		created := os.IsNotExist(err)
+		if b.file, err = bfs.FileSystem.Open([]string{b.name}, b.length); err != nil {
+			return nil, err
+		}
+		if created {
+			bfs.repack(b)
+		} else {
+			bfs.existed = true
+		}
+	}
+	return &offsetFile{File: sharedFile{b.file}, offset: e.offset}, nil
+}
+
+// 只分发文件中一段数据的文件不打包，直接打开
+func (bfs *bundleFileSystem) OpenPartial(name []string, size int64) (File, error) {
+	po, ok := bfs.FileSystem.(partialOpener)
+	if !ok {
+		return nil, errors.New("File system not support partial file")
+	}
+	return po.OpenPartial(name, size)
+}
+
+// 新建bundle文件时，把下载目录中已有的完整文件放入bundle，之后校验Piece时不需要重新下载
+func (bfs *bundleFileSystem) repack(b *bundle) {
+	for j, fd := range b.files {
+		file := localPath(bfs.dir, fd.Name)
+		if st, err := os.Stat(file); err != nil || st.Size() != fd.Length || fd.Length == 0 {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err == nil {
+			_, err = b.file.WriteAt(data, b.offsets[j])
+		}
+		if err != nil {
+			bfs.log.Warnf("Repack file to bundle failed, file=%s, error=%v", file, err)
+		}
+	}
+}
+
+// 下载完成后把bundle中的文件写入下载目录，bundle文件保留到任务结束，期间继续用于给其它节点上传
+func (bfs *bundleFileSystem) unpack() error {
+	if bfs.unpacked {
+		return nil
+	}
+	start := time.Now()
+	count := 0
+	for _, b := range bfs.bundles {
+		if b.file == nil {
+			var err error
+			if b.file, err = bfs.FileSystem.Open([]string{b.name}, b.length); err != nil {
+				return err
+			}
+		}
+		for j, fd := range b.files {
+			file := localPath(bfs.dir, fd.Name)
+			data := make([]byte, fd.Length)
+			if _, err := b.file.ReadAt(data, b.offsets[j]); err != nil {
+				return fmt.Errorf("Read %s from bundle failed: %v", fd.Name, err)
+			}
+			if err := ensureDirectory(file); err != nil {
+				return err
+			}
+			if err := os.WriteFile(file, data, 0644); err != nil {
+				return err
+			}
+			count++
+		}
+	}
+	bfs.unpacked = true
+	bfs.log.Infof("Unpacked %v files from %v bundles (%.2f seconds)", count, len(bfs.bundles), time.Now().Sub(start).Seconds())
+	return nil
+}
+
+// 下载完成后解包bundle中的文件
+func (s *P2pSession) unpackBundles() error {
+	if s.bundles == nil {
+		return nil
+	}
+	return s.bundles.unpack()
+}
+
+// 删除bundle文件
+func (bfs *bundleFileSystem) remove() {
+	for _, b := range bfs.bundles {
+		if err := os.Remove(b.name); err != nil && !os.IsNotExist(err) {
+			bfs.log.Errorf("Remove bundle failed, file=%s, error=%v", b.name, err)
+		}
+	}
+}
+
+func (bfs *bundleFileSystem) Close() error {
+	for _, b := range bfs.bundles {
+		if b.file != nil {
+			b.file.Close()
+			b.file = nil
+		}
+	}
+	return bfs.FileSystem.Close()
+}
+
+// bundle中的文件共用打开的bundle文件，由bundleFileSystem关闭
+type sharedFile struct {
+	File
+}
+
+func (sharedFile) Close() error { return nil }
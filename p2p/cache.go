@@ -7,7 +7,7 @@ import (
 	"sync/atomic"
 	"time"
 
-	log "github.com/cihub/seelog"
+	"github.com/xtfly/gofd/common"
 )
 
 type CacheProvider interface {
@@ -81,7 +81,7 @@ func (r *RamCacheProvider) rebalance(shouldTrim bool) {
 	//Cache size is a diminishing return thing:
 	//The more of it a torrent has, the less of a difference additional cache makes.
 	//Thus, instead of scaling the distribution lineraly with torrent size, we'll do it by square-root
-	log.Debug("Rebalancing caches...")
+	common.DefaultLogger().Debugf("Rebalancing caches...")
 	var scalingTotal float64
 	sqrts := make(map[string]float64)
 	for i, cache := range r.caches {
@@ -95,7 +95,7 @@ func (r *RamCacheProvider) rebalance(shouldTrim bool) {
 		if newCap == 0 {
 			newCap = 1 //Something's better than nothing!
 		}
-		log.Debugf("Setting cache '%s' to new capacity %v (%v MiB)", cache.infohash, newCap, float32(newCap*cache.pieceSize)/float32(1024*1024))
+		common.DefaultLogger().Debugf("Setting cache '%s' to new capacity %v (%v MiB)", cache.infohash, newCap, float32(newCap*cache.pieceSize)/float32(1024*1024))
 		cache.setCapacity(newCap)
 	}
 
@@ -0,0 +1,92 @@
+package p2p
+
+import (
+	"strings"
+)
+
+const (
+	HEALTH_OK             = "OK"
+	HEALTH_STOPPING       = "STOPPING"       // Agent正在停止，不再接收任务
+	HEALTH_UNDER_PRESSURE = "UNDER_PRESSURE" // 因内存或磁盘压力暂停了下载
+)
+
+// Agent支持的功能，随心跳上报给Server，Server按此选择节点
+type AgentCapabilities struct {
+	Version         string   `json:"version"`              // 程序版本
+	ProtocolVersion int      `json:"protocolVersion"`      // 节点之间的协议版本
+	Codecs          []string `json:"codecs"`               // 支持的压缩算法
+	Encryption      []string `json:"encryption,omitempty"` // 数据连接的加密方式，配置了TLS时为tls
+	Transports      []string `json:"transports"`           // 支持的传输方式，如tcp、quic
+	Hashes          []string `json:"hashes"`               // 支持的摘要算法
+	Features        []string `json:"features,omitempty"`   // 其它功能，如复用连接
+	Mode            string   `json:"mode,omitempty"`
+}
+
+// Agent的健康状况与当前负载
+type AgentHealth struct {
+	Status      string  `json:"status"`
+	Version     string  `json:"version"`
+	ActiveTasks int     `json:"activeTasks"`
+	MaxActive   int     `json:"maxActive"`
+	Peers       int     `json:"peers"`       // 所有任务的Peer连接数
+	DiskFree    int64   `json:"diskFree"`    // 下载目录的可用空间，查询失败时为-1
+	MemoryStore int64   `json:"memoryStore"` // 只在内存中保存的任务还可以使用的空间
+	Load        float64 `json:"load"`        // 当前负载，见AgentCapacity.Load
+}
+
+// 当前负载，运行中的任务数占上限的比例，没有上限时为运行中的任务数。
+// 因压力暂停下载时至少为1
+func (c *AgentCapacity) Load() float64 {
+	if c == nil {
+		return 0
+	}
+	load := float64(c.ActiveTasks)
+	if c.MaxActive > 0 {
+		load /= float64(c.MaxActive)
+	}
+	if c.UnderPressure && load < 1 {
+		load = 1
+	}
+	return load
+}
+
+// Agent支持的功能
+func (sm *P2pSessionMgnt) Capabilities() *AgentCapabilities {
+	cfg := sm.g.cfg
+	ac := &AgentCapabilities{
+		Version:         Version,
+		ProtocolVersion: PROTOCOL_VERSION,
+		Codecs:          strings.Split(supportedCodecs, ","),
+		Transports:      TransportNames(),
+		Hashes:          HashNames(),
+		Mode:            cfg.Control.Mode,
+	}
+	if tc := cfg.Net.Tls; tc != nil && tc.Peer {
+		ac.Encryption = []string{"tls"}
+	}
+	if cfg.Net.PeerIdleTimeout > 0 {
+		ac.Features = []string{CONN_FEATURE_POOL}
+	}
+	return ac
+}
+
+// Agent的健康状况，stopping为true时Agent正在停止
+func (sm *P2pSessionMgnt) Health(stopping bool) *AgentHealth {
+	c := sm.capacity()
+	h := &AgentHealth{
+		Status:      HEALTH_OK,
+		Version:     Version,
+		ActiveTasks: c.ActiveTasks,
+		MaxActive:   c.MaxActive,
+		Peers:       c.Peers,
+		DiskFree:    c.DiskFree,
+		MemoryStore: c.MemoryStore,
+		Load:        c.Load(),
+	}
+	if stopping {
+		h.Status = HEALTH_STOPPING
+	} else if c.UnderPressure {
+		h.Status = HEALTH_UNDER_PRESSURE
+	}
+	return h
+}
@@ -0,0 +1,122 @@
+package p2p
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// 重新选择上传Peer的间隔
+	RECHOKE_INTERVAL = 10 * time.Second
+	// 每隔几轮更换一次乐观上传的Peer
+	OPTIMISTIC_UNCHOKE_ROUNDS = 3
+)
+
+// 新接入的下游Peer，上传的Peer数已满时先暂停上传
+func (s *P2pSession) chokeNewPeer(p *peer) {
+	if p.client && s.transfersPaused() {
+		p.choked = true
+		p.SendChoke()
+		return
+	}
+	slots := s.maxUploadPeers()
+	if slots <= 0 || !p.client {
+		return
+	}
+	unchoked := 0
+	for _, o := range s.peers {
+		if o != p && o.client && !o.choked {
+			unchoked++
+		}
+	}
+	if unchoked >= slots {
+		p.choked = true
+		p.SendChoke()
+	}
+}
+
+// 是否需要向该Peer上传
+func (s *P2pSession) interested(p *peer) bool {
+	return p.client && p.have != nil && p.have.Count() < s.totalPieces
+}
+
+// 定时重新选择上传的Peer：优先给最近上传给本节点最多的Peer，
+// 另外轮流给一个暂停中的Peer上传，让新接入的Peer也有机会获得数据
+func (s *P2pSession) rechoke() {
+	slots := s.maxUploadPeers()
+	if slots <= 0 || s.transfersPaused() {
+		return
+	}
+	s.rechokeRound++
+
+	candidates := make([]*peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		if !p.client {
+			continue
+		}
+		downloaded := s.peerStats(p.address).Downloaded
+		p.recentRate, p.lastDownloaded = downloaded-p.lastDownloaded, downloaded
+		if s.interested(p) {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.recentRate != b.recentRate {
+			return a.recentRate > b.recentRate
+		}
+		if a.choked != b.choked {
+			return !a.choked
+		}
+		return a.address < b.address
+	})
+
+	regular := slots
+	if slots > 1 {
+		regular = slots - 1 // 留一个给乐观上传
+	}
+	unchoke := make(map[*peer]bool, slots)
+	for i := 0; i < regular && i < len(candidates); i++ {
+		unchoke[candidates[i]] = true
+	}
+	if slots > 1 && len(candidates) > regular {
+		s.optimisticUnchoke(candidates[regular:], unchoke)
+	}
+
+	for _, p := range s.peers {
+		if !p.client {
+			continue
+		}
+		switch want := unchoke[p]; {
+		case want && p.choked:
+			p.choked = false
+			p.SendUnchoke()
+		case !want && !p.choked:
+			p.choked = true
+			p.SendChoke()
+		}
+	}
+	s.log.Debugf("Rechoke, interested=%v, unchoked=%v", len(candidates), len(unchoke))
+}
+
+// 在剩余的Peer中按地址轮流选择一个
+func (s *P2pSession) optimisticUnchoke(rest []*peer, unchoke map[*peer]bool) {
+	sort.Slice(rest, func(i, j int) bool { return rest[i].address < rest[j].address })
+	if s.rechokeRound%OPTIMISTIC_UNCHOKE_ROUNDS != 0 {
+		for _, p := range rest {
+			if p.address == s.optimistic {
+				unchoke[p] = true
+				return
+			}
+		}
+	}
+	next := rest[0]
+	for _, p := range rest {
+		if p.address > s.optimistic {
+			next = p
+			break
+		}
+	}
+	s.optimistic = next.address
+	unchoke[next] = true
+}
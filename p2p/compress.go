@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// 接入端对连接的响应
+	CONN_RSP_PLAIN = 0xFF // 不压缩
+	CONN_RSP_GZIP  = 0xFE // 使用gzip压缩块数据
+	CONN_RSP_ZSTD  = 0xFD // 使用zstd压缩块数据
+
+	// 发起端支持的压缩算法，按优先级排列，逗号分隔
+	supportedCodecs = "zstd,gzip"
+)
+
+// 块数据的压缩算法
+type pieceCodec struct {
+	name       string
+	rsp        byte // 接入端选择该算法时的连接响应
+	message    byte // 压缩后的消息类型
+	compress   func(w *bytes.Buffer, data []byte) error
+	decompress func(data []byte) ([]byte, error) // 解压后超过MAX_BLOCK_LENGTH时返回错误
+}
+
+// 接入端按该顺序选择发起端支持的算法
+var pieceCodecs = []*pieceCodec{
+	{name: "zstd", rsp: CONN_RSP_ZSTD, message: PIECE_ZSTD, compress: zstdCompress, decompress: zstdDecompress},
+	{name: "gzip", rsp: CONN_RSP_GZIP, message: PIECE_GZIP, compress: gzipCompress, decompress: gzipDecompress},
+}
+
+func lookupCodec(name string) *pieceCodec {
+	for _, c := range pieceCodecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// 接入端根据发起端支持的算法选择压缩方式，优先zstd，其次gzip，元数据禁止压缩时不压缩
+func chooseCodec(offered string, m *MetaInfo) (codec string, rsp byte) {
+	if m.NoCompress {
+		return "", CONN_RSP_PLAIN
+	}
+	names := strings.Split(offered, ",")
+	for _, c := range pieceCodecs {
+		for _, n := range names {
+			if n == c.name {
+				return c.name, c.rsp
+			}
+		}
+	}
+	return "", CONN_RSP_PLAIN
+}
+
+// 发起端根据接入端的响应确定压缩方式，旧版本总是响应CONN_RSP_PLAIN
+func codecFromRsp(rsp byte) string {
+	for _, c := range pieceCodecs {
+		if c.rsp == rsp {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// 压缩PIECE消息，压缩后没有变小时返回nil，按原始PIECE发送
+func compressPiece(codec string, message []byte) []byte {
+	c := lookupCodec(codec)
+	if c == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(c.message)
+	buf.Write(message[1:9])
+	if err := c.compress(&buf, message[9:]); err != nil {
+		return nil
+	}
+	if buf.Len() >= len(message) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// 解压为PIECE消息，限制解压后的长度，防止恶意的数据
+func decompressPiece(message []byte) ([]byte, error) {
+	if len(message) < 9 {
+		return nil, errors.New("unexpected message length")
+	}
+	var c *pieceCodec
+	for _, pc := range pieceCodecs {
+		if pc.message == message[0] {
+			c = pc
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("Unexpected compressed message id: %d", message[0])
+	}
+	data, err := c.decompress(message[9:])
+	if err != nil {
+		return nil, err
+	}
+
+	piece := make([]byte, 9+len(data))
+	piece[0] = PIECE
+	copy(piece[1:9], message[1:9])
+	copy(piece[9:], data)
+	return piece, nil
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+func gzipCompress(buf *bytes.Buffer, data []byte) error {
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func gzipDecompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, MAX_BLOCK_LENGTH+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MAX_BLOCK_LENGTH {
+		return nil, errors.New("Block length too large")
+	}
+	return out, nil
+}
+
+// EncodeAll与DecodeAll可以并发调用，所有连接共用
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MAX_BLOCK_LENGTH+1))
+)
+
+func zstdCompress(buf *bytes.Buffer, data []byte) error {
+	buf.Write(zstdEncoder.EncodeAll(data, nil))
+	return nil
+}
+
+func zstdDecompress(data []byte) ([]byte, error) {
+	out, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MAX_BLOCK_LENGTH {
+		return nil, errors.New("Block length too large")
+	}
+	return out, nil
+}
@@ -0,0 +1,163 @@
+package p2p
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestChooseCodec(t *testing.T) {
+	cases := []struct {
+		offered    string
+		noCompress bool
+		codec      string
+		rsp        byte
+	}{
+		{"zstd,gzip", false, "zstd", CONN_RSP_ZSTD},
+		{"gzip,zstd", false, "zstd", CONN_RSP_ZSTD},
+		{"gzip", false, "gzip", CONN_RSP_GZIP},
+		{"lz4,gzip", false, "gzip", CONN_RSP_GZIP},
+		{"lz4", false, "", CONN_RSP_PLAIN},
+		{"", false, "", CONN_RSP_PLAIN},
+		{"zstd,gzip", true, "", CONN_RSP_PLAIN},
+	}
+	for _, c := range cases {
+		codec, rsp := chooseCodec(c.offered, &MetaInfo{NoCompress: c.noCompress})
+		if codec != c.codec || rsp != c.rsp {
+			t.Errorf("chooseCodec(%q, noCompress=%v)=%q, %#x, want %q, %#x", c.offered, c.noCompress, codec, rsp, c.codec, c.rsp)
+		}
+		if got := codecFromRsp(rsp); got != c.codec {
+			t.Errorf("codecFromRsp(%#x)=%q, want %q", rsp, got, c.codec)
+		}
+	}
+}
+
+// 只支持gzip的旧版本节点的协商逻辑
+func gzipOnlyChoose(offered string, m *MetaInfo) (string, byte) {
+	for _, c := range strings.Split(offered, ",") {
+		if c == "gzip" && !m.NoCompress {
+			return "gzip", CONN_RSP_GZIP
+		}
+	}
+	return "", CONN_RSP_PLAIN
+}
+
+func gzipOnlyFromRsp(rsp byte) string {
+	if rsp == CONN_RSP_GZIP {
+		return "gzip"
+	}
+	return ""
+}
+
+// 支持zstd的节点与只支持gzip的节点之间，无论哪一端发起连接都协商为gzip
+func TestCodecNegotiation(t *testing.T) {
+	type peerCodecs struct {
+		offered string
+		choose  func(string, *MetaInfo) (string, byte)
+		fromRsp func(byte) string
+	}
+	zstdPeer := peerCodecs{supportedCodecs, chooseCodec, codecFromRsp}
+	gzipPeer := peerCodecs{"gzip", gzipOnlyChoose, gzipOnlyFromRsp}
+	plainPeer := peerCodecs{"", func(string, *MetaInfo) (string, byte) { return "", CONN_RSP_PLAIN }, func(byte) string { return "" }}
+
+	cases := []struct {
+		name       string
+		dialer     peerCodecs
+		acceptor   peerCodecs
+		noCompress bool
+		codec      string
+	}{
+		{"zstd to zstd", zstdPeer, zstdPeer, false, "zstd"},
+		{"zstd to gzip", zstdPeer, gzipPeer, false, "gzip"},
+		{"gzip to zstd", gzipPeer, zstdPeer, false, "gzip"},
+		{"zstd to plain", zstdPeer, plainPeer, false, ""},
+		{"plain to zstd", plainPeer, zstdPeer, false, ""},
+		{"no compress", zstdPeer, zstdPeer, true, ""},
+		{"no compress to gzip", zstdPeer, gzipPeer, true, ""},
+	}
+	message := pieceMessage(1, 0, bytes.Repeat([]byte("line of text\n"), 1000))
+	for _, c := range cases {
+		acceptCodec, rsp := c.acceptor.choose(c.dialer.offered, &MetaInfo{NoCompress: c.noCompress})
+		dialCodec := c.dialer.fromRsp(rsp)
+		if acceptCodec != c.codec || dialCodec != c.codec {
+			t.Errorf("%s: acceptor uses %q, dialer uses %q, want %q", c.name, acceptCodec, dialCodec, c.codec)
+			continue
+		}
+		if c.codec == "" {
+			continue
+		}
+		// 两个方向发送的块都能被对端解压
+		for _, codec := range []string{acceptCodec, dialCodec} {
+			piece, err := decompressPiece(compressPiece(codec, message))
+			if err != nil || !bytes.Equal(piece, message) {
+				t.Errorf("%s: block compressed with %s is not restored, error=%v", c.name, codec, err)
+			}
+		}
+	}
+}
+
+func pieceMessage(index, begin uint32, data []byte) []byte {
+	message := make([]byte, 9, 9+len(data))
+	message[0] = PIECE
+	binary.BigEndian.PutUint32(message[1:5], index)
+	binary.BigEndian.PutUint32(message[5:9], begin)
+	return append(message, data...)
+}
+
+func TestCompressPiece(t *testing.T) {
+	message := pieceMessage(3, 16384, bytes.Repeat([]byte(`{"key": "value"}`), 1024))
+	random := make([]byte, 16384)
+	rand.Read(random)
+	for _, c := range pieceCodecs {
+		compressed := compressPiece(c.name, message)
+		if compressed == nil || compressed[0] != c.message || len(compressed) >= len(message) {
+			t.Fatalf("%s: compressible block is not compressed", c.name)
+		}
+		piece, err := decompressPiece(compressed)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !bytes.Equal(piece, message) {
+			t.Fatalf("%s: decompressed block differs", c.name)
+		}
+
+		// 压缩后没有变小时按原始PIECE发送
+		if compressPiece(c.name, pieceMessage(0, 0, random)) != nil {
+			t.Fatalf("%s: incompressible block is compressed", c.name)
+		}
+	}
+	if compressPiece("", message) != nil || compressPiece("lz4", message) != nil {
+		t.Fatal("compress without a negotiated codec")
+	}
+}
+
+// 解压后超过块的最大长度时拒绝
+func TestDecompressPieceLimit(t *testing.T) {
+	header := []byte{0, 0, 0, 0, 1, 0, 0, 0, 0}
+	for _, size := range []int{MAX_BLOCK_LENGTH, MAX_BLOCK_LENGTH + 1, 4 * MAX_BLOCK_LENGTH} {
+		data := make([]byte, size)
+		gz := &bytes.Buffer{}
+		gz.WriteByte(PIECE_GZIP)
+		gz.Write(header[1:])
+		w := gzip.NewWriter(gz)
+		w.Write(data)
+		w.Close()
+		zs := append([]byte{PIECE_ZSTD}, header[1:]...)
+		zs = zstdEncoder.EncodeAll(data, zs)
+
+		for _, message := range [][]byte{gz.Bytes(), zs} {
+			_, err := decompressPiece(message)
+			if ok := size <= MAX_BLOCK_LENGTH; (err == nil) != ok {
+				t.Errorf("decompress %d block of %v bytes error=%v, want ok=%v", message[0], size, err, ok)
+			}
+		}
+	}
+	for _, message := range [][]byte{{PIECE_GZIP, 0}, append([]byte{PIECE}, header[1:]...)} {
+		if _, err := decompressPiece(message); err == nil {
+			t.Errorf("accept message %v", message)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 发起端支持复用连接，在消息头中发送
+	CONN_FEATURE_POOL = "pool"
+
+	// 接入端同意复用连接时，连接响应去掉该位
+	CONN_RSP_POOL_BIT = 0x10
+
+	// 清理连接池中过期连接的间隔
+	CONN_POOL_SWEEP_INTERVAL = 10 * time.Second
+
+	// 复用连接时等待连接响应、释放连接时等待对端RELEASE的最长时间
+	CONN_RELEASE_TIMEOUT = 10 * time.Second
+)
+
+// 节点之间TLS会话的缓存，重新连接同一节点时恢复会话，不再进行完整的握手
+var peerTLSSessions = tls.NewLRUClientSessionCache(256)
+
+// 任务结束后保留的与上游Peer的连接，以连接的地址为键。后续任务连接同一地址时直接发送新任务的消息头，
+// 不再建立TCP与TLS连接；超过idle没有复用的连接关闭
+type connPool struct {
+	lock  sync.Mutex
+	idle  time.Duration
+	conns map[string][]*pooledConn
+
+	metrics *Metrics
+}
+
+type pooledConn struct {
+	conn      net.Conn
+	releaseAt time.Time
+}
+
+func newConnPool(idle time.Duration, metrics *Metrics) *connPool {
+	return &connPool{idle: idle, conns: make(map[string][]*pooledConn), metrics: metrics}
+}
+
+func (cp *connPool) enabled() bool {
+	return cp.idle > 0
+}
+
+// 取出最近放回的连接，没有时返回nil
+func (cp *connPool) get(addr string) net.Conn {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	pcs := cp.conns[addr]
+	for len(pcs) > 0 {
+		pc := pcs[len(pcs)-1]
+		pcs = pcs[:len(pcs)-1]
+		if time.Since(pc.releaseAt) < cp.idle {
+			cp.set(addr, pcs)
+			cp.metrics.pooledConnReused()
+			return pc.conn
+		}
+		pc.conn.Close()
+	}
+	cp.set(addr, pcs)
+	return nil
+}
+
+func (cp *connPool) put(addr string, conn net.Conn) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	cp.conns[addr] = append(cp.conns[addr], &pooledConn{conn: conn, releaseAt: time.Now()})
+}
+
+func (cp *connPool) set(addr string, pcs []*pooledConn) {
+	if len(pcs) == 0 {
+		delete(cp.conns, addr)
+	} else {
+		cp.conns[addr] = pcs
+	}
+}
+
+// 定时关闭过期的连接，quitChan关闭后关闭所有连接
+func (cp *connPool) run(quitChan <-chan struct{}) {
+	if !cp.enabled() {
+		return
+	}
+	tick := time.NewTicker(CONN_POOL_SWEEP_INTERVAL)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			cp.sweep(time.Now().Add(-cp.idle))
+		case <-quitChan:
+			cp.sweep(time.Now().Add(time.Hour))
+			return
+		}
+	}
+}
+
+// 关闭在before之前放回的连接
+func (cp *connPool) sweep(before time.Time) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for addr, pcs := range cp.conns {
+		alive := pcs[:0]
+		for _, pc := range pcs {
+			if pc.releaseAt.Before(before) {
+				pc.conn.Close()
+			} else {
+				alive = append(alive, pc)
+			}
+		}
+		cp.set(addr, alive)
+	}
+}
+
+// 发起端任务结束时释放连接：发送RELEASE后不再写入，收到对端的RELEASE后放回连接池。
+// 接入端收到RELEASE后回复RELEASE，然后等待下一个任务的消息头
+func (s *P2pSession) releasePeer(p *peer) {
+	p.log.Infof("Release connection to peer for later tasks")
+	if !p.client {
+		pool, addr := s.g.connPool, p.dialAddr
+		p.released = func(conn net.Conn) { pool.put(addr, conn) }
+	} else {
+		g := s.g
+		p.released = func(conn net.Conn) { go g.acceptNextTask(conn) }
+	}
+	s.removePeer(p)
+	p.startRelease()
+}
+
+// 接入端复用的连接上等待下一个任务的消息头，超时后关闭
+func (g *global) acceptNextTask(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(g.connPool.idle))
+	c, err := acceptHeader(g.cfg, g.log, conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	g.peerConns <- c
+}
+
+// 连接池中的连接可能已被对端关闭，握手失败时重新建立连接
+func (s *P2pSession) dialPooledPeer(addr string) (conn net.Conn, rsp byte, version int, err error) {
+	for {
+		conn = s.g.connPool.get(addr)
+		if conn == nil {
+			return nil, 0, 0, nil
+		}
+		if s.g.cfg.ProxyFor(addr) == nil && common.AddrMoved(addr, conn.RemoteAddr()) {
+			// 域名已解析到其它节点，重新建立连接
+			s.log.Infof("Peer[%s] has moved, close pooled connection to %s", addr, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(CONN_RELEASE_TIMEOUT))
+		if rsp, version, err = handshakePeer(conn, s.taskId, s.g.cfg); err == nil {
+			conn.SetDeadline(time.Time{})
+			s.log.Infof("Reuse pooled connection to peer[%s]", addr)
+			return
+		}
+		s.log.Debugf("Pooled connection to peer[%s] is broken, error=%v", addr, err)
+		conn.Close()
+	}
+}
+
+// 发送消息头并等待连接响应
+func handshakePeer(conn net.Conn, taskId string, cfg *common.Config) (byte, int, error) {
+	if err := writeHeader(conn, taskId, cfg); err != nil {
+		return 0, 0, err
+	}
+	return readConnRsp(conn)
+}
@@ -0,0 +1,155 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	contentObjectDir   = "objects"   // 按摘要保存的文件，objects/<算法>/<摘要前两位>/<摘要>
+	contentManifestDir = "manifests" // 每个任务的文件与摘要，manifests/<任务ID>.json
+)
+
+// 任务下载完成后记录的文件与摘要
+type ContentManifest struct {
+	TaskId string            `json:"taskId"`
+	Hash   string            `json:"hash"`
+	Files  map[string]string `json:"files"` // 文件名对应十六进制的摘要
+	Time   time.Time         `json:"time"`
+}
+
+// 配置了Control.ContentStore时，Agent上校验通过的文件以硬链接（或reflink、复制）按摘要保存到仓库，
+// 之后的任务中摘要相同的文件直接从仓库链接，不再下载。种子节点、不写入磁盘与只分发文件中一段数据的任务不使用
+func (s *P2pSession) contentStored() bool {
+	return s.g.cfg.Control.ContentStore != "" && !s.g.cfg.Server && !s.task.Seed && !s.noDisk()
+}
+
+// 可以按摘要保存的文件：有数据的完整文件，并且摘要与算法相符
+func (s *P2pSession) contentFile(fd *FileDict) bool {
+	if fd.Link != "" || fd.Same != "" || fd.Partial || fd.Length == 0 {
+		return false
+	}
+	newHash, err := s.task.MetaInfo.hashFunc()
+	return err == nil && len(fd.Sum) == newHash().Size()
+}
+
+func (s *P2pSession) contentObject(fd *FileDict) string {
+	sum := hex.EncodeToString([]byte(fd.Sum))
+	hash := s.task.MetaInfo.Hash
+	if hash == "" {
+		hash = "sha1"
+	}
+	return filepath.Join(s.g.cfg.Control.ContentStore, contentObjectDir, hash, sum[:2], sum)
+}
+
+// 初始化时从仓库链接摘要相同的文件，之后按已有的文件计算缺失的Piece。
+// 与仓库共用的旧版本文件先复制一份，下载时不会修改仓库中的内容。返回链接的文件数
+func (s *P2pSession) adoptContent() int {
+	linked := 0
+	for _, fd := range s.task.MetaInfo.Files {
+		if !s.contentFile(fd) {
+			continue
+		}
+		file := localPath(s.dataDir(), fd.Name)
+		obj := s.contentObject(fd)
+		fi, ferr := os.Lstat(file)
+		if ofi, err := os.Stat(obj); err == nil && ofi.Size() == fd.Length {
+			if ferr == nil && os.SameFile(fi, ofi) {
+				linked++
+				continue
+			}
+			// 旧文件被替换，不修改其内容
+			if _, err = finalizeFile(obj, file, fd); err != nil {
+				s.log.Warnf("Link file from content store failed, file=%s, error=%v", file, err)
+				continue
+			}
+			linked++
+			continue
+		}
+		if ferr == nil && fi.Mode().IsRegular() && linkCount(fi) != 1 {
+			if err := unshareFile(file); err != nil {
+				s.log.Warnf("Unshare file failed, file=%s, error=%v", file, err)
+			}
+		}
+	}
+	if linked > 0 {
+		s.log.Infof("Linked %v files from content store", linked)
+	}
+	return linked
+}
+
+// 文件校验通过后保存到仓库，已存在时不修改
+func (s *P2pSession) storeContent(fd *FileDict) {
+	if !s.contentStored() || !s.contentFile(fd) {
+		return
+	}
+	obj := s.contentObject(fd)
+	if _, err := os.Stat(obj); err == nil {
+		return
+	}
+	file := s.currentPath(fd.Name)
+	method, err := finalizeFile(file, obj, fd)
+	if err != nil {
+		s.log.Warnf("Store file to content store failed, file=%s, error=%v", file, err)
+		return
+	}
+	s.log.Debugf("Stored file %s to content store, method=%s", fd.Name, method)
+}
+
+// 下载完成后保存任务的文件与摘要
+func (s *P2pSession) saveManifest() {
+	if !s.contentStored() {
+		return
+	}
+	m := &ContentManifest{TaskId: s.taskId, Hash: s.task.MetaInfo.Hash, Files: make(map[string]string), Time: time.Now()}
+	for _, fd := range s.task.MetaInfo.Files {
+		if s.contentFile(fd) {
+			m.Files[fd.Name] = hex.EncodeToString([]byte(fd.Sum))
+		}
+	}
+	file := filepath.Join(s.g.cfg.Control.ContentStore, contentManifestDir, s.taskId+".json")
+	data, err := json.Marshal(m)
+	if err == nil {
+		if err = ensureDirectory(file); err == nil {
+			err = ioutil.WriteFile(file, data, 0644)
+		}
+	}
+	if err != nil {
+		s.log.Warnf("Save content manifest failed, file=%s, error=%v", file, err)
+	}
+}
+
+// 读取任务的文件与摘要
+func LoadContentManifest(store, taskId string) (*ContentManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(store, contentManifestDir, taskId+".json"))
+	if err != nil {
+		return nil, err
+	}
+	m := new(ContentManifest)
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 复制文件并替换原文件，不再与其它硬链接共用数据
+func unshareFile(file string) error {
+	tmp := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".gofd")
+	os.Remove(tmp)
+	if _, err := cloneFile(file, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if fi, err := os.Stat(file); err == nil {
+		os.Chmod(tmp, fi.Mode())
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
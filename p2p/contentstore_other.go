@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package p2p
+
+import (
+	"os"
+)
+
+// 不能获取硬链接数，返回0，按可能与仓库共用处理
+func linkCount(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,50 @@
+package p2p
+
+import (
+	"context"
+	"io"
+)
+
+// ctx结束或cancel关闭时关闭返回的chan，与只接受chan的Piece摘要计算兼容。返回的stop释放合并的Goroutine
+func mergeCancel(ctx context.Context, cancel <-chan struct{}) (done <-chan struct{}, stop func()) {
+	if cancel == nil {
+		return ctx.Done(), func() {}
+	}
+	if ctx.Done() == nil {
+		return cancel, func() {}
+	}
+	ch, quit := make(chan struct{}), make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-cancel:
+		case <-quit:
+			return
+		}
+		close(ch)
+	}()
+	return ch, func() { close(quit) }
+}
+
+// 被ctx取消时返回ctx的错误，区分取消与超时
+func canceledErr(ctx context.Context, err error) error {
+	if err == ErrCanceled && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// 每次读取前检查是否已取消，计算整个大文件的摘要时也能及时退出
+type cancelReader struct {
+	r    io.Reader
+	done <-chan struct{}
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, ErrCanceled
+	default:
+	}
+	return c.r.Read(p)
+}
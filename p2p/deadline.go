@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"time"
+)
+
+const (
+	// 判断慢速Peer时统计下载速率的周期
+	SLOW_PEER_WINDOW = 10 * time.Second
+	// 放弃慢速Peer后不再向其请求的时间
+	SLOW_PEER_BACKOFF = 30 * time.Second
+)
+
+// 块请求的超时，超时后从其它Peer重新请求
+func (s *P2pSession) requestTimeout() time.Duration {
+	return time.Duration(s.g.cfg.Control.RequestTimeout) * time.Second
+}
+
+// 下载过程中定时检查上游Peer：取消超过requestTimeout没有收到的块请求；配置了minPeerSpeed时，
+// 一个统计周期内下载速率低于该值的Peer取消所有请求，由其它Peer重新下载，避免一个慢速节点拖住任务的最后几个Piece
+func (s *P2pSession) checkDeadlines() {
+	now := time.Now()
+	abandoned := false
+	for _, p := range s.peers {
+		if p.client {
+			continue
+		}
+		if err := s.doCheckRequests(p); err != nil {
+			p.log.Errorf("Closing peer because %v", err)
+			s.closePeerAndTryReconn(p)
+			continue
+		}
+		if s.abandonSlowPeer(p, now) {
+			abandoned = true
+		}
+	}
+	if !abandoned {
+		return
+	}
+	for _, p := range s.peers {
+		if !p.client {
+			s.fillRequests(p)
+		}
+	}
+}
+
+// 统计周期结束时下载速率低于minPeerSpeed，并且有其它可用的上游Peer时，取消向该Peer的所有请求。
+// 没有未完成的请求时Peer空闲，重新开始统计
+func (s *P2pSession) abandonSlowPeer(p *peer, now time.Time) bool {
+	min := s.g.cfg.Control.MinPeerSpeed
+	if min <= 0 {
+		return false
+	}
+	downloaded := s.peerStats(p.address).Downloaded
+	if len(p.ourRequests) == 0 {
+		p.windowAt = time.Time{}
+		return false
+	}
+	if p.windowAt.IsZero() {
+		p.windowAt, p.windowBytes = now, downloaded
+		return false
+	}
+	elapsed := now.Sub(p.windowAt)
+	if elapsed < SLOW_PEER_WINDOW {
+		return false
+	}
+	rate := float64(downloaded-p.windowBytes) / elapsed.Seconds()
+	p.windowAt, p.windowBytes = now, downloaded
+	if rate >= float64(min)*1024 || !s.hasOtherUpstream(p, now) {
+		return false
+	}
+
+	p.log.Warnf("Abandon slow peer, speed=%s/s, requests=%v", humanSize(rate), len(p.ourRequests))
+	s.removeRequests(p)
+	p.windowAt = time.Time{}
+	p.slowUntil = now.Add(SLOW_PEER_BACKOFF)
+	s.peerStats(p.address).Abandons++
+	s.slowAbandons++
+	return true
+}
+
+// 放弃后的一段时间内不向慢速Peer请求，没有其它可用的上游Peer时仍然请求
+func (s *P2pSession) avoidSlowPeer(p *peer) bool {
+	now := time.Now()
+	return now.Before(p.slowUntil) && s.hasOtherUpstream(p, now)
+}
+
+// 除p之外还有没有暂停上传、也没有被放弃的上游Peer
+func (s *P2pSession) hasOtherUpstream(p *peer, now time.Time) bool {
+	for _, o := range s.peers {
+		if o != p && !o.client && !o.peerChoking && !now.Before(o.slowUntil) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// 创建元数据时查找内容相同的文件，以长度、权限位与摘要为键，值为第一个文件的名称
+type dedupIndex map[string]string
+
+// 与前面的文件内容相同时记录该文件的名称，不再传输数据，返回减少的长度
+func (d dedupIndex) dedup(fd *FileDict) int64 {
+	if fd.Link != "" || fd.Partial || fd.Length == 0 || fd.Sum == "" {
+		return 0
+	}
+	key := fmt.Sprintf("%d/%o/%x", fd.Length, fd.Mode, fd.Sum)
+	name, ok := d[key]
+	if !ok {
+		d[key] = fd.Name
+		return 0
+	}
+	if name == fd.Name {
+		return 0
+	}
+	saved := fd.Length
+	fd.Same, fd.Length = name, 0
+	return saved
+}
+
+// 目录中与前面的文件为同一个文件（硬链接）时，不计算摘要，直接记录为内容相同的文件
+func (m *MetaInfo) addSameFile(pf *pendingFile, src *FileDict) {
+	m.addFiles(pf)
+	fd := m.Files[len(m.Files)-1]
+	m.Length -= fd.Length
+	fd.Same, fd.Length, fd.Sum = src.Name, 0, src.Sum
+	if src.Same != "" {
+		// 前面的文件已按内容去重
+		fd.Same = src.Same
+	}
+}
+
+// Same需要指向任务中前面的一个有数据的文件
+func checkSameFile(m *MetaInfo, idx int) error {
+	fd := m.Files[idx]
+	if err := checkFileName(fd.Same); err != nil {
+		return err
+	}
+	for _, src := range m.Files[:idx] {
+		if src.Name == fd.Same && src.Link == "" && src.Same == "" && !src.Partial {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid file %s, same as %s that is not a previous file", fd.Name, fd.Same)
+}
+
+// 下载完成后为内容相同的文件创建硬链接，不支持硬链接时复制，返回是否为硬链接
+func restoreSame(file, src string) (linked bool, err error) {
+	if fi, err := os.Lstat(file); err == nil {
+		if sfi, err := os.Stat(src); err == nil && os.SameFile(fi, sfi) {
+			return true, nil
+		}
+		if fi.IsDir() {
+			return false, fmt.Errorf("%s is a directory", file)
+		}
+		if err := os.Remove(file); err != nil {
+			return false, err
+		}
+	}
+	if err = ensureDirectory(file); err != nil {
+		return
+	}
+	if os.Link(src, file) == nil {
+		return true, nil
+	}
+	return false, copyFile(src, file)
+}
+
+// 先写入临时文件，完整后再改名
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// 校验本地文件时，内容重复的文件按原文件的长度读取
+func (m *MetaInfo) dataFileDict(fd *FileDict) *FileDict {
+	if fd.Same == "" {
+		return fd
+	}
+	for _, src := range m.Files {
+		if src.Name == fd.Same && src.Same == "" {
+			local := *fd
+			local.Same, local.Length = "", src.Length
+			return &local
+		}
+	}
+	return fd
+}
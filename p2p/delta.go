@@ -0,0 +1,134 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 旧版本文件中一个Piece大小的数据
+type pieceLocation struct {
+	file   string
+	offset int64
+}
+
+// 使用本地旧版本的文件填充缺失的Piece，不需要从其它Peer下载。
+// 先比较同名文件相同位置的数据，再按摘要在所有文件中查找，支持文件改名或移动
+func (s *P2pSession) copyFromPrevious(dir string) {
+	m := s.task.MetaInfo
+	newHash, err := m.hashFunc()
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	hashSize := newHash().Size()
+	missing := s.Missing()
+	offsets, _ := m.fileOffsets()
+	copied := 0
+
+	var rest []int
+	for _, i := range missing {
+		data := make([]byte, s.pieceLength(i))
+		readPrevious(m, offsets, dir, data, int64(i)*m.PieceLen)
+		if s.adoptPiece(i, data) {
+			copied++
+		} else {
+			rest = append(rest, i)
+		}
+	}
+
+	if len(rest) > 0 {
+		index := indexPrevious(dir, m.PieceLen, newHash)
+		for _, i := range rest {
+			if s.pieceLength(i) != int(m.PieceLen) {
+				continue
+			}
+			loc, ok := index[string(m.Pieces[i*hashSize:(i+1)*hashSize])]
+			if !ok {
+				continue
+			}
+			data := make([]byte, m.PieceLen)
+			if readAt(loc.file, data, loc.offset) == nil && s.adoptPiece(i, data) {
+				copied++
+			}
+		}
+	}
+
+	s.checkPieceTime += time.Now().Sub(start).Seconds()
+	s.log.Infof("Copied %v of %v missing pieces from previous version %s", copied, len(missing), dir)
+}
+
+// 按新的元数据读取旧版本中同名文件的数据，文件不存在或长度不够的部分为0
+func readPrevious(m *MetaInfo, offsets []int64, dir string, buf []byte, off int64) {
+	end := off + int64(len(buf))
+	for i, fd := range m.Files {
+		start := offsets[i]
+		if start < off {
+			start = off
+		}
+		stop := min64(end, offsets[i]+fd.Length)
+		if start >= stop {
+			continue
+		}
+		readAt(localPath(dir, fd.Name), buf[start-off:stop-off], fd.Offset+start-offsets[i])
+	}
+}
+
+func readAt(file string, buf []byte, off int64) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(buf, off)
+	return err
+}
+
+// 计算旧版本所有文件中，每个Piece边界开始的完整Piece的摘要
+func indexPrevious(dir string, pieceLen int64, newHash hashFunc) map[string]pieceLocation {
+	index := make(map[string]pieceLocation)
+	buf := make([]byte, pieceLen)
+	hash := newHash()
+	filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		for off := int64(0); off+pieceLen <= fi.Size(); off += pieceLen {
+			if _, err := f.ReadAt(buf, off); err != nil {
+				break
+			}
+			hash.Reset()
+			hash.Write(buf)
+			sum := string(hash.Sum(nil))
+			if _, ok := index[sum]; !ok {
+				index[sum] = pieceLocation{file: file, offset: off}
+			}
+		}
+		return nil
+	})
+	return index
+}
+
+// 写入本地找到的数据，校验通过后作为已下载的Piece
+func (s *P2pSession) adoptPiece(i int, data []byte) bool {
+	off := s.task.MetaInfo.PieceLen * int64(i)
+	s.journal.record(i)
+	if _, err := s.fileStore.WriteAt(data, off); err != nil {
+		return false
+	}
+	ok, err, pieceBytes := checkPiece(s.fileStore, s.totalSize, s.task.MetaInfo, i, s.g.buffers)
+	defer s.g.buffers.put(pieceBytes)
+	if !ok || err != nil {
+		return false
+	}
+	s.fileStore.Commit(i, pieceBytes, off)
+	s.pieceSet.Set(i)
+	s.goodPieces++
+	s.resumeDirty = true
+	return true
+}
@@ -0,0 +1,74 @@
+package p2p
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 任务下载目录模板中的变量：{taskId}任务标识，{date}Agent接收任务的日期，如20060102，
+// {name}元数据中第一个文件的顶层名称
+var destDirVars = []string{"taskId", "date", "name"}
+
+// 替换任务下载目录模板中的变量，结果需要在Control.DestDirs配置的某个目录之下。
+// 没有指定模板时返回Agent的下载目录
+func ResolveDestDir(cfg *common.Config, dt *DispatchTask) (string, error) {
+	if dt.DestDir == "" {
+		return cfg.DownDir, nil
+	}
+	if dt.Seed || dt.InMemory {
+		return "", fmt.Errorf("Dest dir is not supported by seed or in memory task")
+	}
+
+	values := map[string]string{
+		"taskId": dt.TaskId,
+		"date":   time.Now().Format("20060102"),
+	}
+	if dt.MetaInfo != nil && len(dt.MetaInfo.Files) > 0 {
+		values["name"] = strings.SplitN(dt.MetaInfo.Files[0].Name, "/", 2)[0]
+	}
+
+	dir := dt.DestDir
+	for _, k := range destDirVars {
+		v := values[k]
+		if !strings.Contains(dir, "{"+k+"}") {
+			continue
+		}
+		// 变量的值只能作为一级目录
+		if v == "" || v == "." || v == ".." || strings.ContainsAny(v, `/\`) {
+			return "", fmt.Errorf("Invalid value %q of variable %s in dest dir", v, k)
+		}
+		dir = strings.Replace(dir, "{"+k+"}", v, -1)
+	}
+	if strings.ContainsAny(dir, "{}") {
+		return "", fmt.Errorf("Unknown variable in dest dir %s", dt.DestDir)
+	}
+	if !isAbsSlash(filepath.ToSlash(dir)) {
+		return "", fmt.Errorf("Dest dir %s is not an absolute path", dir)
+	}
+
+	dir = filepath.Clean(filepath.FromSlash(dir))
+	for _, base := range cfg.Control.DestDirs {
+		if withinDir(filepath.Clean(base), dir) {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("Dest dir %s is not allowed", dir)
+}
+
+// dir是否为base或在base之下，两者都是清理过的绝对路径
+func withinDir(base, dir string) bool {
+	rel, err := filepath.Rel(base, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// 任务的数据文件所在的目录。元数据与断点续传文件仍然保存在Agent的下载目录中
+func (s *P2pSession) downDir() string {
+	if s.task.DestDir != "" {
+		return s.task.DestDir
+	}
+	return s.g.cfg.DownDir
+}
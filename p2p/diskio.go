@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"errors"
+	"runtime"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 配置了IO优先级时读写任务数据的线程数
+	DISK_WORKERS = 4
+
+	IO_CLASS_BEST_EFFORT = "besteffort" // 与其它进程按优先级分配磁盘带宽
+	IO_CLASS_IDLE        = "idle"       // 磁盘空闲时才读写
+
+	// besteffort默认与最低的优先级，数值越大优先级越低
+	DEFAULT_IO_PRIORITY = 7
+)
+
+var errIOPriorityUnsupported = errors.New("Set io priority is not supported")
+
+// 读写请求，在设置了IO优先级的线程上执行
+type diskJob struct {
+	fn  func() (int, error)
+	out chan diskResult
+}
+
+type diskResult struct {
+	n   int
+	err error
+}
+
+// 以较低的IO优先级与nice值读写任务数据的线程，避免下载时的大量写入影响同一主机上对延迟敏感的服务。
+// Linux的IO优先级与nice值只对设置的线程生效，每个worker锁定在一个系统线程上
+type diskWorkers struct {
+	jobs chan *diskJob
+}
+
+// 没有配置ioClass与nice时返回nil，直接在调用者的线程上读写
+func newDiskWorkers(cfg *common.Config, l common.Logger) *diskWorkers {
+	c := cfg.Control
+	if c.IOClass == "" && c.Nice == 0 {
+		return nil
+	}
+	level := c.IOPriority
+	if level <= 0 || level > DEFAULT_IO_PRIORITY {
+		level = DEFAULT_IO_PRIORITY
+	}
+	w := &diskWorkers{jobs: make(chan *diskJob, DISK_WORKERS)}
+	for i := 0; i < DISK_WORKERS; i++ {
+		go w.run(c.IOClass, level, c.Nice, l, i == 0)
+	}
+	return w
+}
+
+func (w *diskWorkers) run(class string, level, nice int, l common.Logger, first bool) {
+	runtime.LockOSThread()
+	err := setThreadPriority(class, level, nice)
+	if first {
+		if err != nil {
+			l.Warnf("Set io priority of disk workers failed, class=%s, level=%d, nice=%d, error=%v", class, level, nice, err)
+		} else {
+			l.Infof("Set io priority of disk workers, class=%s, level=%d, nice=%d", class, level, nice)
+		}
+	}
+	for job := range w.jobs {
+		n, err := job.fn()
+		job.out <- diskResult{n, err}
+	}
+}
+
+// 在worker上执行读写，w为nil时直接执行
+func (w *diskWorkers) do(fn func() (int, error)) (int, error) {
+	if w == nil {
+		return fn()
+	}
+	job := &diskJob{fn: fn, out: make(chan diskResult, 1)}
+	w.jobs <- job
+	r := <-job.out
+	return r.n, r.err
+}
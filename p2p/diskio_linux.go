@@ -0,0 +1,39 @@
+package p2p
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// linux/ioprio.h
+const (
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+	ioprioWhoProcess = 1
+)
+
+// 设置当前线程的IO调度类、优先级与nice值，需要先锁定系统线程
+func setThreadPriority(class string, level, nice int) error {
+	tid := syscall.Gettid()
+	var prio int
+	switch class {
+	case "":
+	case IO_CLASS_BEST_EFFORT:
+		prio = ioprioClassBE<<ioprioClassShift | level
+	case IO_CLASS_IDLE:
+		prio = ioprioClassIdle << ioprioClassShift
+	default:
+		return fmt.Errorf("Unknown io class %s", class)
+	}
+	if prio != 0 {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio))
+		if errno != 0 {
+			return errno
+		}
+	}
+	if nice != 0 {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package p2p
+
+func setThreadPriority(class string, level, nice int) error {
+	return errIOPriorityUnsupported
+}
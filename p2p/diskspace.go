@@ -0,0 +1,58 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/xtfly/gofd/common"
+)
+
+var errDiskFreeUnsupported = errors.New("Query free disk space is not supported")
+
+// 下载目录所在文件系统的可用空间不足
+type DiskSpaceError struct {
+	Dir       string
+	Required  int64
+	Available int64
+}
+
+func (e *DiskSpaceError) Error() string {
+	return fmt.Sprintf("Insufficient disk space in %s, required=%v, available=%v", e.Dir, e.Required, e.Available)
+}
+
+// 接收任务之前检查任务下载目录dir的可用空间，需要的空间为元数据中的文件长度减去已有文件的长度，
+// 再加上Control.DiskReserve。查询失败或不支持的平台不检查
+func CheckDiskSpace(cfg *common.Config, l common.Logger, mi *MetaInfo, dir string) error {
+	required := int64(cfg.Control.DiskReserve) * 1024 * 1024
+	for _, fd := range mi.Files {
+		if fd.Link != "" {
+			continue
+		}
+		need := fd.Offset + fd.Length
+		if st, err := os.Stat(localPath(dir, fd.Name)); err == nil {
+			need -= st.Size()
+		}
+		if need > 0 {
+			required += need
+		}
+	}
+
+	// 目录还没有创建时查询所在的上级目录
+	fsDir := dir
+	for _, err := os.Stat(fsDir); os.IsNotExist(err) && fsDir != filepath.Dir(fsDir); _, err = os.Stat(fsDir) {
+		fsDir = filepath.Dir(fsDir)
+	}
+	available, err := diskFree(fsDir)
+	if err != nil {
+		if err != errDiskFreeUnsupported {
+			l.Warnf("Query free disk space of %s failed, error=%v", dir, err)
+		}
+		return nil
+	}
+	if available < required {
+		return &DiskSpaceError{Dir: dir, Required: required, Available: available}
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package p2p
+
+func diskFree(dir string) (int64, error) {
+	return 0, errDiskFreeUnsupported
+}
@@ -0,0 +1,17 @@
+package p2p
+
+import "github.com/xtfly/gofd/common"
+
+// 任务失败时上报的错误码，磁盘空间不足等通用的错误码见common包
+const (
+	ERR_CHECKSUM_MISMATCH   = "CHECKSUM_MISMATCH"   // 文件的摘要与元数据不符
+	ERR_PIECE_UNRECOVERABLE = "PIECE_UNRECOVERABLE" // Piece校验失败的次数超过Control.MaxPieceRetries
+	ERR_TASK_EXPIRED        = "TASK_EXPIRED"        // 任务超过存活时间仍未完成
+	ERR_HOOK_FAILED         = "HOOK_FAILED"         // 钩子或升级的安装失败
+	ERR_PIPE_FAILED         = "PIPE_FAILED"         // 写入数据的命令执行失败
+)
+
+func init() {
+	common.RegisterErrorCode(ErrSumMismatch, ERR_CHECKSUM_MISMATCH)
+	common.RegisterErrorCode(ErrCanceled, common.ERR_CANCELED)
+}
@@ -0,0 +1,159 @@
+package p2p
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/flowctrl"
+)
+
+const (
+	// 重新分配各任务速率的间隔
+	FAIR_SHARE_INTERVAL = 1 * time.Second
+	// 空闲或刚开始传输的任务至少分配的速率，Unit: Bps
+	FAIR_SHARE_MIN_RATE = 64 * 1024
+)
+
+// 配置了Control.FairShare且总速率有限制时，按最大最小公平在运行中的任务间分配总速率：
+// 用不完所分配速率的任务只分配实际使用的速率，剩余的由其它任务平分，
+// 避免连接数多的任务占满总速率，其它任务长时间得不到传输
+type fairShare struct {
+	lock  sync.Mutex
+	tasks map[string]*taskShare
+	last  time.Time
+
+	cfg             *common.Config
+	uploadLimiter   *flowctrl.TokenBucket
+	downloadLimiter *flowctrl.TokenBucket
+}
+
+// 任务分配到的上传与下载速率，加入任务所有连接的速率限制中
+type taskShare struct {
+	upload   shareBucket
+	download shareBucket
+}
+
+type shareBucket struct {
+	*flowctrl.TokenBucket
+	used int64 // 上次分配时已传输的字节数
+}
+
+// 需要的速率，-1表示可以用完所有的速率
+type shareDemand struct {
+	bucket *shareBucket
+	demand int64
+}
+
+func newFairShare(g *global) *fairShare {
+	return &fairShare{
+		tasks:           make(map[string]*taskShare),
+		last:            time.Now(),
+		cfg:             g.cfg,
+		uploadLimiter:   g.uploadLimiter,
+		downloadLimiter: g.downloadLimiter,
+	}
+}
+
+func (fs *fairShare) run(quitChan <-chan struct{}) {
+	tick := time.NewTicker(FAIR_SHARE_INTERVAL)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			fs.balance(now)
+		case <-quitChan:
+			return
+		}
+	}
+}
+
+// 任务开始时加入，返回任务的上传与下载速率限制，未分配前不限制
+func (fs *fairShare) add(taskId string) (upload, download *flowctrl.TokenBucket) {
+	ts := &taskShare{
+		upload:   shareBucket{TokenBucket: flowctrl.NewTokenBucket(0)},
+		download: shareBucket{TokenBucket: flowctrl.NewTokenBucket(0)},
+	}
+	fs.lock.Lock()
+	fs.tasks[taskId] = ts
+	fs.lock.Unlock()
+	return ts.upload.TokenBucket, ts.download.TokenBucket
+}
+
+// 任务结束时移除，剩余的速率在下次分配时给其它任务
+func (fs *fairShare) remove(taskId string) {
+	fs.lock.Lock()
+	delete(fs.tasks, taskId)
+	fs.lock.Unlock()
+}
+
+func (fs *fairShare) balance(now time.Time) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	elapsed := now.Sub(fs.last).Seconds()
+	fs.last = now
+	if elapsed <= 0 {
+		return
+	}
+	uploads := make([]*shareBucket, 0, len(fs.tasks))
+	downloads := make([]*shareBucket, 0, len(fs.tasks))
+	for _, ts := range fs.tasks {
+		uploads = append(uploads, &ts.upload)
+		downloads = append(downloads, &ts.download)
+	}
+	enabled := fs.cfg.Control.FairShare
+	allocate(uploads, fs.uploadLimiter.Rate(), enabled, elapsed)
+	allocate(downloads, fs.downloadLimiter.Rate(), enabled, elapsed)
+}
+
+// 按实际使用的速率估计各任务需要的速率，再从需要最少的任务开始分配：
+// 需要的不超过平均值时按需要分配，其余的任务平分剩余的速率
+func allocate(buckets []*shareBucket, total int64, enabled bool, elapsed float64) {
+	demands := make([]shareDemand, 0, len(buckets))
+	for _, b := range buckets {
+		used := b.Used()
+		rate := int64(float64(used-b.used) / elapsed)
+		b.used = used
+		demands = append(demands, shareDemand{bucket: b, demand: shareDemandOf(rate, b.Rate())})
+	}
+	// 只有一个任务时总速率的限制已经足够
+	if !enabled || total <= 0 || len(demands) < 2 {
+		for _, d := range demands {
+			d.bucket.SetRate(0)
+		}
+		return
+	}
+
+	sort.Slice(demands, func(i, j int) bool {
+		if demands[i].demand < 0 || demands[j].demand < 0 {
+			return demands[j].demand < 0 && demands[i].demand >= 0
+		}
+		return demands[i].demand < demands[j].demand
+	})
+	remaining := total
+	rates := make([]int64, len(demands))
+	for i, d := range demands {
+		share := remaining / int64(len(demands)-i)
+		if d.demand >= 0 && d.demand < share {
+			share = d.demand
+		}
+		rates[i] = share
+		remaining -= share
+	}
+	// 所有任务都用不完时，剩余的速率平分，任务的传输增加时可以立即使用
+	for i, d := range demands {
+		d.bucket.SetRate(rates[i] + remaining/int64(len(demands)))
+	}
+}
+
+// 接近用完所分配的速率或未限制时，认为任务可以用完所有的速率
+func shareDemandOf(rate, allocated int64) int64 {
+	if allocated <= 0 || rate >= allocated*9/10 {
+		return -1
+	}
+	if demand := rate * 5 / 4; demand > FAIR_SHARE_MIN_RATE {
+		return demand
+	}
+	return FAIR_SHARE_MIN_RATE
+}
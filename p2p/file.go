@@ -4,7 +4,7 @@ import (
 	"errors"
 	"io"
 
-	log "github.com/cihub/seelog"
+	"github.com/xtfly/gofd/common"
 )
 
 // Interface for a file.
@@ -26,6 +26,53 @@ type FileSystem interface {
 	io.Closer
 }
 
+// 只分发文件中的一段数据时，打开文件的接口，size为文件至少需要的大小
+type partialOpener interface {
+	OpenPartial(name []string, size int64) (file File, err error)
+}
+
+// 文件中的一段数据
+type offsetFile struct {
+	File
+	offset int64
+}
+
+func (o *offsetFile) ReadAt(p []byte, off int64) (int, error) {
+	return o.File.ReadAt(p, o.offset+off)
+}
+
+func (o *offsetFile) WriteAt(p []byte, off int64) (int, error) {
+	return o.File.WriteAt(p, o.offset+off)
+}
+
+// 软链接与内容重复的文件没有数据，不打开文件
+type emptyFile struct{}
+
+func (emptyFile) ReadAt(p []byte, off int64) (int, error)  { return 0, io.EOF }
+func (emptyFile) WriteAt(p []byte, off int64) (int, error) { return 0, errors.New("Write to symlink") }
+func (emptyFile) Close() error                             { return nil }
+
+// 打开元数据中描述的一个文件
+func openFileDict(fileSystem FileSystem, fd *FileDict) (File, error) {
+	if fd.Link != "" || fd.Same != "" {
+		return emptyFile{}, nil
+	}
+	name := []string{fd.Path, fd.Name}
+	if !fd.Partial {
+		return fileSystem.Open(name, fd.Length)
+	}
+
+	po, ok := fileSystem.(partialOpener)
+	if !ok {
+		return nil, errors.New("File system not support partial file")
+	}
+	file, err := po.OpenPartial(name, fd.Offset+fd.Length)
+	if err != nil {
+		return nil, err
+	}
+	return &offsetFile{File: file, offset: fd.Offset}, nil
+}
+
 // A torrent file store.
 type FileStore interface {
 	io.ReaderAt
@@ -40,6 +87,9 @@ type fileStore struct {
 	offsets    []int64
 	files      []fileEntry // Stored in increasing globalOffset order
 	cache      FileCache
+	buffer     *writeBuffer // 延迟写入，为nil时直接写入文件
+	disk       *diskWorkers // 以较低的IO优先级读写文件，为nil时在调用者的线程上读写
+	log        common.Logger
 }
 
 type fileEntry struct {
@@ -48,20 +98,30 @@ type fileEntry struct {
 }
 
 // 根据元数据信息打开所有文件
-func NewFileStore(info *MetaInfo, fileSystem FileSystem) (f FileStore, totalSize int64, err error) {
+func NewFileStore(info *MetaInfo, fileSystem FileSystem, l common.Logger) (f FileStore, totalSize int64, err error) {
 	fs := &fileStore{}
 	fs.fileSystem = fileSystem
+	fs.log = l
 
 	numFiles := len(info.Files)
 	fs.files = make([]fileEntry, numFiles)
-	fs.offsets = make([]int64, numFiles)
+	fs.offsets, totalSize = info.fileOffsets()
 
+	// 文件很多时打开检查后立即关闭，读写时再打开
+	var lazy *openFiles
+	if numFiles > MAX_OPEN_FILES && holdsHandles(fileSystem) {
+		lazy = newOpenFiles(fileSystem, MAX_OPEN_FILES)
+	}
 	for i, _ := range info.Files {
 		src := info.Files[i]
 		var file File
-		file, err = fs.fileSystem.Open([]string{src.Path, src.Name}, src.Length)
+		file, err = openFileDict(fs.fileSystem, src)
+		if err == nil && lazy != nil {
+			file.Close()
+			file = &lazyFile{owner: lazy, fd: src}
+		}
 		if err != nil {
-			log.Errorf("Open file failed, file=%v/%v, error=%v", src.Path, src.Name, err)
+			fs.log.Errorf("Open file failed, file=%v/%v, error=%v", src.Path, src.Name, err)
 			// Close all files opened up to now.
 			for i2 := 0; i2 < i; i2++ {
 				fs.files[i2].file.Close()
@@ -70,13 +130,25 @@ func NewFileStore(info *MetaInfo, fileSystem FileSystem) (f FileStore, totalSize
 		}
 		fs.files[i].file = file
 		fs.files[i].length = src.Length
-		fs.offsets[i] = totalSize
-		totalSize += src.Length
 	}
 	f = fs
 	return
 }
 
+// 每个文件在所有文件中的全局偏移，以及所有文件的总长度
+func (m *MetaInfo) fileOffsets() (offsets []int64, totalSize int64) {
+	offsets = make([]int64, len(m.Files))
+	for i, src := range m.Files {
+		if m.AlignFiles && totalSize%m.PieceLen != 0 && !m.packed(i) {
+			// 文件从Piece边界开始，中间的空洞读出为0。打包的小文件只有第一个从Piece边界开始
+			totalSize += m.PieceLen - totalSize%m.PieceLen
+		}
+		offsets[i] = totalSize
+		totalSize += src.Length
+	}
+	return
+}
+
 func (f *fileStore) SetCache(cache FileCache) {
 	f.cache = cache
 }
@@ -109,7 +181,7 @@ func (f *fileStore) ReadAt(p []byte, off int64) (int, error) {
 	for _, unf := range unfullfilled {
 		_, err := f.RawReadAt(unf.data, unf.i)
 		if err != nil {
-			log.Error("Got an error on read (off=", unf.i, "len=", len(unf.data), ") from filestore:", err)
+			f.log.Errorf("Got an error on read (off=%v len=%v) from filestore: %v", unf.i, len(unf.data), err)
 			retErr = err
 		}
 	}
@@ -117,11 +189,30 @@ func (f *fileStore) ReadAt(p []byte, off int64) (int, error) {
 }
 
 func (f *fileStore) RawReadAt(p []byte, off int64) (n int, err error) {
+	n, err = f.disk.do(func() (int, error) { return f.rawReadAt(p, off) })
+	if f.buffer != nil {
+		f.buffer.overlay(p, off)
+	}
+	return
+}
+
+func (f *fileStore) rawReadAt(p []byte, off int64) (n int, err error) {
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
 		entry := &f.files[index]
 		itemOffset := off - f.offsets[index]
+		if itemOffset < 0 {
+			// 文件对齐产生的空洞
+			gap := int(min64(-itemOffset, chunk))
+			for i := 0; i < gap; i++ {
+				p[i] = 0
+			}
+			n += gap
+			p = p[gap:]
+			off += int64(gap)
+			continue
+		}
 		if itemOffset < entry.length {
 			space := entry.length - itemOffset
 			if space < chunk {
@@ -155,6 +246,8 @@ func (f *fileStore) WriteAt(p []byte, off int64) (int, error) {
 			}
 		}
 		return len(p), nil
+	} else if f.buffer != nil {
+		return len(p), f.buffer.add(p, off)
 	} else {
 		return f.RawWriteAt(p, off)
 	}
@@ -162,21 +255,45 @@ func (f *fileStore) WriteAt(p []byte, off int64) (int, error) {
 
 func (f *fileStore) Commit(pieceNum int, piece []byte, off int64) {
 	if f.cache != nil {
-		_, err := f.RawWriteAt(piece, off)
+		var err error
+		if f.buffer != nil {
+			err = f.buffer.add(piece, off)
+		} else {
+			_, err = f.RawWriteAt(piece, off)
+		}
 		if err != nil {
-			log.Error("Error committing to storage:", err)
+			f.log.Errorf("Error committing to storage: %v", err)
 			return
 		}
 		f.cache.MarkCommitted(pieceNum)
 	}
 }
 
-func (f *fileStore) RawWriteAt(p []byte, off int64) (n int, err error) {
+func (f *fileStore) RawWriteAt(p []byte, off int64) (int, error) {
+	return f.disk.do(func() (int, error) { return f.rawWriteAt(p, off) })
+}
+
+func (f *fileStore) rawWriteAt(p []byte, off int64) (n int, err error) {
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
 		entry := &f.files[index]
 		itemOffset := off - f.offsets[index]
+		if itemOffset < 0 {
+			// 文件对齐产生的空洞，只能写入0
+			gap := int(min64(-itemOffset, chunk))
+			for i := 0; i < gap; i++ {
+				if p[i] != 0 {
+					err = errors.New("Unexpected non-zero data in file alignment padding.")
+					n = n + i
+					return
+				}
+			}
+			n += gap
+			p = p[gap:]
+			off += int64(gap)
+			continue
+		}
 		if itemOffset < entry.length {
 			space := entry.length - itemOffset
 			if space < chunk {
@@ -207,7 +324,32 @@ func (f *fileStore) RawWriteAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
+// 开启延迟写入，budget为缓冲的字节数上限
+func (f *fileStore) SetWriteBuffer(budget int64) {
+	if budget > 0 {
+		f.buffer = newWriteBuffer(budget, f.RawWriteAt, f.log)
+	}
+}
+
+// 在设置了IO优先级的线程上读写文件
+func (f *fileStore) SetDiskWorkers(w *diskWorkers) {
+	f.disk = w
+}
+
+// 把缓冲的数据写入文件
+func (f *fileStore) Flush() error {
+	if f.buffer == nil {
+		return nil
+	}
+	return f.buffer.flush()
+}
+
 func (f *fileStore) Close() (err error) {
+	if f.buffer != nil {
+		if e := f.buffer.flush(); e != nil {
+			f.log.Errorf("Error flushing write buffer: %v", e)
+		}
+	}
 	for i := range f.files {
 		f.files[i].file.Close()
 	}
@@ -0,0 +1,199 @@
+package p2p
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	FILE_CHECK_VERIFIED = "VERIFIED"
+	FILE_CHECK_FAILED   = "FAILED"
+
+	// 每个任务同时校验的文件数
+	FILE_CHECK_WORKERS = 2
+)
+
+// 文件的所有Piece下载完成后，在后台按元数据中的Sum校验整个文件，结果随状态上报给Server，
+// 调用方不需要等任务结束就可以使用校验通过的文件。所有文件校验完成后才上报任务完成
+type fileChecks struct {
+	newHash    hashFunc
+	files      []int           // 需要校验的文件在元数据中的序号，按偏移排列
+	names      map[string]bool // 需要校验的文件名
+	first      []int           // 与files对应，文件所在的第一个与最后一个Piece
+	last       []int
+	started    []bool
+	results    map[string]*FileCheck // 完成校验的文件
+	pending    int                   // 校验中的文件数
+	failed     bool
+	unreported []*FileCheck // 上次上报之后完成校验的文件
+	sem        chan struct{}
+}
+
+// 软链接与内容相同的文件不单独校验，内容相同的文件使用原文件的结果。
+// 旧版本Server下发的元数据中Sum不完整，长度与摘要算法不符的文件不校验
+func newFileChecks(m *MetaInfo) *fileChecks {
+	newHash, err := m.hashFunc()
+	if err != nil {
+		return nil
+	}
+	fc := &fileChecks{
+		newHash: newHash,
+		results: make(map[string]*FileCheck),
+		names:   make(map[string]bool),
+		sem:     make(chan struct{}, FILE_CHECK_WORKERS),
+	}
+	size := newHash().Size()
+	empty := string(newHash().Sum(nil))
+	offsets, _ := m.fileOffsets()
+	for i, fd := range m.Files {
+		if fd.Link != "" || fd.Same != "" || len(fd.Sum) != size {
+			continue
+		}
+		if fd.Length == 0 {
+			r := &FileCheck{Name: fd.Name, Status: FILE_CHECK_VERIFIED}
+			if fd.Sum != empty {
+				r.Status, r.Error, r.Code = FILE_CHECK_FAILED, ErrSumMismatch.Error(), ERR_CHECKSUM_MISMATCH
+			}
+			fc.add(r)
+			continue
+		}
+		fc.files = append(fc.files, i)
+		fc.names[fd.Name] = true
+		fc.first = append(fc.first, int(offsets[i]/m.PieceLen))
+		fc.last = append(fc.last, int((offsets[i]+fd.Length-1)/m.PieceLen))
+	}
+	fc.started = make([]bool, len(fc.files))
+	return fc
+}
+
+func (fc *fileChecks) add(r *FileCheck) {
+	fc.results[r.Name] = r
+	fc.unreported = append(fc.unreported, r)
+	if r.Status == FILE_CHECK_FAILED {
+		fc.failed = true
+	}
+}
+
+// 按文件名排序的所有结果
+func (fc *fileChecks) all() []*FileCheck {
+	if fc == nil {
+		return nil
+	}
+	rs := make([]*FileCheck, 0, len(fc.results))
+	for _, r := range fc.results {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Name < rs[j].Name })
+	return rs
+}
+
+// 上报的结果，all为true时返回所有结果
+func (fc *fileChecks) report(all bool) (rs []*FileCheck) {
+	if fc == nil {
+		return nil
+	}
+	if rs = fc.unreported; all {
+		rs = fc.all()
+	}
+	fc.unreported = nil
+	return
+}
+
+// 是否在后台校验该文件
+func (fc *fileChecks) verifies(name string) bool {
+	return fc != nil && fc.names[name]
+}
+
+func (fc *fileChecks) dirty() bool {
+	return fc != nil && len(fc.unreported) > 0
+}
+
+// 开始校验所有Piece都已下载的文件，piece为刚下载完成的Piece，为-1时检查所有文件
+func (s *P2pSession) checkFiles(piece int) {
+	fc := s.fileChecks
+	if fc == nil {
+		return
+	}
+	j := 0
+	if piece >= 0 {
+		j = sort.Search(len(fc.files), func(k int) bool { return fc.last[k] >= piece })
+	}
+	flushed := false
+	for ; j < len(fc.files); j++ {
+		if piece >= 0 && fc.first[j] > piece {
+			break
+		}
+		if fc.started[j] {
+			continue
+		}
+		if c := s.pieceSet.FindNextClear(fc.first[j]); c >= 0 && c <= fc.last[j] {
+			continue
+		}
+		if !flushed {
+			// 从磁盘读取文件，先写入缓冲的数据
+			if err := s.flushFiles(); err != nil {
+				return
+			}
+			flushed = true
+		}
+		fc.started[j] = true
+		fc.pending++
+		go s.verifyFile(s.task.MetaInfo.Files[fc.files[j]])
+	}
+}
+
+func (s *P2pSession) verifyFile(fd *FileDict) {
+	fc := s.fileChecks
+	select {
+	case fc.sem <- struct{}{}:
+	case <-s.endedChan:
+		return
+	}
+	r := &FileCheck{Name: fd.Name, Status: FILE_CHECK_VERIFIED}
+	sum, err := fileDictSum(s.checkFileSystem(), fd, fc.newHash, s.endedChan)
+	<-fc.sem
+	if err == nil && string(sum) != fd.Sum {
+		err = ErrSumMismatch
+	}
+	if err == ErrCanceled {
+		return
+	}
+	if err != nil {
+		r.Status, r.Error, r.Code = FILE_CHECK_FAILED, err.Error(), common.ErrorCode(err)
+	} else {
+		s.storeContent(fd)
+	}
+	select {
+	case s.fileCheckChan <- r:
+	case <-s.endedChan:
+	}
+}
+
+// 文件校验完成，在Session的Goroutine中调用。校验失败时任务失败，
+// 下载完成后最后一个文件校验通过时上报完成
+func (s *P2pSession) fileChecked(r *FileCheck) {
+	fc := s.fileChecks
+	fc.pending--
+	fc.add(r)
+	for _, fd := range s.task.MetaInfo.Files {
+		if fd.Same == r.Name {
+			fc.add(&FileCheck{Name: fd.Name, Status: r.Status, Error: r.Error})
+		}
+	}
+	if r.Status == FILE_CHECK_FAILED {
+		s.log.Errorf("Verify file failed, file=%s, error=%s", r.Name, r.Error)
+		s.reportFailed(r.Code, fmt.Sprintf("Verify file %s failed: %s", r.Name, r.Error))
+		return
+	}
+	if err := s.commitPartial(r.Name); err != nil {
+		s.log.Errorf("Rename verified file failed, file=%s, error=%v", r.Name, err)
+		s.reportFailed(common.ErrorCode(err), fmt.Sprintf("Rename file %s failed: %v", r.Name, err))
+		return
+	}
+	s.log.Debugf("Verified file %s", r.Name)
+	if fc.pending == 0 && s.goodPieces == s.totalPieces && s.lastErr == "" {
+		s.reportCompleted()
+	}
+}
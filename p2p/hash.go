@@ -0,0 +1,113 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+
+	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// 默认的摘要算法，MetaInfo.Hash为空时使用，兼容旧的元数据
+	DefaultHash = "sha1"
+)
+
+type hashFunc func() hash.Hash
+
+var (
+	hashFuncsLock sync.RWMutex
+	hashFuncs     = map[string]hashFunc{
+		"sha1":    sha1.New,
+		"sha256":  sha256.New,
+		"sha512":  sha512.New,
+		"blake2b": newBlake2b,
+		"xxh3":    func() hash.Hash { return xxh3.New() },
+	}
+	// 摘要算法的实现，没有记录时为标准库，标准库在CPU支持时使用SHA指令
+	hashImpls = map[string]string{}
+)
+
+// 256位的blake2b，比sha256快，没有密钥时不会失败
+func newBlake2b() hash.Hash {
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+// 注册一个没有内置的摘要算法，同名的算法会被覆盖。
+// 分发的所有节点都需要注册相同的算法，否则无法校验元数据
+func RegisterHash(name string, newHash func() hash.Hash) error {
+	if name == "" {
+		return errors.New("Hash name is empty")
+	}
+	if newHash == nil {
+		return fmt.Errorf("Hash %s constructor is nil", name)
+	}
+
+	hashFuncsLock.Lock()
+	defer hashFuncsLock.Unlock()
+	hashFuncs[name] = newHash
+	delete(hashImpls, name)
+	return nil
+}
+
+// 注册摘要算法的另一种实现，如使用SIMD指令的sha256，摘要与原来的算法相同，impl为实现的名称
+func registerHashImpl(name, impl string, newHash func() hash.Hash) {
+	RegisterHash(name, newHash)
+	hashFuncsLock.Lock()
+	defer hashFuncsLock.Unlock()
+	hashImpls[name] = impl
+}
+
+// 摘要算法的实现：内置的算法为go，使用 -tags simd 编译时sha256为sha256-simd，其它注册的算法为custom
+func HashImpl(name string) string {
+	if name == "" {
+		name = DefaultHash
+	}
+	hashFuncsLock.RLock()
+	defer hashFuncsLock.RUnlock()
+	if impl, ok := hashImpls[name]; ok {
+		return impl
+	}
+	switch name {
+	case "sha1", "sha256", "sha512", "blake2b", "xxh3":
+		return "go"
+	}
+	return "custom"
+}
+
+// 已注册的摘要算法
+func HashNames() []string {
+	hashFuncsLock.RLock()
+	defer hashFuncsLock.RUnlock()
+	names := make([]string, 0, len(hashFuncs))
+	for name := range hashFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 根据名称查找摘要算法
+func lookupHash(name string) (hashFunc, error) {
+	if name == "" {
+		name = DefaultHash
+	}
+	hashFuncsLock.RLock()
+	defer hashFuncsLock.RUnlock()
+	if h, ok := hashFuncs[name]; ok {
+		return h, nil
+	}
+	return nil, fmt.Errorf("Not support hash algorithm %s", name)
+}
+
+// 元数据所使用的摘要算法
+func (m *MetaInfo) hashFunc() (hashFunc, error) {
+	return lookupHash(m.Hash)
+}
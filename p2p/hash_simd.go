@@ -0,0 +1,14 @@
+//go:build simd
+// +build simd
+
+package p2p
+
+import (
+	sha256simd "github.com/minio/sha256-simd"
+)
+
+// 使用 -tags simd 编译时，sha256使用SHA扩展指令或AVX-512的实现，CPU都不支持时退回标准库。
+// 摘要与标准库相同，与没有使用该标签的节点可以一起分发
+func init() {
+	registerHashImpl("sha256", "sha256-simd", sha256simd.New)
+}
@@ -0,0 +1,209 @@
+package p2p
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+var (
+	ErrCanceled = errors.New("Canceled")
+)
+
+// 一个Worker负责计算的Piece范围[next, end)
+type pieceRange struct {
+	m    sync.Mutex
+	next int64
+	end  int64
+}
+
+// 从范围的头部取一个Piece
+func (r *pieceRange) take() (int64, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.next >= r.end {
+		return 0, false
+	}
+	r.next++
+	return r.next - 1, true
+}
+
+// 分走范围的后一半，返回分走的范围
+func (r *pieceRange) split() (next, end int64, ok bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.end-r.next < 2 {
+		return 0, 0, false
+	}
+	mid := r.next + (r.end-r.next)/2
+	next, end = mid, r.end
+	r.end = mid
+	return next, end, true
+}
+
+func (r *pieceRange) remaining() int64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.end - r.next
+}
+
+// 并行计算所有Piece的摘要。开始时把Piece平均分给每个Worker，
+// Worker计算完自己的范围后，从剩余最多的Worker那里分走一半，
+// 避免某些文件读取较慢时其它CPU空闲。可以取消，取消后再次run只计算还没完成的Piece
+type pieceHasher struct {
+	fs          FileStore
+	totalLength int64
+	pieceLength int64
+	numPieces   int64
+	newHash     hashFunc
+	hashSize    int64
+	workers     int64
+	progress    *metaProgress // 为nil时不回调进度
+
+	m    sync.Mutex
+	sums []byte
+	done *Bitset
+}
+
+// 根据内存预算计算Worker数，每个Worker缓存一个Piece，预算为0时不限制。
+// Piece较小时使用较多的Worker，Piece较大时使用较少的Worker，最多maxWorkers个，为0时取GOMAXPROCS
+func adaptiveWorkers(maxWorkers int, memoryBudget, pieceLength int64) int64 {
+	workers := int64(defaultWorkers(maxWorkers))
+	if memoryBudget > 0 {
+		if n := memoryBudget / pieceLength; n < workers {
+			workers = n
+		}
+		if workers < 1 {
+			workers = 1
+		}
+	}
+	return workers
+}
+
+func defaultWorkers(workers int) int {
+	if workers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return workers
+}
+
+func newPieceHasher(fs FileStore, totalLength int64, pieceLength int64, newHash hashFunc, workers int, memoryBudget int64) *pieceHasher {
+	numPieces := (totalLength + pieceLength - 1) / pieceLength
+	hashSize := int64(newHash().Size())
+	return &pieceHasher{
+		fs:          fs,
+		totalLength: totalLength,
+		pieceLength: pieceLength,
+		numPieces:   numPieces,
+		newHash:     newHash,
+		hashSize:    hashSize,
+		workers:     adaptiveWorkers(workers, memoryBudget, pieceLength),
+		sums:        make([]byte, hashSize*numPieces),
+		done:        NewBitset(int(numPieces)),
+	}
+}
+
+func (h *pieceHasher) run(cancel <-chan struct{}) (sums []byte, err error) {
+	workers := h.workers
+	if workers > h.numPieces {
+		workers = h.numPieces
+	}
+	ranges := make([]*pieceRange, workers)
+	for i := int64(0); i < workers; i++ {
+		ranges[i] = &pieceRange{next: h.numPieces * i / workers, end: h.numPieces * (i + 1) / workers}
+	}
+
+	var wg sync.WaitGroup
+	canceled := make(chan struct{}, workers)
+	for i := range ranges {
+		wg.Add(1)
+		go func(own *pieceRange) {
+			defer wg.Done()
+			if !h.work(own, ranges, cancel) {
+				canceled <- struct{}{}
+			}
+		}(ranges[i])
+	}
+	wg.Wait()
+
+	if len(canceled) > 0 {
+		return nil, ErrCanceled
+	}
+	return h.sums, nil
+}
+
+// 计算自己范围内的Piece，完成后从其它Worker分走，返回false表示被取消
+func (h *pieceHasher) work(own *pieceRange, ranges []*pieceRange, cancel <-chan struct{}) bool {
+	hasher := h.newHash()
+	buf := make([]byte, h.pieceLength)
+	for {
+		i, ok := own.take()
+		if !ok {
+			if !h.steal(own, ranges) {
+				return true
+			}
+			continue
+		}
+
+		select {
+		case <-cancel:
+			return false
+		default:
+		}
+
+		if h.isDone(i) {
+			continue
+		}
+		piece := buf
+		if i == h.numPieces-1 {
+			piece = buf[0 : h.totalLength-i*h.pieceLength]
+		}
+		// Ignore errors.
+		h.fs.ReadAt(piece, i*h.pieceLength)
+		hasher.Reset()
+		hasher.Write(piece)
+		hasher.Sum(h.sums[i*h.hashSize : i*h.hashSize])
+		h.setDone(i)
+		h.progress.add(int64(len(piece)), 0)
+	}
+}
+
+// 从剩余最多的Worker那里分走一半的Piece
+func (h *pieceHasher) steal(own *pieceRange, ranges []*pieceRange) bool {
+	for {
+		var victim *pieceRange
+		var most int64
+		for _, r := range ranges {
+			if r != own {
+				if n := r.remaining(); n > most {
+					victim, most = r, n
+				}
+			}
+		}
+		if victim == nil {
+			return false
+		}
+		if next, end, ok := victim.split(); ok {
+			own.m.Lock()
+			own.next, own.end = next, end
+			own.m.Unlock()
+			return true
+		}
+		if most < 2 {
+			// 只剩最后一个Piece，由原来的Worker完成
+			return false
+		}
+	}
+}
+
+func (h *pieceHasher) isDone(i int64) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.done.IsSet(int(i))
+}
+
+func (h *pieceHasher) setDone(i int64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.done.Set(int(i))
+}
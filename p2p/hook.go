@@ -0,0 +1,241 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 命令失败时，错误信息中最多带上的输出长度
+	MAX_HOOK_OUTPUT = 512
+)
+
+// 下载完成后执行的钩子，Command与URL只能设置一个
+type Hook struct {
+	Command []string `json:"command,omitempty"` // 命令与参数，不经过shell，在下载目录中执行
+	URL     string   `json:"url,omitempty"`     // 以POST方式发送HookEvent
+}
+
+// URL钩子收到的内容
+type HookEvent struct {
+	TaskId string   `json:"taskId"`
+	IP     string   `json:"ip"`
+	Dir    string   `json:"dir"`   // 下载目录
+	Files  []string `json:"files"` // 相对下载目录的路径
+}
+
+// 接收任务之前检查钩子是否在Agent配置的白名单中
+func CheckHooks(cfg *common.Config, hooks []*Hook) error {
+	for i, h := range hooks {
+		switch {
+		case len(h.Command) > 0 && h.URL != "":
+			return fmt.Errorf("Hook %d has both command and url", i)
+		case len(h.Command) > 0:
+			if !hookCommandAllowed(cfg.Control.HookCommands, h.Command[0]) {
+				return fmt.Errorf("Hook command %s is not allowed", h.Command[0])
+			}
+		case h.URL != "":
+			if !hookURLAllowed(cfg.Control.HookURLs, h.URL) {
+				return fmt.Errorf("Hook url %s is not allowed", h.URL)
+			}
+		default:
+			return fmt.Errorf("Hook %d has neither command nor url", i)
+		}
+	}
+	return nil
+}
+
+func hookCommandAllowed(allowed []string, cmd string) bool {
+	for _, a := range allowed {
+		if a == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// 协议、主机与端口完全相同，路径在配置的路径之下。不按字符串前缀比较，
+// 否则https://hooks.example.com会允许https://hooks.example.com.attacker.net与https://hooks.example.com@evil
+func hookURLAllowed(allowed []string, raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.User != nil || hasDotSegment(u.Path) {
+		return false
+	}
+	for _, a := range allowed {
+		au, err := url.Parse(a)
+		if err != nil || au.Host == "" {
+			continue
+		}
+		if strings.EqualFold(u.Scheme, au.Scheme) && strings.EqualFold(u.Hostname(), au.Hostname()) &&
+			urlPort(u) == urlPort(au) && pathWithin(au.Path, u.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// 没有指定端口时使用协议的默认端口
+func urlPort(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+// p为dir或在dir之下，按/分隔的路径段比较
+func pathWithin(dir, p string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return dir == "" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// 解码后的路径中有.或..段时，服务端可能解析到配置的路径之外，如/deploy/../admin与/deploy/%2e%2e/admin。
+// 有些服务端把\也作为分隔符
+func hasDotSegment(p string) bool {
+	if strings.Contains(p, `\`) {
+		return true
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// 依次执行任务的钩子，一个失败后不再执行后面的。在单独的Goroutine中调用
+func (s *P2pSession) runHooks(hooks []*Hook) error {
+	// 配置可能在任务下发后修改，执行前重新检查
+	if err := CheckHooks(s.g.cfg, hooks); err != nil {
+		return err
+	}
+	timeout := time.Duration(s.g.cfg.Control.HookTimeout) * time.Second
+	for i, h := range hooks {
+		start := time.Now()
+		var err error
+		if len(h.Command) > 0 {
+			err = s.runCommandHook(h.Command, timeout)
+		} else {
+			err = s.runURLHook(h.URL, timeout)
+		}
+		if err != nil {
+			return fmt.Errorf("Hook %d failed: %v", i, err)
+		}
+		s.log.Infof("Run hook %d (%.2f seconds)", i, time.Now().Sub(start).Seconds())
+	}
+	return nil
+}
+
+func (s *P2pSession) runCommandHook(args []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = s.downDir()
+	cmd.Env = append(os.Environ(), "GOFD_TASK_ID="+s.taskId, "GOFD_DOWN_DIR="+s.downDir())
+	cmd.WaitDelay = time.Second // 超时后子进程还占用输出时不再等待
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		s.log.Debugf("Hook command %s output: %s", args[0], out)
+		return nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New("Timeout after " + timeout.String())
+	}
+	if out = bytes.TrimSpace(out); len(out) == 0 {
+		return err
+	}
+	if len(out) > MAX_HOOK_OUTPUT {
+		out = out[len(out)-MAX_HOOK_OUTPUT:]
+	}
+	return fmt.Errorf("%v, output=%s", err, out)
+}
+
+func (s *P2pSession) runURLHook(addr string, timeout time.Duration) error {
+	e := &HookEvent{TaskId: s.taskId, IP: s.g.cfg.Net.IP, Dir: s.downDir()}
+	for _, fd := range s.task.MetaInfo.Files {
+		e.Files = append(e.Files, fd.Name)
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// 不跟随重定向，否则白名单中的地址可以把事件转发到任意地址
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	rsp, err := client.Post(addr, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		return fmt.Errorf("Recv http status code %v", rsp.StatusCode)
+	}
+	return nil
+}
+
+// 下载完成且写入磁盘后上报完成，任务有钩子时等钩子执行成功后再上报，升级任务等新版本安装成功后再上报
+func (s *P2pSession) reportCompleted() {
+	if s.piped() && !s.pipeFinished {
+		// 等命令读完数据并退出后再上报
+		return
+	}
+	if fc := s.fileChecks; fc != nil {
+		if fc.pending > 0 {
+			// 等所有文件校验完成后再上报
+			return
+		}
+		if fc.failed {
+			s.reportStatus(float32(-1))
+			return
+		}
+	}
+	s.saveManifest()
+	if len(s.task.Hooks) == 0 && !s.task.Upgrade || s.seeding() {
+		s.reportStatus(float32(100))
+		return
+	}
+	s.log.Infof("Run %v hooks", len(s.task.Hooks))
+	go func(hooks []*Hook, upgrade bool) {
+		err := s.runHooks(hooks)
+		if err == nil && upgrade {
+			// 升级任务在钩子之后安装新版本
+			err = s.installUpgrade()
+		}
+		s.hookChan <- err
+	}(s.task.Hooks, s.task.Upgrade)
+}
+
+// 钩子执行完成，在Session的Goroutine中调用
+func (s *P2pSession) hooksDone(err error) {
+	if err != nil {
+		s.log.Errorf("Run hooks failed, error=%v", err)
+		s.reportFailed(ERR_HOOK_FAILED, err.Error())
+		return
+	}
+	s.reportStatus(float32(100))
+	if s.task.Upgrade {
+		s.g.upgrader.Restart(s.taskId)
+	}
+}
@@ -0,0 +1,74 @@
+package p2p
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+func TestHookURLAllowed(t *testing.T) {
+	allowed := []string{"https://hooks.example.com", "http://10.0.0.2:8080/deploy/", "http://ci.example.com/api"}
+	cases := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://hooks.example.com/notify", true},
+		{"https://HOOKS.example.com:443/notify", true},
+		{"https://hooks.example.com.attacker.net/notify", false},
+		{"https://hooks.example.com@evil/notify", false},
+		{"https://user@hooks.example.com/notify", false},
+		{"http://hooks.example.com/notify", false},
+		{"https://hooks.example.com:8443/notify", false},
+		{"http://10.0.0.2:8080/deploy/app", true},
+		{"http://10.0.0.2:8080/deploy", true},
+		{"http://10.0.0.2:8080/deployment", false},
+		{"http://10.0.0.2/deploy/app", false},
+		{"http://ci.example.com/api/hook", true},
+		{"http://ci.example.com/apis", false},
+		{"http://10.0.0.2:8080/deploy/../admin", false},
+		{"http://10.0.0.2:8080/deploy/%2e%2e/admin", false},
+		{"http://10.0.0.2:8080/deploy/%2E%2E/admin", false},
+		{"http://10.0.0.2:8080/deploy/..%2fadmin", false},
+		{"http://10.0.0.2:8080/deploy/..", false},
+		{"http://10.0.0.2:8080/deploy/./app", false},
+		{"http://10.0.0.2:8080/deploy/..\\admin", false},
+		{"http://10.0.0.2:8080/deploy/app..v2", true},
+		{"https://hooks.example.com/a/../b", false},
+		{"/deploy/app", false},
+		{"not a url", false},
+	}
+	for _, c := range cases {
+		if hookURLAllowed(allowed, c.url) != c.ok {
+			t.Errorf("hookURLAllowed(%q) want %v", c.url, c.ok)
+		}
+	}
+	if hookURLAllowed(nil, "https://hooks.example.com/") || hookURLAllowed([]string{""}, "https://hooks.example.com/") {
+		t.Error("empty allowlist allows url")
+	}
+}
+
+// 白名单中的地址重定向到其它地址时不跟随，钩子失败
+func TestURLHookRedirect(t *testing.T) {
+	other := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		other <- r.URL.Path
+	}))
+	defer target.Close()
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+"/admin", http.StatusTemporaryRedirect)
+	}))
+	defer hook.Close()
+
+	s := &P2pSession{g: &global{cfg: &common.Config{}}, task: &DispatchTask{MetaInfo: &MetaInfo{}}}
+	if err := s.runURLHook(hook.URL+"/deploy", time.Second); err == nil {
+		t.Fatal("redirected hook succeeds")
+	}
+	select {
+	case p := <-other:
+		t.Fatalf("follow redirect to %s", p)
+	default:
+	}
+}
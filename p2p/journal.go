@@ -0,0 +1,149 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 记录已写入Piece的日志文件后缀，与断点续传文件放在同一目录
+	journalFileSuffix = ".gofd-journal"
+	// 写缓冲写入磁盘并保存位图后清空日志的间隔
+	JOURNAL_CHECKPOINT_INTERVAL = 30 * time.Second
+)
+
+// 写入数据前先追加Piece序号的日志。位图中不在日志里的Piece已写入磁盘，
+// Agent异常退出后只需要校验日志中的Piece，不需要校验整个位图或所有文件。
+// 每次检查点把写缓冲写入磁盘、保存位图后，日志中只保留正在下载的Piece
+type pieceJournal struct {
+	file       string
+	header     []byte // 元数据指纹与Piece个数
+	n          int
+	written    *Bitset // 已记录到日志中的Piece
+	fd         *os.File
+	disabled   bool      // 日志不可用（还没有检查点或写入失败），不再记录
+	checkpoint time.Time // 上次检查点的时间
+	log        common.Logger
+}
+
+func newPieceJournal(dir, taskId string, m *MetaInfo, n int, l common.Logger) *pieceJournal {
+	var header bytes.Buffer
+	header.Write(m.Fingerprint())
+	binary.Write(&header, binary.BigEndian, uint32(n))
+	return &pieceJournal{
+		file:     filepath.Join(dir, "."+taskId+journalFileSuffix),
+		header:   header.Bytes(),
+		n:        n,
+		written:  NewBitset(n),
+		disabled: true,
+		log:      l,
+	}
+}
+
+// 读取日志中的Piece，文件不存在或与元数据不匹配时返回nil。
+// 最后一条记录没有写完整时忽略
+func (j *pieceJournal) load() *Bitset {
+	if j == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(j.file)
+	if err != nil {
+		return nil
+	}
+	hl := len(j.header)
+	if len(data) < hl || !bytes.Equal(data[:hl], j.header) {
+		j.log.Warnf("Ignore mismatched journal file %s", j.file)
+		return nil
+	}
+	b := NewBitset(j.n)
+	for off := hl; off+4 <= len(data); off += 4 {
+		if i := int(binary.BigEndian.Uint32(data[off : off+4])); i < j.n {
+			b.Set(i)
+		}
+	}
+	return b
+}
+
+// 写入Piece的数据前调用，每个Piece在两次检查点之间只记录一次
+func (j *pieceJournal) record(piece int) {
+	if j == nil || j.disabled || j.written.IsSet(piece) {
+		return
+	}
+	if j.fd == nil {
+		fd, err := os.OpenFile(j.file, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			j.fail(err)
+			return
+		}
+		j.fd = fd
+	}
+	var rec [4]byte
+	binary.BigEndian.PutUint32(rec[:], uint32(piece))
+	if _, err := j.fd.Write(rec[:]); err != nil {
+		j.fail(err)
+		return
+	}
+	j.written.Set(piece)
+}
+
+// 日志写入失败时删除日志，重启后按位图校验所有Piece
+func (j *pieceJournal) fail(err error) {
+	j.log.Errorf("Write journal file %s failed, error=%v", j.file, err)
+	j.remove()
+}
+
+// 位图保存后调用，重写只包含active的日志
+func (j *pieceJournal) reset(active []int) {
+	if j == nil {
+		return
+	}
+	j.close()
+	var buf bytes.Buffer
+	buf.Write(j.header)
+	j.written = NewBitset(j.n)
+	for _, i := range active {
+		binary.Write(&buf, binary.BigEndian, uint32(i))
+		j.written.Set(i)
+	}
+
+	tmp := j.file + ".tmp"
+	err := ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(tmp, j.file)
+	}
+	j.checkpoint = time.Now()
+	if err != nil {
+		j.fail(err)
+		return
+	}
+	j.disabled = false
+}
+
+// 距离上次检查点是否超过了间隔
+func (j *pieceJournal) due() bool {
+	return j != nil && time.Now().Sub(j.checkpoint) >= JOURNAL_CHECKPOINT_INTERVAL
+}
+
+func (j *pieceJournal) close() {
+	if j != nil && j.fd != nil {
+		j.fd.Close()
+		j.fd = nil
+	}
+}
+
+func (j *pieceJournal) remove() {
+	if j == nil {
+		return
+	}
+	j.close()
+	j.disabled = true
+	if err := os.Remove(j.file); err != nil && !os.IsNotExist(err) {
+		j.log.Errorf("Remove journal file %s failed, error=%v", j.file, err)
+	}
+}
@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	// 文件数超过该值的任务，Server只给Agent下发任务URI，Agent以压缩的JSONL获取元数据
+	LARGE_META_FILES = 10000
+
+	// 获取元数据接口的format参数，返回gzip压缩的JSONL，没有该参数时返回JSON
+	META_FORMAT_JSONL = "jsonl"
+)
+
+// 按行输出元数据时的首行，之后每行一个FileDict
+type metaHeader struct {
+	Length       int64    `json:"length"`
+	PieceLen     int64    `json:"PieceLen"`
+	Pieces       []byte   `json:"pieces"`
+	Hash         string   `json:"hash,omitempty"`
+	AlignFiles   bool     `json:"alignFiles,omitempty"`
+	Signature    []byte   `json:"signature,omitempty"`
+	FileCount    int      `json:"fileCount"`
+	PadLastPiece bool     `json:"padLastPiece,omitempty"`
+	WebSeeds     []string `json:"webSeeds,omitempty"`
+	NoCompress   bool     `json:"noCompress,omitempty"`
+	EncryptKey   []byte   `json:"encryptKey,omitempty"`
+	BundleSize   int64    `json:"bundleSize,omitempty"`
+}
+
+// 以按行分隔的JSON格式输出元数据，便于下游工具边读边处理文件列表
+func (m *MetaInfo) WriteJSONL(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	h := &metaHeader{
+		Length:       m.Length,
+		PieceLen:     m.PieceLen,
+		Pieces:       m.Pieces,
+		Hash:         m.Hash,
+		AlignFiles:   m.AlignFiles,
+		Signature:    m.Signature,
+		FileCount:    len(m.Files),
+		PadLastPiece: m.PadLastPiece,
+		WebSeeds:     m.WebSeeds,
+		NoCompress:   m.NoCompress,
+		EncryptKey:   m.EncryptKey,
+		BundleSize:   m.BundleSize,
+	}
+	if err := enc.Encode(h); err != nil {
+		return err
+	}
+	for _, fd := range m.Files {
+		if err := enc.Encode(fd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 读取WriteJSONL输出的元数据
+func ReadJSONL(r io.Reader) (*MetaInfo, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	h := &metaHeader{}
+	if err := dec.Decode(h); err != nil {
+		return nil, fmt.Errorf("Read metainfo header failed: %v", err)
+	}
+
+	// 文件数来自对端，只按上限预分配
+	capacity := h.FileCount
+	if capacity > LARGE_META_FILES {
+		capacity = LARGE_META_FILES
+	}
+	m := &MetaInfo{
+		Length:       h.Length,
+		PieceLen:     h.PieceLen,
+		Pieces:       h.Pieces,
+		Hash:         h.Hash,
+		AlignFiles:   h.AlignFiles,
+		Signature:    h.Signature,
+		Files:        make([]*FileDict, 0, capacity),
+		PadLastPiece: h.PadLastPiece,
+		WebSeeds:     h.WebSeeds,
+		NoCompress:   h.NoCompress,
+		EncryptKey:   h.EncryptKey,
+		BundleSize:   h.BundleSize,
+	}
+	// 同一目录中的文件共用Path，几十万个文件时可以节省不少内存
+	paths := make(map[string]string)
+	for i := 0; i < h.FileCount; i++ {
+		fd := &FileDict{}
+		if err := dec.Decode(fd); err != nil {
+			return nil, fmt.Errorf("Read file %d of %d failed: %v", i, h.FileCount, err)
+		}
+		if p, ok := paths[fd.Path]; ok {
+			fd.Path = p
+		} else {
+			paths[fd.Path] = fd.Path
+		}
+		m.Files = append(m.Files, fd)
+	}
+	return m, nil
+}
+
+// 元数据编码为gzip压缩的JSONL，文件列表逐行写入，不需要在内存中生成整个JSON
+func EncodeMeta(m *MetaInfo) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := m.WriteJSONL(zw); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 边读边解码元数据，支持gzip压缩的JSONL与旧版本Server返回的JSON
+func ReadMeta(r io.Reader) (*MetaInfo, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return ReadJSONL(zr)
+	}
+	m := new(MetaInfo)
+	if err := json.NewDecoder(br).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 按获取元数据接口的format参数返回EncodeMeta的结果或转换为JSON，旧版本的Agent没有该参数，使用JSON
+func MetaResponse(data []byte, format string) (body []byte, contentType string, err error) {
+	if format == META_FORMAT_JSONL {
+		return data, "application/gzip", nil
+	}
+	m, err := ReadMeta(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	body, err = json.Marshal(m)
+	return body, "application/json", err
+}
@@ -0,0 +1,109 @@
+package p2p
+
+import (
+	"container/list"
+	"sync"
+)
+
+// 任务的文件数超过该值时，读取已有文件的存储在读写时才打开文件，
+// 最多同时打开该数量的文件，避免几十万个小文件耗尽文件句柄
+const MAX_OPEN_FILES = 1024
+
+// 打开后一直占用文件句柄的文件系统，文件数多时需要延迟打开
+func holdsHandles(fileSystem FileSystem) bool {
+	_, ok := fileSystem.(*fileSystemAdapter)
+	return ok
+}
+
+// 延迟打开的文件共用的句柄，最久没有使用的先关闭
+type openFiles struct {
+	sync.Mutex
+	fileSystem FileSystem
+	max        int
+	lru        *list.List // 已打开的*lazyFile，最近使用的在前
+}
+
+func newOpenFiles(fileSystem FileSystem, max int) *openFiles {
+	return &openFiles{fileSystem: fileSystem, max: max, lru: list.New()}
+}
+
+// 关闭没有在读写的文件，直到不超过上限
+func (o *openFiles) evict() {
+	for e := o.lru.Back(); e != nil && o.lru.Len() > o.max; {
+		prev := e.Prev()
+		if l := e.Value.(*lazyFile); l.refs == 0 {
+			l.file.Close()
+			l.file, l.elem = nil, nil
+			o.lru.Remove(e)
+		}
+		e = prev
+	}
+}
+
+// 读写时才打开的文件，元数据中的FileDict在打开时使用
+type lazyFile struct {
+	owner *openFiles
+	fd    *FileDict
+	file  File
+	refs  int // 正在读写的次数，大于0时不关闭
+	elem  *list.Element
+}
+
+func (l *lazyFile) acquire() (File, error) {
+	o := l.owner
+	o.Lock()
+	defer o.Unlock()
+	if l.file == nil {
+		file, err := openFileDict(o.fileSystem, l.fd)
+		if err != nil {
+			return nil, err
+		}
+		l.file = file
+		l.elem = o.lru.PushFront(l)
+		o.evict()
+	} else {
+		o.lru.MoveToFront(l.elem)
+	}
+	l.refs++
+	return l.file, nil
+}
+
+func (l *lazyFile) release() {
+	o := l.owner
+	o.Lock()
+	defer o.Unlock()
+	if l.refs--; l.refs == 0 && o.lru.Len() > o.max {
+		o.evict()
+	}
+}
+
+func (l *lazyFile) ReadAt(p []byte, off int64) (int, error) {
+	file, err := l.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer l.release()
+	return file.ReadAt(p, off)
+}
+
+func (l *lazyFile) WriteAt(p []byte, off int64) (int, error) {
+	file, err := l.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer l.release()
+	return file.WriteAt(p, off)
+}
+
+func (l *lazyFile) Close() error {
+	o := l.owner
+	o.Lock()
+	defer o.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	o.lru.Remove(l.elem)
+	l.file, l.elem = nil, nil
+	return err
+}
@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 运行中的任务调整传输限制，为nil的字段保持不变
+type TaskLimits struct {
+	TaskId         string `json:"taskId,omitempty"`
+	Upload         *int   `json:"upload,omitempty"`         // Unit: MiBps，0表示不限制
+	Download       *int   `json:"download,omitempty"`       // Unit: MiBps，0表示不限制
+	MaxUploadPeers *int   `json:"maxUploadPeers,omitempty"` // 同时上传的下游Peer数，0表示不限制
+	RequestWindow  *int   `json:"requestWindow,omitempty"`  // 向每个上游Peer未完成的块请求数
+	Paused         *bool  `json:"paused,omitempty"`         // 为true时暂停块的传输，保留已下载的Piece与Peer连接，为false时恢复
+}
+
+func (tl *TaskLimits) Validate() error {
+	if tl.Upload == nil && tl.Download == nil && tl.MaxUploadPeers == nil && tl.RequestWindow == nil && tl.Paused == nil {
+		return errors.New("No limit to change")
+	}
+	for name, v := range map[string]*int{"upload": tl.Upload, "download": tl.Download, "maxUploadPeers": tl.MaxUploadPeers} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("Invalid %s %d", name, *v)
+		}
+	}
+	if tl.RequestWindow != nil && *tl.RequestWindow < 1 {
+		return fmt.Errorf("Invalid requestWindow %d", *tl.RequestWindow)
+	}
+	return nil
+}
+
+func (tl *TaskLimits) String() string {
+	s := ""
+	add := func(name string, v *int) {
+		if v != nil {
+			s += fmt.Sprintf(", %s=%d", name, *v)
+		}
+	}
+	add("upload", tl.Upload)
+	add("download", tl.Download)
+	add("maxUploadPeers", tl.MaxUploadPeers)
+	add("requestWindow", tl.RequestWindow)
+	if tl.Paused != nil {
+		s += fmt.Sprintf(", paused=%v", *tl.Paused)
+	}
+	if s == "" {
+		return ""
+	}
+	return s[2:]
+}
+
+// 调整任务的传输限制，任务结束后忽略
+func (s *P2pSession) SetLimits(tl *TaskLimits) {
+	select {
+	case s.limitsChan <- tl:
+	case <-s.endedChan:
+	}
+}
+
+// 在Session的Goroutine中调用
+func (s *P2pSession) applyLimits(tl *TaskLimits) {
+	s.log.Infof("Set task limits, %v", tl)
+	if tl.Upload != nil {
+		s.uploadLimiter.SetRate(mibps(*tl.Upload))
+	}
+	if tl.Download != nil {
+		s.downloadLimiter.SetRate(mibps(*tl.Download))
+	}
+	if tl.Paused != nil && *tl.Paused != s.adminPaused {
+		s.adminPaused = *tl.Paused
+		s.log.Infof("Task is paused=%v", s.adminPaused)
+		s.pausedChanged()
+	}
+	if tl.MaxUploadPeers == nil && tl.RequestWindow == nil {
+		return
+	}
+	if tl.MaxUploadPeers != nil {
+		v := *tl.MaxUploadPeers
+		s.limits.MaxUploadPeers = &v
+	}
+	if tl.RequestWindow != nil {
+		v := *tl.RequestWindow
+		s.limits.RequestWindow = &v
+	}
+	// 立即按新的限制选择上传的Peer，补充请求
+	if !s.transfersPaused() {
+		s.resumeTransfers()
+	}
+}
+
+// 同时上传的下游Peer数，没有调整过时使用配置
+func (s *P2pSession) maxUploadPeers() int {
+	if s.limits.MaxUploadPeers != nil {
+		return *s.limits.MaxUploadPeers
+	}
+	return s.g.cfg.Control.MaxUploadPeers
+}
+
+// 向每个上游Peer未完成的块请求数，没有调整过时使用配置
+func (s *P2pSession) requestWindow() int {
+	if s.limits.RequestWindow != nil {
+		return *s.limits.RequestWindow
+	}
+	return s.g.cfg.Control.RequestWindow
+}
@@ -2,12 +2,15 @@ package p2p
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"time"
 
-	log "github.com/cihub/seelog"
 	"github.com/xtfly/gofd/common"
 	"github.com/xtfly/gokits"
 )
@@ -19,79 +22,206 @@ type P2pConn struct {
 	client     bool //  对端是否为客户端
 	remoteAddr net.Addr
 	taskId     string
+	codecs     string // 发起端支持的压缩算法
+	codec      string // 协商后的压缩算法
+	pool       bool   // 发起端支持复用连接
+	pooled     bool   // 协商后复用连接
+	dialAddr   string // 本端发起连接时连接的地址
+	version    int    // 对端的协议版本
 }
 
 // StartListen listens on a TCP port for incoming connections and
 // demuxes them to the appropriate active p2pSession based on the taskId
 // in the header.
-func StartListen(cfg *common.Config) (conChan chan *P2pConn, listener net.Listener, err error) {
-	listener, err = CreateListener(cfg)
+func StartListen(cfg *common.Config, l common.Logger) (conChan chan *P2pConn, listener net.Listener, err error) {
+	listener, err = CreateListener(cfg, l)
 	if err != nil {
 		return
 	}
 
 	conChan = make(chan *P2pConn)
-	go func(cfg *common.Config, conChan chan *P2pConn) {
-		var tempDelay time.Duration
-		for {
-			conn, e := listener.Accept()
-			if e != nil {
-				if ne, ok := e.(net.Error); ok && ne.Temporary() {
-					if tempDelay == 0 {
-						tempDelay = 5 * time.Millisecond
-					} else {
-						tempDelay *= 2
-					}
-					if max := 1 * time.Second; tempDelay > max {
-						tempDelay = max
-					}
-					log.Infof("Accept error: %v; retrying in %v", e, tempDelay)
-					time.Sleep(tempDelay)
-					continue
-				}
-				return
-			}
-			tempDelay = 0
+	go acceptPeers(cfg, l, listener, conChan)
 
-			h, err := readHeader(conn)
-			if err != nil {
-				log.Error("Error reading header: ", err)
-				continue
-			}
+	// 配置了其它传输方式时同时监听，TCP始终可用
+	var others []net.Listener
+	if name := cfg.Net.Transport; name != "" && name != TRANSPORT_TCP {
+		var extra net.Listener
+		if extra, err = listenTransport(cfg, name); err != nil {
+			listener.Close()
+			return
+		}
+		go acceptPeers(cfg, l, extra, conChan)
+		others = append(others, extra)
+	}
+	// 配置了中继时同时通过中继接收连接
+	if cfg.Net.Relay != "" {
+		rl := listenRelay(cfg, l)
+		go acceptPeers(cfg, l, rl, conChan)
+		others = append(others, rl)
+	}
+	if len(others) > 0 {
+		listener = &multiListener{Listener: listener, others: others}
+	}
+	return
+}
 
-			if err := h.validate(cfg); err != nil {
-				log.Error("header auth failed:", err)
+// 接收Peer的连接，读取连接头后按任务分发
+func acceptPeers(cfg *common.Config, l common.Logger, listener net.Listener, conChan chan *P2pConn) {
+	var tempDelay time.Duration
+	for {
+		conn, e := listener.Accept()
+		if e != nil {
+			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				l.Infof("Accept error: %v; retrying in %v", e, tempDelay)
+				time.Sleep(tempDelay)
 				continue
 			}
+			return
+		}
+		tempDelay = 0
 
-			conChan <- &P2pConn{
-				conn:       conn,
-				client:     true,
-				remoteAddr: conn.RemoteAddr(),
-				taskId:     h.TaskId,
-			}
+		c, err := acceptHeader(cfg, l, conn)
+		if err != nil {
+			continue
 		}
-	}(cfg, conChan)
+		conChan <- c
+	}
+}
 
+// 读取连接头并认证，复用的连接上每个任务都重新认证
+func acceptHeader(cfg *common.Config, l common.Logger, conn net.Conn) (*P2pConn, error) {
+	h, err := readHeader(conn)
+	if err != nil {
+		l.With("peerID", conn.RemoteAddr().String()).Errorf("Error reading header: %v", err)
+		return nil, err
+	}
+
+	if err := h.validate(cfg); err != nil {
+		l.With("peerID", conn.RemoteAddr().String()).Errorf("header auth failed: %v", err)
+		return nil, err
+	}
+
+	version := parseVersion(h.Version)
+	if version < MIN_PROTOCOL_VERSION {
+		err = fmt.Errorf("Protocol version %d is too old, min is %d", version, MIN_PROTOCOL_VERSION)
+		l.With("peerID", conn.RemoteAddr().String()).Errorf("%v", err)
+		return nil, err
+	}
+
+	return &P2pConn{
+		conn:       conn,
+		client:     true,
+		remoteAddr: conn.RemoteAddr(),
+		taskId:     h.TaskId,
+		codecs:     h.Codecs,
+		pool:       h.Features == CONN_FEATURE_POOL,
+		version:    version,
+	}, nil
+}
+
+// 读取连接响应，接入端去掉了CONN_RSP_VERSION_BIT时再读取一个字节的版本
+func readConnRsp(conn net.Conn) (rsp byte, version int, err error) {
+	bs := make([]byte, 1)
+	if _, err = io.ReadFull(conn, bs); err != nil {
+		return
+	}
+	rsp, version = bs[0], 1
+	if rsp&CONN_RSP_VERSION_BIT == 0 {
+		if _, err = io.ReadFull(conn, bs); err != nil {
+			return
+		}
+		version = int(bs[0])
+	}
 	return
 }
 
-func CreateListener(cfg *common.Config) (listener net.Listener, err error) {
-	listener, err = net.ListenTCP("tcp",
+// 监听TCP的数据端口，TCP始终可用
+func CreateListener(cfg *common.Config, l common.Logger) (listener net.Listener, err error) {
+	if listener, err = listenTransport(cfg, TRANSPORT_TCP); err != nil {
+		l.Errorf("Listen failed: %v", err)
+		return
+	}
+	l.Infof("Listening for peers on %s", common.JoinHostPort(cfg.DataListenIP(), cfg.Net.DataPort))
+	return
+}
+
+func listenTCP(cfg *common.Config) (listener net.Listener, err error) {
+	listener, err = net.ListenTCP(cfg.DataListenNetwork(),
 		&net.TCPAddr{
-			IP:   net.ParseIP(cfg.Net.IP),
+			IP:   net.ParseIP(cfg.DataListenIP()),
 			Port: cfg.Net.DataPort,
 		})
-
 	if err != nil {
-		log.Error("Listen failed:", err)
 		return
 	}
 
-	log.Infof("Listening for peers on %s:%v", cfg.Net.IP, cfg.Net.DataPort)
+	if tc := cfg.Net.Tls; tc != nil && tc.Peer {
+		var c *tls.Config
+		if c, err = tc.ServerConfig(); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("Load tls config failed: %v", err)
+		}
+		listener = tls.NewListener(listener, c)
+	}
 	return
 }
 
+// 连接其它Peer，优先使用配置的传输方式，失败时使用TCP。经过代理时只使用TCP
+func dialPeer(cfg *common.Config, l common.Logger, addr string, timeout time.Duration) (net.Conn, error) {
+	if name := cfg.Net.Transport; name != "" && name != TRANSPORT_TCP && cfg.ProxyFor(addr) == nil {
+		if t, ok := lookupTransport(name); ok {
+			conn, err := t.Dial(cfg, addr, timeout)
+			if err == nil {
+				return conn, nil
+			}
+			l.Warnf("Dial peer %s by %s failed, fall back to tcp, error=%v", addr, name, err)
+		}
+	}
+	t, _ := lookupTransport(TRANSPORT_TCP)
+	return t.Dial(cfg, addr, timeout)
+}
+
+// TCP连接，配置了TLS时使用TLS连接。配置了dataIP时从该地址发起连接，匹配到代理时经过代理
+func dialTCP(cfg *common.Config, addr string, timeout time.Duration) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if src := cfg.DataSourceAddr(); src != nil {
+		d.LocalAddr = src
+	}
+	tc := cfg.Net.Tls
+	if tc == nil || !tc.Peer {
+		return cfg.DialContext(context.Background(), d, "tcp", addr)
+	}
+	c, err := tc.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	c.ClientSessionCache = peerTLSSessions
+	if c.ServerName == "" {
+		c.ServerName = common.StripPort(addr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := cfg.DialContext(ctx, d, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, c)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
 // reading header info
 func readHeader(conn net.Conn) (h *Header, err error) {
 	h = &Header{}
@@ -134,6 +264,27 @@ func readHeader(conn net.Conn) (h *Header, err error) {
 		return
 	}
 
+	// 旧版本没有发送支持的压缩算法
+	if buf.Len() > 0 {
+		if h.Codecs, err = readString(buf); err != nil {
+			return
+		}
+	}
+
+	// 旧版本不支持复用连接
+	if buf.Len() > 0 {
+		if h.Features, err = readString(buf); err != nil {
+			return
+		}
+	}
+
+	// 旧版本没有发送协议版本
+	if buf.Len() > 0 {
+		if h.Version, err = readString(buf); err != nil {
+			return
+		}
+	}
+
 	return
 }
 
@@ -151,7 +302,14 @@ func writeHeader(conn net.Conn, taskId string, cfg *common.Config) (err error) {
 	all := [][]byte{[]byte(taskId),
 		[]byte(cfg.Auth.Username),
 		[]byte(pwd),
-		[]byte(salt)}
+		[]byte(salt),
+		[]byte(supportedCodecs)}
+	// 不复用连接时功能为空，后面跟协议版本
+	var features string
+	if cfg.Net.PeerIdleTimeout > 0 {
+		features = CONN_FEATURE_POOL
+	}
+	all = append(all, []byte(features), []byte(strconv.Itoa(PROTOCOL_VERSION)))
 
 	buf := bytes.NewBuffer(make([]byte, 0))
 	blen := 0
@@ -0,0 +1,127 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	taskURIScheme = "magnet"
+	taskURIPrefix = "urn:gofd:"
+)
+
+// 元数据的标识，为指纹的十六进制。Agent初始化时会修改文件的Path，需要在初始化之前计算
+func (m *MetaInfo) InfoHash() string {
+	return hex.EncodeToString(m.Fingerprint())
+}
+
+// 简短的任务引用，Agent只知道InfoHash时，从Tracker或已有任务的Peer获取完整的元数据，
+// 格式为magnet:?xt=urn:gofd:<InfoHash>&dn=<TaskId>&tr=<服务端管理地址>&x.pe=<Agent管理地址>
+type TaskURI struct {
+	TaskId   string
+	InfoHash string
+	Trackers []string // 服务端的管理地址
+	Peers    []string // 已有任务的Agent的管理地址
+}
+
+func (u *TaskURI) String() string {
+	// xt放在最前面，不使用url.Values的按键排序
+	var b strings.Builder
+	b.WriteString(taskURIScheme + ":?xt=" + taskURIPrefix + u.InfoHash)
+	if u.TaskId != "" {
+		b.WriteString("&dn=" + url.QueryEscape(u.TaskId))
+	}
+	for _, tr := range u.Trackers {
+		b.WriteString("&tr=" + url.QueryEscape(tr))
+	}
+	for _, pe := range u.Peers {
+		b.WriteString("&x.pe=" + url.QueryEscape(pe))
+	}
+	return b.String()
+}
+
+func ParseTaskURI(s string) (*TaskURI, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != taskURIScheme {
+		return nil, fmt.Errorf("Invalid task uri scheme %q", u.Scheme)
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	xt := q.Get("xt")
+	if !strings.HasPrefix(xt, taskURIPrefix) {
+		return nil, fmt.Errorf("Invalid task uri xt %q", xt)
+	}
+	tu := &TaskURI{
+		TaskId:   q.Get("dn"),
+		InfoHash: strings.ToLower(strings.TrimPrefix(xt, taskURIPrefix)),
+		Trackers: q["tr"],
+		Peers:    q["x.pe"],
+	}
+	if bs, err := hex.DecodeString(tu.InfoHash); err != nil || len(bs) != sha256.Size {
+		return nil, fmt.Errorf("Invalid task uri info hash %q", tu.InfoHash)
+	}
+	if len(tu.Trackers) == 0 && len(tu.Peers) == 0 {
+		return nil, errors.New("Task uri has no tracker or peer")
+	}
+	return tu, nil
+}
+
+// 依次从Tracker与Peer获取元数据，校验InfoHash一致后返回
+func ResolveTaskURI(cfg *common.Config, l common.Logger, tu *TaskURI) (*MetaInfo, error) {
+	return ResolveTaskURIContext(context.Background(), cfg, l, tu)
+}
+
+// ctx取消后不再尝试其它地址，返回ctx的错误
+func ResolveTaskURIContext(ctx context.Context, cfg *common.Config, l common.Logger, tu *TaskURI) (*MetaInfo, error) {
+	var lastErr error
+	client := common.CreateHttpClient(cfg)
+	try := func(addr, urlpath string) *MetaInfo {
+		// 元数据可能有几十万个文件，边读边解码
+		body, err := common.OpenHttpReqContext(ctx, client, cfg, "GET", addr, urlpath+tu.InfoHash+"?format="+META_FORMAT_JSONL)
+		if err == nil {
+			var m *MetaInfo
+			m, err = ReadMeta(body)
+			body.Close()
+			if err == nil && m.InfoHash() != tu.InfoHash {
+				err = errors.New("Info hash mismatch")
+			}
+			if err == nil {
+				return m
+			}
+		}
+		l.Warnf("Fetch metainfo from %s failed, error=%v", addr, err)
+		lastErr = err
+		return nil
+	}
+
+	for _, addr := range common.ResolveAddrs(tu.Trackers) {
+		if m := try(addr, "/api/v1/server/meta/"); m != nil {
+			return m, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	for _, addr := range tu.Peers {
+		if m := try(addr, "/api/v1/agent/meta/"); m != nil {
+			return m, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("Resolve task uri failed, last error=%v", lastErr)
+}
@@ -0,0 +1,202 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var errMemoryStoreDisabled = errors.New("Memory store is disabled")
+
+// 内存中的空间不足
+type MemoryStoreError struct {
+	Required  int64
+	Available int64
+}
+
+func (e *MemoryStoreError) Error() string {
+	return fmt.Sprintf("Insufficient memory store, required=%v, available=%v", e.Required, e.Available)
+}
+
+// 只在内存中保存的一个任务的文件
+type memTask struct {
+	names  []string          // 文件打开的顺序
+	files  map[string][]byte // 按文件的本地路径
+	size   int64
+	ended  bool      // Session已结束，下载完成的数据保留到空间不足时淘汰
+	usedAt time.Time // Session结束或最近一次读取的时间
+}
+
+// 不读写磁盘的任务数据，所有任务总的大小不超过limit
+type MemoryStore struct {
+	lock  sync.Mutex
+	limit int64
+	used  int64
+	tasks map[string]*memTask
+}
+
+func NewMemoryStore(limit int64) *MemoryStore {
+	return &MemoryStore{limit: limit, tasks: make(map[string]*memTask)}
+}
+
+// 元数据中需要保存的数据长度，软链接没有数据
+func memTaskSize(mi *MetaInfo) (size int64) {
+	for _, fd := range mi.Files {
+		if fd.Link == "" {
+			size += fd.Length
+		}
+	}
+	return
+}
+
+// 已结束的任务可以被淘汰，不计入已使用的空间
+func (ms *MemoryStore) availableLocked() int64 {
+	available := ms.limit - ms.used
+	for _, mt := range ms.tasks {
+		if mt.ended {
+			available += mt.size
+		}
+	}
+	return available
+}
+
+// 还可以使用的空间
+func (ms *MemoryStore) available() int64 {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.availableLocked()
+}
+
+// 接收任务之前检查空间是否足够
+func (ms *MemoryStore) Check(mi *MetaInfo) error {
+	if ms.limit <= 0 {
+		return errMemoryStoreDisabled
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	required := memTaskSize(mi)
+	if available := ms.availableLocked(); available < required {
+		return &MemoryStoreError{Required: required, Available: available}
+	}
+	return nil
+}
+
+// 为任务分配空间，空间不足时按结束的先后淘汰已结束的任务。同一任务重新下发时替换原有的数据
+func (ms *MemoryStore) reserve(taskId string, mi *MetaInfo) (*memTask, error) {
+	if ms.limit <= 0 {
+		return nil, errMemoryStoreDisabled
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.removeLocked(taskId)
+
+	required := memTaskSize(mi)
+	if available := ms.availableLocked(); available < required {
+		return nil, &MemoryStoreError{Required: required, Available: available}
+	}
+	for ms.limit-ms.used < required {
+		var oldest string
+		for id, mt := range ms.tasks {
+			if mt.ended && (oldest == "" || mt.usedAt.Before(ms.tasks[oldest].usedAt)) {
+				oldest = id
+			}
+		}
+		ms.removeLocked(oldest)
+	}
+
+	mt := &memTask{files: make(map[string][]byte), size: required}
+	ms.tasks[taskId] = mt
+	ms.used += required
+	return mt, nil
+}
+
+func (ms *MemoryStore) removeLocked(taskId string) {
+	if mt, ok := ms.tasks[taskId]; ok {
+		delete(ms.tasks, taskId)
+		ms.used -= mt.size
+	}
+}
+
+// Session结束时调用，下载完成的数据保留，其它的释放
+func (ms *MemoryStore) taskEnded(taskId string, complete bool) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	mt, ok := ms.tasks[taskId]
+	if !ok {
+		return
+	}
+	if !complete {
+		ms.removeLocked(taskId)
+		return
+	}
+	mt.ended, mt.usedAt = true, time.Now()
+}
+
+// 读取已结束任务保留的文件，file为本地路径，为空时读取第一个文件
+func (ms *MemoryStore) open(taskId, file string) (io.ReadCloser, bool) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	mt, ok := ms.tasks[taskId]
+	if !ok || !mt.ended || len(mt.names) == 0 {
+		return nil, false
+	}
+	if file == "" {
+		file = mt.names[0]
+	}
+	data, ok := mt.files[file]
+	if !ok {
+		return nil, false
+	}
+	mt.usedAt = time.Now()
+	return io.NopCloser(bytes.NewReader(data)), true
+}
+
+// 任务的文件保存在memTask中的FileSystem，只在Session的Goroutine中打开文件
+type memFileSystem struct {
+	task *memTask
+}
+
+func (m *memFileSystem) Open(name []string, length int64) (File, error) {
+	key := localPath(name...)
+	data, ok := m.task.files[key]
+	if !ok {
+		data = make([]byte, length)
+		m.task.files[key] = data
+		m.task.names = append(m.task.names, key)
+	}
+	return &memFile{data: data}, nil
+}
+
+func (m *memFileSystem) Close() error {
+	return nil
+}
+
+// 长度固定的内存文件
+type memFile struct {
+	data []byte
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(f.data)) {
+		return 0, fmt.Errorf("Write out of range, offset=%v, length=%v, size=%v", off, len(p), len(f.data))
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
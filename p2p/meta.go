@@ -1,111 +1,493 @@
 package p2p
 
 import (
-	"crypto/sha1"
+	"context"
 	"fmt"
 	"io"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 
-	log "github.com/cihub/seelog"
+	"github.com/xtfly/gofd/common"
+)
+
+// 打开文件时，文件实际大小的检查方式
+type SizeCheck int
+
+const (
+	SizeCheck_Exact   SizeCheck = iota // 实际大小必须与元数据一致
+	SizeCheck_AtLeast                  // 实际大小不小于元数据中的大小，只读取前面的部分
+	SizeCheck_Ignore                   // 不检查
 )
 
 // FileSystem接口适配
 type fileSystemAdapter struct {
+	sizeCheck SizeCheck
+	s3        *S3Client // 不为nil时，s3://开头的路径从对象存储读取
+}
+
+// 只读打开已有文件的FileSystem
+func NewFileSystemAdapter(sizeCheck SizeCheck) FileSystem {
+	return &fileSystemAdapter{sizeCheck: sizeCheck}
 }
 
 func (f *fileSystemAdapter) Open(name []string, length int64) (file File, err error) {
+	if f.s3 != nil && len(name) > 0 && isS3Path(name[0]) {
+		return f.s3.open(name, length, f.sizeCheck)
+	}
 	var ff *os.File
-	ff, err = os.Open(path.Clean(path.Join(name...)))
+	ff, err = os.Open(localPath(name...))
 	if err != nil {
 		return
 	}
 	stat, err := ff.Stat()
 	if err != nil {
+		ff.Close()
 		return
 	}
 	actualSize := stat.Size()
-	if actualSize != length {
+	switch {
+	case f.sizeCheck == SizeCheck_Exact && actualSize != length:
 		err = fmt.Errorf("Unexpected file size %v. Expected %v", actualSize, length)
+	case f.sizeCheck == SizeCheck_AtLeast && actualSize < length:
+		err = fmt.Errorf("Unexpected file size %v. Expected at least %v", actualSize, length)
+	}
+	if err != nil {
+		ff.Close()
 		return
 	}
 	file = ff
 	return
 }
 
+func (f *fileSystemAdapter) OpenPartial(name []string, size int64) (file File, err error) {
+	if f.sizeCheck == SizeCheck_Ignore {
+		return f.Open(name, size)
+	}
+	return (&fileSystemAdapter{sizeCheck: SizeCheck_AtLeast, s3: f.s3}).Open(name, size)
+}
+
 func (f *fileSystemAdapter) Close() error {
 	return nil
 }
 
-func (m *MetaInfo) addFiles(fileInfo os.FileInfo, file string, idx int) (err error) {
-	fileDict := FileDict{Length: fileInfo.Size()}
-	cleanFile := path.Clean(file)
-	fileDict.Path, fileDict.Name = path.Split(cleanFile)
-	fileDict.Sum, err = sha1Sum(file)
+// 待计算摘要的文件
+type pendingFile struct {
+	file     string
+	fileInfo os.FileInfo
+	dir      string // 目录中的文件，dir为目录的上一级，name为相对dir的路径
+	name     string
+	link     string       // 保留的软链接指向的相对路径
+	same     *pendingFile // 目录中指向前面某个文件的硬链接或软链接，作为内容相同的文件分发
+	sum      string
+	err      error
+}
+
+// 收集待计算摘要的文件，按文件大小分组，用于查找重复的文件
+type fileCollector struct {
+	opts   *CreateOptions
+	files  []*pendingFile
+	bySize map[int64][]*pendingFile
+}
+
+// 查找指向同一个文件的路径，软链接已由os.Stat解析
+func (c *fileCollector) findSameFile(fi os.FileInfo) *pendingFile {
+	for _, pf := range c.bySize[fi.Size()] {
+		if os.SameFile(pf.fileInfo, fi) {
+			return pf
+		}
+	}
+	return nil
+}
+
+func (c *fileCollector) add(f string, fileInfo os.FileInfo, dir, name string) error {
+	// 不打开非普通文件，打开管道会一直阻塞
+	if !fileInfo.Mode().IsRegular() {
+		if c.opts.SpecialFiles == SpecialFile_Fail {
+			return fmt.Errorf("Not support special file %s, mode=%v", f, fileInfo.Mode())
+		}
+		c.opts.logger().Warnf("Skip special file %s, mode=%v", f, fileInfo.Mode())
+		return nil
+	}
+
+	if dup := c.findSameFile(fileInfo); dup != nil && name != "" {
+		// 目录中的硬链接是目录结构的一部分，Agent上同样需要这个路径
+		c.opts.logger().Debugf("File %s is the same file as %s", f, dup.file)
+		c.files = append(c.files, &pendingFile{file: f, fileInfo: fileInfo, dir: dir, name: name, same: dup})
+		return nil
+	} else if dup != nil {
+		real, _ := filepath.EvalSymlinks(f)
+		if c.opts.Duplicates == Duplicate_Fail {
+			return fmt.Errorf("File %s and %s are the same file %s", dup.file, f, real)
+		}
+		c.opts.logger().Warnf("Skip duplicate file %s, same as %s (%s)", f, dup.file, real)
+		return nil
+	}
+
+	pf := &pendingFile{file: f, fileInfo: fileInfo, dir: dir, name: name}
+	c.files = append(c.files, pf)
+	c.bySize[fileInfo.Size()] = append(c.bySize[fileInfo.Size()], pf)
+	return nil
+}
+
+// 递归遍历目录，文件按路径的字典序排列，保证不同主机上生成的Piece摘要一致。
+// 目录中的软链接指向文件时按文件处理，指向目录时不进入，避免循环
+func (c *fileCollector) addDir(root string) error {
+	root = filepath.Clean(root)
+	parent := filepath.Dir(root)
+	return filepath.Walk(root, func(f string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, ok := c.innerLink(root, f); ok {
+				rel, err := filepath.Rel(parent, f)
+				if err != nil {
+					return err
+				}
+				c.files = append(c.files, &pendingFile{file: f, fileInfo: fi, dir: parent,
+					name: filepath.ToSlash(rel), link: link})
+				return nil
+			}
+			if fi, err = os.Stat(f); err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				c.opts.logger().Warnf("Skip symlink to dir %s", f)
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(parent, f)
+		if err != nil {
+			return err
+		}
+		return c.add(f, fi, parent, filepath.ToSlash(rel))
+	})
+}
+
+// 配置保留软链接时，指向目录内的相对软链接作为软链接分发，其它软链接仍按指向的文件处理
+func (c *fileCollector) innerLink(root, f string) (string, bool) {
+	if !c.opts.KeepLinks {
+		return "", false
+	}
+	target, err := os.Readlink(f)
+	if err != nil || filepath.IsAbs(target) {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, filepath.Join(filepath.Dir(f), target))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		c.opts.logger().Warnf("Symlink %s points to %s outside of %s, dispatch the target", f, target, root)
+		return "", false
+	}
+	return filepath.ToSlash(target), true
+}
+
+func (m *MetaInfo) addFiles(pf *pendingFile) {
+	fileDict := FileDict{Length: pf.fileInfo.Size(), Sum: pf.sum}
+	if pf.link != "" {
+		fileDict.Length, fileDict.Link = 0, pf.link
+	} else {
+		fileDict.Mode = uint32(pf.fileInfo.Mode().Perm())
+		if mt := pf.fileInfo.ModTime(); !mt.IsZero() {
+			fileDict.ModTime = mt.Unix()
+		}
+	}
+	if pf.name != "" {
+		// 保留文件在目录中的相对路径，下载时在下载目录中重建目录结构
+		fileDict.Path, fileDict.Name = filepath.ToSlash(pf.dir), pf.name
+	} else if isS3Path(pf.file) {
+		// path.Clean会把s3://变为s3:/
+		i := strings.LastIndex(pf.file, "/")
+		fileDict.Path, fileDict.Name = pf.file[:i+1], pf.file[i+1:]
+	} else {
+		fileDict.Path, fileDict.Name = splitLocalPath(pf.file)
+	}
+	m.Files = append(m.Files, &fileDict)
+	m.Length += fileDict.Length
+}
+
+// 多个Goroutine并行计算文件的摘要，优先使用预先计算的摘要，其次是缓存
+func sumFiles(files []*pendingFile, opts *CreateOptions, hashName string, newHash hashFunc, done <-chan struct{}) error {
+	sums, err := precomputedSums(opts.FileSums, newHash().Size())
 	if err != nil {
 		return err
 	}
-	m.Files[idx] = &fileDict
-	return
+	var total int64
+	count := 0
+	for _, pf := range files {
+		if pf.link == "" && pf.same == nil {
+			total += pf.fileInfo.Size()
+			count++
+		}
+	}
+	progress := newMetaProgress(opts.Progress, META_PHASE_FILE_SUM, total, count)
+
+	jobs := make(chan *pendingFile)
+	var wg sync.WaitGroup
+	for i := 0; i < defaultWorkers(opts.Workers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pf := range jobs {
+				select {
+				case <-done:
+					pf.err = ErrCanceled
+					continue
+				default:
+				}
+				if sum, ok := sums[filepath.Clean(pf.file)]; ok {
+					pf.sum = sum
+					progress.add(pf.fileInfo.Size(), 1)
+					continue
+				}
+				if opts.SumCache != nil {
+					if sum, ok := opts.SumCache.get(pf.file, pf.fileInfo, hashName); ok {
+						pf.sum = sum
+						progress.add(pf.fileInfo.Size(), 1)
+						continue
+					}
+				}
+				if isS3Path(pf.file) {
+					pf.sum, pf.err = opts.S3.sum(pf.file, newHash, done)
+					progress.add(pf.fileInfo.Size(), 1)
+				} else {
+					pf.sum, pf.err = fileSum(pf.file, newHash, opts.logger(), done, progress)
+					progress.add(0, 1)
+				}
+				if pf.err == ErrCanceled {
+					continue
+				}
+				if opts.SumCache != nil {
+					if pf.err != nil {
+						opts.SumCache.fail(pf.file, pf.err)
+					} else {
+						opts.SumCache.put(pf.file, pf.fileInfo, hashName, pf.sum)
+					}
+				}
+			}
+		}()
+	}
+
+	for _, pf := range files {
+		if pf.link == "" && pf.same == nil {
+			jobs <- pf
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	progress.finish()
+	return nil
+}
+
+// 遇到管道、Socket、设备等非普通文件时的处理策略
+type SpecialFilePolicy int
+
+const (
+	SpecialFile_Skip SpecialFilePolicy = iota // 跳过并记录告警
+	SpecialFile_Fail                          // 返回错误
+)
+
+// 指定的多个路径（如文件与指向它的软链接）指向同一个文件时的处理策略，目录中的硬链接总是作为内容相同的文件分发
+type DuplicatePolicy int
+
+const (
+	Duplicate_Collapse DuplicatePolicy = iota // 只保留第一个路径
+	Duplicate_Fail                            // 返回错误
+)
+
+// 创建元数据的选项
+type CreateOptions struct {
+	Profile      *Profile
+	SpecialFiles SpecialFilePolicy
+	Duplicates   DuplicatePolicy
+	SkipErrors   bool            // 跳过计算摘要失败的文件，不返回错误
+	SumCache     *SumCache       // 重试时复用上一次计算成功的文件摘要
+	Cancel       <-chan struct{} // 关闭时取消计算摘要，新的调用方使用CreateFileMetaContext的ctx
+	MemoryBudget int64           // 并行计算摘要时缓存Piece的内存上限，单位字节，0表示不限制
+	Workers      int             // 并行计算摘要的Goroutine数，0表示GOMAXPROCS
+	S3           *S3Client       // 分发s3://开头的对象时使用
+	KeepLinks    bool            // 目录中指向目录内的相对软链接作为软链接分发
+	DedupFiles   bool            // 内容相同的文件只传输一次，Agent上创建硬链接或复制
+	Log          common.Logger   // 为nil时使用common.DefaultLogger()
+
+	// 不计算整个文件的摘要，每个文件只读取一次。Agent不再校验整个文件，DedupFiles也不生效
+	SkipFileSums bool
+	// 预先计算的文件摘要，如构建系统已生成的校验和，不再读取这些文件计算。键为文件路径，
+	// 目录中的文件为目录路径与相对路径拼接的路径；值为十六进制，与Profile的摘要算法一致
+	FileSums map[string]string
+	// 计算文件与Piece的摘要时回调进度，相同阶段的回调间隔不小于META_PROGRESS_INTERVAL，不能阻塞
+	Progress func(p *MetaProgress)
+}
+
+func (o *CreateOptions) logger() common.Logger {
+	if o.Log == nil {
+		return common.DefaultLogger()
+	}
+	return o.Log
 }
 
 func CreateFileMeta(roots []string, pieceLen int64) (mi *MetaInfo, err error) {
-	mi = &MetaInfo{Files: make([]*FileDict, len(roots))}
-	for idx, f := range roots {
+	return CreateFileMetaWithProfile(roots, &Profile{PieceLen: pieceLen})
+}
+
+// 根据分发模板创建元数据
+func CreateFileMetaWithProfile(roots []string, p *Profile) (mi *MetaInfo, err error) {
+	return CreateFileMetaWithOptions(roots, &CreateOptions{Profile: p})
+}
+
+func CreateFileMetaWithOptions(roots []string, opts *CreateOptions) (mi *MetaInfo, err error) {
+	return CreateFileMetaContext(context.Background(), roots, opts)
+}
+
+// ctx取消或超时后停止计算文件与Piece的摘要，返回ctx的错误
+func CreateFileMetaContext(ctx context.Context, roots []string, opts *CreateOptions) (mi *MetaInfo, err error) {
+	done, stop := mergeCancel(ctx, opts.Cancel)
+	defer stop()
+	defer func() { err = canceledErr(ctx, err) }()
+
+	p := opts.Profile
+	if p == nil {
+		p = &Profile{}
+	}
+	if err = p.Validate(); err != nil {
+		return nil, err
+	}
+	newHash, _ := lookupHash(p.Hash)
+
+	mi = &MetaInfo{
+		Files:        make([]*FileDict, 0, len(roots)),
+		Hash:         p.Hash,
+		AlignFiles:   p.AlignFiles,
+		PadLastPiece: p.PadLastPiece,
+		BundleSize:   p.BundleSize,
+	}
+	c := &fileCollector{
+		opts:   opts,
+		files:  make([]*pendingFile, 0, len(roots)),
+		bySize: make(map[int64][]*pendingFile),
+	}
+	for _, f := range roots {
 		var fileInfo os.FileInfo
-		fileInfo, err = os.Stat(f)
+		if isS3Path(f) {
+			if opts.S3 == nil {
+				return nil, fmt.Errorf("Not config s3 for file %s", f)
+			}
+			// 只支持单个对象，不支持按前缀分发
+			fileInfo, err = opts.S3.stat(f)
+		} else {
+			fileInfo, err = os.Stat(f)
+		}
 		if err != nil {
-			log.Errorf("File not exist file=%s, error=%v", f, err)
+			opts.logger().Errorf("File not exist file=%s, error=%v", f, err)
 			return
 		}
 
 		if fileInfo.IsDir() {
-			return nil, fmt.Errorf("Not support dir")
+			err = c.addDir(f)
+		} else {
+			err = c.add(f, fileInfo, "", "")
 		}
-
-		err = mi.addFiles(fileInfo, f, idx)
 		if err != nil {
 			return nil, err
 		}
-		mi.Length += fileInfo.Size()
 	}
 
+	if !opts.SkipFileSums {
+		if err = sumFiles(c.files, opts, p.Hash, newHash, done); err != nil {
+			return nil, err
+		}
+	}
+	var dedup dedupIndex
+	if opts.DedupFiles {
+		dedup = make(dedupIndex)
+	}
+	added := make(map[*pendingFile]*FileDict)
+	for _, pf := range c.files {
+		if pf.same != nil {
+			if src, ok := added[pf.same]; ok {
+				mi.addSameFile(pf, src)
+			} else {
+				opts.logger().Errorf("Skip file %s, same file %s is skipped", pf.file, pf.same.file)
+			}
+			continue
+		}
+		if pf.err != nil {
+			if !opts.SkipErrors || pf.err == ErrCanceled {
+				return nil, pf.err
+			}
+			opts.logger().Errorf("Skip file that summary failed, file=%s, error=%v", pf.file, pf.err)
+			continue
+		}
+		mi.addFiles(pf)
+		added[pf] = mi.Files[len(mi.Files)-1]
+		if dedup != nil {
+			mi.Length -= dedup.dedup(mi.Files[len(mi.Files)-1])
+		}
+	}
+	if len(mi.Files) == 0 {
+		return nil, fmt.Errorf("No file to dispatch")
+	}
+
+	pieceLen := p.PieceLen
 	if pieceLen == 0 {
-		pieceLen = choosePieceLength(mi.Length)
+		pieceLen = p.choosePieceLength(mi.Length)
 	}
 	mi.PieceLen = pieceLen
 
-	fileStore, fileStoreLength, err := NewFileStore(mi, &fileSystemAdapter{})
+	fileStore, fileStoreLength, err := NewFileStore(mi, &fileSystemAdapter{s3: opts.S3}, opts.logger())
 	if err != nil {
 		return nil, err
 	}
 	defer fileStore.Close()
+	if mi.AlignFiles {
+		// 文件对齐后，文件之间填充的空洞也计入总长度
+		mi.Length = fileStoreLength
+	}
 	if fileStoreLength != mi.Length {
 		return nil, fmt.Errorf("Filestore total length %v, expected %v", fileStoreLength, mi.Length)
 	}
 
 	var sums []byte
-	sums, err = computeSums(fileStore, mi.Length, mi.PieceLen)
+	sums, err = runPieceHasher(fileStore, mi, newHash, opts, done)
 	if err != nil {
 		return nil, err
 	}
 	mi.Pieces = sums
-	log.Debugf("File totallength=%v, piecelength=%v", mi.Length, pieceLen)
+	opts.logger().Debugf("File totallength=%v, piecelength=%v", mi.Length, pieceLen)
 	return mi, nil
 }
 
-func sha1Sum(file string) (sum string, err error) {
+// 计算所有Piece的摘要，回调进度
+func runPieceHasher(fs FileStore, mi *MetaInfo, newHash hashFunc, opts *CreateOptions, done <-chan struct{}) ([]byte, error) {
+	length := mi.pieceDataLength(mi.Length)
+	h := newPieceHasher(fs, length, mi.PieceLen, newHash, opts.Workers, opts.MemoryBudget)
+	h.progress = newMetaProgress(opts.Progress, META_PHASE_PIECE_SUM, length, 0)
+	sums, err := h.run(done)
+	if err == nil {
+		h.progress.finish()
+	}
+	return sums, err
+}
+
+func fileSum(file string, newHash hashFunc, l common.Logger, done <-chan struct{}, progress *metaProgress) (sum string, err error) {
 	var f *os.File
 	f, err = os.Open(file)
 	if err != nil {
-		log.Errorf("Open file failed, file=%s, error=%v", file, err)
+		l.Errorf("Open file failed, file=%s, error=%v", file, err)
 		return
 	}
 	defer f.Close()
-	hash := sha1.New()
-	_, err = io.Copy(hash, f)
+	hash := newHash()
+	_, err = io.Copy(hash, &cancelReader{r: &progressReader{r: f, p: progress}, done: done})
+	if err == ErrCanceled {
+		return
+	}
 	if err != nil {
-		log.Errorf("Summary file by sha1 failed, file=%s, error=%v", file, err)
+		l.Errorf("Summary file failed, file=%s, error=%v", file, err)
 		return
 	}
 	sum = string(hash.Sum(nil))
@@ -114,23 +496,120 @@ func sha1Sum(file string) (sum string, err error) {
 
 const (
 	MinimumPieceLength   = 16 * 1024
-	TargetPieceCountLog2 = 10
+	TargetPieceCountLog2 = 10 // 分发模板没有配置PieceCountLog2时的默认值
 	TargetPieceCountMin  = 1 << TargetPieceCountLog2
 
 	// Target piece count should be < TargetPieceCountMax
 	TargetPieceCountMax = TargetPieceCountMin << 1
+
+	// 配置的PieceCountLog2的上限
+	MaxPieceCountLog2 = 24
 )
 
-// Choose a good piecelength.
-func choosePieceLength(totalLength int64) (pieceLength int64) {
-	// Must be a power of 2.
-	// Must be a multiple of 16KB
-	// Prefer to provide around 1024..2048 pieces.
-	pieceLength = MinimumPieceLength
-	pieces := totalLength / pieceLength
-	for pieces >= TargetPieceCountMax {
-		pieceLength <<= 1
-		pieces >>= 1
+// 文件中的一段数据，Length为0时到文件末尾
+type FileRange struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset,omitempty"`
+	Length int64  `json:"length,omitempty"`
+}
+
+// 为文件中[offset, offset+length)范围内的数据创建元数据，如磁盘镜像中的一个分区
+func CreateRangeFileMeta(file string, offset, length, pieceLen int64) (mi *MetaInfo, err error) {
+	if length <= 0 {
+		return nil, fmt.Errorf("Invalid range length %v", length)
 	}
-	return
+	if pieceLen != 0 && !validPieceLength(pieceLen) {
+		return nil, fmt.Errorf("Invalid piece length %v", pieceLen)
+	}
+	return CreateRangesFileMeta([]*FileRange{{File: file, Offset: offset, Length: length}},
+		&CreateOptions{Profile: &Profile{PieceLen: pieceLen}})
+}
+
+// 为多个文件中的多段数据创建元数据，只分发大文件中变化的部分，接收端在已有文件的相同位置写入，
+// 不截断文件。同一文件中的多段数据不能重叠
+func CreateRangesFileMeta(ranges []*FileRange, opts *CreateOptions) (mi *MetaInfo, err error) {
+	return CreateRangesFileMetaContext(context.Background(), ranges, opts)
+}
+
+func CreateRangesFileMetaContext(ctx context.Context, ranges []*FileRange, opts *CreateOptions) (mi *MetaInfo, err error) {
+	done, stop := mergeCancel(ctx, opts.Cancel)
+	defer stop()
+	defer func() { err = canceledErr(ctx, err) }()
+
+	p := opts.Profile
+	if p == nil {
+		p = &Profile{}
+	}
+	if err = p.Validate(); err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("No range to dispatch")
+	}
+	newHash, _ := lookupHash(p.Hash)
+
+	mi = &MetaInfo{Hash: p.Hash, AlignFiles: p.AlignFiles, PadLastPiece: p.PadLastPiece}
+	byFile := make(map[string][]*FileDict)
+	for _, r := range ranges {
+		file := filepath.Clean(r.File)
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			opts.logger().Errorf("File not exist file=%s, error=%v", file, err)
+			return nil, err
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil, fmt.Errorf("Not support special file %s, mode=%v", file, fileInfo.Mode())
+		}
+		length := r.Length
+		if length == 0 {
+			length = fileInfo.Size() - r.Offset
+		}
+		if r.Offset < 0 || length <= 0 || r.Offset+length > fileInfo.Size() {
+			return nil, fmt.Errorf("Range [%v, %v) out of file size %v, file=%s", r.Offset, r.Offset+length, fileInfo.Size(), file)
+		}
+
+		fd := &FileDict{Length: length, Offset: r.Offset, Partial: true}
+		fd.Path, fd.Name = splitLocalPath(file)
+		for _, o := range byFile[file] {
+			if fd.Offset < o.Offset+o.Length && o.Offset < fd.Offset+fd.Length {
+				return nil, fmt.Errorf("Range [%v, %v) overlaps [%v, %v), file=%s", fd.Offset, fd.Offset+fd.Length, o.Offset, o.Offset+o.Length, file)
+			}
+		}
+		if fd.Sum, err = partialSum(fd, newHash, done); err != nil {
+			return nil, err
+		}
+		byFile[file] = append(byFile[file], fd)
+		mi.Files = append(mi.Files, fd)
+		mi.Length += length
+	}
+
+	mi.PieceLen = p.PieceLen
+	if mi.PieceLen == 0 {
+		mi.PieceLen = p.choosePieceLength(mi.Length)
+	}
+	fileStore, fileStoreLength, err := NewFileStore(mi, &fileSystemAdapter{}, opts.logger())
+	if err != nil {
+		return nil, err
+	}
+	defer fileStore.Close()
+	if mi.AlignFiles {
+		// 文件对齐后，文件之间填充的空洞也计入总长度
+		mi.Length = fileStoreLength
+	}
+
+	mi.Pieces, err = runPieceHasher(fileStore, mi, newHash, opts, done)
+	if err != nil {
+		return nil, err
+	}
+	opts.logger().Debugf("File ranges=%v, totallength=%v, piecelength=%v", len(ranges), mi.Length, mi.PieceLen)
+	return mi, nil
+}
+
+// 一段数据的摘要
+func partialSum(fd *FileDict, newHash hashFunc, done <-chan struct{}) (string, error) {
+	sum, err := fileDictSum(&fileSystemAdapter{}, fd, newHash, done)
+	if err != nil {
+		return "", err
+	}
+	return string(sum), nil
 }
@@ -0,0 +1,88 @@
+package p2p
+
+import (
+	"context"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 创建元数据的选项，修改CreateOptions中的对应项。之后增加的参数只增加选项，CreateMeta的签名保持不变
+type MetaOption func(*CreateOptions)
+
+func NewCreateOptions(opts ...MetaOption) *CreateOptions {
+	o := &CreateOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// 修改分发模板的副本，不修改调用方传入或已注册的模板
+func (o *CreateOptions) editProfile(fn func(p *Profile)) {
+	p := Profile{}
+	if o.Profile != nil {
+		p = *o.Profile
+	}
+	fn(&p)
+	o.Profile = &p
+}
+
+// 分发模板，之后的WithPieceLength与WithHasher在其副本上修改
+func WithProfile(p *Profile) MetaOption {
+	return func(o *CreateOptions) { o.Profile = p }
+}
+
+// Piece的长度，必须是2的幂，为0时根据文件总大小自动选择
+func WithPieceLength(pieceLen int64) MetaOption {
+	return func(o *CreateOptions) { o.editProfile(func(p *Profile) { p.PieceLen = pieceLen }) }
+}
+
+// Piece与文件的摘要算法，见HashNames
+func WithHasher(name string) MetaOption {
+	return func(o *CreateOptions) { o.editProfile(func(p *Profile) { p.Hash = name }) }
+}
+
+// 为nil时使用common.DefaultLogger()
+func WithLogger(l common.Logger) MetaOption {
+	return func(o *CreateOptions) { o.Log = l }
+}
+
+// 并行计算摘要的Goroutine数与缓存Piece的内存上限，单位字节，0表示不限制
+func WithConcurrency(workers int, memoryBudget int64) MetaOption {
+	return func(o *CreateOptions) { o.Workers, o.MemoryBudget = workers, memoryBudget }
+}
+
+// 重试时复用上一次计算成功的文件摘要
+func WithSumCache(c *SumCache) MetaOption {
+	return func(o *CreateOptions) { o.SumCache = c }
+}
+
+// 计算摘要时回调进度，不能阻塞
+func WithProgress(fn func(p *MetaProgress)) MetaOption {
+	return func(o *CreateOptions) { o.Progress = fn }
+}
+
+// 分发s3://开头的对象
+func WithS3(c *S3Client) MetaOption {
+	return func(o *CreateOptions) { o.S3 = c }
+}
+
+// 目录中指向目录内的相对软链接作为软链接分发
+func WithKeepLinks() MetaOption {
+	return func(o *CreateOptions) { o.KeepLinks = true }
+}
+
+// 内容相同的文件只传输一次
+func WithDedupFiles() MetaOption {
+	return func(o *CreateOptions) { o.DedupFiles = true }
+}
+
+// 按选项创建元数据，ctx取消或超时后停止计算摘要，返回ctx的错误
+func CreateMeta(ctx context.Context, roots []string, opts ...MetaOption) (*MetaInfo, error) {
+	return CreateFileMetaContext(ctx, roots, NewCreateOptions(opts...))
+}
+
+// 按选项创建只分发文件中部分数据的元数据
+func CreateRangesMeta(ctx context.Context, ranges []*FileRange, opts ...MetaOption) (*MetaInfo, error) {
+	return CreateRangesFileMetaContext(ctx, ranges, NewCreateOptions(opts...))
+}
@@ -0,0 +1,104 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 创建元数据的阶段
+const (
+	META_PHASE_FILE_SUM  = "fileSum"  // 计算整个文件的摘要
+	META_PHASE_PIECE_SUM = "pieceSum" // 计算Piece的摘要
+
+	// 两次进度回调的最小间隔，阶段结束时总是回调
+	META_PROGRESS_INTERVAL = 200 * time.Millisecond
+)
+
+// 创建元数据的进度，每个阶段从0开始计算
+type MetaProgress struct {
+	Phase     string `json:"phase"`
+	Total     int64  `json:"total"`               // 本阶段需要读取的字节数
+	Done      int64  `json:"done"`                // 已读取的字节数，使用缓存或预先计算的摘要的文件直接计入
+	Files     int    `json:"files,omitempty"`     // 计算文件摘要阶段的文件数
+	DoneFiles int    `json:"doneFiles,omitempty"` // 已完成的文件数
+}
+
+// 多个Goroutine计算摘要时汇总进度，回调不会并发调用
+type metaProgress struct {
+	fn   func(p *MetaProgress)
+	lock sync.Mutex
+	p    MetaProgress
+	last time.Time
+}
+
+// 没有设置回调时返回nil，nil的方法为空操作
+func newMetaProgress(fn func(p *MetaProgress), phase string, total int64, files int) *metaProgress {
+	if fn == nil {
+		return nil
+	}
+	m := &metaProgress{fn: fn, p: MetaProgress{Phase: phase, Total: total, Files: files}, last: time.Now()}
+	m.report()
+	return m
+}
+
+func (m *metaProgress) add(bytes int64, files int) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.p.Done += bytes
+	m.p.DoneFiles += files
+	if time.Since(m.last) >= META_PROGRESS_INTERVAL {
+		m.last = time.Now()
+		m.report()
+	}
+}
+
+// 阶段成功结束时调用
+func (m *metaProgress) finish() {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.p.Done, m.p.DoneFiles = m.p.Total, m.p.Files
+	m.report()
+}
+
+func (m *metaProgress) report() {
+	p := m.p
+	m.fn(&p)
+}
+
+// 读取时累计已读取的字节数
+type progressReader struct {
+	r io.Reader
+	p *metaProgress
+}
+
+func (r *progressReader) Read(b []byte) (n int, err error) {
+	n, err = r.r.Read(b)
+	r.p.add(int64(n), 0)
+	return
+}
+
+// 预先计算的文件摘要，键按filepath.Clean后匹配，值为十六进制
+func precomputedSums(sums map[string]string, hashSize int) (map[string]string, error) {
+	if len(sums) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(sums))
+	for f, v := range sums {
+		sum, err := hex.DecodeString(v)
+		if err != nil || len(sum) != hashSize {
+			return nil, fmt.Errorf("Invalid precomputed sum %s of file %s", v, f)
+		}
+		m[filepath.Clean(f)] = string(sum)
+	}
+	return m, nil
+}
@@ -0,0 +1,300 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 运行指标，以Prometheus的文本格式输出
+type Metrics struct {
+	lock sync.Mutex
+
+	tasks         map[string]*taskMetrics // 活动的任务
+	peers         int                     // 所有任务的Peer连接数
+	pieceFailures uint64                  // Piece校验失败的次数
+	hashedBytes   uint64                  // 校验下载的Piece计算摘要的字节数
+	hashes        durationMetric          // 校验下载的Piece的耗时
+	transfers     durationMetric          // 下载完成的耗时
+	reports       durationMetric          // 向Server上报状态的耗时
+
+	pieceCacheHits   uint64 // Piece缓存命中的次数
+	pieceCacheMisses uint64
+	pieceCacheBytes  int64 // Piece缓存已使用的字节数
+
+	pressurePauses uint64 // 因主机资源压力暂停块传输的次数
+	underPressure  bool
+
+	pooledConnReuses uint64 // 复用连接池中连接的次数
+
+	bufferPoolGets     uint64 // 从缓冲池取用缓冲的次数
+	bufferPoolHits     uint64 // 取用时复用了空闲缓冲的次数
+	bufferPoolDiscards uint64 // 超过上限丢弃放回缓冲的次数
+	bufferPoolBytes    int64  // 缓冲池中空闲缓冲的字节数
+
+	relayConns int               // 正在中继的连接数
+	relayBytes map[string]uint64 // 按目标节点统计的中继字节数
+}
+
+// 单个任务传输的字节数
+type taskMetrics struct {
+	sent     uint64
+	received uint64
+}
+
+// 耗时的汇总
+type durationMetric struct {
+	count   uint64
+	seconds float64
+}
+
+func (d *durationMetric) observe(elapsed time.Duration) {
+	d.count++
+	d.seconds += elapsed.Seconds()
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{tasks: make(map[string]*taskMetrics), relayBytes: make(map[string]uint64)}
+}
+
+func (m *Metrics) taskStarted(taskId string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.tasks[taskId]; !ok {
+		m.tasks[taskId] = &taskMetrics{}
+	}
+}
+
+func (m *Metrics) taskEnded(taskId string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.tasks, taskId)
+}
+
+func (m *Metrics) activeTasks() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.tasks)
+}
+
+func (m *Metrics) task(taskId string) *taskMetrics {
+	tm, ok := m.tasks[taskId]
+	if !ok {
+		tm = &taskMetrics{}
+		m.tasks[taskId] = tm
+	}
+	return tm
+}
+
+func (m *Metrics) sent(taskId string, n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.task(taskId).sent += uint64(n)
+}
+
+func (m *Metrics) received(taskId string, n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.task(taskId).received += uint64(n)
+}
+
+func (m *Metrics) peerConnected(delta int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.peers += delta
+}
+
+// 所有任务的Peer连接数
+func (m *Metrics) peerCount() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.peers
+}
+
+func (m *Metrics) pieceFailed() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pieceFailures++
+}
+
+func (m *Metrics) pieceHashed(n int, elapsed time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.hashedBytes += uint64(n)
+	m.hashes.observe(elapsed)
+}
+
+func (m *Metrics) transferred(elapsed time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.transfers.observe(elapsed)
+}
+
+func (m *Metrics) reported(elapsed time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.reports.observe(elapsed)
+}
+
+func (m *Metrics) pieceCacheRead(hit bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if hit {
+		m.pieceCacheHits++
+	} else {
+		m.pieceCacheMisses++
+	}
+}
+
+func (m *Metrics) pieceCacheSize(bytes int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pieceCacheBytes = bytes
+}
+
+func (m *Metrics) pooledConnReused() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pooledConnReuses++
+}
+
+func (m *Metrics) bufferPoolGet(hit bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bufferPoolGets++
+	if hit {
+		m.bufferPoolHits++
+	}
+}
+
+func (m *Metrics) bufferPoolDiscarded() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bufferPoolDiscards++
+}
+
+func (m *Metrics) bufferPoolSize(bytes int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bufferPoolBytes = bytes
+}
+
+func (m *Metrics) relayConnected(delta int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.relayConns += delta
+}
+
+func (m *Metrics) relayed(target string, n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.relayBytes[target] += uint64(n)
+}
+
+func (m *Metrics) pressurePaused(paused bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if paused {
+		m.pressurePauses++
+	}
+	m.underPressure = paused
+}
+
+// 是否因内存或磁盘压力暂停了下载
+func (m *Metrics) pressured() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.underPressure
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetricHeader(b *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSummary(b *bytes.Buffer, name, help string, d durationMetric) {
+	writeMetricHeader(b, name, "summary", help)
+	fmt.Fprintf(b, "%s_sum %g\n%s_count %d\n", name, d.seconds, name, d.count)
+}
+
+// 以Prometheus的文本格式输出所有指标
+func (m *Metrics) String() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ids := make([]string, 0, len(m.tasks))
+	for id := range m.tasks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	b := new(bytes.Buffer)
+	writeMetricHeader(b, "gofd_active_tasks", "gauge", "Number of active tasks.")
+	fmt.Fprintf(b, "gofd_active_tasks %d\n", len(m.tasks))
+
+	writeMetricHeader(b, "gofd_task_sent_bytes_total", "counter", "Bytes sent to peers per task.")
+	for _, id := range ids {
+		fmt.Fprintf(b, "gofd_task_sent_bytes_total{task=\"%s\"} %d\n", labelEscaper.Replace(id), m.tasks[id].sent)
+	}
+	writeMetricHeader(b, "gofd_task_received_bytes_total", "counter", "Bytes received from peers and web seeds per task.")
+	for _, id := range ids {
+		fmt.Fprintf(b, "gofd_task_received_bytes_total{task=\"%s\"} %d\n", labelEscaper.Replace(id), m.tasks[id].received)
+	}
+
+	writeMetricHeader(b, "gofd_peer_connections", "gauge", "Number of connected peers of all tasks.")
+	fmt.Fprintf(b, "gofd_peer_connections %d\n", m.peers)
+
+	writeMetricHeader(b, "gofd_piece_verify_failures_total", "counter", "Number of downloaded pieces that failed verification.")
+	fmt.Fprintf(b, "gofd_piece_verify_failures_total %d\n", m.pieceFailures)
+	writeMetricHeader(b, "gofd_piece_hash_bytes_total", "counter", "Bytes of downloaded pieces hashed for verification.")
+	fmt.Fprintf(b, "gofd_piece_hash_bytes_total %d\n", m.hashedBytes)
+	writeMetricHeader(b, "gofd_hash_info", "gauge", "Implementation of each registered hash algorithm.")
+	for _, name := range HashNames() {
+		fmt.Fprintf(b, "gofd_hash_info{hash=\"%s\",impl=\"%s\"} 1\n", labelEscaper.Replace(name), HashImpl(name))
+	}
+
+	writeMetricHeader(b, "gofd_piece_cache_hits_total", "counter", "Number of piece reads served from the piece cache.")
+	fmt.Fprintf(b, "gofd_piece_cache_hits_total %d\n", m.pieceCacheHits)
+	writeMetricHeader(b, "gofd_piece_cache_misses_total", "counter", "Number of piece reads that missed the piece cache.")
+	fmt.Fprintf(b, "gofd_piece_cache_misses_total %d\n", m.pieceCacheMisses)
+	writeMetricHeader(b, "gofd_piece_cache_bytes", "gauge", "Bytes of pieces held in the piece cache.")
+	fmt.Fprintf(b, "gofd_piece_cache_bytes %d\n", m.pieceCacheBytes)
+
+	writeMetricHeader(b, "gofd_pressure_paused", "gauge", "Whether piece transfers are paused because the host is under pressure.")
+	fmt.Fprintf(b, "gofd_pressure_paused %d\n", boolToInt32(m.underPressure))
+	writeMetricHeader(b, "gofd_pressure_pauses_total", "counter", "Number of times piece transfers were paused by host pressure.")
+	fmt.Fprintf(b, "gofd_pressure_pauses_total %d\n", m.pressurePauses)
+
+	writeMetricHeader(b, "gofd_peer_pool_reuses_total", "counter", "Number of pooled peer connections reused by later tasks.")
+	fmt.Fprintf(b, "gofd_peer_pool_reuses_total %d\n", m.pooledConnReuses)
+
+	writeMetricHeader(b, "gofd_buffer_pool_gets_total", "counter", "Number of block and piece buffers taken from the buffer pool.")
+	fmt.Fprintf(b, "gofd_buffer_pool_gets_total %d\n", m.bufferPoolGets)
+	writeMetricHeader(b, "gofd_buffer_pool_hits_total", "counter", "Number of buffers taken from the pool that reused an idle buffer.")
+	fmt.Fprintf(b, "gofd_buffer_pool_hits_total %d\n", m.bufferPoolHits)
+	writeMetricHeader(b, "gofd_buffer_pool_discards_total", "counter", "Number of returned buffers dropped because the pool was full.")
+	fmt.Fprintf(b, "gofd_buffer_pool_discards_total %d\n", m.bufferPoolDiscards)
+	writeMetricHeader(b, "gofd_buffer_pool_idle_bytes", "gauge", "Bytes of idle buffers held in the buffer pool.")
+	fmt.Fprintf(b, "gofd_buffer_pool_idle_bytes %d\n", m.bufferPoolBytes)
+
+	targets := make([]string, 0, len(m.relayBytes))
+	for t := range m.relayBytes {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+	writeMetricHeader(b, "gofd_relay_connections", "gauge", "Number of peer connections being relayed.")
+	fmt.Fprintf(b, "gofd_relay_connections %d\n", m.relayConns)
+	writeMetricHeader(b, "gofd_relay_bytes_total", "counter", "Bytes relayed in both directions per relayed peer.")
+	for _, t := range targets {
+		fmt.Fprintf(b, "gofd_relay_bytes_total{peer=\"%s\"} %d\n", labelEscaper.Replace(t), m.relayBytes[t])
+	}
+
+	writeSummary(b, "gofd_transfer_duration_seconds", "Time from task start to download completed.", m.transfers)
+	writeSummary(b, "gofd_report_duration_seconds", "Latency of status reports to the server.", m.reports)
+	writeSummary(b, "gofd_piece_hash_duration_seconds", "Time to read and hash each downloaded piece.", m.hashes)
+	return b.String()
+}
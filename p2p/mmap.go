@@ -0,0 +1,104 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/xtfly/gofd/common"
+)
+
+var (
+	errMmapUnsupported = errors.New("Mmap is not supported on this platform")
+)
+
+// 服务端发送块时从内存映射读取数据，不需要每次读取都调用read。
+// 文件在分发过程中不能被截断，否则访问映射时进程会收到SIGBUS
+type MmapFsProvider struct {
+	Fallback FsProvider // 不支持mmap或映射失败时使用
+}
+
+func (m MmapFsProvider) NewFS() (FileSystem, error) {
+	fallback, err := m.Fallback.NewFS()
+	if err != nil {
+		return nil, err
+	}
+	return &mmapFileSystem{fallback: fallback}, nil
+}
+
+type mmapFileSystem struct {
+	fallback FileSystem
+}
+
+func (m *mmapFileSystem) Open(name []string, length int64) (File, error) {
+	file, err := openMmapFile(localPath(name...), length, SizeCheck_Exact)
+	if err != nil {
+		common.DefaultLogger().Warnf("Mmap file %v failed, use read instead, error=%v", name, err)
+		return m.fallback.Open(name, length)
+	}
+	return file, nil
+}
+
+func (m *mmapFileSystem) OpenPartial(name []string, size int64) (File, error) {
+	file, err := openMmapFile(localPath(name...), size, SizeCheck_AtLeast)
+	if err == nil {
+		return file, nil
+	}
+	common.DefaultLogger().Warnf("Mmap file %v failed, use read instead, error=%v", name, err)
+	po, ok := m.fallback.(partialOpener)
+	if !ok {
+		return nil, errors.New("File system not support partial file")
+	}
+	return po.OpenPartial(name, size)
+}
+
+func (m *mmapFileSystem) Close() error {
+	return m.fallback.Close()
+}
+
+// 只读的内存映射文件
+type mmapFile struct {
+	data []byte
+}
+
+func openMmapFile(file string, length int64, sizeCheck SizeCheck) (*mmapFile, error) {
+	data, err := mmapOpen(file)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(data))
+	switch {
+	case sizeCheck == SizeCheck_Exact && size != length:
+		err = fmt.Errorf("Unexpected file size %v. Expected %v", size, length)
+	case sizeCheck == SizeCheck_AtLeast && size < length:
+		err = fmt.Errorf("Unexpected file size %v. Expected at least %v", size, length)
+	}
+	if err != nil {
+		mmapClose(data)
+		return nil, err
+	}
+	return &mmapFile{data: data}, nil
+}
+
+func (m *mmapFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, m.data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (m *mmapFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("Mmap file is read only")
+}
+
+func (m *mmapFile) Close() (err error) {
+	if m.data != nil {
+		err = mmapClose(m.data)
+		m.data = nil
+	}
+	return
+}
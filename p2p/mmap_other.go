@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package p2p
+
+func mmapOpen(file string) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func mmapClose(data []byte) error {
+	return nil
+}
@@ -0,0 +1,216 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 不使用 -tags fuse 编译时不支持挂载
+var errMountUnsupported = errors.New("Mount is not supported, build with -tags fuse")
+
+// 只读挂载的任务目录树，由文件名中的路径构成。文件的内容从任务的存储读取，
+// 数据还没有下载时读取等待，任务创建时指定顺序下载才能尽早读到数据
+type mountNode struct {
+	name     string
+	children map[string]*mountNode // 目录的子节点，文件为nil
+	file     *FileDict
+	reader   *streamReader // 文件的内容，内容相同的文件共用
+	inode    uint64
+}
+
+func (n *mountNode) isDir() bool {
+	return n.children != nil
+}
+
+// 按名称排序的子节点
+func (n *mountNode) entries() []*mountNode {
+	nodes := make([]*mountNode, 0, len(n.children))
+	for _, c := range n.children {
+		nodes = append(nodes, c)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+	return nodes
+}
+
+func (n *mountNode) mode() os.FileMode {
+	switch {
+	case n.isDir():
+		return os.ModeDir | 0555
+	case n.file.Link != "":
+		return os.ModeSymlink | 0777
+	case n.file.Mode != 0:
+		return os.FileMode(n.file.Mode) & 0555
+	}
+	return 0444
+}
+
+func (n *mountNode) size() int64 {
+	if n.reader != nil {
+		return n.reader.end - n.reader.start
+	}
+	return 0
+}
+
+func (n *mountNode) modTime() time.Time {
+	if n.file != nil && n.file.ModTime > 0 {
+		return time.Unix(n.file.ModTime, 0)
+	}
+	return time.Time{}
+}
+
+// 一个任务的挂载，持有文件的读取，卸载前任务的存储不会关闭
+type taskMount struct {
+	taskId  string
+	dir     string
+	root    *mountNode
+	readers []*streamReader
+	unmount func() error
+	inodes  uint64 // 已分配的inode，根目录为1
+}
+
+func newTaskMount(ts *P2pSession, dir string) *taskMount {
+	tm := &taskMount{taskId: ts.taskId, dir: dir, inodes: 1}
+	tm.root = &mountNode{children: make(map[string]*mountNode), inode: 1}
+	m := ts.task.MetaInfo
+	offsets, _ := m.fileOffsets()
+	readers := make(map[string]*streamReader, len(m.Files))
+	for i, fd := range m.Files {
+		if fd.Link == "" && fd.Same == "" {
+			r := ts.stream.reader(offsets[i], fd.Length)
+			readers[fd.Name] = r
+			tm.readers = append(tm.readers, r)
+		}
+	}
+	for _, fd := range m.Files {
+		n := tm.add(fd.Name)
+		n.file = fd
+		if fd.Same != "" {
+			n.reader = readers[fd.Same]
+		} else {
+			n.reader = readers[fd.Name]
+		}
+	}
+	return tm
+}
+
+// 按路径创建节点及其上级目录
+func (tm *taskMount) add(name string) *mountNode {
+	n := tm.root
+	parts := strings.Split(strings.Trim(filepath.ToSlash(name), "/"), "/")
+	for i, part := range parts {
+		c, ok := n.children[part]
+		if !ok {
+			tm.inodes++
+			c = &mountNode{name: part, inode: tm.inodes}
+			if i < len(parts)-1 {
+				c.children = make(map[string]*mountNode)
+			}
+			n.children[part] = c
+		}
+		n = c
+	}
+	return n
+}
+
+// 先关闭读取，唤醒等待数据的进程，避免卸载时挂载点忙
+func (tm *taskMount) close() error {
+	for _, r := range tm.readers {
+		r.Close()
+	}
+	if tm.unmount != nil {
+		return tm.unmount()
+	}
+	return nil
+}
+
+// 运行中的挂载，按任务ID索引
+type mounts struct {
+	lock  sync.Mutex
+	tasks map[string]*taskMount
+}
+
+// 把任务的文件只读挂载到dir，dir需要在Control.MountDirs配置的某个目录之下。
+// 下载完成后继续上传的任务也可以挂载，卸载前任务的存储不会关闭
+func (sm *P2pSessionMgnt) Mount(taskId, dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("Mount dir %s is not an absolute path", dir)
+	}
+	dir = filepath.Clean(dir)
+	allowed := false
+	for _, base := range sm.g.cfg.Control.MountDirs {
+		if withinDir(filepath.Clean(base), dir) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("Mount dir %s is not allowed", dir)
+	}
+
+	sm.mounts.lock.Lock()
+	defer sm.mounts.lock.Unlock()
+	if tm, ok := sm.mounts.tasks[taskId]; ok {
+		return fmt.Errorf("Task is already mounted at %s", tm.dir)
+	}
+	for _, tm := range sm.mounts.tasks {
+		if tm.dir == dir {
+			return fmt.Errorf("Mount dir %s is used by task %s", dir, tm.taskId)
+		}
+	}
+
+	q := &streamQuery{taskId: taskId, out: make(chan *P2pSession, 1)}
+	sm.streamChan <- q
+	ts := <-q.out
+	if ts == nil {
+		return errors.New("Task is not existed")
+	}
+	if ts.piped() {
+		return errors.New("Task data is written to pipe")
+	}
+	tm := newTaskMount(ts, dir)
+	unmount, err := mountFS(tm, sm.g.log.With("taskID", taskId))
+	if err != nil {
+		tm.close()
+		return err
+	}
+	tm.unmount = unmount
+	sm.mounts.tasks[taskId] = tm
+	sm.g.log.With("taskID", taskId).Infof("Mounted task files at %s", dir)
+	return nil
+}
+
+// 卸载任务的文件，读取中的进程返回错误。卸载失败时保留挂载，可以再次卸载
+func (sm *P2pSessionMgnt) Unmount(taskId string) error {
+	sm.mounts.lock.Lock()
+	defer sm.mounts.lock.Unlock()
+	tm, ok := sm.mounts.tasks[taskId]
+	if !ok {
+		return errors.New("Task is not mounted")
+	}
+	if err := tm.close(); err != nil {
+		sm.g.log.With("taskID", taskId).Errorf("Unmount %s failed, error=%v", tm.dir, err)
+		return err
+	}
+	delete(sm.mounts.tasks, taskId)
+	sm.g.log.With("taskID", taskId).Infof("Unmounted task files at %s", tm.dir)
+	return nil
+}
+
+// 退出时卸载所有任务
+func (sm *P2pSessionMgnt) unmountAll() {
+	sm.mounts.lock.Lock()
+	tms := sm.mounts.tasks
+	sm.mounts.tasks = make(map[string]*taskMount)
+	sm.mounts.lock.Unlock()
+	for _, tm := range tms {
+		if err := tm.close(); err != nil {
+			sm.g.log.With("taskID", tm.taskId).Warnf("Unmount %s failed, error=%v", tm.dir, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+//go:build fuse && (linux || freebsd)
+// +build fuse
+// +build linux freebsd
+
+package p2p
+
+import (
+	"context"
+	"io"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/xtfly/gofd/common"
+)
+
+// 通过FUSE只读挂载任务的文件，需要使用 -tags fuse 编译，并安装fuse
+func mountFS(tm *taskMount, l common.Logger) (func() error, error) {
+	c, err := fuse.Mount(tm.dir, fuse.ReadOnly(), fuse.FSName("gofd"), fuse.Subtype("gofd"))
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := fs.Serve(c, &fuseFS{root: tm.root}); err != nil {
+			l.Errorf("Serve mount %s failed, error=%v", tm.dir, err)
+		}
+	}()
+	return func() error {
+		if err := fuse.Unmount(tm.dir); err != nil {
+			return err
+		}
+		<-done
+		return c.Close()
+	}, nil
+}
+
+type fuseFS struct {
+	root *mountNode
+}
+
+func (f *fuseFS) Root() (fs.Node, error) {
+	return &fuseNode{f.root}, nil
+}
+
+// 目录、文件与软链接，内核只按节点的类型调用对应的方法
+type fuseNode struct {
+	n *mountNode
+}
+
+func (fn *fuseNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = fn.n.inode
+	a.Mode = fn.n.mode()
+	a.Size = uint64(fn.n.size())
+	a.Mtime = fn.n.modTime()
+	return nil
+}
+
+func (fn *fuseNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if c, ok := fn.n.children[name]; ok {
+		return &fuseNode{c}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (fn *fuseNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var ents []fuse.Dirent
+	for _, c := range fn.n.entries() {
+		typ := fuse.DT_File
+		if c.isDir() {
+			typ = fuse.DT_Dir
+		} else if c.file.Link != "" {
+			typ = fuse.DT_Link
+		}
+		ents = append(ents, fuse.Dirent{Inode: c.inode, Name: c.name, Type: typ})
+	}
+	return ents, nil
+}
+
+func (fn *fuseNode) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return fn.n.file.Link, nil
+}
+
+// 数据还没有下载时等待，任务没有下载完成就结束时返回EIO
+func (fn *fuseNode) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if fn.n.reader == nil {
+		return nil
+	}
+	buf := make([]byte, req.Size)
+	n, err := fn.n.reader.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return fuse.EIO
+	}
+	resp.Data = buf[:n]
+	return nil
+}
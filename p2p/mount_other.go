@@ -0,0 +1,10 @@
+//go:build !fuse || !(linux || freebsd)
+// +build !fuse !linux,!freebsd
+
+package p2p
+
+import "github.com/xtfly/gofd/common"
+
+func mountFS(tm *taskMount, l common.Logger) (func() error, error) {
+	return nil, errMountUnsupported
+}
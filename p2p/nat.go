@@ -0,0 +1,278 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/jackpal/gateway"
+	natpmp "github.com/jackpal/go-nat-pmp"
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 端口映射的租期，到期前一半时间续租
+	NAT_MAPPING_LIFETIME = 20 * time.Minute
+	// 映射失败后重试的间隔
+	NAT_RETRY_INTERVAL = time.Minute
+)
+
+var errNoGateway = errors.New("No UPnP or NAT-PMP gateway found")
+
+// 网关上的端口映射，UPnP IGD或NAT-PMP
+type portMapper interface {
+	name() string
+	externalIP() (net.IP, error)
+	// 返回网关实际映射的外部端口
+	addMapping(proto string, port int, lifetime time.Duration) (int, error)
+	deleteMapping(proto string, port, external int) error
+}
+
+// Agent位于NAT之后时，在网关上映射数据端口并定期续租，退出时删除映射。
+// 映射成功后心跳上报外部地址，Server分发时使用该地址
+type natMapper struct {
+	kind  string // common.NAT_UPNP、NAT_PMP或NAT_AUTO
+	proto string // TCP，QUIC传输时为UDP
+	port  int
+	ip    string // 配置的监听地址，UPnP映射的内部地址
+
+	log common.Logger
+
+	lock     sync.Mutex
+	mapper   portMapper
+	external string // 外部数据地址，没有映射成功时为空
+}
+
+// 没有配置Net.Nat时返回nil
+func newNatMapper(cfg *common.Config, l common.Logger) *natMapper {
+	if cfg.Server || cfg.Net.Nat == "" {
+		return nil
+	}
+	proto := "TCP"
+	if cfg.Net.Transport == "quic" {
+		proto = "UDP"
+	}
+	return &natMapper{kind: cfg.Net.Nat, proto: proto, port: cfg.Net.DataPort, ip: cfg.DataListenIP(), log: l}
+}
+
+// 映射后的外部数据地址，nm为nil或还没有映射成功时为空
+func (nm *natMapper) externalAddr() string {
+	if nm == nil {
+		return ""
+	}
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+	return nm.external
+}
+
+func (nm *natMapper) setExternal(addr string) {
+	nm.lock.Lock()
+	defer nm.lock.Unlock()
+	nm.external = addr
+}
+
+// 映射并定期续租，直到quitChan关闭
+func (nm *natMapper) run(quitChan <-chan struct{}) {
+	if nm == nil {
+		return
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var external int
+	for {
+		select {
+		case <-timer.C:
+			if e, err := nm.renew(); err != nil {
+				nm.log.Warnf("Map data port %d on NAT gateway failed, error=%v", nm.port, err)
+				nm.setExternal("")
+				nm.mapper = nil
+				timer.Reset(NAT_RETRY_INTERVAL)
+			} else {
+				external = e
+				timer.Reset(NAT_MAPPING_LIFETIME / 2)
+			}
+		case <-quitChan:
+			if nm.mapper != nil {
+				if err := nm.mapper.deleteMapping(nm.proto, nm.port, external); err != nil {
+					nm.log.Warnf("Delete port mapping on NAT gateway failed, error=%v", err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// 映射或续租，外部地址变化时输出日志
+func (nm *natMapper) renew() (int, error) {
+	if nm.mapper == nil {
+		m, err := discoverPortMapper(nm.kind, nm.ip)
+		if err != nil {
+			return 0, err
+		}
+		nm.mapper = m
+	}
+	external, err := nm.mapper.addMapping(nm.proto, nm.port, NAT_MAPPING_LIFETIME)
+	if err != nil {
+		return 0, err
+	}
+	ip, err := nm.mapper.externalIP()
+	if err != nil {
+		return 0, err
+	}
+	addr := common.JoinHostPort(ip.String(), external)
+	if addr != nm.externalAddr() {
+		nm.log.Infof("Mapped data port %d to %s by %s", nm.port, addr, nm.mapper.name())
+		nm.setExternal(addr)
+	}
+	return external, nil
+}
+
+func discoverPortMapper(kind, ip string) (portMapper, error) {
+	var errs []string
+	if kind == common.NAT_UPNP || kind == common.NAT_AUTO {
+		m, err := discoverUPnP(ip)
+		if err == nil {
+			return m, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if kind == common.NAT_PMP || kind == common.NAT_AUTO {
+		m, err := discoverNatPMP()
+		if err == nil {
+			return m, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return nil, errNoGateway
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+//----------------------------------------
+// WANIPConnection1与WANPPPConnection1的公共方法
+type igdClient interface {
+	GetExternalIPAddress() (string, error)
+	AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16,
+		internalClient string, enabled bool, description string, leaseDuration uint32) error
+	DeletePortMapping(remoteHost string, externalPort uint16, protocol string) error
+}
+
+type upnpMapper struct {
+	client   igdClient
+	internal string // 本机在网关所在网络中的地址
+}
+
+func discoverUPnP(ip string) (portMapper, error) {
+	var clients []igdClient
+	var gw string
+	if ipc, _, err := internetgateway1.NewWANIPConnection1Clients(); err == nil {
+		for _, c := range ipc {
+			clients, gw = append(clients, c), c.Location.Host
+		}
+	}
+	if len(clients) == 0 {
+		if pppc, _, err := internetgateway1.NewWANPPPConnection1Clients(); err == nil {
+			for _, c := range pppc {
+				clients, gw = append(clients, c), c.Location.Host
+			}
+		}
+	}
+	if len(clients) == 0 {
+		return nil, errors.New("No UPnP gateway found")
+	}
+
+	// 监听在未指定的地址时，使用连接网关的本地地址
+	if pip := net.ParseIP(ip); pip == nil || pip.IsUnspecified() {
+		conn, err := net.Dial("udp", gw)
+		if err != nil {
+			return nil, err
+		}
+		ip = common.StripPort(conn.LocalAddr().String())
+		conn.Close()
+	}
+	return &upnpMapper{client: clients[0], internal: ip}, nil
+}
+
+func (m *upnpMapper) name() string {
+	return common.NAT_UPNP
+}
+
+func (m *upnpMapper) externalIP() (net.IP, error) {
+	s, err := m.client.GetExternalIPAddress()
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid external ip %s from UPnP gateway", s)
+	}
+	return ip, nil
+}
+
+// 外部端口与内部端口相同
+func (m *upnpMapper) addMapping(proto string, port int, lifetime time.Duration) (int, error) {
+	err := m.client.AddPortMapping("", uint16(port), proto, uint16(port), m.internal, true,
+		"gofd", uint32(lifetime/time.Second))
+	return port, err
+}
+
+func (m *upnpMapper) deleteMapping(proto string, port, external int) error {
+	return m.client.DeletePortMapping("", uint16(external), proto)
+}
+
+//----------------------------------------
+type natpmpMapper struct {
+	client *natpmp.Client
+}
+
+func discoverNatPMP() (portMapper, error) {
+	gw, err := gateway.DiscoverGateway()
+	if err != nil {
+		return nil, err
+	}
+	c := natpmp.NewClient(gw)
+	// 网关不支持NAT-PMP时超时
+	if _, err = c.GetExternalAddress(); err != nil {
+		return nil, fmt.Errorf("No NAT-PMP gateway at %s: %v", gw, err)
+	}
+	return &natpmpMapper{client: c}, nil
+}
+
+func (m *natpmpMapper) name() string {
+	return common.NAT_PMP
+}
+
+func (m *natpmpMapper) externalIP() (net.IP, error) {
+	r, err := m.client.GetExternalAddress()
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(r.ExternalIPAddress[:]), nil
+}
+
+// 网关可能映射到其它的外部端口
+func (m *natpmpMapper) addMapping(proto string, port int, lifetime time.Duration) (int, error) {
+	r, err := m.client.AddPortMapping(strings.ToLower(proto), port, port, int(lifetime/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return int(r.MappedExternalPort), nil
+}
+
+// 租期为0时删除映射
+func (m *natpmpMapper) deleteMapping(proto string, port, external int) error {
+	_, err := m.client.AddPortMapping(strings.ToLower(proto), port, 0, 0)
+	return err
+}
+
+//----------------------------------------
+// addr是否为本节点的数据地址，包括上报的数据地址与NAT映射后的外部地址
+func (g *global) isSelf(addr string) bool {
+	return addr == common.JoinHostPort(g.cfg.Net.IP, g.cfg.Net.DataPort) || addr == g.cfg.DataAddr() ||
+		(addr != "" && addr == g.nat.externalAddr())
+}
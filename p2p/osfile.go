@@ -2,39 +2,109 @@ package p2p
 
 import (
 	"errors"
+	"fmt"
 	"os"
-	"path"
-	"strings"
+	"path/filepath"
 )
 
+// 文件系统不支持预分配时使用稀疏文件
+var errPreallocUnsupported = errors.New("Preallocate is not supported")
+
 // a  FileSystem that is backed by real OS files
 type osFileSystem struct {
+	limits *fileLimits
 }
 
 // A File that is backed by an OS file
 type osFile struct {
 	filePath string
+	limits   *fileLimits
 }
 
-type OsFsProvider struct{}
+// 零值不限制同时打开的文件数
+type OsFsProvider struct {
+	total   fileLimiter // 所有任务共用
+	perTask int
+}
+
+// maxFiles为所有任务同时打开的文件数，maxTaskFiles为每个任务的，0表示不限制
+func NewOsFsProvider(maxFiles, maxTaskFiles int) OsFsProvider {
+	return OsFsProvider{total: newFileLimiter(maxFiles), perTask: maxTaskFiles}
+}
 
 func (o OsFsProvider) NewFS() (fs FileSystem, err error) {
-	return &osFileSystem{}, nil
+	return &osFileSystem{limits: &fileLimits{task: newFileLimiter(o.perTask), total: o.total}}, nil
+}
+
+// 限制同时打开的文件数，读写时才打开文件，超过限制时等待其它读写完成
+type fileLimiter chan struct{}
+
+func newFileLimiter(n int) fileLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(fileLimiter, n)
+}
+
+type fileLimits struct {
+	task  fileLimiter
+	total fileLimiter
+}
+
+// 先占用任务的再占用总的，避免任务占用总数后等待自己的限制
+func (l *fileLimits) acquire() {
+	if l == nil {
+		return
+	}
+	if l.task != nil {
+		l.task <- struct{}{}
+	}
+	if l.total != nil {
+		l.total <- struct{}{}
+	}
+}
+
+func (l *fileLimits) release() {
+	if l == nil {
+		return
+	}
+	if l.total != nil {
+		<-l.total
+	}
+	if l.task != nil {
+		<-l.task
+	}
 }
 
 func (o *osFileSystem) Open(name []string, length int64) (file File, err error) {
-	cleanSrcPath := path.Clean(path.Join(name...))
-	fullPath := path.Join(cleanSrcPath)
+	fullPath := localPath(name...)
 	err = ensureDirectory(fullPath)
 	if err != nil {
 		return
 	}
-	osfile := &osFile{fullPath}
+	osfile := &osFile{fullPath, o.limits}
 	file = osfile
 	err = osfile.ensureExists(length)
 	return
 }
 
+// 只分发文件中的一段数据，文件不够大时扩展，不截断已有的数据
+func (o *osFileSystem) OpenPartial(name []string, size int64) (file File, err error) {
+	fullPath := localPath(name...)
+	err = ensureDirectory(fullPath)
+	if err != nil {
+		return
+	}
+	osfile := &osFile{fullPath, o.limits}
+	file = osfile
+	st, err := os.Stat(fullPath)
+	if err == nil && st.Size() >= size {
+		return
+	}
+	err = osfile.ensureExists(size)
+	return
+}
+
 func (o *osFileSystem) Close() error {
 	return nil
 }
@@ -44,24 +114,17 @@ func (o *osFile) Close() (err error) {
 }
 
 func ensureDirectory(fullPath string) (err error) {
-	fullPath = path.Clean(fullPath)
-	if !strings.HasPrefix(fullPath, "/") {
-		// Transform into absolute path.
-		var cwd string
-		if cwd, err = os.Getwd(); err != nil {
-			return
-		}
-		fullPath = cwd + "/" + fullPath
-	}
-	base, _ := path.Split(fullPath)
-	if base == "" {
-		panic("Programming error: could not find base directory for absolute path " + fullPath)
+	// Transform into absolute path.
+	if fullPath, err = filepath.Abs(fullPath); err != nil {
+		return
 	}
-	err = os.MkdirAll(base, 0755)
+	err = os.MkdirAll(filepath.Dir(fullPath), 0755)
 	return
 }
 
 func (o *osFile) ensureExists(length int64) (err error) {
+	o.limits.acquire()
+	defer o.limits.release()
 	name := o.filePath
 	st, err := os.Stat(name)
 	if err != nil && os.IsNotExist(err) {
@@ -75,6 +138,14 @@ func (o *osFile) ensureExists(length int64) (err error) {
 			return
 		}
 	}
+	if st == nil || st.Size() < length {
+		// 需要扩展文件时先预分配，已有的数据不变
+		if err = preallocate(name, length); err == nil {
+			return
+		} else if err != errPreallocUnsupported {
+			return fmt.Errorf("Could not allocate %v bytes for %s: %v", length, name, err)
+		}
+	}
 	err = os.Truncate(name, length)
 	if err != nil {
 		err = errors.New("Could not truncate file.")
@@ -84,6 +155,8 @@ func (o *osFile) ensureExists(length int64) (err error) {
 }
 
 func (o *osFile) ReadAt(p []byte, off int64) (n int, err error) {
+	o.limits.acquire()
+	defer o.limits.release()
 	file, err := os.OpenFile(o.filePath, os.O_RDWR, 0600)
 	if err != nil {
 		return
@@ -93,6 +166,8 @@ func (o *osFile) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (o *osFile) WriteAt(p []byte, off int64) (n int, err error) {
+	o.limits.acquire()
+	defer o.limits.release()
 	file, err := os.OpenFile(o.filePath, os.O_RDWR, 0600)
 	if err != nil {
 		return
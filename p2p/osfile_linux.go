@@ -0,0 +1,37 @@
+package p2p
+
+import (
+	"os"
+	"syscall"
+)
+
+// 使用fallocate预分配磁盘空间，空间不足时在下载开始前失败，同时减少文件碎片
+func preallocate(name string, length int64) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		err = syscall.Fallocate(int(f.Fd()), 0, 0, length)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return errPreallocUnsupported
+	}
+	return err
+}
+
+// Linux的FICLONE
+const ficlone = 0x40049409
+
+// 在支持的文件系统(btrfs、xfs等)上克隆文件，与源文件共用数据块，写入时才复制
+func reflink(src, dst *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
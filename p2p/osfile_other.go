@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package p2p
+
+import "os"
+
+// 其它平台不预分配，使用稀疏文件
+func preallocate(name string, length int64) error {
+	return errPreallocUnsupported
+}
+
+// 其它平台不支持reflink，复制文件
+func reflink(src, dst *os.File) error {
+	return errReflinkUnsupported
+}
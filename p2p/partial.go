@@ -0,0 +1,262 @@
+package p2p
+
+import (
+	"os"
+	"sync"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gokits"
+)
+
+// 配置了Control.PartialSuffix或Control.PartialDir时，下载中的文件写入临时的路径，
+// 文件校验通过后原子地改名为元数据中的名字，监视下载目录的脚本不会读到写了一半的文件。
+// 使用暂存目录、不写入磁盘、种子节点与只分发文件中一段数据的任务不使用
+func (s *P2pSession) partialNamed() bool {
+	c := s.g.cfg.Control
+	if c.PartialSuffix == "" && c.PartialDir == "" || s.seeding() || s.noDisk() || s.staged() {
+		return false
+	}
+	for _, fd := range s.task.MetaInfo.Files {
+		if fd.Partial {
+			return false
+		}
+	}
+	return true
+}
+
+// 下载中的文件的路径：下载目录中PartialDir下的相同路径，文件名加上PartialSuffix
+func (s *P2pSession) partialPath(name string) string {
+	c := s.g.cfg.Control
+	return localPath(s.dataDir(), c.PartialDir, name+c.PartialSuffix)
+}
+
+// 文件当前在磁盘上的路径，还没有改名时为临时路径
+func (s *P2pSession) currentPath(name string) string {
+	if s.partials != nil {
+		if e, ok := s.partials.byName[name]; ok && !e.isCommitted() {
+			return e.tmp
+		}
+	}
+	return localPath(s.dataDir(), name)
+}
+
+// 文件校验通过后改为元数据中的名字
+func (s *P2pSession) commitPartial(name string) error {
+	if s.partials == nil {
+		return nil
+	}
+	return s.partials.commit(name)
+}
+
+// 下载完成后改名不在后台校验的文件，后台校验的文件在校验通过后改名
+func (s *P2pSession) commitPartials() error {
+	if s.partials == nil {
+		return nil
+	}
+	for name := range s.partials.byName {
+		if s.fileChecks.verifies(name) {
+			continue
+		}
+		if err := s.partials.commit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 元数据中的一个文件，临时路径与最终路径
+type partialEntry struct {
+	sync.RWMutex
+	tmp       string
+	full      string
+	committed bool // 已改名，之后读写最终路径
+}
+
+func (e *partialEntry) isCommitted() bool {
+	e.RLock()
+	defer e.RUnlock()
+	return e.committed
+}
+
+// 把元数据中的文件映射到临时路径，其它文件（如bundle文件）直接打开
+type partialFileSystem struct {
+	FileSystem
+	byPath map[string]*partialEntry // 以最终的完整路径为键
+	byName map[string]*partialEntry // 以元数据中的文件名为键
+	log    common.Logger
+}
+
+func (s *P2pSession) newPartialFileSystem(fs FileSystem) *partialFileSystem {
+	pfs := &partialFileSystem{
+		FileSystem: fs,
+		byPath:     make(map[string]*partialEntry),
+		byName:     make(map[string]*partialEntry),
+		log:        s.log,
+	}
+	for _, fd := range s.task.MetaInfo.Files {
+		if fd.Link != "" || fd.Same != "" {
+			continue
+		}
+		e := &partialEntry{tmp: s.partialPath(fd.Name), full: localPath(s.dataDir(), fd.Name)}
+		pfs.byPath[e.full] = e
+		pfs.byName[fd.Name] = e
+	}
+	return pfs
+}
+
+// 下载目录中已有文件而没有临时文件时，先复制到临时路径（支持时reflink），已有的数据仍可以使用，
+// 改名之前不修改已有的文件
+func (pfs *partialFileSystem) Open(name []string, length int64) (File, error) {
+	e, ok := pfs.byPath[localPath(name...)]
+	if !ok {
+		return pfs.FileSystem.Open(name, length)
+	}
+	if err := pfs.prepare(e); err != nil {
+		return nil, err
+	}
+
+	f := &partialFile{fs: pfs.FileSystem, e: e, length: length}
+	e.RLock()
+	defer e.RUnlock()
+	if _, err := f.current(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (pfs *partialFileSystem) prepare(e *partialEntry) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.committed || gokits.FileExist(e.tmp) || !gokits.FileExist(e.full) {
+		return nil
+	}
+	if err := ensureDirectory(e.tmp); err != nil {
+		return err
+	}
+	method, err := cloneFile(e.full, e.tmp)
+	if err != nil {
+		os.Remove(e.tmp)
+		return err
+	}
+	pfs.log.Debugf("Copied existing file to %s, method=%s", e.tmp, method)
+	return nil
+}
+
+// 原子地改名，之后打开的文件与已打开的文件都读写最终路径。临时文件不存在时（如打包传输的文件）只记录
+func (pfs *partialFileSystem) commit(name string) error {
+	e, ok := pfs.byName[name]
+	if !ok {
+		return nil
+	}
+	e.Lock()
+	defer e.Unlock()
+	if e.committed {
+		return nil
+	}
+	if err := ensureDirectory(e.full); err != nil {
+		return err
+	}
+	if err := os.Rename(e.tmp, e.full); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	e.committed = true
+	pfs.log.Debugf("Renamed verified file to %s", e.full)
+	return nil
+}
+
+// 删除还没有改名的临时文件
+func (pfs *partialFileSystem) remove() {
+	for _, e := range pfs.byName {
+		if e.isCommitted() {
+			continue
+		}
+		if err := os.Remove(e.tmp); err != nil && !os.IsNotExist(err) {
+			pfs.log.Errorf("Remove partial file failed, file=%s, error=%v", e.tmp, err)
+		}
+	}
+}
+
+// 改名后重新打开最终路径
+type partialFile struct {
+	fs     FileSystem
+	e      *partialEntry
+	length int64
+
+	mu    sync.Mutex
+	file  File
+	final bool // file为改名后打开的
+}
+
+// 调用方持有e的读锁
+func (f *partialFile) current() (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil && f.final == f.e.committed {
+		return f.file, nil
+	}
+	path := f.e.tmp
+	if f.e.committed {
+		path = f.e.full
+	}
+	file, err := f.fs.Open([]string{path}, f.length)
+	if err != nil {
+		return nil, err
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file, f.final = file, f.e.committed
+	return file, nil
+}
+
+func (f *partialFile) ReadAt(p []byte, off int64) (int, error) {
+	f.e.RLock()
+	defer f.e.RUnlock()
+	file, err := f.current()
+	if err != nil {
+		return 0, err
+	}
+	return file.ReadAt(p, off)
+}
+
+func (f *partialFile) WriteAt(p []byte, off int64) (int, error) {
+	f.e.RLock()
+	defer f.e.RUnlock()
+	file, err := f.current()
+	if err != nil {
+		return 0, err
+	}
+	return file.WriteAt(p, off)
+}
+
+func (f *partialFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// 后台校验文件时读取当前的路径，已改名或没有临时文件时读取最终路径
+type partialReader struct {
+	FileSystem
+	pfs *partialFileSystem
+}
+
+func (r *partialReader) Open(name []string, length int64) (File, error) {
+	if e, ok := r.pfs.byPath[localPath(name...)]; ok && !e.isCommitted() && gokits.FileExist(e.tmp) {
+		return r.FileSystem.Open([]string{e.tmp}, length)
+	}
+	return r.FileSystem.Open(name, length)
+}
+
+// 后台校验文件使用的文件系统
+func (s *P2pSession) checkFileSystem() FileSystem {
+	if s.partials == nil {
+		return &fileSystemAdapter{}
+	}
+	return &partialReader{FileSystem: &fileSystemAdapter{}, pfs: s.partials}
+}
@@ -0,0 +1,84 @@
+package p2p
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 元数据中的路径统一使用/分隔，与创建元数据的平台无关，各节点打开文件时再转换为本地路径
+
+// 本地文件路径拆分为元数据中的目录与文件名，目录以/结尾
+func splitLocalPath(file string) (dir, name string) {
+	return path.Split(filepath.ToSlash(filepath.Clean(file)))
+}
+
+// 元数据中的目录与文件名转换为本地路径
+func localPath(elem ...string) string {
+	parts := make([]string, len(elem))
+	for i, e := range elem {
+		parts[i] = filepath.FromSlash(e)
+	}
+	return filepath.Join(parts...)
+}
+
+// 是否为绝对路径，包括Windows的盘符路径，如C:/data
+func isAbsSlash(p string) bool {
+	if path.IsAbs(p) {
+		return true
+	}
+	return len(p) >= 2 && p[1] == ':' &&
+		(('a' <= p[0] && p[0] <= 'z') || ('A' <= p[0] && p[0] <= 'Z'))
+}
+
+// Agent在下载目录中创建文件，文件名不能是绝对路径，也不能跳出下载目录
+func checkFileName(name string) error {
+	if name == "" || isAbsSlash(name) {
+		return fmt.Errorf("Invalid file name %s", name)
+	}
+	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
+		// 其它平台上合法的文件名，在本地会被当作目录分隔符
+		return fmt.Errorf("Invalid file name %s, contains %c", name, filepath.Separator)
+	}
+	if strings.IndexByte(name, 0) >= 0 {
+		return fmt.Errorf("Invalid file name %q, contains NUL", name)
+	}
+	for _, e := range strings.Split(name, "/") {
+		if e == ".." {
+			return fmt.Errorf("Invalid file name %s, outside of download directory", name)
+		}
+	}
+	return nil
+}
+
+// 检查下载目录中已有的路径，文件或其上级目录是软链接时必须指向root之内，
+// 否则写入时会跟随软链接写到下载目录之外。不存在的部分由Agent创建，不需要检查
+func checkInsideDir(root, name string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p := root
+	for _, e := range strings.Split(name, "/") {
+		p = filepath.Join(p, e)
+		st, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if st.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		// 指向不存在的路径的软链接同样拒绝，创建文件时会在目标位置创建
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil || !withinDir(realRoot, real) {
+			return fmt.Errorf("Invalid file name %s, %s links outside of download directory", name, p)
+		}
+	}
+	return nil
+}
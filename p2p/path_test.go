@@ -0,0 +1,105 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCheckFileName(t *testing.T) {
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"dir/a.txt", true},
+		{"dir/../a.txt", false},
+		{"..", false},
+		{"../a.txt", false},
+		{"dir/..", false},
+		{"..a/b..", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"C:/Windows/a.dll", false},
+		{"c:a.txt", false},
+		{"a\x00b", false},
+	}
+	for _, c := range cases {
+		if err := checkFileName(c.name); (err == nil) != c.ok {
+			t.Errorf("checkFileName(%q) error=%v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
+
+func TestCheckInsideDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlink requires privilege on windows")
+	}
+	root := filepath.Join(t.TempDir(), "down")
+	outside := t.TempDir()
+	mustMkdir(t, filepath.Join(root, "sub"))
+	mustSymlink(t, outside, filepath.Join(root, "escape"))
+	mustSymlink(t, "sub", filepath.Join(root, "inner"))
+	mustSymlink(t, filepath.Join(outside, "none"), filepath.Join(root, "dangling"))
+	mustSymlink(t, filepath.Join(outside, "f"), filepath.Join(root, "sub", "file"))
+
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"sub/a.txt", true},
+		{"new/dir/a.txt", true},
+		{"inner/a.txt", true},
+		{"escape/a.txt", false},
+		{"escape", false},
+		{"dangling", false},
+		{"sub/file", false},
+	}
+	for _, c := range cases {
+		if err := checkInsideDir(root, c.name); (err == nil) != c.ok {
+			t.Errorf("checkInsideDir(%q) error=%v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+
+	// 下载目录还不存在时不需要检查
+	if err := checkInsideDir(filepath.Join(outside, "missing"), "a.txt"); err != nil {
+		t.Errorf("checkInsideDir on missing root: %v", err)
+	}
+}
+
+func TestWithinDir(t *testing.T) {
+	sep := string(filepath.Separator)
+	base := sep + filepath.Join("data", "down")
+	cases := []struct {
+		dir string
+		ok  bool
+	}{
+		{base, true},
+		{filepath.Join(base, "a"), true},
+		{filepath.Join(base, "..a"), true},
+		{sep + "data", false},
+		{base + "2", false},
+		{sep + filepath.Join("data", "other"), false},
+	}
+	for _, c := range cases {
+		if withinDir(base, c.dir) != c.ok {
+			t.Errorf("withinDir(%q, %q) want %v", base, c.dir, c.ok)
+		}
+	}
+}
+
+func mustMkdir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustSymlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,17 +1,22 @@
 package p2p
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
-	log "github.com/cihub/seelog"
+	"github.com/xtfly/gofd/common"
 	"github.com/xtfly/gofd/flowctrl"
 )
 
 const (
-	// 最多从其它Peer发送请求
-	MAX_OUR_REQUESTS = 5
+	// 写Chan的缓冲，一次补充的多个请求不需要逐个等待写入
+	PEER_WRITE_QUEUE = 64
+	// 合并写入连接的缓冲大小，写Chan中没有消息时再写入连接
+	PEER_WRITE_BUFFER = 64 * 1024
 )
 
 const (
@@ -26,6 +31,27 @@ const (
 
 	// 当客户端收到某个peer的request消息后,则发送piece消息将文件数据传给该peer。
 	PIECE
+
+	// 块数据使用gzip压缩的PIECE消息，只在建立连接时协商了压缩才发送
+	PIECE_GZIP
+
+	// 暂停向对端上传，对端收到后不再发送REQUEST，只在配置了maxUploadPeers时发送
+	CHOKE
+
+	// 恢复向对端上传
+	UNCHOKE
+
+	// 使用任务密钥加密的PIECE或压缩的PIECE消息，元数据中有加密密钥时只发送该消息
+	PIECE_SEALED
+
+	// 任务结束后释放连接，双方都发送后连接用于下一个任务，只在建立连接时协商了复用才发送
+	RELEASE
+
+	// 交换任务的上游节点列表，负载为以换行分隔的数据地址，只在配置了pex时发送
+	PEX
+
+	// 块数据使用zstd压缩的PIECE消息，只在建立连接时协商了zstd才发送
+	PIECE_ZSTD
 )
 
 // 下载连接端
@@ -34,14 +60,45 @@ type peer struct {
 	address string   // 对端地址
 	conn    net.Conn // 物理连接
 	client  bool     // 对端是否为客户端
+	codec   string   // 块数据的压缩算法，为空时不压缩
+
+	pooled     bool           // 建立连接时双方同意复用连接
+	dialAddr   string         // 本端发起连接时连接的地址，连接放回连接池时使用
+	releasing  int32          // 原子操作，1表示连接正在释放，不再属于Session
+	writerDone chan error     // 写Goroutine退出时发送，释放成功时为nil
+	released   func(net.Conn) // 双方都发送RELEASE后处理连接
+
+	log common.Logger // 带有taskID与peerID字段
 
-	writeChan      chan []byte      // 连接的写Chan
-	flowctrlWriter *flowctrl.Writer // 基于流控的写
+	buffers        *bufferPool            // 读取消息的缓冲，块消息处理后由Session放回
+	writeChan      chan *peerWrite        // 连接的写Chan
+	flowctrlWriter *flowctrl.BucketWriter // 基于流控的写
+	flowctrlReader *flowctrl.BucketReader // 基于流控的读
 
 	lastReadTime time.Time //
 	have         *Bitset   // 已有的Piece
 
-	ourRequests map[uint64]time.Time // What we requested, when we requested it
+	choked         bool   // 本节点暂停向对端上传
+	peerChoking    bool   // 对端暂停向本节点上传
+	lastDownloaded uint64 // 上一轮选择上传Peer时，从对端下载的字节数
+	recentRate     uint64 // 最近一轮从对端下载的字节数
+
+	version     int // 协商后的协议版本，只发送该版本支持的消息
+	peerVersion int // 对端的协议版本
+
+	ourRequests map[uint64]*blockRequest // What we requested, when we requested it
+	timeouts    int                      // 连续超时的请求数
+	blockSize   *blockSizer              // 开启adaptiveBlock时向对端请求的块大小
+
+	windowAt    time.Time // 统计下载速率的周期开始时间，没有未完成的请求时为零
+	windowBytes uint64    // 周期开始时从对端下载的字节数
+	slowUntil   time.Time // 下载速率过低被放弃，此前不再向对端请求
+}
+
+// 向对端发送的块请求
+type blockRequest struct {
+	at     time.Time
+	length int
 }
 
 type peerMessage struct {
@@ -49,79 +106,177 @@ type peerMessage struct {
 	message []byte // nil means an error occurred
 }
 
-func NewPeer(c *P2pConn, speed int64) *peer {
-	writeChan := make(chan []byte)
+// 上传与下载分别受任务与全局的速率限制
+func NewPeer(c *P2pConn, l common.Logger, uploadLimiters, downloadLimiters []*flowctrl.TokenBucket) *peer {
+	writeChan := make(chan *peerWrite, PEER_WRITE_QUEUE)
 	return &peer{
 		taskId:         c.taskId,
 		conn:           c.conn,
 		address:        c.remoteAddr.String(),
+		log:            l,
 		client:         c.client,
+		codec:          c.codec,
 		writeChan:      writeChan,
-		flowctrlWriter: flowctrl.NewWriter(c.conn, speed),
-		ourRequests:    make(map[uint64]time.Time, MAX_OUR_REQUESTS),
+		pooled:         c.pooled,
+		dialAddr:       c.dialAddr,
+		version:        negotiateVersion(c.version),
+		peerVersion:    c.version,
+		writerDone:     make(chan error, 1),
+		flowctrlWriter: flowctrl.NewBucketWriter(c.conn, uploadLimiters...),
+		flowctrlReader: flowctrl.NewBucketReader(c.conn, downloadLimiters...),
+		ourRequests:    make(map[uint64]*blockRequest),
+		blockSize:      newBlockSizer(),
 	}
 }
 
 func (p *peer) Close() {
-	log.Infof("[%s] Closing connection to %s", p.taskId, p.address)
+	p.log.Infof("Closing connection to peer")
 	p.conn.Close()
 	//close(p.writeChan)
 }
 
 func (p *peer) sendMessage(b []byte) {
-	p.writeChan <- b
+	if len(b) > 0 && !p.supports(b[0]) {
+		p.log.Debugf("Skip message id %d not supported by peer of protocol version %d", b[0], p.version)
+		return
+	}
+	p.writeChan <- &peerWrite{msg: b}
+}
+
+// 发送从缓冲池取用的消息，写入连接后放回
+func (p *peer) sendPooledMessage(b []byte, pool *bufferPool) {
+	p.writeChan <- &peerWrite{msg: b, pool: pool}
+}
+
+// 发送消息头，消息体的length字节从文件段发送
+func (p *peer) sendSegmentsMessage(header []byte, segs []fileSegment) {
+	p.writeChan <- &peerWrite{msg: header, segments: segs}
 }
 
 func (p *peer) keepAlive() {
 	p.sendMessage([]byte{})
 }
 
+var errPeerWriterExited = errors.New("Peer writer exited")
+
+// 释放期间读Goroutine丢弃收到的消息，等待对端的RELEASE
+func (p *peer) startRelease() {
+	atomic.StoreInt32(&p.releasing, 1)
+	p.conn.SetReadDeadline(time.Now().Add(CONN_RELEASE_TIMEOUT))
+	// 写Goroutine已退出或写Chan已满时不能释放
+	select {
+	case p.writeChan <- &peerWrite{release: true}:
+	default:
+		p.conn.Close()
+	}
+}
+
+func (p *peer) isReleasing() bool {
+	return atomic.LoadInt32(&p.releasing) == 1
+}
+
+// 在读Goroutine中收到RELEASE后调用，本端的RELEASE写入后交出连接
+func (p *peer) finishRelease() {
+	if err := <-p.writerDone; err != nil {
+		p.log.Warnf("Release connection to peer failed, error=%v", err)
+		p.conn.Close()
+		return
+	}
+	p.conn.SetReadDeadline(time.Time{})
+	p.log.Infof("Released connection to peer")
+	p.released(p.conn)
+}
+
 // This func is designed to be run as a goroutine. It
 // listens for messages on a channel and sends them to a peer.
 func (p *peer) peerWriter(errorChan chan peerMessage) {
-	log.Infof("[%s] Writing messages to peer[%s]", p.taskId, p.address)
+	p.log.Infof("Writing messages to peer")
 	var lastWriteTime time.Time
+	w := bufio.NewWriterSize(p.flowctrlWriter, PEER_WRITE_BUFFER)
 
-	for msg := range p.writeChan {
+	var zeros []byte
+	for pw := range p.writeChan {
+		if pw.release {
+			err := writeNBOUint32(w, 1)
+			if err == nil {
+				err = w.WriteByte(RELEASE)
+			}
+			if err == nil {
+				err = w.Flush()
+			}
+			p.writerDone <- err
+			p.log.Infof("Exiting Writing messages to peer for release")
+			return
+		}
+		msg := pw.msg
 		now := time.Now()
-		if len(msg) == 0 {
+		if len(msg) == 0 && pw.segments == nil {
 			// This is a keep-alive message.
 			if now.Sub(lastWriteTime) < 2*time.Minute {
 				continue
 			}
-			log.Tracef("[%s] Sending keep alive to peer[%s]", p.taskId, p.address)
+			p.log.Debugf("Sending keep alive to peer")
 		}
 		lastWriteTime = now
 
 		//log.Debugf("[%s] Sending message to peer[%s], length=%v", p.taskId, p.address, uint32(len(msg)))
-		err := writeNBOUint32(p.flowctrlWriter, uint32(len(msg)))
+		var bodyLen int64
+		for _, seg := range pw.segments {
+			bodyLen += seg.n
+		}
+		err := writeNBOUint32(w, uint32(int64(len(msg))+bodyLen))
 		if err != nil {
-			log.Error(err)
+			p.log.Errorf("%v", err)
 			break
 		}
-		_, err = p.flowctrlWriter.Write(msg)
+		_, err = w.Write(msg)
+		pw.pool.put(msg)
 		if err != nil {
-			log.Errorf("[%s] Failed to write a message to peer[%s], length=%v, err=%v", p.taskId, p.address, len(msg), err)
+			p.log.Errorf("Failed to write a message to peer, length=%v, err=%v", len(msg), err)
 			break
 		}
+		if pw.segments != nil {
+			// 消息头先写入连接，块数据从文件直接发送
+			if err = w.Flush(); err == nil {
+				if zeros == nil {
+					zeros = make([]byte, STANDARD_BLOCK_LENGTH)
+				}
+				err = p.sendSegments(pw.segments, zeros)
+			}
+			if err != nil {
+				p.log.Errorf("Failed to send block to peer, length=%v, err=%v", bodyLen, err)
+				break
+			}
+			continue
+		}
+		// 连续的请求等消息合并后一起写入
+		if len(p.writeChan) == 0 {
+			if err = w.Flush(); err != nil {
+				p.log.Errorf("Failed to write messages to peer, err=%v", err)
+				break
+			}
+		}
 	}
 
-	log.Infof("[%s] Exiting Writing messages to peer[%s]", p.taskId, p.address)
-	errorChan <- peerMessage{p, nil}
+	p.log.Infof("Exiting Writing messages to peer")
+	p.writerDone <- errPeerWriterExited
+	if !p.isReleasing() {
+		errorChan <- peerMessage{p, nil}
+	}
 }
 
 // This func is designed to be run as a goroutine. It
 // listens for messages from the peer and forwards them to a channel.
 func (p *peer) peerReader(msgChan chan peerMessage) {
-	log.Infof("[%s] Reading messages from peer[%s]", p.taskId, p.address)
+	p.log.Infof("Reading messages from peer")
 	for {
 		var n uint32
-		n, err := readNBOUint32(p.conn)
+		n, err := readNBOUint32(p.flowctrlReader)
 		if err != nil {
 			break
 		}
 		if n > MAX_BLOCK_LENGTH {
-			log.Error("[", p.taskId, "] Message size too large: ", n)
+			p.log.Errorf("Message size too large: %v", n)
 			break
 		}
 
@@ -130,18 +285,35 @@ func (p *peer) peerReader(msgChan chan peerMessage) {
 			// keep-alive - we want an empty message
 			buf = make([]byte, 1)
 		} else {
-			buf = make([]byte, n)
+			buf = p.buffers.get(int(n))
 		}
 
-		_, err = io.ReadFull(p.conn, buf)
+		_, err = io.ReadFull(p.flowctrlReader, buf)
 		if err != nil {
 			break
 		}
+		if p.pooled && n == 1 && buf[0] == RELEASE {
+			if !p.isReleasing() {
+				// 对端发起释放，由Session移除Peer后回复RELEASE
+				msgChan <- peerMessage{p, buf}
+			}
+			p.finishRelease()
+			p.log.Infof("Exiting reading messages from peer for release")
+			return
+		}
+		if p.isReleasing() {
+			continue
+		}
 		msgChan <- peerMessage{p, buf}
 	}
 
-	msgChan <- peerMessage{p, nil}
-	log.Infof("[%s] Exiting reading messages from peer[%s]", p.taskId, p.address)
+	if p.isReleasing() {
+		// Session已经移除了该Peer
+		p.conn.Close()
+	} else {
+		msgChan <- peerMessage{p, nil}
+	}
+	p.log.Infof("Exiting reading messages from peer")
 }
 
 // 发送位图
@@ -149,7 +321,7 @@ func (p *peer) SendBitfield(bs *Bitset) {
 	msg := make([]byte, len(bs.Bytes())+1)
 	msg[0] = BITFIELD
 	copy(msg[1:], bs.Bytes())
-	log.Tracef("[%s] send BITFIELD to peer[%s]", p.taskId, p.address)
+	p.log.Debugf("send BITFIELD to peer")
 	p.sendMessage(msg)
 }
 
@@ -157,10 +329,20 @@ func (p *peer) SendHave(piece uint32) {
 	haveMsg := make([]byte, 5)
 	haveMsg[0] = HAVE
 	uint32ToBytes(haveMsg[1:5], piece)
-	log.Tracef("[%s] send HAVE to peer[%s], piece=%v", p.taskId, p.address, piece)
+	p.log.Debugf("send HAVE to peer, piece=%v", piece)
 	p.sendMessage(haveMsg)
 }
 
+func (p *peer) SendChoke() {
+	p.log.Debugf("send CHOKE to peer")
+	p.sendMessage([]byte{CHOKE})
+}
+
+func (p *peer) SendUnchoke() {
+	p.log.Debugf("send UNCHOKE to peer")
+	p.sendMessage([]byte{UNCHOKE})
+}
+
 func (p *peer) SendRequest(piece, begin, length int) {
 	req := make([]byte, 13)
 	req[0] = byte(REQUEST)
@@ -169,8 +351,7 @@ func (p *peer) SendRequest(piece, begin, length int) {
 	uint32ToBytes(req[9:13], uint32(length))
 	requestIndex := (uint64(piece) << 32) | uint64(begin)
 
-	p.ourRequests[requestIndex] = time.Now()
-	log.Tracef("[%s] send REQUEST to peer[%s], piece=%v, begin=%v, length=%v",
-		p.taskId, p.address, piece, begin, length)
+	p.ourRequests[requestIndex] = &blockRequest{at: time.Now(), length: length}
+	p.log.Debugf("send REQUEST to peer, piece=%v, begin=%v, length=%v", piece, begin, length)
 	p.sendMessage(req)
 }
@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	// 一个PEX消息中最多的地址数，多于该数目时只处理前面的地址
+	PEX_MAX_PEERS = 50
+)
+
+// 本节点已知的上游节点，不包括Server与发送过坏Piece的Peer。
+// Server总是最后一个上游节点，对端已经知道
+func (s *P2pSession) pexPeers() []string {
+	if len(s.upstreams) < 2 {
+		return nil
+	}
+	var addrs []string
+	for _, a := range s.upstreams[:len(s.upstreams)-1] {
+		if s.isBadPeer(a) || s.swarmBadPeers[a] {
+			continue
+		}
+		addrs = append(addrs, a)
+		if len(addrs) >= PEX_MAX_PEERS {
+			break
+		}
+	}
+	return addrs
+}
+
+// 配置了pex时向Peer发送已知的上游节点，对端不支持时不发送
+func (s *P2pSession) sendPex(p *peer) {
+	if !s.g.cfg.Control.Pex || s.topologyFixed() {
+		return
+	}
+	addrs := s.pexPeers()
+	if len(addrs) == 0 {
+		return
+	}
+	p.log.Debugf("send PEX to peer, peers=%v", len(addrs))
+	p.sendMessage(append([]byte{PEX}, strings.Join(addrs, "\n")...))
+}
+
+// 连接建立时发送一次，之后每次保活时发送，上游节点有变化时对端可以及时获得
+func (s *P2pSession) broadcastPex() {
+	for _, p := range s.peers {
+		s.sendPex(p)
+	}
+}
+
+// 收到的地址加在Server之前，分发路径中的上游节点都不可用时连接，Server不可用时仍可以继续下载
+func (s *P2pSession) recvPex(message []byte) error {
+	if !s.g.cfg.Control.Pex {
+		return nil
+	}
+	var addrs []string
+	for _, b := range bytes.Split(message[1:], []byte("\n")) {
+		a := string(b)
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return errors.New("Invalid PEX address")
+		}
+		if s.isBadPeer(a) || s.swarmBadPeers[a] {
+			continue
+		}
+		addrs = append(addrs, a)
+		if len(addrs) >= PEX_MAX_PEERS {
+			break
+		}
+	}
+	s.addUpstreams(addrs, "pex peer")
+	return nil
+}
@@ -1,16 +1,19 @@
 package p2p
 
 import (
-	"crypto/sha1"
 	"errors"
 	"fmt"
-	"runtime"
+
+	"github.com/xtfly/gofd/common"
 )
 
 const (
 	// 每个Piece分成多个Block，每次下载块的大小
 	STANDARD_BLOCK_LENGTH = 32 * 1024
 
+	// 记录块下载状态的单位，也是自适应块大小时最小的请求长度
+	MIN_BLOCK_LENGTH = 8 * 1024
+
 	// 最大块的长度
 	MAX_BLOCK_LENGTH = 128 * 1024
 )
@@ -20,6 +23,32 @@ type chunk struct {
 	data []byte
 }
 
+// 参与传输与计算摘要的数据长度，最后一个Piece补0时为PieceLen的整数倍
+func (m *MetaInfo) pieceDataLength(totalLength int64) int64 {
+	if m.PadLastPiece && totalLength%m.PieceLen != 0 {
+		return totalLength + m.PieceLen - totalLength%m.PieceLen
+	}
+	return totalLength
+}
+
+// 全局偏移所在的Piece，以及在该Piece内的偏移
+func (m *MetaInfo) PieceAtOffset(off int64) (index int, pieceOffset int64, err error) {
+	if off < 0 || off >= m.Length {
+		err = fmt.Errorf("Offset %v out of range 0..%v", off, m.Length)
+		return
+	}
+	index = int(off / m.PieceLen)
+	pieceOffset = off % m.PieceLen
+	return
+}
+
+// 元数据中的Piece个数
+func (m *MetaInfo) NumPieces() int {
+	_, totalSize := m.fileOffsets()
+	n, _ := countPieces(m.pieceDataLength(totalSize), m.PieceLen)
+	return n
+}
+
 func countPieces(totalSize, pieceLen int64) (totalPieces, lastPieceLength int) {
 	totalPieces = int(totalSize / pieceLen)
 	lastPieceLength = int(totalSize % pieceLen)
@@ -31,24 +60,30 @@ func countPieces(totalSize, pieceLen int64) (totalPieces, lastPieceLength int) {
 	return
 }
 
-// 根据元数据信息，在文件中检查已下载的位图信息，有多少好的Piece，有多少块的Piece
-func checkPieces(fs FileStore, totalLength int64, m *MetaInfo) (good, bad int, goodBits *Bitset, err error) {
+// 根据元数据信息，在文件中检查已下载的位图信息，有多少好的Piece，有多少块的Piece。
+// memoryBudget限制并行校验时缓存Piece的内存，0表示不限制
+func checkPieces(fs FileStore, totalLength int64, m *MetaInfo, memoryBudget int64) (good, bad int, goodBits *Bitset, err error) {
 	pieceLen := m.PieceLen
 	totalPieces, _ := countPieces(totalLength, pieceLen)
 	goodBits = NewBitset(int(totalPieces))
+	newHash, err := m.hashFunc()
+	if err != nil {
+		return
+	}
+	hashSize := newHash().Size()
 	ref := m.Pieces
 	refLen := len(ref)
-	if refLen != totalPieces*sha1.Size {
-		err = errors.New(fmt.Sprint("Incorrect MetaInfo.Pieces length ", totalPieces*sha1.Size, "actual length ", refLen))
+	if refLen != totalPieces*hashSize {
+		err = errors.New(fmt.Sprint("Incorrect MetaInfo.Pieces length ", totalPieces*hashSize, "actual length ", refLen))
 		return
 	}
-	currentSums, err := computeSums(fs, totalLength, pieceLen)
+	currentSums, err := computeSums(fs, m.pieceDataLength(totalLength), pieceLen, newHash, memoryBudget)
 	if err != nil {
 		return
 	}
 	for i := 0; i < totalPieces; i++ {
-		base := i * sha1.Size
-		end := base + sha1.Size
+		base := i * hashSize
+		end := base + hashSize
 		if checkEqual([]byte(ref[base:end]), currentSums[base:end]) {
 			good++
 			goodBits.Set(int(i))
@@ -59,61 +94,22 @@ func checkPieces(fs FileStore, totalLength int64, m *MetaInfo) (good, bad int, g
 	return
 }
 
-// computeSums reads the file content and computes the SHA1 hash for each
-// piece. Spawns parallel goroutines to compute the hashes, since each
-// computation takes ~30ms.
-func computeSums(fs FileStore, totalLength int64, pieceLength int64) (sums []byte, err error) {
-	// Calculate the SHA1 hash for each piece in parallel goroutines.
-	hashes := make(chan chunk)
-	results := make(chan chunk, 3)
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		go hashPiece(hashes, results)
-	}
-
-	// Read file content and send to "pieces", keeping order.
-	numPieces := (totalLength + pieceLength - 1) / pieceLength
-	go func() {
-		for i := int64(0); i < numPieces; i++ {
-			piece := make([]byte, pieceLength, pieceLength)
-			if i == numPieces-1 {
-				piece = piece[0 : totalLength-i*pieceLength]
-			}
-			// Ignore errors.
-			fs.ReadAt(piece, i*pieceLength)
-			hashes <- chunk{i: i, data: piece}
-		}
-		close(hashes)
-	}()
-
-	// Merge back the results.
-	sums = make([]byte, sha1.Size*numPieces)
-	for i := int64(0); i < numPieces; i++ {
-		h := <-results
-		copy(sums[h.i*sha1.Size:], h.data)
-	}
-	return
-}
-
-func hashPiece(h chan chunk, result chan chunk) {
-	hasher := sha1.New()
-	for piece := range h {
-		hasher.Reset()
-		_, err := hasher.Write(piece.data)
-		if err != nil {
-			result <- chunk{piece.i, nil}
-		} else {
-			result <- chunk{piece.i, hasher.Sum(nil)}
-		}
-	}
+// computeSums reads the file content and computes the hash for each
+// piece. Spawns GOMAXPROCS goroutines to compute the hashes, since each
+// computation takes ~30ms. The output keeps the piece order.
+func computeSums(fs FileStore, totalLength int64, pieceLength int64, newHash hashFunc, memoryBudget int64) (sums []byte, err error) {
+	return newPieceHasher(fs, totalLength, pieceLength, newHash, 0, memoryBudget).run(nil)
 }
 
-func computePieceSum(fs FileStore, totalLength int64, pieceLength int64, pieceIndex int) (sum []byte, err error, piece []byte) {
+// buffers不为nil时从缓冲池取用piece的缓冲，由调用方放回
+func computePieceSum(fs FileStore, totalLength int64, pieceLength int64, pieceIndex int, newHash hashFunc, buffers *bufferPool) (sum []byte, err error, piece []byte) {
 	numPieces := (totalLength + pieceLength - 1) / pieceLength
-	hasher := sha1.New()
-	piece = make([]byte, pieceLength)
+	hasher := newHash()
+	n := pieceLength
 	if int64(pieceIndex) == numPieces-1 {
-		piece = piece[0 : totalLength-int64(pieceIndex)*pieceLength]
+		n = totalLength - int64(pieceIndex)*pieceLength
 	}
+	piece = buffers.get(int(n))
 	_, err = fs.ReadAt(piece, int64(pieceIndex)*pieceLength)
 	if err != nil {
 		return
@@ -126,52 +122,58 @@ func computePieceSum(fs FileStore, totalLength int64, pieceLength int64, pieceIn
 	return
 }
 
-func checkPiece(fs FileStore, totalLength int64, m *MetaInfo, pieceIndex int) (good bool, err error, piece []byte) {
+func checkPiece(fs FileStore, totalLength int64, m *MetaInfo, pieceIndex int, buffers *bufferPool) (good bool, err error, piece []byte) {
 	ref := m.Pieces
+	newHash, err := m.hashFunc()
+	if err != nil {
+		return
+	}
 	var currentSum []byte
-	currentSum, err, piece = computePieceSum(fs, totalLength, m.PieceLen, pieceIndex)
+	currentSum, err, piece = computePieceSum(fs, m.pieceDataLength(totalLength), m.PieceLen, pieceIndex, newHash, buffers)
 	if err != nil {
 		return
 	}
-	base := pieceIndex * sha1.Size
-	end := base + sha1.Size
-	refSha1 := []byte(ref[base:end])
-	good = checkEqual(refSha1, currentSum)
+	hashSize := len(currentSum)
+	base := pieceIndex * hashSize
+	end := base + hashSize
+	refSum := []byte(ref[base:end])
+	good = checkEqual(refSum, currentSum)
 	if !good {
-		err = fmt.Errorf("reference sha1: %v != piece sha1: %v", refSha1, currentSum)
+		err = fmt.Errorf("reference sum: %v != piece sum: %v", refSum, currentSum)
 	}
 	return
 }
 
-// 正在下载的Piece
+// 正在下载的Piece，按MIN_BLOCK_LENGTH记录每段的下载状态
 type ActivePiece struct {
 	downloaderCount []int // -1 means piece is already downloaded
 	pieceLength     int
+	span            common.Span // 从第一次请求到校验完成
 }
 
 func NewActivePiece(pieceLength int) *ActivePiece {
-	pieceCount := (pieceLength + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH
-	return &ActivePiece{make([]int, pieceCount), pieceLength}
+	pieceCount := (pieceLength + MIN_BLOCK_LENGTH - 1) / MIN_BLOCK_LENGTH
+	return &ActivePiece{downloaderCount: make([]int, pieceCount), pieceLength: pieceLength}
 }
 
-func (a *ActivePiece) chooseBlockToDownload(endgame bool) (index int) {
+// 选择最多units个连续的段作为一个块请求，返回第一个段的序号与段数
+func (a *ActivePiece) chooseBlockToDownload(endgame bool, units int) (index, count int) {
 	if endgame {
-		return a.chooseBlockToDownloadEndgame()
+		return a.chooseBlockToDownloadEndgame(units)
 	}
-	return a.chooseBlockToDownloadNormal()
+	return a.chooseBlockToDownloadNormal(units)
 }
 
-func (a *ActivePiece) chooseBlockToDownloadNormal() (index int) {
+func (a *ActivePiece) chooseBlockToDownloadNormal(units int) (index, count int) {
 	for i, v := range a.downloaderCount {
 		if v == 0 {
-			a.downloaderCount[i]++
-			return i
+			return i, a.takeRun(i, units, 0)
 		}
 	}
-	return -1
+	return -1, 0
 }
 
-func (a *ActivePiece) chooseBlockToDownloadEndgame() (index int) {
+func (a *ActivePiece) chooseBlockToDownloadEndgame(units int) (index, count int) {
 	index, minCount := -1, -1
 	for i, v := range a.downloaderCount {
 		if v >= 0 && (minCount == -1 || minCount > v) {
@@ -179,17 +181,35 @@ func (a *ActivePiece) chooseBlockToDownloadEndgame() (index int) {
 		}
 	}
 	if index > -1 {
-		a.downloaderCount[index]++
+		count = a.takeRun(index, units, minCount)
 	}
 	return
 }
 
-func (a *ActivePiece) recordBlock(index int) (requestCount int) {
-	requestCount = a.downloaderCount[index]
-	a.downloaderCount[index] = -1
+// 从index开始取请求数都为reqs的连续段，最多units个
+func (a *ActivePiece) takeRun(index, units, reqs int) (count int) {
+	for i := index; i < len(a.downloaderCount) && count < units && a.downloaderCount[i] == reqs; i++ {
+		a.downloaderCount[i]++
+		count++
+	}
 	return
 }
 
+func (a *ActivePiece) recordBlock(index, count int) {
+	for i := index; i < index+count && i < len(a.downloaderCount); i++ {
+		a.downloaderCount[i] = -1
+	}
+}
+
+// 请求超时或取消后减少请求数
+func (a *ActivePiece) unrequestBlock(index, count int) {
+	for i := index; i < index+count && i < len(a.downloaderCount); i++ {
+		if a.downloaderCount[i] > 0 {
+			a.downloaderCount[i]--
+		}
+	}
+}
+
 func (a *ActivePiece) isComplete() bool {
 	for _, v := range a.downloaderCount {
 		if v != -1 {
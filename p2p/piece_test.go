@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestPieceDataLength(t *testing.T) {
+	cases := []struct {
+		length     int64
+		pad        bool
+		dataLength int64
+		pieces     int
+		lastLength int
+	}{
+		{10, false, 10, 3, 2},
+		{10, true, 12, 3, 4},
+		{12, false, 12, 3, 4},
+		{12, true, 12, 3, 4},
+		{3, true, 4, 1, 4},
+		{0, true, 0, 0, 4},
+	}
+	for _, c := range cases {
+		m := &MetaInfo{PieceLen: 4, PadLastPiece: c.pad}
+		dataLength := m.pieceDataLength(c.length)
+		if dataLength != c.dataLength {
+			t.Errorf("pieceDataLength(%v) pad=%v is %v, want %v", c.length, c.pad, dataLength, c.dataLength)
+		}
+		pieces, last := countPieces(dataLength, m.PieceLen)
+		if pieces != c.pieces || last != c.lastLength {
+			t.Errorf("countPieces(%v) is %v, %v, want %v, %v", dataLength, pieces, last, c.pieces, c.lastLength)
+		}
+	}
+}
+
+// 补0时最后一个Piece按补齐后的数据计算摘要，Length仍为文件的实际长度
+func TestPadLastPieceSums(t *testing.T) {
+	const pieceLen = 16 * 1024
+	data := bytes.Repeat([]byte("0123456789"), 2000)
+	file := filepath.Join(t.TempDir(), "a")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	padded := append(append([]byte(nil), data...), make([]byte, 2*pieceLen-len(data))...)
+
+	for _, pad := range []bool{false, true} {
+		mi, err := CreateFileMetaWithProfile([]string{file}, &Profile{PieceLen: pieceLen, PadLastPiece: pad})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mi.Length != int64(len(data)) || mi.PadLastPiece != pad {
+			t.Fatalf("pad=%v: length=%v, padLastPiece=%v", pad, mi.Length, mi.PadLastPiece)
+		}
+		last := data[pieceLen:]
+		if pad {
+			last = padded[pieceLen:]
+		}
+		first, second := sha1.Sum(data[:pieceLen]), sha1.Sum(last)
+		if want := append(first[:], second[:]...); !bytes.Equal(mi.Pieces, want) {
+			t.Errorf("pad=%v: pieces do not match the hash of the data", pad)
+		}
+	}
+}
+
+func TestPieceAtOffset(t *testing.T) {
+	m := &MetaInfo{Length: 10, PieceLen: 4}
+	cases := []struct {
+		off         int64
+		index       int
+		pieceOffset int64
+		ok          bool
+	}{
+		{0, 0, 0, true},
+		{3, 0, 3, true},
+		{4, 1, 0, true},
+		{9, 2, 1, true},
+		{10, 0, 0, false},
+		{-1, 0, 0, false},
+	}
+	for _, c := range cases {
+		index, pieceOffset, err := m.PieceAtOffset(c.off)
+		if (err == nil) != c.ok {
+			t.Errorf("PieceAtOffset(%v) error=%v, want ok=%v", c.off, err, c.ok)
+			continue
+		}
+		if c.ok && (index != c.index || pieceOffset != c.pieceOffset) {
+			t.Errorf("PieceAtOffset(%v)=%v, %v, want %v, %v", c.off, index, pieceOffset, c.index, c.pieceOffset)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package p2p
+
+import (
+	"container/list"
+	"sync"
+)
+
+type pieceKey struct {
+	taskId string
+	index  int
+}
+
+type cachedPiece struct {
+	key  pieceKey
+	data []byte
+}
+
+// 源头节点上所有任务共享的Piece缓存，按最近使用淘汰，总大小不超过limit。
+// 下游Peer请求同一Piece的不同块时，只从磁盘读取一次
+type PieceCache struct {
+	lock    sync.Mutex
+	limit   int64
+	used    int64
+	lru     *list.List // 最近使用的在前面
+	pieces  map[pieceKey]*list.Element
+	metrics *Metrics
+}
+
+func NewPieceCache(limit int64, metrics *Metrics) *PieceCache {
+	return &PieceCache{limit: limit, lru: list.New(), pieces: make(map[pieceKey]*list.Element), metrics: metrics}
+}
+
+func (pc *PieceCache) enabled() bool {
+	return pc.limit > 0
+}
+
+func (pc *PieceCache) get(key pieceKey) ([]byte, bool) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	e, ok := pc.pieces[key]
+	if ok {
+		pc.lru.MoveToFront(e)
+	}
+	pc.metrics.pieceCacheRead(ok)
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*cachedPiece).data, true
+}
+
+func (pc *PieceCache) add(key pieceKey, data []byte) {
+	if int64(len(data)) > pc.limit {
+		return
+	}
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if _, ok := pc.pieces[key]; ok {
+		return
+	}
+	for pc.used+int64(len(data)) > pc.limit {
+		pc.removeLocked(pc.lru.Back())
+	}
+	pc.pieces[key] = pc.lru.PushFront(&cachedPiece{key: key, data: data})
+	pc.used += int64(len(data))
+	pc.metrics.pieceCacheSize(pc.used)
+}
+
+func (pc *PieceCache) removeLocked(e *list.Element) {
+	cp := pc.lru.Remove(e).(*cachedPiece)
+	delete(pc.pieces, cp.key)
+	pc.used -= int64(len(cp.data))
+	pc.metrics.pieceCacheSize(pc.used)
+}
+
+// 任务结束时释放任务的所有Piece
+func (pc *PieceCache) removeTask(taskId string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	for key, e := range pc.pieces {
+		if key.taskId == taskId {
+			pc.removeLocked(e)
+		}
+	}
+}
+
+// 读取时按整个Piece缓存，只用于数据不再变化的源头节点
+type pieceCacheStore struct {
+	FileStore
+	cache       *PieceCache
+	taskId      string
+	pieceLen    int64
+	totalLength int64
+}
+
+func newPieceCacheStore(fs FileStore, cache *PieceCache, taskId string, pieceLen, totalLength int64) FileStore {
+	return &pieceCacheStore{FileStore: fs, cache: cache, taskId: taskId, pieceLen: pieceLen, totalLength: totalLength}
+}
+
+func (c *pieceCacheStore) ReadAt(p []byte, off int64) (n int, err error) {
+	end := min64(off+int64(len(p)), c.totalLength)
+	for piece := off / c.pieceLen; piece*c.pieceLen < end; piece++ {
+		data, err := c.piece(int(piece))
+		if err != nil {
+			return n, err
+		}
+
+		// 只复制与读取范围重叠的部分
+		pieceStart := piece * c.pieceLen
+		from, to := max64(off, pieceStart), min64(end, pieceStart+int64(len(data)))
+		n += copy(p[from-off:to-off], data[from-pieceStart:to-pieceStart])
+	}
+	return
+}
+
+func (c *pieceCacheStore) piece(index int) ([]byte, error) {
+	key := pieceKey{taskId: c.taskId, index: index}
+	if data, ok := c.cache.get(key); ok {
+		return data, nil
+	}
+	start := int64(index) * c.pieceLen
+	data := make([]byte, min64(c.pieceLen, c.totalLength-start))
+	if _, err := c.FileStore.ReadAt(data, start); err != nil {
+		return nil, err
+	}
+	c.cache.add(key, data)
+	return data, nil
+}
@@ -0,0 +1,340 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 写入命令的任务在内存中缓冲的数据上限，命令读取得慢时不再请求后面的Piece
+	MAX_PIPE_BUFFER = 64 * 1024 * 1024
+	// 每次写入命令的数据长度
+	PIPE_CHUNK_SIZE = 1024 * 1024
+)
+
+var errPipeReleased = errors.New("Data has been written to pipe command")
+
+// 接收任务之前检查写入的命令是否在Agent配置的hookCommands中
+func CheckPipe(cfg *common.Config, dt *DispatchTask) error {
+	if len(dt.Pipe) == 0 {
+		return nil
+	}
+	if dt.Seed || dt.InMemory || dt.DestDir != "" {
+		return errors.New("Pipe is not supported by seed, in memory or dest dir task")
+	}
+	if !hookCommandAllowed(cfg.Control.HookCommands, dt.Pipe[0]) {
+		return fmt.Errorf("Pipe command %s is not allowed", dt.Pipe[0])
+	}
+	if dt.MetaInfo != nil {
+		for _, fd := range dt.MetaInfo.Files {
+			if fd.Partial {
+				return errors.New("Pipe is not supported by partial file")
+			}
+		}
+	}
+	return nil
+}
+
+// 数据按顺序写入命令的标准输入，不写入下载目录
+func (s *P2pSession) piped() bool {
+	return len(s.task.Pipe) > 0 && !s.seeding()
+}
+
+// 写入命令的任务的数据，按全局偏移以Piece长度分页保存，写入命令后释放
+type pipeBuffer struct {
+	lock     sync.Mutex
+	pageLen  int64
+	pages    map[int64][]byte
+	released int64 // 已写入命令的字节数，之前的数据不能再读取
+}
+
+func newPipeBuffer(pageLen int64) *pipeBuffer {
+	return &pipeBuffer{pageLen: pageLen, pages: make(map[int64][]byte)}
+}
+
+func (b *pipeBuffer) readAt(p []byte, off int64) (n int, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if off < b.released {
+		return 0, errPipeReleased
+	}
+	for n < len(p) {
+		pos := off + int64(n)
+		idx, begin := pos/b.pageLen, pos%b.pageLen
+		m := int(min64(b.pageLen-begin, int64(len(p)-n)))
+		if page, ok := b.pages[idx]; ok {
+			copy(p[n:n+m], page[begin:])
+		} else {
+			// 没有写入的数据为0
+			for i := n; i < n+m; i++ {
+				p[i] = 0
+			}
+		}
+		n += m
+	}
+	return
+}
+
+func (b *pipeBuffer) writeAt(p []byte, off int64) (n int, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if off < b.released {
+		return 0, errPipeReleased
+	}
+	for n < len(p) {
+		pos := off + int64(n)
+		idx, begin := pos/b.pageLen, pos%b.pageLen
+		page, ok := b.pages[idx]
+		if !ok {
+			page = make([]byte, b.pageLen)
+			b.pages[idx] = page
+		}
+		n += copy(page[begin:], p[n:])
+	}
+	return
+}
+
+// 释放已写入命令的数据
+func (b *pipeBuffer) release(off int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.released = off
+	for idx := range b.pages {
+		if (idx+1)*b.pageLen <= off {
+			delete(b.pages, idx)
+		}
+	}
+}
+
+// Piece是否在可以缓冲的范围内
+func (b *pipeBuffer) inWindow(piece int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return int64(piece)*b.pageLen < b.released+max64(MAX_PIPE_BUFFER, b.pageLen)
+}
+
+// 按元数据中的全局偏移把文件映射到pipeBuffer，与fileStore读写使用的偏移一致，
+// AlignFiles时文件之间有空洞
+type pipeFileSystem struct {
+	buf     *pipeBuffer
+	offsets map[string]int64 // 以文件的本地路径为键
+}
+
+func newPipeFileSystem(buf *pipeBuffer, m *MetaInfo) *pipeFileSystem {
+	fs := &pipeFileSystem{buf: buf, offsets: make(map[string]int64)}
+	offsets, _ := m.fileOffsets()
+	for i, fd := range m.Files {
+		fs.offsets[localPath(fd.Path, fd.Name)] = offsets[i]
+	}
+	return fs
+}
+
+func (fs *pipeFileSystem) Open(name []string, length int64) (File, error) {
+	offset, ok := fs.offsets[localPath(name...)]
+	if !ok {
+		return nil, fmt.Errorf("File %s is not in task", localPath(name...))
+	}
+	return &pipeFile{buf: fs.buf, offset: offset, length: length}, nil
+}
+
+func (fs *pipeFileSystem) Close() error {
+	return nil
+}
+
+type pipeFile struct {
+	buf    *pipeBuffer
+	offset int64
+	length int64
+}
+
+func (f *pipeFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.length {
+		return 0, io.EOF
+	}
+	if rest := f.length - off; int64(len(p)) > rest {
+		n, err := f.buf.readAt(p[:rest], f.offset+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return f.buf.readAt(p, f.offset+off)
+}
+
+func (f *pipeFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > f.length {
+		return 0, fmt.Errorf("Write out of range, offset=%v, length=%v, size=%v", off, len(p), f.length)
+	}
+	return f.buf.writeAt(p, f.offset+off)
+}
+
+func (f *pipeFile) Close() error {
+	return nil
+}
+
+// 文件数据在全局偏移中的范围，相邻的文件合并，不包括文件之间的空洞
+type pipeSegment struct {
+	start, end int64
+}
+
+func pipeSegments(m *MetaInfo) []pipeSegment {
+	offsets, _ := m.fileOffsets()
+	var segs []pipeSegment
+	for i, fd := range m.Files {
+		if fd.Length == 0 {
+			continue
+		}
+		if n := len(segs); n > 0 && segs[n-1].end == offsets[i] {
+			segs[n-1].end += fd.Length
+		} else {
+			segs = append(segs, pipeSegment{offsets[i], offsets[i] + fd.Length})
+		}
+	}
+	return segs
+}
+
+// 把从全局偏移pos开始的数据中属于文件的部分写入w，返回写入的字节数
+func writeSegments(w io.Writer, segs []pipeSegment, p []byte, pos int64) (written int64, err error) {
+	end := pos + int64(len(p))
+	i := sort.Search(len(segs), func(i int) bool { return segs[i].end > pos })
+	for ; i < len(segs) && segs[i].start < end; i++ {
+		lo, hi := max64(segs[i].start, pos), min64(segs[i].end, end)
+		var n int
+		n, err = w.Write(p[lo-pos : hi-pos])
+		written += int64(n)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 只保留最后写入的size个字节，命令输出很多时不占用过多内存
+type tailBuffer struct {
+	size int
+	buf  []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) >= t.size {
+		t.buf = append(t.buf[:0], p[len(p)-t.size:]...)
+		return n, nil
+	}
+	if over := len(t.buf) + len(p) - t.size; over > 0 {
+		t.buf = t.buf[:copy(t.buf, t.buf[over:])]
+	}
+	t.buf = append(t.buf, p...)
+	return n, nil
+}
+
+func (t *tailBuffer) Bytes() []byte {
+	return t.buf
+}
+
+// 启动命令，在单独的Goroutine中把校验通过的数据按顺序写入命令的标准输入，结束后通知Session
+func (s *P2pSession) startPipe() {
+	r := s.stream.reader(0, s.totalSize)
+	go func(args []string) {
+		s.pipeChan <- s.runPipe(args, r)
+	}(s.task.Pipe)
+}
+
+func (s *P2pSession) runPipe(args []string, r io.ReadCloser) error {
+	defer r.Close()
+	// 配置可能在任务下发后修改，执行前重新检查
+	if !hookCommandAllowed(s.g.cfg.Control.HookCommands, args[0]) {
+		return fmt.Errorf("Pipe command %s is not allowed", args[0])
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = s.downDir()
+	cmd.Env = append(os.Environ(), "GOFD_TASK_ID="+s.taskId, "GOFD_DOWN_DIR="+s.downDir())
+	// 只用到最后的输出，命令在传输过程中一直输出时不缓存全部内容
+	out := &tailBuffer{size: MAX_HOOK_OUTPUT}
+	cmd.Stdout, cmd.Stderr = out, out
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	s.log.Infof("Started pipe command %s", args[0])
+
+	// 按全局偏移读取，文件之间的空洞不写入命令
+	segs := pipeSegments(s.task.MetaInfo)
+	var pos, written int64
+	buf := make([]byte, PIPE_CHUNK_SIZE)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			var w int64
+			w, err = writeSegments(stdin, segs, buf[:n], pos)
+			written += w
+			if err != nil {
+				break
+			}
+			pos += int64(n)
+			s.pipeBuf.release(pos)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			// 任务结束时没有下载完成
+			err = rerr
+			cmd.Process.Kill()
+			break
+		}
+	}
+	stdin.Close()
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	if err == nil {
+		s.log.Infof("Pipe command %s exited, written=%v", args[0], written)
+		return nil
+	}
+	o := bytes.TrimSpace(out.Bytes())
+	if len(o) > MAX_HOOK_OUTPUT {
+		o = o[len(o)-MAX_HOOK_OUTPUT:]
+	}
+	if len(o) == 0 {
+		return fmt.Errorf("Pipe command failed: %v", err)
+	}
+	return fmt.Errorf("Pipe command failed: %v, output=%s", err, o)
+}
+
+// 命令退出，在Session的Goroutine中调用。命令成功后再执行钩子并上报完成
+func (s *P2pSession) pipeDone(err error) {
+	s.pipeFinished = true
+	if err != nil {
+		s.log.Errorf("Run pipe command failed, error=%v", err)
+		s.reportFailed(ERR_PIPE_FAILED, err.Error())
+		return
+	}
+	if s.goodPieces == s.totalPieces {
+		s.reportCompleted()
+	}
+}
+
+// 命令读取数据后缓冲有了空间，补充请求
+func (s *P2pSession) fillPipeWindow() {
+	if s.pipeBuf == nil || s.transfersPaused() || s.goodPieces == s.totalPieces {
+		return
+	}
+	for _, p := range s.peers {
+		if !p.client && !p.peerChoking {
+			s.fillRequests(p)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPipeBufferWindow(t *testing.T) {
+	b := newPipeBuffer(4)
+	if _, err := b.writeAt([]byte("abcdef"), 2); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 10)
+	if _, err := b.readAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("\x00\x00abcdef\x00\x00"); !bytes.Equal(p, want) {
+		t.Fatalf("readAt=%q, want %q", p, want)
+	}
+
+	// 释放后之前的页被删除，不能再读写
+	b.release(5)
+	if len(b.pages) != 1 {
+		t.Fatalf("pages=%v after release, want only page 1", len(b.pages))
+	}
+	if _, err := b.readAt(p[:1], 4); err != errPipeReleased {
+		t.Fatalf("readAt released offset error=%v", err)
+	}
+	if _, err := b.writeAt([]byte("x"), 4); err != errPipeReleased {
+		t.Fatalf("writeAt released offset error=%v", err)
+	}
+	if _, err := b.readAt(p[:3], 5); err != nil || string(p[:3]) != "def" {
+		t.Fatalf("readAt after release=%q, error=%v", p[:3], err)
+	}
+}
+
+func TestPipeBufferInWindow(t *testing.T) {
+	const pageLen = 1024 * 1024
+	b := newPipeBuffer(pageLen)
+	last := MAX_PIPE_BUFFER/pageLen - 1
+	if !b.inWindow(last) || b.inWindow(last+1) {
+		t.Fatalf("window before release is wrong")
+	}
+	b.release(pageLen)
+	if !b.inWindow(last+1) || b.inWindow(last+2) {
+		t.Fatalf("window does not move after release")
+	}
+	// Piece比缓冲的上限大时至少可以缓冲一个Piece
+	if big := newPipeBuffer(2 * MAX_PIPE_BUFFER); !big.inWindow(0) || big.inWindow(1) {
+		t.Fatalf("window of large piece is wrong")
+	}
+}
+
+// AlignFiles时文件按对齐后的全局偏移写入，空洞不写入命令
+func TestPipeAlignedFiles(t *testing.T) {
+	m := &MetaInfo{
+		PieceLen:   4,
+		AlignFiles: true,
+		Files: []*FileDict{
+			{Length: 3, Name: "a"},
+			{Name: "empty"},
+			{Length: 5, Name: "b"},
+			{Length: 2, Name: "c"},
+		},
+	}
+	buf := newPipeBuffer(m.PieceLen)
+	fs := newPipeFileSystem(buf, m)
+	offsets, total := m.fileOffsets()
+	if total != 14 {
+		t.Fatalf("total=%v, want 14", total)
+	}
+	for i, fd := range m.Files {
+		f, err := fs.Open([]string{fd.Path, fd.Name}, fd.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pf := f.(*pipeFile); pf.offset != offsets[i] {
+			t.Fatalf("file %s offset=%v, want %v", fd.Name, pf.offset, offsets[i])
+		}
+		if _, err = f.WriteAt(bytes.Repeat([]byte(fd.Name[:1]), int(fd.Length)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.Open([]string{"", "other"}, 1); err == nil {
+		t.Fatal("open file not in task")
+	}
+
+	// 按任意大小的块读取，结果都只有文件的数据
+	segs := pipeSegments(m)
+	for _, chunk := range []int{1, 3, 4, 5, 14} {
+		var out bytes.Buffer
+		p := make([]byte, chunk)
+		for pos := int64(0); pos < total; pos += int64(chunk) {
+			n := int(min64(int64(chunk), total-pos))
+			if _, err := buf.readAt(p[:n], pos); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := writeSegments(&out, segs, p[:n], pos); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if out.String() != "aaabbbbbcc" {
+			t.Fatalf("chunk %v: written %q", chunk, out.String())
+		}
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tb := &tailBuffer{size: 4}
+	for _, s := range []string{"ab", "cd", "e", "", "fghij", "k"} {
+		tb.Write([]byte(s))
+	}
+	if got := string(tb.Bytes()); got != "hijk" {
+		t.Fatalf("tail=%q, want hijk", got)
+	}
+	tb.Write([]byte("0123456789"))
+	if got := string(tb.Bytes()); got != "6789" {
+		t.Fatalf("tail=%q, want 6789", got)
+	}
+}
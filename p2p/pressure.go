@@ -0,0 +1,197 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 采样主机资源的间隔
+	PRESSURE_SAMPLE_INTERVAL = time.Second
+)
+
+var errPressureUnsupported = errors.New("Sample host pressure is not supported")
+
+// 主机资源的压力，CPU、下载目录所在磁盘的IO利用率或内存超过阈值时暂停下载与上传块，
+// 全部降到阈值以下后恢复。阈值为0的资源不检查
+type pressureMonitor struct {
+	maxCPU    float64 // Unit: Percent
+	maxDiskIO float64 // Unit: Percent
+	maxMemory uint64  // Unit: Byte
+	dir       string  // 检查该目录所在磁盘的IO
+
+	log     common.Logger
+	metrics *Metrics
+
+	paused int32 // 原子操作，1表示暂停
+
+	lastCPUBusy, lastCPUTotal uint64
+	lastIOTicks               uint64 // Unit: Millisecond
+	lastSampleAt              time.Time
+}
+
+func newPressureMonitor(cfg *common.Config, l common.Logger, metrics *Metrics) *pressureMonitor {
+	return &pressureMonitor{
+		maxCPU:    float64(cfg.Control.MaxCPU),
+		maxDiskIO: float64(cfg.Control.MaxDiskIO),
+		maxMemory: uint64(cfg.Control.MaxMemory) * 1024 * 1024,
+		dir:       cfg.DownDir,
+		log:       l,
+		metrics:   metrics,
+	}
+}
+
+func (pm *pressureMonitor) enabled() bool {
+	return pm.maxCPU > 0 || pm.maxDiskIO > 0 || pm.maxMemory > 0
+}
+
+// 是否需要暂停块的传输
+func (pm *pressureMonitor) underPressure() bool {
+	return atomic.LoadInt32(&pm.paused) == 1
+}
+
+// 定时采样，直到quitChan关闭
+func (pm *pressureMonitor) run(quitChan <-chan struct{}) {
+	if !pm.enabled() {
+		return
+	}
+	tick := time.NewTicker(PRESSURE_SAMPLE_INTERVAL)
+	defer tick.Stop()
+	pm.sample()
+	for {
+		select {
+		case <-tick.C:
+			pm.update(pm.sample())
+		case <-quitChan:
+			return
+		}
+	}
+}
+
+func (pm *pressureMonitor) update(reasons []string) {
+	paused := len(reasons) > 0
+	old := atomic.SwapInt32(&pm.paused, boolToInt32(paused)) == 1
+	if paused == old {
+		return
+	}
+	pm.metrics.pressurePaused(paused)
+	if paused {
+		pm.log.Warnf("Host is under pressure, pause piece transfers, %s", strings.Join(reasons, ", "))
+	} else {
+		pm.log.Infof("Host pressure is relieved, resume piece transfers")
+	}
+}
+
+// 返回超过阈值的资源，第一次采样只记录CPU与磁盘的计数
+func (pm *pressureMonitor) sample() (reasons []string) {
+	now := time.Now()
+	elapsed := now.Sub(pm.lastSampleAt)
+	first := pm.lastSampleAt.IsZero()
+	pm.lastSampleAt = now
+
+	if pm.maxCPU > 0 {
+		busy, total, err := readCPUTicks()
+		if err != nil {
+			pm.log.Warnf("Sample cpu usage failed, disable the check, error=%v", err)
+			pm.maxCPU = 0
+		} else {
+			if !first && total > pm.lastCPUTotal {
+				usage := float64(busy-pm.lastCPUBusy) * 100 / float64(total-pm.lastCPUTotal)
+				if usage > pm.maxCPU {
+					reasons = append(reasons, fmt.Sprintf("cpu=%.1f%%", usage))
+				}
+			}
+			pm.lastCPUBusy, pm.lastCPUTotal = busy, total
+		}
+	}
+
+	if pm.maxDiskIO > 0 {
+		ticks, err := readDiskIOTicks(pm.dir)
+		if err != nil {
+			pm.log.Warnf("Sample disk io of %s failed, disable the check, error=%v", pm.dir, err)
+			pm.maxDiskIO = 0
+		} else {
+			if !first && elapsed > 0 {
+				util := float64(ticks-pm.lastIOTicks) * 100 / float64(elapsed/time.Millisecond)
+				if util > pm.maxDiskIO {
+					reasons = append(reasons, fmt.Sprintf("diskIO=%.1f%%", util))
+				}
+			}
+			pm.lastIOTicks = ticks
+		}
+	}
+
+	if pm.maxMemory > 0 {
+		// 块的缓冲、写缓冲、Piece缓存与内存存储都在堆上
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		if ms.HeapInuse > pm.maxMemory {
+			reasons = append(reasons, fmt.Sprintf("memory=%s", humanSize(float64(ms.HeapInuse))))
+		}
+	}
+	return
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 在Session的Goroutine中调用，压力变化时暂停或恢复本任务的块传输
+func (s *P2pSession) checkPressure() {
+	paused := s.g.pressure.underPressure()
+	if paused == s.pressurePaused {
+		return
+	}
+	s.pressurePaused = paused
+	if !s.adminPaused {
+		s.pausedChanged()
+	}
+}
+
+// 暂停块的传输：主机资源压力过高，或者管理员暂停了任务
+func (s *P2pSession) transfersPaused() bool {
+	return s.pressurePaused || s.adminPaused
+}
+
+// 在Session的Goroutine中调用，暂停状态变化后暂停或恢复本任务的块传输
+func (s *P2pSession) pausedChanged() {
+	if s.transfersPaused() {
+		// 下游Peer收到CHOKE后取消已发送的请求；已发送的请求收到后不再请求新的块
+		for _, p := range s.peers {
+			if p.client && !p.choked {
+				p.choked = true
+				p.SendChoke()
+			}
+		}
+		return
+	}
+	s.resumeTransfers()
+}
+
+// 按上传的Peer数限制恢复上传，并补充向上游的请求
+func (s *P2pSession) resumeTransfers() {
+	if s.maxUploadPeers() > 0 {
+		s.rechoke()
+	} else {
+		for _, p := range s.peers {
+			if p.client && p.choked {
+				p.choked = false
+				p.SendUnchoke()
+			}
+		}
+	}
+	for _, p := range s.peers {
+		if !p.client && !p.peerChoking {
+			s.fillRequests(p)
+		}
+	}
+}
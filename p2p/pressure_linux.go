@@ -0,0 +1,67 @@
+package p2p
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// /proc/stat中所有CPU的时间，busy不包括idle与iowait
+func readCPUTicks() (busy, total uint64, err error) {
+	data, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, errors.New("Invalid /proc/stat")
+	}
+	var idle uint64
+	for i, f := range fields[1:] {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += n
+		if i == 3 || i == 4 { // idle与iowait
+			idle += n
+		}
+	}
+	return total - idle, total, nil
+}
+
+// dir所在块设备的io_ticks，即设备有IO在处理的累计毫秒数
+func readDiskIOTicks(dir string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, err
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+
+	f, err := os.Open("/proc/diskstats")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	want := fmt.Sprintf("%d %d", major, minor)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 || fields[0]+" "+fields[1] != want {
+			continue
+		}
+		return strconv.ParseUint(fields[12], 10, 64)
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("Block device %s not found in /proc/diskstats", strings.Replace(want, " ", ":", 1))
+}
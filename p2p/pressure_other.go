@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package p2p
+
+func readCPUTicks() (busy, total uint64, err error) {
+	return 0, 0, errPressureUnsupported
+}
+
+func readDiskIOTicks(dir string) (uint64, error) {
+	return 0, errPressureUnsupported
+}
@@ -0,0 +1,71 @@
+package p2p
+
+import (
+	"fmt"
+	"path"
+)
+
+// 校验文件优先级的模式，模式为元数据中的文件名或path.Match的模式
+func CheckFilePriorities(priorities map[string]int) error {
+	for pattern := range priorities {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid file priority pattern %s", pattern)
+		}
+	}
+	return nil
+}
+
+// 文件的优先级，匹配多个模式时使用最大的，都不匹配时为0
+func filePriority(priorities map[string]int, name string) (prio int) {
+	matched := false
+	for pattern, p := range priorities {
+		if ok, _ := path.Match(pattern, name); ok && (!matched || p > prio) {
+			prio, matched = p, true
+		}
+	}
+	return
+}
+
+// 每个Piece的优先级，跨文件的Piece使用其中最大的文件优先级。
+// 没有设置文件优先级时返回nil，按稀有优先或顺序下载
+func piecePriorities(m *MetaInfo, priorities map[string]int, totalPieces int) []int {
+	if len(priorities) == 0 {
+		return nil
+	}
+	// 内容相同的文件只传输原文件，原文件使用两者中较大的优先级
+	byName := make(map[string]int, len(m.Files))
+	for _, fd := range m.Files {
+		prio := filePriority(priorities, fd.Name)
+		name := fd.Name
+		if fd.Same != "" {
+			name = fd.Same
+		}
+		if p, ok := byName[name]; !ok || prio > p {
+			byName[name] = prio
+		}
+	}
+	prios := make([]int, totalPieces)
+	set := make([]bool, totalPieces)
+	offsets, _ := m.fileOffsets()
+	for i, fd := range m.Files {
+		if fd.Length == 0 {
+			continue
+		}
+		prio := byName[fd.Name]
+		first := int(offsets[i] / m.PieceLen)
+		last := int((offsets[i] + fd.Length - 1) / m.PieceLen)
+		for p := first; p <= last && p < totalPieces; p++ {
+			if !set[p] || prio > prios[p] {
+				prios[p], set[p] = prio, true
+			}
+		}
+	}
+	return prios
+}
+
+func (s *P2pSession) piecePriority(piece int) int {
+	if piece < len(s.priorities) {
+		return s.priorities[piece]
+	}
+	return 0
+}
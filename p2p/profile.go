@@ -0,0 +1,123 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// 分发模板，把Piece相关的参数按分发文件的规模归类，创建元数据时按名称引用
+type Profile struct {
+	Name         string `yaml:"name"`
+	PieceLen     int64  `yaml:"pieceLen"`     // 为0时根据文件总大小自动选择
+	AlignFiles   bool   `yaml:"alignFiles"`   // 每个文件都从Piece的边界开始
+	Hash         string `yaml:"hash"`         // Piece与文件的摘要算法，为空时使用DefaultHash
+	PadLastPiece bool   `yaml:"padLastPiece"` // 最后一个Piece补0到PieceLen
+	BundleSize   int64  `yaml:"bundleSize"`   // 长度小于该值的连续文件打包传输，AlignFiles时只有每个包从Piece的边界开始，为0时不打包
+
+	// 自动选择PieceLen时，Piece个数在[2^PieceCountLog2, 2^(PieceCountLog2+1))之间，为0时使用TargetPieceCountLog2
+	PieceCountLog2 int `yaml:"pieceCountLog2,omitempty"`
+	// 自动选择的Piece长度不超过MaxPieceLen，超过时Piece个数多于目标值，同时限制指定的PieceLen，为0时不限制
+	MaxPieceLen int64 `yaml:"maxPieceLen,omitempty"`
+}
+
+var (
+	profilesLock sync.RWMutex
+	profiles     = map[string]*Profile{
+		// 小文件，如配置文件
+		"small": &Profile{Name: "small", PieceLen: 64 * 1024},
+		// 中等大小的文件，如二进制程序
+		"balanced": &Profile{Name: "balanced"},
+		// 大文件，如镜像文件
+		"large": &Profile{Name: "large", PieceLen: 4 * 1024 * 1024, AlignFiles: true, Hash: "sha256"},
+	}
+)
+
+// 注册一个分发模板，同名的模板会被覆盖
+func RegisterProfile(p *Profile) error {
+	if p.Name == "" {
+		return errors.New("Profile name is empty")
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+	profiles[p.Name] = p
+	return nil
+}
+
+// 根据名称查找分发模板
+func LookupProfile(name string) (*Profile, bool) {
+	profilesLock.RLock()
+	defer profilesLock.RUnlock()
+	p, ok := profiles[name]
+	return p, ok
+}
+
+// 检查模板中的参数
+func (p *Profile) Validate() error {
+	if p.PieceCountLog2 < 0 || p.PieceCountLog2 > MaxPieceCountLog2 {
+		return fmt.Errorf("Invalid piece count log2 %v, must be in [0, %v]", p.PieceCountLog2, MaxPieceCountLog2)
+	}
+	if p.MaxPieceLen != 0 {
+		if err := CheckPieceLength(p.MaxPieceLen); err != nil {
+			return err
+		}
+	}
+	if p.PieceLen != 0 {
+		if err := p.CheckPieceLength(p.PieceLen); err != nil {
+			return err
+		}
+	}
+	if p.BundleSize < 0 {
+		return fmt.Errorf("Invalid bundle size %v", p.BundleSize)
+	}
+	if _, err := lookupHash(p.Hash); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Piece的长度必须是2的幂，且不小于MinimumPieceLength
+func validPieceLength(pieceLen int64) bool {
+	return pieceLen >= MinimumPieceLength && pieceLen&(pieceLen-1) == 0
+}
+
+// 检查配置或接口中指定的Piece长度
+func CheckPieceLength(pieceLen int64) error {
+	if !validPieceLength(pieceLen) {
+		return fmt.Errorf("Invalid piece length %v, must be a power of 2 and a multiple of 16KB", pieceLen)
+	}
+	return nil
+}
+
+// 使用模板创建元数据时指定的Piece长度，还不能超过MaxPieceLen
+func (p *Profile) CheckPieceLength(pieceLen int64) error {
+	if err := CheckPieceLength(pieceLen); err != nil {
+		return err
+	}
+	if p.MaxPieceLen != 0 && pieceLen > p.MaxPieceLen {
+		return fmt.Errorf("Invalid piece length %v, exceeds max piece length %v", pieceLen, p.MaxPieceLen)
+	}
+	return nil
+}
+
+// 根据文件总大小选择Piece长度。必须是2的幂且不小于MinimumPieceLength，
+// 尽量让Piece个数在目标范围内，但不超过MaxPieceLen
+func (p *Profile) choosePieceLength(totalLength int64) (pieceLength int64) {
+	countLog2 := p.PieceCountLog2
+	if countLog2 == 0 {
+		countLog2 = TargetPieceCountLog2
+	}
+	maxCount := int64(2) << uint(countLog2)
+
+	pieceLength = MinimumPieceLength
+	pieces := totalLength / pieceLength
+	for pieces >= maxCount && (p.MaxPieceLen == 0 || pieceLength<<1 <= p.MaxPieceLen) {
+		pieceLength <<= 1
+		pieces >>= 1
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package p2p
+
+import (
+	"path"
+	"sort"
+)
+
+const (
+	// 从源站下载的数据，按该地址统计
+	webSeedAddress = "webseeds"
+)
+
+// 下载进度的回调，在Session的Goroutine中调用，不能阻塞
+type ProgressListener interface {
+	OnProgress(p *TaskProgress)
+}
+
+// Piece校验失败的回调，attempts为该Piece累计失败的次数，在Session的Goroutine中调用，不能阻塞
+type PieceFailedListener interface {
+	OnPieceFailed(taskId string, index int, attempts int)
+}
+
+// 记录从Peer下载的字节数
+func (s *P2pSession) peerDownloaded(address string, n int) {
+	s.peerStats(address).Downloaded += uint64(n)
+	s.g.metrics.received(s.taskId, n)
+}
+
+// 记录上传给Peer的字节数
+func (s *P2pSession) peerUploaded(address string, n int) {
+	s.peerStats(address).Uploaded += uint64(n)
+	s.g.metrics.sent(s.taskId, n)
+}
+
+func (s *P2pSession) peerStats(address string) *PeerProgress {
+	pp, ok := s.peerProgress[address]
+	if !ok {
+		pp = &PeerProgress{Address: address}
+		s.peerProgress[address] = pp
+	}
+	return pp
+}
+
+func (s *P2pSession) progress() *TaskProgress {
+	tp := &TaskProgress{
+		TaskId:      s.taskId,
+		TotalBytes:  s.totalSize,
+		BytesDone:   s.totalSize - s.RemainingBytes(),
+		PiecesDone:  s.goodPieces,
+		PiecesTotal: s.totalPieces,
+		Speed:       s.speed,
+		ETA:         -1,
+		Peers:       make([]*PeerProgress, 0, len(s.peerProgress)),
+		Status:      s.status(),
+		Error:       s.lastErr,
+		ErrorCode:   s.lastCode,
+		Files:       make([]string, 0, len(s.task.MetaInfo.Files)),
+		Checks:      s.fileChecks.all(),
+	}
+	for _, fd := range s.task.MetaInfo.Files {
+		tp.Files = append(tp.Files, path.Join(fd.Path, fd.Name))
+	}
+	if s.goodPieces == s.totalPieces {
+		tp.ETA = 0
+	} else if s.speed > 0 {
+		tp.ETA = float64(s.totalSize-tp.BytesDone) / float64(s.speed)
+	}
+	for _, pp := range s.peerProgress {
+		c := *pp
+		tp.Peers = append(tp.Peers, &c)
+	}
+	sort.Slice(tp.Peers, func(i, j int) bool { return tp.Peers[i].Address < tp.Peers[j].Address })
+	return tp
+}
+
+func (s *P2pSession) status() string {
+	switch {
+	case s.lastErr != "":
+		return "FAILED"
+	case s.goodPieces == s.totalPieces:
+		return "COMPLETED"
+	case s.startAt.IsZero():
+		return "INIT"
+	case s.adminPaused:
+		return "PAUSED"
+	default:
+		return "INPROGRESS"
+	}
+}
+
+// 查询下载进度，可以在其它Goroutine中调用
+func (s *P2pSession) Progress() (*TaskProgress, bool) {
+	out := make(chan *TaskProgress, 1)
+	select {
+	case s.progressChan <- out:
+	case <-s.endedChan:
+		return nil, false
+	}
+	select {
+	case tp := <-out:
+		return tp, true
+	case <-s.endedChan:
+		return nil, false
+	}
+}
+
+// 通知下载进度
+func (s *P2pSession) notifyProgress() {
+	if l := s.g.progressListener; l != nil {
+		l.OnProgress(s.progress())
+	}
+}
@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"math/rand"
+)
+
+// 已连接的Peer中拥有每个Piece的个数
+type pieceAvailability []int
+
+func (a pieceAvailability) add(piece, delta int) {
+	if piece < len(a) {
+		a[piece] += delta
+	}
+}
+
+func (a pieceAvailability) addBitset(b *Bitset, delta int) {
+	if b == nil {
+		return
+	}
+	for i := b.FindNextSet(0); i >= 0 && i < len(a); i = b.FindNextSet(i + 1) {
+		a[i] += delta
+	}
+}
+
+// 在上报的Goroutine中调用，只保留最新的一次
+func (s *P2pSession) setSwarmAvailability(a []int) {
+	select {
+	case <-s.swarmChan:
+	default:
+	}
+	select {
+	case s.swarmChan <- a:
+	default:
+	}
+}
+
+// 是否需要从Peer下载该Piece
+func (s *P2pSession) wantPiece(piece int) bool {
+	if s.pieceSet.IsSet(piece) || s.unrecoverable[piece] || s.webSeedPieces[piece] || s.pieceBackoff(piece) || !s.assignedPiece(piece) {
+		return false
+	}
+	if s.pipeBuf != nil && !s.pipeBuf.inWindow(piece) {
+		return false
+	}
+	_, ok := s.activePieces[piece]
+	return !ok
+}
+
+// 稀有优先：在p拥有而本节点缺失的Piece中，选择拥有的Peer最少的，个数相同时选择所有Agent中副本最少的，
+// 仍相同时随机选择，避免下游节点都从同一个Piece开始下载。设置了文件优先级时只在优先级最高的Piece中选择
+func (s *P2pSession) ChoosePiece(p *peer) (piece int) {
+	piece = -1
+	best, bestSwarm, bestPrio, ties := 0, 0, 0, 0
+	end := min(p.have.n, s.pieceSet.n)
+	if s.task.Sequential {
+		// 顺序下载：选择p拥有的第一个缺失的Piece，设置了文件优先级时选择优先级最高的第一个
+		for i := p.have.FindNextSet(0); i >= 0 && i < end; i = p.have.FindNextSet(i + 1) {
+			if !s.wantPiece(i) {
+				continue
+			}
+			if s.priorities == nil {
+				return i
+			}
+			if prio := s.piecePriority(i); piece < 0 || prio > bestPrio {
+				piece, bestPrio = i, prio
+			}
+		}
+		return
+	}
+	for i := p.have.FindNextSet(0); i >= 0 && i < end; i = p.have.FindNextSet(i + 1) {
+		if !s.wantPiece(i) {
+			continue
+		}
+		count, swarm, prio := 0, 0, s.piecePriority(i)
+		if i < len(s.availability) {
+			count = s.availability[i]
+		}
+		if i < len(s.swarmAvailability) {
+			swarm = s.swarmAvailability[i]
+		}
+		if piece >= 0 && prio < bestPrio {
+			// 优先下载优先级高的文件
+			continue
+		}
+		switch {
+		case piece < 0 || prio > bestPrio || count < best || count == best && swarm < bestSwarm:
+			piece, best, bestSwarm, bestPrio, ties = i, count, swarm, prio, 1
+		case count == best && swarm == bestSwarm:
+			ties++
+			if rand.Intn(ties) == 0 {
+				piece = i
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,495 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/flowctrl"
+	"github.com/xtfly/gokits"
+)
+
+// 中继连接的操作
+const (
+	RELAY_OP_REGISTER = "register" // 只能通过中继接收连接的节点注册，保持为控制连接
+	RELAY_OP_CONNECT  = "connect"  // 连接注册过的节点
+	RELAY_OP_ACCEPT   = "accept"   // 注册过的节点按控制连接中的通知接受连接
+)
+
+// 中继的响应
+const (
+	RELAY_RSP_OK      byte = 0
+	RELAY_RSP_REFUSED byte = 1 // 目标节点没有注册或没有及时接受
+)
+
+const (
+	// 控制连接上的心跳间隔，超过3倍没有收到时重新注册
+	RELAY_KEEPALIVE = 30 * time.Second
+	// 等待目标节点接受连接的时间
+	RELAY_ACCEPT_TIMEOUT = 10 * time.Second
+	// 连接中继的超时
+	RELAY_DIAL_TIMEOUT = 5 * time.Second
+	// 注册失败后重试的间隔
+	RELAY_RETRY_INTERVAL = 10 * time.Second
+)
+
+var errRelayClosed = errors.New("Relay listener closed")
+
+//----------------------------------------
+// 中继连接头，与数据连接头一样认证
+type relayHeader struct {
+	Op       string
+	Addr     string // 注册与连接时为节点的数据地址，接受时为连接的编号
+	Username string
+	Passowrd string
+	Salt     string
+}
+
+func writeRelayHeader(conn net.Conn, cfg *common.Config, op, addr string) error {
+	pwd, salt := gokits.GenPasswd(cfg.Auth.Passowrd, 8)
+	all := []string{op, addr, cfg.Auth.Username, pwd, salt}
+	blen := 0
+	for _, v := range all {
+		blen += len(v) + 1
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, int32(blen))
+	for _, v := range all {
+		buf.WriteString(v)
+		buf.WriteByte(0)
+	}
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
+
+func readRelayHeader(conn net.Conn) (*relayHeader, error) {
+	var blen int32
+	if err := binary.Read(conn, binary.BigEndian, &blen); err != nil {
+		return nil, fmt.Errorf("Read length error: %v", err)
+	}
+	if blen <= 0 || blen > 300 {
+		return nil, fmt.Errorf("read length is invalid: %v", blen)
+	}
+	bs := make([]byte, blen)
+	if _, err := io.ReadFull(conn, bs); err != nil {
+		return nil, fmt.Errorf("Couldn't read relay header: %v", err)
+	}
+
+	fields := strings.Split(string(bs), "\x00")
+	if len(fields) < 6 {
+		return nil, errors.New("Invalid relay header")
+	}
+	return &relayHeader{Op: fields[0], Addr: fields[1], Username: fields[2], Passowrd: fields[3], Salt: fields[4]}, nil
+}
+
+func (h *relayHeader) validate(cfg *common.Config) error {
+	if h.Username != cfg.Auth.Username || !gokits.CmpPasswd(cfg.Auth.Passowrd, h.Salt, h.Passowrd) {
+		return errors.New("username or password is incorrect")
+	}
+	return nil
+}
+
+// 连接中继并发送连接头，等待中继的响应
+func dialRelay(cfg *common.Config, relay, op, addr string) (net.Conn, error) {
+	conn, err := dialTCP(cfg, relay, RELAY_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeRelayHeader(conn, cfg, op, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if op == RELAY_OP_ACCEPT {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(RELAY_DIAL_TIMEOUT + RELAY_ACCEPT_TIMEOUT))
+	rsp := make([]byte, 1)
+	if _, err = io.ReadFull(conn, rsp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if rsp[0] != RELAY_RSP_OK {
+		conn.Close()
+		return nil, fmt.Errorf("Relay %s refused %s to %s", relay, op, addr)
+	}
+	return conn, nil
+}
+
+//----------------------------------------
+// 为只能发起连接的节点中继数据连接：节点通过控制连接注册，其它节点连接中继后，
+// 中继通知该节点再连接中继接受，之后在两个连接之间转发数据
+type relayServer struct {
+	cfg      *common.Config
+	log      common.Logger
+	metrics  *Metrics
+	limiter  *flowctrl.TokenBucket // 所有中继连接总的速率
+	listener net.Listener
+
+	lock    sync.Mutex
+	agents  map[string]*relayAgent   // 以节点的数据地址为键
+	pending map[string]chan net.Conn // 等待节点接受的连接，以编号为键
+	nextId  uint64
+}
+
+// 注册的节点
+type relayAgent struct {
+	addr      string
+	conn      net.Conn
+	writeLock sync.Mutex
+}
+
+func (ra *relayAgent) send(line string) error {
+	ra.writeLock.Lock()
+	defer ra.writeLock.Unlock()
+	ra.conn.SetWriteDeadline(time.Now().Add(RELAY_DIAL_TIMEOUT))
+	_, err := io.WriteString(ra.conn, line+"\n")
+	return err
+}
+
+// 在Net.RelayPort上监听，配置了TLS时使用TLS
+func startRelay(g *global) (*relayServer, error) {
+	cfg := g.cfg
+	listener, err := net.Listen(cfg.DataListenNetwork(), common.JoinHostPort(cfg.DataListenIP(), cfg.Net.RelayPort))
+	if err != nil {
+		return nil, err
+	}
+	if tc := cfg.Net.Tls; tc != nil && tc.Peer {
+		var c *tls.Config
+		if c, err = tc.ServerConfig(); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, c)
+	}
+
+	rs := &relayServer{
+		cfg:      cfg,
+		log:      g.log,
+		metrics:  g.metrics,
+		limiter:  flowctrl.NewTokenBucket(mibps(cfg.Control.RelaySpeed)),
+		listener: listener,
+		agents:   make(map[string]*relayAgent),
+		pending:  make(map[string]chan net.Conn),
+	}
+	go rs.serve()
+	g.log.Infof("Relaying peers on %s", common.JoinHostPort(cfg.DataListenIP(), cfg.Net.RelayPort))
+	return rs, nil
+}
+
+func (rs *relayServer) Close() error {
+	err := rs.listener.Close()
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for _, ra := range rs.agents {
+		ra.conn.Close()
+	}
+	return err
+}
+
+func (rs *relayServer) serve() {
+	for {
+		conn, err := rs.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go rs.handle(conn)
+	}
+}
+
+func (rs *relayServer) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(RELAY_DIAL_TIMEOUT))
+	h, err := readRelayHeader(conn)
+	if err == nil {
+		err = h.validate(rs.cfg)
+	}
+	if err != nil {
+		rs.log.With("peerID", conn.RemoteAddr().String()).Errorf("Relay header auth failed: %v", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch h.Op {
+	case RELAY_OP_REGISTER:
+		rs.register(conn, h.Addr)
+	case RELAY_OP_CONNECT:
+		rs.connect(conn, h.Addr)
+	case RELAY_OP_ACCEPT:
+		rs.accept(conn, h.Addr)
+	default:
+		rs.log.Errorf("Unknown relay op %s from %s", h.Op, conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// 保持控制连接，直到节点断开。节点监听在未指定的地址时，使用连接的来源地址
+func (rs *relayServer) register(conn net.Conn, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		addr = net.JoinHostPort(common.StripPort(conn.RemoteAddr().String()), port)
+	}
+
+	ra := &relayAgent{addr: addr, conn: conn}
+	rs.lock.Lock()
+	if old, ok := rs.agents[addr]; ok {
+		old.conn.Close()
+	}
+	rs.agents[addr] = ra
+	rs.lock.Unlock()
+	rs.log.Infof("Relay registered %s from %s", addr, conn.RemoteAddr())
+
+	if _, err = conn.Write([]byte{RELAY_RSP_OK}); err == nil {
+		go rs.keepalive(ra)
+		// 节点不会再发送数据，读取失败时表示断开
+		io.Copy(ioutil.Discard, conn)
+	}
+
+	conn.Close()
+	rs.lock.Lock()
+	if rs.agents[addr] == ra {
+		delete(rs.agents, addr)
+	}
+	rs.lock.Unlock()
+	rs.log.Infof("Relay unregistered %s", addr)
+}
+
+func (rs *relayServer) keepalive(ra *relayAgent) {
+	tick := time.NewTicker(RELAY_KEEPALIVE)
+	defer tick.Stop()
+	for range tick.C {
+		if err := ra.send(""); err != nil {
+			ra.conn.Close()
+			return
+		}
+	}
+}
+
+// 通知目标节点接受连接，接受后转发数据
+func (rs *relayServer) connect(conn net.Conn, target string) {
+	rs.lock.Lock()
+	ra := rs.agents[target]
+	rs.nextId++
+	id := strconv.FormatUint(rs.nextId, 10)
+	ch := make(chan net.Conn, 1)
+	if ra != nil {
+		rs.pending[id] = ch
+	}
+	rs.lock.Unlock()
+
+	var peer net.Conn
+	if ra != nil && ra.send(id) == nil {
+		select {
+		case peer = <-ch:
+		case <-time.After(RELAY_ACCEPT_TIMEOUT):
+		}
+	}
+	rs.lock.Lock()
+	delete(rs.pending, id)
+	rs.lock.Unlock()
+
+	if peer == nil {
+		rs.log.Warnf("Relay %s to %s refused, not registered or not accepted", conn.RemoteAddr(), target)
+		conn.Write([]byte{RELAY_RSP_REFUSED})
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write([]byte{RELAY_RSP_OK}); err != nil {
+		conn.Close()
+		peer.Close()
+		return
+	}
+	rs.pipe(conn, peer, target)
+}
+
+func (rs *relayServer) accept(conn net.Conn, id string) {
+	rs.lock.Lock()
+	ch, ok := rs.pending[id]
+	delete(rs.pending, id)
+	rs.lock.Unlock()
+	if !ok {
+		conn.Close()
+		return
+	}
+	ch <- conn
+}
+
+// 双向转发，任一方向结束时关闭两个连接，按目标节点统计转发的字节数
+func (rs *relayServer) pipe(a, b net.Conn, target string) {
+	rs.metrics.relayConnected(1)
+	defer rs.metrics.relayConnected(-1)
+	start := time.Now()
+
+	var sent, received int64
+	done := make(chan struct{}, 2)
+	relay := func(dst, src net.Conn, n *int64) {
+		w := &relayCounter{w: flowctrl.NewBucketWriter(dst, rs.limiter), n: n, target: target, metrics: rs.metrics}
+		io.Copy(w, src)
+		a.Close()
+		b.Close()
+		done <- struct{}{}
+	}
+	go relay(b, a, &sent)
+	go relay(a, b, &received)
+	<-done
+	<-done
+	rs.log.Infof("Relay to %s closed, sent=%v, received=%v, elapsed=%v", target,
+		atomic.LoadInt64(&sent), atomic.LoadInt64(&received), time.Since(start))
+}
+
+// 统计转发的字节数
+type relayCounter struct {
+	w       io.Writer
+	n       *int64
+	target  string
+	metrics *Metrics
+}
+
+func (c *relayCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	c.metrics.relayed(c.target, n)
+	return n, err
+}
+
+//----------------------------------------
+// 通过中继接收其它节点的连接，接受的连接与监听端口上的连接一样认证
+type relayListener struct {
+	cfg   *common.Config
+	log   common.Logger
+	relay string // 中继的地址
+
+	conns    chan net.Conn
+	quitChan chan struct{}
+	once     sync.Once
+
+	lock    sync.Mutex
+	control net.Conn
+}
+
+func listenRelay(cfg *common.Config, l common.Logger) *relayListener {
+	rl := &relayListener{
+		cfg:      cfg,
+		log:      l,
+		relay:    cfg.Net.Relay,
+		conns:    make(chan net.Conn),
+		quitChan: make(chan struct{}),
+	}
+	go rl.run()
+	return rl
+}
+
+func (rl *relayListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-rl.conns:
+		return conn, nil
+	case <-rl.quitChan:
+		return nil, errRelayClosed
+	}
+}
+
+func (rl *relayListener) Close() error {
+	rl.once.Do(func() {
+		close(rl.quitChan)
+		rl.lock.Lock()
+		defer rl.lock.Unlock()
+		if rl.control != nil {
+			rl.control.Close()
+		}
+	})
+	return nil
+}
+
+func (rl *relayListener) Addr() net.Addr {
+	return relayAddr(rl.relay)
+}
+
+type relayAddr string
+
+func (a relayAddr) Network() string { return "relay" }
+func (a relayAddr) String() string  { return string(a) }
+
+// 注册并读取控制连接上的通知，断开后重新注册，直到关闭
+func (rl *relayListener) run() {
+	self := rl.cfg.DataAddr()
+	for {
+		conn, err := dialRelay(rl.cfg, rl.relay, RELAY_OP_REGISTER, self)
+		if err == nil {
+			rl.log.Infof("Registered to relay %s", rl.relay)
+			err = rl.serve(conn)
+		}
+
+		select {
+		case <-rl.quitChan:
+			return
+		default:
+		}
+		rl.log.Warnf("Relay %s disconnected, retry in %v, error=%v", rl.relay, RELAY_RETRY_INTERVAL, err)
+		select {
+		case <-rl.quitChan:
+			return
+		case <-time.After(RELAY_RETRY_INTERVAL):
+		}
+	}
+}
+
+func (rl *relayListener) serve(conn net.Conn) error {
+	rl.lock.Lock()
+	select {
+	case <-rl.quitChan:
+		rl.lock.Unlock()
+		conn.Close()
+		return errRelayClosed
+	default:
+	}
+	rl.control = conn
+	rl.lock.Unlock()
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * RELAY_KEEPALIVE))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if id := strings.TrimSpace(line); id != "" {
+			go rl.accept(id)
+		}
+	}
+}
+
+func (rl *relayListener) accept(id string) {
+	conn, err := dialRelay(rl.cfg, rl.relay, RELAY_OP_ACCEPT, id)
+	if err != nil {
+		rl.log.Errorf("Accept relayed connection from %s failed, error=%v", rl.relay, err)
+		return
+	}
+	select {
+	case rl.conns <- conn:
+	case <-rl.quitChan:
+		conn.Close()
+	}
+}
@@ -0,0 +1,220 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 保存任务元数据的文件后缀，任务结束后仍可以校验已下载的文件
+	metaFileSuffix = ".gofd-meta"
+)
+
+var (
+	errPieceRepairing = errors.New("piece is repairing")
+)
+
+func metaFile(dir, taskId string) string {
+	return filepath.Join(dir, "."+taskId+metaFileSuffix)
+}
+
+// 保存任务的元数据，路径已修改为下载目录
+func saveTaskMeta(dir, taskId string, m *MetaInfo) error {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	file := metaFile(dir, taskId)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func loadTaskMeta(dir, taskId string) (*MetaInfo, error) {
+	bs, err := ioutil.ReadFile(metaFile(dir, taskId))
+	if err != nil {
+		return nil, err
+	}
+	m := new(MetaInfo)
+	if err := json.Unmarshal(bs, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func removeTaskMeta(dir, taskId string, l common.Logger) {
+	if err := os.Remove(metaFile(dir, taskId)); err != nil && !os.IsNotExist(err) {
+		l.Errorf("Remove meta file failed, error=%v", err)
+	}
+}
+
+// 损坏的Piece合并为连续的范围后，转换为在各文件中的范围
+func corruptRanges(m *MetaInfo, totalSize int64, bad []int) []*CorruptRange {
+	offsets, _ := m.fileOffsets()
+	var ranges []*CorruptRange
+	for i := 0; i < len(bad); {
+		j := i + 1
+		for j < len(bad) && bad[j] == bad[j-1]+1 {
+			j++
+		}
+		start := int64(bad[i]) * m.PieceLen
+		end := min64(int64(bad[j-1]+1)*m.PieceLen, totalSize)
+		for k, fd := range m.Files {
+			from, to := max64(start, offsets[k]), min64(end, offsets[k]+fd.Length)
+			if from < to {
+				ranges = append(ranges, &CorruptRange{File: fd.Name, Offset: fd.Offset + from - offsets[k], Length: to - from})
+			}
+		}
+		i = j
+	}
+	return ranges
+}
+
+// 重新计算所有Piece的摘要，返回损坏的Piece
+func verifyStore(fs FileStore, m *MetaInfo, totalSize int64, memoryBudget int64) (bad []int, total int, err error) {
+	_, _, good, err := checkPieces(fs, totalSize, m, memoryBudget)
+	if err != nil {
+		return nil, 0, err
+	}
+	total = good.Len()
+	for i := good.FindNextClear(0); i >= 0 && i < total; i = good.FindNextClear(i + 1) {
+		bad = append(bad, i)
+	}
+	return
+}
+
+// 校验已结束任务保存的元数据对应的文件，只能报告损坏的数据，不能修复
+func verifyStoredTask(dir, taskId string, l common.Logger, memoryBudget int64) (*VerifyResult, error) {
+	m, err := loadTaskMeta(dir, taskId)
+	if err != nil {
+		return nil, err
+	}
+	fs, totalSize, err := NewFileStore(m, NewFileSystemAdapter(SizeCheck_AtLeast), l)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	start := time.Now()
+	bad, total, err := verifyStore(fs, m, totalSize, memoryBudget)
+	if err != nil {
+		return nil, err
+	}
+	l.Infof("Verified stored files: total(%v), bad(%v) (%.2f seconds)", total, len(bad),
+		time.Now().Sub(start).Seconds())
+	return &VerifyResult{TaskId: taskId, PiecesTotal: total, BadPieces: bad,
+		BadRanges: corruptRanges(m, totalSize, bad)}, nil
+}
+
+// 按元数据校验dir目录下的文件，不需要运行Agent，如在构建流水线中校验解压或复制后的文件。
+// 文件按元数据中的相对路径在dir下查找，软链接与内容重复的文件不校验
+func VerifyDir(mi *MetaInfo, dir string, memoryBudget int64) (*VerifyResult, error) {
+	local := *mi
+	local.Files = make([]*FileDict, len(mi.Files))
+	for i, fd := range mi.Files {
+		if err := checkFileName(fd.Name); err != nil {
+			return nil, err
+		}
+		f := *fd
+		f.Path = dir
+		local.Files[i] = &f
+	}
+	fs, totalSize, err := NewFileStore(&local, NewFileSystemAdapter(SizeCheck_Exact), common.DefaultLogger())
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	bad, total, err := verifyStore(fs, &local, totalSize, memoryBudget)
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyResult{PiecesTotal: total, BadPieces: bad, BadRanges: corruptRanges(&local, totalSize, bad)}, nil
+}
+
+type verifyQuery struct {
+	repair bool
+	out    chan *verifyOutput
+}
+
+type verifyOutput struct {
+	result *VerifyResult
+	err    error
+}
+
+// 校验运行中任务的文件，可以在其它Goroutine中调用
+func (s *P2pSession) Verify(repair bool) (*VerifyResult, error) {
+	q := &verifyQuery{repair: repair, out: make(chan *verifyOutput, 1)}
+	select {
+	case s.verifyChan <- q:
+	case <-s.endedChan:
+		return nil, errors.New("Task is ended")
+	}
+	select {
+	case o := <-q.out:
+		return o.result, o.err
+	case <-s.endedChan:
+		return nil, errors.New("Task is ended")
+	}
+}
+
+// 在Session的Goroutine中校验。修复时把损坏的Piece标记为缺失，从上游的Peer重新下载
+func (s *P2pSession) verifyImp(repair bool) (*VerifyResult, error) {
+	if err := s.flushFiles(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	m := s.task.MetaInfo
+	bad, total, err := verifyStore(s.fileStore, m, s.totalSize, int64(s.g.cfg.Control.VerifyMemory)*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	s.checkPieceTime += time.Now().Sub(start).Seconds()
+
+	vr := &VerifyResult{TaskId: s.taskId, PiecesTotal: total}
+	for _, i := range bad {
+		// 还没有下载的Piece不算损坏
+		if s.pieceSet.IsSet(i) {
+			vr.BadPieces = append(vr.BadPieces, i)
+		}
+	}
+	vr.BadRanges = corruptRanges(m, s.totalSize, vr.BadPieces)
+	s.log.Infof("Verified files: total(%v), bad(%v) (%.2f seconds)", total, len(vr.BadPieces),
+		time.Now().Sub(start).Seconds())
+
+	if !repair || len(vr.BadPieces) == 0 || s.seeding() {
+		return vr, nil
+	}
+
+	for _, i := range vr.BadPieces {
+		s.pieceSet.Clear(i)
+		s.goodPieces--
+		s.repairPieces[i] = true
+	}
+	s.resumeDirty = true
+	s.finishedAt = time.Time{}
+	s.reportStep = 0
+	s.lastErr, s.lastCode = "", ""
+	vr.Repairing = true
+
+	upstream := 0
+	for _, p := range s.peers {
+		if !p.client {
+			upstream++
+			s.fillRequests(p)
+		}
+	}
+	if upstream == 0 && !s.startAt.IsZero() {
+		s.tryNewPeer()
+	}
+	s.reportStatus(float32(s.goodPieces*100) / float32(s.totalPieces))
+	return vr, nil
+}
@@ -0,0 +1,57 @@
+package p2p
+
+// 在上报的Goroutine中调用。Session来不及处理时丢弃，Server超时后重新分配
+func (s *P2pSession) setAssignedPieces(pieces []int) {
+	select {
+	case s.assignChan <- pieces:
+	default:
+	}
+}
+
+// 是否需要下载该Piece，复制模式下只下载Server分配的Piece
+func (s *P2pSession) assignedPiece(piece int) bool {
+	return s.assigned == nil || s.assigned.IsSet(piece)
+}
+
+// 加入Server分配的Piece，并向已解除阻塞的上游请求
+func (s *P2pSession) assignPieces(pieces []int) {
+	if s.assigned == nil || s.pieceSet == nil {
+		return
+	}
+	added := 0
+	for _, i := range pieces {
+		if i >= 0 && i < s.totalPieces && !s.assigned.IsSet(i) {
+			s.assigned.Set(i)
+			added++
+		}
+	}
+	if added == 0 {
+		return
+	}
+	s.log.Infof("Assigned %v pieces to replicate", added)
+	for _, p := range s.peers {
+		if !p.client && !p.peerChoking {
+			s.fillRequests(p)
+		}
+	}
+}
+
+// 复制模式下分配的Piece都已完成或不能下载，等待Server新的分配
+func (s *P2pSession) replicaIdle() bool {
+	if s.assigned == nil || s.pieceSet == nil {
+		return false
+	}
+	for i := s.assigned.FindNextSet(0); i >= 0 && i < s.totalPieces; i = s.assigned.FindNextSet(i + 1) {
+		if !s.pieceSet.IsSet(i) && !s.unrecoverable[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 空闲时定期上报位图，其它Agent退出后由Server分配副本数不足的Piece
+func (s *P2pSession) reportReplicaIdle() {
+	if s.goodPieces != s.totalPieces && s.replicaIdle() {
+		s.reportStatus(float32(s.goodPieces*100) / float32(s.totalPieces))
+	}
+}
@@ -2,31 +2,71 @@ package p2p
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"time"
 
-	log "github.com/cihub/seelog"
 	"github.com/xtfly/gofd/common"
 )
 
+const (
+	// 所有地址都上报失败后，重试的最大轮数
+	MAX_REPORT_RETRIES = 6
+	// 重试间隔从1秒开始指数增长，不超过该值
+	MAX_REPORT_BACKOFF = time.Minute
+)
+
 type reportInfo struct {
-	serverAddr      string
+	serverAddrs     []string
+	announceAddr    string // ServerAddr对应的UDP上报地址
 	percentComplete float32
+	leaving         bool
+	speed           int64
+	err             string
+	errCode         string
+	have            []byte
+	transfer        *TransferReport
+	badPeers        []string
+	files           []*FileCheck
 }
 
 type reportor struct {
-	taskId string
-	cfg    *common.Config
-	client *http.Client
+	taskId  string
+	cfg     *common.Config
+	log     common.Logger
+	client  *http.Client
+	metrics *Metrics
+	active  int         // 最近一次上报成功的地址，下次从该地址开始
+	span    common.Span // 任务的Span，每次上报作为其子Span
+
+	udpFailures int       // UDP上报连续失败的次数
+	udpRetryAt  time.Time // 连续失败后，该时间之前只使用HTTP
+
+	// 收到Server返回的Piece副本数时回调
+	OnAvailability func(availability []int)
+	// 收到Server返回的已完成并继续上传的Agent时回调
+	OnSeeds func(seeds []string)
+	// 收到Server返回的其它Agent上报的坏Peer时回调
+	OnBadPeers func(addrs []string)
+	// 复制模式下收到Server分配的Piece时回调
+	OnAssign func(pieces []int)
 
 	reportChan chan *reportInfo
+	quitChan   chan struct{}
+	doneChan   chan struct{} // 所有上报处理完后关闭
 }
 
-func NewReportor(taskId string, cfg *common.Config) *reportor {
+func NewReportor(taskId string, cfg *common.Config, l common.Logger, metrics *Metrics, span common.Span) *reportor {
 	r := &reportor{
 		taskId:     taskId,
 		cfg:        cfg,
+		log:        l,
 		client:     common.CreateHttpClient(cfg),
+		metrics:    metrics,
+		span:       span,
 		reportChan: make(chan *reportInfo, 20),
+		quitChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
 	}
 
 	go r.run()
@@ -34,38 +74,179 @@ func NewReportor(taskId string, cfg *common.Config) *reportor {
 }
 
 func (r *reportor) run() {
-	for rc := range r.reportChan {
-		r.reportImp(rc)
+	defer close(r.doneChan)
+	for {
+		select {
+		case rc := <-r.reportChan:
+			r.reportImp(rc)
+		case <-r.quitChan:
+			// 关闭前处理已提交的上报，失败时不再重试
+			for {
+				select {
+				case rc := <-r.reportChan:
+					r.reportImp(rc)
+				default:
+					return
+				}
+			}
+		}
 	}
 }
 
-func (r *reportor) DoReport(serverAddr string, pecent float32) {
-	r.reportChan <- &reportInfo{serverAddr: serverAddr, percentComplete: pecent}
+func (r *reportor) DoReport(lc *LinkChain, pecent float32, speed int64, err, errCode string, have []byte, transfer *TransferReport,
+	badPeers []string, files []*FileCheck) {
+	r.submit(&reportInfo{serverAddrs: lc.reportAddrs(), announceAddr: lc.AnnounceAddr, percentComplete: pecent, speed: speed,
+		err: err, errCode: errCode, have: have, transfer: transfer, badPeers: badPeers, files: files})
+}
+
+// 通知Server本节点退出
+func (r *reportor) DoLeave(lc *LinkChain, pecent float32) {
+	r.submit(&reportInfo{serverAddrs: lc.reportAddrs(), announceAddr: lc.AnnounceAddr, percentComplete: pecent, leaving: true})
+}
+
+// 关闭后提交的上报直接丢弃
+func (r *reportor) submit(ri *reportInfo) {
+	select {
+	case r.reportChan <- ri:
+	case <-r.quitChan:
+	}
 }
 
 func (r *reportor) Close() {
-	close(r.reportChan)
+	close(r.quitChan)
 }
 
 func (r *reportor) reportImp(ri *reportInfo) {
 	if int(ri.percentComplete) == 100 {
-		log.Infof("[%s] Report session status... completed", r.taskId)
+		r.log.Infof("Report session status... completed")
 	}
+	span := common.StartSpan(r.span, "tracker.announce", "task.percent", ri.percentComplete, "task.leaving", ri.leaving)
+	defer span.End()
 	csr := &StatusReport{
 		TaskId:          r.taskId,
 		IP:              r.cfg.Net.IP,
 		PercentComplete: ri.percentComplete,
+		Leaving:         ri.leaving,
+		Speed:           ri.speed,
+		Error:           ri.err,
+		ErrorCode:       ri.errCode,
+		Have:            ri.have,
+		Transfer:        ri.transfer,
+		BadPeers:        ri.badPeers,
+		Files:           ri.files,
+		TraceParent:     span.TraceParent(),
+		ProtocolVersion: PROTOCOL_VERSION,
 	}
 	bs, err := json.Marshal(csr)
 	if err != nil {
-		log.Errorf("[%s] Report session status failed. error=%v", r.taskId, err)
+		r.log.Errorf("Report session status failed. error=%v", err)
 		return
 	}
 
-	_, err = common.SendHttpReq(r.cfg, "POST",
-		ri.serverAddr, "/api/v1/server/tasks/status", bs)
+	backoff := time.Second
+	for retry := 0; ; retry++ {
+		// 每次重试重新查询SRV记录
+		if r.reportOnce(common.ResolveAddrs(ri.serverAddrs), ri.announceAddr, bs) {
+			span.SetAttributes("announce.retries", retry)
+			return
+		}
+		if retry >= MAX_REPORT_RETRIES {
+			r.log.Errorf("Report session status failed after %v retries", retry)
+			span.SetError(fmt.Errorf("Report failed after %v retries", retry))
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-r.quitChan:
+			return
+		}
+		if backoff *= 2; backoff > MAX_REPORT_BACKOFF {
+			backoff = MAX_REPORT_BACKOFF
+		}
+	}
+}
+
+// 旧版本的Server返回空的响应
+func (r *reportor) announced(rsp []byte) {
+	if len(rsp) == 0 || (r.OnAvailability == nil && r.OnSeeds == nil && r.OnBadPeers == nil && r.OnAssign == nil) {
+		return
+	}
+	ar := new(AnnounceResponse)
+	if err := json.Unmarshal(rsp, ar); err != nil {
+		r.log.Debugf("Decode announce response failed. error=%v", err)
+		return
+	}
+	if len(ar.Availability) > 0 && r.OnAvailability != nil {
+		r.OnAvailability(ar.Availability)
+	}
+	if len(ar.Seeds) > 0 && r.OnSeeds != nil {
+		r.OnSeeds(ar.Seeds)
+	}
+	if len(ar.BadPeers) > 0 && r.OnBadPeers != nil {
+		r.OnBadPeers(ar.BadPeers)
+	}
+	if len(ar.Assign) > 0 && r.OnAssign != nil {
+		r.OnAssign(ar.Assign)
+	}
+}
+
+// 从上次成功的地址开始依次上报，有一个成功即返回
+func (r *reportor) reportOnce(addrs []string, announceAddr string, bs []byte) bool {
+	if r.active >= len(addrs) {
+		r.active = 0
+	}
+	for i := 0; i < len(addrs); i++ {
+		idx := (r.active + i) % len(addrs)
+		start := time.Now()
+		var rsp []byte
+		var err error
+		if idx == 0 && r.useUdp(announceAddr, bs) {
+			rsp, err = r.reportUdp(announceAddr, bs)
+		}
+		if rsp == nil {
+			rsp, err = common.SendHttpReq(r.cfg, "POST",
+				addrs[idx], "/api/v1/server/tasks/status", bs)
+		}
+		r.metrics.reported(time.Now().Sub(start))
+		if err == nil {
+			r.announced(rsp)
+			if idx != r.active {
+				r.log.Infof("Report session status to %s", addrs[idx])
+				r.active = idx
+			}
+			return true
+		}
+		r.log.Errorf("Report session status to %s failed. error=%v", addrs[idx], err)
+	}
+	return false
+}
+
+// 内容较小、不需要经过代理并且最近没有连续失败时使用UDP上报
+func (r *reportor) useUdp(announceAddr string, bs []byte) bool {
+	return announceAddr != "" && len(bs) <= UDP_ANNOUNCE_MAX_PAYLOAD && r.cfg.ProxyFor(announceAddr) == nil &&
+		!time.Now().Before(r.udpRetryAt)
+}
+
+// UDP上报失败时返回nil，由调用方改用HTTP
+func (r *reportor) reportUdp(announceAddr string, bs []byte) ([]byte, error) {
+	rsp, err := udpAnnounce(r.cfg, announceAddr, bs)
+	if err == errUdpAnnounceHttp {
+		return nil, err
+	}
 	if err != nil {
-		log.Errorf("[%s] Report session status failed. error=%v", r.taskId, err)
+		if r.udpFailures++; r.udpFailures >= UDP_ANNOUNCE_MAX_FAILURES {
+			r.udpFailures, r.udpRetryAt = 0, time.Now().Add(UDP_ANNOUNCE_BACKOFF)
+			r.log.Warnf("Announce to %s over udp failed %v times, use http in %v", announceAddr, UDP_ANNOUNCE_MAX_FAILURES, UDP_ANNOUNCE_BACKOFF)
+		} else {
+			r.log.Debugf("Announce to %s over udp failed, fall back to http. error=%v", announceAddr, err)
+		}
+		return nil, err
+	}
+	r.udpFailures = 0
+	if rsp == nil {
+		// Server返回空的响应
+		rsp = []byte{}
 	}
-	return
+	return rsp, nil
 }
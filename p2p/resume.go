@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 保存Piece位图的文件后缀，与下载的文件放在同一目录
+	resumeFileSuffix = ".gofd-resume"
+)
+
+// 持久化已校验通过的Piece位图，Agent重启后只需要校验位图中的Piece，
+// 不需要重新下载。元数据变化后位图失效
+type resumeFile struct {
+	file        string
+	fingerprint []byte
+	log         common.Logger
+}
+
+func newResumeFile(dir, taskId string, m *MetaInfo, l common.Logger) *resumeFile {
+	return &resumeFile{
+		file:        filepath.Join(dir, "."+taskId+resumeFileSuffix),
+		fingerprint: m.Fingerprint(),
+		log:         l,
+	}
+}
+
+// 读取保存的位图，文件不存在或与元数据不匹配时返回nil
+func (r *resumeFile) load(n int) *Bitset {
+	data, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return nil
+	}
+	fl := len(r.fingerprint)
+	if len(data) < fl+4 || !bytes.Equal(data[:fl], r.fingerprint) {
+		r.log.Warnf("Ignore mismatched resume file %s", r.file)
+		return nil
+	}
+	if int(binary.BigEndian.Uint32(data[fl:fl+4])) != n {
+		r.log.Warnf("Ignore mismatched resume file %s", r.file)
+		return nil
+	}
+	return NewBitsetFromBytes(n, data[fl+4:])
+}
+
+// 先写临时文件再改名，避免写一半时退出导致位图损坏
+func (r *resumeFile) save(b *Bitset) error {
+	var buf bytes.Buffer
+	buf.Write(r.fingerprint)
+	binary.Write(&buf, binary.BigEndian, uint32(b.Len()))
+	buf.Write(b.Bytes())
+
+	tmp := r.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.file)
+}
+
+func (r *resumeFile) remove() {
+	if err := os.Remove(r.file); err != nil && !os.IsNotExist(err) {
+		r.log.Errorf("Remove resume file %s failed, error=%v", r.file, err)
+	}
+}
@@ -0,0 +1,131 @@
+package p2p
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 重试等待时间的上限
+	MAX_RETRY_BACKOFF = 30 * time.Second
+	// 坏Peer最近一次发送坏Piece之后不再连接的时间，之后重新计数
+	BAD_PEER_COOLDOWN = 10 * time.Minute
+)
+
+// 连接Peer与请求Piece失败后的重试策略
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	jitter   float64
+}
+
+func newRetryPolicy(c *common.Control) *retryPolicy {
+	return &retryPolicy{
+		attempts: c.RetryAttempts,
+		base:     time.Duration(c.RetryBackoff) * time.Millisecond,
+		jitter:   float64(c.RetryJitter) / 100,
+	}
+}
+
+// 第n次失败后的等待时间：从base开始指数增长，再随机增减jitter的比例，避免下游节点同时重试
+func (r *retryPolicy) backoff(n int) time.Duration {
+	d := r.base
+	for i := 1; i < n && d < MAX_RETRY_BACKOFF; i++ {
+		d *= 2
+	}
+	if d > MAX_RETRY_BACKOFF {
+		d = MAX_RETRY_BACKOFF
+	}
+	if r.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * r.jitter * float64(d))
+	}
+	return d
+}
+
+// 连接失败后等待退避时间再重试
+func (s *P2pSession) retryConnect() {
+	s.connFailCount++
+	s.connRetries++
+	delay := s.g.retry.backoff(s.connFailCount)
+	s.log.Debugf("Retry connect after %v, failures=%v", delay, s.connFailCount)
+	s.retryConnTimeChan = time.After(delay)
+}
+
+// 发送的坏Piece达到Control.BadPeerPieces的Peer，BAD_PEER_COOLDOWN内不再连接。
+// 冷却结束后重新计数，Peer的数据可能已经修复，任务也可能只剩该Peer可以提供数据
+func (s *P2pSession) isBadPeer(address string) bool {
+	if s.badPeers[address] < s.g.cfg.Control.BadPeerPieces {
+		return false
+	}
+	if time.Since(s.badPeerAt[address]) >= BAD_PEER_COOLDOWN {
+		delete(s.badPeers, address)
+		delete(s.badPeerAt, address)
+		return false
+	}
+	return true
+}
+
+// 本节点不再连接的Peer，按地址排序后上报给Server
+func (s *P2pSession) bannedPeers() []string {
+	var addrs []string
+	for addr := range s.badPeers {
+		if s.isBadPeer(addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Piece是否还在退避中
+func (s *P2pSession) pieceBackoff(piece int) bool {
+	at, ok := s.pieceRetryAt[piece]
+	return ok && time.Now().Before(at)
+}
+
+// Piece第n次失败，退避结束前不再请求
+func (s *P2pSession) delayPiece(piece, n int) {
+	at := time.Now().Add(s.g.retry.backoff(n))
+	s.pieceRetryAt[piece] = at
+	if s.retryPieceChan == nil || at.Before(s.nextPieceRetry) {
+		s.nextPieceRetry = at
+		s.retryPieceChan = time.After(at.Sub(time.Now()))
+	}
+}
+
+// 请求超时，同一Peer连续超时RetryAttempts次后返回错误，断开重连
+func (s *P2pSession) requestTimedOut(p *peer, piece int) error {
+	s.pieceTimeouts[piece]++
+	s.requestTimeouts++
+	s.peerStats(p.address).Timeouts++
+	s.delayPiece(piece, s.pieceTimeouts[piece])
+	p.timeouts++
+	if p.timeouts >= s.g.retry.attempts {
+		return fmt.Errorf("%v requests timed out", p.timeouts)
+	}
+	return nil
+}
+
+// 退避结束后继续向上游的Peer请求
+func (s *P2pSession) retryPieces() {
+	s.retryPieceChan = nil
+	now := time.Now()
+	for piece, at := range s.pieceRetryAt {
+		if !at.After(now) {
+			delete(s.pieceRetryAt, piece)
+		} else if s.retryPieceChan == nil || at.Before(s.nextPieceRetry) {
+			s.nextPieceRetry = at
+			s.retryPieceChan = time.After(at.Sub(now))
+		}
+	}
+	for _, p := range s.peers {
+		if p.client {
+			continue
+		}
+		s.fillRequests(p)
+	}
+}
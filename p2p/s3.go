@@ -0,0 +1,395 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// S3对象的路径前缀，如 s3://bucket/dir/file
+	S3_SCHEME = "s3://"
+
+	s3DefaultRegion   = "us-east-1"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// 是否为S3对象的路径
+func isS3Path(p string) bool {
+	return strings.HasPrefix(p, S3_SCHEME)
+}
+
+// 解析 s3://bucket/key
+func parseS3Path(p string) (bucket, key string, err error) {
+	if !isS3Path(p) {
+		return "", "", fmt.Errorf("Not a s3 path %s", p)
+	}
+	p = strings.TrimPrefix(p, S3_SCHEME)
+	i := strings.Index(p, "/")
+	if i <= 0 {
+		return p, "", nil
+	}
+	return p[:i], strings.TrimPrefix(path.Clean(p[i:]), "/"), nil
+}
+
+// 访问S3兼容对象存储的客户端，使用路径风格的URL与AWS Signature V4签名
+type S3Client struct {
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func NewS3Client(cfg *common.S3Config) *S3Client {
+	region := cfg.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	return &S3Client{
+		endpoint:  strings.TrimSuffix(cfg.Endpoint, "/"),
+		region:    region,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		client:    &http.Client{},
+	}
+}
+
+// 按SigV4的要求编码对象路径，除了非保留字符与'/'，全部编码
+func s3EscapePath(p string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (c *S3Client) newRequest(method, bucket, key string, body io.Reader, payloadHash string) (*http.Request, error) {
+	uri := s3EscapePath("/" + bucket + "/" + key)
+	req, err := http.NewRequest(method, c.endpoint+uri, body)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, uri, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// AWS Signature V4签名，只签名host与x-amz-*头
+func (c *S3Client) sign(req *http.Request, uri, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func (c *S3Client) do(req *http.Request, expected ...int) (*http.Response, error) {
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if rsp.StatusCode == code {
+			return rsp, nil
+		}
+	}
+	rsp.Body.Close()
+	return nil, fmt.Errorf("S3 %s %s failed, status=%s", req.Method, req.URL.Path, rsp.Status)
+}
+
+// 查询对象的大小与修改时间
+func (c *S3Client) Head(bucket, key string) (size int64, modTime time.Time, err error) {
+	req, err := c.newRequest(http.MethodHead, bucket, key, nil, s3EmptyPayload)
+	if err != nil {
+		return
+	}
+	rsp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return
+	}
+	rsp.Body.Close()
+	size = rsp.ContentLength
+	modTime, _ = http.ParseTime(rsp.Header.Get("Last-Modified"))
+	return
+}
+
+// 读取对象中从off开始的n个字节，n<0时读到末尾
+func (c *S3Client) Get(bucket, key string, off, n int64) (io.ReadCloser, error) {
+	req, err := c.newRequest(http.MethodGet, bucket, key, nil, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	if n >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	} else if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+	rsp, err := c.do(req, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode == http.StatusOK && off > 0 {
+		// 不支持Range时跳过前面的数据
+		if _, err = io.CopyN(ioutil.Discard, rsp.Body, off); err != nil {
+			rsp.Body.Close()
+			return nil, err
+		}
+	}
+	return rsp.Body, nil
+}
+
+// 上传对象，数据不参与签名，需要使用HTTPS保证完整性
+func (c *S3Client) Put(bucket, key string, r io.Reader, size int64) error {
+	req, err := c.newRequest(http.MethodPut, bucket, key, r, s3UnsignedPayload)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	rsp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+// 把本地文件上传到 s3://bucket/key
+func (c *S3Client) PutFile(s3Path, file string) error {
+	bucket, key, err := parseS3Path(s3Path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return c.Put(bucket, key, f, fi.Size())
+}
+
+// S3中的一个对象，只读
+type s3File struct {
+	client      *S3Client
+	bucket, key string
+	size        int64
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	want := int64(len(p))
+	if off+want > f.size {
+		want = f.size - off
+	}
+	body, err := f.client.Get(f.bucket, f.key, off, want)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err = io.ReadFull(body, p[:want])
+	if err == nil && int64(n) < int64(len(p)) {
+		err = io.EOF
+	}
+	return
+}
+
+func (f *s3File) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("S3 file is read only")
+}
+
+func (f *s3File) Close() error {
+	return nil
+}
+
+// S3对象的os.FileInfo，用于创建元数据
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *s3FileInfo) Name() string       { return fi.name }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) Mode() os.FileMode  { return 0444 }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return false }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
+
+func (c *S3Client) stat(s3Path string) (os.FileInfo, error) {
+	bucket, key, err := parseS3Path(s3Path)
+	if err != nil {
+		return nil, err
+	}
+	size, modTime, err := c.Head(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3FileInfo{name: path.Base(key), size: size, modTime: modTime}, nil
+}
+
+// 打开S3对象，按sizeCheck检查对象的大小
+func (c *S3Client) open(name []string, length int64, sizeCheck SizeCheck) (File, error) {
+	bucket, key, err := parseS3Path(name[0])
+	if err != nil {
+		return nil, err
+	}
+	key = strings.TrimPrefix(path.Join(append([]string{"/", key}, name[1:]...)...), "/")
+	size, _, err := c.Head(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case sizeCheck == SizeCheck_Exact && size != length:
+		err = fmt.Errorf("Unexpected file size %v. Expected %v", size, length)
+	case sizeCheck == SizeCheck_AtLeast && size < length:
+		err = fmt.Errorf("Unexpected file size %v. Expected at least %v", size, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{client: c, bucket: bucket, key: key, size: size}, nil
+}
+
+// 计算S3对象的摘要
+func (c *S3Client) sum(s3Path string, newHash hashFunc, done <-chan struct{}) (sum string, err error) {
+	bucket, key, err := parseS3Path(s3Path)
+	if err != nil {
+		return
+	}
+	body, err := c.Get(bucket, key, 0, -1)
+	if err != nil {
+		common.DefaultLogger().Errorf("Open file failed, file=%s, error=%v", s3Path, err)
+		return
+	}
+	defer body.Close()
+	hash := newHash()
+	if _, err = io.Copy(hash, &cancelReader{r: body, done: done}); err == ErrCanceled {
+		return
+	} else if err != nil {
+		common.DefaultLogger().Errorf("Summary file failed, file=%s, error=%v", s3Path, err)
+		return
+	}
+	sum = string(hash.Sum(nil))
+	return
+}
+
+// 路径以s3://开头的文件从S3读取，其它文件由local处理
+type s3FileSystem struct {
+	client *S3Client
+	local  FileSystem
+}
+
+func NewS3FileSystem(client *S3Client, local FileSystem) FileSystem {
+	return &s3FileSystem{client: client, local: local}
+}
+
+func (s *s3FileSystem) Open(name []string, length int64) (File, error) {
+	if len(name) > 0 && isS3Path(name[0]) {
+		return s.client.open(name, length, SizeCheck_Exact)
+	}
+	return s.local.Open(name, length)
+}
+
+func (s *s3FileSystem) OpenPartial(name []string, size int64) (File, error) {
+	if len(name) > 0 && isS3Path(name[0]) {
+		return s.client.open(name, size, SizeCheck_AtLeast)
+	}
+	po, ok := s.local.(partialOpener)
+	if !ok {
+		return nil, errors.New("File system not support partial file")
+	}
+	return po.OpenPartial(name, size)
+}
+
+func (s *s3FileSystem) Close() error {
+	return s.local.Close()
+}
+
+// 服务端从S3读取分发的文件
+type S3FsProvider struct {
+	Client *S3Client
+	Local  FsProvider
+}
+
+func (p S3FsProvider) NewFS() (FileSystem, error) {
+	local, err := p.Local.NewFS()
+	if err != nil {
+		return nil, err
+	}
+	return NewS3FileSystem(p.Client, local), nil
+}
+
+// 下载完成后把文件上传到配置的S3路径下，保留文件在任务中的相对路径
+func (s *P2pSession) uploadToS3() {
+	prefix := strings.TrimSuffix(s.g.cfg.S3.UploadTo, "/")
+	for _, fd := range s.task.MetaInfo.Files {
+		file := localPath(s.downDir(), fd.Name)
+		if s.partials != nil {
+			// 还在后台校验的文件没有改名
+			file = s.currentPath(fd.Name)
+		}
+		dest := prefix + "/" + fd.Name
+		if err := s.g.s3.PutFile(dest, file); err != nil {
+			s.log.Errorf("Upload file to s3 failed, file=%s, dest=%s, error=%v", file, dest, err)
+			continue
+		}
+		s.log.Infof("Uploaded file to s3, file=%s, dest=%s", file, dest)
+	}
+}
@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/flowctrl"
+)
+
+const (
+	// 检查速率时间段的间隔，时间段以分钟为单位
+	BANDWIDTH_SCHEDULE_INTERVAL = 30 * time.Second
+)
+
+// 按Control.BandwidthSchedule调整所有任务总的速率。
+// 时间段内的速率与配置或通过接口调整的总速率取较小的值，不在时间段内时使用总速率
+type speedSchedule struct {
+	lock     sync.Mutex
+	upload   int // Unit: MiBps, 配置或调整的总上传速率
+	download int // Unit: MiBps, 配置或调整的总下载速率
+	window   *common.BandwidthWindow
+
+	cfg             *common.Config
+	log             common.Logger
+	uploadLimiter   *flowctrl.TokenBucket
+	downloadLimiter *flowctrl.TokenBucket
+}
+
+func newSpeedSchedule(g *global) *speedSchedule {
+	ss := &speedSchedule{
+		upload:          g.cfg.Control.UploadSpeed,
+		download:        g.cfg.Control.DownloadSpeed,
+		cfg:             g.cfg,
+		log:             g.log,
+		uploadLimiter:   g.uploadLimiter,
+		downloadLimiter: g.downloadLimiter,
+	}
+	ss.apply(time.Now())
+	return ss
+}
+
+func (ss *speedSchedule) run(quitChan <-chan struct{}) {
+	tick := time.NewTicker(BANDWIDTH_SCHEDULE_INTERVAL)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			ss.apply(now)
+		case <-quitChan:
+			return
+		}
+	}
+}
+
+// 调整总速率，所在时间段的速率更低时仍然按时间段限制
+func (ss *speedSchedule) setTotal(upload, download int) {
+	ss.lock.Lock()
+	ss.upload, ss.download = upload, download
+	ss.lock.Unlock()
+	ss.apply(time.Now())
+}
+
+func (ss *speedSchedule) apply(now time.Time) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	upload, download := ss.upload, ss.download
+	w := ss.cfg.Control.BandwidthSchedule.Window(now)
+	if w != nil {
+		upload, download = lowerSpeed(upload, w.Upload), lowerSpeed(download, w.Download)
+	}
+	if w != ss.window {
+		if w != nil {
+			ss.log.Infof("Enter bandwidth schedule %s-%s, upload=%vMiBps, download=%vMiBps", w.Start, w.End, upload, download)
+		} else {
+			ss.log.Infof("Leave bandwidth schedule %s-%s, upload=%vMiBps, download=%vMiBps",
+				ss.window.Start, ss.window.End, upload, download)
+		}
+		ss.window = w
+	}
+	ss.uploadLimiter.SetRate(mibps(upload))
+	ss.downloadLimiter.SetRate(mibps(download))
+}
+
+// 两个速率中较低的，0表示不限制
+func lowerSpeed(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,71 @@
+package p2p
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+const (
+	// 任务加密密钥的长度，使用AES-256-GCM
+	ENCRYPT_KEY_SIZE = 32
+)
+
+// 为任务生成随机的加密密钥，随元数据下发给Agent
+func NewEncryptKey() ([]byte, error) {
+	key := make([]byte, ENCRYPT_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newPieceSealer(key []byte) (cipher.AEAD, error) {
+	if len(key) != ENCRYPT_KEY_SIZE {
+		return nil, fmt.Errorf("Invalid encrypt key length %v", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 加密PIECE或压缩的PIECE消息：消息类型与块数据一起加密，index与begin作为附加数据参与认证。
+// 格式为 PIECE_SEALED | index | begin | nonce | 密文
+func sealPiece(aead cipher.AEAD, message []byte) []byte {
+	ns := aead.NonceSize()
+	plain := make([]byte, 0, len(message)-8)
+	plain = append(append(plain, message[0]), message[9:]...)
+
+	buf := make([]byte, 9+ns, 9+ns+len(plain)+aead.Overhead())
+	buf[0] = PIECE_SEALED
+	copy(buf[1:9], message[1:9])
+	if _, err := rand.Read(buf[9 : 9+ns]); err != nil {
+		panic(err) // 系统随机数不可用时无法安全加密
+	}
+	return aead.Seal(buf, buf[9:9+ns], plain, buf[1:9])
+}
+
+// 解密为PIECE或压缩的PIECE消息，密钥不同或数据被篡改时返回错误
+func openPiece(aead cipher.AEAD, message []byte) ([]byte, error) {
+	ns := aead.NonceSize()
+	if len(message) < 9+ns+aead.Overhead()+1 {
+		return nil, errors.New("unexpected message length")
+	}
+	plain, err := aead.Open(nil, message[9:9+ns], message[9+ns:], message[1:9])
+	if err != nil {
+		return nil, errors.New("Decrypt block failed, encrypt key mismatch or data corrupted")
+	}
+	if plain[0] != PIECE && plain[0] != PIECE_GZIP && plain[0] != PIECE_ZSTD {
+		return nil, fmt.Errorf("Unexpected sealed message id: %d", plain[0])
+	}
+
+	piece := make([]byte, 9+len(plain)-1)
+	piece[0] = plain[0]
+	copy(piece[1:9], message[1:9])
+	copy(piece[9:], plain[1:])
+	return piece, nil
+}
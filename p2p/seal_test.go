@@ -0,0 +1,53 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealPiece(t *testing.T) {
+	key, err := NewEncryptKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newPieceSealer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := pieceMessage(7, 32768, bytes.Repeat([]byte("config=1\n"), 512))
+	// 先压缩再加密，解密后仍是压缩的消息
+	for _, m := range [][]byte{message, compressPiece("gzip", message), compressPiece("zstd", message)} {
+		sealed := sealPiece(aead, m)
+		if sealed[0] != PIECE_SEALED || bytes.Contains(sealed, m[9:40]) {
+			t.Fatal("block data is not encrypted")
+		}
+		opened, err := openPiece(aead, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened, m) {
+			t.Fatalf("opened message %d differs", m[0])
+		}
+	}
+
+	// 修改index或密文，以及使用其它密钥时解密失败
+	sealed := sealPiece(aead, message)
+	sealed[4] ^= 1
+	if _, err = openPiece(aead, sealed); err == nil {
+		t.Fatal("accept block with modified index")
+	}
+	sealed[4] ^= 1
+	sealed[len(sealed)-1] ^= 1
+	if _, err = openPiece(aead, sealed); err == nil {
+		t.Fatal("accept modified ciphertext")
+	}
+	sealed[len(sealed)-1] ^= 1
+	other, _ := NewEncryptKey()
+	otherAead, _ := newPieceSealer(other)
+	if _, err = openPiece(otherAead, sealed); err == nil {
+		t.Fatal("accept block sealed with another key")
+	}
+	if _, err = newPieceSealer(key[:16]); err == nil {
+		t.Fatal("accept short key")
+	}
+}
@@ -0,0 +1,37 @@
+package p2p
+
+import (
+	"math/rand"
+	"os"
+)
+
+// 种子节点信任已有的文件时，不重新计算所有Piece的摘要：文件长度在打开之前已检查，
+// 元数据中有修改时间的文件还需要修改时间一致，之后按SeedSample的百分比随机抽样校验Piece。
+// 返回false时需要校验所有Piece
+func (s *P2pSession) trustSeedFiles() bool {
+	for _, fd := range s.task.MetaInfo.Files {
+		if fd.Link != "" || fd.Same != "" || fd.Partial || fd.ModTime == 0 {
+			continue
+		}
+		st, err := os.Stat(localPath(fd.Path, fd.Name))
+		if err != nil || st.ModTime().Unix() != fd.ModTime {
+			s.log.Warnf("Seed file %s has been modified, verify all pieces", fd.Name)
+			return false
+		}
+	}
+
+	n := s.totalPieces * s.task.SeedSample / 100
+	if n == 0 && s.task.SeedSample > 0 && s.totalPieces > 0 {
+		n = 1
+	}
+	for _, i := range rand.Perm(s.totalPieces)[:n] {
+		ok, _, data := checkPiece(s.fileStore, s.totalSize, s.task.MetaInfo, i, s.g.buffers)
+		s.g.buffers.put(data)
+		if !ok {
+			s.log.Warnf("Sampled piece %v of seed files is bad, verify all pieces", i)
+			return false
+		}
+	}
+	s.log.Infof("Trust seed files, sampled %v of %v pieces", n, s.totalPieces)
+	return true
+}
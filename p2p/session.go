@@ -1,31 +1,35 @@
 package p2p
 
 import (
+	"crypto/cipher"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
-	"path/filepath"
+	"os"
 	"time"
 
-	log "github.com/cihub/seelog"
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/flowctrl"
 	"github.com/xtfly/gokits"
 )
 
-const (
-	// 同一地址最大连接次数
-	MAX_RETRY_CONNECT_TIMES = 10
-)
-
 type P2pSession struct {
 	// 全局信息
 	g *global
 
 	// 任务信息
 	taskId    string
+	log       common.Logger // 带有taskID字段
 	task      *DispatchTask
 	fileStore FileStore
+	readStore FileStore   // 给其它Peer发送块时读取数据
+	sealer    cipher.AEAD // 元数据中有加密密钥时，加密收发的块数据
+
+	// 初始化之前的元数据与InfoHash，其它节点通过InfoHash获取元数据。
+	// 元数据以压缩的JSONL保存，几十万个文件时也不会占用太多内存
+	infoHash string
+	metaData []byte
 
 	// 下载过程中的Pieces信息
 	pieceSet        *Bitset // 本节点已存在Piece
@@ -35,9 +39,70 @@ type P2pSession struct {
 	goodPieces      int     // 已下载的Piece个数
 	downloaded      uint64  // 已下载的字节数
 	checkPieceTime  float64 // 检查Piece所花费的时间累计
+	hashedBytes     int64   // 校验下载的Piece计算摘要的字节数
+	hashTime        float64 // 校验下载的Piece所花费的时间累计
+	speed           int64   // 最近的下载速率，字节每秒
+
+	// 下载进度
+	peerProgress map[string]*PeerProgress // 每个Peer传输的字节数
+	progressChan chan chan *TaskProgress
+
+	// 从文件开头连续下载完成的数据，可以在其它Goroutine中读取
+	stream *pieceStream
+
+	// 断点续传，客户端才保存已下载的Piece位图
+	resume      *resumeFile
+	resumeDirty bool          // 位图有变化，还没有保存
+	journal     *pieceJournal // 写入数据前记录Piece，重启后只校验日志中的Piece
 
 	// 正在下载的Piece
-	activePieces map[int]*ActivePiece
+	activePieces      map[int]*ActivePiece
+	availability      pieceAvailability // 已连接的Peer中拥有每个Piece的个数
+	swarmAvailability []int             // Server返回的所有Agent中拥有每个Piece的个数
+	swarmChan         chan []int
+	swarmSeedsChan    chan []string   // Server返回的已完成并继续上传的Agent
+	swarmBadPeers     map[string]bool // Server返回的其它Agent上报的坏Peer
+	swarmBadChan      chan []string
+	assigned          *Bitset    // 复制模式下Server分配给本节点的Piece，其它任务为nil
+	assignChan        chan []int // Server新分配的Piece
+	priorities        []int      // 每个Piece的下载优先级，没有设置文件优先级时为nil
+
+	// 校验失败的Piece
+	pieceFailures map[int]int          // 每个Piece校验失败的次数
+	unrecoverable map[int]bool         // 超过重试次数，不再下载的Piece
+	badPeers      map[string]int       // 每个Peer发送的坏Piece个数，达到Control.BadPeerPieces后不再连接
+	badPeerAt     map[string]time.Time // 每个Peer最近一次发送坏Piece的时间，BAD_PEER_COOLDOWN之后重新计数
+	repairPieces  map[int]bool         // 校验时发现损坏，重新下载的Piece
+	verifyChan    chan *verifyQuery
+
+	// 请求失败的Piece，退避结束前不再请求
+	pieceRetryAt   map[int]time.Time
+	pieceTimeouts  map[int]int // 每个Piece请求超时的次数
+	nextPieceRetry time.Time
+	retryPieceChan <-chan time.Time
+
+	// 上传Peer的选择
+	rechokeRound int    // 已重新选择的轮数
+	optimistic   string // 乐观上传的Peer地址
+
+	pressurePaused bool // 主机资源压力过高，暂停了块的传输
+	adminPaused    bool // 管理员暂停了任务的块传输，恢复前保留已下载的Piece与Peer连接
+
+	// 运行时调整的限制，只在Session的Goroutine中访问
+	limits     TaskLimits
+	limitsChan chan *TaskLimits
+
+	// 任务的速率限制
+	uploadLimiter   *flowctrl.TokenBucket
+	downloadLimiter *flowctrl.TokenBucket
+	// 在任务间公平分配的总速率中，任务分到的速率
+	shareUpload   *flowctrl.TokenBucket
+	shareDownload *flowctrl.TokenBucket
+
+	// 没有Peer可以提供缺失的Piece时，从源站下载
+	webSeeder     *webSeeder
+	webSeedPieces map[int]bool // 正在从源站下载的Piece
+	webSeedChan   chan *webSeedPiece
 
 	// Peer信息
 	addPeerChan     chan *P2pConn
@@ -47,61 +112,182 @@ type P2pSession struct {
 
 	// 重新连接定时器
 	retryConnTimeChan <-chan time.Time
-	indexInChain      int
+	upstreams         []string // 按优先顺序排列的上游节点，最后一个为Server
+	upstreamIdx       int
 	connFailCount     int
 
 	//
-	quitChan     chan struct{}
+	quitChan     chan bool // 为true时删除未下载完成的文件
+	leaveChan    chan struct{}
 	endedChan    chan struct{}
 	stopSessChan chan string // sessionmgnt
 
+	// 任务在本节点的Span，Server下发的追踪上下文为其父Span
+	span common.Span
+
 	//
 	reportor   *reportor
 	reportStep int
+	lastErr    string // 任务失败的原因
+	lastCode   string // 任务失败的错误码，如NO_SPACE
+	handedOff  bool   // 升级重启时退出未上报，交接给新进程
+	hookChan   chan error
+
+	// 下载完成的文件的校验，不写入磁盘的任务为nil
+	fileChecks    *fileChecks
+	fileCheckChan chan *FileCheck
+
+	// 数据写入命令的任务
+	pipeBuf      *pipeBuffer
+	pipeChan     chan error
+	pipeFinished bool // 命令已退出
 
 	//
-	initedAt   time.Time
-	startAt    time.Time
-	finishedAt time.Time
+	createdAt   time.Time
+	initedAt    time.Time
+	startAt     time.Time
+	finishedAt  time.Time
+	completedAt time.Time // 上报完成的时间
+
+	// 传输报告的统计
+	connRetries     int
+	requestTimeouts int
+	slowAbandons    int  // 放弃慢速Peer的次数
+	reportSaved     bool // 已生成传输报告
+
+	finalized bool // 暂存的文件已放到下载目录
+
+	bundles  *bundleFileSystem  // 小文件打包传输时写入的bundle，没有时为nil
+	partials *partialFileSystem // 下载中的文件写入临时路径，校验后改名，没有配置时为nil
 }
 
 func NewP2pSession(g *global, dt *DispatchTask, stopSessChan chan string) (s *P2pSession, err error) {
+	span := common.StartRemoteSpan(dt.TraceParent, "p2p.session", "task.id", dt.TaskId, "node.ip", g.cfg.Net.IP,
+		"node.server", g.cfg.Server, "task.seed", dt.Seed)
 	s = &P2pSession{
-		g:      g,
-		taskId: dt.TaskId,
-		task:   dt,
-
-		activePieces: make(map[int]*ActivePiece),
-		peers:        make(map[string]*peer),
+		g:         g,
+		taskId:    dt.TaskId,
+		createdAt: time.Now(),
+		log:       g.log.With("taskID", dt.TaskId),
+		task:      dt,
+
+		activePieces:  make(map[int]*ActivePiece),
+		pieceFailures: make(map[int]int),
+		unrecoverable: make(map[int]bool),
+		badPeers:      make(map[string]int),
+		badPeerAt:     make(map[string]time.Time),
+		repairPieces:  make(map[int]bool),
+		verifyChan:    make(chan *verifyQuery),
+		pieceRetryAt:  make(map[int]time.Time),
+		pieceTimeouts: make(map[int]int),
+		webSeedPieces: make(map[int]bool),
+		webSeedChan:   make(chan *webSeedPiece, MAX_WEBSEED_PIECES),
+		peerProgress:  make(map[string]*PeerProgress),
+		progressChan:  make(chan chan *TaskProgress),
+		limitsChan:    make(chan *TaskLimits),
+		swarmChan:     make(chan []int, 1),
+		peers:         make(map[string]*peer),
+		stream:        newPieceStream(),
+
+		swarmSeedsChan: make(chan []string, 1),
+		swarmBadChan:   make(chan []string, 1),
+		assignChan:     make(chan []int, 4),
 
 		addPeerChan:     make(chan *P2pConn, 5), // 不要阻塞
 		startChan:       make(chan *StartTask),
 		peerMessageChan: make(chan peerMessage, 5),
 
-		quitChan:  make(chan struct{}),
+		quitChan:  make(chan bool),
+		leaveChan: make(chan struct{}),
 		endedChan: make(chan struct{}),
 
-		stopSessChan: stopSessChan,
-		reportor:     NewReportor(dt.TaskId, g.cfg),
+		uploadLimiter:   flowctrl.NewTokenBucket(dt.Speed),
+		downloadLimiter: flowctrl.NewTokenBucket(0),
+
+		stopSessChan:  stopSessChan,
+		hookChan:      make(chan error, 1),
+		fileCheckChan: make(chan *FileCheck, FILE_CHECK_WORKERS),
+		pipeChan:      make(chan error, 1),
+		span:          span,
+		reportor:      NewReportor(dt.TaskId, g.cfg, g.log.With("taskID", dt.TaskId), g.metrics, span),
 	}
+	s.reportor.OnAvailability = s.setSwarmAvailability
+	s.reportor.OnSeeds = s.setSwarmSeeds
+	s.reportor.OnBadPeers = s.setSwarmBadPeers
+	s.reportor.OnAssign = s.setAssignedPieces
+	if dt.MetaInfo == nil {
+		span.End()
+		return nil, errors.New("Task has no metainfo")
+	}
+	s.infoHash = dt.MetaInfo.InfoHash()
+	s.metaData, err = EncodeMeta(dt.MetaInfo)
 	return
 }
 
 func (s *P2pSession) init() error {
-	log.Infof("[%s] Initing p2p session...", s.taskId)
-	fileSystem, err := s.g.fsProvider.NewFS()
+	s.log.Infof("Initing p2p session...")
+	var fileSystem FileSystem
+	var err error
+	if s.inMemory() {
+		var mt *memTask
+		if mt, err = s.g.memStore.reserve(s.taskId, s.task.MetaInfo); err == nil {
+			fileSystem = &memFileSystem{task: mt}
+		}
+	} else if s.piped() {
+		s.pipeBuf = newPipeBuffer(s.task.MetaInfo.PieceLen)
+		fileSystem = newPipeFileSystem(s.pipeBuf, s.task.MetaInfo)
+	} else {
+		fileSystem, err = s.g.fsProvider.NewFS()
+	}
 	if err != nil {
 		return err
 	}
+	if s.partialNamed() {
+		s.partials = s.newPartialFileSystem(fileSystem)
+		fileSystem = s.partials
+	}
+	if !s.seeding() && !s.noDisk() {
+		// 连续的小文件写入bundle，下载完成后再解包
+		if s.bundles = newBundleFileSystem(fileSystem, s.task.MetaInfo, s.dataDir(), s.infoHash, s.log); s.bundles != nil {
+			fileSystem = s.bundles
+		}
+	}
 
 	// 初始化存储
 	m := s.task.MetaInfo
-	s.fileStore, s.totalSize, err = NewFileStore(m, fileSystem)
+	s.fileStore, s.totalSize, err = NewFileStore(m, fileSystem, s.log)
 	if err != nil {
 		return err
 	}
 
-	s.totalPieces, s.lastPieceLength = countPieces(s.totalSize, m.PieceLen)
+	if wb, ok := s.fileStore.(writeBuffered); ok && !s.seeding() && !s.noDisk() && s.g.cfg.Control.WriteBuffer > 0 {
+		wb.SetWriteBuffer(int64(s.g.cfg.Control.WriteBuffer) * 1024 * 1024)
+	}
+	if ds, ok := s.fileStore.(diskScheduled); ok && s.g.disk != nil {
+		ds.SetDiskWorkers(s.g.disk)
+	}
+
+	s.readStore = s.fileStore
+	s.stream.setStore(s.fileStore, s.totalSize)
+	if s.g.cfg.Control.VerifyReads {
+		if s.readStore, err = NewVerifyingReadFileStore(s.fileStore, m, s.totalSize, s.log); err != nil {
+			return err
+		}
+	}
+	if s.seeding() && s.g.pieceCache.enabled() {
+		// 源头节点的数据不再变化，校验后的Piece可以一直缓存
+		s.readStore = newPieceCacheStore(s.readStore, s.g.pieceCache, s.taskId, m.PieceLen, s.totalSize)
+	}
+
+	if len(m.EncryptKey) > 0 {
+		if s.sealer, err = newPieceSealer(m.EncryptKey); err != nil {
+			return err
+		}
+	}
+
+	// 最后一个Piece补0时，按完整的Piece传输，超出文件末尾的0在写入时被丢弃
+	s.totalPieces, s.lastPieceLength = countPieces(m.pieceDataLength(s.totalSize), m.PieceLen)
+	s.availability = make(pieceAvailability, s.totalPieces)
 	return nil
 }
 
@@ -117,8 +303,55 @@ func (s *P2pSession) initInServer() error {
 		s.pieceSet.Set(index)
 	}
 
-	log.Infof("[%s] Inited p2p server session", s.taskId)
+	s.log.Infof("Inited p2p server session")
+	s.initedAt = time.Now()
+	return nil
+}
+
+// 种子节点使用元数据中的路径，文件长度不一致时不打开，避免修改已有的文件
+func (s *P2pSession) initInSeed() error {
+	for _, fd := range s.task.MetaInfo.Files {
+		if fd.Link != "" || fd.Same != "" {
+			continue
+		}
+		name := localPath(fd.Path, fd.Name)
+		st, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if (fd.Partial && st.Size() < fd.Offset+fd.Length) || (!fd.Partial && st.Size() != fd.Length) {
+			return fmt.Errorf("Seed file %s has unexpected length %v", name, st.Size())
+		}
+	}
+
+	if err := s.init(); err != nil {
+		return err
+	}
+
+	var err error
+	start := time.Now()
+	if s.task.TrustSeed && s.trustSeedFiles() {
+		s.goodPieces = s.totalPieces
+		s.pieceSet = NewBitset(s.totalPieces)
+		for index := 0; index < s.totalPieces; index++ {
+			s.pieceSet.Set(index)
+		}
+	} else {
+		s.goodPieces, _, s.pieceSet, err = checkPieces(s.fileStore, s.totalSize, s.task.MetaInfo,
+			int64(s.g.cfg.Control.VerifyMemory)*1024*1024)
+	}
+	s.checkPieceTime += time.Now().Sub(start).Seconds()
+	if err != nil {
+		return err
+	}
+	if s.goodPieces != s.totalPieces {
+		return fmt.Errorf("Seed files are incomplete, good=%v, total=%v", s.goodPieces, s.totalPieces)
+	}
+
+	s.log.Infof("Inited p2p seed session (%.2f seconds)", s.checkPieceTime)
+	// 不需要Server启动，一直上传到任务结束
 	s.initedAt = time.Now()
+	s.startAt = s.initedAt
 	return nil
 }
 
@@ -126,22 +359,104 @@ func (s *P2pSession) initInClient() error {
 	// 客户端与服务端的下载路径不同，修改路径
 	exsited := false
 	for idx, _ := range s.task.MetaInfo.Files {
-		s.task.MetaInfo.Files[idx].Path = s.g.cfg.DownDir
-		exsited = gokits.FileExist(filepath.Join(s.g.cfg.DownDir, s.task.MetaInfo.Files[idx].Name))
+		fd := s.task.MetaInfo.Files[idx]
+		if err := checkFileName(fd.Name); err != nil {
+			return err
+		}
+		if fd.Link != "" {
+			if err := checkLinkTarget(fd.Name, fd.Link); err != nil {
+				return err
+			}
+		}
+		if fd.Same != "" {
+			if err := checkSameFile(s.task.MetaInfo, idx); err != nil {
+				return err
+			}
+		}
+		if !s.noDisk() {
+			if err := s.checkInsideDirs(fd.Name); err != nil {
+				return err
+			}
+		}
+		s.task.MetaInfo.Files[idx].Path = s.dataDir()
+		if fd.Link == "" && fd.Same == "" && !s.noDisk() {
+			exsited = gokits.FileExist(localPath(s.dataDir(), fd.Name)) || s.partialNamed() && gokits.FileExist(s.partialPath(fd.Name))
+		}
+	}
+	if s.contentStored() && s.adoptContent() > 0 {
+		exsited = true
 	}
 
 	if err := s.init(); err != nil {
 		return err
 	}
+	if s.bundles != nil && s.bundles.existed {
+		exsited = true
+	}
+	if !s.piped() {
+		// 写入命令的任务按顺序写入，不使用文件优先级
+		s.priorities = piecePriorities(s.task.MetaInfo, s.task.FilePriorities, s.totalPieces)
+	}
+
+	// 不写入磁盘的任务不保存元数据与断点续传信息
+	var saved, journaled *Bitset
+	if !s.noDisk() {
+		if err := saveTaskMeta(s.g.cfg.DownDir, s.taskId, s.task.MetaInfo); err != nil {
+			s.log.Errorf("Save metainfo failed, error=%v", err)
+		}
+		s.resume = newResumeFile(s.g.cfg.DownDir, s.taskId, s.task.MetaInfo, s.log)
+		saved = s.resume.load(s.totalPieces)
+		s.journal = newPieceJournal(s.g.cfg.DownDir, s.taskId, s.task.MetaInfo, s.totalPieces, s.log)
+		journaled = s.journal.load()
+	}
 
 	//计算已经下载的块信息
-	if exsited {
+	if exsited && saved != nil && journaled != nil {
+		// 位图中不在日志里的Piece已写入磁盘，只校验日志中的Piece
+		start := time.Now()
+		s.pieceSet = NewBitset(s.totalPieces)
+		s.goodPieces = 0
+		for i := saved.FindNextSet(0); i >= 0 && i < s.totalPieces; i = saved.FindNextSet(i + 1) {
+			if !journaled.IsSet(i) {
+				s.pieceSet.Set(i)
+				s.goodPieces++
+			}
+		}
+		for i := journaled.FindNextSet(0); i >= 0 && i < s.totalPieces; i = journaled.FindNextSet(i + 1) {
+			ok, _, data := checkPiece(s.fileStore, s.totalSize, s.task.MetaInfo, i, s.g.buffers)
+			s.g.buffers.put(data)
+			if ok {
+				s.pieceSet.Set(i)
+				s.goodPieces++
+			}
+		}
+		s.checkPieceTime += time.Now().Sub(start).Seconds()
+		s.log.Infof("Resumed pieces: total(%v), saved(%v), journaled(%v), good(%v) (%.2f seconds)",
+			s.totalPieces, saved.Count(), journaled.Count(), s.goodPieces, s.checkPieceTime)
+	} else if exsited && saved != nil {
+		// 只校验上次保存的Piece
+		start := time.Now()
+		s.pieceSet = NewBitset(s.totalPieces)
+		s.goodPieces = 0
+		for i := saved.FindNextSet(0); i >= 0 && i < s.totalPieces; i = saved.FindNextSet(i + 1) {
+			ok, _, data := checkPiece(s.fileStore, s.totalSize, s.task.MetaInfo, i, s.g.buffers)
+			s.g.buffers.put(data)
+			if ok {
+				s.pieceSet.Set(i)
+				s.goodPieces++
+			}
+		}
+		s.checkPieceTime += time.Now().Sub(start).Seconds()
+		s.log.Infof("Resumed pieces: total(%v), saved(%v), good(%v) (%.2f seconds)",
+			s.totalPieces, saved.Count(), s.goodPieces, s.checkPieceTime)
+	} else if exsited {
 		var err error
 		start := time.Now()
-		s.goodPieces, _, s.pieceSet, err = checkPieces(s.fileStore, s.totalSize, s.task.MetaInfo)
+		s.goodPieces, _, s.pieceSet, err = checkPieces(s.fileStore, s.totalSize, s.task.MetaInfo,
+			int64(s.g.cfg.Control.VerifyMemory)*1024*1024)
 		end := time.Now()
 		s.checkPieceTime += end.Sub(start).Seconds()
-		log.Infof("[%s] Computed missing pieces: total(%v), good(%v) (%.2f seconds)", s.taskId,
+		s.log.Infof("Computed missing pieces: total(%v), good(%v) (%.2f seconds)",
 			s.totalPieces, s.goodPieces, s.checkPieceTime)
 		if err != nil {
 			return err
@@ -151,7 +466,28 @@ func (s *P2pSession) initInClient() error {
 		s.goodPieces = 0
 	}
 
-	log.Infof("[%s] Inited p2p client session", s.taskId)
+	if s.task.Replicate {
+		// 开始时没有分配，上报后由Server分配副本数不足的Piece
+		s.assigned = NewBitset(s.totalPieces)
+	}
+
+	if s.task.PreviousPath != "" && s.goodPieces != s.totalPieces {
+		s.copyFromPrevious(s.task.PreviousPath)
+	}
+
+	// 保存校验后的位图，之后写入的Piece记录到新的日志中
+	s.checkpoint()
+
+	if !s.noDisk() {
+		s.fileChecks = newFileChecks(s.task.MetaInfo)
+		s.checkFiles(-1)
+	}
+
+	if len(s.task.MetaInfo.WebSeeds) > 0 {
+		s.webSeeder = newWebSeeder(s.task.MetaInfo, s.log, s.downloadLimiter, s.shareDownload, s.g.downloadLimiter)
+	}
+
+	s.log.Infof("Inited p2p client session")
 	s.initedAt = time.Now()
 	return nil
 }
@@ -161,7 +497,7 @@ func (s *P2pSession) initPeersBitset() {
 	for _, p := range s.peers {
 		if p.have.n != s.totalPieces {
 			if p.have.n != 0 {
-				log.Error("Expected p.have.n == 0")
+				s.log.Errorf("Expected p.have.n == 0")
 				panic("Expected p.have.n == 0")
 			}
 			p.have = NewBitset(s.totalPieces)
@@ -174,106 +510,178 @@ func (s *P2pSession) Start(st *StartTask) {
 }
 
 func (s *P2pSession) startImp(st *StartTask) {
-	if s.g.cfg.Server {
+	if s.seeding() {
 		s.startAt = time.Now()
 		return
 	}
 
 	if s.totalPieces == s.goodPieces {
 		// 本地文件的Piece与Block都下载完成，不再需要下载
-		log.Infof("[%s] All piece has already download.", s.taskId)
-		go s.reportStatus(float32(100))
+		s.log.Infof("All piece has already download.")
+		if err := s.flushFiles(); err != nil {
+			s.reportFailed(common.ErrorCode(err), err.Error())
+			return
+		}
+		if err := s.unpackBundles(); err != nil {
+			s.reportFailed(common.ErrorCode(err), err.Error())
+			return
+		}
+		s.restoreAttrs()
+		if err := s.commitPartials(); err != nil {
+			s.reportFailed(common.ErrorCode(err), err.Error())
+			return
+		}
+		if err := s.finalizeFiles(); err != nil {
+			s.reportFailed(common.ErrorCode(err), err.Error())
+			return
+		}
+		s.reportCompleted()
 		return
 	}
 
-	log.Infof("[%s] Starting p2p session...", s.taskId)
+	s.log.Infof("Starting p2p session...")
 	// 更新路径
 	s.task.LinkChain = st.LinkChain
 
-	// 找到分发路径中位置
-	net := s.g.cfg.Net
-	self := fmt.Sprintf("%s:%v", net.IP, net.DataPort)
+	// 找到分发路径中位置，确定依次连接的上游节点
 	addrs := s.task.LinkChain.DispatchAddrs
 	count := len(addrs)
+	pos := 0
 	for idx := count - 1; idx > 0; idx-- {
-		if self == addrs[idx] {
-			s.indexInChain = idx - 1
+		if s.g.isSelf(addrs[idx]) {
+			pos = idx
 			break
 		}
 	}
+	s.upstreams, s.upstreamIdx = s.task.LinkChain.upstreams(pos), 0
 
 	// 尝试与上一个节点建立连接
 	s.tryNewPeer()
 	s.initPeersBitset()
 	s.startAt = time.Now()
-	log.Infof("[%s] Started p2p client session", s.taskId)
+	s.log.Infof("Started p2p client session")
 }
 
 // 寻找可用的地址并连接
 func (s *P2pSession) tryNewPeer() {
-	addrs := s.task.LinkChain.DispatchAddrs
-	if s.connFailCount >= MAX_RETRY_CONNECT_TIMES {
-		s.indexInChain--
+	if s.connFailCount >= s.g.retry.attempts {
+		s.nextUpstream()
 	}
-	if s.indexInChain < 0 {
-		s.indexInChain = 0
+	// 跳过发送过坏Piece或被其它Agent上报的Peer，但总是可以连接Server
+	for s.upstreamIdx < len(s.upstreams)-1 && (s.isBadPeer(s.upstreamAddr()) || s.swarmBadPeers[s.upstreamAddr()]) {
+		s.nextUpstream()
 	}
-	peer := addrs[s.indexInChain]
-	s.connectToPeer(peer)
+	s.connectToPeer(s.upstreamAddr())
+}
+
+// 服务端与种子节点已有完整的文件，只上传
+func (s *P2pSession) seeding() bool {
+	return s.g.cfg.Server || s.task.Seed
+}
+
+// 下载的数据只保存在内存中，不读写下载目录
+func (s *P2pSession) inMemory() bool {
+	return s.task.InMemory && !s.seeding()
+}
+
+// 数据不写入下载目录，也不保存断点续传信息
+func (s *P2pSession) noDisk() bool {
+	return s.inMemory() || s.piped()
 }
 
 // 连接其它的Peer
-func (s *P2pSession) connectToPeer(peer string) error {
-	log.Debugf("[%s] Try connect to peer[%s]", s.taskId, peer)
-	conn, err := net.DialTimeout("tcp", peer, 1*time.Second)
+func (s *P2pSession) connectToPeer(peer string) (err error) {
+	s.log.Debugf("Try connect to peer[%s]", peer)
+	span := common.StartSpan(s.span, "peer.handshake", "peer.address", peer)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	if conn, rsp, version, err := s.dialPooledPeer(peer); conn != nil && err == nil {
+		s.connFailCount = 0
+		span.SetAttributes("peer.pooled", true)
+		s.addPeerImp(s.dialedConn(conn, peer, rsp, version))
+		return nil
+	}
+
+	conn, err := s.dial(peer)
 	if err != nil {
-		log.Errorf("[%s] Failed to connect to peer[%s], error=%v", s.taskId, peer, err)
-		conn.Close()
-		s.connFailCount++
-		s.retryConnTimeChan = time.After(50 * time.Microsecond)
+		s.log.Errorf("Failed to connect to peer[%s], error=%v", peer, err)
+		s.retryConnect()
 		return err
 	}
 
 	// 发送消息头，用于认证
 	err = writeHeader(conn, s.taskId, s.g.cfg)
 	if err != nil {
-		log.Errorf("[%s] Failed to send header to peer[%s], error=%v", s.taskId, peer, err)
+		s.log.Errorf("Failed to send header to peer[%s], error=%v", peer, err)
 		conn.Close()
-		s.indexInChain-- //连接下一个
-		s.retryConnTimeChan = time.After(50 * time.Microsecond)
+		s.nextUpstream() //连接下一个
+		s.retryConnect()
 		return err
 	}
 
 	// 阻塞接收响应
-	bs := make([]byte, 1)
-	_, err = conn.Read(bs)
+	rsp, version, err := readConnRsp(conn)
 	if err != nil {
 		// 认证通过了，但没有返回正确的响应，Peer还没创建对应Task的Session
-		log.Errorf("[%s] Failed to reading header from peer[%s], error=%v", s.taskId, peer, err)
+		s.log.Errorf("Failed to reading header from peer[%s], error=%v", peer, err)
 		conn.Close()
-		s.retryConnTimeChan = time.After(50 * time.Microsecond)
+		s.retryConnect()
 		return err
 	}
 
 	s.connFailCount = 0
-	log.Infof("[%s] Success to connect to peer[%s]", s.taskId, peer)
-	p2pconn := &P2pConn{
+	s.log.Infof("Success to connect to peer[%s]", peer)
+	s.addPeerImp(s.dialedConn(conn, peer, rsp, version))
+	return nil
+}
+
+// 对端只能通过中继连接时经过中继
+func (s *P2pSession) dial(peer string) (net.Conn, error) {
+	if relay, ok := s.task.LinkChain.Relays[peer]; ok {
+		return dialRelay(s.g.cfg, relay, RELAY_OP_CONNECT, peer)
+	}
+	return dialPeer(s.g.cfg, s.log, peer, 1*time.Second)
+}
+
+// 连接响应中协商了压缩算法、是否复用连接与协议版本
+func (s *P2pSession) dialedConn(conn net.Conn, addr string, rsp byte, version int) *P2pConn {
+	return &P2pConn{
 		conn:       conn,
 		client:     false, // 对端是Server
 		remoteAddr: conn.RemoteAddr(),
 		taskId:     s.taskId,
+		codec:      codecFromRsp(rsp | CONN_RSP_POOL_BIT | CONN_RSP_VERSION_BIT),
+		pooled:     s.g.connPool.enabled() && rsp&CONN_RSP_POOL_BIT == 0,
+		dialAddr:   addr,
+		version:    version,
 	}
-
-	s.addPeerImp(p2pconn)
-	return nil
 }
 
 // 接入其它的Peer连接
 func (s *P2pSession) AcceptNewPeer(c *P2pConn) {
-	// 先回一个连接响应
-	_, err := c.conn.Write([]byte{byte(0xFF)})
+	if s.piped() {
+		// 写入命令后的数据不再保存，不给其它节点上传
+		s.log.Warnf("Reject peer[%s], task data is written to pipe", c.remoteAddr.String())
+		c.conn.Close()
+		return
+	}
+	// 先回一个连接响应，同时协商压缩算法
+	var rsp byte
+	c.codec, rsp = chooseCodec(c.codecs, s.task.MetaInfo)
+	if c.pool && s.g.connPool.enabled() {
+		c.pooled = true
+		rsp &^= CONN_RSP_POOL_BIT
+	}
+	// 发起端发送了版本时返回本节点的版本
+	msg := []byte{rsp}
+	if c.version > 1 {
+		msg = []byte{rsp &^ CONN_RSP_VERSION_BIT, PROTOCOL_VERSION}
+	}
+	_, err := c.conn.Write(msg)
 	if err != nil {
-		log.Errorf("[%s] Write connection init response to peer[%s] failed", s.taskId, c.remoteAddr.String())
+		s.log.Errorf("Write connection init response to peer[%s] failed", c.remoteAddr.String())
 		return
 	}
 	s.addPeerChan <- c
@@ -282,12 +690,31 @@ func (s *P2pSession) AcceptNewPeer(c *P2pConn) {
 // 处理连接到其它成功的Peer，或者是其它Peer的接入
 func (s *P2pSession) addPeerImp(c *P2pConn) {
 	peerAddr := c.remoteAddr.String()
-	log.Infof("[%s] Add new peer, peer[%s]", c.taskId, peerAddr)
+	old, ok := s.peers[peerAddr]
+	if !ok && c.client && s.connLimited() {
+		s.log.Warnf("Reject peer[%s], too many connections", peerAddr)
+		c.conn.Close()
+		return
+	}
+	if !ok && c.client && s.downstreamLimited() {
+		s.log.Warnf("Reject peer[%s], already serving %v downstreams", peerAddr, s.task.LinkChain.fanout())
+		c.conn.Close()
+		return
+	}
+	s.log.Infof("Add new peer, peer[%s]", peerAddr)
 	// 创建一个Peer对象
-	ps := NewPeer(c, s.task.Speed)
+	ps := NewPeer(c, s.log.With("peerID", peerAddr),
+		[]*flowctrl.TokenBucket{s.uploadLimiter, s.shareUpload, s.g.uploadLimiter},
+		[]*flowctrl.TokenBucket{s.downloadLimiter, s.shareDownload, s.g.downloadLimiter})
 
+	ps.buffers = s.g.buffers
 	// 位图
 	ps.have = NewBitset(s.totalPieces)
+	if !ok {
+		s.g.metrics.peerConnected(1)
+	} else {
+		s.availability.addBitset(old.have, -1)
+	}
 	s.peers[peerAddr] = ps
 
 	// 一个从连接上写消息，或读消息
@@ -298,6 +725,18 @@ func (s *P2pSession) addPeerImp(c *P2pConn) {
 	if s.pieceSet != nil {
 		ps.SendBitfield(s.pieceSet)
 	}
+	s.chokeNewPeer(ps)
+	s.sendPex(ps)
+}
+
+// 接入的连接是否达到任务或所有任务总的连接数限制。
+// 只限制其它Peer的接入，连接上游的Peer不受限制，否则任务可能无法下载
+func (s *P2pSession) connLimited() bool {
+	c := s.g.cfg.Control
+	if c.MaxTaskConns > 0 && len(s.peers) >= c.MaxTaskConns {
+		return true
+	}
+	return c.MaxConns > 0 && s.g.metrics.peerCount() >= c.MaxConns
 }
 
 // 关闭Peer
@@ -311,28 +750,37 @@ func (s *P2pSession) closePeerAndTryReconn(peer *peer) {
 // 关闭Peer
 func (s *P2pSession) ClosePeer(peer *peer) {
 	peer.Close()
+	s.removePeer(peer)
+}
+
+// 从Session中移除Peer，不关闭连接
+func (s *P2pSession) removePeer(peer *peer) {
 	s.removeRequests(peer)
+	if o, ok := s.peers[peer.address]; ok {
+		s.g.metrics.peerConnected(-1)
+		if o == peer {
+			s.availability.addBitset(peer.have, -1)
+		}
+	}
 	delete(s.peers, peer.address)
 }
 
 // 删除REQUEST信息
 func (s *P2pSession) removeRequests(p *peer) (err error) {
-	for k := range p.ourRequests {
+	for k, req := range p.ourRequests {
 		piece := int(k >> 32)
 		begin := int(k & 0xffffffff)
-		block := begin / STANDARD_BLOCK_LENGTH
-		log.Infof("[%s] Forgetting we requested block %v.%v", s.taskId, piece, block)
-		s.removeRequest(piece, block)
+		s.log.Infof("Forgetting we requested block %v.%v", piece, begin/MIN_BLOCK_LENGTH)
+		s.removeRequest(piece, begin, req.length)
 	}
-	p.ourRequests = make(map[uint64]time.Time, MAX_OUR_REQUESTS)
+	p.ourRequests = make(map[uint64]*blockRequest)
 	return
 }
 
 // 删除REQUEST信息
-func (s *P2pSession) removeRequest(piece, block int) {
-	v, ok := s.activePieces[piece]
-	if ok && v.downloaderCount[block] > 0 {
-		v.downloaderCount[block]--
+func (s *P2pSession) removeRequest(piece, begin, length int) {
+	if v, ok := s.activePieces[piece]; ok {
+		v.unrequestBlock(blockUnitsOf(begin, length))
 	}
 }
 
@@ -352,10 +800,22 @@ func (s *P2pSession) DoMessage(p *peer, message []byte) (err error) {
 
 func (s *P2pSession) generalMessage(message []byte, p *peer) (err error) {
 	messageID := message[0]
+	if s.sealer != nil {
+		// 加密的任务只接受加密的块数据，防止被降级为明文传输
+		switch messageID {
+		case PIECE, PIECE_GZIP, PIECE_ZSTD:
+			return errors.New("Recv plaintext block on encrypted task")
+		case PIECE_SEALED:
+			if message, err = openPiece(s.sealer, message); err != nil {
+				return err
+			}
+			messageID = message[0]
+		}
+	}
 
 	switch messageID {
 	case HAVE: // 处理Peer发送过来的HAVE消息
-		log.Tracef("[%s] Recv HAVE from peer[%s] ", p.taskId, p.address)
+		p.log.Debugf("Recv HAVE from peer")
 		if len(message) != 5 {
 			return errors.New("Unexpected length")
 		}
@@ -363,42 +823,71 @@ func (s *P2pSession) generalMessage(message []byte, p *peer) (err error) {
 		if n >= uint32(p.have.n) {
 			return errors.New("have index is out of range")
 		}
-		p.have.Set(int(n))
+		if !p.have.IsSet(int(n)) {
+			p.have.Set(int(n))
+			s.availability.add(int(n), 1)
+		}
 		if !p.client {
-			for i := 0; i < MAX_OUR_REQUESTS; i++ {
-				s.RequestBlock(p) // 向请此Peer上请求发送块
-			}
+			s.fillRequests(p) // 向请此Peer上请求发送块
 		}
 	case BITFIELD: // 处理Peer发送过来的BITFIELD消息
-		log.Tracef("[%s] Recv BITFIELD from peer[%s] isclient=%v", p.taskId, p.address, p.client)
-		p.have = NewBitsetFromBytes(s.totalPieces, message[1:])
-		if p.have == nil {
+		p.log.Debugf("Recv BITFIELD from peer isclient=%v", p.client)
+		have := NewBitsetFromBytes(s.totalPieces, message[1:])
+		if have == nil {
 			return errors.New("Invalid bitfield data")
 		}
+		s.availability.addBitset(p.have, -1)
+		s.availability.addBitset(have, 1)
+		p.have = have
 		if !p.client {
-			s.RequestBlock(p) // 向Server Peer请求发送块
+			s.fillRequests(p) // 向Server Peer请求发送块
 		}
 	case REQUEST: // 处理Peer发送过来的REQUEST消息
-		log.Tracef("[%s] Recv REQUEST from peer[%s] ", p.taskId, p.address)
+		p.log.Debugf("Recv REQUEST from peer")
 		index, begin, length, err := s.decodeRequest(message, p)
+		if err == errPieceRepairing {
+			p.log.Debugf("Ignore REQUEST of repairing piece from peer")
+			return nil
+		}
 		if err != nil {
 			return err
 		}
+		if p.choked {
+			// 对端收到CHOKE之前发送的请求，直接丢弃
+			p.log.Debugf("Ignore REQUEST from choked peer")
+			return nil
+		}
 		return s.sendPiece(p, index, begin, length)
+	case CHOKE: // 对端暂停上传，取消已发送的请求，由其它Peer下载
+		p.log.Debugf("Recv CHOKE from peer")
+		p.peerChoking = true
+		s.removeRequests(p)
+	case UNCHOKE:
+		p.log.Debugf("Recv UNCHOKE from peer")
+		p.peerChoking = false
+		if !p.client {
+			s.fillRequests(p)
+		}
+	case PIECE_GZIP, PIECE_ZSTD: // 解压后按PIECE消息处理
+		if message, err = decompressPiece(message); err != nil {
+			return err
+		}
+		fallthrough
 	case PIECE: // 处理Peer发送过来的PIECE消息
-		log.Tracef("[%s] Recv PIECE from peer[%s]", p.taskId, p.address)
+		p.log.Debugf("Recv PIECE from peer")
 		index, begin, length, err := s.decodePiece(message, p)
 		if err != nil {
 			return err
 		}
 
 		if s.pieceSet.IsSet(int(index)) {
-			log.Debugf("[%s] Recv PIECE from peer[%s] is already", p.taskId, p.address)
-			err = s.RequestBlock(p)
+			p.log.Debugf("Recv PIECE from peer is already")
+			err = s.fillRequests(p)
 			break //  本Peer已存在此Piece，则继续
 		}
 
 		globalOffset := int64(index)*s.task.MetaInfo.PieceLen + int64(begin)
+		s.journal.record(int(index))
 		_, err = s.fileStore.WriteAt(message[9:], globalOffset)
 		if err != nil {
 			return err
@@ -406,8 +895,21 @@ func (s *P2pSession) generalMessage(message []byte, p *peer) (err error) {
 
 		// 存储块的信息
 		s.RecordBlock(p, index, begin, uint32(length))
-		err = s.RequestBlock(p) // 继续向此Peer请求发送块信息
+		err = s.fillRequests(p) // 继续向此Peer请求发送块信息
+	case RELEASE: // 对端的任务已结束，回复后连接用于下一个任务
+		if !p.pooled {
+			return errors.New("Recv RELEASE on connection not pooled")
+		}
+		s.releasePeer(p)
+	case PEX: // 对端已知的上游节点
+		p.log.Debugf("Recv PEX from peer")
+		return s.recvPex(message)
 	default:
+		// 版本更高的对端不应发送本节点不支持的消息，忽略而不断开连接
+		if p.peerVersion > PROTOCOL_VERSION {
+			p.log.Debugf("Ignore unknown message id %d from peer of protocol version %d", messageID, p.peerVersion)
+			break
+		}
 		return fmt.Errorf("Uknown message id: %d\n", messageID)
 	}
 
@@ -427,7 +929,11 @@ func (s *P2pSession) decodeRequest(message []byte, p *peer) (index, begin, lengt
 		return
 	}
 	if !s.pieceSet.IsSet(int(index)) {
-		err = errors.New("we don't have that piece")
+		if s.repairPieces[int(index)] {
+			err = errPieceRepairing // 对端还不知道本节点的Piece已损坏
+		} else {
+			err = errors.New("we don't have that piece")
+		}
 		return
 	}
 	if int64(begin) >= s.task.MetaInfo.PieceLen {
@@ -443,38 +949,71 @@ func (s *P2pSession) decodeRequest(message []byte, p *peer) (index, begin, lengt
 
 // 给Peer发送块消息
 func (s *P2pSession) sendPiece(p *peer, index, begin, length uint32) (err error) {
-	log.Debugf("[%s] Sending block to peer[%s], index=%v, begin=%v, length=%v",
-		s.taskId, p.address, index, begin, length)
-	buf := make([]byte, length+9)
+	p.log.Debugf("Sending block to peer, index=%v, begin=%v, length=%v", index, begin, length)
+	off := int64(index)*s.task.MetaInfo.PieceLen + int64(begin)
+	if fs, ok := s.zeroCopy(p); ok {
+		if segs, e := fs.segments(off, int64(length)); e == nil {
+			header := make([]byte, 9)
+			header[0] = PIECE
+			uint32ToBytes(header[1:5], index)
+			uint32ToBytes(header[5:9], begin)
+			p.sendSegmentsMessage(header, segs)
+			s.peerUploaded(p.address, int(length))
+			return
+		}
+	}
+
+	buf := s.g.buffers.get(int(length) + 9)
 	buf[0] = PIECE
 	uint32ToBytes(buf[1:5], index)
 	uint32ToBytes(buf[5:9], begin)
-	_, err = s.fileStore.ReadAt(buf[9:],
-		int64(index)*s.task.MetaInfo.PieceLen+int64(begin))
+	_, err = s.readStore.ReadAt(buf[9:], off)
 	if err != nil {
-		log.Errorf("[%s] Read file failed, error=%v", s.taskId, err)
+		s.g.buffers.put(buf)
+		s.log.Errorf("Read file failed, error=%v", err)
 		return
 	}
-	p.sendMessage(buf)
+	// 压缩或加密生成新的消息时原缓冲立即放回，否则写入连接后放回
+	msg, copied := buf, false
+	if p.codec != "" {
+		if c := compressPiece(p.codec, msg); c != nil {
+			msg, copied = c, true
+		}
+	}
+	if s.sealer != nil {
+		msg, copied = sealPiece(s.sealer, msg), true
+	}
+	if copied {
+		s.g.buffers.put(buf)
+		p.sendMessage(msg)
+	} else {
+		p.sendPooledMessage(buf, s.g.buffers)
+	}
+	s.peerUploaded(p.address, int(length))
 
 	return
 }
 
 // 接收块消息
 func (s *P2pSession) RecordBlock(p *peer, piece, begin, length uint32) (err error) {
-	block := begin / STANDARD_BLOCK_LENGTH
-	log.Debugf("[%s] Received block from peer[%s] %v.%v", s.taskId, p.address, piece, block)
+	block, units := blockUnitsOf(int(begin), int(length))
+	p.log.Debugf("Received block from peer %v.%v", piece, block)
 
 	requestIndex := (uint64(piece) << 32) | uint64(begin)
+	if req, ok := p.ourRequests[requestIndex]; ok {
+		p.blockSize.received(time.Now().Sub(req.at))
+	}
 	delete(p.ourRequests, requestIndex)
+	p.timeouts = 0
 	v, ok := s.activePieces[int(piece)]
 	if !ok {
-		log.Debugf("[%s] Received a block we already have from peer[%s], piece=%v.%v", s.taskId, p.address, piece, block)
+		p.log.Debugf("Received a block we already have from peer, piece=%v.%v", piece, block)
 		return
 	}
 
-	v.recordBlock(int(block))
+	v.recordBlock(block, units)
 	s.downloaded += uint64(length)
+	s.peerDownloaded(p.address, int(length))
 	if !v.isComplete() {
 		return
 	}
@@ -483,34 +1022,89 @@ func (s *P2pSession) RecordBlock(p *peer, piece, begin, length uint32) (err erro
 	delete(s.activePieces, int(piece))
 	var pieceBytes []byte
 	start := time.Now()
-	ok, err, pieceBytes = checkPiece(s.fileStore, s.totalSize, s.task.MetaInfo, int(piece))
-	s.checkPieceTime += time.Now().Sub(start).Seconds()
+	ok, err, pieceBytes = checkPiece(s.fileStore, s.totalSize, s.task.MetaInfo, int(piece), s.g.buffers)
+	elapsed := time.Now().Sub(start)
+	s.checkPieceTime += elapsed.Seconds()
+	s.hashTime += elapsed.Seconds()
+	s.hashedBytes += int64(len(pieceBytes))
+	s.g.metrics.pieceHashed(len(pieceBytes), elapsed)
+	s.endPieceSpan(v, p.address, ok, err)
 	if !ok || err != nil {
-		log.Errorf("[%s] Closing peer[%s] that sent a bad piece=%v, error=%v", s.taskId, p.address, piece, err)
-		go s.reportStatus(float32(-1))
-		p.Close()
+		s.g.buffers.put(pieceBytes)
+		p.log.Errorf("Recv a bad piece=%v from peer, error=%v", piece, err)
+		s.pieceFailed(p, int(piece))
+		if s.isBadPeer(p.address) {
+			// 下次上报时通知Server，其它Agent不再优先连接该Peer
+			p.log.Errorf("Closing peer that sent %v bad pieces", s.badPeers[p.address])
+			p.Close()
+		}
 		return
 	}
 
+	s.commitPiece(piece, pieceBytes)
+	return
+}
+
+// 提交校验通过的Piece，并通知其它Peer。提交后pieceBytes放回缓冲池
+func (s *P2pSession) commitPiece(piece uint32, pieceBytes []byte) {
 	// 提交文件存储
 	s.fileStore.Commit(int(piece), pieceBytes, s.task.MetaInfo.PieceLen*int64(piece))
+	s.g.buffers.put(pieceBytes)
 	s.pieceSet.Set(int(piece))
 	s.goodPieces++
+	s.resumeDirty = true
+	delete(s.repairPieces, int(piece))
+	delete(s.pieceRetryAt, int(piece))
+	s.updateStream()
+	s.checkFiles(int(piece))
 
 	var percentComplete float32
 	if s.totalPieces > 0 {
 		percentComplete = float32(s.goodPieces*100) / float32(s.totalPieces)
 	}
-	log.Debugf("[%s] Have %v of %v pieces %v%% complete", s.taskId, s.goodPieces, s.totalPieces,
+	s.log.Debugf("Have %v of %v pieces %v%% complete", s.goodPieces, s.totalPieces,
 		percentComplete)
 	if s.goodPieces == s.totalPieces {
 		s.finishedAt = time.Now() // 下载完成
-		go s.reportStatus(percentComplete)
+		if !s.startAt.IsZero() {
+			s.g.metrics.transferred(s.finishedAt.Sub(s.startAt))
+		}
+		if s.hashTime > 0 {
+			s.log.Infof("Verified %s of downloaded pieces in %.2f seconds, %s/s by %s", humanSize(float64(s.hashedBytes)),
+				s.hashTime, humanSize(float64(s.hashedBytes)/s.hashTime), HashImpl(s.task.MetaInfo.Hash))
+		}
+		err := s.flushFiles()
+		if err == nil {
+			err = s.unpackBundles()
+		}
+		if err != nil {
+			s.lastErr, s.lastCode = err.Error(), common.ErrorCode(err) // 数据没有写入磁盘
+		} else {
+			s.restoreAttrs()
+			if err = s.commitPartials(); err != nil {
+				s.lastErr, s.lastCode = err.Error(), common.ErrorCode(err) // 没有改为元数据中的名字
+			} else if err = s.finalizeFiles(); err != nil {
+				s.lastErr, s.lastCode = err.Error(), common.ErrorCode(err) // 没有放到下载目录
+			}
+		}
+		s.saveResume()
+		s.notifyProgress()
+		if err != nil {
+			s.reportStatus(float32(-1))
+		} else {
+			s.reportCompleted()
+		}
+		if s.g.s3 != nil && s.g.cfg.S3.UploadTo != "" && !s.noDisk() {
+			go s.uploadToS3()
+		}
+	} else if s.replicaIdle() {
+		// 分配的Piece都已完成，立即上报以获得新的分配
+		s.reportStatus(percentComplete)
 	} else {
 		// 减少上报次数，减轻Server的压力
 		if int(percentComplete) > s.reportStep {
 			s.reportStep += 10
-			go s.reportStatus(percentComplete)
+			s.reportStatus(percentComplete)
 		}
 	}
 
@@ -522,8 +1116,90 @@ func (s *P2pSession) RecordBlock(p *peer, piece, begin, length uint32) (err erro
 			p.SendHave(piece)
 		}
 	}
+}
+
+// 没有Peer可以提供缺失的Piece时，从源站下载
+func (s *P2pSession) tryWebSeeds() {
+	if s.webSeeder == nil || s.startAt.IsZero() || s.adminPaused || s.goodPieces == s.totalPieces {
+		return
+	}
 
-	return
+	var candidates []int
+	for i := s.pieceSet.FindNextClear(0); i >= 0; i = s.pieceSet.FindNextClear(i + 1) {
+		if _, ok := s.activePieces[i]; ok || s.webSeedPieces[i] || s.unrecoverable[i] || !s.assignedPiece(i) {
+			continue
+		}
+		for _, p := range s.peers {
+			if !p.client && p.have != nil && p.have.IsSet(i) {
+				// 还有Peer可以提供数据
+				return
+			}
+		}
+		candidates = append(candidates, i)
+		if len(s.webSeedPieces)+len(candidates) >= MAX_WEBSEED_PIECES {
+			break
+		}
+	}
+
+	for _, i := range candidates {
+		s.webSeedPieces[i] = true
+		s.log.Debugf("Fetching piece %v from web seeds", i)
+		go func(index, length int) {
+			wp := s.webSeeder.fetchPiece(index, length)
+			select {
+			case s.webSeedChan <- wp:
+			case <-s.endedChan:
+			}
+		}(i, s.pieceLength(i))
+	}
+}
+
+// 处理从源站下载的Piece
+func (s *P2pSession) recordWebSeedPiece(wp *webSeedPiece) {
+	delete(s.webSeedPieces, wp.index)
+	if wp.err != nil || s.pieceSet.IsSet(wp.index) {
+		return
+	}
+	s.journal.record(wp.index)
+	if _, err := s.fileStore.WriteAt(wp.data, s.task.MetaInfo.PieceLen*int64(wp.index)); err != nil {
+		s.log.Errorf("Write piece %v from web seeds failed, error=%v", wp.index, err)
+		return
+	}
+	ok, err, pieceBytes := checkPiece(s.fileStore, s.totalSize, s.task.MetaInfo, wp.index, s.g.buffers)
+	if !ok || err != nil {
+		s.g.buffers.put(pieceBytes)
+		s.log.Errorf("Web seeds sent a bad piece=%v, error=%v", wp.index, err)
+		return
+	}
+	s.downloaded += uint64(len(wp.data))
+	s.peerDownloaded(webSeedAddress, len(wp.data))
+	s.commitPiece(uint32(wp.index), pieceBytes)
+}
+
+// 记录Piece校验失败，超过重试次数后不再下载该Piece，并上报失败
+func (s *P2pSession) pieceFailed(p *peer, piece int) {
+	s.g.metrics.pieceFailed()
+	s.pieceFailures[piece]++
+	s.peerStats(p.address).CorruptPieces++
+	attempts := s.pieceFailures[piece]
+	s.badPeers[p.address]++
+	s.badPeerAt[p.address] = time.Now()
+	s.delayPiece(piece, attempts)
+	if l := s.g.pieceFailedListener; l != nil {
+		l.OnPieceFailed(s.taskId, piece, attempts)
+	}
+
+	maxRetries := s.g.cfg.Control.MaxPieceRetries
+	if maxRetries <= 0 {
+		s.reportFailed(ERR_CHECKSUM_MISMATCH, fmt.Sprintf("Piece %v failed verification", piece))
+		return
+	}
+	if attempts >= maxRetries && !s.unrecoverable[piece] {
+		reason := fmt.Sprintf("Piece %v is unrecoverable after %v attempts", piece, attempts)
+		s.log.Errorf("%s", reason)
+		s.unrecoverable[piece] = true
+		s.reportFailed(ERR_PIECE_UNRECOVERABLE, reason)
+	}
 }
 
 func (s *P2pSession) decodePiece(message []byte, p *peer) (index, begin, length uint32, err error) {
@@ -556,33 +1232,13 @@ func (s *P2pSession) decodePiece(message []byte, p *peer) (index, begin, length
 }
 
 // 请求下载时，选择一个可用的Piece
-func (s *P2pSession) ChoosePiece(p *peer) (piece int) {
-	n := s.totalPieces
-	start := rand.Intn(n)
-	piece = s.checkRange(p, start, n)
-	if piece == -1 {
-		piece = s.checkRange(p, 0, start)
-	}
-	return
-}
-
-func (s *P2pSession) checkRange(p *peer, start, end int) (piece int) {
-	clampedEnd := min(end, min(p.have.n, s.pieceSet.n))
-	for i := start; i < clampedEnd; i++ {
-		// 本Peer没有，但其它Peer存在时
-		if (!s.pieceSet.IsSet(i)) && p.have.IsSet(i) {
-			if _, ok := s.activePieces[i]; !ok {
-				return i
-			}
-		}
-	}
-	return -1
-}
-
 // 构建请求块（本Peer缺失）信息
 func (s *P2pSession) RequestBlock(p *peer) (err error) {
+	if p.peerChoking || s.transfersPaused() {
+		return
+	}
 	for k := range s.activePieces {
-		if p.have.IsSet(k) {
+		if p.have.IsSet(k) && !s.pieceBackoff(k) {
 			err = s.requestBlock2(p, k, false)
 			if err != io.EOF {
 				return
@@ -594,7 +1250,7 @@ func (s *P2pSession) RequestBlock(p *peer) (err error) {
 	piece := s.ChoosePiece(p)
 	if piece < 0 {
 		for k := range s.activePieces {
-			if p.have.IsSet(k) {
+			if p.have.IsSet(k) && !s.pieceBackoff(k) {
 				err = s.requestBlock2(p, k, true)
 				if err != io.EOF {
 					return
@@ -608,16 +1264,38 @@ func (s *P2pSession) RequestBlock(p *peer) (err error) {
 		return
 	}
 
-	s.activePieces[piece] = NewActivePiece(s.pieceLength(piece))
+	v := NewActivePiece(s.pieceLength(piece))
+	v.span = common.StartSpan(s.span, "piece.transfer", "piece.index", piece, "piece.length", v.pieceLength)
+	s.activePieces[piece] = v
 	return s.requestBlock2(p, piece, false)
 
 }
 
+// 补充向Peer的请求，未完成的请求数保持为配置的窗口大小，高延迟的链路上也能持续传输。
+// 返回第一次请求的错误，与每次只请求一个块时一致
+func (s *P2pSession) fillRequests(p *peer) (err error) {
+	if s.avoidSlowPeer(p) {
+		return
+	}
+	for i := 0; len(p.ourRequests) < s.requestWindow(); i++ {
+		n := len(p.ourRequests)
+		e := s.RequestBlock(p)
+		if i == 0 {
+			err = e
+		}
+		if e != nil || len(p.ourRequests) == n {
+			// 没有可以请求的块
+			return
+		}
+	}
+	return
+}
+
 func (s *P2pSession) requestBlock2(p *peer, piece int, endGame bool) (err error) {
 	v := s.activePieces[piece]
-	block := v.chooseBlockToDownload(endGame)
+	block, units := v.chooseBlockToDownload(endGame, s.blockUnits(p))
 	if block >= 0 {
-		s.requestBlockImp(p, piece, block)
+		s.requestBlockImp(p, piece, block, units)
 	} else {
 		//log.Debugf("[%s] Request block from peer[%s], EOF", s.taskId, p.address)
 		return io.EOF
@@ -626,14 +1304,11 @@ func (s *P2pSession) requestBlock2(p *peer, piece int, endGame bool) (err error)
 }
 
 // Request a block
-func (s *P2pSession) requestBlockImp(p *peer, piece int, block int) {
-	begin := block * STANDARD_BLOCK_LENGTH
-	length := STANDARD_BLOCK_LENGTH
-	if piece == s.totalPieces-1 {
-		left := s.lastPieceLength - begin
-		if left < length {
-			length = left
-		}
+func (s *P2pSession) requestBlockImp(p *peer, piece int, block, units int) {
+	begin := block * MIN_BLOCK_LENGTH
+	length := units * MIN_BLOCK_LENGTH
+	if left := s.pieceLength(piece) - begin; left < length {
+		length = left
 	}
 
 	//log.Tracef("[%s] Requesting block from peer[%s], piece=%v.%v, length=%v", s.taskId, p.address, piece, block, length)
@@ -648,36 +1323,203 @@ func (s *P2pSession) pieceLength(piece int) int {
 	return s.lastPieceLength
 }
 
+// 本节点还缺失的Piece
+func (s *P2pSession) Missing() []int {
+	if s.pieceSet == nil {
+		return nil
+	}
+	missing := make([]int, 0, s.totalPieces-s.goodPieces)
+	for i := s.pieceSet.FindNextClear(0); i >= 0; i = s.pieceSet.FindNextClear(i + 1) {
+		missing = append(missing, i)
+	}
+	return missing
+}
+
+// 还需要下载的字节数，最后一个Piece按实际长度计算
+func (s *P2pSession) RemainingBytes() (remaining int64) {
+	for _, piece := range s.Missing() {
+		remaining += int64(s.pieceLength(piece))
+	}
+	return
+}
+
 func (s *P2pSession) Quit() (err error) {
+	return s.Cancel(false)
+}
+
+// 取消任务，clean为true时删除本节点未下载完成的文件
+func (s *P2pSession) Cancel(clean bool) (err error) {
 	select {
-	case s.quitChan <- struct{}{}:
+	case s.quitChan <- clean:
 	case <-s.endedChan: // 防quit阻塞
 	}
 	return
 }
 
+// 节点退出时调用：写入缓冲的数据，保存断点续传信息，通知Server本节点离开后关闭任务，
+// 等待上报完成后返回。重启后重新下发的任务从保存的位置继续下载
+func (s *P2pSession) Leave() {
+	select {
+	case s.leaveChan <- struct{}{}:
+	case <-s.endedChan:
+	}
+	<-s.endedChan
+	<-s.reportor.doneChan
+}
+
+func (s *P2pSession) leave() {
+	s.flushFiles()
+	if s.g.handoff && s.handoffable() {
+		s.handedOff = true
+	} else if !s.seeding() && s.goodPieces != s.totalPieces {
+		var percentComplete float32
+		if s.totalPieces > 0 {
+			percentComplete = float32(s.goodPieces*100) / float32(s.totalPieces)
+		}
+		s.reportor.DoLeave(s.task.LinkChain, percentComplete)
+	}
+	s.shutdown()
+}
+
 func (s *P2pSession) shutdown() (err error) {
 	for _, peer := range s.peers {
-		s.ClosePeer(peer)
+		if peer.pooled && !peer.client {
+			// 由发起连接的一端释放，连接留给后续的任务
+			s.releasePeer(peer)
+		} else {
+			s.ClosePeer(peer)
+		}
 	}
+	s.checkpoint()
+	s.journal.close()
 
-	if s.fileStore != nil {
+	// 已下载完成且还在读取时，由读取的连接关闭存储
+	closed := s.stream.close()
+	if closed && s.fileStore != nil {
 		err = s.fileStore.Close()
 		if err != nil {
-			log.Errorf("[%s] Error closing filestore : %v", s.taskId, err)
+			s.log.Errorf("Error closing filestore : %v", err)
 		}
 	}
+	if s.finalized && closed {
+		// 文件已放到下载目录，还在读取时保留暂存目录
+		s.removeStaging()
+	}
+	if s.bundles != nil && s.bundles.unpacked && closed {
+		s.bundles.remove()
+	}
 
+	if !s.g.cfg.Server && !s.reportSaved && s.totalPieces > 0 {
+		// 任务被取消或节点退出
+		s.saveTransferReport()
+	}
 	if s.reportor != nil {
 		s.reportor.Close()
 	}
 
+	if s.inMemory() {
+		s.g.memStore.taskEnded(s.taskId, s.goodPieces == s.totalPieces)
+	}
+	s.g.pieceCache.removeTask(s.taskId)
+	s.g.metrics.taskEnded(s.taskId)
+	s.g.fair.remove(s.taskId)
+	s.endSpan()
 	close(s.endedChan)
 	return
 }
 
+// 下载完成后把缓冲的数据写入磁盘，再上报状态
+func (s *P2pSession) flushFiles() (err error) {
+	if wb, ok := s.fileStore.(writeBuffered); ok {
+		if err = wb.Flush(); err != nil {
+			s.log.Errorf("Flush files failed, error=%v", err)
+		}
+	}
+	return
+}
+
+// 删除未下载完成的文件与断点续传信息，服务端与已下载完成的任务不删除
+func (s *P2pSession) removeFiles() {
+	if s.seeding() || s.noDisk() || s.totalPieces == s.goodPieces {
+		return
+	}
+	if s.staged() {
+		// 下载目录中的文件不属于该任务
+		s.removeStaging()
+	} else {
+		for _, fd := range s.task.MetaInfo.Files {
+			if fd.Partial {
+				// 只下载了文件中的一段，文件的其它部分不属于该任务
+				continue
+			}
+			file := localPath(s.downDir(), fd.Name)
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				s.log.Errorf("Remove file failed, file=%s, error=%v", file, err)
+			}
+		}
+		if s.bundles != nil {
+			s.bundles.remove()
+		}
+		if s.partials != nil {
+			s.partials.remove()
+		}
+	}
+	if s.resume != nil {
+		s.resume.remove()
+	}
+	s.journal.remove()
+	removeTaskMeta(s.g.cfg.DownDir, s.taskId, s.log)
+	s.log.Infof("Removed unfinished files")
+}
+
+// 调整任务的传输速率，单位为字节每秒，0表示不限制
+func (s *P2pSession) SetSpeed(upload, download int64) {
+	s.log.Infof("Set speed, upload=%v, download=%v", upload, download)
+	s.uploadLimiter.SetRate(upload)
+	s.downloadLimiter.SetRate(download)
+}
+
+// 保存已下载的Piece位图，下载完成后不再需要
+func (s *P2pSession) saveResume() (err error) {
+	if s.resume == nil || !s.resumeDirty {
+		return
+	}
+	s.resumeDirty = false
+	if s.goodPieces == s.totalPieces {
+		s.resume.remove()
+		s.journal.remove()
+		return
+	}
+	if err = s.resume.save(s.pieceSet); err != nil {
+		s.resumeDirty = true
+		s.log.Errorf("Save resume file failed, error=%v", err)
+	}
+	return
+}
+
+// 检查点：写缓冲写入磁盘后保存位图，日志中只保留正在下载的Piece
+func (s *P2pSession) checkpoint() {
+	if s.journal == nil {
+		return
+	}
+	if err := s.flushFiles(); err != nil {
+		return
+	}
+	s.resumeDirty = true
+	if err := s.saveResume(); err != nil || s.goodPieces == s.totalPieces {
+		return
+	}
+	active := make([]int, 0, len(s.activePieces))
+	for i := range s.activePieces {
+		active = append(active, i)
+	}
+	s.journal.reset(active)
+}
+
 // 初始化
 func (s *P2pSession) Init() {
+	s.g.metrics.taskStarted(s.taskId)
+	s.shareUpload, s.shareDownload = s.g.fair.add(s.taskId)
 	// 开启缓存
 	if s.fileStore != nil {
 		cache := s.g.cacher.NewCache(s.taskId, s.totalPieces, int(s.task.MetaInfo.PieceLen), s.totalSize)
@@ -686,18 +1528,38 @@ func (s *P2pSession) Init() {
 
 	if s.g.cfg.Server {
 		if err := s.initInServer(); err != nil {
-			log.Errorf("[%s] Init p2p server session failed, %v", s.taskId, err)
+			s.log.Errorf("Init p2p server session failed, %v", err)
+		}
+	} else if s.task.Seed {
+		if err := s.initInSeed(); err != nil {
+			// 不能作为源头，关闭后下游的节点重新连接
+			s.log.Errorf("Init p2p seed session failed, %v", err)
+			go func() { s.stopSessChan <- s.taskId }()
 		}
 	} else {
 		if err := s.initInClient(); err != nil {
-			log.Errorf("[%s] Init p2p client session failed, %v", s.taskId, err)
+			s.log.Errorf("Init p2p client session failed, %v", err)
+		} else {
+			if s.piped() {
+				s.startPipe()
+			}
+			if s.goodPieces < s.totalPieces {
+				// 加入时立即上报，尽早获得其它Agent的Piece副本数
+				s.reportStatus(float32(s.goodPieces*100) / float32(s.totalPieces))
+			}
 		}
 	}
+	s.updateStream()
 
 	keepAliveChan := time.Tick(60 * time.Second)
 	tickDuration := 2 * time.Second
 	tickChan := time.Tick(tickDuration)
+	rechokeChan := time.Tick(RECHOKE_INTERVAL)
 	lastDownloaded := s.downloaded
+	var ctxDone <-chan struct{}
+	if s.task.ctx != nil {
+		ctxDone = s.task.ctx.Done()
+	}
 
 	for {
 		select {
@@ -709,9 +1571,15 @@ func (s *P2pSession) Init() {
 			peer, message := pm.peer, pm.message
 			peer.lastReadTime = time.Now()
 			err2 := s.DoMessage(peer, message)
+			if isPieceMessage(message) {
+				s.g.buffers.put(message)
+			}
 			if err2 != nil {
 				if err2 != io.EOF {
-					log.Error("[", s.taskId, "] Closing peer[", peer.address, "] because ", err2)
+					peer.log.Errorf("Closing peer because %v", err2)
+					s.closePeerAndTryReconn(peer)
+				} else if s.isBadPeer(peer.address) || s.goodPieces != s.totalPieces {
+					// 上游的节点退出时重新连接，发送坏Piece的Peer换为连接链中的上一个节点
 					s.closePeerAndTryReconn(peer)
 				} else {
 					s.ClosePeer(peer)
@@ -721,21 +1589,92 @@ func (s *P2pSession) Init() {
 			if s.timeout() {
 				// Session超时没有启动，需要stop
 				s.stopSessChan <- s.taskId
-				log.Info("[", s.taskId, "] P2p session is timeout")
+				s.log.Infof("P2p session is timeout")
+			}
+			if s.expired() {
+				// Server可能已不可用，不等待取消，直接结束并删除未完成的文件
+				s.log.Errorf("P2p session is expired, ttl=%v", s.taskTtl())
+				if !s.seeding() {
+					s.reportFailed(ERR_TASK_EXPIRED, "TASK_EXPIRED")
+				}
+				s.shutdown()
+				s.removeFiles()
+				go func() { s.stopSessChan <- s.taskId }()
+				return
 			}
 			s.peersKeepAlive()
+			s.broadcastPex()
+			s.reportReplicaIdle()
 		case <-tickChan:
-			if !s.g.cfg.Server && s.totalPieces != s.goodPieces {
-				speed := humanSize(float64(s.downloaded-lastDownloaded) / tickDuration.Seconds())
+			if !s.seeding() && s.totalPieces != s.goodPieces && !s.replicaIdle() {
+				s.speed = int64(float64(s.downloaded-lastDownloaded) / tickDuration.Seconds())
+				speed := humanSize(float64(s.speed))
 				lastDownloaded = s.downloaded
-				log.Infof("[%s] downloaded: %d(%s/s), pieces: %d/%d, check pieces: (%.2f seconds)",
-					s.taskId, s.downloaded, speed, s.goodPieces, s.totalPieces, s.checkPieceTime)
+				s.notifyProgress()
+				s.checkDeadlines()
+				s.log.Infof("downloaded: %d(%s/s), remaining: %s of %s, pieces: %d/%d, check pieces: (%.2f seconds)",
+					s.downloaded, speed, humanSize(float64(s.RemainingBytes())), humanSize(float64(s.totalSize)),
+					s.goodPieces, s.totalPieces, s.checkPieceTime)
+				if s.fileChecks.dirty() {
+					// 尽早上报校验完成的文件
+					s.reportStatus(float32(s.goodPieces*100) / float32(s.totalPieces))
+				}
+			}
+			if s.journal.due() && s.goodPieces != s.totalPieces {
+				s.checkpoint()
+			} else {
+				s.saveResume()
+			}
+			s.checkPressure()
+			s.tryWebSeeds()
+			s.fillPipeWindow()
+		case <-rechokeChan:
+			s.rechoke()
+		case tl := <-s.limitsChan:
+			s.applyLimits(tl)
+		case a := <-s.swarmChan:
+			s.swarmAvailability = a
+		case seeds := <-s.swarmSeedsChan:
+			s.addSeedUpstreams(seeds)
+		case addrs := <-s.swarmBadChan:
+			s.updateSwarmBadPeers(addrs)
+		case pieces := <-s.assignChan:
+			s.assignPieces(pieces)
+		case <-ctxDone:
+			// 已下载完成时只关闭，不上报失败
+			ctxDone = nil
+			s.log.Infof("Task context done, stop p2p session, %v", s.task.ctx.Err())
+			if !s.seeding() && s.goodPieces != s.totalPieces {
+				s.reportFailed(common.ErrorCode(s.task.ctx.Err()), s.task.ctx.Err().Error())
 			}
+			go func() { s.stopSessChan <- s.taskId }()
+		case out := <-s.progressChan:
+			out <- s.progress()
+		case q := <-s.verifyChan:
+			vr, err := s.verifyImp(q.repair)
+			q.out <- &verifyOutput{result: vr, err: err}
+		case wp := <-s.webSeedChan:
+			s.recordWebSeedPiece(wp)
 		case <-s.retryConnTimeChan:
 			s.tryNewPeer()
-		case <-s.quitChan:
-			log.Info("[", s.taskId, "] Quit p2p session")
+		case <-s.retryPieceChan:
+			s.retryPieces()
+		case err := <-s.hookChan:
+			s.hooksDone(err)
+		case r := <-s.fileCheckChan:
+			s.fileChecked(r)
+		case err := <-s.pipeChan:
+			s.pipeDone(err)
+		case <-s.leaveChan:
+			s.log.Infof("Leave p2p session")
+			s.leave()
+			return
+		case clean := <-s.quitChan:
+			s.log.Infof("Quit p2p session")
 			s.shutdown()
+			if clean {
+				s.removeFiles()
+			}
 			return
 		}
 	}
@@ -744,11 +1683,16 @@ func (s *P2pSession) Init() {
 func (s *P2pSession) doCheckRequests(p *peer) (err error) {
 	now := time.Now()
 	for k, v := range p.ourRequests {
-		if now.Sub(v).Seconds() > 30 {
+		if now.Sub(v.at) > s.requestTimeout() {
 			piece := int(k >> 32)
-			block := int(k&0xffffffff) / STANDARD_BLOCK_LENGTH
-			log.Error("[", s.taskId, "] Timing out request of ", piece, ".", block)
-			s.removeRequest(piece, block)
+			begin := int(k & 0xffffffff)
+			p.log.Errorf("Timing out request of %v.%v", piece, begin/MIN_BLOCK_LENGTH)
+			delete(p.ourRequests, k)
+			s.removeRequest(piece, begin, v.length)
+			p.blockSize.timedOut()
+			if err == nil {
+				err = s.requestTimedOut(p, piece)
+			}
 		}
 	}
 	return
@@ -758,16 +1702,16 @@ func (s *P2pSession) peersKeepAlive() {
 	now := time.Now()
 	for _, peer := range s.peers {
 		if peer.lastReadTime.Second() != 0 && now.Sub(peer.lastReadTime) > 3*time.Minute {
-			log.Error("[", s.taskId, "] Closing peer [", peer.address, "] because timed out")
+			peer.log.Errorf("Closing peer because timed out")
 			s.ClosePeer(peer)
 			continue
 		}
 		err2 := s.doCheckRequests(peer)
 		if err2 != nil {
 			if err2 != io.EOF {
-				log.Error("[", s.taskId, "] Closing peer[", peer.address, "] because", err2)
+				peer.log.Errorf("Closing peer because %v", err2)
 			}
-			s.ClosePeer(peer)
+			s.closePeerAndTryReconn(peer)
 			continue
 		}
 		peer.keepAlive()
@@ -781,12 +1725,60 @@ func (s *P2pSession) timeout() bool {
 		return true
 	}
 
-	if !s.finishedAt.IsZero() && now.Sub(s.finishedAt) >= 3*time.Minute {
+	if !s.finishedAt.IsZero() && now.Sub(s.finishedAt) >= s.seedLinger() {
 		return true
 	}
 	return false
 }
 
+// 收到任务后的最长时间，任务与配置都指定时取较小的值，为0时不限制
+func (s *P2pSession) taskTtl() time.Duration {
+	ttl := s.task.Ttl
+	if c := s.g.cfg.Control.TaskTtl; c > 0 && (ttl == 0 || c < ttl) {
+		ttl = c
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// 超过ttl还没有下载完成，或作为种子节点还没有被Server停止
+func (s *P2pSession) expired() bool {
+	if s.g.cfg.Server || !s.finishedAt.IsZero() {
+		return false
+	}
+	ttl := s.taskTtl()
+	return ttl > 0 && time.Since(s.createdAt) >= ttl
+}
+
+// 下载完成后继续给其它节点上传的时间，任务没有指定时使用配置
+func (s *P2pSession) seedLinger() time.Duration {
+	if s.task.SeedLinger > 0 {
+		return time.Duration(s.task.SeedLinger) * time.Second
+	}
+	return time.Duration(s.g.cfg.Control.SeedLinger) * time.Second
+}
+
+// 在Session的Goroutine中调用，异步上报。完成或失败时生成传输报告
 func (s *P2pSession) reportStatus(pecent float32) {
-	s.reportor.DoReport(s.task.LinkChain.ServerAddr, pecent)
+	lc, speed, lastErr, lastCode := s.task.LinkChain, s.speed, s.lastErr, s.lastCode
+	var have []byte
+	if s.pieceSet != nil {
+		have = append([]byte(nil), s.pieceSet.Bytes()...)
+	}
+	var tr *TransferReport
+	if int(pecent) == 100 || int(pecent) == -1 {
+		if int(pecent) == 100 {
+			s.completedAt = time.Now()
+		}
+		if tr = s.saveTransferReport(); !s.task.PushReport {
+			tr = nil
+		}
+	}
+	files := s.fileChecks.report(int(pecent) == 100 || int(pecent) == -1)
+	go s.reportor.DoReport(lc, pecent, speed, lastErr, lastCode, have, tr, s.bannedPeers(), files)
+}
+
+// 记录失败的错误码与原因并上报
+func (s *P2pSession) reportFailed(code, reason string) {
+	s.lastErr, s.lastCode = reason, code
+	s.reportStatus(float32(-1))
 }
@@ -0,0 +1,146 @@
+package p2p
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+func testSession(pieceLen, totalSize int64) *P2pSession {
+	s := &P2pSession{task: &DispatchTask{MetaInfo: &MetaInfo{Length: totalSize, PieceLen: pieceLen}}}
+	s.totalSize = totalSize
+	s.totalPieces, s.lastPieceLength = countPieces(totalSize, pieceLen)
+	s.pieceSet = NewBitset(s.totalPieces)
+	return s
+}
+
+func TestRemainingBytes(t *testing.T) {
+	cases := []struct {
+		name      string
+		totalSize int64
+		have      []int
+		missing   []int
+		remaining int64
+	}{
+		{"nothing downloaded", 10, nil, []int{0, 1, 2}, 10},
+		{"short last piece missing", 10, []int{0, 1}, []int{2}, 2},
+		{"short last piece downloaded", 10, []int{2}, []int{0, 1}, 8},
+		{"full last piece", 12, []int{1}, []int{0, 2}, 8},
+		{"all downloaded", 10, []int{0, 1, 2}, []int{}, 0},
+		{"single short piece", 3, nil, []int{0}, 3},
+	}
+	for _, c := range cases {
+		s := testSession(4, c.totalSize)
+		for _, i := range c.have {
+			s.pieceSet.Set(i)
+			s.goodPieces++
+		}
+		if got := s.Missing(); !reflect.DeepEqual(got, c.missing) {
+			t.Errorf("%s: Missing()=%v, want %v", c.name, got, c.missing)
+		}
+		if got := s.RemainingBytes(); got != c.remaining {
+			t.Errorf("%s: RemainingBytes()=%v, want %v", c.name, got, c.remaining)
+		}
+	}
+}
+
+func TestRemainingBytesBeforeInit(t *testing.T) {
+	s := &P2pSession{}
+	if s.Missing() != nil || s.RemainingBytes() != 0 {
+		t.Fatal("session without piece set reports missing pieces")
+	}
+}
+
+type failedListener struct {
+	attempts []int
+}
+
+func (l *failedListener) OnPieceFailed(taskId string, index int, attempts int) {
+	l.attempts = append(l.attempts, attempts)
+}
+
+// 下载前的Session，已有的Piece在pieceSet中设置
+func testFailSession(t *testing.T, maxRetries int) (*P2pSession, *failedListener) {
+	src := filepath.Join(t.TempDir(), "a")
+	if err := ioutil.WriteFile(src, make([]byte, 40*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mi, err := CreateFileMeta([]string{src}, 16*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &common.Config{DownDir: t.TempDir(), Control: &common.Control{MaxActive: 1, MaxPieceRetries: maxRetries, BadPeerPieces: 2}}
+	sm := NewSessionMgnt(cfg, nil)
+	l := &failedListener{}
+	sm.SetPieceFailedListener(l)
+	s, err := NewP2pSession(sm.g, &DispatchTask{TaskId: "1", MetaInfo: mi, LinkChain: &LinkChain{}}, make(chan string, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.reportor.Close)
+	s.totalSize = mi.Length
+	s.totalPieces, s.lastPieceLength = countPieces(mi.Length, mi.PieceLen)
+	s.pieceSet = NewBitset(s.totalPieces)
+	s.fileChecks = newFileChecks(mi)
+	return s, l
+}
+
+// 一个Piece校验失败MaxPieceRetries次后不再下载，并上报失败
+func TestPieceGiveUp(t *testing.T) {
+	s, l := testFailSession(t, 3)
+	s.pieceSet.Set(0)
+	s.pieceSet.Set(2)
+	have := NewBitset(s.totalPieces)
+	for i := 0; i < s.totalPieces; i++ {
+		have.Set(i)
+	}
+	seed := &peer{address: "10.0.0.9:45002", have: have}
+
+	for i, addr := range []string{"10.0.0.2:45002", "10.0.0.3:45002", "10.0.0.4:45002"} {
+		if _, ok := s.unrecoverable[1]; ok {
+			t.Fatalf("piece is unrecoverable after %v attempts", i)
+		}
+		// 退避结束后仍然下载该Piece
+		s.pieceRetryAt = make(map[int]time.Time)
+		if piece := s.ChoosePiece(seed); piece != 1 {
+			t.Fatalf("attempt %v chooses piece %v", i+1, piece)
+		}
+		s.pieceFailed(&peer{address: addr, have: have}, 1)
+	}
+	if !s.unrecoverable[1] || s.lastCode != ERR_PIECE_UNRECOVERABLE {
+		t.Fatalf("unrecoverable=%v, code=%s", s.unrecoverable[1], s.lastCode)
+	}
+	s.pieceRetryAt = make(map[int]time.Time)
+	if piece := s.ChoosePiece(seed); piece != -1 {
+		t.Fatalf("choose unrecoverable piece %v", piece)
+	}
+	if !reflect.DeepEqual(l.attempts, []int{1, 2, 3}) {
+		t.Fatalf("listener attempts=%v", l.attempts)
+	}
+}
+
+// 坏Peer在冷却时间之后重新计数
+func TestBadPeerCooldown(t *testing.T) {
+	s, _ := testFailSession(t, 0)
+	p := &peer{address: "10.0.0.2:45002"}
+	s.pieceFailed(p, 0)
+	if s.isBadPeer(p.address) {
+		t.Fatal("peer is bad after one bad piece")
+	}
+	s.pieceFailed(p, 1)
+	if !s.isBadPeer(p.address) || !reflect.DeepEqual(s.bannedPeers(), []string{p.address}) {
+		t.Fatal("peer is not bad after two bad pieces")
+	}
+	s.badPeerAt[p.address] = time.Now().Add(-BAD_PEER_COOLDOWN)
+	if s.isBadPeer(p.address) || len(s.bannedPeers()) != 0 {
+		t.Fatal("peer is still bad after cooldown")
+	}
+	s.pieceFailed(p, 2)
+	if s.isBadPeer(p.address) {
+		t.Fatal("bad pieces before cooldown are counted")
+	}
+}
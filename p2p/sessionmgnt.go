@@ -1,97 +1,314 @@
 package p2p
 
 import (
-	log "github.com/cihub/seelog"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/flowctrl"
 )
 
 type global struct {
 	cfg *common.Config // 全局配置
+	log common.Logger  // 日志
 
 	fsProvider FsProvider    // 读取文件
 	cacher     CacheProvider // 用于缓存块信息
+
+	uploadLimiter   *flowctrl.TokenBucket // 所有任务总的上传速率
+	downloadLimiter *flowctrl.TokenBucket // 所有任务总的下载速率
+	speed           *speedSchedule        // 按时间段调整总的速率
+	fair            *fairShare            // 在运行中的任务间公平分配总的速率
+
+	progressListener    ProgressListener    // 下载进度的回调
+	pieceFailedListener PieceFailedListener // Piece校验失败的回调
+
+	s3 *S3Client // 配置了对象存储时不为nil
+
+	metrics *Metrics // 运行指标
+
+	memStore *MemoryStore // 只在内存中保存的任务数据
+
+	pieceCache *PieceCache // 源头节点发送块时读取的Piece缓存
+
+	buffers *bufferPool // 读写块与Piece时复用的缓冲
+
+	pressure *pressureMonitor // 主机资源压力过高时暂停块的传输
+
+	disk *diskWorkers // 配置了IO优先级时读写任务数据的线程，否则为nil
+
+	retry *retryPolicy // 连接与请求失败后的重试策略
+
+	connPool  *connPool     // 任务结束后保留的与上游Peer的连接
+	peerConns chan *P2pConn // 认证通过的Peer连接，包括复用的连接
+
+	transfers *transferReports // 已结束任务的传输报告
+
+	nat *natMapper // 配置了Net.Nat时在网关上映射数据端口，否则为nil
+
+	upgrader Upgrader // 安装升级任务下载的新版本，没有设置时为nil
+	handoff  bool     // 升级重启，下载中的任务退出时不上报，交接给新进程
 }
 
 type P2pSessionMgnt struct {
 	g *global //
 
-	quitChan chan struct{} // 退出
+	quitChan    chan struct{} // 退出
+	stoppedChan chan struct{} // 所有任务关闭后关闭
 
 	createSessChan chan *DispatchTask     // 要创建的Task
 	startSessChan  chan *StartTask        //
 	stopSessChan   chan string            // 要关闭的Task
+	cancelSessChan chan *cancelTask       // 要取消的Task
+	speedChan      chan *SpeedLimit       // 调整任务的速率
+	limitsChan     chan *TaskLimits       // 调整任务的传输限制
+	progressChan   chan *progressQuery    // 查询任务的进度
+	listChan       chan *listQuery        // 查询所有任务
+	streamChan     chan *streamQuery      // 读取下载中的文件
+	metaChan       chan *metaQuery        // 按InfoHash查询元数据
+	verifyChan     chan *verifyTask       // 校验任务的文件
 	sessions       map[string]*P2pSession //
+	mounts         mounts                 // 挂载的任务文件
 }
 
-func NewSessionMgnt(cfg *common.Config) *P2pSessionMgnt {
+// l为nil时使用seelog
+func NewSessionMgnt(cfg *common.Config, l common.Logger) *P2pSessionMgnt {
+	if l == nil {
+		l = common.NewSeelogLogger()
+	}
+	g := &global{
+		cfg:        cfg,
+		log:        l,
+		fsProvider: NewOsFsProvider(cfg.Control.MaxOpenFiles, cfg.Control.MaxTaskOpenFiles),
+		cacher:     NewRamCacheProvider(cfg.Control.CacheSize),
+
+		uploadLimiter:   flowctrl.NewTokenBucket(mibps(cfg.Control.UploadSpeed)),
+		downloadLimiter: flowctrl.NewTokenBucket(mibps(cfg.Control.DownloadSpeed)),
+
+		metrics:  NewMetrics(),
+		retry:    newRetryPolicy(cfg.Control),
+		memStore: NewMemoryStore(int64(cfg.Control.MemoryStore) * 1024 * 1024),
+
+		transfers: newTransferReports(),
+	}
+	g.pieceCache = NewPieceCache(int64(cfg.Control.PieceCache)*1024*1024, g.metrics)
+	g.buffers = newBufferPool(int64(cfg.Control.BufferPool)*1024*1024, g.metrics)
+	g.pressure = newPressureMonitor(cfg, l, g.metrics)
+	g.disk = newDiskWorkers(cfg, l)
+	g.connPool = newConnPool(time.Duration(cfg.Net.PeerIdleTimeout)*time.Second, g.metrics)
+	g.nat = newNatMapper(cfg, l)
+	g.speed = newSpeedSchedule(g)
+	g.fair = newFairShare(g)
+	if cfg.Server && cfg.Control.Mmap {
+		g.fsProvider = MmapFsProvider{Fallback: g.fsProvider}
+	}
+	if cfg.S3 != nil {
+		g.s3 = NewS3Client(cfg.S3)
+		g.fsProvider = S3FsProvider{Client: g.s3, Local: g.fsProvider}
+	}
 	return &P2pSessionMgnt{
-		g: &global{
-			cfg:        cfg,
-			fsProvider: OsFsProvider{},
-			cacher:     NewRamCacheProvider(cfg.Control.CacheSize),
-		},
+		g:              g,
 		quitChan:       make(chan struct{}, 1),
+		stoppedChan:    make(chan struct{}),
 		createSessChan: make(chan *DispatchTask, cfg.Control.MaxActive),
 		startSessChan:  make(chan *StartTask, cfg.Control.MaxActive),
 		stopSessChan:   make(chan string, 1),
+		cancelSessChan: make(chan *cancelTask),
+		speedChan:      make(chan *SpeedLimit, 1),
+		limitsChan:     make(chan *TaskLimits, 1),
+		progressChan:   make(chan *progressQuery),
+		listChan:       make(chan *listQuery),
+		streamChan:     make(chan *streamQuery),
+		metaChan:       make(chan *metaQuery),
+		verifyChan:     make(chan *verifyTask),
 		sessions:       make(map[string]*P2pSession, 10),
+		mounts:         mounts{tasks: make(map[string]*taskMount)},
 	}
 }
 
 // 启动监控
 func (sm *P2pSessionMgnt) Start() error {
-	conChan, listener, err := StartListen(sm.g.cfg)
+	defer close(sm.stoppedChan)
+	conChan, listener, err := StartListen(sm.g.cfg, sm.g.log)
 	if err != nil {
-		log.Error("Couldn't listen for peers connection: ", err)
+		sm.g.log.Errorf("Couldn't listen for peers connection: %v", err)
 		return err
 	}
 	defer listener.Close()
+	sm.g.peerConns = conChan
+	if sm.g.cfg.Net.RelayPort > 0 {
+		rs, err := startRelay(sm.g)
+		if err != nil {
+			sm.g.log.Errorf("Couldn't listen for relay: %v", err)
+			return err
+		}
+		defer rs.Close()
+	}
+	go sm.g.pressure.run(sm.stoppedChan)
+	go sm.g.connPool.run(sm.stoppedChan)
+	go sm.g.nat.run(sm.stoppedChan)
+	go sm.g.speed.run(sm.stoppedChan)
+	go sm.g.fair.run(sm.stoppedChan)
 
 	for {
 		select {
 		case task := <-sm.createSessChan:
 			if ts, err := NewP2pSession(sm.g, task, sm.stopSessChan); err != nil {
-				log.Error("Could not create p2p task session.", err)
+				sm.g.log.With("taskID", task.TaskId).Errorf("Could not create p2p task session. %v", err)
 			} else {
-				log.Infof("[%s] Created p2p task session", task.TaskId)
+				sm.g.log.With("taskID", task.TaskId).Infof("Created p2p task session")
+				old := sm.sessions[ts.taskId]
 				sm.sessions[ts.taskId] = ts
-				go func(s *P2pSession) {
+				go func(s, old *P2pSession) {
+					if old != nil {
+						// 重复下发的任务，如备Server接管后重新下发，关闭原来的任务并保存断点续传信息后再初始化
+						s.log.Infof("Replace running p2p task session")
+						old.Quit()
+						<-old.endedChan
+					}
 					s.Init()
-				}(ts)
+				}(ts, old)
 			}
 		case task := <-sm.startSessChan:
 			if ts, ok := sm.sessions[task.TaskId]; ok {
 				ts.Start(task)
 			} else {
-				log.Errorf("[%s] Not find p2p task session", task.TaskId)
+				sm.g.log.With("taskID", task.TaskId).Errorf("Not find p2p task session")
 			}
 		case taskId := <-sm.stopSessChan:
-			log.Infof("[%s] Stop p2p task session", taskId)
+			sm.g.log.With("taskID", taskId).Infof("Stop p2p task session")
 			if ts, ok := sm.sessions[taskId]; ok {
 				delete(sm.sessions, taskId)
 				ts.Quit()
 			}
+		case ct := <-sm.cancelSessChan:
+			sm.g.log.With("taskID", ct.taskId).Infof("Cancel p2p task session, clean=%v", ct.clean)
+			if ts, ok := sm.sessions[ct.taskId]; ok {
+				delete(sm.sessions, ct.taskId)
+				go ts.Cancel(ct.clean)
+			}
+		case sl := <-sm.speedChan:
+			if ts, ok := sm.sessions[sl.TaskId]; ok {
+				ts.SetSpeed(mibps(sl.Upload), mibps(sl.Download))
+			} else {
+				sm.g.log.With("taskID", sl.TaskId).Errorf("Not find p2p task session")
+			}
+		case tl := <-sm.limitsChan:
+			if ts, ok := sm.sessions[tl.TaskId]; ok {
+				go ts.SetLimits(tl)
+			} else {
+				sm.g.log.With("taskID", tl.TaskId).Errorf("Not find p2p task session")
+			}
+		case q := <-sm.progressChan:
+			if ts, ok := sm.sessions[q.taskId]; ok {
+				// 不阻塞Session管理
+				go func(ts *P2pSession) {
+					tp, _ := ts.Progress()
+					q.out <- tp
+				}(ts)
+			} else {
+				q.out <- nil
+			}
+		case q := <-sm.listChan:
+			sessions := make([]*P2pSession, 0, len(sm.sessions))
+			for _, ts := range sm.sessions {
+				sessions = append(sessions, ts)
+			}
+			go func() {
+				tps := make([]*TaskProgress, 0, len(sessions))
+				for _, ts := range sessions {
+					if tp, ok := ts.Progress(); ok {
+						tps = append(tps, tp)
+					}
+				}
+				sort.Slice(tps, func(i, j int) bool { return tps[i].TaskId < tps[j].TaskId })
+				q.out <- tps
+			}()
+		case q := <-sm.streamChan:
+			if ts, ok := sm.sessions[q.taskId]; ok {
+				q.out <- ts
+			} else {
+				q.out <- nil
+			}
+		case q := <-sm.metaChan:
+			var meta []byte
+			for _, ts := range sm.sessions {
+				if ts.infoHash == q.infoHash {
+					meta = ts.metaData
+					break
+				}
+			}
+			q.out <- meta
+		case vt := <-sm.verifyChan:
+			ts, ok := sm.sessions[vt.taskId]
+			// 校验可能很耗时，不阻塞Session管理
+			go func() {
+				o := &verifyOutput{}
+				if ok {
+					o.result, o.err = ts.Verify(vt.repair)
+				} else if !sm.g.cfg.Server {
+					o.result, o.err = verifyStoredTask(sm.g.cfg.DownDir, vt.taskId, sm.g.log.With("taskID", vt.taskId),
+						int64(sm.g.cfg.Control.VerifyMemory)*1024*1024)
+				} else {
+					o.err = errors.New("Task is not existed")
+				}
+				vt.out <- o
+			}()
 		case <-sm.quitChan:
+			// 不再处理新的任务，所有任务保存状态后退出
+			var wg sync.WaitGroup
+			sessions := make([]*P2pSession, 0, len(sm.sessions))
 			for _, ts := range sm.sessions {
-				go ts.Quit()
+				sessions = append(sessions, ts)
+				wg.Add(1)
+				go func(ts *P2pSession) {
+					defer wg.Done()
+					ts.Leave()
+				}(ts)
+			}
+			wg.Wait()
+			if sm.g.handoff {
+				sm.saveHandoff(sessions)
 			}
-			log.Info("Closed all sessiong")
+			sm.g.log.Infof("Closed all sessiong")
 			return nil
 		case c := <-conChan:
-			log.Infof("[%s] New p2p connection, peer addr %s", c.taskId, c.remoteAddr.String())
-			if ts, ok := sm.sessions[c.taskId]; ok {
+			sm.g.log.With("taskID", c.taskId, "peerID", c.remoteAddr.String()).Infof("New p2p connection")
+			if sm.g.cfg.Control.Mode == common.AGENT_MODE_LEECH {
+				// 只下载，不给其它节点上传
+				sm.g.log.With("taskID", c.taskId).Warnf("Reject p2p connection in leech mode")
+				c.conn.Close()
+			} else if ts, ok := sm.sessions[c.taskId]; ok {
 				ts.AcceptNewPeer(c)
 			} else {
-				log.Errorf("[%s] Not find p2p task session", c.taskId)
+				sm.g.log.With("taskID", c.taskId).Errorf("Not find p2p task session")
 				c.conn.Close() // TODO让客户端重连
 			}
 		}
 	}
 }
 
-// 停止所有的任务，并退出监控
+// 运行指标
+func (sm *P2pSessionMgnt) Metrics() *Metrics {
+	return sm.g.metrics
+}
+
+// 停止所有的任务，并退出监控。最多等待Control.DrainTimeout让任务保存状态
 func (sm *P2pSessionMgnt) Stop() {
+	sm.unmountAll()
 	sm.quitChan <- struct{}{}
+	timeout := time.Duration(sm.g.cfg.Control.DrainTimeout) * time.Second
+	select {
+	case <-sm.stoppedChan:
+	case <-time.After(timeout):
+		sm.g.log.Warnf("Close all sessions timeout after %v", timeout)
+	}
 }
 
 // 创建一个任务
@@ -101,6 +318,12 @@ func (sm *P2pSessionMgnt) CreateTask(dt *DispatchTask) {
 	}(dt)
 }
 
+// ctx取消或超时后，本节点的任务失败并关闭，不影响其它节点
+func (sm *P2pSessionMgnt) CreateTaskContext(ctx context.Context, dt *DispatchTask) {
+	dt.ctx = ctx
+	sm.CreateTask(dt)
+}
+
 // 启动一个任务
 func (sm *P2pSessionMgnt) StartTask(st *StartTask) {
 	go func(st *StartTask) {
@@ -114,3 +337,182 @@ func (sm *P2pSessionMgnt) StopTask(taskId string) {
 		sm.stopSessChan <- taskId
 	}(taskId)
 }
+
+type cancelTask struct {
+	taskId string
+	clean  bool
+}
+
+// 取消一个任务，关闭所有Peer连接并释放缓存，clean为true时删除未下载完成的文件
+func (sm *P2pSessionMgnt) CancelTask(taskId string, clean bool) {
+	go func(ct *cancelTask) {
+		sm.cancelSessChan <- ct
+	}(&cancelTask{taskId: taskId, clean: clean})
+}
+
+// 调整传输速率，TaskId为空时调整所有任务总的速率
+func (sm *P2pSessionMgnt) SetSpeed(sl *SpeedLimit) {
+	if sl.TaskId == "" {
+		sm.g.log.Infof("Set total speed, upload=%vMiBps, download=%vMiBps", sl.Upload, sl.Download)
+		sm.g.speed.setTotal(sl.Upload, sl.Download)
+		return
+	}
+	go func(sl *SpeedLimit) {
+		sm.speedChan <- sl
+	}(sl)
+}
+
+// 调整运行中任务的速率、上传的Peer数与请求窗口
+func (sm *P2pSessionMgnt) SetLimits(tl *TaskLimits) {
+	go func(tl *TaskLimits) {
+		sm.limitsChan <- tl
+	}(tl)
+}
+
+type progressQuery struct {
+	taskId string
+	out    chan *TaskProgress
+}
+
+// 查询任务的下载进度，任务不存在时返回false
+func (sm *P2pSessionMgnt) Progress(taskId string) (*TaskProgress, bool) {
+	q := &progressQuery{taskId: taskId, out: make(chan *TaskProgress, 1)}
+	sm.progressChan <- q
+	tp := <-q.out
+	return tp, tp != nil
+}
+
+type listQuery struct {
+	out chan []*TaskProgress
+}
+
+// 查询所有运行中的任务，按任务ID排序
+func (sm *P2pSessionMgnt) Tasks() []*TaskProgress {
+	q := &listQuery{out: make(chan []*TaskProgress, 1)}
+	sm.listChan <- q
+	return <-q.out
+}
+
+// 检查内存中是否有足够的空间接收只在内存中保存的任务
+func (sm *P2pSessionMgnt) CheckMemoryStore(mi *MetaInfo) error {
+	return sm.g.memStore.Check(mi)
+}
+
+type streamQuery struct {
+	taskId string
+	out    chan *P2pSession
+}
+
+// 按顺序读取任务中的一个文件，name为空时读取第一个文件。数据还没有下载时Read等待，
+// 下载完成前任务结束时Read返回错误。任务创建时指定顺序下载，才能尽早读到数据
+func (sm *P2pSessionMgnt) OpenStream(taskId, name string) (io.ReadCloser, error) {
+	q := &streamQuery{taskId: taskId, out: make(chan *P2pSession, 1)}
+	sm.streamChan <- q
+	ts := <-q.out
+	if ts == nil {
+		// 已结束的任务，读取内存中保留的数据
+		file := ""
+		if name != "" {
+			file = localPath(sm.g.cfg.DownDir, name)
+		}
+		if r, ok := sm.g.memStore.open(taskId, file); ok {
+			return r, nil
+		}
+		return nil, errors.New("Task is not existed")
+	}
+
+	m := ts.task.MetaInfo
+	offsets, _ := m.fileOffsets()
+	for _, fd := range m.Files {
+		if fd.Same != "" && fd.Name == name {
+			// 读取内容相同的文件
+			name = fd.Same
+		}
+	}
+	for i, fd := range m.Files {
+		if fd.Link != "" || fd.Same != "" || (name != "" && fd.Name != name) {
+			continue
+		}
+		return ts.stream.reader(offsets[i], fd.Length), nil
+	}
+	return nil, fmt.Errorf("File %s is not existed in task", name)
+}
+
+type metaQuery struct {
+	infoHash string
+	out      chan []byte
+}
+
+// 按InfoHash查询运行中任务的元数据，返回EncodeMeta的编码，供其它节点解析任务URI
+func (sm *P2pSessionMgnt) MetaByHash(infoHash string) ([]byte, bool) {
+	q := &metaQuery{infoHash: strings.ToLower(infoHash), out: make(chan []byte, 1)}
+	sm.metaChan <- q
+	meta := <-q.out
+	return meta, meta != nil
+}
+
+type verifyTask struct {
+	taskId string
+	repair bool
+	out    chan *verifyOutput
+}
+
+// 重新计算任务所有Piece的摘要，报告损坏的数据。任务运行中且repair为true时，从Peer重新下载损坏的Piece；
+// Agent上已结束的任务使用保存的元数据校验，只报告不修复
+func (sm *P2pSessionMgnt) VerifyTask(taskId string, repair bool) (*VerifyResult, error) {
+	vt := &verifyTask{taskId: taskId, repair: repair, out: make(chan *verifyOutput, 1)}
+	sm.verifyChan <- vt
+	o := <-vt.out
+	return o.result, o.err
+}
+
+// 向Server注册与心跳的内容
+func (sm *P2pSessionMgnt) Heartbeat() *AgentHeartbeat {
+	cfg := sm.g.cfg
+	hb := &AgentHeartbeat{
+		IP:       cfg.Net.IP,
+		MgntPort: cfg.Net.MgntPort,
+		DataPort: cfg.Net.DataPort,
+		Zone:     cfg.Net.Zone,
+		Labels:   cfg.Net.Labels,
+		Mode:     cfg.Control.Mode,
+		External: sm.g.nat.externalAddr(),
+		DataAddr: cfg.AdvertisedDataAddr(),
+		Relay:    cfg.Net.Relay,
+		Capacity: sm.capacity(),
+
+		ProtocolVersion: PROTOCOL_VERSION,
+		Capabilities:    sm.Capabilities(),
+	}
+	return hb
+}
+
+// 当前接收任务的能力
+func (sm *P2pSessionMgnt) capacity() *AgentCapacity {
+	c := &AgentCapacity{
+		MaxActive:     sm.g.cfg.Control.MaxActive,
+		ActiveTasks:   sm.g.metrics.activeTasks(),
+		MemoryStore:   max64(sm.g.memStore.available(), 0),
+		Peers:         sm.g.metrics.peerCount(),
+		UnderPressure: sm.g.metrics.pressured(),
+	}
+	var err error
+	if c.DiskFree, err = diskFree(sm.g.cfg.DownDir); err != nil {
+		c.DiskFree = -1
+	}
+	return c
+}
+
+// 设置下载进度的回调，需要在Start之前调用
+func (sm *P2pSessionMgnt) SetProgressListener(l ProgressListener) {
+	sm.g.progressListener = l
+}
+
+// 设置Piece校验失败的回调，需要在Start之前调用
+func (sm *P2pSessionMgnt) SetPieceFailedListener(l PieceFailedListener) {
+	sm.g.pieceFailedListener = l
+}
+
+func mibps(speed int) int64 {
+	return int64(speed) * 1024 * 1024
+}
@@ -0,0 +1,163 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// 元数据有可选字段时指纹编码的版本
+	FINGERPRINT_VERSION = 1
+)
+
+// 元数据的指纹，对除签名与加密密钥外的所有字段按固定顺序编码后计算SHA256。
+// 没有可选字段时使用最初的编码，与之前的指纹相同；否则以-1与版本号开头，之后不论是否为零值都编码所有字段，
+// 每个字段长度固定或带长度前缀，不同的元数据不会得到相同的编码。合法的元数据Length不为负，两种编码不会相同
+func (m *MetaInfo) Fingerprint() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 256+len(m.Pieces)))
+	writeInt := func(n int64) { binary.Write(buf, binary.BigEndian, n) }
+	writeBytes := func(b []byte) {
+		writeInt(int64(len(b)))
+		buf.Write(b)
+	}
+	writeBool := func(b bool) {
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	}
+
+	versioned := m.hasOptionalFields()
+	if versioned {
+		writeInt(-1)
+		buf.WriteByte(FINGERPRINT_VERSION)
+	}
+	writeInt(m.Length)
+	writeInt(m.PieceLen)
+	writeBytes([]byte(m.Hash))
+	writeBool(m.AlignFiles)
+	writeBool(m.PadLastPiece)
+	writeBytes(m.Pieces)
+	writeInt(int64(len(m.Files)))
+	for _, fd := range m.Files {
+		writeInt(fd.Length)
+		writeBytes([]byte(fd.Path))
+		writeBytes([]byte(fd.Name))
+		writeBytes([]byte(fd.Sum))
+		writeInt(fd.Offset)
+		writeBool(fd.Partial)
+		if versioned {
+			writeInt(int64(fd.Mode))
+			writeInt(fd.ModTime)
+			writeBytes([]byte(fd.Link))
+			writeBytes([]byte(fd.Same))
+		}
+	}
+	if versioned {
+		writeInt(int64(len(m.WebSeeds)))
+		for _, seed := range m.WebSeeds {
+			writeBytes([]byte(seed))
+		}
+		writeBool(m.NoCompress)
+		writeInt(m.BundleSize)
+		writeBool(m.Upgrade)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	return sum[:]
+}
+
+// 最初的元数据之后增加的字段，都为零值时使用最初的指纹编码
+func (m *MetaInfo) hasOptionalFields() bool {
+	if len(m.WebSeeds) > 0 || m.NoCompress || m.BundleSize != 0 || m.Upgrade {
+		return true
+	}
+	for _, fd := range m.Files {
+		if fd.Mode != 0 || fd.ModTime != 0 || fd.Link != "" || fd.Same != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 使用私钥对元数据签名，签名保存在Signature中
+func (m *MetaInfo) Sign(priv ed25519.PrivateKey) error {
+	if len(priv) != ed25519.PrivateKeySize {
+		return errors.New("Invalid ed25519 private key")
+	}
+	m.Signature = ed25519.Sign(priv, m.Fingerprint())
+	return nil
+}
+
+// 使用公钥校验元数据的签名，没有签名或签名不正确都返回错误
+func (m *MetaInfo) VerifySignature(pub ed25519.PublicKey) error {
+	if len(pub) != ed25519.PublicKeySize {
+		return errors.New("Invalid ed25519 public key")
+	}
+	if len(m.Signature) == 0 {
+		return errors.New("Metainfo is not signed")
+	}
+	if m.Length < 0 {
+		// 负的Length可能与带版本号的编码相同
+		return errors.New("Metainfo length is negative")
+	}
+	if !ed25519.Verify(pub, m.Fingerprint(), m.Signature) {
+		return errors.New("Metainfo signature is incorrect")
+	}
+	return nil
+}
+
+// 生成签名元数据的密钥对，私钥为base64编码的32字节种子，公钥为base64编码
+func GenerateSignKey() (priv, pub string, err error) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(sk.Seed()), base64.StdEncoding.EncodeToString(pk), nil
+}
+
+// 解析base64编码的私钥，可以是32字节的种子或64字节的完整私钥
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	bs, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ed25519 private key, %v", err)
+	}
+	switch len(bs) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(bs), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(bs), nil
+	}
+	return nil, errors.New("Invalid ed25519 private key length")
+}
+
+// 解析base64编码的公钥列表
+func ParsePublicKeys(keys []string) ([]ed25519.PublicKey, error) {
+	pubs := make([]ed25519.PublicKey, 0, len(keys))
+	for _, k := range keys {
+		bs, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(bs) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid ed25519 public key %q", k)
+		}
+		pubs = append(pubs, ed25519.PublicKey(bs))
+	}
+	return pubs, nil
+}
+
+// 任一公钥校验通过即可，轮换签名密钥时可以同时信任新旧公钥
+func (m *MetaInfo) VerifyAnySignature(pubs []ed25519.PublicKey) (err error) {
+	err = errors.New("No trusted public key")
+	for _, pub := range pubs {
+		if err = m.VerifySignature(pub); err == nil {
+			return nil
+		}
+	}
+	return
+}
@@ -0,0 +1,161 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+func testMeta() *MetaInfo {
+	return &MetaInfo{
+		Length:   3,
+		PieceLen: 16384,
+		Pieces:   []byte("0123456789abcdefghij"),
+		Hash:     "sha1",
+		Files: []*FileDict{
+			{Length: 1, Path: "/data/", Name: "a", Sum: "\x01\x02"},
+			{Length: 2, Path: "/data/", Name: "b", Sum: "\xff\x00"},
+		},
+	}
+}
+
+// 最初的编码，没有可选字段的元数据的指纹需要与之前的版本相同
+func legacyFingerprint(m *MetaInfo) []byte {
+	var buf bytes.Buffer
+	writeInt := func(n int64) { binary.Write(&buf, binary.BigEndian, n) }
+	writeBytes := func(b []byte) {
+		writeInt(int64(len(b)))
+		buf.Write(b)
+	}
+	writeBool := func(b bool) {
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	}
+	writeInt(m.Length)
+	writeInt(m.PieceLen)
+	writeBytes([]byte(m.Hash))
+	writeBool(m.AlignFiles)
+	writeBool(m.PadLastPiece)
+	writeBytes(m.Pieces)
+	writeInt(int64(len(m.Files)))
+	for _, fd := range m.Files {
+		writeInt(fd.Length)
+		writeBytes([]byte(fd.Path))
+		writeBytes([]byte(fd.Name))
+		writeBytes([]byte(fd.Sum))
+		writeInt(fd.Offset)
+		writeBool(fd.Partial)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return sum[:]
+}
+
+func TestFingerprintLegacy(t *testing.T) {
+	m := testMeta()
+	if !bytes.Equal(m.Fingerprint(), legacyFingerprint(m)) {
+		t.Fatal("fingerprint of metainfo without optional fields changed")
+	}
+	m.Files[0].Mode = 0644
+	if bytes.Equal(m.Fingerprint(), legacyFingerprint(m)) {
+		t.Fatal("fingerprint ignores file mode")
+	}
+}
+
+func TestFingerprintJSONRoundTrip(t *testing.T) {
+	m := testMeta()
+	m.Files[1].Mode, m.Files[1].ModTime = 0755, 1700000000
+	m.Files = append(m.Files, &FileDict{Path: "/data/", Name: "c", Same: "a"}, &FileDict{Path: "/data/", Name: "d", Link: "b"})
+	m.WebSeeds = []string{"http://10.0.0.1/"}
+	m.NoCompress, m.BundleSize, m.Upgrade = true, 4096, true
+	m.EncryptKey = []byte("not part of fingerprint")
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got MetaInfo
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.Fingerprint(), got.Fingerprint()) {
+		t.Fatal("fingerprint changed after json round trip")
+	}
+	got.EncryptKey = nil
+	if !bytes.Equal(m.Fingerprint(), got.Fingerprint()) {
+		t.Fatal("fingerprint covers encrypt key")
+	}
+}
+
+// 修改任一字段后指纹都不同，可选字段之间移动内容也不会得到相同的编码
+func TestFingerprintFields(t *testing.T) {
+	changes := map[string]func(m *MetaInfo){
+		"length":       func(m *MetaInfo) { m.Length++ },
+		"pieceLen":     func(m *MetaInfo) { m.PieceLen *= 2 },
+		"hash":         func(m *MetaInfo) { m.Hash = "sha256" },
+		"alignFiles":   func(m *MetaInfo) { m.AlignFiles = true },
+		"padLastPiece": func(m *MetaInfo) { m.PadLastPiece = true },
+		"pieces":       func(m *MetaInfo) { m.Pieces[0] ^= 1 },
+		"path":         func(m *MetaInfo) { m.Files[0].Path = "/tmp/" },
+		"name":         func(m *MetaInfo) { m.Files[0].Name = "x" },
+		"sum":          func(m *MetaInfo) { m.Files[0].Sum = "\x01\x03" },
+		"offset":       func(m *MetaInfo) { m.Files[0].Offset = 1 },
+		"partial":      func(m *MetaInfo) { m.Files[0].Partial = true },
+		"mode":         func(m *MetaInfo) { m.Files[0].Mode = 0600 },
+		"modTime":      func(m *MetaInfo) { m.Files[0].ModTime = 1 },
+		"link":         func(m *MetaInfo) { m.Files[1].Link = "a" },
+		"same":         func(m *MetaInfo) { m.Files[1].Same = "c" },
+		"webSeeds":     func(m *MetaInfo) { m.WebSeeds = []string{"http://a/"} },
+		"noCompress":   func(m *MetaInfo) { m.NoCompress = true },
+		"bundleSize":   func(m *MetaInfo) { m.BundleSize = 1 },
+		"upgrade":      func(m *MetaInfo) { m.Upgrade = true },
+		"same-as-link": func(m *MetaInfo) { m.Files[1].Same, m.Files[1].Link = "", "a" },
+		"moved-seed":   func(m *MetaInfo) { m.WebSeeds = []string{"http://a/", ""} },
+	}
+	base := testMeta()
+	base.Files[1].Same = "a"
+	seen := map[string]string{string(base.Fingerprint()): "base"}
+	for name, change := range changes {
+		m := testMeta()
+		m.Files[1].Same = "a"
+		change(m)
+		fp := string(m.Fingerprint())
+		if other, ok := seen[fp]; ok {
+			t.Errorf("fingerprint of %s equals %s", name, other)
+		}
+		seen[fp] = name
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testMeta()
+	m.Files[0].Mode = 0644
+	if err = m.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.VerifySignature(pub); err != nil {
+		t.Fatalf("verify signed metainfo: %v", err)
+	}
+
+	// 普通任务的签名不能用于升级
+	m.Upgrade = true
+	if err = m.VerifySignature(pub); err == nil {
+		t.Fatal("signature still valid after setting upgrade")
+	}
+	m.Upgrade = false
+
+	m.Length = -1
+	if err = m.VerifySignature(pub); err == nil {
+		t.Fatal("accept negative length")
+	}
+}
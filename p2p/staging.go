@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+var errReflinkUnsupported = errors.New("Reflink is not supported")
+
+// 配置了Control.StagingDir时，任务先下载到暂存目录下以任务ID命名的目录，全部Piece校验通过后再放到下载目录，
+// 下载目录中不会出现写了一半的文件。返回任务的暂存目录，种子节点、不写入磁盘与只分发文件中一段数据的任务返回空
+func StagingDir(cfg *common.Config, dt *DispatchTask) string {
+	if cfg.Control.StagingDir == "" || cfg.Server || dt.Seed || dt.InMemory || len(dt.Pipe) > 0 {
+		return ""
+	}
+	if dt.MetaInfo != nil {
+		for _, fd := range dt.MetaInfo.Files {
+			if fd.Partial {
+				return ""
+			}
+		}
+	}
+	return filepath.Join(cfg.Control.StagingDir, dt.TaskId)
+}
+
+func (s *P2pSession) staged() bool {
+	return s.stagingDir() != ""
+}
+
+func (s *P2pSession) stagingDir() string {
+	return StagingDir(s.g.cfg, s.task)
+}
+
+// 任务的数据文件写入的目录，使用暂存目录时下载完成后再放到downDir
+func (s *P2pSession) dataDir() string {
+	if s.staged() {
+		return s.stagingDir()
+	}
+	return s.downDir()
+}
+
+// 使用暂存目录时，文件在暂存目录与下载目录中都不能通过软链接跳出目录
+func (s *P2pSession) checkInsideDirs(name string) error {
+	if err := checkInsideDir(s.dataDir(), name); err != nil {
+		return err
+	}
+	if s.staged() {
+		return checkInsideDir(s.downDir(), name)
+	}
+	return nil
+}
+
+// 下载完成后把暂存目录中的文件放到下载目录：同一文件系统上创建硬链接，
+// 否则在支持的文件系统上reflink，都不支持时复制。先写入临时文件再改名，替换是原子的。
+// 暂存的文件在任务结束后删除，期间继续用于给其它节点上传
+func (s *P2pSession) finalizeFiles() error {
+	if !s.staged() || s.finalized {
+		return nil
+	}
+	start := time.Now()
+	methods := make(map[string]int)
+	for _, fd := range s.task.MetaInfo.Files {
+		file := localPath(s.downDir(), fd.Name)
+		if fd.Link != "" {
+			if err := restoreLink(file, filepath.FromSlash(fd.Link)); err != nil {
+				s.log.Warnf("Create symlink failed, file=%s, error=%v", file, err)
+			}
+			continue
+		}
+		method, err := finalizeFile(localPath(s.stagingDir(), fd.Name), file, fd)
+		if err != nil {
+			s.log.Errorf("Finalize file failed, file=%s, error=%v", file, err)
+			return err
+		}
+		methods[method]++
+	}
+	s.finalized = true
+	s.log.Infof("Finalized files to %s, methods=%v (%.2f seconds)", s.downDir(), methods, time.Now().Sub(start).Seconds())
+	return nil
+}
+
+// 返回使用的方法：link、reflink或copy
+func finalizeFile(src, dst string, fd *FileDict) (method string, err error) {
+	if err = ensureDirectory(dst); err != nil {
+		return
+	}
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".gofd")
+	os.Remove(tmp)
+	method = "link"
+	if err = os.Link(src, tmp); err != nil {
+		if method, err = cloneFile(src, tmp); err != nil {
+			os.Remove(tmp)
+			return
+		}
+		// 硬链接与暂存的文件共用已恢复的权限位与修改时间
+		if fd.Mode != 0 {
+			os.Chmod(tmp, os.FileMode(fd.Mode)&os.ModePerm)
+		}
+		if fd.ModTime != 0 {
+			mt := time.Unix(fd.ModTime, 0)
+			os.Chtimes(tmp, mt, mt)
+		}
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// 不能创建硬链接时，优先reflink，否则复制
+func cloneFile(src, dst string) (method string, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	method = "reflink"
+	if err = reflink(in, out); err != nil {
+		method = "copy"
+		if _, err = io.Copy(out, in); err == nil {
+			err = out.Sync()
+		}
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	return
+}
+
+// 删除任务的暂存目录
+func (s *P2pSession) removeStaging() {
+	dir := s.stagingDir()
+	if err := os.RemoveAll(dir); err != nil {
+		s.log.Errorf("Remove staging dir failed, dir=%s, error=%v", dir, err)
+	}
+}
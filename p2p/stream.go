@@ -0,0 +1,165 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	errStreamClosed = errors.New("Stream is closed")
+	errTaskStopped  = errors.New("Task is stopped")
+)
+
+// 从文件开头连续下载完成的数据，供任务下载过程中读取
+type pieceStream struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	store   FileStore
+	ready   int64 // 从全局偏移0开始连续下载完成的字节数
+	total   int64
+	readers int  // 未关闭的streamReader
+	ended   bool // 任务已结束
+	closed  bool // 存储已关闭，不能再读取
+}
+
+func newPieceStream() *pieceStream {
+	ps := &pieceStream{}
+	ps.cond = sync.NewCond(&ps.lock)
+	return ps
+}
+
+func (ps *pieceStream) setStore(store FileStore, total int64) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.store, ps.total = store, total
+}
+
+// ready只增加，修复时重新下载的Piece不影响已读取的数据
+func (ps *pieceStream) advance(ready int64) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if ready > ps.ready {
+		ps.ready = ready
+		ps.cond.Broadcast()
+	}
+}
+
+// 任务结束时调用，返回false时由最后一个关闭的streamReader关闭存储：
+// 数据已全部下载时，让读取中的连接读完；否则唤醒等待中的读取并返回错误
+func (ps *pieceStream) close() bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.ended = true
+	if ps.readers > 0 && ps.store != nil && ps.ready >= ps.total {
+		return false
+	}
+	ps.closed = true
+	ps.cond.Broadcast()
+	return true
+}
+
+// 更新连续完成的数据长度，在Session的Goroutine中调用
+func (s *P2pSession) updateStream() {
+	if s.pieceSet == nil {
+		return
+	}
+	ready := s.totalSize
+	if i := s.pieceSet.FindNextClear(0); i >= 0 && i < s.totalPieces {
+		ready = min64(int64(i)*s.task.MetaInfo.PieceLen, s.totalSize)
+	}
+	s.stream.advance(ready)
+}
+
+// 按顺序读取一个文件，数据还没有下载时等待
+type streamReader struct {
+	ps     *pieceStream
+	start  int64 // 文件的全局偏移
+	off    int64 // 下一次读取的全局偏移
+	end    int64
+	closed bool
+}
+
+func (ps *pieceStream) reader(off, length int64) *streamReader {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.readers++
+	return &streamReader{ps: ps, start: off, off: off, end: off + length}
+}
+
+func (r *streamReader) Read(p []byte) (n int, err error) {
+	if r.off >= r.end {
+		return 0, io.EOF
+	}
+	ps := r.ps
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	for !r.closed && !ps.closed && ps.ready <= r.off {
+		ps.cond.Wait()
+	}
+	if r.closed {
+		return 0, errStreamClosed
+	}
+	if ps.closed {
+		// 没有下载完成的任务结束后不能再读取
+		return 0, errTaskStopped
+	}
+
+	if avail := min64(ps.ready, r.end) - r.off; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err = ps.store.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && r.off >= r.end {
+		err = nil
+	}
+	return
+}
+
+// 按文件内的偏移读取，等待要读取的数据全部下载完成，不改变Read的位置。
+// 可以并发调用，用于挂载后的随机读取
+func (r *streamReader) ReadAt(p []byte, off int64) (n int, err error) {
+	size := r.end - r.start
+	if off >= size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if int64(want) > size-off {
+		p = p[:size-off]
+	}
+	ps := r.ps
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	for !r.closed && !ps.closed && ps.ready < r.start+off+int64(len(p)) {
+		ps.cond.Wait()
+	}
+	if r.closed {
+		return 0, errStreamClosed
+	}
+	if ps.closed {
+		return 0, errTaskStopped
+	}
+
+	n, err = ps.store.ReadAt(p, r.start+off)
+	if err == nil && n < want {
+		err = io.EOF
+	}
+	return
+}
+
+// 可以在其它Goroutine中调用，唤醒等待中的Read
+func (r *streamReader) Close() (err error) {
+	ps := r.ps
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	ps.cond.Broadcast()
+	if ps.readers--; ps.readers == 0 && ps.ended && !ps.closed {
+		ps.closed = true
+		err = ps.store.Close()
+	}
+	return
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"fmt"
+	"path"
+)
+
+// 从分发中挑选部分文件后，原来的Pieces中不再被任何文件引用的Piece序号。
+// 文件边界所在的Piece只要还有一个被保留的文件引用，就认为仍被引用
+func (m *MetaInfo) UnreferencedPieces(files []*FileDict) ([]int, error) {
+	included := make(map[string]bool, len(files))
+	for _, fd := range files {
+		included[path.Join(fd.Path, fd.Name)] = true
+	}
+
+	totalPieces, _ := countPieces(m.pieceDataLength(m.Length), m.PieceLen)
+	referenced := NewBitset(totalPieces)
+	offsets, _ := m.fileOffsets()
+	found := 0
+	for i, fd := range m.Files {
+		if !included[path.Join(fd.Path, fd.Name)] {
+			continue
+		}
+		found++
+		if fd.Length == 0 {
+			continue
+		}
+		first, _, err := m.PieceAtOffset(offsets[i])
+		if err != nil {
+			return nil, err
+		}
+		last, _, err := m.PieceAtOffset(offsets[i] + fd.Length - 1)
+		if err != nil {
+			return nil, err
+		}
+		for p := first; p <= last; p++ {
+			referenced.Set(p)
+		}
+	}
+	if found != len(included) {
+		return nil, fmt.Errorf("Subset has %v files not in metainfo", len(included)-found)
+	}
+
+	var unreferenced []int
+	for p := 0; p < totalPieces; p++ {
+		if !referenced.IsSet(p) {
+			unreferenced = append(unreferenced, p)
+		}
+	}
+	return unreferenced, nil
+}
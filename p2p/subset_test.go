@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestUnreferencedPieces(t *testing.T) {
+	// 4个Piece：a在0，b跨0与1，c在1到2，d在3
+	m := &MetaInfo{
+		Length:   16,
+		PieceLen: 4,
+		Files: []*FileDict{
+			{Length: 2, Name: "a"},
+			{Length: 3, Name: "b"},
+			{Length: 6, Name: "c"},
+			{Name: "empty"},
+			{Length: 5, Path: "sub", Name: "d"},
+		},
+	}
+	cases := []struct {
+		name   string
+		subset []string
+		want   []int
+	}{
+		{"all files", []string{"a", "b", "c", "empty", "sub/d"}, nil},
+		{"shared first piece", []string{"a"}, []int{1, 2, 3}},
+		{"file across boundary", []string{"b"}, []int{2, 3}},
+		{"last piece", []string{"sub/d"}, []int{0, 1}},
+		{"empty file", []string{"empty"}, []int{0, 1, 2, 3}},
+		{"no files", nil, []int{0, 1, 2, 3}},
+	}
+	for _, c := range cases {
+		var files []*FileDict
+		for _, name := range c.subset {
+			for _, fd := range m.Files {
+				if path.Join(fd.Path, fd.Name) == name {
+					files = append(files, fd)
+				}
+			}
+		}
+		got, err := m.UnreferencedPieces(files)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: UnreferencedPieces=%v, want %v", c.name, got, c.want)
+		}
+	}
+
+	if _, err := m.UnreferencedPieces([]*FileDict{{Name: "other"}}); err == nil {
+		t.Error("accept file not in metainfo")
+	}
+}
@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// 文件摘要缓存，创建元数据失败重试时，复用已经计算成功的文件摘要，只重新计算失败的文件
+type SumCache struct {
+	m      sync.Mutex
+	sums   map[string]*cachedSum
+	failed map[string]error
+}
+
+// 文件大小、修改时间与摘要算法都相同时，才认为缓存的摘要有效
+type cachedSum struct {
+	size    int64
+	modTime time.Time
+	hash    string
+	sum     string
+}
+
+func NewSumCache() *SumCache {
+	return &SumCache{
+		sums:   make(map[string]*cachedSum),
+		failed: make(map[string]error),
+	}
+}
+
+func (c *SumCache) get(file string, fi os.FileInfo, hashName string) (string, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	cs, ok := c.sums[file]
+	if !ok || cs.size != fi.Size() || !cs.modTime.Equal(fi.ModTime()) || cs.hash != hashName {
+		return "", false
+	}
+	return cs.sum, true
+}
+
+func (c *SumCache) put(file string, fi os.FileInfo, hashName string, sum string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.sums[file] = &cachedSum{size: fi.Size(), modTime: fi.ModTime(), hash: hashName, sum: sum}
+	delete(c.failed, file)
+}
+
+func (c *SumCache) fail(file string, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.sums, file)
+	c.failed[file] = err
+}
+
+// 上一次计算摘要失败的文件
+func (c *SumCache) Failed() map[string]error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	failed := make(map[string]error, len(c.failed))
+	for k, v := range c.failed {
+		failed[k] = v
+	}
+	return failed
+}
@@ -0,0 +1,51 @@
+package p2p
+
+const (
+	TOPOLOGY_CHAIN = "chain" // 所有Agent排成一条流水线，每个节点只向下一个节点上传
+	TOPOLOGY_TREE  = "tree"  // Agent排成以Server为根的树，每个节点最多向Fanout个下游上传
+)
+
+// 按拓扑排列时每个节点的下游数，为0时不按拓扑排列
+func (lc *LinkChain) fanout() int {
+	switch lc.Topology {
+	case TOPOLOGY_CHAIN:
+		return 1
+	case TOPOLOGY_TREE:
+		return max(lc.Fanout, 1)
+	}
+	return 0
+}
+
+// 按树排列的上游节点：DispatchAddrs中第idx个节点的父节点为第(idx-1)/fanout个节点，
+// 父节点不可用时依次连接更上层的节点，最后总是Server
+func (lc *LinkChain) treeUpstreams(idx, fanout int) []string {
+	if idx <= 0 || idx >= len(lc.DispatchAddrs) {
+		return lc.DispatchAddrs[:1]
+	}
+	var addrs []string
+	for j := idx; j > 0; {
+		j = (j - 1) / fanout
+		addrs = append(addrs, lc.DispatchAddrs[j])
+	}
+	return addrs
+}
+
+// 按拓扑排列时，下游只连接拓扑中的上游，不通过PEX或种子增加上游
+func (s *P2pSession) topologyFixed() bool {
+	return s.task.LinkChain != nil && s.task.LinkChain.fanout() > 0
+}
+
+// 按拓扑排列时Agent最多接入fanout个下游，上游不可用的节点再连接更上层的节点，
+// 最后由Server接入。Server与种子节点不限制
+func (s *P2pSession) downstreamLimited() bool {
+	if !s.topologyFixed() || s.seeding() {
+		return false
+	}
+	n := 0
+	for _, p := range s.peers {
+		if p.client {
+			n++
+		}
+	}
+	return n >= s.task.LinkChain.fanout()
+}
@@ -0,0 +1,339 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 填充文件的属性，见BEP 47
+	torrentAttrPad     = "p"
+	torrentAttrLink    = "l"
+	torrentAttrExecute = "x"
+)
+
+// .torrent文件中MetaInfo以外的信息
+type TorrentOptions struct {
+	Announce []string // Tracker地址，第一个写入announce，多于一个时全部写入announce-list
+	Name     string   // 多个文件没有相同的顶层目录时，作为.torrent中的目录名
+}
+
+// 转换为标准BitTorrent的.torrent文件。只支持sha1摘要，对齐的文件与补0的最后一个Piece使用BEP 47的填充文件表示，
+// WebSeeds写入url-list。签名、加密密钥、文件的修改时间等gofd的扩展信息不保存
+func (m *MetaInfo) MarshalTorrent(opts *TorrentOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &TorrentOptions{}
+	}
+	if m.Hash != "" && m.Hash != DefaultHash {
+		return nil, fmt.Errorf("Torrent only supports %s pieces, hash=%s", DefaultHash, m.Hash)
+	}
+	if len(m.Files) == 0 {
+		return nil, errors.New("No file in metainfo")
+	}
+	for _, fd := range m.Files {
+		if fd.Partial {
+			return nil, fmt.Errorf("Partial file %s is not supported in torrent", fd.Name)
+		}
+		if fd.Same != "" {
+			return nil, fmt.Errorf("Deduplicated file %s is not supported in torrent", fd.Name)
+		}
+	}
+
+	offsets, total := m.fileOffsets()
+	padLast := m.PadLastPiece && total%m.PieceLen != 0
+	info := map[string]interface{}{
+		"piece length": m.PieceLen,
+		"pieces":       m.Pieces,
+	}
+	webSeeds := append([]string(nil), m.WebSeeds...)
+
+	if fd := m.Files[0]; len(m.Files) == 1 && fd.Link == "" && !strings.Contains(fd.Name, "/") && !padLast {
+		info["name"] = fd.Name
+		info["length"] = fd.Length
+		torrentFileAttrs(info, m, fd)
+		for i, seed := range webSeeds {
+			// 以/结尾时，客户端在地址后加上文件名
+			webSeeds[i] = strings.TrimSuffix(seed, "/") + "/"
+		}
+	} else {
+		name, strip := opts.Name, 0
+		if top := torrentTopDir(m.Files); top != "" {
+			name, strip = top, 1
+		} else if name == "" {
+			return nil, errors.New("Files have no common directory, need a torrent name")
+		} else {
+			// 源站上的文件不在name目录中
+			webSeeds = nil
+		}
+
+		files := make([]interface{}, 0, len(m.Files))
+		var pos int64
+		for i, fd := range m.Files {
+			if offsets[i] > pos {
+				files = append(files, torrentPadFile(offsets[i]-pos))
+			}
+			f := map[string]interface{}{
+				"length": fd.Length,
+				"path":   strings.Split(fd.Name, "/")[strip:],
+			}
+			torrentFileAttrs(f, m, fd)
+			files = append(files, f)
+			pos = offsets[i] + fd.Length
+		}
+		if padLast {
+			files = append(files, torrentPadFile(m.PieceLen-total%m.PieceLen))
+		}
+		info["name"] = name
+		info["files"] = files
+	}
+
+	t := map[string]interface{}{
+		"info":       info,
+		"created by": "gofd",
+	}
+	if len(opts.Announce) > 0 {
+		t["announce"] = opts.Announce[0]
+	}
+	if len(opts.Announce) > 1 {
+		tiers := make([]interface{}, len(opts.Announce))
+		for i, a := range opts.Announce {
+			tiers[i] = []string{a}
+		}
+		t["announce-list"] = tiers
+	}
+	if len(webSeeds) > 0 {
+		t["url-list"] = webSeeds
+	}
+
+	b := new(bytes.Buffer)
+	if err := bencodeValue(b, t); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// 所有文件相同的顶层目录，没有时返回空
+func torrentTopDir(files []*FileDict) string {
+	top := ""
+	for _, fd := range files {
+		i := strings.Index(fd.Name, "/")
+		if i <= 0 || (top != "" && fd.Name[:i] != top) {
+			return ""
+		}
+		top = fd.Name[:i]
+	}
+	return top
+}
+
+func torrentPadFile(length int64) map[string]interface{} {
+	return map[string]interface{}{
+		"attr":   torrentAttrPad,
+		"length": length,
+		"path":   []string{".pad", strconv.FormatInt(length, 10)},
+	}
+}
+
+// 软链接、可执行权限与sha1摘要
+func torrentFileAttrs(f map[string]interface{}, m *MetaInfo, fd *FileDict) {
+	switch {
+	case fd.Link != "":
+		f["attr"] = torrentAttrLink
+		f["symlink path"] = strings.Split(fd.Link, "/")
+	case fd.Mode&0111 != 0:
+		f["attr"] = torrentAttrExecute
+	}
+	if fd.Link == "" && len(fd.Sum) == sha1.Size {
+		f["sha1"] = fd.Sum
+	}
+}
+
+// 解析标准BitTorrent的.torrent文件。多文件的.torrent中文件名以name目录开头，
+// 文件的Path为空，需要由调用者设置为文件所在的目录
+func UnmarshalTorrent(data []byte) (*MetaInfo, *TorrentOptions, error) {
+	v, err := bdecode(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.New("Torrent is not a dictionary")
+	}
+	info, ok := t["info"].(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.New("Torrent has no info dictionary")
+	}
+
+	pieceLen, _ := info["piece length"].(int64)
+	pieces, _ := info["pieces"].(string)
+	name, _ := info["name"].(string)
+	if pieceLen <= 0 || len(pieces)%sha1.Size != 0 {
+		return nil, nil, errors.New("Torrent has invalid pieces")
+	}
+	if err = checkFileName(name); err != nil || strings.Contains(name, "/") {
+		return nil, nil, fmt.Errorf("Torrent has invalid name %q", name)
+	}
+
+	m := &MetaInfo{PieceLen: pieceLen, Pieces: []byte(pieces)}
+	opts := &TorrentOptions{}
+	if length, ok := info["length"].(int64); ok {
+		fd := &FileDict{Name: name, Length: length}
+		torrentReadAttrs(info, fd)
+		m.Files = []*FileDict{fd}
+	} else if err = m.torrentFiles(info, name); err != nil {
+		return nil, nil, err
+	} else {
+		opts.Name = name
+	}
+
+	var total int64
+	if _, total = m.fileOffsets(); m.PadLastPiece && total%pieceLen == 0 {
+		// 填充后正好对齐，不需要补0
+		m.PadLastPiece = false
+	}
+	m.Length = total
+	if n, _ := countPieces(m.pieceDataLength(total), pieceLen); n != len(pieces)/sha1.Size {
+		return nil, nil, fmt.Errorf("Torrent has %v pieces, expected %v", len(pieces)/sha1.Size, n)
+	}
+
+	opts.Announce = torrentAnnounce(t)
+	m.WebSeeds = torrentWebSeeds(t, m.Files, name)
+	return m, opts, nil
+}
+
+// 解析多文件的files列表，填充文件转换为AlignFiles与PadLastPiece
+func (m *MetaInfo) torrentFiles(info map[string]interface{}, name string) error {
+	list, ok := info["files"].([]interface{})
+	if !ok || len(list) == 0 {
+		return errors.New("Torrent has no files")
+	}
+
+	var torrentOffsets []int64
+	var pos int64
+	for i, e := range list {
+		f, ok := e.(map[string]interface{})
+		if !ok {
+			return errors.New("Torrent has invalid file entry")
+		}
+		length, _ := f["length"].(int64)
+		attr, _ := f["attr"].(string)
+		if length < 0 {
+			return errors.New("Torrent has invalid file length")
+		}
+		if strings.Contains(attr, torrentAttrPad) {
+			if i == len(list)-1 {
+				m.PadLastPiece = true
+			} else {
+				m.AlignFiles = true
+			}
+			pos += length
+			continue
+		}
+
+		elems, err := torrentPath(f["path"])
+		if err != nil {
+			return err
+		}
+		fd := &FileDict{Name: name + "/" + elems, Length: length}
+		if err = checkFileName(fd.Name); err != nil {
+			return err
+		}
+		torrentReadAttrs(f, fd)
+		m.Files = append(m.Files, fd)
+		torrentOffsets = append(torrentOffsets, pos)
+		pos += length
+	}
+	if len(m.Files) == 0 {
+		return errors.New("Torrent has only pad files")
+	}
+
+	// 填充文件需要与gofd对齐文件的方式一致
+	offsets, _ := m.fileOffsets()
+	for i := range offsets {
+		if offsets[i] != torrentOffsets[i] {
+			return fmt.Errorf("Torrent pad files are not aligned to pieces, file=%s", m.Files[i].Name)
+		}
+	}
+	return nil
+}
+
+func torrentPath(v interface{}) (string, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return "", errors.New("Torrent has invalid file path")
+	}
+	elems := make([]string, len(list))
+	for i, e := range list {
+		s, ok := e.(string)
+		if !ok || s == "" || strings.Contains(s, "/") {
+			return "", errors.New("Torrent has invalid file path")
+		}
+		elems[i] = s
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+func torrentReadAttrs(f map[string]interface{}, fd *FileDict) {
+	attr, _ := f["attr"].(string)
+	if strings.Contains(attr, torrentAttrLink) {
+		if link, err := torrentPath(f["symlink path"]); err == nil {
+			fd.Link, fd.Length = link, 0
+		}
+	} else if strings.Contains(attr, torrentAttrExecute) {
+		fd.Mode = 0755
+	}
+	if sum, ok := f["sha1"].(string); ok && len(sum) == sha1.Size {
+		fd.Sum = sum
+	}
+}
+
+func torrentAnnounce(t map[string]interface{}) (announce []string) {
+	seen := make(map[string]bool)
+	add := func(v interface{}) {
+		if s, ok := v.(string); ok && s != "" && !seen[s] {
+			seen[s] = true
+			announce = append(announce, s)
+		}
+	}
+	add(t["announce"])
+	tiers, _ := t["announce-list"].([]interface{})
+	for _, tier := range tiers {
+		list, _ := tier.([]interface{})
+		for _, a := range list {
+			add(a)
+		}
+	}
+	return
+}
+
+// url-list中的地址转换为源站地址，源站地址加上文件名即为文件的URL
+func torrentWebSeeds(t map[string]interface{}, files []*FileDict, name string) (seeds []string) {
+	var urls []string
+	switch v := t["url-list"].(type) {
+	case string:
+		urls = []string{v}
+	case []interface{}:
+		for _, u := range v {
+			if s, ok := u.(string); ok {
+				urls = append(urls, s)
+			}
+		}
+	}
+	single := len(files) == 1 && files[0].Name == name
+	for _, u := range urls {
+		switch {
+		case u == "":
+		case strings.HasSuffix(u, "/"):
+			seeds = append(seeds, strings.TrimSuffix(u, "/"))
+		case single && strings.HasSuffix(u, "/"+name):
+			// 单个文件的.torrent中可以是文件完整的URL
+			seeds = append(seeds, strings.TrimSuffix(u, "/"+name))
+		case !single:
+			seeds = append(seeds, u)
+		}
+	}
+	return
+}
@@ -0,0 +1,35 @@
+package p2p
+
+import (
+	"errors"
+)
+
+var errPieceMismatch = errors.New("piece sum mismatch")
+
+// Piece校验完成时结束其Span，peer为发送最后一个块的Peer
+func (s *P2pSession) endPieceSpan(v *ActivePiece, peer string, good bool, err error) {
+	if v.span == nil {
+		return
+	}
+	v.span.SetAttributes("peer.address", peer, "piece.good", good)
+	if err == nil && !good {
+		err = errPieceMismatch
+	}
+	v.span.SetError(err)
+	v.span.End()
+}
+
+// 任务结束时结束本节点的Span，还没有下载完成的Piece的Span一起结束
+func (s *P2pSession) endSpan() {
+	for _, v := range s.activePieces {
+		if v.span != nil {
+			v.span.SetAttributes("piece.aborted", true)
+			v.span.End()
+		}
+	}
+	s.span.SetAttributes("task.pieces", s.totalPieces, "task.goodPieces", s.goodPieces, "task.downloaded", s.downloaded)
+	if s.lastErr != "" {
+		s.span.SetError(errors.New(s.lastErr))
+	}
+	s.span.End()
+}
@@ -0,0 +1,139 @@
+package p2p
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Agent保留的已结束任务的传输报告个数，超过时淘汰最早的
+	MAX_TRANSFER_REPORTS = 100
+)
+
+// 任务结束时生成的传输报告
+type TransferReport struct {
+	TaskId     string `json:"taskId"`
+	IP         string `json:"ip"`
+	Status     string `json:"status"` // COMPLETED、FAILED或INPROGRESS（任务被取消）
+	Error      string `json:"error,omitempty"`
+	ErrorCode  string `json:"errorCode,omitempty"` // 失败的错误码，如NO_SPACE
+	TotalBytes int64  `json:"totalBytes"`
+	BytesDone  int64  `json:"bytesDone"`
+
+	Peers []*PeerProgress `json:"peers,omitempty"` // 每个Peer传输的字节数、发送的坏Piece与请求超时的次数
+
+	ConnectRetries  int `json:"connectRetries"`  // 连接上游节点失败后重试的次数
+	RequestTimeouts int `json:"requestTimeouts"` // 块请求超时的次数
+	SlowAbandons    int `json:"slowAbandons"`    // 放弃慢速Peer的次数
+	CorruptPieces   int `json:"corruptPieces"`   // 校验失败的Piece次数
+
+	HashImpl string  `json:"hashImpl"`           // 元数据摘要算法的实现
+	HashRate float64 `json:"hashRate,omitempty"` // 校验下载的Piece的速率，包括读取数据，单位为MB/s
+
+	Phases *TransferPhases `json:"phases"`
+}
+
+// 各阶段的耗时，单位为秒，没有经过的阶段为0
+type TransferPhases struct {
+	Init     float64 `json:"init"`     // 创建任务到初始化完成，包括校验已有的文件
+	Wait     float64 `json:"wait"`     // 初始化完成到收到启动命令
+	Transfer float64 `json:"transfer"` // 启动到所有Piece下载完成
+	Finish   float64 `json:"finish"`   // 下载完成到写入命令与钩子执行完成
+}
+
+func seconds(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return to.Sub(from).Seconds()
+}
+
+// 在Session的Goroutine中调用
+func (s *P2pSession) transferReport() *TransferReport {
+	tr := &TransferReport{
+		TaskId:          s.taskId,
+		IP:              s.g.cfg.Net.IP,
+		Status:          s.status(),
+		Error:           s.lastErr,
+		ErrorCode:       s.lastCode,
+		TotalBytes:      s.totalSize,
+		BytesDone:       s.totalSize - s.RemainingBytes(),
+		Peers:           make([]*PeerProgress, 0, len(s.peerProgress)),
+		ConnectRetries:  s.connRetries,
+		RequestTimeouts: s.requestTimeouts,
+		SlowAbandons:    s.slowAbandons,
+	}
+	for _, n := range s.pieceFailures {
+		tr.CorruptPieces += n
+	}
+	tr.HashImpl = HashImpl(s.task.MetaInfo.Hash)
+	if s.hashTime > 0 {
+		tr.HashRate = float64(s.hashedBytes) / s.hashTime / 1024 / 1024
+	}
+	for _, pp := range s.peerProgress {
+		c := *pp
+		tr.Peers = append(tr.Peers, &c)
+	}
+	sort.Slice(tr.Peers, func(i, j int) bool { return tr.Peers[i].Address < tr.Peers[j].Address })
+
+	end := s.completedAt
+	if end.IsZero() {
+		end = time.Now()
+	}
+	tr.Phases = &TransferPhases{
+		Init:     seconds(s.createdAt, s.initedAt),
+		Wait:     seconds(s.initedAt, s.startAt),
+		Transfer: seconds(s.startAt, s.finishedAt),
+		Finish:   seconds(s.finishedAt, s.completedAt),
+	}
+	if s.finishedAt.IsZero() {
+		// 没有下载完成时，传输阶段到现在为止
+		tr.Phases.Transfer = seconds(s.startAt, end)
+	}
+	return tr
+}
+
+// 上报最终的状态时生成报告，之后的报告覆盖之前的
+func (s *P2pSession) saveTransferReport() *TransferReport {
+	tr := s.transferReport()
+	s.g.transfers.add(tr)
+	s.reportSaved = true
+	return tr
+}
+
+// 已结束任务的传输报告，可以在其它Goroutine中访问
+type transferReports struct {
+	lock    sync.Mutex
+	reports map[string]*TransferReport
+	order   []string // 生成的先后
+}
+
+func newTransferReports() *transferReports {
+	return &transferReports{reports: make(map[string]*TransferReport)}
+}
+
+func (t *transferReports) add(tr *TransferReport) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.reports[tr.TaskId]; !ok {
+		t.order = append(t.order, tr.TaskId)
+	}
+	t.reports[tr.TaskId] = tr
+	for len(t.order) > MAX_TRANSFER_REPORTS {
+		delete(t.reports, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+func (t *transferReports) get(taskId string) (*TransferReport, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tr, ok := t.reports[taskId]
+	return tr, ok
+}
+
+// 任务的传输报告，任务还没有结束时没有报告
+func (sm *P2pSessionMgnt) TransferReport(taskId string) (*TransferReport, bool) {
+	return sm.g.transfers.get(taskId)
+}
@@ -0,0 +1,88 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	TRANSPORT_TCP  = "tcp"  // 始终监听，其它传输方式连接失败时使用
+	TRANSPORT_UNIX = "unix" // 同一主机上的节点通过unix socket连接，用于测试
+)
+
+// 节点之间数据连接的传输方式，通过RegisterTransport注册后在net.transport中配置。
+// 连接建立后的握手、认证与Piece的传输与传输方式无关
+type PeerTransport interface {
+	// 在数据端口上接收其它节点的连接，Accept返回的连接的RemoteAddr在同时存在的连接之间不能重复
+	Listen(cfg *common.Config) (net.Listener, error)
+	// 连接其它节点，addr为分发路径中的数据地址host:port，不支持该地址时返回错误，改用TCP连接
+	Dial(cfg *common.Config, addr string, timeout time.Duration) (net.Conn, error)
+}
+
+var (
+	transportsLock sync.RWMutex
+	transports     = map[string]PeerTransport{TRANSPORT_TCP: tcpTransport{}}
+)
+
+// 注册一种传输方式，同名的会被覆盖，注册为tcp时替换内置的TCP
+func RegisterTransport(name string, t PeerTransport) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	transports[name] = t
+}
+
+// 已注册的传输方式，按名称排序
+func TransportNames() []string {
+	transportsLock.RLock()
+	defer transportsLock.RUnlock()
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupTransport(name string) (PeerTransport, bool) {
+	transportsLock.RLock()
+	defer transportsLock.RUnlock()
+	t, ok := transports[name]
+	return t, ok
+}
+
+func listenTransport(cfg *common.Config, name string) (net.Listener, error) {
+	t, ok := lookupTransport(name)
+	if !ok {
+		return nil, fmt.Errorf("Not support peer transport %s, build with -tags %s", name, name)
+	}
+	return t.Listen(cfg)
+}
+
+// 同时监听多种传输方式，关闭时全部关闭
+type multiListener struct {
+	net.Listener
+	others []net.Listener
+}
+
+func (m *multiListener) Close() error {
+	for _, l := range m.others {
+		l.Close()
+	}
+	return m.Listener.Close()
+}
+
+// 内置的TCP，配置了net.tls的peer时使用TLS
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(cfg *common.Config) (net.Listener, error) {
+	return listenTCP(cfg)
+}
+
+func (tcpTransport) Dial(cfg *common.Config, addr string, timeout time.Duration) (net.Conn, error) {
+	return dialTCP(cfg, addr, timeout)
+}
@@ -0,0 +1,118 @@
+//go:build quic
+// +build quic
+
+package p2p
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/xtfly/gofd/common"
+)
+
+// 基于QUIC的数据连接，与TCP使用相同的端口号，每个连接只使用一个Stream。
+// 需要使用 -tags quic 编译，并配置net.tls
+const quicALPN = "gofd-p2p"
+
+func init() {
+	RegisterTransport("quic", quicTransport{})
+}
+
+type quicTransport struct{}
+
+func quicTLSConfig(cfg *common.Config, server bool) (c *tls.Config, err error) {
+	if cfg.Net.Tls == nil {
+		return nil, errors.New("QUIC transport requires net.tls")
+	}
+	if server {
+		c, err = cfg.Net.Tls.ServerConfig()
+	} else {
+		c, err = cfg.Net.Tls.ClientConfig()
+	}
+	if err != nil {
+		return
+	}
+	c.NextProtos = []string{quicALPN}
+	return
+}
+
+func (quicTransport) Listen(cfg *common.Config) (net.Listener, error) {
+	tc, err := quicTLSConfig(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := quic.ListenAddr(common.JoinHostPort(cfg.DataListenIP(), cfg.Net.DataPort), tc, &quic.Config{KeepAlivePeriod: time.Minute})
+	if err != nil {
+		return nil, err
+	}
+	return &quicListener{ln: ln}, nil
+}
+
+func (quicTransport) Dial(cfg *common.Config, addr string, timeout time.Duration) (net.Conn, error) {
+	tc, err := quicTLSConfig(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, tc, &quic.Config{KeepAlivePeriod: time.Minute})
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: conn}, nil
+}
+
+type quicListener struct {
+	ln *quic.Listener
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			conn.CloseWithError(0, "")
+			continue
+		}
+		return &quicConn{Stream: stream, conn: conn}, nil
+	}
+}
+
+func (l *quicListener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// 把QUIC的Stream适配为net.Conn
+type quicConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c *quicConn) Close() error {
+	c.Stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
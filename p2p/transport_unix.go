@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 同一主机上的节点通过unix socket连接，socket按数据端口命名，放在net.socketDir中，
+// 如同一主机上运行多个Agent的测试。连接其它主机的节点时使用TCP
+func init() {
+	RegisterTransport(TRANSPORT_UNIX, unixTransport{})
+}
+
+type unixTransport struct{}
+
+func unixSocketFile(cfg *common.Config, port string) string {
+	dir := cfg.Net.SocketDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "gofd-"+port+".sock")
+}
+
+func (unixTransport) Listen(cfg *common.Config) (net.Listener, error) {
+	file := unixSocketFile(cfg, strconv.Itoa(cfg.Net.DataPort))
+	// 上次退出时遗留的socket文件
+	os.Remove(file)
+	ln, err := net.Listen("unix", file)
+	if err != nil {
+		return nil, err
+	}
+	return &unixListener{Listener: ln, file: file}, nil
+}
+
+func (unixTransport) Dial(cfg *common.Config, addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !isLocalHost(cfg, host) {
+		return nil, errors.New("Not a local address")
+	}
+	conn, err := net.DialTimeout("unix", unixSocketFile(cfg, port), timeout)
+	if err != nil {
+		return nil, err
+	}
+	// 与TCP一样以数据地址标识上游节点
+	return &unixConn{Conn: conn, remote: unixPeerAddr(addr)}, nil
+}
+
+// 回环地址或本节点的地址
+func isLocalHost(cfg *common.Config, host string) bool {
+	if host == "localhost" || host == cfg.Net.IP || host == cfg.DataListenIP() {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// 接入的连接没有对端地址，按接入的顺序编号
+type unixListener struct {
+	net.Listener
+	file string
+	seq  uint64
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddUint64(&l.seq, 1)
+	return &unixConn{Conn: conn, remote: unixPeerAddr(fmt.Sprintf("%s#%d", l.file, n))}, nil
+}
+
+type unixConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type unixPeerAddr string
+
+func (a unixPeerAddr) Network() string { return TRANSPORT_UNIX }
+func (a unixPeerAddr) String() string  { return string(a) }
@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// 目录树中的一个节点
+type treeNode struct {
+	name     string
+	file     *FileDict // 目录时为nil
+	children map[string]*treeNode
+}
+
+func (n *treeNode) child(name string) *treeNode {
+	c, ok := n.children[name]
+	if !ok {
+		c = &treeNode{name: name, children: make(map[string]*treeNode)}
+		n.children[name] = c
+	}
+	return c
+}
+
+func (n *treeNode) sortedChildren() []*treeNode {
+	children := make([]*treeNode, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	return children
+}
+
+// 以目录树的形式输出分发的文件及其大小，类似tree命令
+func (m *MetaInfo) WriteTree(w io.Writer) (err error) {
+	root := &treeNode{children: make(map[string]*treeNode)}
+	var total int64
+	for _, fd := range m.Files {
+		n := root
+		for _, name := range strings.Split(path.Clean(path.Join(fd.Path, fd.Name)), "/") {
+			if name != "" {
+				n = n.child(name)
+			}
+		}
+		n.file = fd
+		total += fd.Length
+	}
+
+	if isAbsSlash(m.firstPath()) {
+		_, err = fmt.Fprintln(w, "/")
+	} else {
+		_, err = fmt.Fprintln(w, ".")
+	}
+	if err != nil {
+		return
+	}
+	if err = writeTreeNode(w, root, ""); err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(w, "\n%d files, %s\n", len(m.Files), humanSize(float64(total)))
+	return
+}
+
+func (m *MetaInfo) firstPath() string {
+	if len(m.Files) == 0 {
+		return ""
+	}
+	return m.Files[0].Path
+}
+
+func writeTreeNode(w io.Writer, n *treeNode, prefix string) (err error) {
+	children := n.sortedChildren()
+	for i, c := range children {
+		branch, indent := "├── ", "│   "
+		if i == len(children)-1 {
+			branch, indent = "└── ", "    "
+		}
+		if c.file != nil {
+			_, err = fmt.Fprintf(w, "%s%s%s (%s)\n", prefix, branch, c.name, humanSize(float64(c.file.Length)))
+		} else {
+			_, err = fmt.Fprintf(w, "%s%s%s\n", prefix, branch, c.name)
+		}
+		if err != nil {
+			return
+		}
+		if err = writeTreeNode(w, c, prefix+indent); err != nil {
+			return
+		}
+	}
+	return
+}
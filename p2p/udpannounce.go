@@ -0,0 +1,126 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// UDP上报的请求与响应，Server不能通过UDP处理时返回UDP_ANNOUNCE_HTTP，Agent改用HTTP
+	UDP_ANNOUNCE_REQUEST  = 1
+	UDP_ANNOUNCE_RESPONSE = 2
+	UDP_ANNOUNCE_HTTP     = 3
+
+	// 报文中JSON内容的上限，超过时使用HTTP
+	UDP_ANNOUNCE_MAX_PAYLOAD = 16 * 1024
+	// 报文的时间与本节点相差超过该值时丢弃，防止重放
+	UDP_ANNOUNCE_MAX_SKEW = 5 * time.Minute
+
+	// 第一次等待响应的超时，之后每次重发加倍
+	UDP_ANNOUNCE_TIMEOUT = 500 * time.Millisecond
+	UDP_ANNOUNCE_RETRIES = 3
+	// 连续失败该次数后，一段时间内不再使用UDP
+	UDP_ANNOUNCE_MAX_FAILURES = 3
+	UDP_ANNOUNCE_BACKOFF      = 5 * time.Minute
+
+	udpAnnounceVersion = 1
+	// magic(4) + version(1) + type(1) + txid(4) + time(8) + hmac(32)
+	udpAnnounceHeaderLen = 4 + 1 + 1 + 4 + 8 + sha256.Size
+)
+
+var (
+	udpAnnounceMagic = []byte("GFDA")
+
+	ErrUdpAnnounceInvalid = errors.New("Invalid udp announce packet")
+	errUdpAnnounceHttp    = errors.New("Server requires http announce")
+	errUdpAnnounceTimeout = errors.New("Udp announce timeout")
+)
+
+// 编码UDP上报的报文。内容使用认证的密码计算HMAC，只防篡改不加密
+func EncodeAnnouncePacket(cfg *common.Config, typ byte, txid uint32, payload []byte) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, udpAnnounceHeaderLen+len(payload)))
+	buf.Write(udpAnnounceMagic)
+	buf.WriteByte(udpAnnounceVersion)
+	buf.WriteByte(typ)
+	binary.Write(buf, binary.BigEndian, txid)
+	binary.Write(buf, binary.BigEndian, time.Now().Unix())
+	buf.Write(make([]byte, sha256.Size))
+	buf.Write(payload)
+	b := buf.Bytes()
+	copy(b[udpAnnounceHeaderLen-sha256.Size:], announceMac(cfg, b))
+	return b
+}
+
+// 解码并校验报文，返回的payload引用b
+func DecodeAnnouncePacket(cfg *common.Config, b []byte) (typ byte, txid uint32, payload []byte, err error) {
+	if len(b) < udpAnnounceHeaderLen || !bytes.Equal(b[:4], udpAnnounceMagic) || b[4] != udpAnnounceVersion {
+		return 0, 0, nil, ErrUdpAnnounceInvalid
+	}
+	macOff := udpAnnounceHeaderLen - sha256.Size
+	mac := append([]byte(nil), b[macOff:udpAnnounceHeaderLen]...)
+	if !hmac.Equal(mac, announceMac(cfg, b)) {
+		return 0, 0, nil, ErrUdpAnnounceInvalid
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(b[10:18])), 0)
+	if d := time.Now().Sub(ts); d > UDP_ANNOUNCE_MAX_SKEW || d < -UDP_ANNOUNCE_MAX_SKEW {
+		return 0, 0, nil, ErrUdpAnnounceInvalid
+	}
+	return b[5], binary.BigEndian.Uint32(b[6:10]), b[udpAnnounceHeaderLen:], nil
+}
+
+// HMAC覆盖除HMAC字段外的所有内容
+func announceMac(cfg *common.Config, b []byte) []byte {
+	macOff := udpAnnounceHeaderLen - sha256.Size
+	h := hmac.New(sha256.New, []byte(cfg.Auth.Username+":"+cfg.Auth.Passowrd))
+	h.Write(b[:macOff])
+	h.Write(b[udpAnnounceHeaderLen:])
+	return h.Sum(nil)
+}
+
+// 通过UDP上报，没有收到响应时按加倍的超时重发，返回Server的响应内容
+func udpAnnounce(cfg *common.Config, addr string, body []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	txid := rand.Uint32()
+	pkt := EncodeAnnouncePacket(cfg, UDP_ANNOUNCE_REQUEST, txid, body)
+	buf := make([]byte, udpAnnounceHeaderLen+UDP_ANNOUNCE_MAX_PAYLOAD)
+	timeout := UDP_ANNOUNCE_TIMEOUT
+	for retry := 0; retry < UDP_ANNOUNCE_RETRIES; retry++ {
+		if _, err = conn.Write(pkt); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			typ, id, payload, err := DecodeAnnouncePacket(cfg, buf[:n])
+			if err != nil || id != txid {
+				// 丢弃之前请求的重复响应
+				continue
+			}
+			if typ == UDP_ANNOUNCE_HTTP {
+				return nil, errUdpAnnounceHttp
+			}
+			return append([]byte(nil), payload...), nil
+		}
+		timeout *= 2
+	}
+	return nil, errUdpAnnounceTimeout
+}
@@ -0,0 +1,121 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// 升级重启时交接给新进程的任务，保存在下载目录
+	handoffFileName = ".gofd-handoff"
+)
+
+// 安装升级任务下载的新版本，由Agent实现
+type Upgrader interface {
+	// 替换程序文件，在单独的Goroutine中调用，失败时任务上报失败
+	Install(taskId, file string) error
+	// 安装成功并上报完成后调用，不能阻塞
+	Restart(taskId string)
+}
+
+// 升级重启前运行中的任务，新进程重新创建后从断点续传信息继续下载
+type HandoffTask struct {
+	Task    *DispatchTask `json:"task"`
+	Started bool          `json:"started"` // 已收到开始命令，重新创建后立即开始
+}
+
+// 设置升级任务的安装者，需要在Start之前调用。没有设置时升级任务失败
+func (sm *P2pSessionMgnt) SetUpgrader(u Upgrader) {
+	sm.g.upgrader = u
+}
+
+// 下载完成且钩子执行成功后安装新版本
+func (s *P2pSession) installUpgrade() error {
+	if s.g.upgrader == nil {
+		return errors.New("Upgrade is not supported")
+	}
+	mi := s.task.MetaInfo
+	if !mi.Upgrade || len(mi.Signature) == 0 {
+		return errors.New("Metainfo is not signed for upgrade")
+	}
+	if len(mi.Files) != 1 {
+		return errors.New("Upgrade task must have only one file")
+	}
+	// 初始化时Path已改为本节点的目录，使用暂存目录时文件已放到下载目录
+	return s.g.upgrader.Install(s.taskId, localPath(s.downDir(), mi.Files[0].Name))
+}
+
+// 升级重启时可以交接的任务：下载中并且不是升级任务本身，本节点调用方创建的任务不交接
+func (s *P2pSession) handoffable() bool {
+	return !s.task.Upgrade && s.task.ctx == nil && !s.seeding() &&
+		s.lastErr == "" && s.goodPieces != s.totalPieces
+}
+
+// 停止所有任务，下载中的任务不上报退出，保存到下载目录由升级后的进程继续。
+// 与Stop不同，超过DrainTimeout后继续等待，返回后交接文件已写入，之后才能重新执行新程序
+func (sm *P2pSessionMgnt) Handoff() {
+	sm.g.handoff = true
+	sm.unmountAll()
+	sm.quitChan <- struct{}{}
+	timeout := time.Duration(sm.g.cfg.Control.DrainTimeout) * time.Second
+	for {
+		select {
+		case <-sm.stoppedChan:
+			return
+		case <-time.After(timeout):
+			sm.g.log.Warnf("Close all sessions for handoff still running after %v, keep waiting", timeout)
+		}
+	}
+}
+
+// 在所有任务关闭后调用
+func (sm *P2pSessionMgnt) saveHandoff(sessions []*P2pSession) {
+	var hts []*HandoffTask
+	for _, ts := range sessions {
+		if ts.handedOff {
+			hts = append(hts, &HandoffTask{Task: ts.task, Started: !ts.startAt.IsZero()})
+		}
+	}
+	if len(hts) == 0 {
+		return
+	}
+	file := filepath.Join(sm.g.cfg.DownDir, handoffFileName)
+	data, err := json.Marshal(hts)
+	if err == nil {
+		err = ioutil.WriteFile(file, data, 0600)
+	}
+	if err != nil {
+		sm.g.log.Errorf("Save %v tasks to %s failed, error=%v", len(hts), file, err)
+		return
+	}
+	sm.g.log.Infof("Saved %v tasks to %s", len(hts), file)
+}
+
+// 重新创建升级前交接的任务，读取后删除文件。在Start之后调用
+func (sm *P2pSessionMgnt) ResumeHandoff() {
+	file := filepath.Join(sm.g.cfg.DownDir, handoffFileName)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	os.Remove(file)
+	var hts []*HandoffTask
+	if err = json.Unmarshal(data, &hts); err != nil {
+		sm.g.log.Errorf("Decode %s failed, error=%v", file, err)
+		return
+	}
+	go func() {
+		// 按顺序创建与开始，开始命令在Session初始化后才处理
+		for _, ht := range hts {
+			sm.g.log.With("taskID", ht.Task.TaskId).Infof("Resume task handed off before upgrade")
+			sm.createSessChan <- ht.Task
+			if ht.Started {
+				sm.startSessChan <- &StartTask{TaskId: ht.Task.TaskId, LinkChain: ht.Task.LinkChain}
+			}
+		}
+	}()
+}
@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+type testUpgrader struct {
+	installed chan string
+	restarted chan string
+}
+
+func (u *testUpgrader) Install(taskId, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	u.installed <- string(data)
+	return nil
+}
+
+func (u *testUpgrader) Restart(taskId string) {
+	u.restarted <- taskId
+}
+
+// 升级任务下载完成后安装下载目录中的新版本，然后上报完成并重启
+func TestUpgradeTask(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "gofd")
+	if err := ioutil.WriteFile(src, []byte("new binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mi, err := CreateFileMeta([]string{src}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi.Upgrade = true
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	if err = mi.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+
+	// 文件已下载到下载目录，开始后直接完成
+	downDir := t.TempDir()
+	if err = ioutil.WriteFile(filepath.Join(downDir, "gofd"), []byte("new binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	reports := make(chan *StatusReport, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &StatusReport{}
+		json.NewDecoder(r.Body).Decode(sr)
+		reports <- sr
+	}))
+	defer srv.Close()
+
+	cfg := &common.Config{DownDir: downDir, Control: &common.Control{MaxActive: 1, HookTimeout: 10}}
+	sm := NewSessionMgnt(cfg, nil)
+	u := &testUpgrader{installed: make(chan string, 1), restarted: make(chan string, 1)}
+	sm.SetUpgrader(u)
+
+	lc := &LinkChain{ServerAddr: srv.Listener.Addr().String()}
+	s, err := NewP2pSession(sm.g, &DispatchTask{TaskId: "upgrade", MetaInfo: mi, LinkChain: lc, Upgrade: true}, make(chan string, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Init()
+	defer s.Quit()
+	s.Start(&StartTask{TaskId: "upgrade", LinkChain: lc})
+
+	timeout := time.After(10 * time.Second)
+	select {
+	case data := <-u.installed:
+		if data != "new binary" {
+			t.Fatalf("installed %q", data)
+		}
+	case sr := <-reports:
+		t.Fatalf("reported %v before install, error=%s", sr.PercentComplete, sr.Error)
+	case <-timeout:
+		t.Fatal("upgrade is not installed")
+	}
+	select {
+	case sr := <-reports:
+		if sr.PercentComplete != 100 {
+			t.Fatalf("reported %v, error=%s", sr.PercentComplete, sr.Error)
+		}
+	case <-timeout:
+		t.Fatal("completion is not reported")
+	}
+	select {
+	case id := <-u.restarted:
+		if id != "upgrade" {
+			t.Fatalf("restarted for task %s", id)
+		}
+	case <-timeout:
+		t.Fatal("agent is not restarted")
+	}
+}
@@ -0,0 +1,165 @@
+package p2p
+
+import "sort"
+
+// 按优先顺序排列的上游节点，idx为本节点在DispatchAddrs中的位置，连接失败或发送坏Piece时依次尝试。
+// 先连接同一分支中的上一个节点，再连接分支的源头，最后总是Server；
+// 配置了zone时，除了每个zone中排在前面的ZoneBridges个节点，其它节点先连接同一zone中的节点。
+// leech模式的节点不上传，不作为上游。按拓扑排列时只连接树中的上层节点
+func (lc *LinkChain) upstreams(idx int) []string {
+	var addrs []string
+	if f := lc.fanout(); f > 0 {
+		addrs = lc.treeUpstreams(idx, f)
+	} else {
+		addrs = lc.chainUpstreams(idx)
+	}
+	if len(lc.Leeches) == 0 {
+		return addrs
+	}
+	leeches := make(map[string]bool, len(lc.Leeches))
+	for _, a := range lc.Leeches {
+		leeches[a] = true
+	}
+	ups := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if !leeches[a] {
+			ups = append(ups, a)
+		}
+	}
+	return ups
+}
+
+func (lc *LinkChain) chainUpstreams(idx int) []string {
+	if idx <= 0 || idx >= len(lc.DispatchAddrs) {
+		return lc.DispatchAddrs[:1]
+	}
+	step := len(lc.SeedAddrs) + 1
+	var addrs []string
+	for j := idx - step; j > 0; j -= step {
+		addrs = append(addrs, lc.DispatchAddrs[j])
+	}
+	if root := (idx - 1) % step; root > 0 {
+		addrs = append(addrs, lc.SeedAddrs[root-1])
+	}
+	addrs = append(addrs, lc.DispatchAddrs[0])
+
+	if len(lc.Zones) != len(lc.DispatchAddrs) || lc.Zones[idx] == "" {
+		return addrs
+	}
+	var same []string // 同一zone中排在前面的节点
+	for j := 1; j < idx; j++ {
+		if lc.Zones[j] == lc.Zones[idx] {
+			same = append(same, lc.DispatchAddrs[j])
+		}
+	}
+	bridges := max(lc.ZoneBridges, 1)
+	if len(same) < bridges {
+		// bridge节点先连接其它zone的节点，Server仍然排在最后
+		zoneOf := make(map[string]string, len(lc.DispatchAddrs))
+		for j, a := range lc.DispatchAddrs {
+			zoneOf[a] = lc.Zones[j]
+		}
+		peers := addrs[:len(addrs)-1]
+		sort.SliceStable(peers, func(i, j int) bool {
+			return zoneOf[peers[i]] != lc.Zones[idx] && zoneOf[peers[j]] == lc.Zones[idx]
+		})
+		return addrs
+	}
+
+	// 在同一zone内以各bridge节点为源头分支，都不可用时再连接其它zone
+	local := make([]string, 0, len(same)/bridges+len(addrs))
+	seen := make(map[string]bool)
+	for j := len(same) - bridges; j >= 0; j -= bridges {
+		local = append(local, same[j])
+		seen[same[j]] = true
+	}
+	for _, a := range addrs {
+		if !seen[a] {
+			local = append(local, a)
+		}
+	}
+	return local
+}
+
+// 连接失败次数过多或发送过坏Piece时，换下一个上游节点，已经是Server时不再变化
+func (s *P2pSession) nextUpstream() {
+	s.connFailCount = 0
+	if s.upstreamIdx < len(s.upstreams)-1 {
+		s.upstreamIdx++
+	}
+}
+
+// 在上报的Goroutine中调用，只保留最新的一次
+func (s *P2pSession) setSwarmSeeds(seeds []string) {
+	select {
+	case <-s.swarmSeedsChan:
+	default:
+	}
+	select {
+	case s.swarmSeedsChan <- seeds:
+	default:
+	}
+}
+
+// 已完成并继续上传的Agent加在Server之前，分发路径中的上游节点都不可用时连接，减轻Server的压力
+func (s *P2pSession) addSeedUpstreams(seeds []string) {
+	s.addUpstreams(seeds, "seed")
+}
+
+// 新的上游节点加在Server之前，from为来源，用于日志
+func (s *P2pSession) addUpstreams(addrs []string, from string) {
+	if s.seeding() || s.goodPieces == s.totalPieces || len(s.upstreams) == 0 || s.topologyFixed() {
+		return
+	}
+	known := make(map[string]bool, len(s.upstreams))
+	for _, a := range s.upstreams {
+		known[a] = true
+	}
+	for _, a := range addrs {
+		if s.g.isSelf(a) || known[a] {
+			continue
+		}
+		known[a] = true
+		// 复制一份，upstreams可能与DispatchAddrs共用底层数组
+		last := len(s.upstreams) - 1
+		ups := make([]string, 0, len(s.upstreams)+1)
+		ups = append(append(ups, s.upstreams[:last]...), a, s.upstreams[last])
+		s.upstreams = ups
+		if s.upstreamIdx == last {
+			// 正在连接Server时不切换
+			s.upstreamIdx++
+		}
+		s.log.Infof("Add %s %s to upstreams", from, a)
+	}
+}
+
+// 在上报的Goroutine中调用，只保留最新的一次
+func (s *P2pSession) setSwarmBadPeers(addrs []string) {
+	select {
+	case <-s.swarmBadChan:
+	default:
+	}
+	select {
+	case s.swarmBadChan <- addrs:
+	default:
+	}
+}
+
+// 其它Agent上报的坏Peer，选择上游时跳过，没有其它上游时连接Server
+func (s *P2pSession) updateSwarmBadPeers(addrs []string) {
+	bad := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		if !s.swarmBadPeers[a] && !s.g.isSelf(a) {
+			s.log.Warnf("Peer %s is reported sending bad pieces, deprioritize it", a)
+		}
+		bad[a] = true
+	}
+	s.swarmBadPeers = bad
+}
+
+func (s *P2pSession) upstreamAddr() string {
+	if len(s.upstreams) == 0 {
+		return s.task.LinkChain.DispatchAddrs[0]
+	}
+	return s.upstreams[s.upstreamIdx]
+}
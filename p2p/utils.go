@@ -21,6 +21,20 @@ func min(a, b int) int {
 	return b
 }
 
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func uint32ToBytes(buf []byte, n uint32) {
 	buf[0] = byte(n >> 24)
 	buf[1] = byte(n >> 16)
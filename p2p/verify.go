@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 使用外部提供的文件摘要（十六进制，以文件路径为键）校验文件内容，
+// 不使用元数据中记录的Sum，避免元数据与文件内容同时被篡改
+func (m *MetaInfo) VerifyAgainstExpected(fs FileSystem, expected map[string]string) error {
+	newHash, err := m.hashFunc()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	seen := make(map[string]bool, len(m.Files))
+	for _, fd := range m.Files {
+		name := path.Join(fd.Path, fd.Name)
+		seen[name] = true
+		want, ok := expected[name]
+		if !ok {
+			common.DefaultLogger().Errorf("Not find expected sum, file=%s", name)
+			failed = append(failed, name)
+			continue
+		}
+
+		sum, err := fileDictSum(fs, m.dataFileDict(fd), newHash, nil)
+		if err != nil {
+			common.DefaultLogger().Errorf("Summary file failed, file=%s, error=%v", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		if !strings.EqualFold(hex.EncodeToString(sum), want) {
+			common.DefaultLogger().Errorf("File sum mismatch, file=%s, expected=%s, actual=%x", name, want, sum)
+			failed = append(failed, name)
+		}
+	}
+
+	for name := range expected {
+		if !seen[name] {
+			common.DefaultLogger().Errorf("Expected file not in metainfo, file=%s", name)
+			failed = append(failed, name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Verify files failed: %v", failed)
+	}
+	return nil
+}
+
+// 计算一个文件的摘要
+// done关闭时返回ErrCanceled，可以为nil
+func fileDictSum(fs FileSystem, fd *FileDict, newHash hashFunc, done <-chan struct{}) (sum []byte, err error) {
+	f, err := openFileDict(fs, fd)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	hash := newHash()
+	if _, err = io.Copy(hash, &cancelReader{r: io.NewSectionReader(f, 0, fd.Length), done: done}); err != nil {
+		return
+	}
+	sum = hash.Sum(nil)
+	return
+}
@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 读取时校验Piece摘要的FileStore，读取的数据所在的Piece都要先校验通过，
+// 避免元数据创建之后磁盘上的数据损坏被传播给其它节点。每个Piece只在第一次读取时计算摘要，
+// 之后直接读取，校验之后才损坏的数据由下载的节点校验失败后从其它Peer重新下载
+type verifyingReadFileStore struct {
+	FileStore
+	m           *MetaInfo
+	totalLength int64
+	log         common.Logger
+
+	lock     sync.Mutex // 多个上传的Peer同时读取
+	verified *Bitset    // 已校验通过的Piece
+}
+
+func NewVerifyingReadFileStore(fs FileStore, m *MetaInfo, totalLength int64, l common.Logger) (FileStore, error) {
+	if _, err := m.hashFunc(); err != nil {
+		return nil, err
+	}
+	return &verifyingReadFileStore{FileStore: fs, m: m, totalLength: totalLength, log: l,
+		verified: NewBitset(m.NumPieces())}, nil
+}
+
+func (v *verifyingReadFileStore) isVerified(piece int) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.verified.IsSet(piece)
+}
+
+func (v *verifyingReadFileStore) setVerified(piece int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.verified.Set(piece)
+}
+
+func (v *verifyingReadFileStore) ReadAt(p []byte, off int64) (n int, err error) {
+	end := off + int64(len(p))
+	if end > v.totalLength {
+		end = v.totalLength
+	}
+	if off >= end {
+		return 0, nil
+	}
+
+	pieceLen := v.m.PieceLen
+	for piece := off / pieceLen; piece*pieceLen < end; piece++ {
+		// 只复制与读取范围重叠的部分
+		pieceStart := piece * pieceLen
+		from, to := off, end
+		if from < pieceStart {
+			from = pieceStart
+		}
+		if to > pieceStart+pieceLen {
+			to = pieceStart + pieceLen
+		}
+
+		if v.isVerified(int(piece)) {
+			m, err2 := v.FileStore.ReadAt(p[from-off:to-off], from)
+			n += m
+			if err2 != nil {
+				return n, err2
+			}
+			continue
+		}
+
+		good, err2, data := checkPiece(v.FileStore, v.totalLength, v.m, int(piece), nil)
+		if err2 != nil || !good {
+			v.log.Errorf("Refuse to read corrupt piece=%v, error=%v", piece, err2)
+			return n, fmt.Errorf("Piece %v is corrupt: %v", piece, err2)
+		}
+		v.setVerified(int(piece))
+		n += copy(p[from-off:to-off], data[from-pieceStart:to-pieceStart])
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 统计从底层读取的字节数
+type countingStore struct {
+	FileStore
+	read int64
+}
+
+func (c *countingStore) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.FileStore.ReadAt(p, off)
+	c.read += int64(n)
+	return n, err
+}
+
+func testVerifyingStore(t *testing.T, data []byte) (string, *countingStore, FileStore) {
+	src := filepath.Join(t.TempDir(), "a")
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mi, err := CreateFileMeta([]string{src}, 16*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, totalSize, err := NewFileStore(mi, NewFileSystemAdapter(SizeCheck_Exact), common.DefaultLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	cs := &countingStore{FileStore: fs}
+	vfs, err := NewVerifyingReadFileStore(cs, mi, totalSize, common.DefaultLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src, cs, vfs
+}
+
+// 每个Piece只在第一次读取时校验
+func TestVerifyingReadOnce(t *testing.T) {
+	data := make([]byte, 40*1024)
+	rand.Read(data)
+	_, cs, vfs := testVerifyingStore(t, data)
+
+	read := func(off int64, n int) {
+		p := make([]byte, n)
+		if m, err := vfs.ReadAt(p, off); err != nil || m != n || !bytes.Equal(p, data[off:off+int64(n)]) {
+			t.Fatalf("ReadAt(%v, %v)=%v, %v", off, n, m, err)
+		}
+	}
+	// 第一块校验整个Piece
+	read(0, 4096)
+	if cs.read != 16*1024 {
+		t.Fatalf("read %v bytes for the first block", cs.read)
+	}
+	// 同一Piece的其它块只读取块的数据
+	for off := int64(4096); off < 16*1024; off += 4096 {
+		read(off, 4096)
+	}
+	if cs.read != 16*1024+12*1024 {
+		t.Fatalf("read %v bytes for the first piece", cs.read)
+	}
+	// 跨过已校验与没有校验的Piece，最后一个Piece不完整
+	cs.read = 0
+	read(12*1024, 28*1024)
+	if want := int64(4*1024 + 16*1024 + 8*1024); cs.read != want {
+		t.Fatalf("read %v bytes, want %v", cs.read, want)
+	}
+}
+
+func TestVerifyingReadCorrupt(t *testing.T) {
+	data := make([]byte, 40*1024)
+	src, _, vfs := testVerifyingStore(t, data)
+	f, err := os.OpenFile(src, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{1}, 20*1024)
+	f.Close()
+
+	p := make([]byte, 8*1024)
+	if _, err = vfs.ReadAt(p, 0); err != nil {
+		t.Fatalf("read good piece: %v", err)
+	}
+	if _, err = vfs.ReadAt(p, 16*1024); err == nil {
+		t.Fatal("read corrupt piece")
+	}
+	if _, err = vfs.ReadAt(p, 16*1024); err == nil {
+		t.Fatal("corrupt piece is cached as verified")
+	}
+}
@@ -0,0 +1,48 @@
+package p2p
+
+import (
+	"strconv"
+)
+
+const (
+	// 节点之间与向Server上报使用的协议版本。发起端在消息头中发送版本，接入端在连接响应后返回自己的版本，
+	// 双方按较小的版本通信，只发送该版本支持的消息。没有发送版本的旧节点为版本1
+	PROTOCOL_VERSION = 3
+
+	// 仍然兼容的最低版本，低于该版本的连接与上报被拒绝
+	MIN_PROTOCOL_VERSION = 1
+
+	// 接入端返回版本时，连接响应去掉该位，之后跟一个字节的版本。旧版本的响应总是带有该位
+	CONN_RSP_VERSION_BIT = 0x20
+)
+
+// 程序的版本，构建时通过-ldflags "-X github.com/xtfly/gofd/p2p.Version=x.y.z"设置
+var Version = "dev"
+
+// 消息从哪个协议版本开始支持，没有列出的消息所有版本都支持。
+// 增加新的消息类型时在这里登记，对端协商的版本较低时不发送
+var messageVersions = map[byte]int{
+	PEX: 3,
+}
+
+// 消息头中的版本，旧版本没有发送时为1
+func parseVersion(s string) int {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 {
+		return 1
+	}
+	return v
+}
+
+// 与对端协商后的版本
+func negotiateVersion(remote int) int {
+	if remote > PROTOCOL_VERSION {
+		return PROTOCOL_VERSION
+	}
+	return remote
+}
+
+// 对端是否支持该消息
+func (p *peer) supports(messageID byte) bool {
+	return messageVersions[messageID] <= p.version
+}
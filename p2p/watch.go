@@ -0,0 +1,148 @@
+package p2p
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 文件多久没有变化之后，才认为写入完成
+	watchStableDelay = 2 * time.Second
+)
+
+var (
+	ErrSumMismatch = errors.New("File sum mismatch")
+)
+
+// 一个文件的校验结果
+type VerifyEvent struct {
+	File   *FileDict
+	Passed bool
+	Err    error
+}
+
+// 监控目录，文件写入完成后立即按元数据中的Sum校验
+type VerifyWatcher struct {
+	Events <-chan *VerifyEvent
+
+	m        *MetaInfo
+	dir      string
+	events   chan *VerifyEvent
+	changed  chan string // 发生变化的文件名
+	quitChan chan struct{}
+	notifier fileNotifier
+}
+
+// 文件变化的通知，Linux下使用inotify，其它平台定时扫描目录
+type fileNotifier interface {
+	Close()
+}
+
+// 监控dir目录，外部程序把文件写入该目录后逐个校验，所有文件都通过校验后关闭Events
+func WatchAndVerify(mi *MetaInfo, dir string) (*VerifyWatcher, error) {
+	events := make(chan *VerifyEvent, len(mi.Files))
+	w := &VerifyWatcher{
+		Events:   events,
+		m:        mi,
+		dir:      dir,
+		events:   events,
+		changed:  make(chan string, 64),
+		quitChan: make(chan struct{}),
+	}
+
+	var err error
+	if w.notifier, err = newFileNotifier(dir, w.changed); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// 停止监控
+func (w *VerifyWatcher) Close() {
+	close(w.quitChan)
+}
+
+func (w *VerifyWatcher) run() {
+	defer close(w.events)
+	defer w.notifier.Close()
+
+	newHash, err := w.m.hashFunc()
+	if err != nil {
+		common.DefaultLogger().Errorf("Watch and verify failed, error=%v", err)
+		return
+	}
+
+	// 还没有通过校验的文件，以及文件最后一次变化的时间
+	pending := make(map[string]*FileDict, len(w.m.Files))
+	changedAt := make(map[string]time.Time, len(w.m.Files))
+	// 校验失败的文件与当时的状态，等文件再次变化后重新校验。
+	// inotify只监控dir本身，子目录中的文件没有通知，定时检查发现长度或修改时间变化后同样重新校验
+	failed := make(map[string]os.FileInfo)
+	now := time.Now()
+	for _, fd := range w.m.Files {
+		pending[fd.Name] = w.m.dataFileDict(fd)
+		changedAt[fd.Name] = now
+	}
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for len(pending) > 0 {
+		select {
+		case <-w.quitChan:
+			return
+		case name := <-w.changed:
+			if _, ok := pending[name]; ok {
+				changedAt[name] = time.Now()
+				delete(failed, name)
+			}
+		case now := <-tick.C:
+			for name, fd := range pending {
+				fi, err := os.Stat(localPath(w.dir, name))
+				if err != nil {
+					continue
+				}
+				if last, ok := failed[name]; ok {
+					if fi.Size() != last.Size() || !fi.ModTime().Equal(last.ModTime()) {
+						delete(failed, name)
+						changedAt[name] = now
+					}
+					continue
+				}
+				if now.Sub(changedAt[name]) < watchStableDelay || fi.Size() != fd.Length {
+					continue
+				}
+				e := w.verify(fd, newHash)
+				if e.Passed {
+					delete(pending, name)
+				} else {
+					failed[name] = fi
+				}
+				select {
+				case w.events <- e:
+				case <-w.quitChan:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *VerifyWatcher) verify(fd *FileDict, newHash hashFunc) *VerifyEvent {
+	local := *fd
+	local.Path = w.dir
+	sum, err := fileDictSum(&fileSystemAdapter{}, &local, newHash, nil)
+	if err != nil {
+		common.DefaultLogger().Errorf("Verify file failed, file=%s, error=%v", fd.Name, err)
+		return &VerifyEvent{File: fd, Err: err}
+	}
+	if string(sum) != fd.Sum {
+		common.DefaultLogger().Errorf("Verify file failed, file=%s, sum mismatch", fd.Name)
+		return &VerifyEvent{File: fd, Err: ErrSumMismatch}
+	}
+	common.DefaultLogger().Infof("Verify file passed, file=%s", fd.Name)
+	return &VerifyEvent{File: fd, Passed: true}
+}
@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 使用inotify监控目录下文件的写入
+type inotifyNotifier struct {
+	fd int
+	wd int
+}
+
+func newFileNotifier(dir string, changed chan<- string) (fileNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO)
+	wd, err := syscall.InotifyAddWatch(fd, dir, mask)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	n := &inotifyNotifier{fd: fd, wd: wd}
+	go n.readEvents(changed)
+	return n, nil
+}
+
+// 移除监控会产生IN_IGNORED事件，使阻塞的read返回，再关闭fd
+func (n *inotifyNotifier) Close() {
+	syscall.InotifyRmWatch(n.fd, uint32(n.wd))
+}
+
+func (n *inotifyNotifier) readEvents(changed chan<- string) {
+	defer syscall.Close(n.fd)
+
+	buf := make([]byte, (syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)*16)
+	for {
+		l, err := syscall.Read(n.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || l <= 0 {
+			common.DefaultLogger().Errorf("Read inotify events failed, error=%v", err)
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= l; {
+			e := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBuf := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(e.Len)]
+			off += syscall.SizeofInotifyEvent + int(e.Len)
+
+			if e.Mask&syscall.IN_IGNORED != 0 {
+				return
+			}
+			name := string(nameBuf)
+			for i, c := range nameBuf {
+				if c == 0 {
+					name = string(nameBuf[:i])
+					break
+				}
+			}
+			select {
+			case changed <- name:
+			default:
+				// 通道满时丢弃，定时检查仍会校验该文件
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !linux
+// +build !linux
+
+package p2p
+
+import (
+	"io/ioutil"
+	"time"
+)
+
+// 不支持inotify的平台，定时扫描目录，根据文件大小与修改时间判断是否变化
+type pollNotifier struct {
+	quitChan chan struct{}
+}
+
+type pollState struct {
+	size    int64
+	modTime time.Time
+}
+
+func newFileNotifier(dir string, changed chan<- string) (fileNotifier, error) {
+	if _, err := ioutil.ReadDir(dir); err != nil {
+		return nil, err
+	}
+	n := &pollNotifier{quitChan: make(chan struct{})}
+	go n.poll(dir, changed)
+	return n, nil
+}
+
+func (n *pollNotifier) Close() {
+	close(n.quitChan)
+}
+
+func (n *pollNotifier) poll(dir string, changed chan<- string) {
+	states := make(map[string]pollState)
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-n.quitChan:
+			return
+		case <-tick.C:
+		}
+
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			st := pollState{size: fi.Size(), modTime: fi.ModTime()}
+			if old, ok := states[fi.Name()]; ok && old == st {
+				continue
+			}
+			states[fi.Name()] = st
+			select {
+			case changed <- fi.Name():
+			default:
+			}
+		}
+	}
+}
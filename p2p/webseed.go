@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/flowctrl"
+)
+
+const (
+	// 同时从源站下载的Piece数
+	MAX_WEBSEED_PIECES = 2
+
+	// 从源站下载一个Piece的超时时间
+	webSeedTimeout = 60 * time.Second
+)
+
+// 从源站下载的Piece
+type webSeedPiece struct {
+	index int
+	data  []byte
+	err   error
+}
+
+// 通过HTTP Range请求从源站下载Piece，源站地址加上文件名即为文件的URL
+type webSeeder struct {
+	m        *MetaInfo
+	offsets  []int64
+	client   *http.Client
+	limiters []*flowctrl.TokenBucket // 与从Peer下载共用速率限制
+	log      common.Logger
+}
+
+func newWebSeeder(m *MetaInfo, l common.Logger, limiters ...*flowctrl.TokenBucket) *webSeeder {
+	offsets, _ := m.fileOffsets()
+	return &webSeeder{
+		m:        m,
+		offsets:  offsets,
+		client:   &http.Client{Timeout: webSeedTimeout},
+		limiters: limiters,
+		log:      l,
+	}
+}
+
+func (w *webSeeder) fileURL(seed string, fd *FileDict) string {
+	names := strings.Split(fd.Name, "/")
+	for i := range names {
+		names[i] = url.PathEscape(names[i])
+	}
+	return strings.TrimSuffix(seed, "/") + "/" + strings.Join(names, "/")
+}
+
+// 下载一个Piece，失败时依次尝试其它源站
+func (w *webSeeder) fetchPiece(index int, length int) *webSeedPiece {
+	seeds := w.m.WebSeeds
+	var err error
+	for i := range seeds {
+		seed := seeds[(index+i)%len(seeds)]
+		data := make([]byte, length)
+		if err = w.fetchRange(seed, data, int64(index)*w.m.PieceLen); err == nil {
+			return &webSeedPiece{index: index, data: data}
+		}
+		w.log.Errorf("Fetch piece %v from web seed %s failed, error=%v", index, seed, err)
+	}
+	return &webSeedPiece{index: index, err: err}
+}
+
+// 读取全局偏移off开始的数据，跨文件时分别请求，文件对齐填充与最后一个Piece补0的部分保持为0
+func (w *webSeeder) fetchRange(seed string, buf []byte, off int64) error {
+	end := off + int64(len(buf))
+	for i, fd := range w.m.Files {
+		start := w.offsets[i]
+		if start < off {
+			start = off
+		}
+		stop := min64(end, w.offsets[i]+fd.Length)
+		if start >= stop {
+			continue
+		}
+		fileOff := fd.Offset + start - w.offsets[i]
+		if err := w.get(w.fileURL(seed, fd), buf[start-off:stop-off], fileOff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *webSeeder) get(u string, buf []byte, off int64) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(buf))-1))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body := flowctrl.NewBucketReader(resp.Body, w.limiters...)
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// 源站不支持Range时返回整个文件，跳过前面的数据
+		if _, err = io.CopyN(ioutil.Discard, body, off); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unexpected status %s from %s", resp.Status, u)
+	}
+	_, err = io.ReadFull(body, buf)
+	return err
+}
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 写入磁盘时按该大小对齐分块
+	WRITE_CHUNK_SIZE = 1024 * 1024
+)
+
+// 支持写缓冲的FileStore
+type writeBuffered interface {
+	SetWriteBuffer(budget int64)
+	Flush() error
+}
+
+// 支持在设置了IO优先级的线程上读写的FileStore
+type diskScheduled interface {
+	SetDiskWorkers(w *diskWorkers)
+}
+
+// 连续的一段待写入数据
+type writeRun struct {
+	off  int64
+	data []byte
+}
+
+func (r *writeRun) end() int64 {
+	return r.off + int64(len(r.data))
+}
+
+// 延迟写入：合并相邻的Piece，超过内存上限时按偏移顺序、以对齐的大块写入磁盘，减少随机IO
+type writeBuffer struct {
+	lock   sync.Mutex
+	budget int64
+	size   int64
+	runs   []*writeRun // 按偏移排序，相邻的数据已合并
+	write  func(p []byte, off int64) (int, error)
+	log    common.Logger
+}
+
+func newWriteBuffer(budget int64, write func(p []byte, off int64) (int, error), l common.Logger) *writeBuffer {
+	return &writeBuffer{budget: budget, write: write, log: l}
+}
+
+func (w *writeBuffer) add(p []byte, off int64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	end := off + int64(len(p))
+	i := sort.Search(len(w.runs), func(i int) bool { return w.runs[i].off >= off })
+	if (i > 0 && w.runs[i-1].end() > off) || (i < len(w.runs) && w.runs[i].off < end) {
+		// 与缓冲中的数据重叠，先写入已缓冲的数据，保证写入顺序
+		if err := w.flushLocked(); err != nil {
+			return err
+		}
+		_, err := w.write(p, off)
+		return err
+	}
+
+	switch {
+	case i > 0 && w.runs[i-1].end() == off:
+		prev := w.runs[i-1]
+		prev.data = append(prev.data, p...)
+		if i < len(w.runs) && w.runs[i].off == end {
+			prev.data = append(prev.data, w.runs[i].data...)
+			w.runs = append(w.runs[:i], w.runs[i+1:]...)
+		}
+	case i < len(w.runs) && w.runs[i].off == end:
+		next := w.runs[i]
+		next.data = append(append(make([]byte, 0, len(p)+len(next.data)), p...), next.data...)
+		next.off = off
+	default:
+		run := &writeRun{off: off, data: append([]byte(nil), p...)}
+		w.runs = append(w.runs, nil)
+		copy(w.runs[i+1:], w.runs[i:])
+		w.runs[i] = run
+	}
+
+	w.size += int64(len(p))
+	if w.size > w.budget {
+		return w.flushLocked()
+	}
+	return nil
+}
+
+// 用缓冲中还没有写入的数据覆盖从磁盘读出的数据
+func (w *writeBuffer) overlay(p []byte, off int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	end := off + int64(len(p))
+	i := sort.Search(len(w.runs), func(i int) bool { return w.runs[i].end() > off })
+	for ; i < len(w.runs) && w.runs[i].off < end; i++ {
+		r := w.runs[i]
+		from, to := max64(r.off, off), min64(r.end(), end)
+		copy(p[from-off:to-off], r.data[from-r.off:to-r.off])
+	}
+}
+
+func (w *writeBuffer) flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.flushLocked()
+}
+
+func (w *writeBuffer) flushLocked() (err error) {
+	for _, r := range w.runs {
+		if e := w.writeAligned(r); e != nil {
+			w.log.Errorf("Flush write buffer failed, offset=%v, length=%v, error=%v", r.off, len(r.data), e)
+			err = e
+		}
+	}
+	w.runs, w.size = nil, 0
+	return
+}
+
+// 第一块写到对齐的边界，之后每次写入WRITE_CHUNK_SIZE
+func (w *writeBuffer) writeAligned(r *writeRun) error {
+	off, data := r.off, r.data
+	for len(data) > 0 {
+		n := WRITE_CHUNK_SIZE - off%WRITE_CHUNK_SIZE
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+		if _, err := w.write(data[:n], off); err != nil {
+			return err
+		}
+		off += n
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 记录每次写入的偏移与长度，数据写到data中
+type recordWriter struct {
+	data   []byte
+	writes [][2]int64
+}
+
+func (r *recordWriter) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(r.data)) {
+		r.data = append(r.data, make([]byte, end-int64(len(r.data)))...)
+	}
+	copy(r.data[off:], p)
+	r.writes = append(r.writes, [2]int64{off, int64(len(p))})
+	return len(p), nil
+}
+
+func TestWriteBufferCoalesce(t *testing.T) {
+	rw := &recordWriter{}
+	w := &writeBuffer{budget: 1 << 30, write: rw.WriteAt}
+	// 乱序写入的相邻块合并为一段
+	for _, off := range []int64{4, 0, 12, 8} {
+		if err := w.add(bytes.Repeat([]byte{byte('a' + off/4)}, 4), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.runs) != 1 || w.runs[0].off != 0 || len(w.runs[0].data) != 16 {
+		t.Fatalf("blocks are not coalesced: %v runs", len(w.runs))
+	}
+
+	// 还没有写入磁盘的数据在读取时覆盖
+	p := make([]byte, 6)
+	w.overlay(p, 2)
+	if string(p) != "aabbbb" {
+		t.Fatalf("overlay=%q", p)
+	}
+	if len(rw.writes) != 0 {
+		t.Fatalf("written before flush: %v", rw.writes)
+	}
+
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if string(rw.data) != "aaaabbbbccccdddd" || len(rw.writes) != 1 || w.size != 0 {
+		t.Fatalf("flush wrote %q in %v writes", rw.data, len(rw.writes))
+	}
+}
+
+func TestWriteBufferOverlap(t *testing.T) {
+	rw := &recordWriter{}
+	w := &writeBuffer{budget: 1 << 30, write: rw.WriteAt}
+	w.add([]byte("aaaa"), 0)
+	// 重叠的写入在已缓冲的数据之后写入
+	if err := w.add([]byte("bb"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if string(rw.data) != "aabb" || len(w.runs) != 0 {
+		t.Fatalf("data=%q, runs=%v", rw.data, len(w.runs))
+	}
+}
+
+func TestWriteBufferBudget(t *testing.T) {
+	rw := &recordWriter{}
+	w := &writeBuffer{budget: 6, write: rw.WriteAt}
+	w.add([]byte("aaaa"), 0)
+	w.add([]byte("cccc"), 8)
+	if len(rw.writes) != 2 || w.size != 0 || len(w.runs) != 0 {
+		t.Fatalf("not flushed over budget: writes=%v, size=%v", rw.writes, w.size)
+	}
+}
+
+// 第一块写到WRITE_CHUNK_SIZE的边界，之后按WRITE_CHUNK_SIZE写入
+func TestWriteBufferAligned(t *testing.T) {
+	rw := &recordWriter{}
+	w := &writeBuffer{budget: 1 << 30, write: rw.WriteAt}
+	off := int64(WRITE_CHUNK_SIZE - 100)
+	w.add(make([]byte, 2*WRITE_CHUNK_SIZE+200), off)
+	w.flush()
+	want := [][2]int64{
+		{off, 100},
+		{WRITE_CHUNK_SIZE, WRITE_CHUNK_SIZE},
+		{2 * WRITE_CHUNK_SIZE, WRITE_CHUNK_SIZE},
+		{3 * WRITE_CHUNK_SIZE, 100},
+	}
+	if len(rw.writes) != len(want) {
+		t.Fatalf("writes=%v, want %v", rw.writes, want)
+	}
+	for i := range want {
+		if rw.writes[i] != want[i] {
+			t.Fatalf("writes=%v, want %v", rw.writes, want)
+		}
+	}
+}
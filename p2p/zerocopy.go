@@ -0,0 +1,117 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+)
+
+var errZeroCopyUnsupported = errors.New("Zero copy is not supported")
+
+// 块数据在文件中的一段，path为空时是对齐产生的空洞或文件末尾之后的数据，发送0
+type fileSegment struct {
+	path   string
+	off    int64
+	n      int64
+	limits *fileLimits // 打开文件时占用的限制
+}
+
+// 写入连接的消息，有segments时消息之后直接从文件发送到连接
+type peerWrite struct {
+	msg      []byte
+	pool     *bufferPool // 不为nil时msg写入后放回缓冲池
+	segments []fileSegment
+	release  bool // 发送RELEASE后写Goroutine退出
+}
+
+// 全局偏移off开始的n字节数据所在的文件段，只支持直接读写本地文件且没有延迟写入的存储
+func (f *fileStore) segments(off, n int64) ([]fileSegment, error) {
+	if f.buffer != nil {
+		return nil, errZeroCopyUnsupported
+	}
+	var segs []fileSegment
+	for index := f.find(off); n > 0 && index < len(f.offsets); index++ {
+		entry := &f.files[index]
+		itemOffset := off - f.offsets[index]
+		if itemOffset < 0 {
+			gap := min64(-itemOffset, n)
+			segs = append(segs, fileSegment{n: gap})
+			off, n, itemOffset = off+gap, n-gap, 0
+		}
+		if n == 0 || itemOffset >= entry.length {
+			continue
+		}
+		o, base, ok := osFileOf(entry.file)
+		if !ok {
+			return nil, errZeroCopyUnsupported
+		}
+		chunk := min64(entry.length-itemOffset, n)
+		segs = append(segs, fileSegment{path: o.filePath, off: base + itemOffset, n: chunk, limits: o.limits})
+		off, n = off+chunk, n-chunk
+	}
+	if n > 0 {
+		segs = append(segs, fileSegment{n: n})
+	}
+	return segs, nil
+}
+
+func osFileOf(file File) (o *osFile, base int64, ok bool) {
+	if of, isOffset := file.(*offsetFile); isOffset {
+		file, base = of.File, of.offset
+	}
+	o, ok = file.(*osFile)
+	return o, base, ok
+}
+
+// 是否可以不经过用户空间发送块：源头节点直接读取本地文件，块数据不压缩、不加密且连接为TCP
+func (s *P2pSession) zeroCopy(p *peer) (*fileStore, bool) {
+	if !s.seeding() || p.codec != "" || s.sealer != nil {
+		return nil, false
+	}
+	if _, ok := p.conn.(*net.TCPConn); !ok {
+		return nil, false
+	}
+	// 校验读取与Piece缓存都需要读出数据
+	fs, ok := s.readStore.(*fileStore)
+	return fs, ok
+}
+
+// 在连接的写Goroutine中调用，Linux上由TCP连接的ReadFrom使用sendfile发送
+func (p *peer) sendSegments(segs []fileSegment, zeros []byte) error {
+	for _, seg := range segs {
+		p.flowctrlWriter.Wait(int(seg.n))
+		if seg.path == "" {
+			for n := seg.n; n > 0; {
+				c, err := p.conn.Write(zeros[:min64(n, int64(len(zeros)))])
+				if err != nil {
+					return err
+				}
+				n -= int64(c)
+			}
+			continue
+		}
+		if err := sendFileSegment(p.conn.(*net.TCPConn), seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendFileSegment(conn *net.TCPConn, seg fileSegment) error {
+	seg.limits.acquire()
+	defer seg.limits.release()
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Seek(seg.off, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := conn.ReadFrom(io.LimitReader(f, seg.n))
+	if err == nil && n < seg.n {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
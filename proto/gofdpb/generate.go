@@ -0,0 +1,5 @@
+// 由gofd.proto生成的gRPC接口类型。需要安装protoc、protoc-gen-go与protoc-gen-go-grpc，
+// 生成后使用 -tags grpc 编译服务端
+package gofdpb
+
+//go:generate protoc -I .. --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ../gofd.proto
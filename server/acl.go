@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 按令牌客户端的ACL校验任务的目的Agent、种子节点与下载目录，失败时code不为0。
+// client为空（如Ha接管的任务）或为节点之间的账号时不校验
+func (s *Server) checkAcl(client string, t *CreateTask) (code int, reason string) {
+	if client == "" || client == s.Cfg.Auth.Username || len(s.Cfg.Acls) == 0 {
+		return 0, ""
+	}
+	r := s.Cfg.AclFor(client)
+	if r == nil {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, no acl for client %s", client)
+		return http.StatusForbidden, "ACL_DENIED"
+	}
+	if t.Upgrade {
+		// 升级Agent只能使用节点之间的账号
+		s.Log.With("taskID", t.Id).Errorf("Recv task, client %s can not upgrade agents", client)
+		return http.StatusForbidden, "UPGRADE_NOT_ALLOWED"
+	}
+
+	for _, ip := range append(append([]string(nil), t.DestIPs...), t.Seeders...) {
+		if !r.AllowAgent(ip) {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, client %s can not dispatch to agent %s", client, ip)
+			return http.StatusForbidden, "AGENT_NOT_ALLOWED"
+		}
+	}
+
+	if t.InMemory || len(t.Pipe) > 0 {
+		return 0, ""
+	}
+	for _, ip := range t.DestIPs {
+		prefixes := r.PathPrefixes(ip)
+		if prefixes == nil {
+			continue
+		}
+		// 没有指定destDir时文件保存在Agent配置的下载目录，Server无法校验
+		if t.DestDir == "" {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, client %s must set destDir for agent %s", client, ip)
+			return http.StatusForbidden, "DEST_DIR_REQUIRED"
+		}
+		if !withinPrefixes(t.DestDir, prefixes) {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, client %s can not write %s on agent %s", client, t.DestDir, ip)
+			return http.StatusForbidden, "DEST_DIR_NOT_ALLOWED"
+		}
+	}
+	return 0, ""
+}
+
+// 按路径的组成部分比较，/data/app不包含/data/application
+func withinPrefixes(p string, prefixes []string) bool {
+	p = path.Clean(filepath.ToSlash(p))
+	for _, prefix := range prefixes {
+		prefix = path.Clean(filepath.ToSlash(prefix))
+		if p == prefix || prefix == "/" || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// 配置了ACL时，令牌客户端只能操作自己创建的任务
+func (s *Server) ownTask(client string, ct *CachedTaskInfo) bool {
+	if client == "" || client == s.Cfg.Auth.Username || len(s.Cfg.Acls) == 0 {
+		return true
+	}
+	return ct.client == client
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/xtfly/gofd/common"
+)
+
+func testAclServer(t *testing.T) *Server {
+	cfg := &common.Config{Server: true, Control: &common.Control{}}
+	cfg.Net.AgentMgntPort = 45001
+	cfg.Net.AgentDataPort = 45002
+	cfg.Auth.Username = "gofd"
+	cfg.Auth.Passowrd = "yrsK+2iiwPqecImH7obTUm1vhnvvQzFmYYiOz5oqaoc="
+	cfg.Auth.Factor = "9427e80d"
+	cfg.Auth.Crc = "63F7"
+	cfg.Acls = []*common.AclRule{
+		{Client: "ci", Agents: []string{"10.0.0.0/24"}, Paths: []*common.AclPath{
+			{Agents: []string{"10.0.0.2"}, Prefixes: []string{"/data/app"}},
+		}},
+		{Client: "ops"},
+	}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return &Server{BaseService: common.BaseService{Cfg: cfg, Log: common.DefaultLogger()}}
+}
+
+func TestCheckAcl(t *testing.T) {
+	s := testAclServer(t)
+	cases := []struct {
+		name   string
+		client string
+		task   *CreateTask
+		code   int
+		reason string
+	}{
+		{"node account", "gofd", &CreateTask{DestIPs: []string{"192.168.1.2"}, Upgrade: true}, 0, ""},
+		{"no client", "", &CreateTask{DestIPs: []string{"192.168.1.2"}}, 0, ""},
+		{"unknown client", "dev", &CreateTask{DestIPs: []string{"10.0.0.3"}}, http.StatusForbidden, "ACL_DENIED"},
+		{"upgrade", "ops", &CreateTask{DestIPs: []string{"10.0.0.3"}, Upgrade: true}, http.StatusForbidden, "UPGRADE_NOT_ALLOWED"},
+		{"unrestricted client", "ops", &CreateTask{DestIPs: []string{"192.168.1.2"}}, 0, ""},
+		{"agent allowed", "ci", &CreateTask{DestIPs: []string{"10.0.0.3"}}, 0, ""},
+		{"agent not allowed", "ci", &CreateTask{DestIPs: []string{"10.0.1.3"}}, http.StatusForbidden, "AGENT_NOT_ALLOWED"},
+		{"seeder not allowed", "ci", &CreateTask{DestIPs: []string{"10.0.0.3"}, Seeders: []string{"10.0.1.3"}}, http.StatusForbidden, "AGENT_NOT_ALLOWED"},
+		// 没有指定destDir时文件写到Agent的下载目录，不能按dispatchFiles校验
+		{"no dest dir", "ci", &CreateTask{DispatchFiles: []string{"/data/app/a.tar"}, DestIPs: []string{"10.0.0.2"}}, http.StatusForbidden, "DEST_DIR_REQUIRED"},
+		{"dest dir allowed", "ci", &CreateTask{DestIPs: []string{"10.0.0.2"}, DestDir: "/data/app/{name}"}, 0, ""},
+		{"dest dir is prefix", "ci", &CreateTask{DestIPs: []string{"10.0.0.2"}, DestDir: "/data/app"}, 0, ""},
+		{"dest dir not allowed", "ci", &CreateTask{DestIPs: []string{"10.0.0.2"}, DestDir: "/data/application"}, http.StatusForbidden, "DEST_DIR_NOT_ALLOWED"},
+		{"dest dir escapes", "ci", &CreateTask{DestIPs: []string{"10.0.0.2"}, DestDir: "/data/app/../etc"}, http.StatusForbidden, "DEST_DIR_NOT_ALLOWED"},
+		{"agent without paths", "ci", &CreateTask{DestIPs: []string{"10.0.0.3"}, DestDir: "/etc"}, 0, ""},
+		{"in memory", "ci", &CreateTask{DestIPs: []string{"10.0.0.2"}, InMemory: true}, 0, ""},
+	}
+	for _, c := range cases {
+		code, reason := s.checkAcl(c.client, c.task)
+		if code != c.code || reason != c.reason {
+			t.Errorf("%s: checkAcl=%v %s, want %v %s", c.name, code, reason, c.code, c.reason)
+		}
+	}
+}
+
+func TestWithinPrefixes(t *testing.T) {
+	cases := []struct {
+		path     string
+		prefixes []string
+		within   bool
+	}{
+		{"/data/app", []string{"/data/app"}, true},
+		{"/data/app/v1", []string{"/data/app/"}, true},
+		{"/data/application", []string{"/data/app"}, false},
+		{"/data/app/../etc", []string{"/data/app"}, false},
+		{"/etc", []string{"/data", "/"}, true},
+		{"/etc", nil, false},
+	}
+	for _, c := range cases {
+		if got := withinPrefixes(c.path, c.prefixes); got != c.within {
+			t.Errorf("withinPrefixes(%s, %v)=%v, want %v", c.path, c.prefixes, got, c.within)
+		}
+	}
+}
+
+// 令牌客户端只能操作自己创建的任务
+func TestOwnTask(t *testing.T) {
+	s := testAclServer(t)
+	ct := &CachedTaskInfo{client: "ci"}
+	cases := []struct {
+		client string
+		own    bool
+	}{
+		{"ci", true},
+		{"ops", false},
+		{"gofd", true},
+		{"", true},
+	}
+	for _, c := range cases {
+		if got := s.ownTask(c.client, ct); got != c.own {
+			t.Errorf("ownTask(%q)=%v, want %v", c.client, got, c.own)
+		}
+	}
+
+	// 重复提交其它客户端的任务时在比较任务内容之前拒绝
+	if cti, code, reason := s.resubmitTask(&CreateTask{Id: "1", DestIPs: []string{"10.0.0.3"}}, ct, "ops"); cti != nil || code != http.StatusForbidden || reason != "ACL_DENIED" {
+		t.Fatalf("resubmitTask=%v %s", code, reason)
+	}
+}
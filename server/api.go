@@ -1,35 +1,211 @@
 package server
 
 //----------------------------------------
-import "time"
+import (
+	"time"
+
+	"github.com/xtfly/gofd/p2p"
+)
 
 // 创建分发任务
 type CreateTask struct {
 	Id            string   `json:"id"`
 	DispatchFiles []string `json:"dispatchFiles"`
 	DestIPs       []string `json:"destIPs"`
+	WebSeeds      []string `json:"webSeeds,omitempty"`     // 可选的HTTP(S)源站，Agent没有可用的Peer时直接下载
+	NoCompress    bool     `json:"noCompress,omitempty"`   // 分发已压缩的文件时，传输时不再压缩
+	PreviousPath  string   `json:"previousPath,omitempty"` // Agent上旧版本文件的目录，相同的数据从本地复制
+	PieceLen      int64    `json:"pieceLen,omitempty"`     // Piece的长度，为0时使用Server配置
+	BundleSize    int64    `json:"bundleSize,omitempty"`   // 长度小于该值的连续文件打包传输，Agent下载完成后解包，为0时使用Server配置
+	Trackers      []string `json:"trackers,omitempty"`     // 备用的Server管理地址，Agent上报状态失败时依次尝试
+	Encrypt       bool     `json:"encrypt,omitempty"`      // 节点之间使用任务密钥加密块数据
+	Priority      int      `json:"priority,omitempty"`     // 排队的优先级，越大越先运行
+	Webhooks      []string `json:"webhooks,omitempty"`     // 任务事件的回调地址，与Server配置的地址都会收到
+	KeepLinks     bool     `json:"keepLinks,omitempty"`    // 目录中指向目录内的相对软链接在Agent上创建为软链接
+	Seeders       []string `json:"seeders,omitempty"`      // 在dispatchFiles相同路径上已有完整文件的Agent，与Server一起作为源头上传
+	TrustSeeders  bool     `json:"trustSeeders,omitempty"` // 种子节点只检查文件的长度与修改时间，不重新计算所有Piece的摘要
+	SeedSample    int      `json:"seedSample,omitempty"`   // trustSeeders时种子节点随机抽样校验的Piece百分比，0表示不抽样
+	Sequential    bool     `json:"sequential,omitempty"`   // Agent按顺序下载Piece，下载过程中即可读取已完成的数据
+	InMemory      bool     `json:"inMemory,omitempty"`     // Agent只在内存中保存下载的数据，不写入磁盘
+	MetaByURI     bool     `json:"metaByURI,omitempty"`    // 只给Agent下发任务URI，Agent从Server获取元数据
+	AllAgents     bool     `json:"allAgents,omitempty"`    // destIPs为空时，分发给所有通过心跳注册且存活的Agent
+	Selector      string   `json:"selector,omitempty"`     // destIPs为空时，分发给标签匹配的存活Agent，如role=web,region=eu
+	DedupFiles    bool     `json:"dedupFiles,omitempty"`   // 内容相同的文件只传输一次，Agent上创建硬链接
+	DestDir       string   `json:"destDir,omitempty"`      // Agent上的下载目录模板，支持{taskId}、{date}、{name}，需要在Agent配置的destDirs之下
+
+	// Agent下载完成后依次执行的命令或调用的地址，需要在Agent配置的白名单中
+	Hooks []*p2p.Hook `json:"hooks,omitempty"`
+
+	// 文件的下载优先级，键为元数据中的文件名（分发目录时包含目录名）或path.Match的模式，越大越先下载，没有匹配的文件为0
+	FilePriorities map[string]int `json:"filePriorities,omitempty"`
+
+	// 所有Agent结束后，完成的Agent达到该百分比时任务成功，否则失败，不计入optionalIPs。
+	// 为0并且没有optionalIPs时，所有Agent结束即成功
+	SuccessPercent int `json:"successPercent,omitempty"`
+	// 失败不影响任务结果的Agent。设置后其它Agent默认需要全部完成
+	OptionalIPs []string `json:"optionalIPs,omitempty"`
+
+	// Agent把数据按顺序写入该命令的标准输入，不写入磁盘，如["docker","load"]。需要在Agent配置的hookCommands中
+	Pipe []string `json:"pipe,omitempty"`
+
+	// Agent完成或失败时上报传输报告，通过/api/v1/server/tasks/:id/reports查询
+	CollectReports bool `json:"collectReports,omitempty"`
+
+	// Agent下载完成后继续上传的时间，单位为秒，为0时使用Agent的配置
+	SeedLinger int `json:"seedLinger,omitempty"`
+	// Agent下载完成后又有该个数的Agent完成时停止上传，为0时不限制
+	SeedUntil int `json:"seedUntil,omitempty"`
+
+	// 只分发文件中的部分数据，Agent在已有文件的相同位置写入，不截断文件。设置后dispatchFiles可以为空
+	Ranges []*p2p.FileRange `json:"ranges,omitempty"`
+
+	// 任务开始后在所有节点上设置的传输限制，与PATCH /api/v1/tasks/:id相同
+	Limits *p2p.TaskLimits `json:"limits,omitempty"`
+
+	// 任务提交后的最长时间，单位为秒，超过后失败并删除Agent上未完成的文件，为0时使用Server的配置
+	Ttl int `json:"ttl,omitempty"`
+	// 运行中所有Agent的进度在该时间内都没有增长时失败，单位为秒，为0时使用Server的配置
+	StallTimeout int `json:"stallTimeout,omitempty"`
+
+	// 为chain或tree时Agent排成流水线或以Server为根的树，每个Agent只从一个上游下载，
+	// 适合同构的数据中心。为空时按分支连接
+	Topology string `json:"topology,omitempty"`
+	// tree时每个节点的下游数，为0时为2
+	Fanout int `json:"fanout,omitempty"`
+
+	// 分发Agent的新版本程序，dispatchFiles只能是一个文件。需要Server配置签名私钥，
+	// Agent配置了allowUpgrade并校验签名后替换程序文件并重启，下载中的任务在重启后继续
+	Upgrade bool `json:"upgrade,omitempty"`
+
+	// 使用Server上保存的任务模板，请求中没有设置的字段使用模板中的值
+	Template string `json:"template,omitempty"`
+	// 制品的name:version。设置了dispatchFiles或ranges时，创建的元数据保存到制品目录；
+	// 都没有设置时，使用目录中的文件与元数据，文件没有变化时不再计算摘要
+	Artifact string `json:"artifact,omitempty"`
+
+	// 任务所属的命名空间，受其配额限制。为空时使用调用方令牌客户端所在的命名空间
+	Namespace string `json:"namespace,omitempty"`
+
+	// 复制模式下每个Piece在目的Agent中的目标副本数。Agent不再下载全部数据，由Server把副本数不足的Piece
+	// 分配给空闲的Agent下载，直到每个Piece都达到该副本数。任务持续运行，直到取消或超过ttl
+	Replication int `json:"replication,omitempty"`
+}
+
+// 命名空间的配额与当前用量，配额为0时不限制
+type NamespaceUsage struct {
+	Name             string `json:"name"`
+	ActiveTasks      int    `json:"activeTasks"`
+	MaxActiveTasks   int    `json:"maxActiveTasks"`
+	BytesToday       int64  `json:"bytesToday"` // 当天已分发的数据量，文件长度乘以目的Agent数
+	MaxBytesPerDay   int64  `json:"maxBytesPerDay"`
+	MaxAgentsPerTask int    `json:"maxAgentsPerTask"`
+}
+
+// 试运行创建任务的结果
+type DryRunReport struct {
+	Feasible bool   `json:"feasible"`        // 元数据创建成功，非可选的Agent都可以接收任务并且数据端口可达
+	Error    string `json:"error,omitempty"` // 创建元数据失败的原因
+
+	DispatchFiles []string `json:"dispatchFiles"`
+	DestIPs       []string `json:"destIPs"` // 选择的目的Agent
+
+	FileCount   int     `json:"fileCount"`
+	TotalLength int64   `json:"totalLength"`
+	PieceLen    int64   `json:"pieceLen"`
+	PieceCount  int     `json:"pieceCount"`
+	MetaSeconds float64 `json:"metaSeconds"` // 创建元数据的时间，复用制品的元数据时接近0
+
+	Agents map[string]*DryRunAgent `json:"agents"` // 目的Agent与种子节点
+}
+
+type DryRunAgent struct {
+	Seeder    bool   `json:"seeder,omitempty"`
+	Optional  bool   `json:"optional,omitempty"`
+	Accepted  bool   `json:"accepted"`  // 下载目录、可用空间与钩子等检查通过，可以接收任务
+	Reachable bool   `json:"reachable"` // 数据端口可以连接
+	Zone      string `json:"zone,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	DataAddr  string `json:"dataAddr,omitempty"`  // 探测的数据地址
+	LatencyMs int64  `json:"latencyMs,omitempty"` // 连接数据端口的时间
+	Error     string `json:"error,omitempty"`     // 不能接收任务或连接失败的原因
+	ErrorCode string `json:"errorCode,omitempty"` // 失败的错误码，如INSUFFICIENT_DISK_SPACE、PEER_UNREACHABLE
+}
+
+// 调整任务的优先级
+type TaskPriority struct {
+	Priority int `json:"priority"`
+}
+
+// 调度队列
+type TaskQueue struct {
+	Max     int           `json:"max"` // 同时运行的最大任务数
+	Running []*QueuedTask `json:"running"`
+	Queued  []*QueuedTask `json:"queued"` // 按运行的先后排列
+}
+
+type QueuedTask struct {
+	Id       string `json:"id"`
+	Priority int    `json:"priority"`
 }
 
 // 查询分发任务
 type TaskInfo struct {
-	Id     string `json:"id"`
-	Status string `json:"status"`
+	Id        string `json:"id"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`     // 任务失败的原因
+	ErrorCode string `json:"errorCode,omitempty"` // 任务失败的错误码，如FILE_NOT_FOUND
+
+	DispatchFiles []string `json:"dispatchFiles"`
+
+	Files []*TaskFile `json:"files,omitempty"` // 创建元数据后任务中的所有文件
 
 	StartedAt  time.Time `json:"startedAt"`
 	FinishedAt time.Time `json:"finishedAt"`
 
 	DispatchInfos map[string]*DispatchInfo `json:"dispatchInfos,omitempty"`
+
+	SuccessPercent int               `json:"successPercent,omitempty"` // 任务成功需要完成的Agent百分比
+	Failures       map[string]string `json:"failures,omitempty"`       // 任务结束时失败的Agent及原因
+
+	BadPeers map[string][]string `json:"badPeers,omitempty"` // Agent上报发送坏Piece的Peer的数据地址，值为上报的Agent
+
+	Transfers map[string]*p2p.TransferReport `json:"-"` // Agent上报的传输报告，单独查询
+
+	Replicas *ReplicaStatus `json:"replicas,omitempty"` // 复制模式下各Piece的副本情况
+}
+
+// 复制模式下各Piece在Agent中的副本情况，不包括Server
+type ReplicaStatus struct {
+	Target          int `json:"target"`          // 目标副本数
+	MinReplicas     int `json:"minReplicas"`     // 副本最少的Piece的副本数
+	UnderReplicated int `json:"underReplicated"` // 副本数不足目标的Piece个数
+	Assigned        int `json:"assigned"`        // 已分配给Agent还没有完成的Piece个数
 }
 
 // 单个IP的分发信息
 type DispatchInfo struct {
 	Status          string  `json:"status"`
 	PercentComplete float32 `json:"percentComplete"`
+	Speed           int64   `json:"speed"`               // Agent最近上报的下载速率，单位为字节每秒
+	Error           string  `json:"error,omitempty"`     // 失败的原因
+	ErrorCode       string  `json:"errorCode,omitempty"` // 失败的错误码，如NO_SPACE、PEER_UNREACHABLE
+	Zone            string  `json:"zone,omitempty"`      // Agent创建任务时返回的zone
+	Mode            string  `json:"mode,omitempty"`      // Agent创建任务时返回的运行模式
+	Optional        bool    `json:"optional,omitempty"`  // 失败不影响任务的结果
 
 	StartedAt  time.Time `json:"startedAt"`
 	FinishedAt time.Time `json:"finishedAt"`
 
 	DispatchFiles []*DispatchFile `json:"dispatchFiles"`
+
+	FileChecks map[string]string `json:"fileChecks,omitempty"` // Agent下载完成并校验了摘要的文件，值为VERIFIED或FAILED
+}
+
+// 任务中的单个文件
+type TaskFile struct {
+	Name   string `json:"name"`
+	Length int64  `json:"length"`
+	Sum    string `json:"sum,omitempty"` // 文件内容的摘要，十六进制，算法与元数据的hash相同，默认为sha1
 }
 
 // 单个文件分发状态
@@ -49,6 +225,9 @@ const (
 	TaskStatus_Completed
 	TaskStatus_InProgress
 	TaskStatus_FileNotExist
+	TaskStatus_Canceled
+	TaskStatus_Queued
+	TaskStatus_Paused
 )
 
 // convert task status to a string
@@ -68,6 +247,12 @@ func (ts TaskStatus) String() string {
 		return "INPROGESS"
 	case TaskStatus_FileNotExist:
 		return "FILE_NOT_EXISTED"
+	case TaskStatus_Canceled:
+		return "CANCELED"
+	case TaskStatus_Queued:
+		return "QUEUED"
+	case TaskStatus_Paused:
+		return "PAUSED"
 	default:
 		return "TASK_NOT_EXISTED"
 	}
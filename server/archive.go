@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
+)
+
+//------------------------------------------
+// GET /api/v1/server/artifacts/:name/:version/export
+// 导出制品的元数据与文件为tar归档，读取时校验Piece的摘要。归档离线带到不能连通的站点，
+// 导入该站点的Server后即可作为源头分发，之后再由P2P同步
+func (s *Server) ExportArtifact(c echo.Context) error {
+	key := c.Param("name") + ":" + c.Param("version")
+	s.Log.Infof("Recv export artifact, artifact=%s", key)
+	a, mi, ok := s.catalog.artifact(key)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, "ARTIFACT_NOT_FOUND")
+	}
+	if len(a.Ranges) > 0 {
+		// 文件中的一段数据在导入时无法还原到原来的文件
+		return common.ReplyCode(c, http.StatusBadRequest, "ARTIFACT_HAS_RANGES")
+	}
+	if stamp, err := filesStamp(a.DispatchFiles, nil); err != nil || stamp != a.Stamp {
+		s.Log.Errorf("Export artifact %s failed, files have been changed, error=%v", key, err)
+		return common.ReplyCode(c, http.StatusConflict, "ARTIFACT_CHANGED")
+	}
+
+	fs, totalSize, err := p2p.NewFileStore(mi, p2p.NewFileSystemAdapter(p2p.SizeCheck_Exact), s.Log)
+	if err != nil {
+		s.Log.Errorf("Export artifact %s failed, error=%v", key, err)
+		return common.ReplyError(c, http.StatusInternalServerError, err)
+	}
+	defer fs.Close()
+	vfs, err := p2p.NewVerifyingReadFileStore(fs, mi, totalSize, s.Log)
+	if err != nil {
+		return common.ReplyError(c, http.StatusInternalServerError, err)
+	}
+
+	res := c.Response()
+	res.Header().Set("Content-Type", "application/x-tar")
+	res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.tar"`, a.Name, a.Version))
+	res.WriteHeader(http.StatusOK)
+	start := time.Now()
+	if err = p2p.WriteArchive(res.Writer(), vfs, mi); err != nil {
+		// 已经发送了响应头，归档不完整，导入时失败
+		s.Log.Errorf("Export artifact %s aborted, error=%v", key, err)
+		return nil
+	}
+	s.Log.Infof("Exported artifact %s, length=%v (%.2f seconds)", key, mi.Length, time.Now().Sub(start).Seconds())
+	return nil
+}
+
+//------------------------------------------
+// POST /api/v1/server/artifacts/:name/:version/import
+// 请求体为导出的tar归档，解压到importDir下并校验所有Piece后登记为制品，之后推送制品时不再计算摘要
+func (s *Server) ImportArtifact(c echo.Context) error {
+	name, version := c.Param("name"), c.Param("version")
+	key := name + ":" + version
+	s.Log.Infof("Recv import artifact, artifact=%s", key)
+	if s.Cfg.Control.ImportDir == "" {
+		return common.ReplyCode(c, http.StatusBadRequest, "IMPORT_NOT_ENABLED")
+	}
+	if strings.ContainsAny(name+version, `/\`) || name == ".." || version == ".." {
+		return common.ReplyCode(c, http.StatusBadRequest, "INVALID_ARTIFACT")
+	}
+
+	// 先解压到临时目录，校验通过后替换已导入的相同版本
+	dir := filepath.Join(s.Cfg.Control.ImportDir, name, version)
+	tmp := dir + ".importing"
+	os.RemoveAll(tmp)
+	start := time.Now()
+	mi, err := p2p.ReadArchive(c.Request().Body(), tmp)
+	if err == nil {
+		if err = os.RemoveAll(dir); err == nil {
+			err = os.Rename(tmp, dir)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		s.Log.Errorf("Import artifact %s failed, error=%v", key, err)
+		return common.ReplyError(c, http.StatusBadRequest, err)
+	}
+
+	// 元数据中的路径指向导入的目录，dispatchFiles为每个文件名的第一级
+	var files []string
+	roots := make(map[string]bool)
+	for _, fd := range mi.Files {
+		fd.Path = dir
+		root := filepath.Join(dir, filepath.FromSlash(strings.SplitN(fd.Name, "/", 2)[0]))
+		if !roots[root] {
+			roots[root] = true
+			files = append(files, root)
+		}
+	}
+	stamp, err := filesStamp(files, nil)
+	if err != nil {
+		s.Log.Errorf("Import artifact %s failed, error=%v", key, err)
+		return common.ReplyError(c, http.StatusInternalServerError, err)
+	}
+	a := &Artifact{
+		Name:          name,
+		Version:       version,
+		DispatchFiles: files,
+		InfoHash:      mi.InfoHash(),
+		Length:        mi.Length,
+		CreatedAt:     time.Now(),
+		Stamp:         stamp,
+		Imported:      true,
+	}
+	if err = s.catalog.putArtifact(a, mi); err != nil {
+		s.Log.Errorf("Save catalog failed, error=%v", err)
+		return common.ReplyCode(c, http.StatusInternalServerError, "SAVE_CATALOG_FAILED")
+	}
+	s.Log.Infof("Imported artifact %s, length=%v (%.2f seconds)", key, mi.Length, time.Now().Sub(start).Seconds())
+	return c.JSON(http.StatusOK, a)
+}
@@ -0,0 +1,42 @@
+package server
+
+// 各Agent上报的已下载Piece位图，汇总每个Piece的副本数。只在任务的Goroutine中访问
+type pieceAvailability struct {
+	haves  map[string][]byte
+	counts []int
+}
+
+func newPieceAvailability() *pieceAvailability {
+	return &pieceAvailability{haves: make(map[string][]byte)}
+}
+
+// have为nil时去掉该Agent
+func (pa *pieceAvailability) update(ip string, have []byte) {
+	if old, ok := pa.haves[ip]; ok {
+		pa.add(old, -1)
+		delete(pa.haves, ip)
+	}
+	if have == nil {
+		return
+	}
+	if n := len(have) * 8; n > len(pa.counts) {
+		pa.counts = append(pa.counts, make([]int, n-len(pa.counts))...)
+	}
+	pa.haves[ip] = have
+	pa.add(have, 1)
+}
+
+func (pa *pieceAvailability) add(have []byte, delta int) {
+	for i, b := range have {
+		for j := 0; b != 0; j, b = j+1, b<<1 {
+			if b&0x80 != 0 {
+				pa.counts[i*8+j] += delta
+			}
+		}
+	}
+}
+
+// 位图末尾补齐的位没有设置，长度可能大于Piece数
+func (pa *pieceAvailability) snapshot() []int {
+	return append([]int(nil), pa.counts...)
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtfly/gofd/p2p"
+)
+
+// 可复用的任务模板，创建任务时请求中没有设置的字段使用模板中的值
+type TaskTemplate struct {
+	Name string `json:"name"`
+	CreateTask
+}
+
+// 目录中的制品，以name:version标识，再次分发时复用创建过的元数据
+type Artifact struct {
+	Name          string           `json:"name"`
+	Version       string           `json:"version"`
+	DispatchFiles []string         `json:"dispatchFiles,omitempty"`
+	Ranges        []*p2p.FileRange `json:"ranges,omitempty"`
+	InfoHash      string           `json:"infoHash"`
+	Length        int64            `json:"length"`
+	TaskId        string           `json:"taskId"` // 创建元数据的任务
+	CreatedAt     time.Time        `json:"createdAt"`
+	Stamp         string           `json:"stamp"`              // 本地文件的路径、大小与修改时间的摘要，文件变化后不再复用
+	Imported      bool             `json:"imported,omitempty"` // 从导出的归档导入，没有创建元数据的任务
+}
+
+func (a *Artifact) key() string {
+	return a.Name + ":" + a.Version
+}
+
+type catalogEntry struct {
+	Artifact *Artifact     `json:"artifact"`
+	Meta     *p2p.MetaInfo `json:"meta"` // 没有设置WebSeeds、签名与密钥的元数据
+}
+
+// 保存到文件的内容
+type catalogFile struct {
+	Templates []*TaskTemplate `json:"templates"`
+	Artifacts []*catalogEntry `json:"artifacts"`
+}
+
+// Server上的任务模板与制品目录，配置了catalogFile时每次修改后保存
+type catalog struct {
+	lock      sync.Mutex
+	file      string
+	templates map[string]*TaskTemplate
+	artifacts map[string]*catalogEntry // 以name:version为键
+}
+
+func newCatalog(file string) (*catalog, error) {
+	c := &catalog{
+		file:      file,
+		templates: make(map[string]*TaskTemplate),
+		artifacts: make(map[string]*catalogEntry),
+	}
+	if file == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cf := new(catalogFile)
+	if err = json.Unmarshal(data, cf); err != nil {
+		return nil, fmt.Errorf("Invalid catalog file %s: %v", file, err)
+	}
+	for _, t := range cf.Templates {
+		c.templates[t.Name] = t
+	}
+	for _, e := range cf.Artifacts {
+		c.artifacts[e.Artifact.key()] = e
+	}
+	return c, nil
+}
+
+// 写入临时文件后替换，持有锁时调用
+func (c *catalog) save() error {
+	if c.file == "" {
+		return nil
+	}
+	cf := &catalogFile{Templates: c.listTemplatesLocked()}
+	for _, a := range c.listArtifactsLocked() {
+		cf.Artifacts = append(cf.Artifacts, c.artifacts[a.key()])
+	}
+	data, err := json.MarshalIndent(cf, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
+
+func (c *catalog) putTemplate(t *TaskTemplate) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.templates[t.Name] = t
+	return c.save()
+}
+
+func (c *catalog) template(name string) (*TaskTemplate, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t, ok := c.templates[name]
+	return t, ok
+}
+
+func (c *catalog) deleteTemplate(name string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.templates[name]; !ok {
+		return false, nil
+	}
+	delete(c.templates, name)
+	return true, c.save()
+}
+
+// 按名称排序
+func (c *catalog) listTemplates() []*TaskTemplate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.listTemplatesLocked()
+}
+
+func (c *catalog) listTemplatesLocked() []*TaskTemplate {
+	ts := make([]*TaskTemplate, 0, len(c.templates))
+	for _, t := range c.templates {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Name < ts[j].Name })
+	return ts
+}
+
+// 相同name:version的制品被替换
+func (c *catalog) putArtifact(a *Artifact, mi *p2p.MetaInfo) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.artifacts[a.key()] = &catalogEntry{Artifact: a, Meta: mi}
+	return c.save()
+}
+
+// 返回的元数据是复制的，可以修改
+func (c *catalog) artifact(key string) (*Artifact, *p2p.MetaInfo, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.artifacts[key]
+	if !ok {
+		return nil, nil, false
+	}
+	mi, err := copyMeta(e.Meta)
+	if err != nil {
+		return nil, nil, false
+	}
+	return e.Artifact, mi, true
+}
+
+func (c *catalog) deleteArtifact(key string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.artifacts[key]; !ok {
+		return false, nil
+	}
+	delete(c.artifacts, key)
+	return true, c.save()
+}
+
+// 按名称与版本排序
+func (c *catalog) listArtifacts() []*Artifact {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.listArtifactsLocked()
+}
+
+func (c *catalog) listArtifactsLocked() []*Artifact {
+	as := make([]*Artifact, 0, len(c.artifacts))
+	for _, e := range c.artifacts {
+		as = append(as, e.Artifact)
+	}
+	sort.Slice(as, func(i, j int) bool {
+		if as[i].Name != as[j].Name {
+			return as[i].Name < as[j].Name
+		}
+		return as[i].Version < as[j].Version
+	})
+	return as
+}
+
+// 制品的标识为name:version，名称中可以有冒号，版本中不可以
+func parseArtifact(s string) (name, version string, err error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("Invalid artifact %s, should be name:version", s)
+	}
+	return s[:i], s[i+1:], nil
+}
+
+// Session会修改元数据中的路径，复制一份
+func copyMeta(mi *p2p.MetaInfo) (*p2p.MetaInfo, error) {
+	data, err := json.Marshal(mi)
+	if err != nil {
+		return nil, err
+	}
+	c := new(p2p.MetaInfo)
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 本地文件的路径、大小与修改时间的摘要，对象存储中的文件不检查
+func filesStamp(files []string, ranges []*p2p.FileRange) (string, error) {
+	roots := append([]string{}, files...)
+	for _, r := range ranges {
+		roots = append(roots, r.File)
+	}
+	h := sha1.New()
+	for _, root := range roots {
+		if strings.HasPrefix(root, "s3://") {
+			fmt.Fprintf(h, "%s\n", root)
+			continue
+		}
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				fmt.Fprintf(h, "%s %d %d %o\n", path, fi.Size(), fi.ModTime().UnixNano(), fi.Mode())
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 请求中设置的字段覆盖模板中的值，id、template与artifact不使用模板
+func (tpl *TaskTemplate) apply(t *CreateTask) (*CreateTask, error) {
+	base, err := json.Marshal(&tpl.CreateTask)
+	if err != nil {
+		return nil, err
+	}
+	over, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	overFields := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(base, &fields); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(over, &overFields); err != nil {
+		return nil, err
+	}
+	delete(fields, "id")
+	delete(fields, "template")
+	delete(fields, "artifact")
+	for k, v := range overFields {
+		switch string(v) {
+		case "null", `""`, "[]":
+			continue
+		}
+		fields[k] = v
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	nt := new(CreateTask)
+	if err = json.Unmarshal(data, nt); err != nil {
+		return nil, err
+	}
+	nt.Id, nt.Template, nt.Artifact = t.Id, t.Template, t.Artifact
+	return nt, nil
+}
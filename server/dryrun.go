@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
+)
+
+const (
+	// 试运行时连接Agent数据端口的超时
+	DRY_RUN_PROBE_TIMEOUT = 3 * time.Second
+)
+
+// 试运行创建任务：与创建任务相同地校验参数、选择Agent并创建元数据，
+// 由每个Agent检查下载目录、可用空间与钩子，并探测数据端口是否可以连接，不创建任务也不传输数据。
+// 参数不合法时report为nil，code与reason与创建任务相同
+func (s *Server) dryRunTask(t *CreateTask) (r *DryRunReport, code int, reason string) {
+	if t, code, reason = s.resolveTask(t); code != 0 {
+		return nil, code, reason
+	}
+	if code, reason = s.checkTask(t); code != 0 {
+		return nil, code, reason
+	}
+	s.Log.With("taskID", t.Id).Infof("Recv dry run task, file=%v, ips=%v", t.DispatchFiles, t.DestIPs)
+
+	// 不加入缓存也不运行，只用于创建元数据与下发给Agent的任务
+	ct := NewCachedTaskInfo(s, t)
+	r = &DryRunReport{DispatchFiles: t.DispatchFiles, DestIPs: t.DestIPs, Agents: make(map[string]*DryRunAgent)}
+	start := time.Now()
+	mi, err := ct.createMeta(context.Background(), false)
+	r.MetaSeconds = time.Now().Sub(start).Seconds()
+	if err != nil {
+		ct.log.Errorf("Dry run, create file meta failed, error=%v", err)
+		r.Error = err.Error()
+		return r, http.StatusOK, ""
+	}
+	r.FileCount = len(mi.Files)
+	r.TotalLength = mi.Length
+	r.PieceLen = mi.PieceLen
+	if mi.PieceLen > 0 {
+		r.PieceCount = int((mi.Length + mi.PieceLen - 1) / mi.PieceLen)
+	}
+
+	optional := make(map[string]bool, len(t.OptionalIPs))
+	for _, ip := range t.OptionalIPs {
+		optional[common.StripPort(ip)] = true
+	}
+	ips := make([]string, 0, len(t.DestIPs)+len(t.Seeders))
+	for _, ip := range t.DestIPs {
+		ip = common.StripPort(ip)
+		r.Agents[ip] = &DryRunAgent{Optional: optional[ip]}
+		ips = append(ips, ip)
+	}
+	for _, ip := range t.Seeders {
+		ip = common.StripPort(ip)
+		r.Agents[ip] = &DryRunAgent{Seeder: true}
+		ips = append(ips, ip)
+	}
+	relays := s.registry.relays(ips)
+
+	var wg sync.WaitGroup
+	for _, ip := range ips {
+		wg.Add(1)
+		go func(ip string, a *DryRunAgent) {
+			defer wg.Done()
+			dt := ct.dispatchTask(mi)
+			if a.Seeder {
+				dt.Seed, dt.DestDir = true, ""
+			}
+			ct.checkAgent(ip, dt, a)
+			if a.Accepted {
+				ct.probeAgent(ip, relays[ip], a)
+			}
+		}(ip, r.Agents[ip])
+	}
+	wg.Wait()
+
+	r.Feasible = r.feasible(t.SuccessPercent)
+	return r, http.StatusOK, ""
+}
+
+// 由Agent检查能否接收任务，旧版本的Agent没有检查接口时返回404
+func (ct *CachedTaskInfo) checkAgent(ip string, dt *p2p.DispatchTask, a *DryRunAgent) {
+	if !ct.s.registry.alive(ip) {
+		a.Error, a.ErrorCode = "Agent heartbeat timeout", common.ERR_PEER_UNREACHABLE
+		return
+	}
+	body, err := json.Marshal(dt)
+	if err != nil {
+		a.Error = err.Error()
+		return
+	}
+	rsp, err := ct.s.HttpPost(ip, "/api/v1/agent/tasks/check", body)
+	if err != nil {
+		ct.log.Warnf("Dry run, check task on agent failed, ip=%s, error=%v", ip, err)
+		a.Error, a.ErrorCode = err.Error(), common.ErrorCode(err)
+		return
+	}
+	tcr := &p2p.CreateTaskRsp{}
+	if len(rsp) > 0 {
+		json.Unmarshal(rsp, tcr)
+	}
+	a.Accepted, a.Zone, a.Mode = true, tcr.Zone, tcr.Mode
+}
+
+// 探测Agent的数据端口，通过中继接收连接的Agent探测中继的地址。
+// 只探测TCP连接，使用其它传输方式时不探测
+func (ct *CachedTaskInfo) probeAgent(ip, relay string, a *DryRunAgent) {
+	a.DataAddr = ct.s.agentDataAddr(ip)
+	if relay != "" {
+		a.DataAddr = relay
+	}
+	if t := ct.s.Cfg.Net.Transport; t != "" && t != "tcp" {
+		a.Reachable = true
+		return
+	}
+	start := time.Now()
+	conn, err := ct.s.Cfg.DialContext(context.Background(), &net.Dialer{Timeout: DRY_RUN_PROBE_TIMEOUT}, "tcp", a.DataAddr)
+	if err != nil {
+		ct.log.Warnf("Dry run, probe data address failed, ip=%s, addr=%s, error=%v", ip, a.DataAddr, err)
+		a.Error, a.ErrorCode = err.Error(), common.ERR_PEER_UNREACHABLE
+		return
+	}
+	conn.Close()
+	a.Reachable = true
+	a.LatencyMs = time.Now().Sub(start).Milliseconds()
+}
+
+// 非可选的Agent都可以接收任务并且数据端口可达，指定了successPercent时达到该百分比即可
+func (r *DryRunReport) feasible(successPercent int) bool {
+	if r.Error != "" {
+		return false
+	}
+	total, ok := 0, 0
+	for _, a := range r.Agents {
+		if a.Seeder || a.Optional {
+			continue
+		}
+		total++
+		if a.Accepted && a.Reachable {
+			ok++
+		}
+	}
+	if successPercent == 0 {
+		return ok == total
+	}
+	return ok*100 >= total*successPercent
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	EVENT_AGENT_PROGRESS = "agent.progress" // Agent的下载进度，每秒合并一次
+	EVENT_AGENT_STATUS   = "agent.status"   // Agent的状态变化，失败时带有错误
+
+	// 每个订阅者缓存的事件数，处理不过来时丢弃
+	EVENT_QUEUE_SIZE = 256
+	// 合并进度事件的间隔
+	EVENT_PROGRESS_INTERVAL = time.Second
+	// 没有事件时发送注释，避免被代理断开
+	EVENT_KEEPALIVE_INTERVAL = 15 * time.Second
+)
+
+// 推送给订阅者的任务事件，包括所有的回调事件
+type TaskEvent struct {
+	WebhookEvent
+	Percent   float32 `json:"percent,omitempty"`   // agent.progress时为下载进度
+	Speed     int64   `json:"speed,omitempty"`     // agent.progress时为下载速率，单位为字节每秒
+	Error     string  `json:"error,omitempty"`     // agent.status时为失败原因
+	ErrorCode string  `json:"errorCode,omitempty"` // agent.status时为失败的错误码
+}
+
+// 任务是否已结束，之后不会再有事件
+func (e *TaskEvent) final() bool {
+	switch e.Event {
+	case WEBHOOK_TASK_COMPLETED, WEBHOOK_TASK_FAILED, WEBHOOK_TASK_CANCELED:
+		return true
+	}
+	return false
+}
+
+// 按任务分发事件给订阅者，发送不阻塞任务的Goroutine
+type eventHub struct {
+	sync.Mutex
+	subs map[string]map[chan *TaskEvent]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[string]map[chan *TaskEvent]bool)}
+}
+
+func (h *eventHub) subscribe(taskId string) chan *TaskEvent {
+	ch := make(chan *TaskEvent, EVENT_QUEUE_SIZE)
+	h.Lock()
+	defer h.Unlock()
+	if h.subs[taskId] == nil {
+		h.subs[taskId] = make(map[chan *TaskEvent]bool)
+	}
+	h.subs[taskId][ch] = true
+	return ch
+}
+
+func (h *eventHub) unsubscribe(taskId string, ch chan *TaskEvent) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.subs[taskId], ch)
+	if len(h.subs[taskId]) == 0 {
+		delete(h.subs, taskId)
+	}
+}
+
+func (h *eventHub) publish(e *TaskEvent) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subs[e.TaskId] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (ct *CachedTaskInfo) publish(e *TaskEvent) {
+	e.TaskId, e.Time = ct.id, time.Now()
+	if e.Status == "" {
+		e.Status = ct.ti.Status
+	}
+	ct.s.events.publish(e)
+}
+
+//------------------------------------------
+// GET /api/v1/tasks/:id/events
+// 以Server-Sent Events推送任务的事件，先发送一次任务的状态，任务结束或客户端断开时结束
+func (s *Server) TaskEvents(c echo.Context) error {
+	id := c.Param("id")
+	s.Log.With("taskID", id).Infof("Recv subscribe task events")
+	v, ok := s.cache.Get(id)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	}
+	flusher, ok := c.Response().(http.Flusher)
+	if !ok {
+		return common.ReplyCode(c, http.StatusNotImplemented, "STREAM_NOT_SUPPORTED")
+	}
+	var closed <-chan bool
+	if cn, ok := c.Response().(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+
+	// 先订阅再查询，不会漏掉查询之后的事件
+	ch := s.events.subscribe(id)
+	defer s.events.unsubscribe(id, ch)
+	ti := v.(*CachedTaskInfo).Query()
+
+	c.Response().Header().Set("Content-Type", "text/event-stream")
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().WriteHeader(http.StatusOK)
+	if err := writeEvent(c, "task", ti); err != nil {
+		return nil
+	}
+	flusher.Flush()
+	switch ti.Status {
+	case TaskStatus_Completed.String(), TaskStatus_Failed.String(), TaskStatus_Canceled.String():
+		return nil
+	}
+
+	progress := make(map[string]*TaskEvent)
+	progressTick := time.NewTicker(EVENT_PROGRESS_INTERVAL)
+	defer progressTick.Stop()
+	keepalive := time.NewTicker(EVENT_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	var err error
+	for {
+		select {
+		case <-closed:
+			return nil
+		case <-keepalive.C:
+			_, err = c.Response().Write([]byte(": keepalive\n\n"))
+		case <-progressTick.C:
+			for ip, e := range progress {
+				if err = writeEvent(c, e.Event, e); err != nil {
+					break
+				}
+				delete(progress, ip)
+			}
+		case e := <-ch:
+			if e.Event == EVENT_AGENT_PROGRESS {
+				// 只保留每个Agent最新的进度
+				progress[e.IP] = e
+				continue
+			}
+			delete(progress, e.IP)
+			err = writeEvent(c, e.Event, e)
+			if err == nil && e.final() {
+				flusher.Flush()
+				return nil
+			}
+		}
+		if err != nil {
+			s.Log.With("taskID", id).Debugf("Task events stream closed, error=%v", err)
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(c echo.Context, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.Response(), "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
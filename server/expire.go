@@ -0,0 +1,81 @@
+package server
+
+import (
+	"time"
+)
+
+const (
+	// 检查任务超时与停滞的间隔
+	TASK_EXPIRE_INTERVAL = 10 * time.Second
+)
+
+// 任务的最长时间，没有指定时使用配置，为0时不限制
+func (ct *CachedTaskInfo) taskTtl() time.Duration {
+	if ct.ttl > 0 {
+		return time.Duration(ct.ttl) * time.Second
+	}
+	return time.Duration(ct.s.Cfg.Control.TaskTtl) * time.Second
+}
+
+func (ct *CachedTaskInfo) taskStallTimeout() time.Duration {
+	if ct.stallTimeout > 0 {
+		return time.Duration(ct.stallTimeout) * time.Second
+	}
+	return time.Duration(ct.s.Cfg.Control.StallTimeout) * time.Second
+}
+
+// 下发给Agent的剩余时间，不限制时为0
+func (ct *CachedTaskInfo) remainingTtl() int {
+	ttl := ct.taskTtl()
+	if ttl == 0 {
+		return 0
+	}
+	remaining := int((ttl - time.Since(ct.submittedAt)) / time.Second)
+	if remaining < 1 {
+		remaining = 1
+	}
+	return remaining
+}
+
+// 所有Agent的进度之和，失败的Agent不计入
+func (ct *CachedTaskInfo) totalProgress() (sum float32) {
+	for _, di := range ct.ti.DispatchInfos {
+		if di.PercentComplete > 0 {
+			sum += di.PercentComplete
+		}
+	}
+	return
+}
+
+// 超过ttl或停滞的任务失败，通知Agent删除未完成的文件，Session与缓存随之释放。
+// 暂停的任务仍然按ttl计算，不检查停滞。复制模式的任务达到副本数后进度不再增长，也不检查停滞
+func (ct *CachedTaskInfo) checkExpired() {
+	queued := ct.ti.Status == TaskStatus_Queued.String()
+	running := ct.ti.Status == TaskStatus_InProgress.String()
+	if !queued && !running && ct.ti.Status != TaskStatus_Paused.String() {
+		return
+	}
+
+	reason := ""
+	now := time.Now()
+	if ttl := ct.taskTtl(); ttl > 0 && now.Sub(ct.submittedAt) >= ttl {
+		reason = "TASK_EXPIRED"
+	} else if stall := ct.taskStallTimeout(); stall > 0 && running && ct.replicas == nil {
+		if p := ct.totalProgress(); p > ct.progress {
+			ct.progress, ct.progressAt = p, now
+		} else if now.Sub(ct.progressAt) >= stall {
+			reason = "TASK_STALLED"
+		}
+	}
+	if reason == "" {
+		return
+	}
+
+	ct.log.Errorf("Task is not finished in time, reason=%s, progress=%v", reason, ct.totalProgress())
+	if queued {
+		ct.s.scheduler.remove(ct.id)
+	}
+	ct.ti.Error = reason
+	ct.endTask(TaskStatus_Failed)
+	ct.stopAllClientTask(true)
+}
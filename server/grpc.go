@@ -0,0 +1,284 @@
+//go:build grpc
+// +build grpc
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
+	"github.com/xtfly/gofd/proto/gofdpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// 与HTTP接口使用相同的认证与任务缓存。需要先在proto/gofdpb中go generate，再使用 -tags grpc 编译
+const (
+	// WatchTask查询任务状态的间隔
+	GRPC_WATCH_INTERVAL = time.Second
+)
+
+func init() {
+	serveGrpc = startGrpc
+}
+
+type grpcServer struct {
+	gofdpb.UnimplementedTaskServiceServer
+	s *Server
+}
+
+func startGrpc(s *Server) (stop func(), err error) {
+	addr := common.JoinHostPort(s.Cfg.Net.IP, s.Cfg.Net.GrpcPort)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.grpcUnaryAuth),
+		grpc.StreamInterceptor(s.grpcStreamAuth),
+	}
+	if s.Cfg.Net.Tls != nil {
+		tc, err := s.Cfg.Net.Tls.ServerConfig()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tc)))
+	}
+	gs := grpc.NewServer(opts...)
+	gofdpb.RegisterTaskServiceServer(gs, &grpcServer{s: s})
+
+	s.Log.Infof("Starting grpc server on %s", addr)
+	go func() {
+		if err := gs.Serve(l); err != nil {
+			s.Log.Errorf("Grpc server stopped, error=%v", err)
+		}
+	}()
+	return gs.GracefulStop, nil
+}
+
+// 一元调用的context中保存认证的调用方
+type grpcClientKey struct{}
+
+// 从metadata的authorization中认证，支持Basic认证与Bearer令牌，返回调用方
+func (s *Server) grpcAuth(ctx context.Context, method string) (string, error) {
+	auth := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vs := md.Get("authorization"); len(vs) > 0 {
+			auth = vs[0]
+		}
+	}
+	client, err := s.AuthenticateHeader(auth)
+	if err != nil {
+		s.Log.Warnf("Reject grpc call %s, error=%v", method, err)
+		return "", status.Error(codes.Unauthenticated, err.Error())
+	}
+	return client, nil
+}
+
+func (s *Server) grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	client, err := s.grpcAuth(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, grpcClientKey{}, client), req)
+}
+
+func (s *Server) grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, err := s.grpcAuth(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// HTTP状态码与错误码转换为gRPC的状态
+func grpcError(code int, reason string) error {
+	switch {
+	case reason == TaskStatus_TaskNotExist.String():
+		return status.Error(codes.NotFound, reason)
+	case reason == TaskStatus_TaskExist.String():
+		return status.Error(codes.AlreadyExists, reason)
+	case code == http.StatusBadRequest:
+		return status.Error(codes.InvalidArgument, reason)
+	case code == http.StatusForbidden:
+		return status.Error(codes.PermissionDenied, reason)
+	case code == http.StatusTooManyRequests:
+		return status.Error(codes.ResourceExhausted, reason)
+	}
+	return status.Error(codes.Internal, reason)
+}
+
+func (g *grpcServer) CreateTask(ctx context.Context, req *gofdpb.CreateTaskRequest) (*gofdpb.TaskInfo, error) {
+	cti, code, reason := g.s.submitTask(createTaskFromProto(req), grpcClient(ctx))
+	if cti == nil {
+		return nil, grpcError(code, reason)
+	}
+	return taskInfoToProto(cti.Query()), nil
+}
+
+func (g *grpcServer) GetTask(ctx context.Context, req *gofdpb.GetTaskRequest) (*gofdpb.TaskInfo, error) {
+	v, ok := g.s.cache.Get(req.Id)
+	if !ok {
+		return nil, grpcError(http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	}
+	return taskInfoToProto(v.(*CachedTaskInfo).Query()), nil
+}
+
+func (g *grpcServer) ListTasks(ctx context.Context, req *gofdpb.ListTasksRequest) (*gofdpb.ListTasksResponse, error) {
+	items := g.s.cache.Items()
+	tis := make([]*TaskInfo, 0, len(items))
+	for _, item := range items {
+		tis = append(tis, item.Object.(*CachedTaskInfo).Snapshot())
+	}
+	sort.Slice(tis, func(i, j int) bool { return tis[i].StartedAt.Before(tis[j].StartedAt) })
+	rsp := &gofdpb.ListTasksResponse{Tasks: make([]*gofdpb.TaskInfo, 0, len(tis))}
+	for _, ti := range tis {
+		rsp.Tasks = append(rsp.Tasks, taskInfoToProto(ti))
+	}
+	return rsp, nil
+}
+
+func (g *grpcServer) CancelTask(ctx context.Context, req *gofdpb.CancelTaskRequest) (*gofdpb.CancelTaskResponse, error) {
+	g.s.Log.With("taskID", req.Id).Infof("Recv grpc cancel task, clean=%v", req.Clean)
+	v, ok := g.s.cache.Get(req.Id)
+	if !ok {
+		return nil, grpcError(http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	}
+	cti := v.(*CachedTaskInfo)
+	if !g.s.ownTask(grpcClient(ctx), cti) {
+		return nil, grpcError(http.StatusForbidden, "ACL_DENIED")
+	}
+	cti.Cancel(req.Clean)
+	return &gofdpb.CancelTaskResponse{}, nil
+}
+
+func grpcClient(ctx context.Context) string {
+	client, _ := ctx.Value(grpcClientKey{}).(string)
+	return client
+}
+
+// 定时查询任务状态，有变化时推送，任务结束或被移出缓存后关闭
+func (g *grpcServer) WatchTask(req *gofdpb.GetTaskRequest, stream gofdpb.TaskService_WatchTaskServer) error {
+	tick := time.NewTicker(GRPC_WATCH_INTERVAL)
+	defer tick.Stop()
+	var last *gofdpb.TaskInfo
+	for {
+		v, ok := g.s.cache.Get(req.Id)
+		if !ok {
+			if last != nil {
+				return nil
+			}
+			return grpcError(http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+		}
+		ti := taskInfoToProto(v.(*CachedTaskInfo).Query())
+		if last == nil || !proto.Equal(ti, last) {
+			if err := stream.Send(ti); err != nil {
+				return err
+			}
+			last = ti
+		}
+		switch ti.Status {
+		case TaskStatus_Queued.String(), TaskStatus_Init.String(), TaskStatus_InProgress.String(), TaskStatus_Paused.String():
+		default:
+			return nil
+		}
+
+		select {
+		case <-tick.C:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func createTaskFromProto(req *gofdpb.CreateTaskRequest) *CreateTask {
+	t := &CreateTask{
+		Id:            req.Id,
+		DispatchFiles: req.DispatchFiles,
+		DestIPs:       req.DestIps,
+		WebSeeds:      req.WebSeeds,
+		NoCompress:    req.NoCompress,
+		PreviousPath:  req.PreviousPath,
+		PieceLen:      req.PieceLen,
+		Trackers:      req.Trackers,
+		Encrypt:       req.Encrypt,
+		Priority:      int(req.Priority),
+		Webhooks:      req.Webhooks,
+		KeepLinks:     req.KeepLinks,
+		Seeders:       req.Seeders,
+		Sequential:    req.Sequential,
+		InMemory:      req.InMemory,
+		MetaByURI:     req.MetaByUri,
+		AllAgents:     req.AllAgents,
+		Selector:      req.Selector,
+		DestDir:       req.DestDir,
+		DedupFiles:    req.DedupFiles,
+
+		SuccessPercent: int(req.SuccessPercent),
+		OptionalIPs:    req.OptionalIps,
+		SeedLinger:     int(req.SeedLinger),
+		SeedUntil:      int(req.SeedUntil),
+		Pipe:           req.Pipe,
+		CollectReports: req.CollectReports,
+		Template:       req.Template,
+		Artifact:       req.Artifact,
+	}
+	for _, h := range req.Hooks {
+		t.Hooks = append(t.Hooks, &p2p.Hook{Command: h.Command, URL: h.Url})
+	}
+	for _, r := range req.Ranges {
+		t.Ranges = append(t.Ranges, &p2p.FileRange{File: r.File, Offset: r.Offset, Length: r.Length})
+	}
+	return t
+}
+
+// 零值的时间不设置
+func timestampToProto(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func taskInfoToProto(ti *TaskInfo) *gofdpb.TaskInfo {
+	pti := &gofdpb.TaskInfo{
+		Id:            ti.Id,
+		Status:        ti.Status,
+		Error:         ti.Error,
+		DispatchFiles: ti.DispatchFiles,
+		StartedAt:     timestampToProto(ti.StartedAt),
+		FinishedAt:    timestampToProto(ti.FinishedAt),
+		DispatchInfos: make(map[string]*gofdpb.DispatchInfo, len(ti.DispatchInfos)),
+
+		SuccessPercent: int32(ti.SuccessPercent),
+		Failures:       ti.Failures,
+	}
+	for ip, di := range ti.DispatchInfos {
+		pdi := &gofdpb.DispatchInfo{
+			Status:          di.Status,
+			PercentComplete: di.PercentComplete,
+			Speed:           di.Speed,
+			Error:           di.Error,
+			Zone:            di.Zone,
+			Optional:        di.Optional,
+			StartedAt:       timestampToProto(di.StartedAt),
+			FinishedAt:      timestampToProto(di.FinishedAt),
+		}
+		for _, df := range di.DispatchFiles {
+			pdi.DispatchFiles = append(pdi.DispatchFiles, df.FileName)
+		}
+		pti.DispatchInfos[ip] = pdi
+	}
+	return pti
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 检查主备状态的间隔
+	HA_CHECK_INTERVAL = 1 * time.Second
+
+	HA_ROLE_PRIMARY = "primary"
+	HA_ROLE_STANDBY = "standby"
+)
+
+// 主Server同步给备Server的状态
+type HaSnapshot struct {
+	Tasks []*CreateTask `json:"tasks"` // 排队与运行中的任务
+}
+
+// GET /api/v1/server/ha 返回的主备状态
+type HaStatus struct {
+	Role     string    `json:"role"`
+	Peer     string    `json:"peer"`
+	LastSync time.Time `json:"lastSync,omitempty"` // 主Server最近同步成功的时间，备Server最近收到同步的时间
+	Tasks    int       `json:"tasks"`              // 备Server收到的任务数
+}
+
+// 主备状态，没有配置Ha时Server的ha为nil
+type haState struct {
+	lock     sync.Mutex
+	cfg      *common.HaConfig
+	standby  bool
+	lastSync time.Time
+	since    time.Time     // 成为备Server的时间，还没有收到同步时从该时间开始计算超时
+	tasks    []*CreateTask // 备Server收到的任务
+}
+
+func newHaState(cfg *common.HaConfig) *haState {
+	if cfg == nil {
+		return nil
+	}
+	return &haState{cfg: cfg, standby: cfg.Standby, since: time.Now()}
+}
+
+func (h *haState) isStandby() bool {
+	if h == nil {
+		return false
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.standby
+}
+
+func (h *haState) status() *HaStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hs := &HaStatus{Role: HA_ROLE_PRIMARY, Peer: h.cfg.Peer, LastSync: h.lastSync, Tasks: len(h.tasks)}
+	if h.standby {
+		hs.Role = HA_ROLE_STANDBY
+	}
+	return hs
+}
+
+// 主Server启动时另一个Server已经接管为主Server，则作为备Server，避免两个主Server
+func (s *Server) checkHaPeer() {
+	if s.ha.standby {
+		return
+	}
+	rsp, err := common.SendHttpReq(s.Cfg, "GET", s.ha.cfg.Peer, "/api/v1/server/ha", nil)
+	if err != nil {
+		s.Log.Infof("Query ha peer %s failed, start as primary, error=%v", s.ha.cfg.Peer, err)
+		return
+	}
+	hs := new(HaStatus)
+	if err = json.Unmarshal(rsp, hs); err == nil && hs.Role == HA_ROLE_PRIMARY {
+		s.Log.Warnf("Ha peer %s is primary, start as standby", s.ha.cfg.Peer)
+		s.ha.standby = true
+	}
+}
+
+// 主Server定期同步任务，备Server超时没有收到同步时接管
+func (s *Server) runHa(quitChan <-chan struct{}) {
+	tick := time.NewTicker(HA_CHECK_INTERVAL)
+	defer tick.Stop()
+	var lastPush time.Time
+	interval := time.Duration(s.ha.cfg.SyncInterval) * time.Second
+	timeout := time.Duration(s.ha.cfg.FailoverTimeout) * time.Second
+	for {
+		select {
+		case now := <-tick.C:
+			if !s.ha.isStandby() {
+				if now.Sub(lastPush) >= interval {
+					lastPush = now
+					s.pushHaSnapshot()
+				}
+				continue
+			}
+			s.ha.lock.Lock()
+			last := s.ha.lastSync
+			if last.Before(s.ha.since) {
+				last = s.ha.since
+			}
+			expired := now.Sub(last) > timeout
+			s.ha.lock.Unlock()
+			if expired {
+				s.takeover()
+			}
+		case <-quitChan:
+			return
+		}
+	}
+}
+
+// 排队与运行中的任务，已结束的任务不需要接管
+func (s *Server) haSnapshot() *HaSnapshot {
+	hs := &HaSnapshot{}
+	for _, item := range s.cache.Items() {
+		ct := item.Object.(*CachedTaskInfo)
+		if ct.task == nil {
+			continue
+		}
+		switch ct.Snapshot().Status {
+		case TaskStatus_Completed.String(), TaskStatus_Failed.String(), TaskStatus_Canceled.String():
+			continue
+		}
+		hs.Tasks = append(hs.Tasks, ct.task)
+	}
+	return hs
+}
+
+func (s *Server) pushHaSnapshot() {
+	body, err := json.Marshal(s.haSnapshot())
+	if err != nil {
+		return
+	}
+	if _, err = common.SendHttpReq(s.Cfg, "POST", s.ha.cfg.Peer, "/api/v1/server/ha/sync", body); err != nil {
+		s.Log.Warnf("Sync tasks to ha peer %s failed, error=%v", s.ha.cfg.Peer, err)
+		return
+	}
+	s.ha.lock.Lock()
+	s.ha.lastSync = time.Now()
+	s.ha.lock.Unlock()
+}
+
+// 备Server成为主Server，重新提交主Server同步的任务。Agent收到相同ID的任务时关闭原来的任务，
+// 按断点续传信息继续下载，之后向本Server上报状态
+func (s *Server) takeover() {
+	s.ha.lock.Lock()
+	if !s.ha.standby {
+		s.ha.lock.Unlock()
+		return
+	}
+	s.ha.standby = false
+	tasks := s.ha.tasks
+	s.ha.tasks = nil
+	s.ha.lock.Unlock()
+
+	s.Log.Warnf("No sync from ha peer %s, take over as primary, tasks=%v", s.ha.cfg.Peer, len(tasks))
+	for _, t := range tasks {
+		// 使用主Server已选择的Agent
+		t.AllAgents, t.Selector = false, ""
+		if _, code, reason := s.submitTask(t, ""); code >= http.StatusBadRequest {
+			s.Log.With("taskID", t.Id).Errorf("Take over task failed, code=%v, reason=%s", code, reason)
+		}
+	}
+}
+
+// 配置了Ha时，另一个Server作为任务的备用地址，Agent上报状态失败时使用
+func (s *Server) backupTrackers(trackers []string) []string {
+	if s.ha == nil || containsString(trackers, s.ha.cfg.Peer) {
+		return trackers
+	}
+	return append(append([]string(nil), trackers...), s.ha.cfg.Peer)
+}
+
+//------------------------------------------
+// GET /api/v1/server/ha
+func (s *Server) QueryHa(c echo.Context) error {
+	if s.ha == nil {
+		return common.ReplyCode(c, http.StatusBadRequest, "HA_NOT_ENABLED")
+	}
+	return c.JSON(http.StatusOK, s.ha.status())
+}
+
+//------------------------------------------
+// POST /api/v1/server/ha/sync
+func (s *Server) SyncHa(c echo.Context) (err error) {
+	if s.ha == nil {
+		return common.ReplyCode(c, http.StatusBadRequest, "HA_NOT_ENABLED")
+	}
+	hs := new(HaSnapshot)
+	if err = c.Bind(hs); err != nil {
+		s.Log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
+		return
+	}
+
+	s.ha.lock.Lock()
+	defer s.ha.lock.Unlock()
+	if !s.ha.standby {
+		s.Log.Errorf("Recv ha sync, but this server is primary")
+		return common.ReplyCode(c, http.StatusConflict, "SERVER_PRIMARY")
+	}
+	s.ha.tasks = hs.Tasks
+	s.ha.lastSync = time.Now()
+	return c.String(http.StatusOK, "")
+}
@@ -1,91 +1,762 @@
 package server
 
 import (
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
-	log "github.com/cihub/seelog"
 	"github.com/labstack/echo"
+	"github.com/xtfly/gofd/common"
 	"github.com/xtfly/gofd/p2p"
 	"github.com/xtfly/gokits"
 )
 
 //------------------------------------------
-// POST /api/v1/server/tasks
+// POST /api/v1/server/tasks?dryRun=true
 func (s *Server) CreateTask(c echo.Context) (err error) {
 	//  获取Body
 	t := new(CreateTask)
 	if err = c.Bind(t); err != nil {
-		log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
+		s.Log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
 		return
 	}
+	if t.Id == "" {
+		t.Id = c.Request().Header().Get("Idempotency-Key")
+	}
 
-	// 检查任务是否存在
-	if v, ok := s.cache.Get(t.Id); ok {
-		cti := v.(*CachedTaskInfo)
-		if cti.EqualCmp(t) {
-			return c.String(http.StatusAccepted, "")
-		} else {
-			log.Debugf("[%s] Recv task, task is existed", t.Id)
-			return c.String(http.StatusBadRequest, TaskStatus_TaskExist.String())
+	if c.QueryParam("dryRun") == "true" {
+		r, code, reason := s.dryRunTask(t)
+		if r == nil {
+			return common.ReplyCode(c, code, reason)
 		}
+		return c.JSON(code, r)
+	}
+
+	cti, code, reason := s.submitTask(t, authClient(c))
+	if cti == nil {
+		return common.ReplyCode(c, code, reason)
+	}
+	return c.JSON(code, cti.Query())
+}
+
+// 认证中间件设置的调用方
+func authClient(c echo.Context) string {
+	client, _ := c.Get("client").(string)
+	return client
+}
+
+// 校验并提交任务，HTTP与gRPC接口共用。返回HTTP状态码，失败时cti为nil，reason为错误码。
+// client为调用方，按其ACL校验任务
+func (s *Server) submitTask(t *CreateTask, client string) (cti *CachedTaskInfo, code int, reason string) {
+	if s.ha.isStandby() {
+		// 由主Server创建任务，接管后才可以创建
+		return nil, http.StatusServiceUnavailable, "SERVER_STANDBY"
+	}
+	if t, code, reason = s.resolveTask(t); code != 0 {
+		return nil, code, reason
 	}
 
-	log.Infof("[%s] Recv task, file=%v, ips=%v", t.Id, t.DispatchFiles, t.DestIPs)
+	// 重复提交时返回已有任务的状态，不重复分发
+	if v, ok := s.cache.Get(t.Id); ok {
+		return s.resubmitTask(t, v.(*CachedTaskInfo), client)
+	}
 
-	cti := NewCachedTaskInfo(s, t)
-	s.cache.Set(t.Id, cti, gokits.NoExpiration)
+	if code, reason = s.checkTask(t); code != 0 {
+		return nil, code, reason
+	}
+	if code, reason = s.checkAcl(client, t); code != 0 {
+		return nil, code, reason
+	}
+	if code, reason = s.checkQuota(client, t); code != 0 {
+		return nil, code, reason
+	}
+
+	cti = NewCachedTaskInfo(s, t)
+	cti.client = client
+	if err := s.cache.Add(t.Id, cti, gokits.NoExpiration); err != nil {
+		// 同时提交的相同任务
+		if v, ok := s.cache.Get(t.Id); ok {
+			return s.resubmitTask(t, v.(*CachedTaskInfo), client)
+		}
+		return nil, http.StatusBadRequest, TaskStatus_TaskExist.String()
+	}
+	s.Log.With("taskID", t.Id).Infof("Recv task, file=%v, ips=%v", t.DispatchFiles, t.DestIPs)
 	s.cache.OnEvicted(func(id string, v interface{}) {
-		log.Infof("[%s] Remove task cache", t.Id)
+		s.Log.With("taskID", t.Id).Infof("Remove task cache")
 		cti := v.(*CachedTaskInfo)
 		cti.quitChan <- struct{}{}
 	})
 	go cti.Start()
+	s.scheduler.submit(cti, t.Priority)
 
-	return c.String(http.StatusAccepted, "")
+	return cti, http.StatusAccepted, ""
+}
+
+// 应用任务模板与制品目录，返回补全后的任务，失败时code不为0
+func (s *Server) resolveTask(t *CreateTask) (*CreateTask, int, string) {
+	if t.Id == "" {
+		t.Id = newTaskId()
+	}
+
+	if t.Template != "" {
+		tpl, ok := s.catalog.template(t.Template)
+		if !ok {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, template %s not found", t.Template)
+			return t, http.StatusBadRequest, "TEMPLATE_NOT_FOUND"
+		}
+		nt, err := tpl.apply(t)
+		if err != nil {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, apply template %s failed, %v", t.Template, err)
+			return t, http.StatusBadRequest, "INVALID_TEMPLATE"
+		}
+		t = nt
+	}
+
+	if t.Artifact != "" {
+		if _, _, err := parseArtifact(t.Artifact); err != nil {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, %v", err)
+			return t, http.StatusBadRequest, "INVALID_ARTIFACT"
+		}
+		if len(t.DispatchFiles) == 0 && len(t.Ranges) == 0 {
+			a, _, ok := s.catalog.artifact(t.Artifact)
+			if !ok {
+				s.Log.With("taskID", t.Id).Errorf("Recv task, artifact %s not found", t.Artifact)
+				return t, http.StatusBadRequest, "ARTIFACT_NOT_FOUND"
+			}
+			t.DispatchFiles, t.Ranges = a.DispatchFiles, a.Ranges
+		}
+	}
+
+	return t, 0, ""
+}
+
+// 校验任务的参数并选择目的Agent，失败时code不为0
+func (s *Server) checkTask(t *CreateTask) (code int, reason string) {
+	if t.PieceLen != 0 {
+		if err := s.profile.CheckPieceLength(t.PieceLen); err != nil {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, %v", err)
+			return http.StatusBadRequest, err.Error()
+		}
+	}
+	if t.BundleSize < 0 {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, invalid bundle size %d", t.BundleSize)
+		return http.StatusBadRequest, "INVALID_BUNDLE_SIZE"
+	}
+
+	if t.Limits != nil {
+		if err := t.Limits.Validate(); err != nil || t.Limits.Paused != nil {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, invalid limits %v, error=%v", t.Limits, err)
+			return http.StatusBadRequest, "INVALID_LIMITS"
+		}
+	}
+
+	if t.SeedSample < 0 || t.SeedSample > 100 {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, invalid seed sample %d", t.SeedSample)
+		return http.StatusBadRequest, "INVALID_SEED_SAMPLE"
+	}
+
+	if t.SuccessPercent < 0 || t.SuccessPercent > 100 {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, invalid success percent %d", t.SuccessPercent)
+		return http.StatusBadRequest, "INVALID_SUCCESS_PERCENT"
+	}
+
+	if len(t.Pipe) > 0 {
+		if t.InMemory || t.DestDir != "" || len(t.Ranges) > 0 {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, pipe can not be used with in memory, dest dir or ranges")
+			return http.StatusBadRequest, "PIPE_CONFLICT"
+		}
+		t.Sequential = true
+	}
+
+	if t.DestDir != "" && t.InMemory {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, dest dir can not be used with in memory")
+		return http.StatusBadRequest, "DEST_DIR_IN_MEMORY"
+	}
+
+	if t.Upgrade {
+		if s.signKey == nil {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, upgrade requires signed metainfo")
+			return http.StatusBadRequest, "UPGRADE_NOT_SIGNED"
+		}
+		if len(t.DispatchFiles) != 1 || t.InMemory || len(t.Pipe) > 0 || len(t.Ranges) > 0 || len(t.Seeders) > 0 {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, upgrade must dispatch only one file without in memory, pipe, ranges or seeders")
+			return http.StatusBadRequest, "UPGRADE_CONFLICT"
+		}
+	}
+
+	switch t.Topology {
+	case "", p2p.TOPOLOGY_CHAIN, p2p.TOPOLOGY_TREE:
+	default:
+		s.Log.With("taskID", t.Id).Errorf("Recv task, invalid topology %s", t.Topology)
+		return http.StatusBadRequest, "INVALID_TOPOLOGY"
+	}
+	if t.Fanout < 0 || t.Fanout > 0 && t.Topology != p2p.TOPOLOGY_TREE {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, invalid fanout %v of topology %s", t.Fanout, t.Topology)
+		return http.StatusBadRequest, "INVALID_TOPOLOGY"
+	}
+	if t.Topology != "" && len(t.Seeders) > 0 {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, topology can not be used with seeders")
+		return http.StatusBadRequest, "TOPOLOGY_CONFLICT"
+	}
+	if t.Topology == p2p.TOPOLOGY_TREE && t.Fanout == 0 {
+		t.Fanout = 2
+	}
+
+	if err := p2p.CheckFilePriorities(t.FilePriorities); err != nil {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, %v", err)
+		return http.StatusBadRequest, "INVALID_FILE_PRIORITY"
+	}
+
+	if len(t.Ranges) > 0 {
+		if t.InMemory {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, ranges can not be stored in memory")
+			return http.StatusBadRequest, "RANGES_IN_MEMORY"
+		}
+		if len(t.DispatchFiles) == 0 {
+			// 查询任务时按文件显示状态
+			seen := make(map[string]bool)
+			for _, r := range t.Ranges {
+				if !seen[r.File] {
+					seen[r.File] = true
+					t.DispatchFiles = append(t.DispatchFiles, r.File)
+				}
+			}
+		}
+	}
+
+	var sel labelSelector
+	if t.Selector != "" {
+		if len(t.DestIPs) > 0 {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, selector is set with destIPs")
+			return http.StatusBadRequest, "SELECTOR_WITH_DEST_IPS"
+		}
+		var err error
+		if sel, err = parseSelector(t.Selector); err != nil {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, %v", err)
+			return http.StatusBadRequest, "INVALID_SELECTOR"
+		}
+	}
+
+	if len(t.DestIPs) == 0 && (t.AllAgents || sel != nil) {
+		// 种子节点不作为下载的目的节点
+		seeders := make(map[string]bool, len(t.Seeders))
+		for _, seeder := range t.Seeders {
+			seeders[common.StripPort(seeder)] = true
+		}
+		for _, ip := range s.registry.aliveIPs(sel) {
+			if !seeders[ip] {
+				t.DestIPs = append(t.DestIPs, ip)
+			}
+		}
+		if len(t.DestIPs) == 0 && sel != nil {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, no alive agent matches selector %s", t.Selector)
+			return http.StatusBadRequest, "NO_AGENT_MATCHED"
+		}
+		if len(t.DestIPs) == 0 {
+			s.Log.With("taskID", t.Id).Errorf("Recv task, no alive agent registered")
+			return http.StatusBadRequest, "NO_AGENT_REGISTERED"
+		}
+	}
+
+	if t.Replication < 0 || t.Replication > len(t.DestIPs) {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, invalid replication %v of %v agents", t.Replication, len(t.DestIPs))
+		return http.StatusBadRequest, "INVALID_REPLICATION"
+	}
+	if t.Replication > 0 && (len(t.Pipe) > 0 || t.Upgrade || len(t.Hooks) > 0 || t.Topology != "") {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, replication can not be used with pipe, upgrade, hooks or topology")
+		return http.StatusBadRequest, "REPLICATION_CONFLICT"
+	}
+
+	for _, seeder := range t.Seeders {
+		for _, ip := range t.DestIPs {
+			if common.StripPort(seeder) == common.StripPort(ip) {
+				s.Log.With("taskID", t.Id).Errorf("Recv task, seeder %s is also a destination", seeder)
+				return http.StatusBadRequest, "SEEDER_IS_DESTINATION"
+			}
+		}
+	}
+
+	return 0, ""
+}
+
+// 相同的任务返回状态，失败的任务重新运行；内容不同时返回错误。
+// 先按ACL校验，令牌客户端不能通过重复提交查询或重新运行其它客户端的任务
+func (s *Server) resubmitTask(t *CreateTask, cti *CachedTaskInfo, client string) (*CachedTaskInfo, int, string) {
+	if code, reason := s.checkAcl(client, t); code != 0 {
+		return nil, code, reason
+	}
+	if !s.ownTask(client, cti) {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, task is owned by another client")
+		return nil, http.StatusForbidden, "ACL_DENIED"
+	}
+	if !cti.EqualCmp(t) {
+		s.Log.With("taskID", t.Id).Debugf("Recv task, task is existed")
+		return nil, http.StatusBadRequest, TaskStatus_TaskExist.String()
+	}
+	s.Log.With("taskID", t.Id).Infof("Recv task, task is resubmitted")
+	return cti, http.StatusOK, ""
 }
 
 //------------------------------------------
-// DELETE /api/v1/server/tasks/:id
+// DELETE /api/v1/server/tasks/:id?clean=true
+// DELETE /api/v1/tasks/:id?clean=true
 func (s *Server) CancelTask(c echo.Context) error {
 	id := c.Param("id")
-	log.Infof("[%s] Recv cancel task", id)
+	clean := c.QueryParam("clean") == "true"
+	s.Log.With("taskID", id).Infof("Recv cancel task, clean=%v", clean)
 	if v, ok := s.cache.Get(id); !ok {
-		return c.String(http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+		return common.ReplyCode(c, http.StatusBadRequest, TaskStatus_TaskNotExist.String())
 	} else {
 		cti := v.(*CachedTaskInfo)
-		cti.stopChan <- struct{}{}
+		if !s.ownTask(authClient(c), cti) {
+			return common.ReplyCode(c, http.StatusForbidden, "ACL_DENIED")
+		}
+		cti.Cancel(clean)
 		return c.JSON(http.StatusAccepted, "")
 	}
 }
 
 //------------------------------------------
 // GET /api/v1/server/tasks/:id
+// GET /api/v1/tasks/:id
 func (s *Server) QueryTask(c echo.Context) error {
 	id := c.Param("id")
-	log.Infof("[%s] Recv query task", id)
+	s.Log.With("taskID", id).Infof("Recv query task")
 	if v, ok := s.cache.Get(id); !ok {
-		return c.String(http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+		// 已经不在缓存中的任务从历史中查询
+		if ti := s.historyTask(id); ti != nil {
+			return c.JSON(http.StatusOK, ti)
+		}
+		return common.ReplyCode(c, http.StatusBadRequest, TaskStatus_TaskNotExist.String())
 	} else {
 		cti := v.(*CachedTaskInfo)
 		return c.JSON(http.StatusOK, cti.Query())
 	}
 }
 
+//------------------------------------------
+// GET /api/v1/server/tasks/:id/torrent?name=app
+func (s *Server) GetTorrent(c echo.Context) error {
+	id := c.Param("id")
+	s.Log.With("taskID", id).Infof("Recv get torrent")
+	v, ok := s.cache.Get(id)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	}
+	mi := v.(*CachedTaskInfo).MetaInfo()
+	if mi == nil {
+		return common.ReplyCode(c, http.StatusBadRequest, "TASK_NOT_STARTED")
+	}
+	bs, err := mi.MarshalTorrent(&p2p.TorrentOptions{Name: c.QueryParam("name")})
+	if err != nil {
+		s.Log.With("taskID", id).Errorf("Marshal torrent failed, error=%v", err)
+		return common.ReplyError(c, http.StatusBadRequest, err)
+	}
+	c.Response().Header().Set("Content-Type", "application/x-bittorrent")
+	c.Response().WriteHeader(http.StatusOK)
+	_, err = c.Response().Write(bs)
+	return err
+}
+
+//------------------------------------------
+// GET /api/v1/server/tasks/:id/uri
+func (s *Server) GetTaskURI(c echo.Context) error {
+	id := c.Param("id")
+	s.Log.With("taskID", id).Infof("Recv get task uri")
+	v, ok := s.cache.Get(id)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	}
+	cti := v.(*CachedTaskInfo)
+	mi := cti.MetaInfo()
+	if mi == nil {
+		return common.ReplyCode(c, http.StatusBadRequest, "TASK_NOT_STARTED")
+	}
+	return c.String(http.StatusOK, cti.taskURI(mi).String())
+}
+
+//------------------------------------------
+// GET /api/v1/server/tasks/:id/reports
+func (s *Server) QueryTransferReports(c echo.Context) error {
+	id := c.Param("id")
+	s.Log.With("taskID", id).Debugf("Recv query transfer reports")
+	v, ok := s.cache.Get(id)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	}
+	return c.JSON(http.StatusOK, v.(*CachedTaskInfo).TransferReports())
+}
+
+//------------------------------------------
+// GET /api/v1/server/meta/:hash?format=jsonl
+func (s *Server) GetMeta(c echo.Context) error {
+	hash := c.Param("hash")
+	s.Log.Debugf("Recv get metainfo, infoHash=%s", hash)
+	meta, ok := s.sessionMgnt.MetaByHash(hash)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, "META_NOT_FOUND")
+	}
+	meta, contentType, err := p2p.MetaResponse(meta, c.QueryParam("format"))
+	if err != nil {
+		return common.ReplyError(c, http.StatusInternalServerError, err)
+	}
+	c.Response().Header().Set("Content-Type", contentType)
+	c.Response().Header().Set("Content-Length", strconv.Itoa(len(meta)))
+	c.Response().WriteHeader(http.StatusOK)
+	_, err = c.Response().Write(meta)
+	return err
+}
+
+//------------------------------------------
+// GET /api/v1/tasks
+func (s *Server) ListTasks(c echo.Context) error {
+	items := s.cache.Items()
+	tis := make([]*TaskInfo, 0, len(items))
+	for _, item := range items {
+		tis = append(tis, item.Object.(*CachedTaskInfo).Snapshot())
+	}
+	sort.Slice(tis, func(i, j int) bool { return tis[i].StartedAt.Before(tis[j].StartedAt) })
+	return c.JSON(http.StatusOK, tis)
+}
+
+//------------------------------------------
+// PUT /api/v1/server/tasks/:id/priority
+func (s *Server) SetPriority(c echo.Context) (err error) {
+	id := c.Param("id")
+	tp := new(TaskPriority)
+	if err = c.Bind(tp); err != nil {
+		s.Log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
+		return
+	}
+
+	s.Log.With("taskID", id).Infof("Recv set priority, priority=%v", tp.Priority)
+	if err = s.scheduler.setPriority(id, tp.Priority); err != nil {
+		return common.ReplyError(c, http.StatusBadRequest, err)
+	}
+	return c.String(http.StatusOK, "")
+}
+
+//------------------------------------------
+// POST /api/v1/server/tasks/:id/preempt
+func (s *Server) PreemptTask(c echo.Context) error {
+	id := c.Param("id")
+	s.Log.With("taskID", id).Infof("Recv preempt task")
+	if err := s.scheduler.preempt(id); err != nil {
+		return common.ReplyError(c, http.StatusBadRequest, err)
+	}
+	return c.String(http.StatusAccepted, "")
+}
+
+//------------------------------------------
+// GET /api/v1/server/queue
+func (s *Server) QueryQueue(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.scheduler.list())
+}
+
+//------------------------------------------
+// GET /api/v1/server/namespaces
+func (s *Server) ListNamespaces(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.namespaceUsages())
+}
+
 //------------------------------------------
 // POST /api/v1/server/tasks/status
 func (s *Server) ReportTask(c echo.Context) (err error) {
 	//  获取Body
 	csr := new(p2p.StatusReport)
 	if err = c.Bind(csr); err != nil {
-		log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
+		s.Log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
 		return
 	}
 
-	log.Debugf("[%s] Recv task report, ip=%v, pecent=%v", csr.TaskId, csr.IP, csr.PercentComplete)
+	ar, code, reason := s.reportTask(csr)
+	if code != http.StatusOK {
+		return common.ReplyCode(c, code, reason)
+	}
+	if ar != nil {
+		return c.JSON(http.StatusOK, ar)
+	}
+	return c.String(http.StatusOK, "")
+}
+
+// HTTP与UDP上报共用，带有位图的上报返回Piece的副本数，否则返回nil
+func (s *Server) reportTask(csr *p2p.StatusReport) (ar *p2p.AnnounceResponse, code int, reason string) {
+	if !p2p.CompatibleVersion(csr.ProtocolVersion) {
+		s.Log.With("taskID", csr.TaskId).Warnf("Reject task report, ip=%v, protocol version %d is too old", csr.IP, csr.ProtocolVersion)
+		return nil, http.StatusUpgradeRequired, "PROTOCOL_VERSION_UNSUPPORTED"
+	}
+
+	s.Log.With("taskID", csr.TaskId).Debugf("Recv task report, ip=%v, pecent=%v", csr.IP, csr.PercentComplete)
+	span := common.StartRemoteSpan(csr.TraceParent, "tracker.report", "task.id", csr.TaskId, "agent.ip", csr.IP,
+		"task.percent", csr.PercentComplete)
+	defer span.End()
 	if v, ok := s.cache.Get(csr.TaskId); ok {
 		cti := v.(*CachedTaskInfo)
 		cti.reportChan <- csr
+		if len(csr.Have) > 0 {
+			ar = cti.Announce(csr.IP)
+		}
+	}
+	return ar, http.StatusOK, ""
+}
+
+//------------------------------------------
+// POST /api/v1/server/speed
+func (s *Server) SetSpeed(c echo.Context) (err error) {
+	//  获取Body
+	sl := new(p2p.SpeedLimit)
+	if err = c.Bind(sl); err != nil {
+		s.Log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
+		return
+	}
+
+	s.Log.With("taskID", sl.TaskId).Infof("Recv set speed, upload=%v, download=%v", sl.Upload, sl.Download)
+	if sl.TaskId == "" {
+		s.sessionMgnt.SetSpeed(sl)
+		return c.String(http.StatusOK, "")
+	}
+
+	if v, ok := s.cache.Get(sl.TaskId); !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	} else {
+		cti := v.(*CachedTaskInfo)
+		cti.setSpeed(sl)
+		return c.String(http.StatusOK, "")
+	}
+}
+
+//------------------------------------------
+// PATCH /api/v1/tasks/:id
+func (s *Server) SetTaskLimits(c echo.Context) (err error) {
+	//  获取Body
+	tl := new(p2p.TaskLimits)
+	if err = c.Bind(tl); err != nil {
+		s.Log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
+		return
 	}
+	tl.TaskId = c.Param("id")
 
+	s.Log.With("taskID", tl.TaskId).Infof("Recv set task limits, %v", tl)
+	if err = tl.Validate(); err != nil {
+		return common.ReplyError(c, http.StatusBadRequest, err)
+	}
+	if tl.Paused != nil {
+		// 通过暂停与恢复接口修改任务的状态
+		return common.ReplyError(c, http.StatusBadRequest, &common.ApiError{Code: "INVALID_LIMITS", Message: "Use pause or resume api to change paused"})
+	}
+	v, ok := s.cache.Get(tl.TaskId)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	}
+	cti := v.(*CachedTaskInfo)
+	if st := cti.Query().Status; st != TaskStatus_InProgress.String() && st != TaskStatus_Paused.String() {
+		return common.ReplyCode(c, http.StatusBadRequest, "TASK_NOT_STARTED")
+	}
+	cti.setLimits(tl)
 	return c.String(http.StatusOK, "")
 }
+
+//------------------------------------------
+// POST /api/v1/server/agents
+func (s *Server) RegisterAgent(c echo.Context) (err error) {
+	//  获取Body
+	hb := new(p2p.AgentHeartbeat)
+	if err = c.Bind(hb); err != nil {
+		s.Log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
+		return
+	}
+
+	// Agent监听在未指定的地址时，使用请求的来源地址
+	if ip := net.ParseIP(hb.IP); ip == nil || ip.IsUnspecified() {
+		hb.IP = common.StripPort(c.Request().RemoteAddress())
+	}
+	if !p2p.CompatibleVersion(hb.ProtocolVersion) {
+		s.Log.Warnf("Reject agent, ip=%s, protocol version %d is too old", hb.IP, hb.ProtocolVersion)
+		return common.ReplyCode(c, http.StatusUpgradeRequired, "PROTOCOL_VERSION_UNSUPPORTED")
+	}
+	if s.registry.heartbeat(hb) {
+		s.Log.Infof("Agent registered, ip=%s, zone=%s, external=%s, dataAddr=%s, protocolVersion=%d",
+			hb.IP, hb.Zone, hb.External, hb.DataAddr, hb.ProtocolVersion)
+	}
+	return c.String(http.StatusOK, "")
+}
+
+//------------------------------------------
+// GET /api/v1/server/agents
+func (s *Server) ListAgents(c echo.Context) error {
+	s.Log.Debugf("Recv list agents")
+	return c.JSON(http.StatusOK, s.registry.list())
+}
+
+//------------------------------------------
+// PUT /api/v1/server/templates/:name
+func (s *Server) PutTemplate(c echo.Context) (err error) {
+	tpl := new(TaskTemplate)
+	if err = c.Bind(tpl); err != nil {
+		s.Log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
+		return
+	}
+	tpl.Name = c.Param("name")
+	tpl.Id, tpl.Template = "", ""
+	if tpl.Limits != nil {
+		if err = tpl.Limits.Validate(); err != nil {
+			return common.ReplyCode(c, http.StatusBadRequest, "INVALID_LIMITS")
+		}
+	}
+	if tpl.Selector != "" {
+		if _, err = parseSelector(tpl.Selector); err != nil {
+			return common.ReplyCode(c, http.StatusBadRequest, "INVALID_SELECTOR")
+		}
+	}
+	s.Log.Infof("Recv put template, name=%s", tpl.Name)
+	if err = s.catalog.putTemplate(tpl); err != nil {
+		s.Log.Errorf("Save template %s failed, error=%v", tpl.Name, err)
+		return common.ReplyCode(c, http.StatusInternalServerError, "SAVE_CATALOG_FAILED")
+	}
+	return c.JSON(http.StatusOK, tpl)
+}
+
+//------------------------------------------
+// GET /api/v1/server/templates
+func (s *Server) ListTemplates(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.catalog.listTemplates())
+}
+
+//------------------------------------------
+// GET /api/v1/server/templates/:name
+func (s *Server) GetTemplate(c echo.Context) error {
+	tpl, ok := s.catalog.template(c.Param("name"))
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, "TEMPLATE_NOT_FOUND")
+	}
+	return c.JSON(http.StatusOK, tpl)
+}
+
+//------------------------------------------
+// DELETE /api/v1/server/templates/:name
+func (s *Server) DeleteTemplate(c echo.Context) error {
+	name := c.Param("name")
+	s.Log.Infof("Recv delete template, name=%s", name)
+	ok, err := s.catalog.deleteTemplate(name)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, "TEMPLATE_NOT_FOUND")
+	}
+	if err != nil {
+		s.Log.Errorf("Save catalog failed, error=%v", err)
+		return common.ReplyCode(c, http.StatusInternalServerError, "SAVE_CATALOG_FAILED")
+	}
+	return c.String(http.StatusOK, "")
+}
+
+//------------------------------------------
+// GET /api/v1/server/artifacts
+func (s *Server) ListArtifacts(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.catalog.listArtifacts())
+}
+
+//------------------------------------------
+// GET /api/v1/server/artifacts/:name/:version
+func (s *Server) GetArtifact(c echo.Context) error {
+	a, _, ok := s.catalog.artifact(c.Param("name") + ":" + c.Param("version"))
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, "ARTIFACT_NOT_FOUND")
+	}
+	return c.JSON(http.StatusOK, a)
+}
+
+//------------------------------------------
+// DELETE /api/v1/server/artifacts/:name/:version
+func (s *Server) DeleteArtifact(c echo.Context) error {
+	key := c.Param("name") + ":" + c.Param("version")
+	s.Log.Infof("Recv delete artifact, artifact=%s", key)
+	ok, err := s.catalog.deleteArtifact(key)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, "ARTIFACT_NOT_FOUND")
+	}
+	if err != nil {
+		s.Log.Errorf("Save catalog failed, error=%v", err)
+		return common.ReplyCode(c, http.StatusInternalServerError, "SAVE_CATALOG_FAILED")
+	}
+	return c.String(http.StatusOK, "")
+}
+
+//------------------------------------------
+// POST /api/v1/server/artifacts/:name/:version/push
+// 分发目录中的制品，请求体可选，与创建任务相同，如指定destIPs或template
+func (s *Server) PushArtifact(c echo.Context) (err error) {
+	t := new(CreateTask)
+	if c.Request().ContentLength() != 0 {
+		if err = c.Bind(t); err != nil {
+			s.Log.Errorf("Recv [%s] request, decode body failed. %v", c.Request().URL(), err)
+			return
+		}
+	}
+	if t.Id == "" {
+		t.Id = c.Request().Header().Get("Idempotency-Key")
+	}
+	t.Artifact = c.Param("name") + ":" + c.Param("version")
+	t.DispatchFiles, t.Ranges = nil, nil
+
+	cti, code, reason := s.submitTask(t, authClient(c))
+	if cti == nil {
+		return common.ReplyCode(c, code, reason)
+	}
+	return c.JSON(code, cti.Query())
+}
+
+//------------------------------------------
+// GET /api/v1/server/history?status=COMPLETED&ip=10.0.0.1&since=2006-01-02T15:04:05Z&until=...&limit=100
+// 按结束时间从新到旧返回已结束的任务
+func (s *Server) ListHistory(c echo.Context) error {
+	if s.history == nil {
+		return common.ReplyCode(c, http.StatusBadRequest, "HISTORY_NOT_ENABLED")
+	}
+	f := &HistoryFilter{Status: c.QueryParam("status"), IP: c.QueryParam("ip")}
+	var err error
+	if v := c.QueryParam("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return common.ReplyCode(c, http.StatusBadRequest, "INVALID_SINCE")
+		}
+	}
+	if v := c.QueryParam("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return common.ReplyCode(c, http.StatusBadRequest, "INVALID_UNTIL")
+		}
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 0 {
+			return common.ReplyCode(c, http.StatusBadRequest, "INVALID_LIMIT")
+		}
+	}
+
+	tis, err := s.history.List(f)
+	if err != nil {
+		s.Log.Errorf("List task history failed, error=%v", err)
+		return common.ReplyCode(c, http.StatusInternalServerError, "LOAD_HISTORY_FAILED")
+	}
+	if tis == nil {
+		tis = []*TaskInfo{}
+	}
+	return c.JSON(http.StatusOK, tis)
+}
+
+//------------------------------------------
+// GET /api/v1/server/history/:id
+func (s *Server) GetHistory(c echo.Context) error {
+	if s.history == nil {
+		return common.ReplyCode(c, http.StatusBadRequest, "HISTORY_NOT_ENABLED")
+	}
+	ti := s.historyTask(c.Param("id"))
+	if ti == nil {
+		return common.ReplyCode(c, http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	}
+	return c.JSON(http.StatusOK, ti)
+}
+
+//------------------------------------------
+// GET /metrics
+func (s *Server) Metrics(c echo.Context) error {
+	return c.String(http.StatusOK, s.sessionMgnt.Metrics().String())
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	// 按保留策略清理历史任务的间隔
+	HISTORY_PRUNE_INTERVAL = time.Hour
+)
+
+// 已结束任务的持久化存储，Server重启后仍然可以查询。
+// bolt之外的实现通过RegisterHistoryStore注册
+type HistoryStore interface {
+	// 保存结束的任务，相同id的任务被替换
+	Put(ti *TaskInfo) error
+	// 任务不存在时返回nil
+	Get(id string) (*TaskInfo, error)
+	// 按结束时间从新到旧返回匹配的任务
+	List(f *HistoryFilter) ([]*TaskInfo, error)
+	// 删除结束时间早于before的任务，max大于0时只保留最近的max个，返回删除的个数
+	Prune(before time.Time, max int) (int, error)
+	Close() error
+}
+
+// 打开path指定的存储
+type HistoryOpener func(path string) (HistoryStore, error)
+
+var (
+	historyStoresLock sync.RWMutex
+	historyStores     = map[string]HistoryOpener{}
+)
+
+// 注册一种历史任务的存储，同名的会被覆盖
+func RegisterHistoryStore(name string, open HistoryOpener) {
+	historyStoresLock.Lock()
+	defer historyStoresLock.Unlock()
+	historyStores[name] = open
+}
+
+// 没有配置historyStore时返回nil
+func openHistory(c *common.Control) (HistoryStore, error) {
+	if c.HistoryStore == "" {
+		return nil, nil
+	}
+	historyStoresLock.RLock()
+	open, ok := historyStores[c.HistoryStore]
+	historyStoresLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Not support history store %s, build with -tags %s", c.HistoryStore, c.HistoryStore)
+	}
+	return open(c.HistoryPath)
+}
+
+// 查询历史任务的条件，没有设置的条件不过滤
+type HistoryFilter struct {
+	Status string    // 任务的状态
+	IP     string    // 分发到该Agent的任务
+	Since  time.Time // 结束时间不早于该时间
+	Until  time.Time // 结束时间早于该时间
+	Limit  int       // 最多返回的个数
+}
+
+func (f *HistoryFilter) match(ti *TaskInfo) bool {
+	if f.Status != "" && ti.Status != f.Status {
+		return false
+	}
+	if f.IP != "" {
+		if _, ok := ti.DispatchInfos[f.IP]; !ok {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && ti.FinishedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !ti.FinishedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// 保存结束的任务，失败时只记录日志
+func (s *Server) saveHistory(ti *TaskInfo) {
+	if s.history == nil {
+		return
+	}
+	if err := s.history.Put(ti); err != nil {
+		s.Log.With("taskID", ti.Id).Errorf("Save task history failed, error=%v", err)
+	}
+}
+
+// 没有配置或查询失败时返回nil
+func (s *Server) historyTask(id string) *TaskInfo {
+	if s.history == nil {
+		return nil
+	}
+	ti, err := s.history.Get(id)
+	if err != nil {
+		s.Log.With("taskID", id).Errorf("Load task history failed, error=%v", err)
+		return nil
+	}
+	return ti
+}
+
+// 按historyRetention与historyMaxTasks定期清理，直到quitChan关闭
+func (s *Server) pruneHistory(quitChan <-chan struct{}) {
+	ticker := time.NewTicker(HISTORY_PRUNE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		c := s.Cfg.Control
+		if c.HistoryRetention > 0 || c.HistoryMaxTasks > 0 {
+			var before time.Time
+			if c.HistoryRetention > 0 {
+				before = time.Now().Add(-time.Duration(c.HistoryRetention) * 24 * time.Hour)
+			}
+			if n, err := s.history.Prune(before, c.HistoryMaxTasks); err != nil {
+				s.Log.Errorf("Prune task history failed, error=%v", err)
+			} else if n > 0 {
+				s.Log.Infof("Pruned %d tasks from history", n)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-quitChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 默认的历史任务存储，使用bolt保存在单个文件中
+func init() {
+	RegisterHistoryStore("bolt", openBoltHistory)
+}
+
+var (
+	// 键为结束时间的纳秒数(大端)加任务ID，值为JSON编码的任务，按结束时间有序
+	boltTasksBucket = []byte("tasks")
+	// 键为任务ID，值为在tasks中的键
+	boltIdsBucket = []byte("ids")
+)
+
+type boltHistory struct {
+	db *bolt.DB
+}
+
+func openBoltHistory(path string) (HistoryStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltTasksBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltIdsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltHistory{db: db}, nil
+}
+
+func boltTaskKey(ti *TaskInfo) []byte {
+	key := make([]byte, 8, 8+len(ti.Id))
+	binary.BigEndian.PutUint64(key, uint64(ti.FinishedAt.UnixNano()))
+	return append(key, ti.Id...)
+}
+
+func boltKeyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+}
+
+func (h *boltHistory) Put(ti *TaskInfo) error {
+	data, err := json.Marshal(ti)
+	if err != nil {
+		return err
+	}
+	return h.db.Update(func(tx *bolt.Tx) error {
+		tasks, ids := tx.Bucket(boltTasksBucket), tx.Bucket(boltIdsBucket)
+		if old := ids.Get([]byte(ti.Id)); old != nil {
+			if err := tasks.Delete(old); err != nil {
+				return err
+			}
+		}
+		key := boltTaskKey(ti)
+		if err := tasks.Put(key, data); err != nil {
+			return err
+		}
+		return ids.Put([]byte(ti.Id), key)
+	})
+}
+
+func (h *boltHistory) Get(id string) (ti *TaskInfo, err error) {
+	err = h.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(boltIdsBucket).Get([]byte(id))
+		if key == nil {
+			return nil
+		}
+		data := tx.Bucket(boltTasksBucket).Get(key)
+		if data == nil {
+			return nil
+		}
+		ti = new(TaskInfo)
+		return json.Unmarshal(data, ti)
+	})
+	return
+}
+
+func (h *boltHistory) List(f *HistoryFilter) (tis []*TaskInfo, err error) {
+	err = h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltTasksBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			at := boltKeyTime(k)
+			if !f.Until.IsZero() && !at.Before(f.Until) {
+				continue
+			}
+			if !f.Since.IsZero() && at.Before(f.Since) {
+				break
+			}
+			ti := new(TaskInfo)
+			if err := json.Unmarshal(v, ti); err != nil {
+				return err
+			}
+			if !f.match(ti) {
+				continue
+			}
+			tis = append(tis, ti)
+			if f.Limit > 0 && len(tis) >= f.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (h *boltHistory) Prune(before time.Time, max int) (n int, err error) {
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		tasks, ids := tx.Bucket(boltTasksBucket), tx.Bucket(boltIdsBucket)
+		excess := 0
+		if max > 0 {
+			excess = ids.Stats().KeyN - max
+		}
+		// 游标遍历时删除会跳过元素，先收集再删除
+		var keys [][]byte
+		c := tasks.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if len(keys) >= excess && !boltKeyTime(k).Before(before) {
+				break
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := tasks.Delete(k); err != nil {
+				return err
+			}
+			if err := ids.Delete(k[8:]); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return
+}
+
+func (h *boltHistory) Close() error {
+	return h.db.Close()
+}
@@ -0,0 +1,170 @@
+//go:build sqlite
+// +build sqlite
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// 使用SQLite保存历史任务，需要使用 -tags sqlite 编译(依赖cgo)
+func init() {
+	RegisterHistoryStore("sqlite", openSqliteHistory)
+}
+
+const sqliteHistorySchema = `CREATE TABLE IF NOT EXISTS task_history (
+	id          TEXT PRIMARY KEY,
+	status      TEXT NOT NULL,
+	finished_at INTEGER NOT NULL,
+	info        BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS task_history_finished ON task_history (finished_at);
+CREATE TABLE IF NOT EXISTS task_history_agents (
+	id TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	PRIMARY KEY (ip, id)
+);`
+
+type sqliteHistory struct {
+	db *sql.DB
+}
+
+func openSqliteHistory(path string) (HistoryStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// 只有Server一个写入者，避免并发写入时返回database is locked
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(sqliteHistorySchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteHistory{db: db}, nil
+}
+
+func (h *sqliteHistory) Put(ti *TaskInfo) error {
+	data, err := json.Marshal(ti)
+	if err != nil {
+		return err
+	}
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`INSERT OR REPLACE INTO task_history (id, status, finished_at, info) VALUES (?, ?, ?, ?)`,
+		ti.Id, ti.Status, ti.FinishedAt.UnixNano(), data); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM task_history_agents WHERE id = ?`, ti.Id); err != nil {
+		return err
+	}
+	for ip := range ti.DispatchInfos {
+		if _, err = tx.Exec(`INSERT INTO task_history_agents (id, ip) VALUES (?, ?)`, ti.Id, ip); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (h *sqliteHistory) Get(id string) (*TaskInfo, error) {
+	var data []byte
+	err := h.db.QueryRow(`SELECT info FROM task_history WHERE id = ?`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ti := new(TaskInfo)
+	if err = json.Unmarshal(data, ti); err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
+func (h *sqliteHistory) List(f *HistoryFilter) ([]*TaskInfo, error) {
+	query := `SELECT info FROM task_history WHERE 1 = 1`
+	var args []interface{}
+	if f.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, f.Status)
+	}
+	if f.IP != "" {
+		query += ` AND id IN (SELECT id FROM task_history_agents WHERE ip = ?)`
+		args = append(args, f.IP)
+	}
+	if !f.Since.IsZero() {
+		query += ` AND finished_at >= ?`
+		args = append(args, f.Since.UnixNano())
+	}
+	if !f.Until.IsZero() {
+		query += ` AND finished_at < ?`
+		args = append(args, f.Until.UnixNano())
+	}
+	query += ` ORDER BY finished_at DESC`
+	if f.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, f.Limit)
+	}
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tis []*TaskInfo
+	for rows.Next() {
+		var data []byte
+		if err = rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		ti := new(TaskInfo)
+		if err = json.Unmarshal(data, ti); err != nil {
+			return nil, err
+		}
+		tis = append(tis, ti)
+	}
+	return tis, rows.Err()
+}
+
+func (h *sqliteHistory) Prune(before time.Time, max int) (int, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var n int64
+	if !before.IsZero() {
+		r, err := tx.Exec(`DELETE FROM task_history WHERE finished_at < ?`, before.UnixNano())
+		if err != nil {
+			return 0, err
+		}
+		n, _ = r.RowsAffected()
+	}
+	if max > 0 {
+		r, err := tx.Exec(`DELETE FROM task_history WHERE id NOT IN
+			(SELECT id FROM task_history ORDER BY finished_at DESC LIMIT ?)`, max)
+		if err != nil {
+			return 0, err
+		}
+		m, _ := r.RowsAffected()
+		n += m
+	}
+	if n > 0 {
+		if _, err = tx.Exec(`DELETE FROM task_history_agents WHERE id NOT IN (SELECT id FROM task_history)`); err != nil {
+			return 0, err
+		}
+	}
+	return int(n), tx.Commit()
+}
+
+func (h *sqliteHistory) Close() error {
+	return h.db.Close()
+}
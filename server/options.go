@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
+)
+
+// 创建Server的选项。之后增加的参数只增加选项，New的签名保持不变
+type Option func(*options)
+
+type options struct {
+	log       common.Logger
+	profile   *p2p.Profile
+	pieceLen  int64
+	hash      string
+	rateLimit *p2p.SpeedLimit
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// 日志，为nil时使用seelog
+func WithLogger(l common.Logger) Option {
+	return func(o *options) { o.log = l }
+}
+
+// 创建元数据的分发模板，替代配置中的control.profile，配置中的其它元数据参数仍然生效
+func WithProfile(p *p2p.Profile) Option {
+	return func(o *options) { o.profile = p }
+}
+
+// 固定的Piece长度，替代配置中的control.pieceLen，必须是2的幂
+func WithPieceLength(pieceLen int64) Option {
+	return func(o *options) { o.pieceLen = pieceLen }
+}
+
+// Piece与文件的摘要算法，如sha1、sha256，见p2p.HashNames
+func WithHasher(name string) Option {
+	return func(o *options) { o.hash = name }
+}
+
+// 所有任务总的上传与下载速率，Unit: MiBps，0表示不限制。替代配置中的control.uploadSpeed与downloadSpeed，热加载时不再修改
+func WithRateLimit(upload, download int) Option {
+	return func(o *options) { o.rateLimit = &p2p.SpeedLimit{Upload: upload, Download: download} }
+}
+
+// 在配置确定的分发模板上应用Piece长度与摘要算法
+func (o *options) applyProfile(s *Server) error {
+	if o.pieceLen == 0 && o.hash == "" {
+		return nil
+	}
+	p := *s.profile
+	if o.pieceLen != 0 {
+		p.PieceLen = o.pieceLen
+	}
+	if o.hash != "" {
+		p.Hash = o.hash
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	s.profile = &p
+	return nil
+}
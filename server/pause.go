@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
+)
+
+type pauseTask struct {
+	pause bool
+	out   chan string
+}
+
+// 暂停或恢复运行中的任务，返回错误码，成功时为空
+func (ct *CachedTaskInfo) Pause(pause bool) string {
+	p := &pauseTask{pause: pause, out: make(chan string, 1)}
+	ct.pauseChan <- p
+	return <-p.out
+}
+
+// 暂停时所有节点停止块的传输，保留已下载的Piece与Peer连接，任务仍然占用运行的名额。
+// 恢复后从暂停的位置继续，停滞从恢复时重新计算
+func (ct *CachedTaskInfo) pause(pause bool) string {
+	if pause && ct.ti.Status != TaskStatus_InProgress.String() {
+		return "TASK_NOT_STARTED"
+	}
+	if !pause && ct.ti.Status != TaskStatus_Paused.String() {
+		return "TASK_NOT_PAUSED"
+	}
+	ct.setLimits(&p2p.TaskLimits{TaskId: ct.id, Paused: &pause})
+	if pause {
+		ct.log.Infof("Task is paused")
+		ct.ti.Status = TaskStatus_Paused.String()
+		ct.notify(&WebhookEvent{Event: WEBHOOK_TASK_PAUSED})
+		return ""
+	}
+	ct.log.Infof("Task is resumed")
+	ct.ti.Status = TaskStatus_InProgress.String()
+	ct.progressAt = time.Now()
+	ct.notify(&WebhookEvent{Event: WEBHOOK_TASK_RESUMED})
+	return ""
+}
+
+//------------------------------------------
+// POST /api/v1/server/tasks/:id/pause
+func (s *Server) PauseTask(c echo.Context) error {
+	return s.pauseTask(c, true)
+}
+
+//------------------------------------------
+// POST /api/v1/server/tasks/:id/resume
+func (s *Server) ResumeTask(c echo.Context) error {
+	return s.pauseTask(c, false)
+}
+
+func (s *Server) pauseTask(c echo.Context, pause bool) error {
+	id := c.Param("id")
+	s.Log.With("taskID", id).Infof("Recv pause task, pause=%v", pause)
+	v, ok := s.cache.Get(id)
+	if !ok {
+		return common.ReplyCode(c, http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	}
+	cti := v.(*CachedTaskInfo)
+	if !s.ownTask(authClient(c), cti) {
+		return common.ReplyCode(c, http.StatusForbidden, "ACL_DENIED")
+	}
+	if reason := cti.Pause(pause); reason != "" {
+		return common.ReplyCode(c, http.StatusBadRequest, reason)
+	}
+	return c.String(http.StatusOK, "")
+}
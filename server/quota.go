@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 按命名空间统计运行中的任务与当天分发的数据量
+type quotaTracker struct {
+	sync.Mutex
+	active map[string]map[string]bool // 命名空间中未结束的任务
+	bytes  map[string]int64           // 命名空间当天分发的数据量
+	day    string                     // bytes统计的日期，跨天后清零
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{active: make(map[string]map[string]bool), bytes: make(map[string]int64)}
+}
+
+// 跨天时清零数据量，需要持有锁
+func (q *quotaTracker) rotate() {
+	if today := time.Now().Format("2006-01-02"); today != q.day {
+		q.day = today
+		q.bytes = make(map[string]int64)
+	}
+}
+
+// 任务开始占用命名空间的并发数，重复调用不重复计数
+func (q *quotaTracker) start(ns, id string) {
+	if ns == "" {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.active[ns] == nil {
+		q.active[ns] = make(map[string]bool)
+	}
+	q.active[ns][id] = true
+}
+
+// 任务结束后释放命名空间的并发数
+func (q *quotaTracker) finish(ns, id string) {
+	if ns == "" {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	delete(q.active[ns], id)
+}
+
+// 创建元数据后累加任务需要分发的数据量
+func (q *quotaTracker) addBytes(ns string, n int64) {
+	if ns == "" {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.rotate()
+	q.bytes[ns] += n
+}
+
+// 校验任务的命名空间并占用并发数，失败时code不为0。没有配置命名空间时不限制；
+// 任务没有指定时使用客户端所在的命名空间，客户端不在任何命名空间中时不限制。
+// client为空（Ha接管的任务）时不校验
+func (s *Server) checkQuota(client string, t *CreateTask) (code int, reason string) {
+	if len(s.Cfg.Namespaces) == 0 {
+		return 0, ""
+	}
+	if client == "" {
+		// Ha接管的任务已在主Server上校验过，只统计用量
+		s.quotas.start(t.Namespace, t.Id)
+		return 0, ""
+	}
+	if t.Namespace == "" {
+		n := s.Cfg.ClientNamespace(client)
+		if n == nil {
+			return 0, ""
+		}
+		t.Namespace = n.Name
+	}
+	n := s.Cfg.NamespaceFor(t.Namespace)
+	if n == nil {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, namespace %s not found", t.Namespace)
+		return http.StatusBadRequest, "NAMESPACE_NOT_FOUND"
+	}
+	// 节点之间的账号可以使用所有命名空间
+	if client != s.Cfg.Auth.Username && !n.AllowClient(client) {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, client %s can not use namespace %s", client, n.Name)
+		return http.StatusForbidden, "NAMESPACE_DENIED"
+	}
+	if n.MaxAgentsPerTask > 0 && len(t.DestIPs) > n.MaxAgentsPerTask {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, %v agents exceed quota %v of namespace %s", len(t.DestIPs), n.MaxAgentsPerTask, n.Name)
+		return http.StatusTooManyRequests, "AGENT_QUOTA_EXCEEDED"
+	}
+
+	q := s.quotas
+	q.Lock()
+	defer q.Unlock()
+	q.rotate()
+	if n.MaxActiveTasks > 0 && len(q.active[n.Name]) >= n.MaxActiveTasks {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, active tasks exceed quota %v of namespace %s", n.MaxActiveTasks, n.Name)
+		return http.StatusTooManyRequests, "TASK_QUOTA_EXCEEDED"
+	}
+	if n.MaxBytesPerDay > 0 && q.bytes[n.Name] >= n.MaxBytesPerDay {
+		s.Log.With("taskID", t.Id).Errorf("Recv task, bytes today exceed quota %v of namespace %s", n.MaxBytesPerDay, n.Name)
+		return http.StatusTooManyRequests, "BYTES_QUOTA_EXCEEDED"
+	}
+	// 在锁内占用并发数，同时提交的任务不会超过配额
+	if q.active[n.Name] == nil {
+		q.active[n.Name] = make(map[string]bool)
+	}
+	q.active[n.Name][t.Id] = true
+	return 0, ""
+}
+
+// 所有命名空间的配额与当前用量，按配置的顺序
+func (s *Server) namespaceUsages() []*NamespaceUsage {
+	q := s.quotas
+	q.Lock()
+	defer q.Unlock()
+	q.rotate()
+	usages := make([]*NamespaceUsage, 0, len(s.Cfg.Namespaces))
+	for _, n := range s.Cfg.Namespaces {
+		usages = append(usages, &NamespaceUsage{
+			Name:             n.Name,
+			ActiveTasks:      len(q.active[n.Name]),
+			MaxActiveTasks:   n.MaxActiveTasks,
+			BytesToday:       q.bytes[n.Name],
+			MaxBytesPerDay:   n.MaxBytesPerDay,
+			MaxAgentsPerTask: n.MaxAgentsPerTask,
+		})
+	}
+	return usages
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
+)
+
+// 注册的Agent，查询接口的响应
+type RegisteredAgent struct {
+	p2p.AgentHeartbeat
+	RegisteredAt  time.Time `json:"registeredAt"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+	Alive         bool      `json:"alive"`
+}
+
+// 通过心跳注册的Agent，超过timeout没有心跳的Agent不再下发任务，也不加入Peer列表。
+// 没有注册过的Agent视为存活，与静态配置的destIPs兼容
+type agentRegistry struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	agents  map[string]*RegisteredAgent // 以IP为键
+}
+
+func newAgentRegistry(timeout time.Duration) *agentRegistry {
+	return &agentRegistry{timeout: timeout, agents: make(map[string]*RegisteredAgent)}
+}
+
+// 注册或更新心跳，返回是否为新注册或从超时中恢复的Agent
+func (r *agentRegistry) heartbeat(hb *p2p.AgentHeartbeat) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	ra, ok := r.agents[hb.IP]
+	if !ok {
+		ra = &RegisteredAgent{RegisteredAt: now}
+		r.agents[hb.IP] = ra
+	}
+	revived := !ok || !r.aliveLocked(ra, now)
+	ra.AgentHeartbeat, ra.LastHeartbeat = *hb, now
+	return revived
+}
+
+func (r *agentRegistry) aliveLocked(ra *RegisteredAgent, now time.Time) bool {
+	return now.Sub(ra.LastHeartbeat) <= r.timeout
+}
+
+// ip可以带端口
+func (r *agentRegistry) alive(ip string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ra, ok := r.agents[common.StripPort(ip)]
+	return !ok || r.aliveLocked(ra, time.Now())
+}
+
+// Agent上报的数据地址，NAT映射后的外部地址优先，没有注册或没有上报时为空
+func (r *agentRegistry) dataAddr(ip string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if ra, ok := r.agents[common.StripPort(ip)]; ok {
+		if ra.External != "" {
+			return ra.External
+		}
+		return ra.DataAddr
+	}
+	return ""
+}
+
+// 通过中继接收连接的Agent，以IP为键，值为中继的地址
+func (r *agentRegistry) relays(ips []string) map[string]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var relays map[string]string
+	for _, ip := range ips {
+		if ra, ok := r.agents[common.StripPort(ip)]; ok && ra.Relay != "" {
+			if relays == nil {
+				relays = make(map[string]string)
+			}
+			relays[ip] = ra.Relay
+		}
+	}
+	return relays
+}
+
+// 去掉已注册但超时的Agent
+func (r *agentRegistry) filterAlive(ips []string) []string {
+	alive := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if r.alive(ip) {
+			alive = append(alive, ip)
+		}
+	}
+	return alive
+}
+
+// 按心跳上报的负载从低到高排序，负载低的Agent排在前面作为其它节点的上游。
+// 没有注册或没有上报负载的Agent负载视为0，负载相同时保持原来的顺序
+func (r *agentRegistry) byLoad(ips []string) []string {
+	r.lock.Lock()
+	loads := make(map[string]float64, len(ips))
+	for _, ip := range ips {
+		if ra, ok := r.agents[common.StripPort(ip)]; ok {
+			loads[ip] = ra.Capacity.Load()
+		}
+	}
+	r.lock.Unlock()
+	sorted := append([]string(nil), ips...)
+	sort.SliceStable(sorted, func(i, j int) bool { return loads[sorted[i]] < loads[sorted[j]] })
+	return sorted
+}
+
+// 所有存活并且可以下载的Agent，按IP排序。sel不为nil时只返回标签匹配的Agent
+func (r *agentRegistry) aliveIPs(sel labelSelector) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	ips := make([]string, 0, len(r.agents))
+	for ip, ra := range r.agents {
+		if ra.Mode == common.AGENT_MODE_SEED {
+			continue
+		}
+		if r.aliveLocked(ra, now) && (sel == nil || sel.matches(ra.Labels)) {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// 所有注册过的Agent，按IP排序
+func (r *agentRegistry) list() []*RegisteredAgent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	ras := make([]*RegisteredAgent, 0, len(r.agents))
+	for _, ra := range r.agents {
+		c := *ra
+		c.Alive = r.aliveLocked(ra, now)
+		ras = append(ras, &c)
+	}
+	sort.Slice(ras, func(i, j int) bool { return ras[i].IP < ras[j].IP })
+	return ras
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// 复制模式下每次分配给一个Agent的Piece个数上限
+	REPLICA_ASSIGN_BATCH = 16
+	// 分配的Piece超过该时间还没有上报完成时，重新分配给其它Agent
+	REPLICA_ASSIGN_TIMEOUT = 5 * time.Minute
+)
+
+// 复制模式下分配给各Agent、还没有上报完成的Piece。只在任务的Goroutine中访问
+type replicaAssigner struct {
+	target  int
+	pending map[string]map[int]time.Time // 以Agent的IP为键，值为Piece分配的时间
+}
+
+// target为0时不是复制模式，返回nil
+func newReplicaAssigner(target int) *replicaAssigner {
+	if target <= 0 {
+		return nil
+	}
+	return &replicaAssigner{target: target, pending: make(map[string]map[int]time.Time)}
+}
+
+// Agent失败或退出时，分配给它的Piece重新分配给其它Agent
+func (ra *replicaAssigner) drop(ip string) {
+	if ra != nil {
+		delete(ra.pending, ip)
+	}
+}
+
+// 去掉已完成或超时的分配，返回Agent是否还有正在下载的Piece
+func (ra *replicaAssigner) busy(ip string, have []byte, now time.Time) bool {
+	pieces := ra.pending[ip]
+	for i, at := range pieces {
+		if hasPiece(have, i) || now.Sub(at) >= REPLICA_ASSIGN_TIMEOUT {
+			delete(pieces, i)
+		}
+	}
+	if len(pieces) == 0 {
+		delete(ra.pending, ip)
+		return false
+	}
+	return true
+}
+
+// 每个Piece已分配还没有完成的副本数
+func (ra *replicaAssigner) pendingCounts() map[int]int {
+	counts := make(map[int]int)
+	for _, pieces := range ra.pending {
+		for i := range pieces {
+			counts[i]++
+		}
+	}
+	return counts
+}
+
+// 给空闲的Agent分配副本数不足的Piece，已分配的计入副本数，副本最少的优先。
+// Agent已有的Piece不分配，还在下载之前分配的Piece时返回nil
+func (ra *replicaAssigner) assign(ip string, have []byte, counts []int, total int) []int {
+	now := time.Now()
+	if ra.busy(ip, have, now) {
+		return nil
+	}
+	pending := ra.pendingCounts()
+	replicas := func(i int) int {
+		if i < len(counts) {
+			return counts[i] + pending[i]
+		}
+		return pending[i]
+	}
+
+	var pieces []int
+	for i := 0; i < total; i++ {
+		if !hasPiece(have, i) && replicas(i) < ra.target {
+			pieces = append(pieces, i)
+		}
+	}
+	sort.SliceStable(pieces, func(a, b int) bool { return replicas(pieces[a]) < replicas(pieces[b]) })
+	if len(pieces) > REPLICA_ASSIGN_BATCH {
+		pieces = pieces[:REPLICA_ASSIGN_BATCH]
+	}
+	if len(pieces) > 0 {
+		assigned := make(map[int]time.Time, len(pieces))
+		for _, i := range pieces {
+			assigned[i] = now
+		}
+		ra.pending[ip] = assigned
+	}
+	return pieces
+}
+
+func hasPiece(have []byte, i int) bool {
+	return i/8 < len(have) && have[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+// 复制模式下给上报的Agent分配需要下载的Piece，其它任务以及任务没有运行时返回nil
+func (ct *CachedTaskInfo) assignPieces(ip string) []int {
+	if ct.replicas == nil || ct.mi == nil || ct.ti.Status != TaskStatus_InProgress.String() {
+		return nil
+	}
+	have, ok := ct.availability.haves[ip]
+	if !ok {
+		return nil
+	}
+	pieces := ct.replicas.assign(ip, have, ct.availability.counts, ct.mi.NumPieces())
+	if len(pieces) > 0 {
+		ct.log.Debugf("Assign %v under-replicated pieces to agent, ip=%s", len(pieces), ip)
+		ct.updateReplicas()
+	}
+	return pieces
+}
+
+// 按Agent上报的位图更新任务的副本情况
+func (ct *CachedTaskInfo) updateReplicas() {
+	if ct.replicas == nil || ct.mi == nil {
+		return
+	}
+	total := ct.mi.NumPieces()
+	rs := &ReplicaStatus{Target: ct.replicas.target, MinReplicas: -1}
+	counts := ct.availability.counts
+	for i := 0; i < total; i++ {
+		n := 0
+		if i < len(counts) {
+			n = counts[i]
+		}
+		if n < ct.replicas.target {
+			rs.UnderReplicated++
+		}
+		if rs.MinReplicas < 0 || n < rs.MinReplicas {
+			rs.MinReplicas = n
+		}
+	}
+	if rs.MinReplicas < 0 {
+		rs.MinReplicas = 0
+	}
+	for _, pieces := range ct.replicas.pending {
+		rs.Assigned += len(pieces)
+	}
+	ct.ti.Replicas = rs
+}
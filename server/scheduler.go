@@ -0,0 +1,173 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 排队中的任务
+type queuedTask struct {
+	ct       *CachedTaskInfo
+	priority int
+	seq      int64 // 相同优先级按提交顺序
+}
+
+// 任务调度：最多同时运行max个任务，其它任务按优先级排队
+type scheduler struct {
+	lock    sync.Mutex
+	max     int
+	seq     int64 // 提交的序号
+	front   int64 // 重新排队的序号，小于所有提交的序号
+	running map[string]*queuedTask
+	queue   []*queuedTask // 优先级高的在前
+}
+
+func newScheduler(max int) *scheduler {
+	return &scheduler{max: max, running: make(map[string]*queuedTask)}
+}
+
+// 调整同时运行的最大任务数，增大时立即运行排队的任务，减小时不影响已运行的任务
+func (s *scheduler) setMax(max int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.max = max
+	s.schedule()
+}
+
+// 提交任务，有空闲时立即运行
+func (s *scheduler) submit(ct *CachedTaskInfo, priority int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seq++
+	s.enqueue(&queuedTask{ct: ct, priority: priority, seq: s.seq})
+	s.schedule()
+}
+
+// 被抢占的任务重新排到同优先级的最前面
+func (s *scheduler) requeue(ct *CachedTaskInfo, priority int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.front--
+	s.enqueue(&queuedTask{ct: ct, priority: priority, seq: s.front})
+	s.schedule()
+}
+
+// 任务结束，释放运行的位置
+func (s *scheduler) done(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.running[id]; ok {
+		delete(s.running, id)
+		s.schedule()
+	}
+}
+
+// 从队列中删除没有运行的任务
+func (s *scheduler) remove(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i := s.indexOf(id); i >= 0 {
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// 调整任务的优先级，排队中的任务重新排序，运行中的任务影响被抢占的顺序
+func (s *scheduler) setPriority(id string, priority int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if q, ok := s.running[id]; ok {
+		q.priority = priority
+		return nil
+	}
+	i := s.indexOf(id)
+	if i < 0 {
+		return common.NewApiError(http.StatusBadRequest, TaskStatus_TaskNotExist.String())
+	}
+	q := s.queue[i]
+	s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	q.priority = priority
+	s.enqueue(q)
+	return nil
+}
+
+// 立即运行排队中的任务，没有空闲时暂停一个优先级最低的运行中任务，被暂停的任务重新排队
+func (s *scheduler) preempt(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i := s.indexOf(id)
+	if i < 0 {
+		return common.NewApiError(http.StatusBadRequest, "TASK_NOT_QUEUED")
+	}
+	q := s.queue[i]
+	s.queue = append(s.queue[:i], s.queue[i+1:]...)
+
+	if len(s.running) >= s.max {
+		var victim *queuedTask
+		for _, r := range s.running {
+			if victim == nil || r.priority < victim.priority ||
+				(r.priority == victim.priority && r.seq > victim.seq) {
+				victim = r
+			}
+		}
+		if victim != nil {
+			victim.ct.log.Infof("Preempted by task %s", id)
+			delete(s.running, victim.ct.id)
+			victim.ct.preemptChan <- victim.priority
+		}
+	}
+	s.run(q)
+	return nil
+}
+
+// 运行中与排队中的任务
+func (s *scheduler) list() *TaskQueue {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tq := &TaskQueue{Max: s.max}
+	for _, r := range s.running {
+		tq.Running = append(tq.Running, &QueuedTask{Id: r.ct.id, Priority: r.priority})
+	}
+	sort.Slice(tq.Running, func(i, j int) bool { return tq.Running[i].Id < tq.Running[j].Id })
+	for _, q := range s.queue {
+		tq.Queued = append(tq.Queued, &QueuedTask{Id: q.ct.id, Priority: q.priority})
+	}
+	return tq
+}
+
+func (s *scheduler) enqueue(q *queuedTask) {
+	i := sort.Search(len(s.queue), func(i int) bool {
+		o := s.queue[i]
+		return o.priority < q.priority || (o.priority == q.priority && o.seq > q.seq)
+	})
+	s.queue = append(s.queue, nil)
+	copy(s.queue[i+1:], s.queue[i:])
+	s.queue[i] = q
+}
+
+func (s *scheduler) indexOf(id string) int {
+	for i, q := range s.queue {
+		if q.ct.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *scheduler) schedule() {
+	for len(s.running) < s.max && len(s.queue) > 0 {
+		q := s.queue[0]
+		s.queue = s.queue[1:]
+		s.run(q)
+	}
+}
+
+func (s *scheduler) run(q *queuedTask) {
+	q.ct.log.Infof("Schedule task, priority=%v, running=%v, queued=%v", q.priority, len(s.running)+1, len(s.queue))
+	s.running[q.ct.id] = q
+	q.ct.runChan <- struct{}{}
+}
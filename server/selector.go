@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 标签选择的一个条件：key=value、key!=value、key（存在）或!key（不存在）
+type labelRequirement struct {
+	key   string
+	value string
+	op    string // "="、"!="、"exists"、"!exists"
+}
+
+// 逗号分隔的多个条件，全部满足时匹配
+type labelSelector []labelRequirement
+
+func parseSelector(s string) (labelSelector, error) {
+	var sel labelSelector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var r labelRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			kv := strings.SplitN(term, "!=", 2)
+			r = labelRequirement{key: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1]), op: "!="}
+		case strings.Contains(term, "="):
+			kv := strings.SplitN(strings.Replace(term, "==", "=", 1), "=", 2)
+			r = labelRequirement{key: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1]), op: "="}
+		case strings.HasPrefix(term, "!"):
+			r = labelRequirement{key: strings.TrimSpace(term[1:]), op: "!exists"}
+		default:
+			r = labelRequirement{key: term, op: "exists"}
+		}
+		if r.key == "" || strings.ContainsAny(r.key, "=! ") || strings.ContainsAny(r.value, "=! ") {
+			return nil, fmt.Errorf("Invalid label selector %q", term)
+		}
+		sel = append(sel, r)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("Empty label selector %q", s)
+	}
+	return sel, nil
+}
+
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, r := range sel {
+		v, ok := labels[r.key]
+		switch r.op {
+		case "=":
+			if !ok || v != r.value {
+				return false
+			}
+		case "!=":
+			if ok && v == r.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
 	"time"
 
 	"github.com/labstack/echo"
-	"github.com/labstack/echo/middleware"
 	"github.com/xtfly/gofd/common"
 	"github.com/xtfly/gofd/p2p"
 	"github.com/xtfly/gokits"
@@ -16,29 +19,248 @@ type Server struct {
 	cache *gokits.Cache
 	// Session管理
 	sessionMgnt *p2p.P2pSessionMgnt
+	// 创建元数据所用的分发模板
+	profile *p2p.Profile
+	// 分发对象存储中的文件
+	s3 *p2p.S3Client
+	// 任务排队与并发控制
+	scheduler *scheduler
+	// 任务事件的回调
+	webhooker *webhooker
+	// 推送给订阅者的任务事件
+	events *eventHub
+	// 通过心跳注册的Agent
+	registry *agentRegistry
+	// 任务模板与制品目录
+	catalog *catalog
+	// 已结束任务的历史，没有配置时为nil
+	history HistoryStore
+	// 停止清理历史任务
+	historyQuit chan struct{}
+	// 签名元数据的私钥，没有配置时为nil
+	signKey ed25519.PrivateKey
+	// 停止gRPC管理接口，没有启动时为nil
+	stopGrpc func()
+	// 主备状态，没有配置时为nil
+	ha *haState
+	// 停止主备同步
+	haQuit chan struct{}
+	// UDP状态上报的连接，没有配置时为nil
+	announceConn net.PacketConn
+	// 命名空间的配额用量
+	quotas *quotaTracker
+	// 通过WithRateLimit指定的总速率，热加载时不使用配置中的值，没有指定时为nil
+	rateLimit *p2p.SpeedLimit
 }
 
-func NewServer(cfg *common.Config) (*Server, error) {
+// 使用 -tags grpc 编译时注册，启动gRPC的管理接口
+var serveGrpc func(s *Server) (stop func(), err error)
+
+// l为nil时使用seelog。嵌入其它程序时使用New，通过选项设置其它参数
+func NewServer(cfg *common.Config, l common.Logger) (*Server, error) {
+	return New(cfg, WithLogger(l))
+}
+
+// 按配置创建Server，选项优先于配置中的对应项
+func New(cfg *common.Config, opts ...Option) (*Server, error) {
+	o := newOptions(opts)
+	l := o.log
+	if l == nil {
+		l = common.NewSeelogLogger()
+	}
 	s := &Server{
 		cache:       gokits.NewCache(5 * time.Minute),
-		sessionMgnt: p2p.NewSessionMgnt(cfg),
+		sessionMgnt: p2p.NewSessionMgnt(cfg, l),
+		profile:     &p2p.Profile{Name: "default", PieceLen: 1024 * 1024},
+		scheduler:   newScheduler(cfg.Control.MaxActive),
+		webhooker:   newWebhooker(cfg.Control.Webhooks, l),
+		events:      newEventHub(),
+		registry:    newAgentRegistry(time.Duration(cfg.Control.AgentTimeout) * time.Second),
+		ha:          newHaState(cfg.Ha),
+		quotas:      newQuotaTracker(),
+	}
+	if o.profile != nil {
+		s.profile = o.profile
+	} else if cfg.Control.Profile != "" {
+		p, ok := p2p.LookupProfile(cfg.Control.Profile)
+		if !ok {
+			return nil, fmt.Errorf("Not find profile %s", cfg.Control.Profile)
+		}
+		s.profile = p
+	}
+	if cfg.Control.PieceCountLog2 != 0 || cfg.Control.MaxPieceLen != 0 {
+		p := *s.profile
+		if cfg.Control.PieceCountLog2 != 0 {
+			p.PieceCountLog2 = cfg.Control.PieceCountLog2
+		}
+		if cfg.Control.MaxPieceLen != 0 {
+			p.MaxPieceLen = cfg.Control.MaxPieceLen
+			if p.PieceLen > p.MaxPieceLen {
+				// 分发模板中固定的Piece长度也不能超过上限
+				p.PieceLen = p.MaxPieceLen
+			}
+		}
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+		s.profile = &p
+	}
+	if cfg.Control.PieceLen != 0 {
+		if err := s.profile.CheckPieceLength(cfg.Control.PieceLen); err != nil {
+			return nil, err
+		}
+		p := *s.profile
+		p.PieceLen = cfg.Control.PieceLen
+		s.profile = &p
+	}
+	if cfg.Control.BundleSize > 0 {
+		p := *s.profile
+		p.BundleSize = cfg.Control.BundleSize
+		s.profile = &p
+	}
+	if err := o.applyProfile(s); err != nil {
+		return nil, err
 	}
-	s.BaseService = *common.NewBaseService(cfg, cfg.Name, s)
+	if cfg.S3 != nil {
+		s.s3 = p2p.NewS3Client(cfg.S3)
+	}
+	var err error
+	if s.catalog, err = newCatalog(cfg.Control.CatalogFile); err != nil {
+		return nil, err
+	}
+	if s.history, err = openHistory(cfg.Control); err != nil {
+		return nil, err
+	}
+	if cfg.Sign != nil && cfg.Sign.PrivateKey != "" {
+		key, err := p2p.ParsePrivateKey(cfg.Sign.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		s.signKey = key
+	}
+	if o.rateLimit != nil {
+		s.rateLimit = o.rateLimit
+		s.sessionMgnt.SetSpeed(s.rateLimit)
+	}
+	s.BaseService = *common.NewBaseService(cfg, cfg.Name, s, l)
 	return s, nil
 }
 
 func (s *Server) OnStart(c *common.Config, e *echo.Echo) error {
 	go func() { s.sessionMgnt.Start() }()
+	if s.history != nil {
+		s.historyQuit = make(chan struct{})
+		go s.pruneHistory(s.historyQuit)
+	}
 
-	e.Use(middleware.BasicAuth(s.Auth))
+	e.Use(s.AuthMiddleware())
 	e.POST("/api/v1/server/tasks", s.CreateTask)
 	e.DELETE("/api/v1/server/tasks/:id", s.CancelTask)
 	e.GET("/api/v1/server/tasks/:id", s.QueryTask)
+	e.GET("/api/v1/server/tasks/:id/torrent", s.GetTorrent)
+	e.GET("/api/v1/server/tasks/:id/uri", s.GetTaskURI)
+	e.GET("/api/v1/server/tasks/:id/reports", s.QueryTransferReports)
+	e.GET("/api/v1/server/meta/:hash", s.GetMeta)
+	e.PUT("/api/v1/server/tasks/:id/priority", s.SetPriority)
+	e.POST("/api/v1/server/tasks/:id/preempt", s.PreemptTask)
+	e.POST("/api/v1/server/tasks/:id/pause", s.PauseTask)
+	e.POST("/api/v1/server/tasks/:id/resume", s.ResumeTask)
+	e.GET("/api/v1/server/queue", s.QueryQueue)
+	e.GET("/api/v1/server/namespaces", s.ListNamespaces)
+	e.GET("/api/v1/server/history", s.ListHistory)
+	e.GET("/api/v1/server/history/:id", s.GetHistory)
+	e.GET("/api/v1/tasks", s.ListTasks)
+	e.GET("/api/v1/tasks/:id", s.QueryTask)
+	e.DELETE("/api/v1/tasks/:id", s.CancelTask)
+	e.GET("/api/v1/tasks/:id/events", s.TaskEvents)
+	e.PATCH("/api/v1/tasks/:id", s.SetTaskLimits)
 	e.POST("/api/v1/server/tasks/status", s.ReportTask)
+	e.POST("/api/v1/server/speed", s.SetSpeed)
+	e.POST("/api/v1/server/agents", s.RegisterAgent)
+	e.GET("/api/v1/server/agents", s.ListAgents)
+	e.PUT("/api/v1/server/templates/:name", s.PutTemplate)
+	e.GET("/api/v1/server/templates", s.ListTemplates)
+	e.GET("/api/v1/server/templates/:name", s.GetTemplate)
+	e.DELETE("/api/v1/server/templates/:name", s.DeleteTemplate)
+	e.GET("/api/v1/server/artifacts", s.ListArtifacts)
+	e.GET("/api/v1/server/artifacts/:name/:version", s.GetArtifact)
+	e.DELETE("/api/v1/server/artifacts/:name/:version", s.DeleteArtifact)
+	e.POST("/api/v1/server/artifacts/:name/:version/push", s.PushArtifact)
+	e.GET("/api/v1/server/artifacts/:name/:version/export", s.ExportArtifact)
+	e.POST("/api/v1/server/artifacts/:name/:version/import", s.ImportArtifact)
+	e.GET("/api/v1/server/ha", s.QueryHa)
+	e.POST("/api/v1/server/ha/sync", s.SyncHa)
+	e.GET("/metrics", s.Metrics)
+	e.POST("/api/v1/reload", s.ReloadConfig)
+
+	if s.ha != nil {
+		s.checkHaPeer()
+		s.haQuit = make(chan struct{})
+		go s.runHa(s.haQuit)
+	}
 
+	if c.Net.GrpcPort != 0 {
+		if serveGrpc == nil {
+			return errors.New("Grpc api is not supported, build with -tags grpc")
+		}
+		stop, err := serveGrpc(s)
+		if err != nil {
+			return err
+		}
+		s.stopGrpc = stop
+	}
+
+	if c.Net.AnnouncePort != 0 {
+		if err := s.listenAnnounce(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Implements common.Reloader
+func (s *Server) OnReload(c *common.Config) {
+	s.scheduler.setMax(c.Control.MaxActive)
+	if s.rateLimit == nil {
+		s.sessionMgnt.SetSpeed(&p2p.SpeedLimit{Upload: c.Control.UploadSpeed, Download: c.Control.DownloadSpeed})
+	}
+}
+
 func (s *Server) OnStop(c *common.Config, e *echo.Echo) {
-	go func() { s.sessionMgnt.Stop() }()
+	if s.stopGrpc != nil {
+		s.stopGrpc()
+	}
+	if s.haQuit != nil {
+		close(s.haQuit)
+	}
+	if s.announceConn != nil {
+		s.announceConn.Close()
+	}
+	s.sessionMgnt.Stop()
+	if s.history != nil {
+		if s.historyQuit != nil {
+			close(s.historyQuit)
+		}
+		s.history.Close()
+	}
+}
+
+// 通过中继接收连接的Agent的数据地址与中继的地址，没有时为nil
+func (s *Server) agentRelays(ips []string) map[string]string {
+	var relays map[string]string
+	for ip, relay := range s.registry.relays(ips) {
+		if relays == nil {
+			relays = make(map[string]string)
+		}
+		relays[s.agentDataAddr(ip)] = relay
+	}
+	return relays
+}
+
+// Agent的数据地址，Agent通过NAT映射了数据端口或配置了advertise时使用上报的地址
+func (s *Server) agentDataAddr(ip string) string {
+	if addr := s.registry.dataAddr(ip); addr != "" {
+		return addr
+	}
+	return common.JoinHostPort(ip, s.Cfg.Net.AgentDataPort)
 }
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"time"
+)
+
+const (
+	// 任务状态以外的变化更新快照的最小间隔
+	TASK_SNAPSHOT_INTERVAL = time.Second
+)
+
+// 复制任务的状态，可以在任务的Goroutine之外读取。传输报告单独查询，不复制
+func (ti *TaskInfo) copy() *TaskInfo {
+	c := *ti
+	c.Transfers = nil
+	c.Files = append([]*TaskFile(nil), ti.Files...)
+	if ti.DispatchInfos != nil {
+		c.DispatchInfos = make(map[string]*DispatchInfo, len(ti.DispatchInfos))
+		for ip, di := range ti.DispatchInfos {
+			d := *di
+			d.DispatchFiles = make([]*DispatchFile, len(di.DispatchFiles))
+			for i, df := range di.DispatchFiles {
+				f := *df
+				d.DispatchFiles[i] = &f
+			}
+			if di.FileChecks != nil {
+				d.FileChecks = make(map[string]string, len(di.FileChecks))
+				for k, v := range di.FileChecks {
+					d.FileChecks[k] = v
+				}
+			}
+			c.DispatchInfos[ip] = &d
+		}
+	}
+	if ti.Failures != nil {
+		c.Failures = make(map[string]string, len(ti.Failures))
+		for k, v := range ti.Failures {
+			c.Failures[k] = v
+		}
+	}
+	if ti.BadPeers != nil {
+		c.BadPeers = make(map[string][]string, len(ti.BadPeers))
+		for k, v := range ti.BadPeers {
+			c.BadPeers[k] = append([]string(nil), v...)
+		}
+	}
+	return &c
+}
+
+// 任务的Goroutine处理完一个事件后调用。状态变化时立即更新快照，
+// 其它变化（如Agent上报的进度）由定时器最多每TASK_SNAPSHOT_INTERVAL更新一次
+func (ct *CachedTaskInfo) changed() {
+	ct.snapDirty = true
+	if ct.snap.Status != ct.ti.Status {
+		ct.updateSnapshot()
+	}
+}
+
+func (ct *CachedTaskInfo) updateSnapshot() {
+	snap := ct.ti.copy()
+	ct.snapLock.Lock()
+	ct.snap = snap
+	ct.snapLock.Unlock()
+	ct.snapDirty = false
+}
+
+// 任务状态的快照，不经过任务的Goroutine，创建元数据期间也不阻塞。
+// 进度可能落后TASK_SNAPSHOT_INTERVAL，返回的TaskInfo不能修改
+func (ct *CachedTaskInfo) Snapshot() *TaskInfo {
+	ct.snapLock.RLock()
+	defer ct.snapLock.RUnlock()
+	return ct.snap
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/xtfly/gofd/common"
+)
+
+// 快照不经过任务的Goroutine，与任务的TaskInfo不共享数据
+func TestTaskSnapshot(t *testing.T) {
+	s := &Server{BaseService: common.BaseService{Log: common.DefaultLogger()}}
+	ct := NewCachedTaskInfo(s, &CreateTask{Id: "1", DispatchFiles: []string{"/tmp/a"}, DestIPs: []string{"10.0.0.2"}})
+
+	// 任务的Goroutine没有运行时也可以读取
+	snap := ct.Snapshot()
+	if snap == nil || snap == ct.ti || snap.Status != TaskStatus_Queued.String() {
+		t.Fatalf("snapshot=%+v", snap)
+	}
+
+	// 进度变化在定时器触发时才更新
+	di := ct.ti.DispatchInfos["10.0.0.2"]
+	di.PercentComplete = 50
+	di.DispatchFiles[0].PercentComplete = 50
+	ct.changed()
+	if got := ct.Snapshot().DispatchInfos["10.0.0.2"]; got.PercentComplete != 0 || got.DispatchFiles[0].PercentComplete != 0 {
+		t.Fatal("snapshot shares dispatch infos with the task")
+	}
+	if !ct.snapDirty {
+		t.Fatal("change is not recorded")
+	}
+	ct.updateSnapshot()
+	if got := ct.Snapshot().DispatchInfos["10.0.0.2"]; got.PercentComplete != 50 || ct.snapDirty {
+		t.Fatalf("snapshot progress=%v after update", got.PercentComplete)
+	}
+
+	// 状态变化时立即更新
+	ct.ti.Status = TaskStatus_InProgress.String()
+	ct.changed()
+	if st := ct.Snapshot().Status; st != TaskStatus_InProgress.String() {
+		t.Fatalf("snapshot status=%s", st)
+	}
+	if snap.Status != TaskStatus_Queued.String() {
+		t.Fatal("previous snapshot is modified")
+	}
+}
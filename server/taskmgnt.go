@@ -1,12 +1,15 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 
-	log "github.com/cihub/seelog"
 	"github.com/xtfly/gofd/common"
 	"github.com/xtfly/gofd/p2p"
 	"github.com/xtfly/gokits"
@@ -15,6 +18,10 @@ import (
 type clientRsp struct {
 	IP      string
 	Success bool
+	Error   string
+	Code    string
+	Zone    string
+	Mode    string
 }
 
 type cmpTask struct {
@@ -26,50 +33,180 @@ type queryTask struct {
 	out chan *TaskInfo
 }
 
+type metaQuery struct {
+	out chan *p2p.MetaInfo
+}
+
+type announceQuery struct {
+	ip  string
+	out chan *p2p.AnnounceResponse
+}
+
 // 每一个Task，对应一个缓存对象，所有与它关联的操作都由一个Goroutine来处理
 type CachedTaskInfo struct {
-	s *Server
+	s   *Server
+	log common.Logger // 带有taskID字段
 
 	id            string
 	dispatchFiles []string
 	destIPs       []string
+	webSeeds      []string
+	noCompress    bool
+	previousPath  string
+	pieceLen      int64
+	bundleSize    int64
+	trackers      []string
+	encrypt       bool
+	priority      int
+	webhooks      []string
+	keepLinks     bool
+	seeders       []string
+	trustSeeders  bool
+	seedSample    int
+	sequential    bool
+	priorities    map[string]int
+	inMemory      bool
+	hooks         []*p2p.Hook
+	metaByURI     bool
+	ranges        []*p2p.FileRange
+	allAgents     bool
+	selector      string
+	dedupFiles    bool
+	destDir       string
+	seedLinger    int
+	pipe          []string
+	collect       bool
+	seedUntil     int
+	ttl           int
+	stallTimeout  int
+	limits        *p2p.TaskLimits
+	artifact      string
+	upgrade       bool
+	topology      string
+	fanout        int
+	namespace     string
+	client        string      // 创建任务的调用方，配置了ACL时只有其可以取消
+	task          *CreateTask // 提交的任务，主备时同步给备Server
 	ti            *TaskInfo
 
+	// 任务的Goroutine复制的ti，列出任务时读取，不需要等待任务的Goroutine
+	snapLock  sync.RWMutex
+	snap      *TaskInfo
+	snapDirty bool // ti在上次复制之后有变化，只在任务的Goroutine中访问
+
+	liveSeeds map[string]bool // 创建任务成功的种子节点
+	reseeds   []string        // 下载完成后继续上传的Agent，按完成的先后排列
+
+	availability *pieceAvailability // Agent上报的每个Piece的副本数
+	replicas     *replicaAssigner   // 复制模式下分配给Agent的Piece，其它任务为nil
+
+	submittedAt time.Time // 提交或失败后重新提交的时间，ttl从此时开始计算
+	progress    float32   // 检查停滞时所有Agent进度之和
+	progressAt  time.Time // 进度最近一次增长的时间
+
 	succCount int
 	failCount int
 	allCount  int
 
-	stopChan     chan struct{}
+	runChan      chan struct{} // 调度运行任务
+	preemptChan  chan int      // 被其它任务抢占，重新排队，值为当前的优先级
+	stopChan     chan bool     // 取消任务，为true时同时删除Agent上未下载完成的文件
 	quitChan     chan struct{}
 	reportChan   chan *p2p.StatusReport
 	agentRspChan chan *clientRsp
 	cmpChan      chan *cmpTask
+	pauseChan    chan *pauseTask
 	queryChan    chan *queryTask
+	metaChan     chan *metaQuery
+	availChan    chan *announceQuery
+	transferChan chan chan []*p2p.TransferReport
+
+	mi *p2p.MetaInfo // 任务运行后创建的元数据
+
+	span common.Span // 任务每次运行的Span，没有运行时为nil
+
+	// 创建元数据期间任务的Goroutine不处理stopChan，取消时先中止摘要计算
+	createLock   sync.Mutex
+	createCancel context.CancelFunc
 }
 
 func NewCachedTaskInfo(s *Server, t *CreateTask) *CachedTaskInfo {
-	return &CachedTaskInfo{
+	ct := &CachedTaskInfo{
 		s:             s,
+		log:           s.Log.With("taskID", t.Id),
 		id:            t.Id,
 		dispatchFiles: t.DispatchFiles,
 		destIPs:       t.DestIPs,
+		webSeeds:      t.WebSeeds,
+		noCompress:    t.NoCompress,
+		previousPath:  t.PreviousPath,
+		pieceLen:      t.PieceLen,
+		bundleSize:    t.BundleSize,
+		trackers:      s.backupTrackers(t.Trackers),
+		encrypt:       t.Encrypt,
+		priority:      t.Priority,
+		webhooks:      t.Webhooks,
+		keepLinks:     t.KeepLinks,
+		seeders:       t.Seeders,
+		trustSeeders:  t.TrustSeeders,
+		seedSample:    t.SeedSample,
+		sequential:    t.Sequential,
+		priorities:    t.FilePriorities,
+		inMemory:      t.InMemory,
+		hooks:         t.Hooks,
+		metaByURI:     t.MetaByURI,
+		ranges:        t.Ranges,
+		allAgents:     t.AllAgents,
+		selector:      t.Selector,
+		dedupFiles:    t.DedupFiles,
+		destDir:       t.DestDir,
+		seedLinger:    t.SeedLinger,
+		pipe:          t.Pipe,
+		collect:       t.CollectReports,
+		seedUntil:     t.SeedUntil,
+		ttl:           t.Ttl,
+		stallTimeout:  t.StallTimeout,
+		topology:      t.Topology,
+		fanout:        t.Fanout,
+		namespace:     t.Namespace,
+		limits:        t.Limits,
+		artifact:      t.Artifact,
+		upgrade:       t.Upgrade,
+		task:          t,
 		ti:            newTaskInfo(t),
+		liveSeeds:     make(map[string]bool),
 
-		stopChan:     make(chan struct{}),
+		runChan:      make(chan struct{}, 1),
+		preemptChan:  make(chan int, 1),
+		stopChan:     make(chan bool),
 		quitChan:     make(chan struct{}),
 		reportChan:   make(chan *p2p.StatusReport, 10),
 		agentRspChan: make(chan *clientRsp, 10),
 		cmpChan:      make(chan *cmpTask, 2),
+		pauseChan:    make(chan *pauseTask),
 		queryChan:    make(chan *queryTask, 2),
+		metaChan:     make(chan *metaQuery, 2),
+		availChan:    make(chan *announceQuery, 2),
+		transferChan: make(chan chan []*p2p.TransferReport, 2),
+		availability: newPieceAvailability(),
+		replicas:     newReplicaAssigner(t.Replication),
+		submittedAt:  time.Now(),
 	}
+	ct.snap = ct.ti.copy()
+	return ct
 }
 
 func newTaskInfo(t *CreateTask) *TaskInfo {
 	init := TaskStatus_Init.String()
-	ti := &TaskInfo{Id: t.Id, Status: init, StartedAt: time.Now()}
+	ti := &TaskInfo{Id: t.Id, Status: TaskStatus_Queued.String(), DispatchFiles: t.DispatchFiles, StartedAt: time.Now()}
+	ti.SuccessPercent = t.SuccessPercent
+	optional := make(map[string]bool, len(t.OptionalIPs))
+	for _, ip := range t.OptionalIPs {
+		optional[common.StripPort(ip)] = true
+	}
 	ti.DispatchInfos = make(map[string]*DispatchInfo, len(t.DestIPs))
 	for _, ip := range t.DestIPs {
-		di := &DispatchInfo{Status: init, StartedAt: time.Now()}
+		di := &DispatchInfo{Status: init, StartedAt: time.Now(), Optional: optional[common.StripPort(ip)]}
 		di.DispatchFiles = make([]*DispatchFile, len(t.DispatchFiles))
 		ti.DispatchInfos[ip] = di
 		for j, fn := range t.DispatchFiles {
@@ -79,105 +216,321 @@ func newTaskInfo(t *CreateTask) *TaskInfo {
 	return ti
 }
 
-func createLinkChain(cfg *common.Config, ips []string, ti *TaskInfo) *p2p.LinkChain {
+// 元数据中的文件与摘要，软链接没有内容，不返回摘要
+func taskFiles(mi *p2p.MetaInfo) []*TaskFile {
+	files := make([]*TaskFile, 0, len(mi.Files))
+	for _, fd := range mi.Files {
+		tf := &TaskFile{Name: fd.Name, Length: fd.Length}
+		if fd.Link == "" {
+			tf.Sum = hex.EncodeToString([]byte(fd.Sum))
+		}
+		files = append(files, tf)
+	}
+	return files
+}
+
+// dataAddr返回Agent的数据地址
+func createLinkChain(cfg *common.Config, ips []string, ti *TaskInfo, trackers []string, dataAddr func(string) string) *p2p.LinkChain {
 	lc := new(p2p.LinkChain)
-	lc.ServerAddr = fmt.Sprintf("%s:%v", cfg.Net.IP, cfg.Net.MgntPort)
+	lc.ServerAddr = common.JoinHostPort(cfg.Net.IP, cfg.Net.MgntPort)
+	lc.BackupAddrs = trackers
+	if cfg.Net.AnnouncePort != 0 {
+		lc.AnnounceAddr = common.JoinHostPort(cfg.Net.IP, cfg.Net.AnnouncePort)
+	}
 	lc.DispatchAddrs = make([]string, 1+len(ips))
 	// 第一个节点为服务端
-	lc.DispatchAddrs[0] = fmt.Sprintf("%s:%v", cfg.Net.IP, cfg.Net.DataPort)
+	lc.DispatchAddrs[0] = cfg.DataAddr()
 
-	idx := 1
+	// 同一zone的Agent排在一起，只有每个zone中排在前面的节点从其它zone下载。
+	// leech模式的Agent不给其它节点上传，排在各zone的最后
+	var zones []string
+	zoneIPs := make(map[string][]string)
+	leeches := make(map[string][]string)
 	for _, ip := range ips {
 		if di, ok := ti.DispatchInfos[ip]; ok && di.Status == TaskStatus_InProgress.String() {
-			lc.DispatchAddrs[idx] = fmt.Sprintf("%s:%v", ip, cfg.Net.AgentDataPort)
+			if len(zoneIPs[di.Zone])+len(leeches[di.Zone]) == 0 {
+				zones = append(zones, di.Zone)
+			}
+			if di.Mode == common.AGENT_MODE_LEECH {
+				leeches[di.Zone] = append(leeches[di.Zone], ip)
+				lc.Leeches = append(lc.Leeches, dataAddr(ip))
+			} else {
+				zoneIPs[di.Zone] = append(zoneIPs[di.Zone], ip)
+			}
+		}
+	}
+
+	// 与Server在同一zone的Agent排在最前面
+	for i, zone := range zones {
+		if zone == cfg.Net.Zone {
+			copy(zones[1:i+1], zones[:i])
+			zones[0] = zone
+			break
+		}
+	}
+
+	idx := 1
+	labels := []string{cfg.Net.Zone}
+	for _, zone := range zones {
+		for _, ip := range append(zoneIPs[zone], leeches[zone]...) {
+			lc.DispatchAddrs[idx] = dataAddr(ip)
+			labels = append(labels, zone)
 			idx++
 		}
 	}
 	lc.DispatchAddrs = lc.DispatchAddrs[:idx]
+	if len(zones) > 1 || (len(zones) == 1 && zones[0] != "") {
+		lc.Zones = labels
+		lc.ZoneBridges = cfg.Control.ZoneBridges
+	}
 
 	return lc
 }
 
-// 使用一个Goroutine来启动任务操作
+// 使用一个Goroutine来启动任务操作，由调度器通知运行
 func (ct *CachedTaskInfo) Start() {
-	if ts := ct.createTask(); ts != TaskStatus_InProgress {
-		ct.endTask(ts)
-	}
-
+	expireTick := time.NewTicker(TASK_EXPIRE_INTERVAL)
+	defer expireTick.Stop()
+	snapTick := time.NewTicker(TASK_SNAPSHOT_INTERVAL)
+	defer snapTick.Stop()
 	for {
 		select {
 		case <-ct.quitChan:
-			log.Infof("[%s] Quit task goroutine", ct.id)
+			ct.log.Infof("Quit task goroutine")
 			return
-		case <-ct.stopChan:
-			ct.endTask(TaskStatus_Failed)
-			ct.stopAllClientTask()
-		case c := <-ct.cmpChan:
-			// 内容不相同
-			if !equalSlice(c.t.DestIPs, ct.destIPs) || !equalSlice(c.t.DispatchFiles, ct.dispatchFiles) {
-				c.out <- false
+		case <-expireTick.C:
+			ct.checkExpired()
+		case <-ct.runChan:
+			if ct.ti.Status != TaskStatus_Queued.String() {
+				// 调度运行之前已经取消
+				ct.s.scheduler.done(ct.id)
+				continue
+			}
+			ct.ti.Status, ct.ti.Error, ct.ti.ErrorCode = TaskStatus_Init.String(), "", ""
+			// 创建元数据可能需要很长时间，先更新快照
+			ct.updateSnapshot()
+			ct.startSpan()
+			if ts := ct.createTask(); ts != TaskStatus_InProgress {
+				ct.endTask(ts)
+			} else {
+				ct.notify(&WebhookEvent{Event: WEBHOOK_TASK_STARTED})
+				if ct.limits != nil {
+					tl := *ct.limits
+					tl.TaskId = ct.id
+					ct.setLimits(&tl)
+				}
+			}
+		case priority := <-ct.preemptChan:
+			ct.preempted(priority)
+		case p := <-ct.pauseChan:
+			p.out <- ct.pause(p.pause)
+		case clean := <-ct.stopChan:
+			// 已经结束的任务不修改状态，只通知Agent清理
+			switch ct.ti.Status {
+			case TaskStatus_Queued.String():
+				ct.s.scheduler.remove(ct.id)
+				ct.endTask(TaskStatus_Canceled)
+			case TaskStatus_Init.String(), TaskStatus_InProgress.String(), TaskStatus_Paused.String():
+				ct.endTask(TaskStatus_Canceled)
 			}
+			ct.stopAllClientTask(clean)
+		case c := <-ct.cmpChan:
+			equal := ct.equalTask(c.t)
+			c.out <- equal
 			// 内容相同，如果失败了，则重新启动
-			c.out <- true
-			if ct.ti.Status == TaskStatus_Failed.String() {
+			if equal && ct.ti.Status == TaskStatus_Failed.String() {
 				ct.s.cache.Replace(ct.id, ct, gokits.NoExpiration)
-				log.Infof("[%s] Task status is FAILED, will start task try again", ct.id)
-				if ts := ct.createTask(); ts != TaskStatus_InProgress {
-					ct.endTask(ts)
-				}
+				ct.log.Infof("Task status is FAILED, will start task try again")
+				ct.ti.Status = TaskStatus_Queued.String()
+				ct.submittedAt = time.Now()
+				ct.s.quotas.start(ct.namespace, ct.id)
+				ct.s.scheduler.submit(ct, ct.priority)
 			}
+		case <-snapTick.C:
+			if ct.snapDirty {
+				ct.updateSnapshot()
+			}
+			continue
 		case q := <-ct.queryChan:
-			q.out <- ct.ti
+			q.out <- ct.ti.copy()
+			continue
+		case q := <-ct.metaChan:
+			q.out <- ct.mi
+			continue
+		case out := <-ct.transferChan:
+			out <- ct.transferReports()
+			continue
+		case q := <-ct.availChan:
+			q.out <- &p2p.AnnounceResponse{Availability: ct.availability.snapshot(), Seeds: ct.reseedAddrs(), BadPeers: ct.badPeerAddrs(),
+				Assign: ct.assignPieces(q.ip)}
 		case csr := <-ct.reportChan:
 			ct.reportStatus(csr)
-			if ts, ok := checkFinished(ct.ti); ok {
+			if ts, reason, ok := checkFinished(ct.ti); ok {
+				if ts == TaskStatus_Failed {
+					ct.log.Errorf("Task does not meet success policy, %s", reason)
+					ct.ti.Error = reason
+				}
 				ct.endTask(ts)
-				ct.stopAllClientTask()
+				ct.stopAllClientTask(false)
 			}
 		}
+		ct.changed()
 	}
 }
 
 func (ct *CachedTaskInfo) endTask(ts TaskStatus) {
-	log.Errorf("[%s] Task status changed, status=%v", ct.id, ts)
+	ct.log.Errorf("Task status changed, status=%v", ts)
 	ct.ti.Status = ts.String()
 	ct.ti.FinishedAt = time.Now()
-	log.Infof("[%s] Task elapsed time: (%.2f seconds)", ct.id, ct.ti.FinishedAt.Sub(ct.ti.StartedAt).Seconds())
-	ct.s.cache.Replace(ct.id, ct, 5*time.Minute)
+	ct.log.Infof("Task elapsed time: (%.2f seconds)", ct.ti.FinishedAt.Sub(ct.ti.StartedAt).Seconds())
+	// 保留一段时间，期间重复提交返回任务的状态
+	ct.s.cache.Replace(ct.id, ct, time.Duration(ct.s.Cfg.Control.TaskRetention)*time.Second)
 	ct.s.sessionMgnt.StopTask(ct.id)
+	ct.s.scheduler.done(ct.id)
+	ct.s.quotas.finish(ct.namespace, ct.id)
+	ct.endSpan()
+
+	ct.ti.Failures = nil
+	var failedIPs []string
+	for ip, di := range ct.ti.DispatchInfos {
+		if di.Status == TaskStatus_Failed.String() {
+			if ct.ti.Failures == nil {
+				ct.ti.Failures = make(map[string]string)
+			}
+			ct.ti.Failures[ip] = di.Error
+			failedIPs = append(failedIPs, ip)
+		}
+	}
+	sort.Strings(failedIPs)
+	ct.s.saveHistory(ct.ti)
+
+	switch ts {
+	case TaskStatus_Completed:
+		ct.notify(&WebhookEvent{Event: WEBHOOK_TASK_COMPLETED, FailedIPs: failedIPs})
+	case TaskStatus_Canceled:
+		ct.notify(&WebhookEvent{Event: WEBHOOK_TASK_CANCELED})
+	default:
+		ct.notify(&WebhookEvent{Event: WEBHOOK_TASK_FAILED, FailedIPs: failedIPs})
+	}
+}
+
+func (ct *CachedTaskInfo) notify(e *WebhookEvent) {
+	e.TaskId = ct.id
+	if e.Status == "" {
+		e.Status = ct.ti.Status
+	}
+	ct.s.webhooker.notify(ct.webhooks, e)
+	ct.publish(&TaskEvent{WebhookEvent: *e})
+}
+
+// 被抢占时停止所有节点的下载，Agent保留已下载的数据，重新运行时断点续传
+func (ct *CachedTaskInfo) preempted(priority int) {
+	// 还没有开始运行时，丢弃调度的通知
+	select {
+	case <-ct.runChan:
+	default:
+	}
+	switch ct.ti.Status {
+	case TaskStatus_Init.String(), TaskStatus_InProgress.String(), TaskStatus_Paused.String():
+		ct.stopAllClientTask(false)
+	case TaskStatus_Queued.String():
+	default: // 已经结束
+		return
+	}
+	ct.log.Infof("Task is preempted, queue again")
+	ct.priority = priority
+	ct.ti.Status = TaskStatus_Queued.String()
+	ct.endSpan()
+	ct.s.scheduler.requeue(ct, priority)
 }
 
 func (ct *CachedTaskInfo) createTask() TaskStatus {
 	// 先产生任务元数据信息
-	start := time.Now()
-	mi, err := p2p.CreateFileMeta(ct.dispatchFiles, 1024*1024)
-	end := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	ct.setCreateCancel(cancel)
+	defer ct.setCreateCancel(nil)
+	defer cancel()
+
+	span := common.StartSpan(ct.span, "task.meta")
+	mi, err := ct.createMeta(ctx, true)
+	span.SetError(err)
+	span.End()
+	if err != nil && ctx.Err() != nil {
+		ct.log.Infof("Create file meta canceled")
+		return TaskStatus_Canceled
+	}
 	if err != nil {
-		log.Errorf("[%s] Create file meta failed, error=%v", ct.id, err)
+		ct.log.Errorf("Create file meta failed, error=%v", err)
+		ct.ti.Error, ct.ti.ErrorCode = err.Error(), common.ErrorCode(err)
 		return TaskStatus_FileNotExist
 	}
-	log.Infof("[%s] Create metainfo: (%.2f seconds)", ct.id, end.Sub(start).Seconds())
-
-	dt := &p2p.DispatchTask{
-		TaskId:   ct.id,
-		MetaInfo: mi,
-		Speed:    int64(ct.s.Cfg.Control.Speed * 1024 * 1024),
+	mi.WebSeeds = ct.webSeeds
+	mi.NoCompress = ct.noCompress
+	mi.Upgrade = ct.upgrade
+	if ct.s.signKey != nil {
+		// 签名覆盖除加密密钥外的所有字段，需要在修改元数据之后
+		if err = mi.Sign(ct.s.signKey); err != nil {
+			ct.log.Errorf("Sign metainfo failed, error=%v", err)
+			ct.ti.Error = err.Error()
+			return TaskStatus_Failed
+		}
+	}
+	if ct.encrypt {
+		if mi.EncryptKey, err = p2p.NewEncryptKey(); err != nil {
+			ct.log.Errorf("Create encrypt key failed, error=%v", err)
+			ct.ti.Error = err.Error()
+			return TaskStatus_Failed
+		}
 	}
-	dt.LinkChain = createLinkChain(ct.s.Cfg, []string{}, ct.ti) //
 
-	dtbytes, err1 := json.Marshal(dt)
+	ct.mi = mi
+	ct.ti.Files = taskFiles(mi)
+	ct.s.quotas.addBytes(ct.namespace, mi.Length*int64(len(ct.destIPs)))
+	dt := ct.dispatchTask(mi)
+	dt.LinkChain = createLinkChain(ct.s.Cfg, []string{}, ct.ti, ct.trackers, ct.s.agentDataAddr) //
+
+	// 本节点的Session使用完整的元数据，Agent只收到任务URI。文件很多时元数据很大，
+	// 不在创建任务的请求中下发给每个Agent，由Agent以压缩的JSONL获取
+	if !ct.metaByURI && len(mi.Files) > p2p.LARGE_META_FILES {
+		ct.log.Infof("Task has %v files, dispatch metainfo by uri", len(mi.Files))
+		ct.metaByURI = true
+	}
+	adt := dt
+	if ct.metaByURI {
+		a := *dt
+		a.MetaInfo = nil
+		a.URI = ct.taskURI(mi).String()
+		adt = &a
+	}
+	dtbytes, err1 := json.Marshal(adt)
 	if err1 != nil {
 		return TaskStatus_Failed
 	}
-	log.Debugf("[%s] Create dispatch task, task=%v", ct.id, string(dtbytes))
+	if !ct.encrypt || ct.metaByURI { // 不在日志中输出密钥
+		ct.log.Debugf("Create dispatch task, task=%v", string(dtbytes))
+	}
 
-	ct.allCount = len(ct.destIPs)
+	ct.allCount = len(ct.destIPs) + len(ct.seeders)
 	ct.succCount, ct.failCount = 0, 0
+	ct.progress, ct.progressAt = 0, time.Now()
+	ct.liveSeeds = make(map[string]bool)
+	ct.reseeds = nil
 	ct.ti.Status = TaskStatus_InProgress.String()
 	// 提交到session管理中运行
 	ct.s.sessionMgnt.CreateTask(dt)
 	// 给各节点发送创建分发任务的Rest消息
 	ct.sendReqToClients(ct.destIPs, "/api/v1/agent/tasks", dtbytes)
+	if len(ct.seeders) > 0 {
+		seed := *adt
+		seed.Seed = true
+		seed.TrustSeed, seed.SeedSample = ct.trustSeeders, ct.seedSample
+		seed.DestDir = "" // 种子节点使用dispatchFiles相同的路径
+		seedbytes, err := json.Marshal(&seed)
+		if err != nil {
+			return TaskStatus_Failed
+		}
+		ct.sendReqToClients(ct.seeders, "/api/v1/agent/tasks", seedbytes)
+	}
 
 	for {
 		select {
@@ -195,37 +548,196 @@ func (ct *CachedTaskInfo) createTask() TaskStatus {
 			}
 		case <-time.After(5 * time.Second): // 等超时
 			if ct.succCount == 0 {
-				log.Errorf("[%s] Wait client response timeout.", ct.id)
+				ct.log.Errorf("Wait client response timeout.")
+				ct.ti.Error = "Wait agent response timeout"
 				return TaskStatus_Failed
 			}
 		}
 	}
 }
 
+// 创建元数据，制品目录中的文件没有变化时复用已有的元数据。save为true时新创建的元数据保存到制品目录
+func (ct *CachedTaskInfo) createMeta(ctx context.Context, save bool) (*p2p.MetaInfo, error) {
+	profile := ct.s.profile
+	if ct.pieceLen != 0 || ct.bundleSize != 0 {
+		p := *profile
+		if ct.pieceLen != 0 {
+			p.PieceLen = ct.pieceLen
+		}
+		if ct.bundleSize != 0 {
+			p.BundleSize = ct.bundleSize
+		}
+		profile = &p
+	}
+
+	mi, stamp := ct.artifactMeta()
+	if mi != nil {
+		return mi, nil
+	}
+	start := time.Now()
+	opts := &p2p.CreateOptions{Profile: profile, S3: ct.s.s3, KeepLinks: ct.keepLinks, DedupFiles: ct.dedupFiles, Log: ct.log}
+	var err error
+	if len(ct.ranges) > 0 {
+		mi, err = p2p.CreateRangesFileMetaContext(ctx, ct.ranges, opts)
+	} else {
+		mi, err = p2p.CreateFileMetaContext(ctx, ct.dispatchFiles, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ct.log.Infof("Create metainfo: (%.2f seconds)", time.Now().Sub(start).Seconds())
+	if save {
+		ct.saveArtifact(mi, stamp)
+	}
+	return mi, nil
+}
+
+// 下发给Agent的任务，不包含分发路径
+func (ct *CachedTaskInfo) dispatchTask(mi *p2p.MetaInfo) *p2p.DispatchTask {
+	return &p2p.DispatchTask{
+		TaskId:   ct.id,
+		MetaInfo: mi,
+		Speed:    int64(ct.s.Cfg.Control.Speed * 1024 * 1024),
+
+		PreviousPath:   ct.previousPath,
+		Sequential:     ct.sequential,
+		FilePriorities: ct.priorities,
+		TraceParent:    ct.traceParent(),
+		InMemory:       ct.inMemory,
+		Hooks:          ct.hooks,
+		DestDir:        ct.destDir,
+		SeedLinger:     ct.seedLinger,
+		Replicate:      ct.replicas != nil,
+		Ttl:            ct.remainingTtl(),
+		Pipe:           ct.pipe,
+		PushReport:     ct.collect,
+		Upgrade:        ct.upgrade,
+	}
+}
+
+// 制品目录中文件与元数据都没有变化时，返回复制的元数据，否则返回nil与文件当前的摘要
+func (ct *CachedTaskInfo) artifactMeta() (*p2p.MetaInfo, string) {
+	if ct.artifact == "" {
+		return nil, ""
+	}
+	stamp, err := filesStamp(ct.dispatchFiles, ct.ranges)
+	if err != nil {
+		ct.log.Warnf("Stat files of artifact %s failed, error=%v", ct.artifact, err)
+		return nil, ""
+	}
+	a, mi, ok := ct.s.catalog.artifact(ct.artifact)
+	if !ok || a.Stamp != stamp || !equalSlice(a.DispatchFiles, ct.dispatchFiles) || !equalRanges(a.Ranges, ct.ranges) ||
+		(ct.pieceLen != 0 && mi.PieceLen != ct.pieceLen) || (ct.bundleSize != 0 && mi.BundleSize != ct.bundleSize) {
+		return nil, stamp
+	}
+	ct.log.Infof("Reuse metainfo of artifact %s", ct.artifact)
+	return mi, stamp
+}
+
+// 创建的元数据保存到制品目录，在设置WebSeeds、签名与密钥之前调用
+func (ct *CachedTaskInfo) saveArtifact(mi *p2p.MetaInfo, stamp string) {
+	if ct.artifact == "" || stamp == "" {
+		return
+	}
+	name, version, err := parseArtifact(ct.artifact)
+	if err != nil {
+		return
+	}
+	saved, err := copyMeta(mi)
+	if err != nil {
+		return
+	}
+	a := &Artifact{
+		Name:          name,
+		Version:       version,
+		DispatchFiles: ct.dispatchFiles,
+		Ranges:        ct.ranges,
+		InfoHash:      mi.InfoHash(),
+		Length:        mi.Length,
+		TaskId:        ct.id,
+		CreatedAt:     time.Now(),
+		Stamp:         stamp,
+	}
+	if err = ct.s.catalog.putArtifact(a, saved); err != nil {
+		ct.log.Errorf("Save artifact %s failed, error=%v", ct.artifact, err)
+		return
+	}
+	ct.log.Infof("Saved artifact %s, infoHash=%s", ct.artifact, a.InfoHash)
+}
+
+// 任务的URI，服务端与备用的Server都可以提供元数据
+func (ct *CachedTaskInfo) taskURI(mi *p2p.MetaInfo) *p2p.TaskURI {
+	tu := &p2p.TaskURI{TaskId: ct.id, InfoHash: mi.InfoHash()}
+	tu.Trackers = append([]string{common.JoinHostPort(ct.s.Cfg.Net.IP, ct.s.Cfg.Net.MgntPort)}, ct.trackers...)
+	return tu
+}
+
 func (ct *CachedTaskInfo) checkAgentRsp(tcr *clientRsp) {
+	if ct.isSeeder(tcr.IP) {
+		// 种子节点创建失败时，Agent只从Server与其它种子节点下载
+		if tcr.Success {
+			ct.liveSeeds[tcr.IP] = true
+			ct.succCount++
+		} else {
+			ct.log.Warnf("Create task on seeder failed, ip=%s, error=%s", tcr.IP, tcr.Error)
+			ct.failCount++
+		}
+		return
+	}
 	if di, ok := ct.ti.DispatchInfos[tcr.IP]; ok {
 		di.StartedAt = time.Now()
+		if tcr.Zone != "" {
+			di.Zone = tcr.Zone
+		}
+		di.Mode = tcr.Mode
 		if tcr.Success {
 			di.Status = TaskStatus_InProgress.String()
 			ct.succCount++
 		} else {
 			di.Status = TaskStatus_Failed.String()
+			di.Error, di.ErrorCode = tcr.Error, tcr.Code
 			di.FinishedAt = time.Now()
 			ct.failCount++
 		}
+		ct.publish(&TaskEvent{WebhookEvent: WebhookEvent{Event: EVENT_AGENT_STATUS, IP: tcr.IP, Status: di.Status}, Error: di.Error,
+			ErrorCode: di.ErrorCode})
+	}
+}
+
+func (ct *CachedTaskInfo) isSeeder(ip string) bool {
+	for _, s := range ct.seeders {
+		if common.StripPort(s) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// 创建任务成功的种子节点的数据地址
+func (ct *CachedTaskInfo) seedAddrs() []string {
+	var addrs []string
+	for _, s := range ct.seeders {
+		if ip := common.StripPort(s); ct.liveSeeds[ip] {
+			addrs = append(addrs, ct.s.agentDataAddr(ip))
+		}
 	}
+	return addrs
 }
 
 func (ct *CachedTaskInfo) startTask() TaskStatus {
-	log.Infof("[%s] Recv all client response, will send start command to clients", ct.id)
+	ct.log.Infof("Recv all client response, will send start command to clients")
 	st := &p2p.StartTask{TaskId: ct.id}
-	st.LinkChain = createLinkChain(ct.s.Cfg, ct.destIPs, ct.ti)
+	// 创建任务后心跳超时的Agent不加入Peer列表，负载低的Agent排在前面
+	st.LinkChain = createLinkChain(ct.s.Cfg, ct.s.registry.byLoad(ct.s.registry.filterAlive(ct.destIPs)), ct.ti, ct.trackers, ct.s.agentDataAddr)
+	st.LinkChain.Relays = ct.s.agentRelays(ct.destIPs)
+	st.LinkChain.SeedAddrs = ct.seedAddrs()
+	st.LinkChain.Topology, st.LinkChain.Fanout = ct.topology, ct.fanout
 
 	stbytes, err1 := json.Marshal(st)
 	if err1 != nil {
 		return TaskStatus_Failed
 	}
-	log.Debugf("[%s] Create start task, task=%v", ct.id, string(stbytes))
+	ct.log.Debugf("Create start task, task=%v", string(stbytes))
 
 	// 第一个是Server，不用发送启动
 	ct.allCount = len(st.LinkChain.DispatchAddrs) - 1
@@ -246,7 +758,8 @@ func (ct *CachedTaskInfo) startTask() TaskStatus {
 			}
 		case <-time.After(5 * time.Second): // 等超时
 			if ct.succCount == 0 {
-				log.Errorf("[%s] Wait client response timeout.", ct.id)
+				ct.log.Errorf("Wait client response timeout.")
+				ct.ti.Error = "Wait agent response timeout"
 				return TaskStatus_Failed
 			}
 		}
@@ -254,33 +767,88 @@ func (ct *CachedTaskInfo) startTask() TaskStatus {
 }
 
 func (ct *CachedTaskInfo) sendReqToClients(ips []string, url string, body []byte) {
+	parent := ct.span
 	for _, ip := range ips {
-		if idx := strings.Index(ip, ":"); idx > 0 {
-			ip = ip[:idx]
-		}
+		ip = common.StripPort(ip)
 
 		go func(ip string) {
-			if _, err2 := ct.s.HttpPost(ip, url, body); err2 != nil {
-				log.Errorf("[%s] Send http request failed. POST, ip=%s, url=%s, error=%v", ct.id, ip, url, err2)
-				ct.agentRspChan <- &clientRsp{IP: ip, Success: false}
+			span := common.StartSpan(parent, "task.dispatch", "agent.ip", ip)
+			defer span.End()
+			if !ct.s.registry.alive(ip) {
+				ct.log.Errorf("Agent heartbeat timeout, ip=%s, url=%s", ip, url)
+				span.SetError(errAgentTimeout)
+				ct.agentRspChan <- &clientRsp{IP: ip, Success: false, Error: "Agent heartbeat timeout", Code: common.ERR_PEER_UNREACHABLE}
+				return
+			}
+			if rsp, err2 := ct.s.HttpPost(ip, url, body); err2 != nil {
+				ct.log.Errorf("Send http request failed. POST, ip=%s, url=%s, error=%v", ip, url, err2)
+				span.SetError(err2)
+				ct.agentRspChan <- &clientRsp{IP: ip, Success: false, Error: err2.Error(), Code: common.ErrorCode(err2)}
 			} else {
-				log.Debugf("[%s] Send http request success. POST, ip=%s, url=%s", ct.id, ip, url)
-				ct.agentRspChan <- &clientRsp{IP: ip, Success: true}
+				ct.log.Debugf("Send http request success. POST, ip=%s, url=%s", ip, url)
+				// 旧版本的Agent没有响应内容
+				tcr := &p2p.CreateTaskRsp{}
+				if len(rsp) > 0 {
+					json.Unmarshal(rsp, tcr)
+				}
+				ct.agentRspChan <- &clientRsp{IP: ip, Success: true, Zone: tcr.Zone, Mode: tcr.Mode}
 			}
 		}(ip)
 	}
 }
 
 // 给所有客户端发送停止命令
-func (ct *CachedTaskInfo) stopAllClientTask() {
+func (ct *CachedTaskInfo) stopAllClientTask(clean bool) {
 	url := "/api/v1/agent/tasks/" + ct.id
+	if clean {
+		url += "?clean=true"
+	}
 	ct.s.sessionMgnt.StopTask(ct.id)
-	for _, ip := range ct.destIPs {
+	for _, ip := range append(append([]string{}, ct.destIPs...), ct.seeders...) {
 		go func(ip string) {
 			if err2 := ct.s.HttpDelete(ip, url); err2 != nil {
-				log.Errorf("[%s] Send http request failed. DELETE, ip=%s, url=%s, error=%v", ct.id, ip, url, err2)
+				ct.log.Errorf("Send http request failed. DELETE, ip=%s, url=%s, error=%v", ip, url, err2)
+			} else {
+				ct.log.Debugf("Send http request success. DELETE, ip=%s, url=%s", ip, url)
+			}
+		}(ip)
+	}
+}
+
+// 调整任务的速率，并通知所有客户端
+func (ct *CachedTaskInfo) setSpeed(sl *p2p.SpeedLimit) {
+	ct.s.sessionMgnt.SetSpeed(sl)
+	body, err := json.Marshal(sl)
+	if err != nil {
+		return
+	}
+	url := "/api/v1/agent/speed"
+	for _, ip := range ct.destIPs {
+		go func(ip string) {
+			if _, err2 := ct.s.HttpPost(ip, url, body); err2 != nil {
+				ct.log.Errorf("Send http request failed. POST, ip=%s, url=%s, error=%v", ip, url, err2)
+			} else {
+				ct.log.Debugf("Send http request success. POST, ip=%s, url=%s", ip, url)
+			}
+		}(ip)
+	}
+}
+
+// 调整本节点与所有Agent上该任务的传输限制，包括种子节点
+func (ct *CachedTaskInfo) setLimits(tl *p2p.TaskLimits) {
+	ct.s.sessionMgnt.SetLimits(tl)
+	body, err := json.Marshal(tl)
+	if err != nil {
+		return
+	}
+	url := "/api/v1/agent/tasks/" + tl.TaskId
+	ips := append(append([]string{}, ct.destIPs...), ct.seeders...)
+	for _, ip := range ips {
+		go func(ip string) {
+			if _, err2 := ct.s.HttpPatch(ip, url, body); err2 != nil {
+				ct.log.Errorf("Send http request failed. PATCH, ip=%s, url=%s, error=%v", ip, url, err2)
 			} else {
-				log.Debugf("[%s] Send http request success. DELETE, ip=%s, url=%s", ct.id, ip, url)
+				ct.log.Debugf("Send http request success. PATCH, ip=%s, url=%s", ip, url)
 			}
 		}(ip)
 	}
@@ -288,17 +856,141 @@ func (ct *CachedTaskInfo) stopAllClientTask() {
 
 func (ct *CachedTaskInfo) reportStatus(csr *p2p.StatusReport) {
 	if di, ok := ct.ti.DispatchInfos[csr.IP]; ok {
+		status := di.Status
 		if int(csr.PercentComplete) == 100 {
+			if di.Status != TaskStatus_Completed.String() {
+				ct.notify(&WebhookEvent{Event: WEBHOOK_AGENT_COMPLETED, IP: csr.IP, Status: TaskStatus_Completed.String()})
+				if di.Mode != common.AGENT_MODE_LEECH {
+					ct.addReseed(csr.IP)
+				}
+			}
 			di.Status = TaskStatus_Completed.String()
 			di.FinishedAt = time.Now()
-			log.Infof("[%s] Recv report task status is completed, ip=%s", ct.id, csr.IP)
+			ct.log.Infof("Recv report task status is completed, ip=%s", csr.IP)
 		} else if int(csr.PercentComplete) == -1 {
 			di.Status = TaskStatus_Failed.String()
 			di.FinishedAt = time.Now()
-			log.Infof("[%s] Recv report task status is failed, ip=%s", ct.id, csr.IP)
+			ct.log.Infof("Recv report task status is failed, ip=%s, error=%s", csr.IP, csr.Error)
+		} else if csr.Leaving && di.Status != TaskStatus_Completed.String() {
+			// Agent退出，已保存下载状态，重新创建任务后继续下载
+			di.Status = TaskStatus_Failed.String()
+			di.FinishedAt = time.Now()
+			ct.log.Infof("Recv report agent is leaving, ip=%s, percent=%v", csr.IP, csr.PercentComplete)
+			if csr.Error == "" {
+				csr.Error, csr.ErrorCode = "Agent left before completed", "AGENT_LEFT"
+			}
+		}
+		if di.Status == TaskStatus_Failed.String() {
+			ct.removeReseed(csr.IP)
+		}
+		if csr.Transfer != nil {
+			if ct.ti.Transfers == nil {
+				ct.ti.Transfers = make(map[string]*p2p.TransferReport)
+			}
+			ct.ti.Transfers[csr.IP] = csr.Transfer
+		}
+		ct.addBadPeers(csr.IP, csr.BadPeers)
+		for _, fc := range csr.Files {
+			if di.FileChecks == nil {
+				di.FileChecks = make(map[string]string)
+			}
+			if fc.Status == p2p.FILE_CHECK_VERIFIED && di.FileChecks[fc.Name] != fc.Status {
+				ct.notify(&WebhookEvent{Event: WEBHOOK_FILE_COMPLETED, IP: csr.IP, File: fc.Name})
+			}
+			di.FileChecks[fc.Name] = fc.Status
+		}
+		di.PercentComplete, di.Speed, di.Error, di.ErrorCode = csr.PercentComplete, csr.Speed, csr.Error, csr.ErrorCode
+		if di.Status != status {
+			ct.publish(&TaskEvent{WebhookEvent: WebhookEvent{Event: EVENT_AGENT_STATUS, IP: csr.IP, Status: di.Status}, Error: di.Error,
+				ErrorCode: di.ErrorCode})
+		} else if di.Status == TaskStatus_InProgress.String() {
+			ct.publish(&TaskEvent{WebhookEvent: WebhookEvent{Event: EVENT_AGENT_PROGRESS, IP: csr.IP, Status: di.Status},
+				Percent: di.PercentComplete, Speed: di.Speed})
+		}
+		if int(csr.PercentComplete) == -1 || csr.Leaving {
+			ct.availability.update(csr.IP, nil)
+			ct.replicas.drop(csr.IP)
+		} else if len(csr.Have) > 0 {
+			ct.availability.update(csr.IP, csr.Have)
+		}
+		ct.updateReplicas()
+	}
+}
+
+// Agent下载完成后作为种子返回给其它Agent，之后又有seedUntil个Agent完成时通知它停止上传
+func (ct *CachedTaskInfo) addReseed(ip string) {
+	ct.reseeds = append(ct.reseeds, ip)
+	if ct.seedUntil <= 0 || len(ct.reseeds) <= ct.seedUntil {
+		return
+	}
+	done := ct.reseeds[0]
+	ct.reseeds = ct.reseeds[1:]
+	ct.log.Infof("Stop seeding on agent, %v agents completed after it, ip=%s", ct.seedUntil, done)
+	go func() {
+		if err := ct.s.HttpDelete(done, "/api/v1/agent/tasks/"+ct.id); err != nil {
+			ct.log.Errorf("Send http request failed. DELETE, ip=%s, error=%v", done, err)
+		}
+	}()
+}
+
+func (ct *CachedTaskInfo) removeReseed(ip string) {
+	for i, s := range ct.reseeds {
+		if s == ip {
+			ct.reseeds = append(ct.reseeds[:i], ct.reseeds[i+1:]...)
+			return
+		}
+	}
+}
+
+func (ct *CachedTaskInfo) reseedAddrs() []string {
+	addrs := make([]string, 0, len(ct.reseeds))
+	for _, ip := range ct.reseeds {
+		addrs = append(addrs, ct.s.agentDataAddr(ip))
+	}
+	return addrs
+}
+
+// 记录Agent上报的坏Peer，返回给其它Agent
+func (ct *CachedTaskInfo) addBadPeers(ip string, addrs []string) {
+	for _, addr := range addrs {
+		reporters := ct.ti.BadPeers[addr]
+		if containsString(reporters, ip) {
+			continue
 		}
-		di.PercentComplete = csr.PercentComplete
+		if ct.ti.BadPeers == nil {
+			ct.ti.BadPeers = make(map[string][]string)
+		}
+		ct.ti.BadPeers[addr] = append(reporters, ip)
+		ct.log.Warnf("Agent reported peer %s sending bad pieces, ip=%s", addr, ip)
+	}
+}
+
+func (ct *CachedTaskInfo) badPeerAddrs() []string {
+	if len(ct.ti.BadPeers) == 0 {
+		return nil
+	}
+	addrs := make([]string, 0, len(ct.ti.BadPeers))
+	for addr := range ct.ti.BadPeers {
+		addrs = append(addrs, addr)
 	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (ct *CachedTaskInfo) setCreateCancel(cancel context.CancelFunc) {
+	ct.createLock.Lock()
+	defer ct.createLock.Unlock()
+	ct.createCancel = cancel
+}
+
+// 取消任务，clean为true时同时删除Agent上未下载完成的文件
+func (ct *CachedTaskInfo) Cancel(clean bool) {
+	ct.createLock.Lock()
+	if ct.createCancel != nil {
+		ct.createCancel()
+	}
+	ct.createLock.Unlock()
+	ct.stopChan <- clean
 }
 
 func (ct *CachedTaskInfo) Query() *TaskInfo {
@@ -308,47 +1000,142 @@ func (ct *CachedTaskInfo) Query() *TaskInfo {
 	return <-qchan
 }
 
+// 任务的元数据，任务还没有运行时返回nil
+func (ct *CachedTaskInfo) MetaInfo() *p2p.MetaInfo {
+	q := &metaQuery{out: make(chan *p2p.MetaInfo, 1)}
+	ct.metaChan <- q
+	return <-q.out
+}
+
+// 所有Agent中拥有每个Piece的个数，以及下载完成后继续上传的Agent。复制模式下同时给ip分配需要下载的Piece
+func (ct *CachedTaskInfo) Announce(ip string) *p2p.AnnounceResponse {
+	q := &announceQuery{ip: ip, out: make(chan *p2p.AnnounceResponse, 1)}
+	ct.availChan <- q
+	return <-q.out
+}
+
+// Agent上报的传输报告，按IP排序
+func (ct *CachedTaskInfo) TransferReports() []*p2p.TransferReport {
+	out := make(chan []*p2p.TransferReport, 1)
+	ct.transferChan <- out
+	return <-out
+}
+
+func (ct *CachedTaskInfo) transferReports() []*p2p.TransferReport {
+	trs := make([]*p2p.TransferReport, 0, len(ct.ti.Transfers))
+	for _, tr := range ct.ti.Transfers {
+		trs = append(trs, tr)
+	}
+	sort.Slice(trs, func(i, j int) bool { return trs[i].IP < trs[j].IP })
+	return trs
+}
+
 func (ct *CachedTaskInfo) EqualCmp(t *CreateTask) bool {
-	cchan := make(chan bool, 2)
+	cchan := make(chan bool, 1)
 	ct.cmpChan <- &cmpTask{t: t, out: cchan}
-	defer close(cchan)
 	return <-cchan
 }
 
-func checkFinished(ti *TaskInfo) (TaskStatus, bool) {
+// 重复提交的任务分发的文件与节点是否相同，不比较优先级、速率等运行参数
+func (ct *CachedTaskInfo) equalTask(t *CreateTask) bool {
+	// 分发给所有Agent或按标签选择时，节点在创建时确定
+	selected := len(t.DestIPs) == 0 && (t.AllAgents && ct.allAgents || t.Selector != "" && t.Selector == ct.selector)
+	if !equalSlice(t.DestIPs, ct.destIPs) && !selected {
+		return false
+	}
+	if len(t.Ranges) > 0 || len(ct.ranges) > 0 {
+		if !equalRanges(t.Ranges, ct.ranges) {
+			return false
+		}
+	} else if !equalSlice(t.DispatchFiles, ct.dispatchFiles) {
+		return false
+	}
+	return equalSlice(t.Seeders, ct.seeders)
+}
+
+// 所有Agent结束后按成功条件确定任务的结果，失败时返回原因
+func checkFinished(ti *TaskInfo) (TaskStatus, string, bool) {
 	completed := 0
 	failed := 0
+	required, requiredDone := 0, 0 // 不包括可选的Agent
+	policy := ti.SuccessPercent > 0
 	for _, v := range ti.DispatchInfos {
-		if v.Status == TaskStatus_Completed.String() {
+		done := v.Status == TaskStatus_Completed.String()
+		if done {
 			completed++
 		}
 		if v.Status == TaskStatus_Failed.String() {
 			failed++
 		}
+		if v.Optional {
+			policy = true
+			continue
+		}
+		required++
+		if done {
+			requiredDone++
+		}
 	}
 
 	count := len(ti.DispatchInfos)
-	if completed == count {
-		return TaskStatus_Completed, true
+	if completed+failed != count {
+		return TaskStatus_InProgress, "", false
 	}
-
-	if completed+failed == count {
-		return TaskStatus_Completed, true
+	if !policy {
+		return TaskStatus_Completed, "", true
 	}
 
-	return TaskStatus_InProgress, false
+	percent := ti.SuccessPercent
+	if percent == 0 {
+		percent = 100
+	}
+	if requiredDone*100 < percent*required {
+		return TaskStatus_Failed, fmt.Sprintf("%d of %d required agents completed, %d%% required", requiredDone, required, percent), true
+	}
+	return TaskStatus_Completed, "", true
 }
 
+// 不区分顺序
 func equalSlice(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
 	}
-	for _, i := range a {
-		for _, j := range b {
-			if i != j {
-				return false
-			}
+	counts := make(map[string]int, len(a))
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		if counts[s]--; counts[s] < 0 {
+			return false
 		}
 	}
 	return true
 }
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func equalRanges(a, b []*p2p.FileRange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 客户端没有指定任务ID时生成，重复提交不能识别为同一任务
+func newTaskId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%d-%x", time.Now().Unix(), b)
+}
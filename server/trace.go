@@ -0,0 +1,35 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/xtfly/gofd/common"
+)
+
+var errAgentTimeout = errors.New("Agent heartbeat timeout")
+
+// 任务每次运行时开始新的追踪，任务结束或被抢占时结束。Agent上的Span都是其子Span
+func (ct *CachedTaskInfo) startSpan() {
+	ct.endSpan()
+	ct.span = common.StartSpan(nil, "task", "task.id", ct.id, "task.agents", len(ct.destIPs), "task.seeders", len(ct.seeders))
+}
+
+func (ct *CachedTaskInfo) endSpan() {
+	if ct.span == nil {
+		return
+	}
+	ct.span.SetAttributes("task.status", ct.ti.Status, "task.succeeded", ct.succCount, "task.failed", ct.failCount)
+	if ct.ti.Error != "" {
+		ct.span.SetError(errors.New(ct.ti.Error))
+	}
+	ct.span.End()
+	ct.span = nil
+}
+
+// 随任务下发给Agent的追踪上下文
+func (ct *CachedTaskInfo) traceParent() string {
+	if ct.span == nil {
+		return ""
+	}
+	return ct.span.TraceParent()
+}
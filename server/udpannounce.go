@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/xtfly/gofd/common"
+	"github.com/xtfly/gofd/p2p"
+)
+
+// 配置了Net.AnnouncePort时，通过UDP接收Agent的状态上报，一个报文一次上报，
+// Agent很多时减少HTTP连接的开销。响应超过报文的上限或不能处理时让Agent改用HTTP，
+// 改用HTTP后同一上报会被处理两次，状态的更新是幂等的
+func (s *Server) listenAnnounce() error {
+	addr := common.JoinHostPort(s.Cfg.Net.IP, s.Cfg.Net.AnnouncePort)
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.announceConn = conn
+	s.Log.Infof("Listen udp announce on %s", addr)
+	go s.serveAnnounce(conn)
+	return nil
+}
+
+func (s *Server) serveAnnounce(conn net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		typ, txid, payload, err := p2p.DecodeAnnouncePacket(s.Cfg, buf[:n])
+		if err != nil || typ != p2p.UDP_ANNOUNCE_REQUEST {
+			s.Log.Debugf("Drop udp announce from %v, error=%v", addr, err)
+			continue
+		}
+		// 任务的上报队列满时不阻塞读取
+		go s.handleAnnounce(conn, addr, txid, append([]byte(nil), payload...))
+	}
+}
+
+func (s *Server) handleAnnounce(conn net.PacketConn, addr net.Addr, txid uint32, body []byte) {
+	typ, rsp := byte(p2p.UDP_ANNOUNCE_HTTP), []byte(nil)
+	csr := new(p2p.StatusReport)
+	if err := json.Unmarshal(body, csr); err != nil {
+		s.Log.Errorf("Recv udp announce from %v, decode body failed. %v", addr, err)
+	} else if ar, code, _ := s.reportTask(csr); code == http.StatusOK {
+		typ = p2p.UDP_ANNOUNCE_RESPONSE
+		if ar != nil {
+			if rsp, err = json.Marshal(ar); err != nil || len(rsp) > p2p.UDP_ANNOUNCE_MAX_PAYLOAD {
+				typ, rsp = p2p.UDP_ANNOUNCE_HTTP, nil
+			}
+		}
+	}
+	if _, err := conn.WriteTo(p2p.EncodeAnnouncePacket(s.Cfg, typ, txid, rsp), addr); err != nil {
+		s.Log.Warnf("Send udp announce response to %v failed, error=%v", addr, err)
+	}
+}
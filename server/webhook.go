@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/xtfly/gofd/common"
+)
+
+const (
+	WEBHOOK_TASK_STARTED    = "task.started"
+	WEBHOOK_AGENT_COMPLETED = "agent.completed"
+	WEBHOOK_FILE_COMPLETED  = "file.completed"
+	WEBHOOK_TASK_COMPLETED  = "task.completed"
+	WEBHOOK_TASK_FAILED     = "task.failed"
+	WEBHOOK_TASK_CANCELED   = "task.canceled"
+	WEBHOOK_TASK_PAUSED     = "task.paused"
+	WEBHOOK_TASK_RESUMED    = "task.resumed"
+
+	// 回调失败时的重试次数
+	MAX_WEBHOOK_RETRIES = 3
+)
+
+// 回调的事件
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	TaskId    string    `json:"taskId"`
+	Status    string    `json:"status"`
+	IP        string    `json:"ip,omitempty"`        // agent.completed与file.completed时为完成的Agent
+	File      string    `json:"file,omitempty"`      // file.completed时为Agent上下载完成并校验通过的文件
+	FailedIPs []string  `json:"failedIPs,omitempty"` // task.completed与task.failed时下载失败的Agent
+	Time      time.Time `json:"time"`
+}
+
+type webhookCall struct {
+	urls  []string
+	event *WebhookEvent
+}
+
+// 按顺序发送回调，在单独的Goroutine中执行，不阻塞任务处理
+type webhooker struct {
+	client *http.Client
+	global []string // 所有任务的回调地址
+	queue  chan *webhookCall
+	log    common.Logger
+}
+
+func newWebhooker(global []string, l common.Logger) *webhooker {
+	w := &webhooker{
+		client: &http.Client{Timeout: 5 * time.Second},
+		global: global,
+		queue:  make(chan *webhookCall, 100),
+		log:    l,
+	}
+	go w.run()
+	return w
+}
+
+func (w *webhooker) notify(urls []string, e *WebhookEvent) {
+	all := append(append([]string{}, w.global...), urls...)
+	if len(all) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	select {
+	case w.queue <- &webhookCall{urls: all, event: e}:
+	default:
+		w.log.With("taskID", e.TaskId).Errorf("Webhook queue is full, drop event %s", e.Event)
+	}
+}
+
+func (w *webhooker) run() {
+	for c := range w.queue {
+		body, err := json.Marshal(c.event)
+		if err != nil {
+			continue
+		}
+		for _, url := range c.urls {
+			w.post(url, c.event, body)
+		}
+	}
+}
+
+func (w *webhooker) post(url string, e *WebhookEvent, body []byte) {
+	backoff := time.Second
+	for retry := 0; ; retry++ {
+		err := w.postOnce(url, body)
+		if err == nil {
+			w.log.With("taskID", e.TaskId).Debugf("Send webhook %s to %s", e.Event, url)
+			return
+		}
+		if retry >= MAX_WEBHOOK_RETRIES {
+			w.log.With("taskID", e.TaskId).Errorf("Send webhook %s to %s failed. error=%v", e.Event, url, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *webhooker) postOnce(url string, body []byte) error {
+	rsp, err := w.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		return fmt.Errorf("Recv http status code %v", rsp.StatusCode)
+	}
+	return nil
+}